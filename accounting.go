@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Accounting imports: QuickBooks Online and Xero transaction exports (CSV) are summed per W/E week
+// and written into the company's designated income (GI) and expenses stats, replacing the value
+// for each week the file covers. The designated stats are kept in accounting_mappings.
+
+var accountingKinds = map[string]bool{"income": true, "expenses": true}
+
+// Default transaction types per kind when the export has a type column.
+var accountingDefaultTypes = map[string][]string{
+	"income":   {"invoice", "sales receipt", "accrec", "receive money"},
+	"expenses": {"expense", "bill", "check", "cheque", "accpay", "spend money", "credit card expense"},
+}
+
+// ---------- GET /api/import/accounting/mappings ----------
+func GetAccountingMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`
+		SELECT m.kind, m.stat_id, s.short_id
+		FROM accounting_mappings m JOIN stats s ON s.id = m.stat_id
+		WHERE m.company_id = ?
+		ORDER BY m.kind
+	`, companyDBID)
+	if err != nil {
+		webFail("Failed to query accounting mappings", w, err)
+		return
+	}
+	defer rows.Close()
+
+	type mapping struct {
+		Kind    string `json:"kind"`
+		StatID  int    `json:"stat_id"`
+		ShortID string `json:"short_id"`
+	}
+	out := []mapping{}
+	for rows.Next() {
+		var m mapping
+		if err := rows.Scan(&m.Kind, &m.StatID, &m.ShortID); err != nil {
+			webFail("Failed to scan accounting mapping", w, err)
+			return
+		}
+		out = append(out, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- PUT /api/import/accounting/mappings ----------
+// Body: { "income": <stat_id|null>, "expenses": <stat_id|null> }
+func UpdateAccountingMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]*int
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	for kind, statID := range req {
+		if !accountingKinds[kind] {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf(`{"message":"unknown kind %q (use income or expenses)"}`, kind), http.StatusBadRequest)
+			return
+		}
+		if statID == nil {
+			if _, err := tx.Exec(`DELETE FROM accounting_mappings WHERE company_id = ? AND kind = ?`, companyDBID, kind); err != nil {
+				tx.Rollback()
+				webFail("Failed to clear accounting mapping", w, err)
+				return
+			}
+			continue
+		}
+		var valueType string
+		var isCalculated bool
+		if err := tx.QueryRow(`SELECT value_type, is_calculated FROM stats WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, *statID, companyDBID).Scan(&valueType, &isCalculated); err != nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d not found"}`, *statID), http.StatusBadRequest)
+			return
+		}
+		if valueType != "currency" || isCalculated {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d must be a non-calculated currency stat"}`, *statID), http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO accounting_mappings (company_id, kind, stat_id) VALUES (?, ?, ?)
+			ON CONFLICT(company_id, kind) DO UPDATE SET stat_id = excluded.stat_id
+		`, companyDBID, kind, *statID); err != nil {
+			tx.Rollback()
+			webFail("Failed to save accounting mapping", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit accounting mappings", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Accounting mappings saved"})
+}
+
+// ---------- POST /api/import/accounting?kind=income|expenses&source=quickbooks|xero[&date_format=mdy|dmy|ymd][&dry_run=1][&reason=...] ----------
+// Accepts the CSV export either as the raw request body or as a multipart "file" field.
+// Rows are grouped by W/E and each week's total replaces the designated stat's weekly value. When the
+// company locks logged values, weeks that would change are rejected unless a reason is given.
+func ImportAccountingHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if !accountingKinds[kind] {
+		http.Error(w, `{"message":"kind must be income or expenses"}`, http.StatusBadRequest)
+		return
+	}
+	source := strings.ToLower(q.Get("source"))
+	if source == "" {
+		source = "quickbooks"
+	}
+	if source != "quickbooks" && source != "xero" {
+		http.Error(w, `{"message":"source must be quickbooks or xero"}`, http.StatusBadRequest)
+		return
+	}
+	dateFormat := q.Get("date_format")
+	if dateFormat == "" {
+		dateFormat = "mdy"
+		if source == "xero" {
+			dateFormat = "dmy"
+		}
+	}
+	dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+	reason := strings.TrimSpace(q.Get("reason"))
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var statID int
+	if err := DB.QueryRow(`
+		SELECT m.stat_id FROM accounting_mappings m JOIN stats s ON s.id = m.stat_id
+		WHERE m.company_id = ? AND m.kind = ? AND s.company_id = m.company_id AND s.deleted_at IS NULL
+	`, companyDBID, kind).Scan(&statID); err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":"no stat is designated for %s; set it via /api/import/accounting/mappings"}`, kind), http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, `{"message":"multipart upload must include a file field"}`, http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	currency := statCurrency(statID)
+	totals, skipped, err := sumAccountingCSV(body, kind, dateFormat, currency, requestWeekEndingDay(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	type weekResult struct {
+		Weekending string `json:"Weekending"`
+		Total      string `json:"total"`
+		Previous   string `json:"previous,omitempty"`
+		Action     string `json:"action"`
+		Error      string `json:"error,omitempty"`
+	}
+	weeks := make([]string, 0, len(totals))
+	for we := range totals {
+		weeks = append(weeks, we)
+	}
+	sort.Strings(weeks)
+
+	authorID := r.Context().Value("user_id")
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	results := []weekResult{}
+	for _, we := range weeks {
+		res := weekResult{Weekending: we, Total: formatStatValue(totals[we], "currency", currency)}
+		if err := checkWeeklyRules(tx, statID, we, totals[we], "currency", false); err != nil {
+			if v, ok := err.(*ruleViolation); ok {
+				res.Action, res.Error = "rejected", v.Message
+				results = append(results, res)
+				continue
+			}
+			webFail("Failed to check validation rules", w, err)
+			return
+		}
+		var existingID, existingVal int64
+		err := tx.QueryRow(`SELECT id, value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, statID, we).Scan(&existingID, &existingVal)
+		switch {
+		case err == sql.ErrNoRows:
+			res.Action = "insert"
+			if !dryRun {
+				_, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, author_user_id, submitted_at) VALUES (?, ?, ?, ?, ?)`,
+					statID, we, totals[we], authorID, time.Now().UTC().Format(time.RFC3339))
+			} else {
+				err = nil
+			}
+		case err == nil:
+			res.Previous = formatStatValue(existingVal, "currency", currency)
+			res.Action = "unchanged"
+			if existingVal != totals[we] {
+				if verr := checkEditReason(tx, statID, reason); verr != nil {
+					if v, ok := verr.(*ruleViolation); ok {
+						res.Action, res.Error = "rejected", v.Message
+						results = append(results, res)
+						continue
+					}
+					webFail("Failed to check edit reason", w, verr)
+					return
+				}
+				res.Action = "update"
+				if !dryRun {
+					_, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, author_user_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+						totals[we], authorID, time.Now().UTC().Format(time.RFC3339), existingID)
+					if err == nil {
+						err = recordEditReason(tx, statID, we, reason)
+					}
+				}
+			}
+		}
+		if err == nil && !dryRun && res.Action != "unchanged" {
+			detail := map[string]string{"source": source, "old": res.Previous, "new": res.Total}
+			if res.Action == "update" && reason != "" {
+				detail["reason"] = reason
+			}
+			err = logActivity(tx, authorID, activityValueImported, statID, we, detail)
+		}
+		if err != nil {
+			webFail("Failed to write imported week "+we, w, err)
+			return
+		}
+		results = append(results, res)
+	}
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			webFail("Failed to commit accounting import", w, err)
+			return
+		}
+		log.Printf("Imported %s %s totals for %d weeks into stat %d", source, kind, len(results), statID)
+		for _, res := range results {
+			if res.Action == "insert" || res.Action == "update" {
+				publishStatEvent(liveEvent{Type: eventStatWritten, StatID: statID, WeekEnding: res.Weekending})
+				if err := enqueueRecalc(DB, statID, res.Weekending); err != nil {
+					log.Printf("Failed to queue recalculation of stats depending on %d: %v", statID, err)
+				}
+				if err := markAggregatesDirty(DB, statID, res.Weekending); err != nil {
+					log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat_id":      statID,
+		"dry_run":      dryRun,
+		"weeks":        results,
+		"skipped_rows": skipped,
+	})
+}
+
+// sumAccountingCSV totals the amount column per W/E week (in the minor units of currency). It finds
+// the date, amount and optional transaction-type columns by header name, skipping preamble and total
+// lines.
+func sumAccountingCSV(r io.Reader, kind, dateFormat, currency string, weekday time.Weekday) (map[string]int64, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	dateCol, amountCol, typeCol := -1, -1, -1
+	totals := map[string]int64{}
+	skipped := 0
+	allowed := map[string]bool{}
+	for _, t := range accountingDefaultTypes[kind] {
+		allowed[t] = true
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid CSV: %v", err)
+		}
+
+		if dateCol < 0 {
+			// QuickBooks reports start with a title block; keep scanning until the header row.
+			for i, h := range rec {
+				switch strings.ToLower(strings.TrimSpace(h)) {
+				case "date", "invoicedate", "invoice date", "transaction date", "txn date":
+					if dateCol < 0 {
+						dateCol = i
+					}
+				case "amount", "total", "gross", "total amount", "amount (usd)":
+					if amountCol < 0 {
+						amountCol = i
+					}
+				case "transaction type", "type", "source type":
+					typeCol = i
+				}
+			}
+			if dateCol < 0 || amountCol < 0 {
+				dateCol, amountCol, typeCol = -1, -1, -1
+			}
+			continue
+		}
+
+		if dateCol >= len(rec) || amountCol >= len(rec) {
+			skipped++
+			continue
+		}
+		d, err := parseAccountingDate(rec[dateCol], dateFormat)
+		if err != nil {
+			skipped++ // subtotal/blank lines
+			continue
+		}
+		if typeCol >= 0 && typeCol < len(rec) {
+			if t := strings.ToLower(strings.TrimSpace(rec[typeCol])); t != "" && !allowed[t] {
+				skipped++
+				continue
+			}
+		}
+		amount, err := parseAccountingAmount(rec[amountCol], currency)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if kind == "expenses" && amount < 0 {
+			amount = -amount // some exports show money out as negative
+		}
+		totals[currentWeekEnding(d, weekday)] += amount
+	}
+	if dateCol < 0 {
+		return nil, 0, fmt.Errorf("could not find date and amount columns in CSV header")
+	}
+	return totals, skipped, nil
+}
+
+func parseAccountingDate(s, format string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	layouts := map[string][]string{
+		"mdy": {"01/02/2006", "1/2/2006", "01/02/06", "1/2/06"},
+		"dmy": {"02/01/2006", "2/1/2006", "02 Jan 2006", "2 Jan 2006", "02/01/06"},
+		"ymd": {"2006/01/02", "2006-1-2"},
+	}
+	for _, l := range layouts[format] {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", s)
+}
+
+// parseAccountingAmount parses "$1,234.56", "(12.00)" or "-12.00" into the minor units of currency.
+func parseAccountingAmount(s, currency string) (int64, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		neg = true
+		s = s[1 : len(s)-1]
+	}
+	s = strings.NewReplacer("$", "", ",", "", " ", "").Replace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty amount")
+	}
+	v, err := parseStatValue(s, "currency", currency)
+	if neg {
+		v = -v
+	}
+	return v, err
+}
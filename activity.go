@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Activity log: one row per data change (values entered or edited, quotas set, stats created,
+// reassigned, archived, unarchived, deleted, restored or purged) so reviewers can see why a graph moved. stat_id is not a foreign key and
+// the short id is copied so entries outlive the stat they describe.
+
+const (
+	activityValueEntered   = "value_entered"
+	activityValueEdited    = "value_edited"
+	activityValueImported  = "value_imported"
+	activityValueAdjusted  = "value_adjusted"
+	activityDailySaved     = "daily_values_saved"
+	activityQuotaChanged   = "quota_changed"
+	activityStatCreated    = "stat_created"
+	activityStatUpdated    = "stat_updated"
+	activityStatReassigned = "stat_reassigned"
+	activityStatDeleted    = "stat_deleted"
+	activityStatArchived   = "stat_archived"
+	activityStatUnarchived = "stat_unarchived"
+	activityStatRestored   = "stat_restored"
+	activityStatPurged     = "stat_purged"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// logActivity records a change to a stat. The company and short id are taken from the stat, so
+// it must be called before a stat is deleted. detail is stored as JSON.
+func logActivity(ex execer, userID interface{}, action string, statID int, weekEnding string, detail interface{}) error {
+	var detailJSON interface{}
+	if detail != nil {
+		b, err := json.Marshal(detail)
+		if err != nil {
+			return err
+		}
+		detailJSON = string(b)
+	}
+	_, err := ex.Exec(`
+		INSERT INTO activity_log (company_id, user_id, action, stat_id, stat_short_id, week_ending, detail, created_at)
+		SELECT company_id, ?, ?, id, short_id, ?, ?, ? FROM stats WHERE id = ?
+	`, userID, action, nullIfEmpty(weekEnding), detailJSON, time.Now().UTC().Format(time.RFC3339), statID)
+	return err
+}
+
+type activityEntry struct {
+	ID          int             `json:"id"`
+	Action      string          `json:"action"`
+	StatID      *int            `json:"stat_id,omitempty"`
+	StatShortID string          `json:"stat_short_id,omitempty"`
+	WeekEnding  string          `json:"week_ending,omitempty"`
+	UserID      *int            `json:"user_id,omitempty"`
+	Username    string          `json:"username,omitempty"`
+	Detail      json.RawMessage `json:"detail,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+}
+
+// ---------- GET /api/changes?week=YYYY-MM-DD | ?since=<cursor> ----------
+// Everything that happened to the week: changes to its values and quotas, plus any structural
+// change (stats created, reassigned, deleted) made during the seven days ending on the W/E date.
+// With since, polling clients instead get the current state of what changed after the cursor
+// (see changes.go).
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if since := r.URL.Query().Get("since"); since != "" {
+		companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+		if err != nil {
+			webFail("Failed to resolve company", w, err)
+			return
+		}
+		writeChangesSince(w, companyDBID, since)
+		return
+	}
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	we, _ := time.Parse("2006-01-02", week)
+	from := we.AddDate(0, 0, -6).Format("2006-01-02")
+
+	rows, err := DB.Query(`
+		SELECT a.id, a.action, a.stat_id, COALESCE(a.stat_short_id, ''), COALESCE(a.week_ending, ''),
+		       a.user_id, COALESCE(u.username, ''), a.detail, a.created_at
+		FROM activity_log a LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.company_id = ? AND (a.week_ending = ? OR substr(a.created_at, 1, 10) BETWEEN ? AND ?)
+		ORDER BY a.created_at, a.id
+	`, companyDBID, week, from, week)
+	if err != nil {
+		webFail("Failed to query activity", w, err)
+		return
+	}
+	defer rows.Close()
+
+	changes := []activityEntry{}
+	summary := map[string]int{}
+	authors := map[string]int{}
+	for rows.Next() {
+		e, err := scanActivity(rows)
+		if err != nil {
+			webFail("Failed to scan activity", w, err)
+			return
+		}
+		changes = append(changes, e)
+		summary[e.Action]++
+		if e.Username != "" {
+			authors[e.Username]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		webFail("Failed to read activity", w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week_ending": week,
+		"from":        from,
+		"summary":     summary,
+		"authors":     authors,
+		"changes":     changes,
+	})
+}
+
+func scanActivity(rows *sql.Rows) (activityEntry, error) {
+	var e activityEntry
+	var statID, userID sql.NullInt64
+	var detail sql.NullString
+	if err := rows.Scan(&e.ID, &e.Action, &statID, &e.StatShortID, &e.WeekEnding, &userID, &e.Username, &detail, &e.CreatedAt); err != nil {
+		return e, err
+	}
+	if statID.Valid {
+		id := int(statID.Int64)
+		e.StatID = &id
+	}
+	if userID.Valid {
+		id := int(userID.Int64)
+		e.UserID = &id
+	}
+	if detail.Valid {
+		e.Detail = json.RawMessage(detail.String)
+	}
+	return e, nil
+}
+
+// nullInt64Value returns the int value of v, or nil when NULL, comparable with nullIntPtr.
+func nullInt64Value(v sql.NullInt64) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return int(v.Int64)
+}
+
+// nullStringValue returns the string value of v, or nil when NULL.
+func nullStringValue(v sql.NullString) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
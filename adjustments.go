@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Adjustments correct a week after its deadline without rewriting what was reported: each one is a
+// signed amount with a reason and author, added on top of the original weekly_stats value. Open
+// and due weeks are still edited directly. The stat series returns both totals.
+
+type weeklyAdjustment struct {
+	ID         int    `json:"id"`
+	WeekEnding string `json:"week_ending"`
+	Amount     string `json:"amount"`
+	Reason     string `json:"reason"`
+	AuthorID   int    `json:"author_user_id"`
+	Author     string `json:"author"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// parseSignedValue is parseStatValue for amounts that may be negative.
+func parseSignedValue(raw, valueType, currency string) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	sign := int64(1)
+	if strings.HasPrefix(raw, "-") {
+		sign = -1
+		raw = raw[1:]
+	} else {
+		raw = strings.TrimPrefix(raw, "+")
+	}
+	v, err := parseStatValue(raw, valueType, currency)
+	return sign * v, err
+}
+
+// ---------- POST /api/stats/{id}/adjustments ----------
+// Body: {"week_ending": "2024-01-04", "amount": "-120.00", "reason": "Refund posted late"}
+func CreateAdjustmentHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatAccess(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var req struct {
+		WeekEnding string `json:"week_ending"`
+		Amount     string `json:"amount"`
+		Reason     string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, `{"message":"A reason is required"}`, http.StatusBadRequest)
+		return
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), req.WeekEnding); err != nil {
+		http.Error(w, `{"message":"week_ending must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyID := r.Context().Value("company_id").(string)
+	loc := companyLocation(companyID)
+	if weekState(req.WeekEnding, loc, time.Now().In(loc)) != "locked" {
+		http.Error(w, `{"message":"Only weeks past their deadline can be adjusted; edit the value instead"}`, http.StatusConflict)
+		return
+	}
+
+	var valueType string
+	var calculated bool
+	if err := DB.QueryRow(`SELECT value_type, is_calculated FROM stats WHERE id = ?`, statID).Scan(&valueType, &calculated); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	if calculated {
+		http.Error(w, `{"message":"Calculated stats cannot be adjusted"}`, http.StatusBadRequest)
+		return
+	}
+	currency := statCurrency(statID)
+	amount, err := parseSignedValue(normalizeNumber(req.Amount, requestLocale(r), statInputPlaces(statID)), valueType, currency)
+	if err != nil || amount == 0 {
+		http.Error(w, `{"message":"amount must be a non-zero value"}`, http.StatusBadRequest)
+		return
+	}
+	var original int64
+	if err := DB.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, statID, req.WeekEnding).Scan(&original); err == sql.ErrNoRows {
+		http.Error(w, `{"message":"There is no value to adjust for that week"}`, http.StatusConflict)
+		return
+	} else if err != nil {
+		webFail("Failed to load weekly value", w, err)
+		return
+	}
+
+	authorID := r.Context().Value("user_id")
+	now := time.Now().UTC().Format(time.RFC3339)
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		INSERT INTO weekly_adjustments (stat_id, week_ending, amount, reason, author_user_id, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, statID, req.WeekEnding, amount, req.Reason, authorID, now)
+	if err != nil {
+		webFail("Failed to save adjustment", w, err)
+		return
+	}
+	var adjusted int64
+	if err := tx.QueryRow(`SELECT ? + SUM(amount) FROM weekly_adjustments WHERE stat_id = ? AND week_ending = ?`, original, statID, req.WeekEnding).Scan(&adjusted); err != nil {
+		webFail("Failed to total adjustments", w, err)
+		return
+	}
+	if err := logActivity(tx, authorID, activityValueAdjusted, statID, req.WeekEnding, map[string]string{
+		"amount":   formatStatValue(amount, valueType, currency),
+		"reason":   req.Reason,
+		"adjusted": formatStatValue(adjusted, valueType, currency),
+	}); err != nil {
+		webFail("Failed to log adjustment", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit adjustment", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       id,
+		"original": formatStatValue(original, valueType, currency),
+		"adjusted": formatStatValue(adjusted, valueType, currency),
+	})
+}
+
+// ---------- GET /api/stats/{id}/adjustments?week=YYYY-MM-DD ----------
+// All of a stat's adjustments, newest first; week narrows to one week.
+func ListAdjustmentsHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var valueType string
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ?`, statID).Scan(&valueType); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	currency := statCurrency(statID)
+	query := `
+		SELECT a.id, a.week_ending, a.amount, a.reason, a.author_user_id, COALESCE(u.username, ''), a.created_at
+		FROM weekly_adjustments a LEFT JOIN users u ON u.id = a.author_user_id
+		WHERE a.stat_id = ?`
+	args := []interface{}{statID}
+	if week := r.URL.Query().Get("week"); week != "" {
+		query += ` AND a.week_ending = ?`
+		args = append(args, week)
+	}
+	rows, err := DB.Query(query+` ORDER BY a.id DESC`, args...)
+	if err != nil {
+		webFail("Failed to query adjustments", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []weeklyAdjustment{}
+	for rows.Next() {
+		var a weeklyAdjustment
+		var amount int64
+		if err := rows.Scan(&a.ID, &a.WeekEnding, &amount, &a.Reason, &a.AuthorID, &a.Author, &a.CreatedAt); err != nil {
+			webFail("Failed to scan adjustments", w, err)
+			return
+		}
+		a.Amount = formatStatValue(amount, valueType, currency)
+		out = append(out, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Materialized dashboard aggregates: division_week_aggregates holds one row per company, division
+// (0 = unassigned), week and value type (and currency, for currency stats, so amounts in different
+// currencies are never added up) with the counts the dashboards show. Writes mark the
+// (company, week) dirty in aggregate_dirty — and the following week, whose trend compares against
+// it — and a background job rebuilds dirty weeks. Readers rebuild any dirty week they ask for
+// first, so they never see stale rows.
+//
+// Totals only sum stats that are not calculated, since calculated stats are already the sum of
+// others and would be counted twice.
+
+type divisionAggregate struct {
+	DivisionID    int    `json:"division_id"`
+	DivisionName  string `json:"division_name"`
+	WeekEnding    string `json:"week_ending"`
+	WeekLabel     string `json:"week_label"`
+	ValueType     string `json:"value_type"`
+	Currency      string `json:"currency,omitempty"`
+	StatCount     int    `json:"stat_count"`
+	ReportedCount int    `json:"reported_count"`
+	QuotaCount    int    `json:"quota_count"`
+	QuotaMetCount int    `json:"quota_met_count"`
+	Up            int    `json:"up"`
+	Down          int    `json:"down"`
+	Level         int    `json:"level"`
+	Total         int64  `json:"-"`
+	TotalDisplay  string `json:"total"`
+	YTDTotal      string `json:"ytd_total,omitempty"` // fiscal year to date, with ?ytd=1
+}
+
+var aggregateWake = make(chan struct{}, 1)
+
+// markAggregatesDirty flags the stat's company for rebuild at week and the week after.
+func markAggregatesDirty(ex execer, statID int, week string) error {
+	next := week
+	if t, err := time.Parse("2006-01-02", week); err == nil {
+		next = t.AddDate(0, 0, 7).Format("2006-01-02")
+	}
+	_, err := ex.Exec(`
+		INSERT OR IGNORE INTO aggregate_dirty (company_id, week_ending)
+		SELECT company_id, ? FROM stats WHERE id = ? AND company_id IS NOT NULL
+		UNION SELECT company_id, ? FROM stats WHERE id = ? AND company_id IS NOT NULL
+	`, week, statID, next, statID)
+	if err == nil {
+		select {
+		case aggregateWake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// markCompanyAggregatesDirty flags every week the company has data or aggregates for; used after
+// structural changes (stats created, moved between divisions or deleted).
+func markCompanyAggregatesDirty(ex execer, companyDBID int) error {
+	_, err := ex.Exec(`
+		INSERT OR IGNORE INTO aggregate_dirty (company_id, week_ending)
+		SELECT ?, w.week_ending FROM weekly_stats w JOIN stats s ON s.id = w.stat_id WHERE s.company_id = ?
+		UNION SELECT ?, week_ending FROM division_week_aggregates WHERE company_id = ?
+	`, companyDBID, companyDBID, companyDBID, companyDBID)
+	if err == nil {
+		select {
+		case aggregateWake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// markStatCompanyAggregatesDirty is markCompanyAggregatesDirty for the company owning statID.
+func markStatCompanyAggregatesDirty(statID int) error {
+	var companyDBID sql.NullInt64
+	if err := DB.QueryRow(`SELECT company_id FROM stats WHERE id = ?`, statID).Scan(&companyDBID); err != nil || !companyDBID.Valid {
+		return err
+	}
+	return markCompanyAggregatesDirty(DB, int(companyDBID.Int64))
+}
+
+// StartAggregateJob rebuilds dirty weeks in the background. On startup it also queues weeks that
+// have data but were never aggregated, so existing databases backfill themselves.
+func StartAggregateJob() {
+	if _, err := DB.Exec(`
+		INSERT OR IGNORE INTO aggregate_dirty (company_id, week_ending)
+		SELECT DISTINCT s.company_id, w.week_ending FROM weekly_stats w JOIN stats s ON s.id = w.stat_id
+		WHERE s.company_id IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM division_week_aggregates a WHERE a.company_id = s.company_id AND a.week_ending = w.week_ending)
+	`); err != nil {
+		log.Printf("Aggregate backfill failed: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			rebuildDirtyAggregates(0, nil)
+			select {
+			case <-ticker.C:
+			case <-aggregateWake:
+			}
+		}
+	}()
+}
+
+// rebuildDirtyAggregates rebuilds dirty weeks, limited to one company and set of weeks when given.
+func rebuildDirtyAggregates(companyDBID int, weeks []string) error {
+	q := `SELECT company_id, week_ending FROM aggregate_dirty`
+	var args []interface{}
+	if companyDBID != 0 {
+		q += ` WHERE company_id = ?`
+		args = append(args, companyDBID)
+		if len(weeks) > 0 {
+			q += ` AND week_ending IN (?` + strings.Repeat(",?", len(weeks)-1) + `)`
+			for _, we := range weeks {
+				args = append(args, we)
+			}
+		}
+	}
+	rows, err := DB.Query(q+` LIMIT 500`, args...)
+	if err != nil {
+		return err
+	}
+	type key struct {
+		company int
+		week    string
+	}
+	var dirty []key
+	for rows.Next() {
+		var k key
+		if err := rows.Scan(&k.company, &k.week); err != nil {
+			rows.Close()
+			return err
+		}
+		dirty = append(dirty, k)
+	}
+	rows.Close()
+
+	for _, k := range dirty {
+		// Clear the mark first: a write during the rebuild marks the week again.
+		if _, err := DB.Exec(`DELETE FROM aggregate_dirty WHERE company_id = ? AND week_ending = ?`, k.company, k.week); err != nil {
+			return err
+		}
+		if err := rebuildWeekAggregates(k.company, k.week); err != nil {
+			log.Printf("Aggregate rebuild for company %d W/E %s failed: %v", k.company, k.week, err)
+			DB.Exec(`INSERT OR IGNORE INTO aggregate_dirty (company_id, week_ending) VALUES (?, ?)`, k.company, k.week)
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildWeekAggregates recomputes one company's aggregate rows for a week.
+func rebuildWeekAggregates(companyDBID int, week string) error {
+	prevWeek := week
+	if t, err := time.Parse("2006-01-02", week); err == nil {
+		prevWeek = t.AddDate(0, 0, -7).Format("2006-01-02")
+	}
+	rows, err := DB.Query(`
+		SELECT COALESCE(s.assigned_division_id, 0), s.value_type,
+		       CASE WHEN s.value_type = 'currency' THEN COALESCE(s.currency, cs.default_currency, ?) ELSE '' END,
+		       s.reversed, s.is_calculated,
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT value FROM stat_quotas WHERE stat_id = s.id AND week_ending = ?)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id
+		WHERE s.company_id = ? AND s.deleted_at IS NULL
+	`, defaultCurrency, week, prevWeek, week, companyDBID)
+	if err != nil {
+		return err
+	}
+	type aggKey struct {
+		div       int
+		valueType string
+		currency  string
+	}
+	aggs := map[aggKey]*divisionAggregate{}
+	var order []aggKey
+	for rows.Next() {
+		var k aggKey
+		var reversed, calculated bool
+		var cur, prev, quota sql.NullInt64
+		if err := rows.Scan(&k.div, &k.valueType, &k.currency, &reversed, &calculated, &cur, &prev, &quota); err != nil {
+			rows.Close()
+			return err
+		}
+		a := aggs[k]
+		if a == nil {
+			a = &divisionAggregate{DivisionID: k.div, ValueType: k.valueType, Currency: k.currency}
+			aggs[k] = a
+			order = append(order, k)
+		}
+		a.StatCount++
+		if !cur.Valid {
+			continue
+		}
+		a.ReportedCount++
+		if !calculated {
+			a.Total += cur.Int64
+		}
+		if quota.Valid {
+			a.QuotaCount++
+			if quotaMet(cur.Int64, quota.Int64, reversed) {
+				a.QuotaMetCount++
+			}
+		}
+		if prev.Valid {
+			switch {
+			case cur.Int64 == prev.Int64:
+				a.Level++
+			case (cur.Int64 > prev.Int64) != reversed:
+				a.Up++
+			default:
+				a.Down++
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM division_week_aggregates WHERE company_id = ? AND week_ending = ?`, companyDBID, week); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, k := range order {
+		a := aggs[k]
+		if _, err := tx.Exec(`
+			INSERT INTO division_week_aggregates (company_id, division_id, week_ending, value_type, currency, stat_count, reported_count,
+				quota_count, quota_met_count, up_count, down_count, level_count, total, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, companyDBID, a.DivisionID, week, a.ValueType, a.Currency, a.StatCount, a.ReportedCount, a.QuotaCount, a.QuotaMetCount,
+			a.Up, a.Down, a.Level, a.Total, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ---------- GET /api/dashboard/divisions?week=YYYY-MM-DD&weeks=12&ytd=1 ----------
+// Per-division weekly aggregates for the weeks ending at week, read from division_week_aggregates.
+// ytd=1 adds each row's fiscal year-to-date total (see fiscal.go).
+func DivisionAggregatesHandler(w http.ResponseWriter, r *http.Request) {
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	n := 1
+	if v := r.URL.Query().Get("weeks"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > 104 {
+			http.Error(w, `{"message":"weeks must be between 1 and 104"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	weeks, err := lastWeekEndings(week, n)
+	if err != nil {
+		webFail("Failed to compute weeks", w, err)
+		return
+	}
+	fiscal := companyFiscal(companyDBID)
+	ytd, _ := strconv.ParseBool(r.URL.Query().Get("ytd"))
+	refresh := weeks
+	if ytd {
+		// Year-to-date sums need every week back to the start of the earliest fiscal year shown.
+		first, _ := fiscal.yearStartWeek(weeks[0])
+		if refresh, err = weekEndingsBetween(first, weeks[len(weeks)-1]); err != nil {
+			webFail("Failed to compute weeks", w, err)
+			return
+		}
+	}
+	if err := rebuildDirtyAggregates(companyDBID, refresh); err != nil {
+		webFail("Failed to refresh aggregates", w, err)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT a.division_id, COALESCE(d.name, 'Unassigned'), a.week_ending, a.value_type, a.currency, a.stat_count, a.reported_count,
+		       a.quota_count, a.quota_met_count, a.up_count, a.down_count, a.level_count, a.total
+		FROM division_week_aggregates a LEFT JOIN divisions d ON d.id = a.division_id
+		WHERE a.company_id = ? AND a.week_ending BETWEEN ? AND ?
+		ORDER BY a.week_ending, COALESCE(d.name, 'zzz'), a.value_type, a.currency
+	`, companyDBID, weeks[0], weeks[len(weeks)-1])
+	if err != nil {
+		webFail("Failed to query aggregates", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []divisionAggregate{}
+	for rows.Next() {
+		var a divisionAggregate
+		if err := rows.Scan(&a.DivisionID, &a.DivisionName, &a.WeekEnding, &a.ValueType, &a.Currency, &a.StatCount, &a.ReportedCount,
+			&a.QuotaCount, &a.QuotaMetCount, &a.Up, &a.Down, &a.Level, &a.Total); err != nil {
+			webFail("Failed to scan aggregates", w, err)
+			return
+		}
+		a.TotalDisplay = formatStatValue(a.Total, a.ValueType, a.Currency)
+		a.WeekLabel = fiscal.label(a.WeekEnding)
+		out = append(out, a)
+	}
+	rows.Close()
+	if ytd {
+		for i := range out {
+			a := &out[i]
+			first, _ := fiscal.yearStartWeek(a.WeekEnding)
+			var sum int64
+			if err := DB.QueryRow(`
+				SELECT COALESCE(SUM(total), 0) FROM division_week_aggregates
+				WHERE company_id = ? AND division_id = ? AND value_type = ? AND currency = ? AND week_ending BETWEEN ? AND ?
+			`, companyDBID, a.DivisionID, a.ValueType, a.Currency, first, a.WeekEnding).Scan(&sum); err != nil {
+				webFail("Failed to sum year to date", w, err)
+				return
+			}
+			a.YTDTotal = formatStatValue(sum, a.ValueType, a.Currency)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// API usage quotas: every authenticated request is counted per company and per API client (token
+// family, see tokens.go; 0 is browser sessions). Limits are per company, so one tenant's runaway
+// script only throttles that tenant:
+//
+//   STATHQ_API_SOFT_LIMIT   requests per minute before responses carry X-RateLimit-Warning (300)
+//   STATHQ_API_HARD_LIMIT   requests per minute before requests are refused with 429 (600)
+//   STATHQ_API_DAILY_LIMIT  requests per UTC day before requests are refused with 429 (0 = none)
+//
+// Counters live in memory; daily totals are flushed to api_usage every apiUsageFlushInterval.
+
+const apiUsageFlushInterval = 30 * time.Second
+
+type apiLimits struct {
+	SoftPerMinute int `json:"soft_per_minute"`
+	HardPerMinute int `json:"hard_per_minute"`
+	PerDay        int `json:"per_day"`
+}
+
+func loadAPILimits() apiLimits {
+	return apiLimits{
+		SoftPerMinute: envInt("STATHQ_API_SOFT_LIMIT", 300),
+		HardPerMinute: envInt("STATHQ_API_HARD_LIMIT", 600),
+		PerDay:        envInt("STATHQ_API_DAILY_LIMIT", 0),
+	}
+}
+
+type apiUsageKey struct{ company, family int }
+
+type apiUsageCount struct{ requests, rejected int }
+
+var apiUsage = struct {
+	sync.Mutex
+	minute    time.Time
+	perMinute map[int]int
+	warned    map[int]bool
+	day       string
+	perDay    map[int]int                    // company totals for day, including flushed counts
+	pending   map[apiUsageKey]*apiUsageCount // not yet flushed to api_usage
+}{perMinute: map[int]int{}, warned: map[int]bool{}, perDay: map[int]int{}, pending: map[apiUsageKey]*apiUsageCount{}}
+
+// apiUsageRoll starts new minute and day windows as time passes. Callers hold the lock.
+func apiUsageRoll(now time.Time) {
+	if m := now.Truncate(time.Minute); !m.Equal(apiUsage.minute) {
+		apiUsage.minute = m
+		apiUsage.perMinute = map[int]int{}
+		apiUsage.warned = map[int]bool{}
+	}
+	if d := now.Format("2006-01-02"); d != apiUsage.day {
+		if apiUsage.day != "" {
+			flushAPIUsageLocked()
+		}
+		apiUsage.day = d
+		apiUsage.perDay = map[int]int{}
+	}
+}
+
+// apiQuotaGuard counts the request against its company and refuses it once a hard limit is reached.
+func apiQuotaGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		companyCode, _ := r.Context().Value("company_id").(string)
+		company, err := companyDBID(companyCode)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		family, _ := r.Context().Value("token_family_id").(int)
+		limits := loadAPILimits()
+		now := time.Now().UTC()
+
+		apiUsage.Lock()
+		apiUsageRoll(now)
+		if _, ok := apiUsage.perDay[company]; !ok {
+			var flushed int
+			DB.QueryRow(`SELECT COALESCE(SUM(requests), 0) FROM api_usage WHERE company_id = ? AND day = ?`, company, apiUsage.day).Scan(&flushed)
+			apiUsage.perDay[company] = flushed
+		}
+		key := apiUsageKey{company, family}
+		c := apiUsage.pending[key]
+		if c == nil {
+			c = &apiUsageCount{}
+			apiUsage.pending[key] = c
+		}
+		minuteCount, dayCount := apiUsage.perMinute[company]+1, apiUsage.perDay[company]+1
+		var refused string
+		var retryAfter time.Duration
+		switch {
+		case limits.HardPerMinute > 0 && minuteCount > limits.HardPerMinute:
+			refused = fmt.Sprintf("API limit of %d requests per minute reached for this company", limits.HardPerMinute)
+			retryAfter = apiUsage.minute.Add(time.Minute).Sub(now)
+		case limits.PerDay > 0 && dayCount > limits.PerDay:
+			refused = fmt.Sprintf("API limit of %d requests per day reached for this company", limits.PerDay)
+			day, _ := time.Parse("2006-01-02", apiUsage.day)
+			retryAfter = day.AddDate(0, 0, 1).Sub(now)
+		}
+		if refused != "" {
+			c.rejected++
+		} else {
+			c.requests++
+			apiUsage.perMinute[company] = minuteCount
+			apiUsage.perDay[company] = dayCount
+		}
+		warn := refused == "" && limits.SoftPerMinute > 0 && minuteCount > limits.SoftPerMinute
+		firstWarning := warn && !apiUsage.warned[company]
+		if warn {
+			apiUsage.warned[company] = true
+		}
+		reset := apiUsage.minute.Add(time.Minute)
+		apiUsage.Unlock()
+
+		if limits.HardPerMinute > 0 {
+			remaining := limits.HardPerMinute - minuteCount
+			if remaining < 0 {
+				remaining = 0
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limits.HardPerMinute))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		}
+		if refused != "" {
+			secs := int(retryAfter.Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": refused, "retry_after": secs, "limits": limits})
+			return
+		}
+		if warn {
+			w.Header().Set("X-RateLimit-Warning", fmt.Sprintf("soft limit of %d requests per minute exceeded", limits.SoftPerMinute))
+			if firstWarning {
+				log.Printf("Company %s passed the API soft limit (%d/min)", companyCode, limits.SoftPerMinute)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// flushAPIUsageLocked adds the pending counts to api_usage. Callers hold the lock.
+func flushAPIUsageLocked() {
+	if len(apiUsage.pending) == 0 {
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("API usage flush: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for k, c := range apiUsage.pending {
+		if _, err := tx.Exec(`
+			INSERT INTO api_usage (company_id, family_id, day, requests, rejected) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(company_id, family_id, day) DO UPDATE SET requests = requests + excluded.requests, rejected = rejected + excluded.rejected
+		`, k.company, k.family, apiUsage.day, c.requests, c.rejected); err != nil {
+			log.Printf("API usage flush: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("API usage flush: %v", err)
+		return
+	}
+	apiUsage.pending = map[apiUsageKey]*apiUsageCount{}
+}
+
+func flushAPIUsage() {
+	apiUsage.Lock()
+	defer apiUsage.Unlock()
+	apiUsageRoll(time.Now().UTC())
+	flushAPIUsageLocked()
+}
+
+// StartAPIUsageJob periodically writes the in-memory request counts to api_usage.
+func StartAPIUsageJob() {
+	go func() {
+		for range time.Tick(apiUsageFlushInterval) {
+			flushAPIUsage()
+		}
+	}()
+}
+
+// ---------- GET /api/usage?days=30 ----------
+// The company's limits, this minute's count, today's requests per API client and the daily history.
+func APIUsageHandler(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 366 {
+			http.Error(w, `{"message":"days must be between 1 and 366"}`, http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	company, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	flushAPIUsage()
+	apiUsage.Lock()
+	minuteCount, today := apiUsage.perMinute[company], apiUsage.day
+	apiUsage.Unlock()
+
+	type clientUsage struct {
+		ClientID   int    `json:"client_id"`
+		ClientName string `json:"client_name"`
+		Requests   int    `json:"requests"`
+		Rejected   int    `json:"rejected"`
+	}
+	type dayUsage struct {
+		Day      string `json:"day"`
+		Requests int    `json:"requests"`
+		Rejected int    `json:"rejected"`
+	}
+	clients := []clientUsage{}
+	rows, err := DB.Query(`
+		SELECT a.family_id, COALESCE(f.client_name, CASE a.family_id WHEN 0 THEN 'browser sessions' ELSE 'revoked client' END),
+		       a.requests, a.rejected
+		FROM api_usage a LEFT JOIN api_token_families f ON f.id = a.family_id
+		WHERE a.company_id = ? AND a.day = ?
+		ORDER BY a.requests DESC
+	`, company, today)
+	if err != nil {
+		webFail("Failed to query API usage", w, err)
+		return
+	}
+	for rows.Next() {
+		var c clientUsage
+		if err := rows.Scan(&c.ClientID, &c.ClientName, &c.Requests, &c.Rejected); err != nil {
+			rows.Close()
+			webFail("Failed to scan API usage", w, err)
+			return
+		}
+		clients = append(clients, c)
+	}
+	rows.Close()
+
+	history := []dayUsage{}
+	from := time.Now().UTC().AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+	rows, err = DB.Query(`
+		SELECT day, SUM(requests), SUM(rejected) FROM api_usage
+		WHERE company_id = ? AND day >= ? GROUP BY day ORDER BY day
+	`, company, from)
+	if err != nil {
+		webFail("Failed to query API usage", w, err)
+		return
+	}
+	defer rows.Close()
+	var todayTotal, todayRejected int
+	for rows.Next() {
+		var d dayUsage
+		if err := rows.Scan(&d.Day, &d.Requests, &d.Rejected); err != nil {
+			webFail("Failed to scan API usage", w, err)
+			return
+		}
+		if d.Day == today {
+			todayTotal, todayRejected = d.Requests, d.Rejected
+		}
+		history = append(history, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limits":      loadAPILimits(),
+		"this_minute": minuteCount,
+		"today":       map[string]interface{}{"day": today, "requests": todayTotal, "rejected": todayRejected, "clients": clients},
+		"history":     history,
+	})
+}
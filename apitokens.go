@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Long-lived API tokens for machine clients (POS systems, spreadsheets, scripts) that push values
+// without anyone logging in. Admins create them with /api/tokens; the plaintext (shq_...) is shown
+// once. A token acts as one user of the company, limited by its scopes:
+//
+//   read    GET requests only
+//   write   reads and writes, with the rights of a plain user
+//   admin   everything the user's role may do (the user must be a manager or admin)
+
+const apiTokenPrefix = "shq_"
+
+var apiTokenScopes = []string{"read", "write", "admin"}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenAllows reports whether a token with scopes may make a request with method.
+func apiTokenAllows(scopes []string, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return len(scopes) > 0
+	}
+	return hasScope(scopes, "write") || hasScope(scopes, "admin")
+}
+
+// apiTokenRole caps the user's role at "user" unless the token has the admin scope.
+func apiTokenRole(role string, scopes []string) string {
+	if !hasScope(scopes, "admin") && roleAtLeast(role, "manager") {
+		return "user"
+	}
+	return role
+}
+
+// parseAPITokenScopes validates and normalises a scope list; admin implies write, write implies read.
+func parseAPITokenScopes(in []string) ([]string, bool) {
+	set := map[string]bool{}
+	for _, s := range in {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !hasScope(apiTokenScopes, s) {
+			return nil, false
+		}
+		set[s] = true
+	}
+	if set["admin"] {
+		set["write"] = true
+	}
+	if set["write"] {
+		set["read"] = true
+	}
+	var out []string
+	for _, s := range apiTokenScopes {
+		if set[s] {
+			out = append(out, s)
+		}
+	}
+	return out, len(out) > 0
+}
+
+// apiTokenAuth resolves an API token to its user and scopes.
+func apiTokenAuth(token string) (bearerAuth, error) {
+	var auth bearerAuth
+	var scopes string
+	var expires, lastUsed sql.NullString
+	err := DB.QueryRow(`
+		SELECT id, user_id, scopes, expires_at, last_used_at FROM api_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL
+	`, hashSecretToken(token)).Scan(&auth.APITokenID, &auth.UserID, &scopes, &expires, &lastUsed)
+	if err == sql.ErrNoRows {
+		return bearerAuth{}, errTokenInvalid
+	} else if err != nil {
+		return bearerAuth{}, err
+	}
+	now := time.Now().UTC()
+	if expires.Valid {
+		if t, err := time.Parse(time.RFC3339, expires.String); err != nil || now.After(t) {
+			return bearerAuth{}, errTokenInvalid
+		}
+	}
+	auth.Scopes = strings.Split(scopes, ",")
+	// last_used_at is informational, so it is written at most once a minute.
+	if t, err := time.Parse(time.RFC3339, lastUsed.String); err != nil || now.Sub(t) >= time.Minute {
+		DB.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now.Format(time.RFC3339), auth.APITokenID)
+	}
+	return auth, nil
+}
+
+type apiToken struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	UserID     int      `json:"user_id"`
+	Username   string   `json:"username"`
+	Scopes     []string `json:"scopes"`
+	Hint       string   `json:"hint"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+	Token      string   `json:"token,omitempty"` // only returned on creation
+}
+
+// ---------- GET /api/tokens ----------
+func ListAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`
+		SELECT t.id, t.name, t.user_id, u.username, t.scopes, t.token_hint, t.created_at,
+		       COALESCE(t.expires_at, ''), COALESCE(t.last_used_at, ''), COALESCE(t.revoked_at, '')
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.company_id = ? ORDER BY t.id DESC
+	`, companyDBID)
+	if err != nil {
+		webFail("Failed to query API tokens", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []apiToken{}
+	for rows.Next() {
+		var t apiToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.Name, &t.UserID, &t.Username, &scopes, &t.Hint, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt); err != nil {
+			webFail("Failed to scan API tokens", w, err)
+			return
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		out = append(out, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/tokens ----------
+// Body: {"name": "POS", "scopes": ["write"], "user_id": 12, "expires_in_days": 365}. user_id defaults
+// to the caller; expires_in_days 0 or missing means the token does not expire.
+func CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		UserID        int      `json:"user_id"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, `{"message":"name is required (at most 100 characters)"}`, http.StatusBadRequest)
+		return
+	}
+	scopes, ok := parseAPITokenScopes(req.Scopes)
+	if !ok {
+		http.Error(w, `{"message":"scopes must be a non-empty list of read, write and admin"}`, http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > 3650 {
+		http.Error(w, `{"message":"expires_in_days must be between 0 and 3650"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if req.UserID == 0 {
+		req.UserID = r.Context().Value("user_id").(int)
+	}
+	var role string
+	if err := DB.QueryRow(`SELECT role FROM users WHERE id = ? AND company_id = ?`, req.UserID, companyDBID).Scan(&role); err != nil {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	if hasScope(scopes, "admin") && !roleAtLeast(role, "manager") {
+		http.Error(w, `{"message":"the admin scope needs a manager or admin user"}`, http.StatusBadRequest)
+		return
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate token", w, err)
+		return
+	}
+	token := apiTokenPrefix + secret
+	now := time.Now().UTC()
+	t := apiToken{
+		Name:      req.Name,
+		UserID:    req.UserID,
+		Scopes:    scopes,
+		Hint:      token[len(token)-4:],
+		CreatedAt: now.Format(time.RFC3339),
+		Token:     token,
+	}
+	var expires interface{}
+	if req.ExpiresInDays > 0 {
+		t.ExpiresAt = now.AddDate(0, 0, req.ExpiresInDays).Format(time.RFC3339)
+		expires = t.ExpiresAt
+	}
+	res, err := DB.Exec(`
+		INSERT INTO api_tokens (company_id, user_id, name, token_hash, token_hint, scopes, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, companyDBID, req.UserID, t.Name, hashSecretToken(token), t.Hint, strings.Join(scopes, ","), r.Context().Value("user_id"), t.CreatedAt, expires)
+	if err != nil {
+		webFail("Failed to create API token", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	t.ID = int(id)
+	DB.QueryRow(`SELECT username FROM users WHERE id = ?`, req.UserID).Scan(&t.Username)
+	log.Printf("User %v created API token %d (%s) for user %d with scopes %v", r.Context().Value("user_id"), t.ID, t.Name, t.UserID, scopes)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// ---------- PATCH /api/tokens/{id} ----------
+// Body: {"name": "...", "scopes": [...]}; either may be left out.
+func UpdateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   *string  `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var id int
+	var name, scopes, role string
+	err = DB.QueryRow(`
+		SELECT t.id, t.name, t.scopes, u.role FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.id = ? AND t.company_id = ? AND t.revoked_at IS NULL
+	`, mux.Vars(r)["id"], companyDBID).Scan(&id, &name, &scopes, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Token not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		webFail("Failed to load API token", w, err)
+		return
+	}
+	if req.Name != nil {
+		if name = strings.TrimSpace(*req.Name); name == "" || len(name) > 100 {
+			http.Error(w, `{"message":"name is required (at most 100 characters)"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Scopes != nil {
+		list, ok := parseAPITokenScopes(req.Scopes)
+		if !ok {
+			http.Error(w, `{"message":"scopes must be a non-empty list of read, write and admin"}`, http.StatusBadRequest)
+			return
+		}
+		if hasScope(list, "admin") && !roleAtLeast(role, "manager") {
+			http.Error(w, `{"message":"the admin scope needs a manager or admin user"}`, http.StatusBadRequest)
+			return
+		}
+		scopes = strings.Join(list, ",")
+	}
+	if _, err := DB.Exec(`UPDATE api_tokens SET name = ?, scopes = ? WHERE id = ?`, name, scopes, id); err != nil {
+		webFail("Failed to update API token", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "name": name, "scopes": strings.Split(scopes, ",")})
+}
+
+// ---------- DELETE /api/tokens/{id} ----------
+func RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	res, err := DB.Exec(`UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND company_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), mux.Vars(r)["id"], companyDBID)
+	if err != nil {
+		webFail("Failed to revoke API token", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"Token not found"}`, http.StatusNotFound)
+		return
+	}
+	log.Printf("User %v revoked API token %s", r.Context().Value("user_id"), mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked"})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Archiving retires a stat without losing anything. An archived stat (stats.archived_at set) leaves
+// the assigned list, the week and kiosk entry lists and the personal summary, and its daily grid
+// answers 410. Its values stay: the series endpoints (GET /api/stats/{id}/series,
+// /api/public/stats/{id}/series, /services/getWeeklyStats and /services/getStatsData) answer 410 too
+// unless asked with ?include_archived=1, and /api/stats/all and the public list include archived
+// stats, with their archived_at, when asked the same way.
+//
+// No new values can be entered for an archived stat, whatever the path (7R grid, weekly entry, quick
+// entry, kiosk, QR codes, devices, imports): writes answer 410 until it is unarchived.
+//
+// POST /api/stats/{id}/archive and POST /api/stats/{id}/unarchive switch it; deleting a user can also
+// archive their personal stats (see deactivation.go).
+
+// errStatArchived is returned by the shared write paths (writeWeeklyValue, writeDailyValue).
+var errStatArchived = errors.New("stat is archived; unarchive it to enter values")
+
+// includeArchived reports whether the request asks for archived stats (?include_archived=1).
+func includeArchived(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("include_archived"))
+	return include
+}
+
+// statArchived reports whether a stat is archived.
+func statArchived(statID int) bool {
+	var archivedAt sql.NullString
+	DB.QueryRow(`SELECT archived_at FROM stats WHERE id = ?`, statID).Scan(&archivedAt)
+	return archivedAt.Valid
+}
+
+// refuseArchived answers 410 for an archived stat unless the request includes archived stats.
+func refuseArchived(w http.ResponseWriter, r *http.Request, statID int) bool {
+	if includeArchived(r) || !statArchived(statID) {
+		return false
+	}
+	http.Error(w, `{"message":"stat is archived; add include_archived=1 to see its history"}`, http.StatusGone)
+	return true
+}
+
+// refuseArchivedWrite answers 410 for an archived stat; include_archived only opens the history.
+func refuseArchivedWrite(w http.ResponseWriter, statID int) bool {
+	if !statArchived(statID) {
+		return false
+	}
+	writeArchivedError(w)
+	return true
+}
+
+func writeArchivedError(w http.ResponseWriter) {
+	http.Error(w, `{"message":"`+errStatArchived.Error()+`"}`, http.StatusGone)
+}
+
+// ---------- POST /api/stats/{id}/archive ----------
+func ArchiveStatHandler(w http.ResponseWriter, r *http.Request) {
+	setStatArchived(w, r, true)
+}
+
+// ---------- POST /api/stats/{id}/unarchive ----------
+func UnarchiveStatHandler(w http.ResponseWriter, r *http.Request) {
+	setStatArchived(w, r, false)
+}
+
+func setStatArchived(w http.ResponseWriter, r *http.Request, archive bool) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, `{"message":"`+msg+`"}`, status)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var archivedAt interface{}
+	query, action := `UPDATE stats SET archived_at = NULL WHERE id = ? AND archived_at IS NOT NULL`, activityStatUnarchived
+	args := []interface{}{statID}
+	if archive {
+		archivedAt = time.Now().UTC().Format(time.RFC3339)
+		query, action = `UPDATE stats SET archived_at = ? WHERE id = ? AND archived_at IS NULL`, activityStatArchived
+		args = []interface{}{archivedAt, statID}
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		webFail("Failed to update stat", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if archive {
+			http.Error(w, `{"message":"stat is already archived"}`, http.StatusConflict)
+		} else {
+			http.Error(w, `{"message":"stat is not archived"}`, http.StatusConflict)
+		}
+		return
+	}
+	if err := logActivity(tx, r.Context().Value("user_id"), action, statID, "", nil); err != nil {
+		webFail("Failed to log activity", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to update stat", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": statID, "archived_at": archivedAt})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Quota attainment: GET /api/stats/{id}/attainment lists, for each week of a range, the stat's
+// actual value (adjustments included, as in the series), its quota and how much of the quota was
+// attained, so the dashboard can colour weeks without knowing which way the stat points. For a
+// reversed stat (lower is better) attainment is quota / actual, so coming in under quota scores over
+// 100%. Each week gets a status:
+//
+//   met       the quota is met (quotaMet)
+//   near      not met, but attained at least STATHQ_ATTAINMENT_NEAR percent (90)
+//   missed    otherwise
+//   no_quota  a value but no quota
+//   no_value  no value reported
+//
+// Attainment is left out when it cannot be computed: a quota of zero or below, or a reversed stat
+// at zero or below, where only the status says how the week went.
+
+const (
+	attainmentMet     = "met"
+	attainmentNear    = "near"
+	attainmentMissed  = "missed"
+	attainmentNoQuota = "no_quota"
+	attainmentNoValue = "no_value"
+)
+
+type attainmentWeek struct {
+	WeekEnding string   `json:"week_ending"`
+	WeekLabel  string   `json:"week_label"`
+	Actual     *float64 `json:"actual"`
+	Quota      *float64 `json:"quota"`
+	Percent    *float64 `json:"percent_attained"`
+	Status     string   `json:"status"`
+}
+
+// attainmentPercent is how much of the quota a value attains, in percent, or nil when undefined.
+func attainmentPercent(value, quota int64, reversed bool) *float64 {
+	var p float64
+	switch {
+	case quota <= 0:
+		return nil
+	case !reversed:
+		p = float64(value) / float64(quota) * 100
+	case value <= 0:
+		return nil
+	default:
+		p = float64(quota) / float64(value) * 100
+	}
+	p = math.Round(p*10) / 10 // one decimal
+	return &p
+}
+
+// attainmentStatus classifies a week, see the statuses above.
+func attainmentStatus(value, quota *int64, reversed bool, percent *float64) string {
+	switch {
+	case value == nil:
+		return attainmentNoValue
+	case quota == nil:
+		return attainmentNoQuota
+	case quotaMet(*value, *quota, reversed):
+		return attainmentMet
+	case percent != nil && *percent >= float64(envInt("STATHQ_ATTAINMENT_NEAR", 90)):
+		return attainmentNear
+	}
+	return attainmentMissed
+}
+
+// ---------- GET /api/stats/{id}/attainment?range=12w[&end=YYYY-MM-DD] ----------
+// Per-week actual, quota and percent attained, oldest first, with totals for the range.
+func StatAttainmentHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, `{"message":"`+msg+`"}`, status)
+		return
+	}
+	q := r.URL.Query()
+	nWeeks, err := parseRangeWeeks(q.Get("range"))
+	if err != nil {
+		http.Error(w, `{"message":"invalid range (use e.g. 12, 12w, 6m, 1y)"}`, http.StatusBadRequest)
+		return
+	}
+	end := q.Get("end")
+	if end == "" {
+		end = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	} else if err := checkIfValidWE(r.Context().Value("company_id").(string), end); err != nil {
+		http.Error(w, `{"message":"invalid end week (must be a W/E date YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	weeks, err := lastWeekEndings(end, nWeeks)
+	if err != nil {
+		webFail("Failed to compute weeks", w, err)
+		return
+	}
+
+	var shortID, valueType string
+	var reversed bool
+	if err := DB.QueryRow(`SELECT short_id, value_type, reversed FROM stats WHERE id = ?`, statID).Scan(&shortID, &valueType, &reversed); err != nil {
+		webFail("Failed to query stat", w, err)
+		return
+	}
+	values, quotas := map[string]int64{}, map[string]int64{}
+	rows, err := DB.Query(`
+		SELECT w.week_ending, w.value + COALESCE((SELECT SUM(a.amount) FROM weekly_adjustments a
+			WHERE a.stat_id = w.stat_id AND a.week_ending = w.week_ending), 0)
+		FROM weekly_stats w WHERE w.stat_id = ? AND w.week_ending BETWEEN ? AND ?
+		UNION ALL
+		SELECT '#' || week_ending, value FROM stat_quotas WHERE stat_id = ? AND week_ending BETWEEN ? AND ?
+	`, statID, weeks[0], end, statID, weeks[0], end)
+	if err != nil {
+		webFail("Failed to query attainment", w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var we string
+		var v sql.NullInt64
+		if err := rows.Scan(&we, &v); err != nil {
+			webFail("Failed to scan attainment", w, err)
+			return
+		}
+		if !v.Valid {
+			continue
+		}
+		if we[0] == '#' {
+			quotas[we[1:]] = v.Int64
+		} else {
+			values[we] = v.Int64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		webFail("Failed to scan attainment", w, err)
+		return
+	}
+
+	fiscal := statFiscal(statID)
+	currency := statCurrency(statID)
+	toFloat := func(v *int64) *float64 {
+		if v == nil {
+			return nil
+		}
+		f := statValueToFloat(*v, valueType, currency)
+		return &f
+	}
+	out := make([]attainmentWeek, 0, len(weeks))
+	var withQuota, met int
+	for _, we := range weeks {
+		var value, quota *int64
+		if v, ok := values[we]; ok {
+			value = &v
+		}
+		if v, ok := quotas[we]; ok {
+			quota = &v
+		}
+		wk := attainmentWeek{WeekEnding: we, WeekLabel: fiscal.label(we), Actual: toFloat(value), Quota: toFloat(quota)}
+		if value != nil && quota != nil {
+			wk.Percent = attainmentPercent(*value, *quota, reversed)
+			withQuota++
+		}
+		wk.Status = attainmentStatus(value, quota, reversed, wk.Percent)
+		if wk.Status == attainmentMet {
+			met++
+		}
+		out = append(out, wk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat_id":               statID,
+		"short_id":              shortID,
+		"value_type":            valueType,
+		"reversed":              reversed,
+		"from":                  weeks[0],
+		"to":                    end,
+		"weeks_with_quota":      withQuota,
+		"weeks_quota_met":       met,
+		"quota_attainment_rate": rate(met, withQuota),
+		"weeks":                 out,
+	})
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Offsite backups: a background job snapshots the SQLite database with the online backup API,
+// gzips and encrypts it (AES-256-GCM) and uploads it to an S3-compatible bucket, keeping the newest
+// STATHQ_BACKUP_RETAIN copies. Restore with: ./stathq -restore-backup=latest (server stopped).
+//
+// Configuration (backups are disabled unless bucket, credentials and key are all set):
+//   STATHQ_BACKUP_S3_ENDPOINT   default https://s3.amazonaws.com
+//   STATHQ_BACKUP_S3_REGION     default us-east-1
+//   STATHQ_BACKUP_S3_BUCKET
+//   STATHQ_BACKUP_S3_ACCESS_KEY
+//   STATHQ_BACKUP_S3_SECRET_KEY
+//   STATHQ_BACKUP_KEY           64 hex chars (32-byte AES key)
+//   STATHQ_BACKUP_PREFIX        default "stathq/"
+//   STATHQ_BACKUP_INTERVAL      default 24h
+//   STATHQ_BACKUP_RETAIN        default 14
+
+type backupConfig struct {
+	S3       *s3Client
+	Key      []byte
+	Prefix   string
+	Interval time.Duration
+	Retain   int
+}
+
+type backupStatus struct {
+	Configured  bool      `json:"configured"`
+	Running     bool      `json:"running"`
+	Interval    string    `json:"interval,omitempty"`
+	Retain      int       `json:"retain,omitempty"`
+	LastRun     time.Time `json:"last_run,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastKey     string    `json:"last_key,omitempty"`
+	LastSize    int64     `json:"last_size,omitempty"`
+	NextRun     time.Time `json:"next_run,omitempty"`
+}
+
+var (
+	backupMu    sync.Mutex
+	backupState backupStatus
+)
+
+const backupMagic = "SHQBAK1\n"
+const backupChunkSize = 1 << 20
+
+func loadBackupConfig() (*backupConfig, error) {
+	bucket := envString("STATHQ_BACKUP_S3_BUCKET", "")
+	access := envString("STATHQ_BACKUP_S3_ACCESS_KEY", "")
+	secret := envString("STATHQ_BACKUP_S3_SECRET_KEY", "")
+	keyHex := envString("STATHQ_BACKUP_KEY", "")
+	if bucket == "" && keyHex == "" {
+		return nil, nil
+	}
+	if bucket == "" || access == "" || secret == "" || keyHex == "" {
+		return nil, errors.New("STATHQ_BACKUP_S3_BUCKET, STATHQ_BACKUP_S3_ACCESS_KEY, STATHQ_BACKUP_S3_SECRET_KEY and STATHQ_BACKUP_KEY are all required")
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("STATHQ_BACKUP_KEY must be 64 hex characters")
+	}
+	return &backupConfig{
+		S3: &s3Client{
+			Endpoint:  envString("STATHQ_BACKUP_S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:    envString("STATHQ_BACKUP_S3_REGION", "us-east-1"),
+			Bucket:    bucket,
+			AccessKey: access,
+			SecretKey: secret,
+		},
+		Key:      key,
+		Prefix:   envString("STATHQ_BACKUP_PREFIX", "stathq/"),
+		Interval: envDuration("STATHQ_BACKUP_INTERVAL", 24*time.Hour),
+		Retain:   envInt("STATHQ_BACKUP_RETAIN", 14),
+	}, nil
+}
+
+// StartBackupJob launches the periodic backup loop if backups are configured.
+func StartBackupJob() {
+	cfg, err := loadBackupConfig()
+	if err != nil {
+		log.Printf("Backups disabled: %v", err)
+		return
+	}
+	if cfg == nil {
+		return
+	}
+
+	backupMu.Lock()
+	backupState.Configured = true
+	backupState.Interval = cfg.Interval.String()
+	backupState.Retain = cfg.Retain
+	backupState.NextRun = time.Now().Add(cfg.Interval)
+	backupMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runBackup(cfg)
+		}
+	}()
+	log.Printf("Backup job scheduled every %s to bucket %s", cfg.Interval, cfg.S3.Bucket)
+}
+
+// runBackup performs one snapshot/encrypt/upload/prune cycle and records the outcome.
+func runBackup(cfg *backupConfig) {
+	backupMu.Lock()
+	if backupState.Running {
+		backupMu.Unlock()
+		return
+	}
+	backupState.Running = true
+	backupState.LastRun = time.Now()
+	backupMu.Unlock()
+
+	key, size, err := backupOnce(cfg)
+
+	backupMu.Lock()
+	backupState.Running = false
+	backupState.NextRun = time.Now().Add(cfg.Interval)
+	if err != nil {
+		backupState.LastError = err.Error()
+		log.Printf("Backup failed: %v", err)
+	} else {
+		backupState.LastError = ""
+		backupState.LastSuccess = time.Now()
+		backupState.LastKey = key
+		backupState.LastSize = size
+		log.Printf("Backup uploaded: %s (%d bytes)", key, size)
+	}
+	backupMu.Unlock()
+}
+
+func backupOnce(cfg *backupConfig) (string, int64, error) {
+	dir, err := os.MkdirTemp("", "stathq-backup-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	snap := filepath.Join(dir, "snapshot.db")
+	if err := snapshotDB(snap); err != nil {
+		return "", 0, fmt.Errorf("snapshot: %v", err)
+	}
+
+	encPath := filepath.Join(dir, "snapshot.db.gz.enc")
+	if err := encryptFile(snap, encPath, cfg.Key); err != nil {
+		return "", 0, fmt.Errorf("encrypt: %v", err)
+	}
+
+	f, err := os.Open(encPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	key := cfg.Prefix + "stats-" + time.Now().UTC().Format("20060102T150405Z") + ".db.gz.enc"
+	if err := cfg.S3.PutObject(key, f, size, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return "", 0, fmt.Errorf("upload: %v", err)
+	}
+
+	if err := pruneBackups(cfg); err != nil {
+		log.Printf("Backup retention cleanup failed: %v", err)
+	}
+	return key, size, nil
+}
+
+// pruneBackups deletes all but the newest cfg.Retain backups under the prefix.
+func pruneBackups(cfg *backupConfig) error {
+	if cfg.Retain <= 0 {
+		return nil
+	}
+	objs, err := cfg.S3.ListObjects(cfg.Prefix)
+	if err != nil {
+		return err
+	}
+	var backups []s3Object
+	for _, o := range objs {
+		if strings.HasSuffix(o.Key, ".db.gz.enc") {
+			backups = append(backups, o)
+		}
+	}
+	for i := 0; i < len(backups)-cfg.Retain; i++ {
+		if err := cfg.S3.DeleteObject(backups[i].Key); err != nil {
+			return err
+		}
+		log.Printf("Pruned old backup %s", backups[i].Key)
+	}
+	return nil
+}
+
+// snapshotDB copies the live database to dst using SQLite's online backup API, which is safe while
+// the server keeps writing.
+func snapshotDB(dst string) error {
+	ctx := context.Background()
+	srcConn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destDB, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			d, ok1 := dc.(*sqlite3.SQLiteConn)
+			s, ok2 := sc.(*sqlite3.SQLiteConn)
+			if !ok1 || !ok2 {
+				return errors.New("unexpected driver connection type")
+			}
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// encryptFile gzips src and writes it to dst as a sequence of AES-GCM sealed chunks.
+// Layout: magic | 8-byte nonce prefix | { 4-byte header (length, high bit = last) | sealed chunk }...
+// The header is authenticated, so truncation or reordering is detected on restore.
+func encryptFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, in)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	if err := encryptStream(out, pr, key); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func encryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := dst.Write(append([]byte(backupMagic), prefix...)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, backupChunkSize)
+	next := make([]byte, backupChunkSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	for counter := uint32(0); ; counter++ {
+		// Read ahead so we know whether this chunk is the last one.
+		m, rerr := io.ReadFull(src, next)
+		if rerr != nil && rerr != io.ErrUnexpectedEOF && rerr != io.EOF {
+			return rerr
+		}
+		last := m == 0
+
+		hdr := make([]byte, 4)
+		v := uint32(n)
+		if last {
+			v |= 1 << 31
+		}
+		binary.BigEndian.PutUint32(hdr, v)
+		nonce := backupNonce(prefix, counter)
+		if _, err := dst.Write(hdr); err != nil {
+			return err
+		}
+		if _, err := dst.Write(aead.Seal(nil, nonce, buf[:n], hdr)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf, next = next, buf
+		n = m
+	}
+}
+
+func decryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, len(backupMagic)+8)
+	if _, err := io.ReadFull(src, head); err != nil {
+		return err
+	}
+	if string(head[:len(backupMagic)]) != backupMagic {
+		return errors.New("not a StatHQ backup file")
+	}
+	prefix := head[len(backupMagic):]
+
+	hdr := make([]byte, 4)
+	for counter := uint32(0); ; counter++ {
+		if _, err := io.ReadFull(src, hdr); err != nil {
+			return fmt.Errorf("backup truncated: %v", err)
+		}
+		v := binary.BigEndian.Uint32(hdr)
+		last := v&(1<<31) != 0
+		n := int(v &^ (1 << 31))
+		if n > backupChunkSize {
+			return errors.New("invalid backup chunk size")
+		}
+		sealed := make([]byte, n+aead.Overhead())
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return fmt.Errorf("backup truncated: %v", err)
+		}
+		plain, err := aead.Open(nil, backupNonce(prefix, counter), sealed, hdr)
+		if err != nil {
+			return errors.New("backup decryption failed (wrong key or corrupted file)")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func backupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func backupNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// RestoreBackup downloads a backup ("latest" or an object key), decrypts it and replaces dbFile.
+// The previous database is kept next to it as <dbFile>.pre-restore-<timestamp>.
+// It must be run while the server is stopped.
+func RestoreBackup(name, dbFile string) error {
+	cfg, err := loadBackupConfig()
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return errors.New("backups are not configured (set STATHQ_BACKUP_* variables)")
+	}
+
+	if name == "latest" {
+		objs, err := cfg.S3.ListObjects(cfg.Prefix)
+		if err != nil {
+			return err
+		}
+		name = ""
+		for _, o := range objs {
+			if strings.HasSuffix(o.Key, ".db.gz.enc") {
+				name = o.Key
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("no backups found under %s", cfg.Prefix)
+		}
+	}
+
+	body, err := cfg.S3.GetObject(name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decryptStream(pw, body, cfg.Key))
+	}()
+	gz, err := gzip.NewReader(pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+
+	tmp := dbFile + ".restore"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// Sanity-check the restored file before swapping it in.
+	check, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	var result string
+	err = check.QueryRow(`PRAGMA integrity_check`).Scan(&result)
+	check.Close()
+	if err != nil || result != "ok" {
+		os.Remove(tmp)
+		return fmt.Errorf("restored database failed integrity check: %v %s", err, result)
+	}
+
+	if exists, _ := FileExists(dbFile); exists {
+		keep := dbFile + ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(dbFile, keep); err != nil {
+			return err
+		}
+		log.Printf("Previous database kept at %s", keep)
+	}
+	if err := os.Rename(tmp, dbFile); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from backup %s", dbFile, name)
+	return nil
+}
+
+// ---------- GET /api/admin/backups ----------
+// Returns the backup job status and, when configured, the backups currently stored in the bucket.
+// The backups hold every company, so this is for super-admins.
+func BackupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	backupMu.Lock()
+	status := backupState
+	backupMu.Unlock()
+
+	resp := map[string]interface{}{"status": status}
+	if status.Configured {
+		if cfg, err := loadBackupConfig(); err == nil && cfg != nil {
+			objs, err := cfg.S3.ListObjects(cfg.Prefix)
+			if err != nil {
+				resp["remote_error"] = err.Error()
+			} else {
+				if objs == nil {
+					objs = []s3Object{}
+				}
+				resp["remote"] = objs
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
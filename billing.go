@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription billing.
+//
+// Plans and their limits (seats, stats, weeks of history) are rows in the plans table. Each company
+// has a company_billing row holding its plan, purchased seats (max users) and the Stripe
+// subscription state. Stripe pushes subscription changes to /api/billing/webhook; the plan
+// is read from the subscription's metadata.plan or its price lookup_key, and seats from the quantity.
+// Limits are only enforced when STATHQ_BILLING_ENABLED=true, so self-hosted installs are unaffected.
+//
+// A cancelled subscription drops the company to the free plan. A lapsed one (unpaid, expired, or
+// past due for longer than the grace period) locks the company: billingGuard refuses every change
+// except billing itself until payment is sorted out. Stripe customers and the portal: stripe.go.
+//
+//   STATHQ_BILLING_ENABLED          enforce plan limits (default false)
+//   STATHQ_BILLING_GRACE            how long a past-due company keeps working (default 168h)
+//   STATHQ_STRIPE_WEBHOOK_SECRET    signing secret of the Stripe webhook endpoint (whsec_...)
+
+type billingPlan struct {
+	Name         string `json:"name"`
+	MaxUsers     int    `json:"max_users"`     // seats included
+	MaxStats     int    `json:"max_stats"`     // 0 = unlimited
+	HistoryWeeks int    `json:"history_weeks"` // weeks of history retained, 0 = unlimited
+}
+
+// loadBillingPlan reads a plan from the plans table; sql.ErrNoRows means there is no such plan.
+func loadBillingPlan(name string) (billingPlan, error) {
+	p := billingPlan{Name: name}
+	err := DB.QueryRow(`SELECT max_users, max_stats, history_weeks FROM plans WHERE name = ?`, name).Scan(&p.MaxUsers, &p.MaxStats, &p.HistoryWeeks)
+	return p, err
+}
+
+type companyBilling struct {
+	Plan                 string `json:"plan"`
+	Seats                int    `json:"seats"`
+	Status               string `json:"status"`
+	CurrentPeriodEnd     string `json:"current_period_end,omitempty"`
+	StripeCustomerID     string `json:"-"`
+	StripeSubscriptionID string `json:"-"`
+}
+
+func billingEnabled() bool {
+	return envBool("STATHQ_BILLING_ENABLED", false)
+}
+
+// loadCompanyBilling returns the company's billing row, defaulting to an active free plan.
+func loadCompanyBilling(companyDBID int) (companyBilling, error) {
+	b := companyBilling{Plan: "free", Status: "active"}
+	var periodEnd, customer, sub sql.NullString
+	err := DB.QueryRow(`
+		SELECT plan, seats, status, current_period_end, stripe_customer_id, stripe_subscription_id
+		FROM company_billing WHERE company_id = ?
+	`, companyDBID).Scan(&b.Plan, &b.Seats, &b.Status, &periodEnd, &customer, &sub)
+	if err == sql.ErrNoRows {
+		free, err := loadBillingPlan("free")
+		b.Seats = free.MaxUsers
+		return b, err
+	}
+	if err != nil {
+		return b, err
+	}
+	b.CurrentPeriodEnd = periodEnd.String
+	b.StripeCustomerID = customer.String
+	b.StripeSubscriptionID = sub.String
+	return b, nil
+}
+
+// billingUsage counts the company's active users and stats. Deactivated users do not take a seat.
+func billingUsage(companyDBID int) (users, stats int, err error) {
+	if err = DB.QueryRow(`SELECT COUNT(*) FROM users WHERE company_id = ? AND active = 1`, companyDBID).Scan(&users); err != nil {
+		return
+	}
+	err = DB.QueryRow(`SELECT COUNT(*) FROM stats WHERE company_id = ? AND deleted_at IS NULL`, companyDBID).Scan(&stats)
+	return
+}
+
+// checkBillingLimit reports whether the company may create one more "user" or "stat".
+// When it may not, msg explains why and the caller should answer 402 Payment Required.
+func checkBillingLimit(companyDBID int, kind string) (ok bool, msg string, err error) {
+	if !billingEnabled() {
+		return true, "", nil
+	}
+	b, err := loadCompanyBilling(companyDBID)
+	if err != nil {
+		return false, "", err
+	}
+	if b.Status != "active" && b.Status != "trialing" {
+		return false, fmt.Sprintf("Subscription is %s; update billing to add %ss", b.Status, kind), nil
+	}
+	users, stats, err := billingUsage(companyDBID)
+	if err != nil {
+		return false, "", err
+	}
+	plan, err := loadBillingPlan(b.Plan)
+	if err != nil && err != sql.ErrNoRows {
+		return false, "", err
+	}
+	switch kind {
+	case "user":
+		if users >= b.Seats {
+			return false, fmt.Sprintf("All %d seats on the %s plan are in use", b.Seats, b.Plan), nil
+		}
+	case "stat":
+		if plan.MaxStats > 0 && stats >= plan.MaxStats {
+			return false, fmt.Sprintf("The %s plan allows %d stats", b.Plan, plan.MaxStats), nil
+		}
+	}
+	return true, "", nil
+}
+
+// billingLapsed reports whether the subscription has lapsed far enough to lock the company.
+func billingLapsed(b companyBilling, now time.Time) bool {
+	switch b.Status {
+	case "unpaid", "incomplete_expired":
+		return true
+	case "past_due":
+		end, err := time.Parse(time.RFC3339, b.CurrentPeriodEnd)
+		return err == nil && now.After(end.Add(envDuration("STATHQ_BILLING_GRACE", 7*24*time.Hour)))
+	}
+	return false
+}
+
+// billingGuard makes companies with a lapsed subscription read-only. Billing routes stay open so
+// an admin can pay.
+func billingGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !billingEnabled() || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions ||
+			strings.HasPrefix(r.URL.Path, "/api/billing") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		companyID, _ := r.Context().Value("company_id").(string)
+		id, err := companyDBID(companyID)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if msg, err := billingLockMessage(id); err != nil {
+			webFail("Failed to check billing", w, err)
+			return
+		} else if msg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(map[string]string{"message": msg})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// billingLockMessage explains why a company is read-only for billing, or is "" when it is not.
+func billingLockMessage(companyDBID int) (string, error) {
+	if !billingEnabled() {
+		return "", nil
+	}
+	b, err := loadCompanyBilling(companyDBID)
+	if err != nil {
+		return "", err
+	}
+	if !billingLapsed(b, time.Now()) {
+		return "", nil
+	}
+	return fmt.Sprintf("Subscription is %s; the company is read-only until billing is updated", strings.ReplaceAll(b.Status, "_", " ")), nil
+}
+
+// companyWritable makes the checks of AuthMiddleware and its guards for the paths that store values
+// without a signed-in user (device ingest, kiosks, QR codes, Telegram, MQTT): a suspended company, a
+// lapsed subscription or an expired or full trial takes no values. It returns the status and
+// message to refuse the write with, or status 0.
+func companyWritable(companyDBID int) (int, string, error) {
+	var suspended bool
+	if err := DB.QueryRow(`SELECT suspended_at IS NOT NULL FROM companies WHERE id = ?`, companyDBID).Scan(&suspended); err != nil {
+		return 0, "", err
+	}
+	if suspended {
+		return http.StatusForbidden, "This company is suspended", nil
+	}
+	if msg, err := billingLockMessage(companyDBID); err != nil {
+		return 0, "", err
+	} else if msg != "" {
+		return http.StatusPaymentRequired, msg, nil
+	}
+	if msg, err := trialLockMessage(companyDBID, "", true); err != nil {
+		return 0, "", err
+	} else if msg != "" {
+		return http.StatusForbidden, msg, nil
+	}
+	return 0, "", nil
+}
+
+// refuseLockedCompany answers a write to a company that companyWritable refuses.
+func refuseLockedCompany(w http.ResponseWriter, companyDBID int) bool {
+	status, msg, err := companyWritable(companyDBID)
+	if err != nil {
+		webFail("Failed to check company status", w, err)
+		return true
+	}
+	if status == 0 {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+	return true
+}
+
+// ---------- GET /api/billing ----------
+func GetBillingHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	b, err := loadCompanyBilling(companyDBID)
+	if err != nil {
+		webFail("Failed to load billing", w, err)
+		return
+	}
+	users, stats, err := billingUsage(companyDBID)
+	if err != nil {
+		webFail("Failed to count usage", w, err)
+		return
+	}
+	plan, err := loadBillingPlan(b.Plan)
+	if err != nil && err != sql.ErrNoRows {
+		webFail("Failed to load plan", w, err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"enforced":           billingEnabled(),
+		"plan":               b.Plan,
+		"status":             b.Status,
+		"seats":              b.Seats,
+		"seats_used":         users,
+		"max_stats":          plan.MaxStats,
+		"stats_used":         stats,
+		"current_period_end": b.CurrentPeriodEnd,
+		"has_subscription":   b.StripeSubscriptionID != "",
+		"locked":             billingEnabled() && billingLapsed(b, time.Now()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type usageMeter struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"` // 0 = unlimited
+}
+
+// ---------- GET /api/company/usage ----------
+// How close the company is to its plan limits. History is the number of weeks between the oldest
+// stored weekly value and the current week; it is reported against the plan's retention but values
+// are never removed for it. Trial companies also get the trial caps (see trial.go).
+func CompanyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.Context().Value("company_id").(string)
+	companyDBID, err := companyDBID(code)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	b, err := loadCompanyBilling(companyDBID)
+	if err != nil {
+		webFail("Failed to load billing", w, err)
+		return
+	}
+	plan, err := loadBillingPlan(b.Plan)
+	if err != nil && err != sql.ErrNoRows {
+		webFail("Failed to load plan", w, err)
+		return
+	}
+	users, stats, err := billingUsage(companyDBID)
+	if err != nil {
+		webFail("Failed to count usage", w, err)
+		return
+	}
+	var values int
+	var oldest sql.NullString
+	if err := DB.QueryRow(`
+		SELECT COUNT(*), MIN(ws.week_ending) FROM weekly_stats ws JOIN stats s ON s.id = ws.stat_id WHERE s.company_id = ?
+	`, companyDBID).Scan(&values, &oldest); err != nil {
+		webFail("Failed to count values", w, err)
+		return
+	}
+	weeks := 0
+	if oldest.Valid {
+		if t, err := time.Parse("2006-01-02", oldest.String); err == nil {
+			weeks = int(time.Since(t).Hours()/(24*7)) + 1
+		}
+	}
+
+	resp := map[string]interface{}{
+		"enforced":      billingEnabled(),
+		"plan":          plan,
+		"status":        b.Status,
+		"users":         usageMeter{users, b.Seats},
+		"stats":         usageMeter{stats, plan.MaxStats},
+		"history_weeks": usageMeter{weeks, plan.HistoryWeeks},
+		"weekly_values": values,
+		"oldest_week":   oldest.String,
+	}
+	if _, isTrial, err := companyTrialExpiry(companyDBID); err == nil && isTrial {
+		resp["trial_limits"] = loadTrialLimits()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ---------- POST /api/billing/webhook (Stripe) ----------
+func StripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := envString("STATHQ_STRIPE_WEBHOOK_SECRET", "")
+	if secret == "" {
+		http.Error(w, `{"message":"Billing webhook not configured"}`, http.StatusNotFound)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, `{"message":"Failed to read body"}`, http.StatusBadRequest)
+		return
+	}
+	if err := verifyStripeSignature(payload, r.Header.Get("Stripe-Signature"), secret, time.Now()); err != nil {
+		log.Printf("Rejected Stripe webhook: %v", err)
+		http.Error(w, `{"message":"Invalid signature"}`, http.StatusBadRequest)
+		return
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		err = handleStripeCheckout(event.Data.Object)
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		err = handleStripeSubscription(event.Data.Object, event.Type == "customer.subscription.deleted")
+	default:
+		// Other events are acknowledged and ignored.
+	}
+	if err != nil {
+		// A 5xx makes Stripe retry the delivery later.
+		webFail("Failed to process Stripe event "+event.ID, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"received":true}`)
+}
+
+// verifyStripeSignature checks the Stripe-Signature header (t=...,v1=...) against the payload.
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return fmt.Errorf("missing timestamp or signature")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return fmt.Errorf("timestamp outside tolerance")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, s := range sigs {
+		if hmac.Equal([]byte(s), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
+
+// handleStripeCheckout links the Stripe customer to the company passed as client_reference_id.
+func handleStripeCheckout(raw json.RawMessage) error {
+	var s struct {
+		ClientReferenceID string `json:"client_reference_id"`
+		Customer          string `json:"customer"`
+		Subscription      string `json:"subscription"`
+	}
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	if s.ClientReferenceID == "" || s.Customer == "" {
+		return nil
+	}
+	companyDBID, err := companyDBID(s.ClientReferenceID)
+	if err != nil {
+		log.Printf("Stripe checkout for unknown company %q", s.ClientReferenceID)
+		return nil
+	}
+	_, err = DB.Exec(`
+		INSERT INTO company_billing (company_id, stripe_customer_id, stripe_subscription_id)
+		VALUES (?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET
+			stripe_customer_id = excluded.stripe_customer_id,
+			stripe_subscription_id = COALESCE(excluded.stripe_subscription_id, company_billing.stripe_subscription_id)
+	`, companyDBID, s.Customer, nullIfEmpty(s.Subscription))
+	return err
+}
+
+// handleStripeSubscription mirrors a subscription object into company_billing, and ends the
+// company's trial once the subscription is active.
+func handleStripeSubscription(raw json.RawMessage, deleted bool) error {
+	var sub struct {
+		ID               string            `json:"id"`
+		Customer         string            `json:"customer"`
+		Status           string            `json:"status"`
+		CurrentPeriodEnd int64             `json:"current_period_end"`
+		Metadata         map[string]string `json:"metadata"`
+		Items            struct {
+			Data []struct {
+				Quantity int `json:"quantity"`
+				Price    struct {
+					LookupKey string `json:"lookup_key"`
+				} `json:"price"`
+			} `json:"data"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &sub); err != nil {
+		return err
+	}
+
+	// Find the company: by stored customer id, falling back to metadata.company_id.
+	var companyDBIDVal int
+	err := DB.QueryRow(`SELECT company_id FROM company_billing WHERE stripe_customer_id = ?`, sub.Customer).Scan(&companyDBIDVal)
+	if err == sql.ErrNoRows {
+		cid := sub.Metadata["company_id"]
+		if cid == "" {
+			log.Printf("Stripe subscription %s has no matching company", sub.ID)
+			return nil
+		}
+		if companyDBIDVal, err = companyDBID(cid); err != nil {
+			log.Printf("Stripe subscription %s references unknown company %q", sub.ID, cid)
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	plan := sub.Metadata["plan"]
+	seats := 0
+	if len(sub.Items.Data) > 0 {
+		if plan == "" {
+			plan = sub.Items.Data[0].Price.LookupKey
+		}
+		seats = sub.Items.Data[0].Quantity
+	}
+	p, err := loadBillingPlan(plan)
+	if err == sql.ErrNoRows {
+		log.Printf("Stripe subscription %s has unknown plan %q; keeping free limits", sub.ID, plan)
+		p, err = loadBillingPlan("free")
+	}
+	if err != nil {
+		return err
+	}
+	status := sub.Status
+	if deleted {
+		if p, err = loadBillingPlan("free"); err != nil {
+			return err
+		}
+		seats, status = 0, "canceled"
+	}
+	plan = p.Name
+	if seats <= 0 {
+		seats = p.MaxUsers
+	}
+	var periodEnd interface{}
+	if sub.CurrentPeriodEnd > 0 {
+		periodEnd = time.Unix(sub.CurrentPeriodEnd, 0).UTC().Format(time.RFC3339)
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO company_billing (company_id, plan, seats, status, current_period_end, stripe_customer_id, stripe_subscription_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET
+			plan = excluded.plan, seats = excluded.seats, status = excluded.status,
+			current_period_end = excluded.current_period_end,
+			stripe_customer_id = excluded.stripe_customer_id,
+			stripe_subscription_id = excluded.stripe_subscription_id
+	`, companyDBIDVal, plan, seats, status, periodEnd, sub.Customer, sub.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Billing updated for company %d: plan=%s seats=%d status=%s", companyDBIDVal, plan, seats, status)
+	if status == "active" {
+		return endTrial(companyDBIDVal)
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Request size limits. limitBodies caps every request body at STATHQ_MAX_BODY_KB (1024); the bulk
+// upload routes in bulkUploadPaths get STATHQ_IMPORT_MAX_MB (512) instead. Handlers that take a list
+// of rows refuse more than STATHQ_MAX_ROWS_PER_REQUEST (500). Problems come back the same way
+// everywhere:
+//
+//   413 {"message": "Request body too large", "limit_bytes": N}
+//   413 {"message": "Too many rows in one request", "max_rows": N}
+//   400 {"message": "Invalid JSON"}
+//   422 {"message": "...", "row": i}   a row (0-based) that fails validation
+
+// bulkUploadPaths are path prefixes that accept file uploads and archives.
+var bulkUploadPaths = []string{"/api/import/", "/api/company/import", "/api/admin/import-company"}
+
+func maxBodyBytes(path string) int64 {
+	for _, p := range bulkUploadPaths {
+		if strings.HasPrefix(path, p) {
+			return int64(envInt("STATHQ_IMPORT_MAX_MB", 512)) << 20
+		}
+	}
+	return int64(envInt("STATHQ_MAX_BODY_KB", 1024)) << 10
+}
+
+func maxRowsPerRequest() int {
+	return envInt("STATHQ_MAX_ROWS_PER_REQUEST", 500)
+}
+
+// limitBodies wraps every request body in a MaxBytesReader. Requests that announce a larger body
+// are refused before a handler runs.
+func limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBodyBytes(r.URL.Path)
+		if r.ContentLength > limit {
+			writeBodyTooLarge(w, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Request body too large", "limit_bytes": limit})
+}
+
+// decodeJSONBody decodes the request body into v, writing 413 or 400 when it cannot.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeBodyTooLarge(w, tooLarge.Limit)
+	default:
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+	}
+	return false
+}
+
+// tooManyRows writes 413 when n exceeds the per-request row cap.
+func tooManyRows(w http.ResponseWriter, n int) bool {
+	max := maxRowsPerRequest()
+	if n <= max {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Too many rows in one request", "max_rows": max})
+	return true
+}
+
+// writeInvalidRow writes 422 for a row that fails validation.
+func writeInvalidRow(w http.ResponseWriter, row int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": fmt.Sprintf(format, args...), "row": row})
+}
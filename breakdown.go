@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Categorized weekly values. A stat such as EXPENSES can list categories (payroll, rent,
+// supplies); its weekly value is then entered as a breakdown, stored per category in
+// weekly_stat_components, and the total is written to weekly_stats like any other entry so
+// graphs, quotas and calculated stats keep working off the rolled-up value.
+
+type statComponent struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+}
+
+// statCategories returns a stat's categories in display order.
+func statCategories(statID int) ([]string, error) {
+	rows, err := DB.Query(`SELECT name FROM stat_categories WHERE stat_id = ? ORDER BY position, id`, statID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// badBreakdown answers 400 with a message that may quote user input.
+func badBreakdown(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+// ---------- PUT /api/stats/{id}/categories ----------
+// Body: {"categories": ["Payroll", "Rent", "Supplies"]}. An empty list turns breakdowns off.
+func SetStatCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var req struct {
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	var calculated bool
+	DB.QueryRow(`SELECT is_calculated FROM stats WHERE id = ?`, statID).Scan(&calculated)
+	if calculated && len(req.Categories) > 0 {
+		http.Error(w, `{"message":"Calculated stats cannot have categories"}`, http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, c := range req.Categories {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[strings.ToLower(c)] {
+			continue
+		}
+		seen[strings.ToLower(c)] = true
+		names = append(names, c)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM stat_categories WHERE stat_id = ?`, statID); err != nil {
+		webFail("Failed to clear categories", w, err)
+		return
+	}
+	for i, name := range names {
+		if _, err := tx.Exec(`INSERT INTO stat_categories (stat_id, name, position) VALUES (?, ?, ?)`, statID, name, i); err != nil {
+			webFail("Failed to save category", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit", w, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"stat_id": statID, "categories": names})
+}
+
+// ---------- GET /api/stats/{id}/breakdown?week=YYYY-MM-DD ----------
+func GetStatBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	week := r.URL.Query().Get("week")
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	var valueType string
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ?`, statID).Scan(&valueType); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	currency := statCurrency(statID)
+	categories, err := statCategories(statID)
+	if err != nil {
+		webFail("Failed to load categories", w, err)
+		return
+	}
+	rows, err := DB.Query(`SELECT category, value FROM weekly_stat_components WHERE stat_id = ? AND week_ending = ? ORDER BY id`, statID, week)
+	if err != nil {
+		webFail("Failed to load breakdown", w, err)
+		return
+	}
+	defer rows.Close()
+	components := []statComponent{}
+	for rows.Next() {
+		var c statComponent
+		var v int64
+		if err := rows.Scan(&c.Category, &v); err != nil {
+			webFail("Failed to scan breakdown", w, err)
+			return
+		}
+		c.Value = formatStatValue(v, valueType, currency)
+		components = append(components, c)
+	}
+
+	out := map[string]interface{}{"stat_id": statID, "week_ending": week, "categories": categories, "components": components, "total": nil, "version": 0}
+	var total int64
+	var version int
+	if err := DB.QueryRow(`SELECT value, version FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, statID, week).Scan(&total, &version); err == nil {
+		out["total"] = formatStatValue(total, valueType, currency)
+		out["version"] = version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- PUT /api/stats/{id}/breakdown ----------
+// Body: {"week_ending": "2024-01-04", "components": [{"category": "Payroll", "value": "1200.00"}], "version": 3}
+// Replaces the week's breakdown and stores its total as the stat's weekly value. version is
+// optional and checked like on /services/logWeeklyStats.
+func SaveStatBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatAccess(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var req struct {
+		WeekEnding string          `json:"week_ending"`
+		Components []statComponent `json:"components"`
+		Version    *int            `json:"version,omitempty"`
+		Confirm    bool            `json:"confirm,omitempty"` // accept a total flagged by max_change_pct
+		Reason     string          `json:"reason,omitempty"`  // for changing a logged week, see valuehistory.go
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), req.WeekEnding); err != nil {
+		http.Error(w, `{"message":"week_ending must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Components) == 0 {
+		http.Error(w, `{"message":"components are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var valueType string
+	var calculated bool
+	if err := DB.QueryRow(`SELECT value_type, is_calculated FROM stats WHERE id = ?`, statID).Scan(&valueType, &calculated); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	if calculated {
+		http.Error(w, `{"message":"Calculated stats cannot be entered"}`, http.StatusBadRequest)
+		return
+	}
+	currency := statCurrency(statID)
+	categories, err := statCategories(statID)
+	if err != nil {
+		webFail("Failed to load categories", w, err)
+		return
+	}
+	if len(categories) == 0 {
+		http.Error(w, `{"message":"This stat has no categories"}`, http.StatusBadRequest)
+		return
+	}
+	known := map[string]string{}
+	for _, c := range categories {
+		known[strings.ToLower(c)] = c
+	}
+
+	locale, places := requestLocale(r), statInputPlaces(statID)
+	values := map[string]int64{}
+	var total int64
+	for _, c := range req.Components {
+		name, ok := known[strings.ToLower(strings.TrimSpace(c.Category))]
+		if !ok {
+			badBreakdown(w, fmt.Sprintf("unknown category %q", c.Category))
+			return
+		}
+		if _, dup := values[name]; dup {
+			badBreakdown(w, fmt.Sprintf("category %q listed twice", name))
+			return
+		}
+		v, err := parseStatValue(normalizeNumber(c.Value, locale, places), valueType, currency)
+		if err != nil {
+			badBreakdown(w, fmt.Sprintf("invalid %s value for %q", valueType, name))
+			return
+		}
+		values[name] = v
+		total += v
+	}
+
+	if err := checkWeeklyRules(DB, statID, req.WeekEnding, total, valueType, req.Confirm); err != nil {
+		writeRuleViolation(w, err)
+		return
+	}
+
+	authorID := r.Context().Value("user_id")
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var existingID, existingVal int64
+	var existingVersion int
+	err = tx.QueryRow(`SELECT id, value, version FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, statID, req.WeekEnding).Scan(&existingID, &existingVal, &existingVersion)
+	if err != nil && err != sql.ErrNoRows {
+		webFail("Failed to query weekly_stats", w, err)
+		return
+	}
+	exists := err == nil
+	if req.Version != nil && *req.Version != existingVersion {
+		current := map[string]interface{}{"version": existingVersion}
+		if exists {
+			current["value"] = formatStatValue(existingVal, valueType, currency)
+		}
+		writeConflict(w, "This week's value was changed by someone else since you loaded it", current)
+		return
+	}
+	if exists && existingVal != total {
+		if err := checkEditReason(tx, statID, req.Reason); err != nil {
+			writeRuleViolation(w, err)
+			return
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	if _, err := tx.Exec(`DELETE FROM weekly_stat_components WHERE stat_id = ? AND week_ending = ?`, statID, req.WeekEnding); err != nil {
+		webFail("Failed to clear breakdown", w, err)
+		return
+	}
+	for _, name := range categories {
+		v, ok := values[name]
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO weekly_stat_components (stat_id, week_ending, category, value, author_user_id, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		`, statID, req.WeekEnding, name, v, authorID, now); err != nil {
+			webFail("Failed to save breakdown", w, err)
+			return
+		}
+	}
+
+	detail := map[string]string{"new": formatStatValue(total, valueType, currency), "source": "breakdown"}
+	if exists {
+		if _, err := tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, author_user_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+			total, authorID, now, existingID); err != nil {
+			webFail("Failed to update weekly_stats", w, err)
+			return
+		}
+		if existingVal != total {
+			detail["old"] = formatStatValue(existingVal, valueType, currency)
+			if reason := strings.TrimSpace(req.Reason); reason != "" {
+				detail["reason"] = reason
+			}
+			if err = recordEditReason(tx, statID, req.WeekEnding, req.Reason); err == nil {
+				err = logActivity(tx, authorID, activityValueEdited, statID, req.WeekEnding, detail)
+			}
+		}
+	} else {
+		if _, err := tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, author_user_id, submitted_at, version, updated_at) VALUES (?, ?, ?, ?, ?, 1, ?)`,
+			statID, req.WeekEnding, total, authorID, now, now); err != nil {
+			webFail("Failed to insert weekly_stats", w, err)
+			return
+		}
+		err = logActivity(tx, authorID, activityValueEntered, statID, req.WeekEnding, detail)
+	}
+	if err != nil {
+		webFail("Failed to log breakdown", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit breakdown", w, err)
+		return
+	}
+	publishWeeklyEvents(statID, req.WeekEnding, total)
+	if err := enqueueRecalc(DB, statID, req.WeekEnding); err != nil {
+		log.Printf("Failed to queue recalculation of stats depending on %d: %v", statID, err)
+	}
+	if err := markAggregatesDirty(DB, statID, req.WeekEnding); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Breakdown saved",
+		"total":   formatStatValue(total, valueType, currency),
+		"version": existingVersion + 1,
+	})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streaming bulk import. The request body is newline-delimited JSON, one value per line:
+//
+//	{"stat_id": 12, "week_ending": "2021-01-07", "value": "1234.56"}
+//	{"short_id": "GI", "date": "2021-01-04", "value": 17}
+//
+// A line with week_ending writes weekly_stats, one with date writes daily_stats. A line that changes
+// a logged value needs a "reason" when the company locks values. Lines are read
+// and written chunk by chunk (?chunk=, default 500), each chunk in its own transaction, so memory
+// use does not grow with the payload and a failure part way keeps the chunks already committed.
+// The response is NDJSON too: one progress object per committed chunk, flushed as it happens, and a
+// final summary. The body is only read as fast as chunks are written, which is the backpressure.
+
+const (
+	importMaxLine      = 64 * 1024
+	importMaxErrors    = 100 // per chunk, beyond that errors are only counted
+	importDefaultChunk = 500
+)
+
+type importLine struct {
+	StatID     int             `json:"stat_id"`
+	ShortID    string          `json:"short_id"`
+	WeekEnding string          `json:"week_ending"`
+	Date       string          `json:"date"`
+	Value      json.RawMessage `json:"value"`
+	Reason     string          `json:"reason"`
+}
+
+type importError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type importProgress struct {
+	Chunk     int           `json:"chunk,omitempty"`
+	Lines     int           `json:"lines"`
+	Inserted  int           `json:"inserted"`
+	Updated   int           `json:"updated"`
+	Unchanged int           `json:"unchanged"`
+	Failed    int           `json:"failed"`
+	Errors    []importError `json:"errors,omitempty"`
+	Done      bool          `json:"done,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func (p *importProgress) add(o importProgress) {
+	p.Lines += o.Lines
+	p.Inserted += o.Inserted
+	p.Updated += o.Updated
+	p.Unchanged += o.Unchanged
+	p.Failed += o.Failed
+}
+
+type importStat struct {
+	id         int
+	valueType  string
+	currency   string
+	calculated bool
+	archived   bool
+}
+
+// ---------- POST /api/import/ndjson?chunk=500&dry_run=1 ----------
+func ImportNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	chunkSize := importDefaultChunk
+	if v := r.URL.Query().Get("chunk"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			http.Error(w, `{"message":"chunk must be between 1 and 10000"}`, http.StatusBadRequest)
+			return
+		}
+		chunkSize = n
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	// Progress is written while the body is still being read.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		log.Printf("NDJSON import: full duplex unavailable, progress is sent at the end: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	stats := map[string]importStat{} // "id:12" / "short:gi" -> stat
+	authorID := r.Context().Value("user_id")
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(make([]byte, 0, 4096), importMaxLine)
+
+	var total importProgress
+	lineNo, chunkNo := 0, 0
+	pending := make([]struct {
+		no   int
+		line importLine
+	}, 0, chunkSize)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		chunkNo++
+		p, err := importChunk(companyDBID, stats, pending, authorID, dryRun)
+		p.Chunk = chunkNo
+		pending = pending[:0]
+		if err != nil {
+			return err
+		}
+		total.add(p)
+		enc.Encode(p)
+		rc.Flush()
+		return nil
+	}
+
+	for sc.Scan() {
+		lineNo++
+		raw := strings.TrimSpace(sc.Text())
+		if raw == "" {
+			continue
+		}
+		var l importLine
+		if err := json.Unmarshal([]byte(raw), &l); err != nil {
+			total.Lines++
+			total.Failed++
+			enc.Encode(importProgress{Lines: 1, Failed: 1, Errors: []importError{{lineNo, "invalid JSON: " + err.Error()}}})
+			continue
+		}
+		pending = append(pending, struct {
+			no   int
+			line importLine
+		}{lineNo, l})
+		if len(pending) >= chunkSize {
+			if err := flush(); err != nil {
+				total.Error = fmt.Sprintf("chunk %d failed and was rolled back: %v", chunkNo, err)
+				break
+			}
+		}
+	}
+	if total.Error == "" {
+		if err := sc.Err(); err != nil {
+			total.Error = fmt.Sprintf("reading line %d: %v", lineNo+1, err)
+		} else if err := flush(); err != nil {
+			total.Error = fmt.Sprintf("chunk %d failed and was rolled back: %v", chunkNo, err)
+		}
+	}
+	total.Done = true
+	if total.Error != "" {
+		log.Printf("NDJSON import for company %d stopped: %s", companyDBID, total.Error)
+	} else if !dryRun {
+		log.Printf("NDJSON import for company %d: %d lines, %d inserted, %d updated, %d failed",
+			companyDBID, total.Lines, total.Inserted, total.Updated, total.Failed)
+	}
+	enc.Encode(total)
+}
+
+// importChunk writes one chunk in a transaction. Bad lines are reported and skipped; a database
+// error fails the whole chunk.
+func importChunk(companyDBID int, stats map[string]importStat, lines []struct {
+	no   int
+	line importLine
+}, authorID interface{}, dryRun bool) (importProgress, error) {
+	p := importProgress{Lines: len(lines)}
+	weekday := weekEndingDayOf(companyDBID)
+	fail := func(no int, msg string) {
+		p.Failed++
+		if len(p.Errors) < importMaxErrors {
+			p.Errors = append(p.Errors, importError{no, msg})
+		}
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return p, err
+	}
+	defer tx.Rollback()
+
+	type statWeek struct {
+		stat int
+		week string
+	}
+	touched := map[statWeek]bool{}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, pl := range lines {
+		l := pl.line
+		st, err := resolveImportStat(tx, companyDBID, stats, l)
+		if err != nil {
+			fail(pl.no, err.Error())
+			continue
+		}
+		rawValue := strings.Trim(string(l.Value), `"`)
+		if rawValue == "" || rawValue == "null" {
+			fail(pl.no, "value is required")
+			continue
+		}
+		value, err := parseStatValue(rawValue, st.valueType, st.currency)
+		if err != nil {
+			fail(pl.no, fmt.Sprintf("invalid %s value %q", st.valueType, rawValue))
+			continue
+		}
+
+		var table, key, keyCol string
+		switch {
+		case l.WeekEnding != "" && l.Date == "":
+			if err := checkWeekEndingOn(l.WeekEnding, weekday); err != nil {
+				fail(pl.no, fmt.Sprintf("week_ending must be a %s (YYYY-MM-DD)", weekday))
+				continue
+			}
+			table, keyCol, key = "weekly_stats", "week_ending", l.WeekEnding
+			err = checkWeeklyRules(tx, st.id, key, value, st.valueType, false)
+		case l.Date != "" && l.WeekEnding == "":
+			if _, err := time.Parse("2006-01-02", l.Date); err != nil {
+				fail(pl.no, "date must be YYYY-MM-DD")
+				continue
+			}
+			table, keyCol, key = "daily_stats", "date", l.Date
+			err = checkDailyRules(tx, st.id, value, st.valueType)
+		default:
+			fail(pl.no, "exactly one of week_ending or date is required")
+			continue
+		}
+		if v, ok := err.(*ruleViolation); ok {
+			fail(pl.no, v.Message)
+			continue
+		} else if err != nil {
+			return p, err
+		}
+
+		num, den := ratioParts(rawValue, st.valueType)
+		var existingID, existingVal int64
+		err = tx.QueryRow(fmt.Sprintf(`SELECT id, value FROM %s WHERE stat_id = ? AND %s = ? ORDER BY id DESC LIMIT 1`, table, keyCol), st.id, key).Scan(&existingID, &existingVal)
+		switch {
+		case err == sql.ErrNoRows:
+			p.Inserted++
+			if dryRun {
+				continue
+			}
+			if table == "weekly_stats" {
+				// submitted_at stays NULL: historical values were not entered late.
+				_, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, numerator, denominator, author_user_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+					st.id, key, value, num, den, authorID, now)
+			} else {
+				_, err = tx.Exec(`INSERT INTO daily_stats (stat_id, date, value, numerator, denominator, updated_at) VALUES (?, ?, ?, ?, ?, ?)`, st.id, key, value, num, den, now)
+			}
+		case err == nil && existingVal == value:
+			p.Unchanged++
+			continue
+		case err == nil:
+			if verr := checkEditReason(tx, st.id, l.Reason); verr != nil {
+				if v, ok := verr.(*ruleViolation); ok {
+					fail(pl.no, v.Message)
+					continue
+				}
+				return p, verr
+			}
+			p.Updated++
+			if dryRun {
+				continue
+			}
+			if table == "weekly_stats" {
+				_, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = ?, denominator = ?, author_user_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+					value, num, den, authorID, now, existingID)
+				if err == nil {
+					err = recordEditReason(tx, st.id, key, l.Reason)
+				}
+			} else {
+				_, err = tx.Exec(`UPDATE daily_stats SET value = ?, numerator = ?, denominator = ?, version = version + 1, updated_at = ? WHERE id = ?`, value, num, den, now, existingID)
+			}
+		}
+		if err != nil {
+			return p, err
+		}
+		if table == "weekly_stats" {
+			detail := map[string]string{"source": "ndjson", "new": formatStatValue(value, st.valueType, st.currency)}
+			if reason := strings.TrimSpace(l.Reason); existingID != 0 && reason != "" {
+				detail["reason"] = reason
+			}
+			if err := logActivity(tx, authorID, activityValueImported, st.id, key, detail); err != nil {
+				return p, err
+			}
+			touched[statWeek{st.id, key}] = true
+		}
+	}
+	if dryRun {
+		return p, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return p, err
+	}
+	for k := range touched {
+		if err := enqueueRecalc(DB, k.stat, k.week); err != nil {
+			log.Printf("Failed to queue recalculation of stats depending on %d: %v", k.stat, err)
+		}
+		if err := markAggregatesDirty(DB, k.stat, k.week); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", k.stat, err)
+		}
+	}
+	return p, nil
+}
+
+// resolveImportStat finds the line's stat in the company, caching lookups across chunks.
+func resolveImportStat(tx *sql.Tx, companyDBID int, cache map[string]importStat, l importLine) (importStat, error) {
+	var key, where string
+	var arg interface{}
+	switch {
+	case l.StatID != 0:
+		key, where, arg = "id:"+strconv.Itoa(l.StatID), "id = ?", l.StatID
+	case l.ShortID != "":
+		key, where, arg = "short:"+strings.ToLower(l.ShortID), "lower(short_id) = ?", strings.ToLower(l.ShortID)
+	default:
+		return importStat{}, fmt.Errorf("stat_id or short_id is required")
+	}
+	st, ok := cache[key]
+	if !ok {
+		err := tx.QueryRow(`
+			SELECT id, value_type, COALESCE(currency, (SELECT default_currency FROM company_settings WHERE company_id = ?), ?),
+			       is_calculated, archived_at IS NOT NULL
+			FROM stats WHERE company_id = ? AND deleted_at IS NULL AND `+where+` LIMIT 1
+		`, companyDBID, defaultCurrency, companyDBID, arg).Scan(&st.id, &st.valueType, &st.currency, &st.calculated, &st.archived)
+		if err != nil && err != sql.ErrNoRows {
+			return st, err
+		}
+		cache[key] = st
+	}
+	switch {
+	case st.id == 0:
+		return st, fmt.Errorf("unknown stat")
+	case st.calculated:
+		return st, fmt.Errorf("calculated stats cannot be imported")
+	case st.archived:
+		return st, errStatArchived
+	}
+	return st, nil
+}
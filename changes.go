@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Incremental sync: triggers append every insert, update and delete of stats, weekly values, daily
+// values and quotas to change_log, whatever code path made it (handlers, imports, the recalculation
+// worker). GET /api/changes?since=<cursor> returns the current state of everything touched after the
+// cursor, plus what was deleted, and the cursor to pass next time. change_log is pruned after
+// changeLogRetention; a client whose cursor predates that gets reset and must reload in full.
+
+const (
+	changeLogRetention = 30 * 24 * time.Hour
+	changesPageSize    = 5000
+)
+
+// changeLogTriggers builds the triggers feeding change_log. They run after the ensureColumn
+// migrations because they read stats.company_id.
+func changeLogTriggers() string {
+	var b strings.Builder
+	company := func(row string) string {
+		return fmt.Sprintf("(SELECT company_id FROM stats WHERE id = %s.stat_id)", row)
+	}
+	for _, t := range []struct{ table, kind, key string }{
+		{"weekly_stats", "weekly", "week_ending"},
+		{"daily_stats", "daily", "date"},
+		{"stat_quotas", "quota", "week_ending"},
+	} {
+		for _, op := range []string{"INSERT", "UPDATE", "DELETE"} {
+			row := "NEW"
+			if op == "DELETE" {
+				row = "OLD"
+			}
+			fmt.Fprintf(&b, "CREATE TRIGGER IF NOT EXISTS change_log_%s_%s AFTER %s ON %s BEGIN\n", t.table, strings.ToLower(op), op, t.table)
+			fmt.Fprintf(&b, "\tINSERT INTO change_log (company_id, kind, stat_id, key) VALUES (%s, '%s', %s.stat_id, %s.%s);\n",
+				company(row), t.kind, row, row, t.key)
+			if op == "UPDATE" {
+				// A row moved to another stat or week also changed where it was.
+				fmt.Fprintf(&b, "\tINSERT INTO change_log (company_id, kind, stat_id, key) SELECT %s, '%s', OLD.stat_id, OLD.%s WHERE OLD.stat_id != NEW.stat_id OR OLD.%s != NEW.%s;\n",
+					company("OLD"), t.kind, t.key, t.key, t.key)
+			}
+			b.WriteString("END;\n")
+		}
+	}
+	for _, op := range []string{"INSERT", "UPDATE", "DELETE"} {
+		row := "NEW"
+		if op == "DELETE" {
+			row = "OLD"
+		}
+		fmt.Fprintf(&b, "CREATE TRIGGER IF NOT EXISTS change_log_stats_%s AFTER %s ON stats BEGIN\n", strings.ToLower(op), op)
+		fmt.Fprintf(&b, "\tINSERT INTO change_log (company_id, kind, stat_id, key) VALUES (%s.company_id, 'stat', %s.id, '');\nEND;\n", row, row)
+	}
+	return b.String()
+}
+
+// pruneChangeLog drops change_log rows older than the retention.
+func pruneChangeLog() error {
+	_, err := DB.Exec(`DELETE FROM change_log WHERE changed_at < ?`, time.Now().UTC().Add(-changeLogRetention).Format(time.RFC3339))
+	return err
+}
+
+type changedStat struct {
+	ID                 int    `json:"id"`
+	ShortID            string `json:"short_id"`
+	FullName           string `json:"full_name"`
+	Type               string `json:"type"`
+	ValueType          string `json:"value_type"`
+	Reversed           bool   `json:"reversed"`
+	AssignedUserID     *int   `json:"assigned_user_id"`
+	AssignedDivisionID *int   `json:"assigned_division_id"`
+	IsCalculated       bool   `json:"is_calculated"`
+}
+
+type changedValue struct {
+	StatID     int    `json:"stat_id"`
+	WeekEnding string `json:"week_ending,omitempty"`
+	Date       string `json:"date,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	UpdatedAt  string `json:"updated_at,omitempty"`
+}
+
+// parseChangesCursor accepts a cursor from a previous response or an RFC3339 time / YYYY-MM-DD
+// date, which is turned into the cursor just before that moment. A time older than the retained log
+// gives -1: the changes since then are no longer known.
+func parseChangesCursor(since string) (int64, error) {
+	if n, err := strconv.ParseInt(since, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", since); err != nil {
+			return 0, err
+		}
+	}
+	if t.Before(time.Now().Add(-changeLogRetention)) {
+		return -1, nil
+	}
+	var cursor int64
+	err = DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM change_log WHERE changed_at < ?`, t.UTC().Format(time.RFC3339)).Scan(&cursor)
+	return cursor, err
+}
+
+// writeChangesSince answers GET /api/changes?since=... (see ChangesHandler).
+func writeChangesSince(w http.ResponseWriter, companyDBID int, since string) {
+	cursor, err := parseChangesCursor(since)
+	if err != nil {
+		http.Error(w, `{"message":"since must be a cursor, an RFC3339 time or YYYY-MM-DD"}`, http.StatusBadRequest)
+		return
+	}
+	// latest bounds this response so rows written while it is built are picked up by the next one.
+	var latest, oldest int64
+	if err := DB.QueryRow(`
+		SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'change_log'), 0),
+		       COALESCE((SELECT MIN(id) FROM change_log), (SELECT seq + 1 FROM sqlite_sequence WHERE name = 'change_log'), 1)
+	`).Scan(&latest, &oldest); err != nil {
+		webFail("Failed to read change log", w, err)
+		return
+	}
+	// Rows are only ever removed by pruning, so a gap after the cursor means changes were lost.
+	if cursor < 0 || (cursor > 0 && cursor+1 < oldest) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"cursor": strconv.FormatInt(latest, 10), "reset": true})
+		return
+	}
+
+	rows, err := DB.Query(`SELECT id, kind, stat_id, key FROM change_log WHERE company_id = ? AND id > ? AND id <= ? ORDER BY id LIMIT ?`,
+		companyDBID, cursor, latest, changesPageSize)
+	if err != nil {
+		webFail("Failed to query change log", w, err)
+		return
+	}
+	type change struct {
+		kind   string
+		statID int
+		key    string
+	}
+	var touched []change
+	seen := map[change]bool{}
+	next, n := cursor, 0
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&next, &c.kind, &c.statID, &c.key); err != nil {
+			rows.Close()
+			webFail("Failed to scan change log", w, err)
+			return
+		}
+		n++
+		if !seen[c] {
+			seen[c] = true
+			touched = append(touched, c)
+		}
+	}
+	rows.Close()
+	if n < changesPageSize {
+		// Nothing newer for this company: move the cursor past other companies' changes too.
+		next = latest
+	}
+
+	stats, weekly, daily, quotas := []changedStat{}, []changedValue{}, []changedValue{}, []changedValue{}
+	deletedStats := []int{}
+	deletedWeekly, deletedDaily, deletedQuotas := []changedValue{}, []changedValue{}, []changedValue{}
+	type statKind struct{ valueType, currency string }
+	kinds := map[int]statKind{}
+	formatValue := func(statID int, v int64) string {
+		k, ok := kinds[statID]
+		if !ok {
+			DB.QueryRow(`SELECT value_type FROM stats WHERE id = ?`, statID).Scan(&k.valueType)
+			k.currency = statCurrency(statID)
+			kinds[statID] = k
+		}
+		return formatStatValue(v, k.valueType, k.currency)
+	}
+	for _, c := range touched {
+		switch c.kind {
+		case "stat":
+			var s changedStat
+			var user, div sql.NullInt64
+			err := DB.QueryRow(`
+				SELECT id, short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated
+				FROM stats WHERE id = ? AND company_id = ?
+			`, c.statID, companyDBID).Scan(&s.ID, &s.ShortID, &s.FullName, &s.Type, &s.ValueType, &s.Reversed, &user, &div, &s.IsCalculated)
+			if err == sql.ErrNoRows {
+				deletedStats = append(deletedStats, c.statID)
+				continue
+			} else if err != nil {
+				webFail("Failed to load changed stat", w, err)
+				return
+			}
+			if user.Valid {
+				v := int(user.Int64)
+				s.AssignedUserID = &v
+			}
+			if div.Valid {
+				v := int(div.Int64)
+				s.AssignedDivisionID = &v
+			}
+			stats = append(stats, s)
+		case "weekly", "quota":
+			query := `SELECT value, version, COALESCE(updated_at, submitted_at, '') FROM weekly_stats WHERE stat_id = ? AND week_ending = ? ORDER BY id DESC LIMIT 1`
+			if c.kind == "quota" {
+				query = `SELECT value, 0, '' FROM stat_quotas WHERE stat_id = ? AND week_ending = ?`
+			}
+			v := changedValue{StatID: c.statID, WeekEnding: c.key}
+			var value int64
+			err := DB.QueryRow(query, c.statID, c.key).Scan(&value, &v.Version, &v.UpdatedAt)
+			switch {
+			case err == sql.ErrNoRows && c.kind == "weekly":
+				deletedWeekly = append(deletedWeekly, v)
+			case err == sql.ErrNoRows:
+				deletedQuotas = append(deletedQuotas, v)
+			case err != nil:
+				webFail("Failed to load changed value", w, err)
+				return
+			case c.kind == "weekly":
+				v.Value = formatValue(c.statID, value)
+				weekly = append(weekly, v)
+			default:
+				v.Value = formatValue(c.statID, value)
+				quotas = append(quotas, v)
+			}
+		case "daily":
+			v := changedValue{StatID: c.statID, Date: c.key}
+			var value int64
+			err := DB.QueryRow(`SELECT value, version, COALESCE(updated_at, '') FROM daily_stats WHERE stat_id = ? AND date = ? LIMIT 1`,
+				c.statID, c.key).Scan(&value, &v.Version, &v.UpdatedAt)
+			if err == sql.ErrNoRows {
+				deletedDaily = append(deletedDaily, v)
+				continue
+			} else if err != nil {
+				webFail("Failed to load changed value", w, err)
+				return
+			}
+			v.Value = formatValue(c.statID, value)
+			daily = append(daily, v)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cursor":  strconv.FormatInt(next, 10),
+		"more":    n == changesPageSize,
+		"stats":   stats,
+		"weekly":  weekly,
+		"daily":   daily,
+		"quotas":  quotas,
+		"deleted": map[string]interface{}{"stats": deletedStats, "weekly": deletedWeekly, "daily": deletedDaily, "quotas": deletedQuotas},
+	})
+}
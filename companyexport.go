@@ -0,0 +1,614 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Portable company export: GET /api/company/export streams a ZIP with one file per table (JSON
+// arrays by default, CSV with ?format=csv) and a manifest.json, for customers taking their data
+// elsewhere or keeping an offline copy. Unlike the SQLite archive (GET /api/admin/company-db) it only
+// holds the structure and values, with stable column names, and leaves out password hashes. Ids are
+// this instance's database ids; files reference each other through them. Values are in their stored
+// integer form (cents for currency, hundredths for percentage, ten-thousandths for decimal and
+// ratio, see valuetypes.go), as in the rest of the API.
+// POST /api/company/import loads such an archive into a new, empty company.
+
+const companyExportFormat = 1
+
+type companyExportFile struct {
+	Name  string
+	Query string // selects the company's rows, with ? bound to the company db id
+}
+
+var companyExportFiles = []companyExportFile{
+	{"users", `SELECT id, username, role, email FROM users WHERE company_id = ? ORDER BY id`},
+	{"divisions", `SELECT id, name FROM divisions WHERE company_id = ? ORDER BY id`},
+	{"stats", `SELECT id, short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated, calc_operator, decimal_places,
+		unit_label, thousands_separator, currency, deleted_at
+		FROM stats WHERE company_id = ? ORDER BY id`},
+	{"stat_calculations", `SELECT c.stat_id, c.dependent_stat_id, c.sign, c.divisor
+		FROM stat_calculations c JOIN stats s ON s.id = c.stat_id WHERE s.company_id = ? ORDER BY c.stat_id, c.dependent_stat_id`},
+	{"stat_user_assignments", `SELECT a.stat_id, a.user_id
+		FROM stat_user_assignments a JOIN stats s ON s.id = a.stat_id WHERE s.company_id = ? ORDER BY a.stat_id, a.user_id`},
+	{"stat_division_assignments", `SELECT a.stat_id, a.division_id
+		FROM stat_division_assignments a JOIN stats s ON s.id = a.stat_id WHERE s.company_id = ? ORDER BY a.stat_id, a.division_id`},
+	{"stat_quotas", `SELECT q.stat_id, q.week_ending, q.value
+		FROM stat_quotas q JOIN stats s ON s.id = q.stat_id WHERE s.company_id = ? ORDER BY q.stat_id, q.week_ending`},
+	{"weekly_stats", `SELECT w.id, w.stat_id, w.week_ending, w.value, w.numerator, w.denominator, w.author_user_id, w.submitted_at, w.updated_at
+		FROM weekly_stats w JOIN stats s ON s.id = w.stat_id WHERE s.company_id = ? ORDER BY w.stat_id, w.week_ending`},
+	{"daily_stats", `SELECT d.id, d.stat_id, d.date, d.value, d.numerator, d.denominator, d.author_user_id, d.updated_at
+		FROM daily_stats d JOIN stats s ON s.id = d.stat_id WHERE s.company_id = ? ORDER BY d.stat_id, d.date, d.id`},
+}
+
+type companyExportManifest struct {
+	Format     int            `json:"format"`
+	CompanyID  string         `json:"company_id"`
+	Name       string         `json:"name"`
+	ExportedAt string         `json:"exported_at"`
+	FileFormat string         `json:"file_format"`
+	Rows       map[string]int `json:"rows"`
+}
+
+// ---------- GET /api/company/export?format=json|csv ----------
+func CompanyExportHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.Context().Value("company_id").(string)
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, `{"message":"format must be json or csv"}`, http.StatusBadRequest)
+		return
+	}
+	manifest := companyExportManifest{
+		Format:     companyExportFormat,
+		CompanyID:  code,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		FileFormat: format,
+		Rows:       map[string]int{},
+	}
+	var companyDBID int
+	if err := DB.QueryRow(`SELECT id, name FROM companies WHERE company_id = ?`, code).Scan(&companyDBID, &manifest.Name); err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	// A read transaction keeps the files consistent with each other while they are written.
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start export", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	name := fmt.Sprintf("stathq-%s-%s.zip", strings.ToLower(code), time.Now().UTC().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
+	zw := zip.NewWriter(w)
+	for _, f := range companyExportFiles {
+		fw, err := zw.Create(f.Name + "." + format)
+		if err != nil {
+			log.Printf("Company export %s: %v", code, err)
+			return
+		}
+		n, err := writeExportFile(tx, fw, format, f.Query, companyDBID)
+		if err != nil {
+			// Headers are already sent; the truncated archive fails to open on the client.
+			log.Printf("Company export %s: writing %s: %v", code, f.Name, err)
+			return
+		}
+		manifest.Rows[f.Name] = n
+	}
+	fw, err := zw.Create("manifest.json")
+	if err == nil {
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Company export %s: %v", code, err)
+		return
+	}
+	log.Printf("Company %s exported by user %v (%s)", code, r.Context().Value("user_id"), format)
+}
+
+// writeExportFile writes the rows of query to w as a JSON array of objects or as CSV with a header
+// row, and returns the number of rows written.
+func writeExportFile(tx *sql.Tx, w io.Writer, format, query string, args ...interface{}) (int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		cw.Write(cols)
+	} else {
+		io.WriteString(w, "[")
+	}
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if cw != nil {
+			rec := make([]string, len(cols))
+			for i, v := range vals {
+				rec[i] = exportCell(v)
+			}
+			if err := cw.Write(rec); err != nil {
+				return n, err
+			}
+		} else {
+			obj := make(map[string]interface{}, len(cols))
+			for i, v := range vals {
+				if b, ok := v.([]byte); ok {
+					v = string(b)
+				}
+				obj[cols[i]] = v
+			}
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return n, err
+			}
+			if n > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, "\n")
+			if _, err := w.Write(b); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if cw != nil {
+		cw.Flush()
+		return n, cw.Error()
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return n, err
+}
+
+// exportCell formats a database value for CSV; NULL is the empty string.
+func exportCell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return t.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+// ---------- POST /api/company/import ----------
+// Body: a ZIP from GET /api/company/export, raw or as the "file" field of a multipart form. The
+// archive is loaded into the caller's company, which must not have any divisions or stats yet.
+// Users are matched by username; archive users missing here are created with a random password for
+// an admin to reset. Every id is remapped and every reference is checked before anything is written,
+// and the whole import is one transaction.
+func CompanyImportHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.Context().Value("company_id").(string)
+	companyDBID, err := companyDBID(code)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var existing int
+	if err := DB.QueryRow(`SELECT (SELECT COUNT(*) FROM stats WHERE company_id = ?) + (SELECT COUNT(*) FROM divisions WHERE company_id = ?)`,
+		companyDBID, companyDBID).Scan(&existing); err != nil {
+		webFail("Failed to check company", w, err)
+		return
+	}
+	if existing > 0 {
+		http.Error(w, `{"message":"archives can only be imported into a company without divisions or stats"}`, http.StatusConflict)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(envInt("STATHQ_IMPORT_MAX_MB", 512))<<20)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, `{"message":"multipart upload must include a file field"}`, http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	tmp, err := os.CreateTemp("", "stathq-export-*.zip")
+	if err != nil {
+		webFail("Failed to store archive", w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		http.Error(w, `{"message":"Failed to read archive"}`, http.StatusBadRequest)
+		return
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		http.Error(w, `{"message":"archive is not a ZIP file"}`, http.StatusBadRequest)
+		return
+	}
+	archive, err := readCompanyExport(zr)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Invalid archive", "details": err.Error()})
+		return
+	}
+	if problems := archive.validate(); len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Archive references are inconsistent", "errors": problems})
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start import", w, err)
+		return
+	}
+	defer tx.Rollback()
+	result, err := archive.load(tx, companyDBID)
+	if err != nil {
+		log.Printf("Company import into %s failed: %v", code, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Import failed", "details": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit import", w, err)
+		return
+	}
+	for _, row := range archive.files["weekly_stats"] {
+		statID := int(result.IDMap["stats"][row.int("stat_id")])
+		if err := markAggregatesDirty(DB, statID, row["week_ending"]); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+		}
+	}
+	log.Printf("User %v imported %s's export into company %s", r.Context().Value("username"), archive.manifest.CompanyID, code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// exportRow is one row of an export file, with NULL as the empty string.
+type exportRow map[string]string
+
+func (r exportRow) int(col string) int64 {
+	n, _ := strconv.ParseInt(r[col], 10, 64)
+	return n
+}
+
+func (r exportRow) bool(col string) bool {
+	return r[col] == "1" || r[col] == "true"
+}
+
+// null returns the column for an INSERT, nil when it is empty.
+func (r exportRow) null(col string) interface{} {
+	if r[col] == "" {
+		return nil
+	}
+	return r[col]
+}
+
+type companyExportArchive struct {
+	manifest companyExportManifest
+	files    map[string][]exportRow
+}
+
+type companyExportImport struct {
+	SourceCompany string                     `json:"source_company"`
+	Rows          map[string]int             `json:"rows"`
+	IDMap         map[string]map[int64]int64 `json:"id_map"`
+	CreatedUsers  []string                   `json:"created_users"`
+}
+
+// readCompanyExport reads the manifest and every export file from an archive.
+func readCompanyExport(zr *zip.Reader) (*companyExportArchive, error) {
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	mf, ok := entries["manifest.json"]
+	if !ok {
+		return nil, fmt.Errorf("manifest.json is missing")
+	}
+	a := &companyExportArchive{files: map[string][]exportRow{}}
+	rc, err := mf.Open()
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(rc).Decode(&a.manifest)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("manifest.json: %v", err)
+	}
+	if a.manifest.Format != companyExportFormat {
+		return nil, fmt.Errorf("unsupported export format %d", a.manifest.Format)
+	}
+	format := a.manifest.FileFormat
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unsupported file format %q", format)
+	}
+	for _, spec := range companyExportFiles {
+		f, ok := entries[spec.Name+"."+format]
+		if !ok {
+			return nil, fmt.Errorf("%s.%s is missing", spec.Name, format)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := readExportFile(rc, format)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", spec.Name, format, err)
+		}
+		a.files[spec.Name] = rows
+	}
+	return a, nil
+}
+
+// readExportFile parses a file written by writeExportFile.
+func readExportFile(r io.Reader, format string) ([]exportRow, error) {
+	var out []exportRow
+	if format == "csv" {
+		in := csv.NewReader(r)
+		header, err := in.Read()
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for {
+			rec, err := in.Read()
+			if err == io.EOF {
+				return out, nil
+			} else if err != nil {
+				return nil, err
+			}
+			row := exportRow{}
+			for i, col := range header {
+				row[col] = rec[i]
+			}
+			out = append(out, row)
+		}
+	}
+	var objs []map[string]interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&objs); err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		row := exportRow{}
+		for col, v := range obj {
+			switch t := v.(type) {
+			case nil:
+				row[col] = ""
+			case string:
+				row[col] = t
+			case json.Number:
+				row[col] = t.String()
+			case bool:
+				row[col] = exportCell(t)
+			default:
+				return nil, fmt.Errorf("column %s holds a %T", col, v)
+			}
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+// validate checks that every id referenced in the archive is defined in it, and returns one message
+// per dangling or duplicate reference.
+func (a *companyExportArchive) validate() []string {
+	var problems []string
+	defined := map[string]map[string]bool{}
+	for _, file := range []string{"users", "divisions", "stats"} {
+		defined[file] = map[string]bool{}
+		for i, row := range a.files[file] {
+			id := row["id"]
+			if id == "" || defined[file][id] {
+				problems = append(problems, fmt.Sprintf("%s row %d: missing or duplicate id %q", file, i+1, id))
+			}
+			defined[file][id] = true
+		}
+	}
+	check := func(file string, i int, row exportRow, col, target string, required bool) {
+		v := row[col]
+		if v == "" {
+			if required {
+				problems = append(problems, fmt.Sprintf("%s row %d: %s is empty", file, i+1, col))
+			}
+			return
+		}
+		if !defined[target][v] {
+			problems = append(problems, fmt.Sprintf("%s row %d: %s %s is not in %s", file, i+1, col, v, target))
+		}
+	}
+	for file, refs := range map[string][][3]string{
+		"stats":                     {{"assigned_user_id", "users", ""}, {"assigned_division_id", "divisions", ""}},
+		"stat_calculations":         {{"stat_id", "stats", "required"}, {"dependent_stat_id", "stats", "required"}},
+		"stat_user_assignments":     {{"stat_id", "stats", "required"}, {"user_id", "users", ""}},
+		"stat_division_assignments": {{"stat_id", "stats", "required"}, {"division_id", "divisions", ""}},
+		"stat_quotas":               {{"stat_id", "stats", "required"}},
+		"weekly_stats":              {{"stat_id", "stats", "required"}, {"author_user_id", "users", ""}},
+		"daily_stats":               {{"stat_id", "stats", "required"}, {"author_user_id", "users", ""}},
+	} {
+		for i, row := range a.files[file] {
+			for _, ref := range refs {
+				check(file, i, row, ref[0], ref[1], ref[2] != "")
+			}
+		}
+	}
+	return problems
+}
+
+// load writes the archive into the company inside tx, returning the row counts and id mapping.
+func (a *companyExportArchive) load(tx *sql.Tx, companyDBID int) (*companyExportImport, error) {
+	res := &companyExportImport{
+		SourceCompany: a.manifest.CompanyID,
+		Rows:          map[string]int{},
+		IDMap:         map[string]map[int64]int64{"users": {}, "divisions": {}, "stats": {}},
+		CreatedUsers:  []string{},
+	}
+	users, divisions, stats := res.IDMap["users"], res.IDMap["divisions"], res.IDMap["stats"]
+	ref := func(m map[int64]int64, row exportRow, col string) interface{} {
+		if row[col] == "" {
+			return nil
+		}
+		return m[row.int(col)]
+	}
+	insert := func(file, query string, args ...interface{}) (int64, error) {
+		r, err := tx.Exec(query, args...)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", file, err)
+		}
+		res.Rows[file]++
+		return r.LastInsertId()
+	}
+
+	for _, row := range a.files["users"] {
+		username := strings.ToLower(strings.TrimSpace(row["username"]))
+		var id int64
+		err := tx.QueryRow(`SELECT id FROM users WHERE company_id = ? AND username = ?`, companyDBID, username).Scan(&id)
+		if err == sql.ErrNoRows {
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				return nil, err
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(buf)), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, err
+			}
+			if id, err = insert("users", `INSERT INTO users (company_id, username, password_hash, role, email) VALUES (?, ?, ?, ?, ?)`,
+				companyDBID, username, string(hash), row["role"], row.null("email")); err != nil {
+				return nil, err
+			}
+			res.CreatedUsers = append(res.CreatedUsers, username)
+		} else if err != nil {
+			return nil, err
+		}
+		users[row.int("id")] = id
+	}
+	for _, row := range a.files["divisions"] {
+		id, err := insert("divisions", `INSERT INTO divisions (name, company_id) VALUES (?, ?)`, row["name"], companyDBID)
+		if err != nil {
+			return nil, err
+		}
+		divisions[row.int("id")] = id
+	}
+	for _, row := range a.files["stats"] {
+		op := row["calc_operator"]
+		if op == "" {
+			op = calcOpSum // exports from before operators
+		}
+		id, err := insert("stats", `
+			INSERT INTO stats (short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated, calc_operator,
+				decimal_places, unit_label, thousands_separator, currency, deleted_at, company_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, row["short_id"], row["full_name"], row["type"], row["value_type"], row.bool("reversed"),
+			ref(users, row, "assigned_user_id"), ref(divisions, row, "assigned_division_id"), row.bool("is_calculated"), op,
+			row.null("decimal_places"), row.null("unit_label"), row["thousands_separator"] == "" || row.bool("thousands_separator"), row.null("currency"), row.null("deleted_at"), companyDBID)
+		if err != nil {
+			return nil, err
+		}
+		stats[row.int("id")] = id
+	}
+	for _, row := range a.files["stat_calculations"] {
+		if _, err := insert("stat_calculations", `INSERT INTO stat_calculations (stat_id, dependent_stat_id, sign, divisor) VALUES (?, ?, ?, ?)`,
+			stats[row.int("stat_id")], stats[row.int("dependent_stat_id")], row.int("sign"), row.int("divisor")); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range a.files["stat_user_assignments"] {
+		if row["user_id"] == "" {
+			continue
+		}
+		if _, err := insert("stat_user_assignments", `INSERT INTO stat_user_assignments (stat_id, user_id) VALUES (?, ?)`,
+			stats[row.int("stat_id")], users[row.int("user_id")]); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range a.files["stat_division_assignments"] {
+		if row["division_id"] == "" {
+			continue
+		}
+		if _, err := insert("stat_division_assignments", `INSERT INTO stat_division_assignments (stat_id, division_id) VALUES (?, ?)`,
+			stats[row.int("stat_id")], divisions[row.int("division_id")]); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range a.files["stat_quotas"] {
+		if _, err := insert("stat_quotas", `INSERT INTO stat_quotas (stat_id, week_ending, value) VALUES (?, ?, ?)`,
+			stats[row.int("stat_id")], row["week_ending"], row.int("value")); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range a.files["weekly_stats"] {
+		if _, err := insert("weekly_stats", `INSERT INTO weekly_stats (stat_id, week_ending, value, numerator, denominator, author_user_id, submitted_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			stats[row.int("stat_id")], row["week_ending"], row.int("value"), row.null("numerator"), row.null("denominator"), ref(users, row, "author_user_id"),
+			row.null("submitted_at"), row.null("updated_at")); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range a.files["daily_stats"] {
+		if _, err := insert("daily_stats", `INSERT INTO daily_stats (stat_id, date, value, numerator, denominator, author_user_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			stats[row.int("stat_id")], row["date"], row.int("value"), row.null("numerator"), row.null("denominator"), ref(users, row, "author_user_id"), row.null("updated_at")); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cross-instance company migration. The archive is the per-company database written by
+// exportCompanyShard (GET /api/admin/company-db, -export-company): the same schema holding one
+// company's structure, values and audit trail, plus a stathq_archive table describing the export.
+//
+// POST /api/admin/import-company (or -import-company) loads an archive as a new company. Row ids are
+// reassigned, since the destination already uses them; every reference is rewritten through the
+// mapping and the old -> new ids per table are returned and kept in company_imports as the manifest,
+// so integrations holding ids from the old instance can translate them.
+//
+// References are found from the destination schema's foreign keys and, for columns declared
+// without one, from their names (stat_id, *_user_id, ...), so tables added later need no changes.
+// Importing is disabled unless STATHQ_COMPANY_IMPORT=true, and over HTTP it is for super-admins.
+//
+// Only tables holding one company's rows (those shardFilter scopes) are read from the archive; the
+// installation's own tables (plans, invites, ...) are never written by an import. Billing, the trial
+// and the invite a company registered with belong to the instance, so they start afresh: the
+// imported company is on the free plan, with no trial and no invite.
+
+const companyArchiveFormat = 1
+
+// importSkipTables are company tables the instance manages itself (live logins stay where they
+// were made, as in exportCompanyShard); importResetColumns are columns set to NULL instead of taken
+// from the archive.
+var importSkipTables = map[string]bool{"company_billing": true, "company_trials": true, "sessions": true}
+
+var importResetColumns = map[string]bool{"companies.invite_id": true}
+
+var errCompanyExists = errors.New("a company with this code already exists")
+
+type companyImportManifest struct {
+	Format        int                         `json:"format"`
+	SourceCompany string                      `json:"source_company"`
+	Source        string                      `json:"source,omitempty"`
+	ExportedAt    string                      `json:"exported_at,omitempty"`
+	CompanyID     string                      `json:"company_id"`
+	CompanyDBID   int64                       `json:"company_db_id"`
+	Rows          map[string]int              `json:"rows"`
+	IDMap         map[string]map[string]int64 `json:"id_map"`
+	Warnings      []string                    `json:"warnings,omitempty"`
+}
+
+// writeArchiveInfo records the archive format and origin in an exported company database.
+func writeArchiveInfo(ctx context.Context, conn *sql.Conn, companyDBID int) error {
+	var code string
+	if err := conn.QueryRowContext(ctx, `SELECT company_id FROM main.companies WHERE id = ?`, companyDBID).Scan(&code); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE shard.stathq_archive (format INTEGER NOT NULL, company_code TEXT NOT NULL, exported_at TEXT NOT NULL, source TEXT NOT NULL)`); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, `INSERT INTO shard.stathq_archive VALUES (?, ?, ?, ?)`,
+		companyArchiveFormat, code, time.Now().UTC().Format(time.RFC3339), envString("STATHQ_INSTANCE_NAME", host))
+	return err
+}
+
+type importColumn struct {
+	name     string
+	ref      string // referenced table, "" when the column is plain data
+	identity bool   // INTEGER PRIMARY KEY reassigned on insert
+}
+
+// importRefTable guesses the table a column without a declared foreign key points at.
+func importRefTable(table, column string) string {
+	switch {
+	case column == "company_id":
+		if table == "companies" {
+			return "" // the public company code
+		}
+		return "companies"
+	case column == "stat_id" || column == "dependent_stat_id":
+		return "stats"
+	case column == "user_id" || strings.HasSuffix(column, "_user_id"):
+		return "users"
+	case column == "division_id" || strings.HasSuffix(column, "_division_id"):
+		return "divisions"
+	case column == "condition_id":
+		return "stat_conditions"
+	case column == "family_id":
+		return "api_token_families"
+	case column == "invite_id":
+		return "registration_invites"
+	}
+	return ""
+}
+
+// importColumns lists the columns table shares between the archive and this database.
+func importColumns(ctx context.Context, conn *sql.Conn, table string) ([]importColumn, error) {
+	info := func(schema string) (map[string][2]string, []string, error) {
+		rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA %s.table_info(%s)", schema, table))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		cols := map[string][2]string{}
+		var order []string
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, colType string
+			var dflt sql.NullString
+			if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+				return nil, nil, err
+			}
+			cols[name] = [2]string{strings.ToUpper(colType), strconv.Itoa(pk)}
+			order = append(order, name)
+		}
+		return cols, order, rows.Err()
+	}
+	dest, order, err := info("main")
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := info("src")
+	if err != nil {
+		return nil, err
+	}
+	fks := map[string]string{}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA main.foreign_key_list(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, seq int
+		var refTable, from string
+		var to, onUpdate, onDelete, match sql.NullString
+		if err := rows.Scan(&id, &seq, &refTable, &from, &to, &onUpdate, &onDelete, &match); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fks[from] = refTable
+	}
+	rows.Close()
+
+	pks := 0
+	for _, c := range dest {
+		if c[1] != "0" {
+			pks++
+		}
+	}
+	var cols []importColumn
+	for _, name := range order {
+		if _, ok := src[name]; !ok {
+			continue
+		}
+		c := importColumn{name: name, ref: fks[name]}
+		if c.ref == "" {
+			c.ref = importRefTable(table, name)
+		}
+		c.identity = pks == 1 && dest[name][1] == "1" && dest[name][0] == "INTEGER" && c.ref == ""
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// importCompanyArchive loads the archive at path as a new company, under newCode when given.
+func importCompanyArchive(path, newCode string) (*companyImportManifest, error) {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, path); err != nil {
+		return nil, fmt.Errorf("not a StatHQ company archive: %v", err)
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+
+	m := &companyImportManifest{Format: companyArchiveFormat, Rows: map[string]int{}, IDMap: map[string]map[string]int64{}}
+	var hasInfo int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM src.sqlite_master WHERE type = 'table' AND name = 'stathq_archive'`).Scan(&hasInfo); err != nil {
+		return nil, fmt.Errorf("not a StatHQ company archive: %v", err)
+	}
+	if hasInfo > 0 {
+		if err := conn.QueryRowContext(ctx, `SELECT format, source, exported_at FROM src.stathq_archive`).Scan(&m.Format, &m.Source, &m.ExportedAt); err != nil {
+			return nil, err
+		}
+		if m.Format > companyArchiveFormat {
+			return nil, fmt.Errorf("archive format %d is newer than this instance supports (%d)", m.Format, companyArchiveFormat)
+		}
+	}
+	var srcCompanies int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MAX(company_id), '') FROM src.companies`).Scan(&srcCompanies, &m.SourceCompany); err != nil {
+		return nil, fmt.Errorf("not a StatHQ company archive: %v", err)
+	}
+	if srcCompanies != 1 {
+		return nil, fmt.Errorf("archive holds %d companies, expected 1", srcCompanies)
+	}
+	m.CompanyID = m.SourceCompany
+	if newCode != "" {
+		m.CompanyID = newCode
+	}
+	var exists int
+	conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM main.companies WHERE company_id = ?`, m.CompanyID).Scan(&exists)
+	if exists > 0 {
+		return nil, errCompanyExists
+	}
+
+	var tables []string
+	rows, err := conn.QueryContext(ctx, `
+		SELECT s.name FROM src.sqlite_master s
+		WHERE s.type = 'table' AND s.name NOT LIKE 'sqlite_%' AND s.name NOT IN ('stathq_archive', 'change_log')
+		  AND s.name IN (SELECT name FROM main.sqlite_master WHERE type = 'table')
+		ORDER BY (SELECT rowid FROM main.sqlite_master WHERE type = 'table' AND name = s.name)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	for _, name := range names {
+		if importSkipTables[name] {
+			continue
+		}
+		if filter, err := shardFilter(conn, name); err != nil {
+			return nil, err
+		} else if filter != "" {
+			tables = append(tables, name)
+		}
+	}
+	imported := map[string]bool{}
+	for _, t := range tables {
+		imported[t] = false
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// References to tables later in the order are patched at the end; check keys only then.
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return nil, err
+	}
+	type deferredRef struct {
+		table, column, ref string
+		rowid, old         int64
+	}
+	var pending []deferredRef
+	unmapped := map[string]int{}
+	mapped := func(ref string, old int64) (int64, bool) {
+		v, ok := m.IDMap[ref][strconv.FormatInt(old, 10)]
+		return v, ok
+	}
+
+	for _, table := range tables {
+		cols, err := importColumns(ctx, conn, table)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+		var names, insertNames, marks []string
+		identity := -1
+		for i, c := range cols {
+			names = append(names, c.name)
+			if c.identity {
+				identity = i
+				continue
+			}
+			insertNames = append(insertNames, c.name)
+			marks = append(marks, "?")
+		}
+		if len(insertNames) == 0 {
+			continue
+		}
+		srcRows, err := tx.Query(fmt.Sprintf(`SELECT %s FROM src.%s ORDER BY rowid`, strings.Join(names, ", "), table))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", table, err)
+		}
+		var all [][]interface{}
+		for srcRows.Next() {
+			vals := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+			if err := srcRows.Scan(ptrs...); err != nil {
+				srcRows.Close()
+				return nil, err
+			}
+			all = append(all, vals)
+		}
+		srcRows.Close()
+
+		insert := fmt.Sprintf(`INSERT INTO main.%s (%s) VALUES (%s)`, table, strings.Join(insertNames, ", "), strings.Join(marks, ", "))
+		for _, vals := range all {
+			var args []interface{}
+			var later []deferredRef
+			for i, c := range cols {
+				if c.identity {
+					continue
+				}
+				v := vals[i]
+				if table == "companies" && c.name == "company_id" {
+					v = m.CompanyID
+				} else if importResetColumns[table+"."+c.name] {
+					v = nil
+				} else if old, ok := v.(int64); ok && c.ref != "" && old != 0 {
+					if n, ok := mapped(c.ref, old); ok {
+						v = n
+					} else if done, inArchive := imported[c.ref]; inArchive && !done {
+						later = append(later, deferredRef{table: table, column: c.name, ref: c.ref, old: old})
+					} else {
+						v = nil
+						unmapped[table+"."+c.name]++
+					}
+				}
+				args = append(args, v)
+			}
+			res, err := tx.Exec(insert, args...)
+			if err != nil {
+				return nil, fmt.Errorf("importing %s: %v", table, err)
+			}
+			rowid, _ := res.LastInsertId()
+			for _, d := range later {
+				d.rowid = rowid
+				pending = append(pending, d)
+			}
+			if identity >= 0 {
+				if old, ok := vals[identity].(int64); ok {
+					if m.IDMap[table] == nil {
+						m.IDMap[table] = map[string]int64{}
+					}
+					m.IDMap[table][strconv.FormatInt(old, 10)] = rowid
+				}
+			}
+			m.Rows[table]++
+		}
+		imported[table] = true
+	}
+	for _, d := range pending {
+		var v interface{}
+		if n, ok := mapped(d.ref, d.old); ok {
+			v = n
+		} else {
+			unmapped[d.table+"."+d.column]++
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE main.%s SET %s = ? WHERE rowid = ?`, d.table, d.column), v, d.rowid); err != nil {
+			return nil, fmt.Errorf("linking %s.%s: %v", d.table, d.column, err)
+		}
+	}
+	for col, n := range unmapped {
+		m.Warnings = append(m.Warnings, fmt.Sprintf("%s: %d references to rows outside the archive were cleared", col, n))
+	}
+
+	if err := tx.QueryRow(`SELECT id FROM main.companies WHERE company_id = ?`, m.CompanyID).Scan(&m.CompanyDBID); err != nil {
+		return nil, err
+	}
+	manifest, _ := json.Marshal(m)
+	if _, err := tx.Exec(`INSERT INTO main.company_imports (company_id, source_company, source, imported_at, manifest) VALUES (?, ?, ?, ?, ?)`,
+		m.CompanyDBID, m.SourceCompany, m.Source, time.Now().UTC().Format(time.RFC3339), string(manifest)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("archive is inconsistent: %v", err)
+	}
+	return m, nil
+}
+
+// importCompanyFromCLI is the -import-company entry point.
+func importCompanyFromCLI(path, newCode string) error {
+	m, err := importCompanyArchive(path, newCode)
+	if err != nil {
+		return err
+	}
+	var parts []string
+	for table, n := range m.Rows {
+		parts = append(parts, fmt.Sprintf("%s=%d", table, n))
+	}
+	log.Printf("Imported company %s as %s (%s)", m.SourceCompany, m.CompanyID, strings.Join(parts, ", "))
+	for _, w := range m.Warnings {
+		log.Printf("warning: %s", w)
+	}
+	return nil
+}
+
+// ---------- POST /api/admin/import-company?company_id=NEWCODE ----------
+// Body: the archive, raw or as the "archive" field of a multipart form. Responds with the manifest.
+func ImportCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	if !envBool("STATHQ_COMPANY_IMPORT", false) {
+		http.Error(w, `{"message":"Company import is disabled on this instance"}`, http.StatusForbidden)
+		return
+	}
+	newCode := strings.TrimSpace(r.URL.Query().Get("company_id"))
+	if newCode != "" && !shardCodePattern.MatchString(newCode) {
+		http.Error(w, `{"message":"company_id may only contain letters, digits, - and _"}`, http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(envInt("STATHQ_IMPORT_MAX_MB", 512))<<20)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		f, _, err := r.FormFile("archive")
+		if err != nil {
+			http.Error(w, `{"message":"multipart upload needs an archive file field"}`, http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+		if v := strings.TrimSpace(r.FormValue("company_id")); v != "" && newCode == "" {
+			if !shardCodePattern.MatchString(v) {
+				http.Error(w, `{"message":"company_id may only contain letters, digits, - and _"}`, http.StatusBadRequest)
+				return
+			}
+			newCode = v
+		}
+	}
+	dir, err := os.MkdirTemp("", "stathq-import-")
+	if err != nil {
+		webFail("Failed to create temp dir", w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "company.db")
+	f, err := os.Create(path)
+	if err != nil {
+		webFail("Failed to store archive", w, err)
+		return
+	}
+	_, err = io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		http.Error(w, `{"message":"Failed to read archive"}`, http.StatusBadRequest)
+		return
+	}
+
+	m, err := importCompanyArchive(path, newCode)
+	if err == errCompanyExists {
+		http.Error(w, `{"message":"A company with this code already exists; pass company_id to import under a new code"}`, http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Company import failed: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Import failed", "details": err.Error()})
+		return
+	}
+	log.Printf("User %v imported company %s as %s", r.Context().Value("username"), m.SourceCompany, m.CompanyID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
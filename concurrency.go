@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Optimistic concurrency: weekly_stats and daily_stats rows carry a version that every write
+// bumps. Weekly writes may send the version they loaded; the 7R grid, which rewrites five daily
+// rows at once, sends a token derived from the (id, version) of those rows. A mismatch means
+// someone else saved in between, and the write is refused with 409 instead of overwriting.
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// dailyWeekVersion returns the concurrency token of a stat's daily rows on the given dates.
+// Rows that are rewritten get new ids, so the token changes on any save.
+func dailyWeekVersion(q queryer, statID int, dates []string) (string, error) {
+	args := []interface{}{statID}
+	for _, d := range dates {
+		args = append(args, d)
+	}
+	rows, err := q.Query(`SELECT id, version FROM daily_stats WHERE stat_id = ? AND date IN (?`+strings.Repeat(",?", len(dates)-1)+`) ORDER BY date, id`, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	n := 0
+	for rows.Next() {
+		var id, version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%d:%d;", id, version)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "0", nil
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// writeConflict answers 409 with the current state so the client can reload or merge.
+func writeConflict(w http.ResponseWriter, msg string, current map[string]interface{}) {
+	body := map[string]interface{}{"message": msg}
+	for k, v := range current {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(body)
+}
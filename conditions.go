@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Condition formulas: assigning a weekly condition to a stat creates one checklist item per step
+// of that condition's formula. The stat's assigned user and division are copied onto the
+// assignment so the checklist can be queried per user and per division even after a reassignment.
+
+var conditionFormulas = map[string][]string{
+	"power": {
+		"Don't disconnect",
+		"Make a record of all lines of the post",
+		"Write up the post and hand it over",
+		"Do all you can to make the post occupiable",
+	},
+	"power_change": {
+		"Don't change anything",
+		"Follow the established routine of the post",
+		"Study the post's lines and records",
+	},
+	"affluence": {
+		"Economize",
+		"Pay every bill",
+		"Invest the remainder in service facilities",
+		"Discover what caused the affluence and strengthen it",
+	},
+	"normal": {
+		"Don't change anything",
+		"Keep ethics mild",
+		"When a stat betters, find out what bettered it and do that",
+		"When a stat worsens slightly, quickly find out why and remedy it",
+	},
+	"emergency": {
+		"Promote",
+		"Change your operating basis",
+		"Economize",
+		"Prepare to deliver",
+		"Stiffen discipline",
+	},
+	"danger": {
+		"Bypass habits or normal routines",
+		"Handle the situation and any danger in it",
+		"Assign self a Danger condition",
+		"Get in your own personal ethics",
+		"Reorganize so the dangerous situation is not continually happening",
+		"Formulate and adopt firm policy that will detect and prevent the same situation",
+	},
+	"non_existence": {
+		"Find a communication line",
+		"Make yourself known",
+		"Discover what is needed or wanted",
+		"Do, produce and/or present it",
+	},
+	"liability": {
+		"Decide who are one's friends",
+		"Deliver an effective blow to the enemies of the group",
+		"Make up the damage done by personal contribution beyond the ordinary demands",
+		"Apply for re-entry to the group",
+	},
+	"doubt": {
+		"Inform oneself honestly of the intentions and activities of the group",
+		"Examine the statistics",
+		"Decide on the basis of the greatest good for the greatest number",
+		"Improve the actions and statistics of the group chosen",
+	},
+	"enemy":     {"Find out who you really are"},
+	"treason":   {"Find out that you are"},
+	"confusion": {"Find out where you are"},
+}
+
+type conditionStep struct {
+	ID          int     `json:"id"`
+	StepNo      int     `json:"step_no"`
+	Text        string  `json:"text"`
+	DueDate     string  `json:"due_date"`
+	CompletedAt *string `json:"completed_at,omitempty"`
+	CompletedBy *int    `json:"completed_by,omitempty"`
+	Note        string  `json:"note,omitempty"`
+	Overdue     bool    `json:"overdue"`
+}
+
+type conditionAssignment struct {
+	ID         int             `json:"id"`
+	StatID     int             `json:"stat_id"`
+	ShortID    string          `json:"short_id"`
+	WeekEnding string          `json:"week_ending"`
+	Condition  string          `json:"condition"`
+	UserID     *int            `json:"user_id,omitempty"`
+	DivisionID *int            `json:"division_id,omitempty"`
+	AssignedAt string          `json:"assigned_at"`
+	Completed  int             `json:"completed"`
+	Total      int             `json:"total"`
+	Steps      []conditionStep `json:"steps"`
+}
+
+// ---------- GET /api/conditions/formulas ----------
+func ConditionFormulasHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conditionFormulas)
+}
+
+// ---------- POST /api/stats/{id}/conditions ----------
+// Body: { "week_ending": "YYYY-MM-DD", "condition": "emergency", "due_date": "YYYY-MM-DD" (optional) }.
+// Steps are due on due_date, by default the next W/E. Re-assigning a week replaces its checklist.
+func AssignConditionHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		WeekEnding string `json:"week_ending"`
+		Condition  string `json:"condition"`
+		DueDate    string `json:"due_date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), req.WeekEnding); err != nil {
+		http.Error(w, `{"message":"week_ending must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	req.Condition = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(req.Condition), " ", "_"))
+	steps, ok := conditionFormulas[req.Condition]
+	if !ok {
+		http.Error(w, `{"message":"unknown condition"}`, http.StatusBadRequest)
+		return
+	}
+	if req.DueDate == "" {
+		we, _ := time.Parse("2006-01-02", req.WeekEnding)
+		req.DueDate = we.AddDate(0, 0, 7).Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", req.DueDate); err != nil {
+		http.Error(w, `{"message":"due_date must be YYYY-MM-DD"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM stat_conditions WHERE stat_id = ? AND week_ending = ?`, statID, req.WeekEnding); err != nil {
+		webFail("Failed to replace condition", w, err)
+		return
+	}
+	res, err := tx.Exec(`
+		INSERT INTO stat_conditions (stat_id, week_ending, condition, user_id, division_id, assigned_by, assigned_at)
+		SELECT id, ?, ?, assigned_user_id, assigned_division_id, ?, ? FROM stats WHERE id = ?
+	`, req.WeekEnding, req.Condition, r.Context().Value("user_id"), time.Now().UTC().Format(time.RFC3339), statID)
+	if err != nil {
+		webFail("Failed to assign condition", w, err)
+		return
+	}
+	condID, _ := res.LastInsertId()
+	for i, text := range steps {
+		if _, err := tx.Exec(`INSERT INTO condition_steps (condition_id, step_no, text, due_date) VALUES (?, ?, ?, ?)`, condID, i+1, text, req.DueDate); err != nil {
+			webFail("Failed to create condition steps", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit condition", w, err)
+		return
+	}
+
+	list, err := loadConditions(`c.id = ?`, condID)
+	if err != nil || len(list) == 0 {
+		webFail("Failed to load condition", w, err)
+		return
+	}
+	publishStatEvent(liveEvent{Type: eventConditionChanged, StatID: list[0].StatID, WeekEnding: list[0].WeekEnding, Data: list[0]})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list[0])
+}
+
+// ---------- GET /api/conditions?user_id=&division_id=&week=&open=true ----------
+// Non-admins only see their own checklists.
+func ListConditionsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	q := r.URL.Query()
+	where := []string{`s.company_id = ?`}
+	args := []interface{}{companyDBID}
+
+	if !can(r.Context().Value("role").(string), permAllStats) {
+		where = append(where, `c.user_id = ?`)
+		args = append(args, r.Context().Value("user_id"))
+	} else if v := q.Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid user_id"}`, http.StatusBadRequest)
+			return
+		}
+		where = append(where, `c.user_id = ?`)
+		args = append(args, id)
+	}
+	if v := q.Get("division_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid division_id"}`, http.StatusBadRequest)
+			return
+		}
+		where = append(where, `c.division_id = ?`)
+		args = append(args, id)
+	}
+	if v := q.Get("week"); v != "" {
+		where = append(where, `c.week_ending = ?`)
+		args = append(args, v)
+	}
+	if open, _ := strconv.ParseBool(q.Get("open")); open {
+		where = append(where, `EXISTS (SELECT 1 FROM condition_steps cs WHERE cs.condition_id = c.id AND cs.completed_at IS NULL)`)
+	}
+
+	list, err := loadConditions(strings.Join(where, " AND "), args...)
+	if err != nil {
+		webFail("Failed to query conditions", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// ---------- PATCH /api/conditions/steps/{id} ----------
+// Body: { "completed": true, "note": "...", "due_date": "YYYY-MM-DD" } (all optional).
+// The user the condition was assigned to, or an admin.
+func UpdateConditionStepHandler(w http.ResponseWriter, r *http.Request) {
+	stepID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid step id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Completed *bool   `json:"completed"`
+		Note      *string `json:"note"`
+		DueDate   *string `json:"due_date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	var companyID, weekEnding string
+	var owner sql.NullInt64
+	var statID, conditionID int
+	err = DB.QueryRow(`
+		SELECT co.company_id, c.user_id, c.stat_id, c.week_ending, c.id
+		FROM condition_steps cs
+		JOIN stat_conditions c ON c.id = cs.condition_id
+		JOIN stats s ON s.id = c.stat_id
+		JOIN companies co ON co.id = s.company_id
+		WHERE cs.id = ?
+	`, stepID).Scan(&companyID, &owner, &statID, &weekEnding, &conditionID)
+	if err != nil || companyID != r.Context().Value("company_id") {
+		http.Error(w, `{"message":"step not found"}`, http.StatusNotFound)
+		return
+	}
+	if !can(r.Context().Value("role").(string), permAllStats) && (!owner.Valid || int(owner.Int64) != r.Context().Value("user_id")) {
+		http.Error(w, `{"message":"Forbidden"}`, http.StatusForbidden)
+		return
+	}
+
+	if req.Completed != nil {
+		if *req.Completed {
+			_, err = DB.Exec(`UPDATE condition_steps SET completed_at = ?, completed_by = ? WHERE id = ? AND completed_at IS NULL`,
+				time.Now().UTC().Format(time.RFC3339), r.Context().Value("user_id"), stepID)
+		} else {
+			_, err = DB.Exec(`UPDATE condition_steps SET completed_at = NULL, completed_by = NULL WHERE id = ?`, stepID)
+		}
+		if err != nil {
+			webFail("Failed to update step", w, err)
+			return
+		}
+	}
+	if req.Note != nil {
+		if _, err := DB.Exec(`UPDATE condition_steps SET note = ? WHERE id = ?`, strings.TrimSpace(*req.Note), stepID); err != nil {
+			webFail("Failed to update step", w, err)
+			return
+		}
+	}
+	if req.DueDate != nil {
+		if _, err := time.Parse("2006-01-02", *req.DueDate); err != nil {
+			http.Error(w, `{"message":"due_date must be YYYY-MM-DD"}`, http.StatusBadRequest)
+			return
+		}
+		if _, err := DB.Exec(`UPDATE condition_steps SET due_date = ? WHERE id = ?`, *req.DueDate, stepID); err != nil {
+			webFail("Failed to update step", w, err)
+			return
+		}
+	}
+
+	if list, err := loadConditions(`c.id = ?`, conditionID); err == nil && len(list) > 0 {
+		publishStatEvent(liveEvent{Type: eventConditionChanged, StatID: statID, WeekEnding: weekEnding, Data: list[0]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Step updated"})
+}
+
+// loadConditions returns condition assignments matching where (over stat_conditions c joined to
+// stats s) with their steps, newest week first.
+func loadConditions(where string, args ...interface{}) ([]conditionAssignment, error) {
+	rows, err := DB.Query(`
+		SELECT c.id, c.stat_id, s.short_id, c.week_ending, c.condition, c.user_id, c.division_id, c.assigned_at
+		FROM stat_conditions c JOIN stats s ON s.id = c.stat_id
+		WHERE `+where+`
+		ORDER BY c.week_ending DESC, s.short_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	list := []conditionAssignment{}
+	for rows.Next() {
+		var c conditionAssignment
+		var userID, divID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.StatID, &c.ShortID, &c.WeekEnding, &c.Condition, &userID, &divID, &c.AssignedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			c.UserID = &id
+		}
+		if divID.Valid {
+			id := int(divID.Int64)
+			c.DivisionID = &id
+		}
+		list = append(list, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	for i := range list {
+		c := &list[i]
+		c.Steps = []conditionStep{}
+		srows, err := DB.Query(`SELECT id, step_no, text, due_date, completed_at, completed_by, COALESCE(note, '') FROM condition_steps WHERE condition_id = ? ORDER BY step_no`, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		for srows.Next() {
+			var s conditionStep
+			var completedAt sql.NullString
+			var completedBy sql.NullInt64
+			if err := srows.Scan(&s.ID, &s.StepNo, &s.Text, &s.DueDate, &completedAt, &completedBy, &s.Note); err != nil {
+				srows.Close()
+				return nil, err
+			}
+			if completedAt.Valid {
+				s.CompletedAt = &completedAt.String
+				c.Completed++
+			} else {
+				s.Overdue = s.DueDate < today
+			}
+			if completedBy.Valid {
+				id := int(completedBy.Int64)
+				s.CompletedBy = &id
+			}
+			c.Steps = append(c.Steps, s)
+		}
+		srows.Close()
+		c.Total = len(c.Steps)
+	}
+	return list, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Currencies. A currency stat can name its own ISO 4217 currency (stats.currency); without one it
+// is in the company's default_currency (see settings.go), USD unless set. Amounts are stored in the
+// currency's minor units: cents for USD, whole yen for JPY, which has none, so "12.5" is refused for a
+// yen stat (parseStatValue). The currency also decides how values are shown: its symbol and its
+// places, unless the stat sets decimal_places (see statformat.go). Codes without an entry in
+// currencies have two places and are shown as "CODE 1,250.00". Rules, quotas and calculations work
+// on the stored amounts, so a calculated stat's currency inputs should share its currency.
+//
+// currency_rates holds, per company, how many units of the default currency one unit of another
+// currency is worth. With ?convert=1 the series endpoints (GET /api/stats/{id}/series and
+// /services/getStatsData) report a currency stat in the default currency at that rate; a stat in a
+// currency without a rate answers 409.
+
+type currencyInfo struct {
+	Symbol string
+	Places int
+}
+
+var currencies = map[string]currencyInfo{
+	"USD": {"$", 2}, "EUR": {"€", 2}, "GBP": {"£", 2}, "JPY": {"¥", 0}, "CNY": {"CN¥", 2},
+	"CAD": {"CA$", 2}, "AUD": {"A$", 2}, "NZD": {"NZ$", 2}, "CHF": {"CHF", 2}, "SEK": {"kr", 2},
+	"NOK": {"kr", 2}, "DKK": {"kr", 2}, "PLN": {"zł", 2}, "CZK": {"Kč", 2}, "HUF": {"Ft", 2},
+	"INR": {"₹", 2}, "KRW": {"₩", 0}, "MXN": {"MX$", 2}, "BRL": {"R$", 2}, "ZAR": {"R", 2},
+	"ILS": {"₪", 2}, "SGD": {"S$", 2}, "HKD": {"HK$", 2}, "TRY": {"₺", 2}, "ISK": {"kr", 0},
+}
+
+func currencyOf(code string) currencyInfo {
+	if c, ok := currencies[code]; ok {
+		return c
+	}
+	return currencyInfo{Symbol: code, Places: 2}
+}
+
+// statCurrency is the currency of a stat's amounts: its own, or its company's default.
+func statCurrency(statID int) string {
+	code := defaultCurrency
+	DB.QueryRow(`
+		SELECT COALESCE(s.currency, cs.default_currency, ?)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ?
+	`, defaultCurrency, statID).Scan(&code)
+	return code
+}
+
+// parseStatValue is parseValueByType for a stat whose currency is known: currency amounts are
+// stored in that currency's minor units, and a fraction is refused when it has none.
+func parseStatValue(raw, valueType, currency string) (int64, error) {
+	if valueType != "currency" {
+		return parseValueByType(raw, valueType)
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	places := currencyOf(currency).Places
+	minor := f * math.Pow10(places)
+	if places == 0 && minor != math.Trunc(minor) {
+		return 0, fmt.Errorf("%s has no minor unit; enter a whole amount instead of %s", currency, raw)
+	}
+	return int64(math.Round(minor)), nil
+}
+
+// formatStatValue is formatStoredValue for a stat whose currency is known: currency amounts are
+// written with that currency's places ("1250" for yen, "12.50" for dollars).
+func formatStatValue(v int64, valueType, currency string) string {
+	if valueType != "currency" {
+		return formatStoredValue(v, valueType)
+	}
+	places := currencyOf(currency).Places
+	return strconv.FormatFloat(float64(v)/math.Pow10(places), 'f', places, 64)
+}
+
+// statValueToFloat is storedToFloat for a stat whose currency is known: currency amounts in units of
+// that currency.
+func statValueToFloat(v int64, valueType, currency string) float64 {
+	if valueType != "currency" {
+		return storedToFloat(v, valueType)
+	}
+	return float64(v) / math.Pow10(currencyOf(currency).Places)
+}
+
+// Stored amounts only keep their meaning between currencies with the same places: cents of a dollar
+// would be read as whole yen. A stat that holds values cannot move to such a currency, whether its
+// own or, for stats without one, the company's default.
+const loggedAmounts = `(EXISTS (SELECT 1 FROM weekly_stats WHERE stat_id = s.id) OR EXISTS (SELECT 1 FROM daily_stats WHERE stat_id = s.id)
+	OR EXISTS (SELECT 1 FROM stat_quotas WHERE stat_id = s.id))`
+
+// checkStatCurrencyChange returns why a stat cannot move to currency code ("" is the company's
+// default), or "" when it can.
+func checkStatCurrencyChange(statID int, code string) string {
+	var companyDBID int
+	var logged bool
+	if err := DB.QueryRow(`SELECT s.company_id, `+loggedAmounts+` FROM stats s WHERE s.id = ? AND s.value_type = 'currency'`, statID).
+		Scan(&companyDBID, &logged); err != nil || !logged {
+		return ""
+	}
+	if code == "" {
+		code = companyCurrency(companyDBID)
+	}
+	if from := statCurrency(statID); currencyOf(from).Places != currencyOf(code).Places {
+		return fmt.Sprintf("the stat has values in %s, which cannot be kept in %s (different decimal places)", from, code)
+	}
+	return ""
+}
+
+// checkDefaultCurrencyChange returns why a company's default currency cannot become code, or "" when
+// it can.
+func checkDefaultCurrencyChange(companyDBID int, code string) string {
+	from := companyCurrency(companyDBID)
+	if currencyOf(from).Places == currencyOf(code).Places {
+		return ""
+	}
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM stats s WHERE s.company_id = ? AND s.value_type = 'currency' AND s.currency IS NULL AND `+loggedAmounts, companyDBID).Scan(&n)
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d stats have values in %s, which cannot be kept in %s (different decimal places); give them their own currency first", n, from, code)
+}
+
+// validCurrencyCode reports whether code looks like an ISO 4217 code (three capital letters).
+func validCurrencyCode(code string) bool {
+	return len(code) == 3 && strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+// withSymbol prefixes a formatted amount with the currency's symbol, keeping the sign in front;
+// alphabetic symbols are set off by a space ("CHF 12.50").
+func (c currencyInfo) withSymbol(amount string) string {
+	sign := ""
+	if strings.HasPrefix(amount, "-") {
+		sign, amount = "-", amount[1:]
+	}
+	sep := ""
+	if last := c.Symbol[len(c.Symbol)-1]; last >= 'A' && last <= 'z' {
+		sep = " "
+	}
+	return sign + c.Symbol + sep + amount
+}
+
+// companyCurrency is a company's (by database id) default currency.
+func companyCurrency(companyDBID int) string {
+	var code string
+	if err := DB.QueryRow(`SELECT default_currency FROM company_settings WHERE company_id = ?`, companyDBID).Scan(&code); err != nil || code == "" {
+		return defaultCurrency
+	}
+	return code
+}
+
+// errNoRate is returned by currencyConversion when the company has no rate for the stat's currency.
+type errNoRate struct{ From, To string }
+
+func (e errNoRate) Error() string {
+	return fmt.Sprintf("no rate from %s to %s; set one with PUT /api/currency-rates/%s", e.From, e.To, e.From)
+}
+
+// currencyConversion returns what converts a currency stat's stored values into the company's
+// default currency and changes f to show them in it. Other stats, and stats already in the default
+// currency, are returned unchanged.
+func currencyConversion(companyDBID int, f *statFormat) (func(int64) int64, error) {
+	same := func(v int64) int64 { return v }
+	to := companyCurrency(companyDBID)
+	if f.ValueType != "currency" || f.Currency == to {
+		return same, nil
+	}
+	var rate float64
+	err := DB.QueryRow(`SELECT rate FROM currency_rates WHERE company_id = ? AND currency = ?`, companyDBID, f.Currency).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return nil, errNoRate{From: f.Currency, To: to}
+	} else if err != nil {
+		return nil, err
+	}
+	// The rate is per unit; the currencies' minor units may differ (yen into cents).
+	rate *= math.Pow10(currencyOf(to).Places - currencyOf(f.Currency).Places)
+	f.Currency = to
+	return func(v int64) int64 { return int64(math.Round(float64(v) * rate)) }, nil
+}
+
+// writeConversionError answers 409 for a missing rate, or 500 for any other error.
+func writeConversionError(w http.ResponseWriter, err error) {
+	if e, ok := err.(errNoRate); ok {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, e.Error()), http.StatusConflict)
+		return
+	}
+	webFail("Failed to convert currency", w, err)
+}
+
+type currencyRate struct {
+	Currency  string  `json:"currency"`
+	Rate      float64 `json:"rate"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+// ---------- GET /api/currency-rates ----------
+func ListCurrencyRatesHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`SELECT currency, rate, updated_at FROM currency_rates WHERE company_id = ? ORDER BY currency`, companyDBID)
+	if err != nil {
+		webFail("Failed to query currency rates", w, err)
+		return
+	}
+	defer rows.Close()
+	rates := []currencyRate{}
+	for rows.Next() {
+		var cr currencyRate
+		if err := rows.Scan(&cr.Currency, &cr.Rate, &cr.UpdatedAt); err != nil {
+			webFail("Failed to read currency rates", w, err)
+			return
+		}
+		rates = append(rates, cr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"default_currency": companyCurrency(companyDBID), "rates": rates})
+}
+
+// ---------- PUT /api/currency-rates/{currency} ----------
+// Body: {"rate": 1.08}, units of the default currency per unit of {currency}.
+func SetCurrencyRateHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(mux.Vars(r)["currency"])
+	if !validCurrencyCode(code) {
+		http.Error(w, `{"message":"currency must be an ISO 4217 code such as EUR"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Rate float64 `json:"rate"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Rate <= 0 || math.IsInf(req.Rate, 0) {
+		http.Error(w, `{"message":"rate must be above zero"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if code == companyCurrency(companyDBID) {
+		http.Error(w, `{"message":"the default currency needs no rate"}`, http.StatusBadRequest)
+		return
+	}
+	cr := currencyRate{Currency: code, Rate: req.Rate, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
+	if _, err := DB.Exec(`
+		INSERT INTO currency_rates (company_id, currency, rate, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (company_id, currency) DO UPDATE SET rate = excluded.rate, updated_at = excluded.updated_at
+	`, companyDBID, cr.Currency, cr.Rate, cr.UpdatedAt); err != nil {
+		webFail("Failed to save currency rate", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cr)
+}
+
+// ---------- DELETE /api/currency-rates/{currency} ----------
+func DeleteCurrencyRateHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	res, err := DB.Exec(`DELETE FROM currency_rates WHERE company_id = ? AND currency = ?`, companyDBID, strings.ToUpper(mux.Vars(r)["currency"]))
+	if err != nil {
+		webFail("Failed to delete currency rate", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"no rate for that currency"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"message":"Currency rate deleted"}`)
+}
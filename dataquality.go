@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weekly data quality report: flags values that are probably entry errors so admins can fix them
+// before the executive review. Only stats with a value for the week and that are not calculated are
+// examined; the checks are heuristics, nothing is changed.
+//
+//   duplicate_value  the same non-zero value entered on dup_min (3) or more stats
+//   unexpected_zero  zero on a stat whose last history (12) weeks were all non-zero (at least 4)
+//   outlier          more than sigma (3) standard deviations from the stat's history mean
+//   saved_late       written after the week locked (Friday 14:00 company time, see week.go)
+
+const dataQualityMinHistory = 4
+
+type dataQualityIssue struct {
+	Check    string `json:"check"`
+	StatID   int    `json:"stat_id"`
+	ShortID  string `json:"short_id"`
+	FullName string `json:"full_name"`
+	Value    string `json:"value"`
+	Message  string `json:"message"`
+}
+
+// ---------- GET /api/reports/data-quality?week=YYYY-MM-DD&sigma=3&history=12&dup_min=3 ----------
+func DataQualityHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	week := q.Get("week")
+	if week == "" {
+		week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	sigma, history, dupMin := 3.0, 12, 3
+	if s := q.Get("sigma"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 {
+			http.Error(w, `{"message":"sigma must be a positive number"}`, http.StatusBadRequest)
+			return
+		}
+		sigma = v
+	}
+	if s := q.Get("history"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < dataQualityMinHistory || v > 104 {
+			http.Error(w, `{"message":"history must be between 4 and 104 weeks"}`, http.StatusBadRequest)
+			return
+		}
+		history = v
+	}
+	if s := q.Get("dup_min"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 2 {
+			http.Error(w, `{"message":"dup_min must be at least 2"}`, http.StatusBadRequest)
+			return
+		}
+		dupMin = v
+	}
+	companyID := r.Context().Value("company_id").(string)
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	type entry struct {
+		statID                int
+		shortID, fullName, vt string
+		currency              string
+		value                 int64
+		savedAt, author       string
+	}
+	rows, err := DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.value_type, COALESCE(s.currency, cs.default_currency, ?), ws.value,
+		       COALESCE(ws.updated_at, ws.submitted_at, ''), COALESCE(u.username, '')
+		FROM weekly_stats ws
+		JOIN stats s ON s.id = ws.stat_id
+		LEFT JOIN users u ON u.id = ws.author_user_id
+		LEFT JOIN company_settings cs ON cs.company_id = s.company_id
+		WHERE s.company_id = ? AND ws.week_ending = ? AND s.is_calculated = 0
+		ORDER BY s.short_id
+	`, defaultCurrency, companyDBID, week)
+	if err != nil {
+		webFail("Failed to query weekly values", w, err)
+		return
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.statID, &e.shortID, &e.fullName, &e.vt, &e.currency, &e.value, &e.savedAt, &e.author); err != nil {
+			rows.Close()
+			webFail("Failed to scan weekly value", w, err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	issues := []dataQualityIssue{}
+	issue := func(check string, e entry, msg string) {
+		issues = append(issues, dataQualityIssue{check, e.statID, e.shortID, e.fullName, formatStatValue(e.value, e.vt, e.currency), msg})
+	}
+
+	// Duplicates compare the stored value, its type and currency, so $12.00, 1200 and ¥1,200 are not
+	// the same.
+	type dupKey struct {
+		value        int64
+		vt, currency string
+	}
+	groups := map[dupKey][]entry{}
+	for _, e := range entries {
+		if e.value != 0 {
+			k := dupKey{e.value, e.vt, e.currency}
+			groups[k] = append(groups[k], e)
+		}
+	}
+	for _, e := range entries {
+		group := groups[dupKey{e.value, e.vt, e.currency}]
+		if e.value == 0 || len(group) < dupMin {
+			continue
+		}
+		var others []string
+		for _, o := range group {
+			if o.statID != e.statID {
+				others = append(others, o.shortID)
+			}
+		}
+		issue("duplicate_value", e, fmt.Sprintf("Same value as %s", strings.Join(others, ", ")))
+	}
+
+	weeks, _ := lastWeekEndings(week, history+1)
+	weeks = weeks[:history]
+	for _, e := range entries {
+		var past []float64
+		zeros := 0
+		hrows, err := DB.Query(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending BETWEEN ? AND ?`,
+			e.statID, weeks[0], weeks[len(weeks)-1])
+		if err != nil {
+			webFail("Failed to query history", w, err)
+			return
+		}
+		for hrows.Next() {
+			var v int64
+			if err := hrows.Scan(&v); err != nil {
+				hrows.Close()
+				webFail("Failed to scan history", w, err)
+				return
+			}
+			if v == 0 {
+				zeros++
+			}
+			past = append(past, float64(v))
+		}
+		hrows.Close()
+		if len(past) < dataQualityMinHistory {
+			continue
+		}
+		if e.value == 0 && zeros == 0 {
+			issue("unexpected_zero", e, fmt.Sprintf("Zero, but non-zero in each of the last %d reported weeks", len(past)))
+			continue
+		}
+		var mean, variance float64
+		for _, v := range past {
+			mean += v
+		}
+		mean /= float64(len(past))
+		for _, v := range past {
+			variance += (v - mean) * (v - mean)
+		}
+		stddev := math.Sqrt(variance / float64(len(past)))
+		if stddev == 0 {
+			continue
+		}
+		if dev := math.Abs(float64(e.value)-mean) / stddev; dev > sigma {
+			issue("outlier", e, fmt.Sprintf("%.1f standard deviations from the %d-week average of %s",
+				dev, len(past), formatStatValue(int64(math.Round(mean)), e.vt, e.currency)))
+		}
+	}
+
+	closes, _ := weekCloseIn(week, companyLocation(companyID))
+	lockedAt := closes.Add(24 * time.Hour)
+	for _, e := range entries {
+		saved, err := time.Parse(time.RFC3339, e.savedAt)
+		if err != nil || !saved.After(lockedAt) {
+			continue
+		}
+		msg := "Saved " + saved.UTC().Format(time.RFC3339) + " after the week locked"
+		if e.author != "" {
+			msg += " by " + e.author
+		}
+		issue("saved_late", e, msg)
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].ShortID < issues[j].ShortID })
+	counts := map[string]int{}
+	for _, is := range issues {
+		counts[is.Check]++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week":     week,
+		"checked":  len(entries),
+		"counts":   counts,
+		"issues":   issues,
+		"settings": map[string]interface{}{"sigma": sigma, "history": history, "dup_min": dupMin},
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -13,6 +14,9 @@ import (
 // DB is the global database handle used across the app.
 var DB *sql.DB
 
+// dbFile is the SQLite database path (a sharded worker's company file, see shardrouter.go).
+var dbFile = "./stats.db"
+
 // InitDB initializes the database schema for a clean start.
 // Design decisions reflected here:
 // - stats table contains canonical assignment: assigned_user_id and assigned_division_id.
@@ -24,7 +28,7 @@ var DB *sql.DB
 // - We keep stat_user_assignments and stat_division_assignments as optional history/compatibility tables.
 func InitDB() {
 	var err error
-	DB, err = sql.Open("sqlite3", "./stats.db")
+	DB, err = sql.Open("sqlite3", dbFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -49,7 +53,7 @@ func InitDB() {
 		company_id INTEGER NOT NULL,
 		username TEXT NOT NULL,
 		password_hash TEXT NOT NULL,
-		role TEXT NOT NULL CHECK(role IN ('admin','user')),
+		role TEXT NOT NULL CHECK(role IN ('admin','manager','user')),
 		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
 		UNIQUE(company_id, username)
 	);
@@ -66,7 +70,7 @@ func InitDB() {
 		short_id TEXT NOT NULL,
 		full_name TEXT NOT NULL,
 		type TEXT NOT NULL CHECK(type IN ('personal','divisional','main')),
-		value_type TEXT NOT NULL CHECK(value_type IN ('number','currency','percentage')),
+		value_type TEXT NOT NULL CHECK(value_type IN ('number','currency','percentage','decimal','ratio','duration')),
 		reversed BOOLEAN NOT NULL DEFAULT 0,
 		assigned_user_id INTEGER,       -- canonical assigned user (nullable)
 		assigned_division_id INTEGER,   -- canonical assigned division (nullable)
@@ -131,64 +135,1006 @@ func InitDB() {
 	-- Enforce a single canonical row per (stat_id, week_ending)
 	CREATE UNIQUE INDEX IF NOT EXISTS uniq_weekly_stat_week ON weekly_stats(stat_id, week_ending);
 	CREATE INDEX IF NOT EXISTS idx_weekly_stat_week ON weekly_stats(stat_id, week_ending);
+
+	-- Overwritten weekly values (see valuehistory.go), filled by a trigger on weekly_stats.
+	CREATE TABLE IF NOT EXISTS weekly_stats_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		old_value INTEGER NOT NULL,
+		new_value INTEGER NOT NULL,
+		editor_user_id INTEGER,
+		changed_at TEXT NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (editor_user_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_weekly_stats_history_stat ON weekly_stats_history(stat_id, week_ending);
+
+	-- Weekly quotas: one row per (stat_id, week_ending), stored in the same integer form as values.
+	CREATE TABLE IF NOT EXISTS stat_quotas (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		value INTEGER NOT NULL,
+		author_user_id INTEGER,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (author_user_id) REFERENCES users(id),
+		UNIQUE(stat_id, week_ending)
+	);
+
+	-- Optional LDAP/AD authentication per company; local bcrypt users remain the fallback.
+	CREATE TABLE IF NOT EXISTS company_ldap (
+		company_id INTEGER PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT 0,
+		url TEXT NOT NULL,
+		bind_dn_template TEXT NOT NULL,   -- e.g. uid=%s,ou=people,dc=example,dc=com
+		base_dn TEXT NOT NULL,
+		user_attr TEXT NOT NULL DEFAULT 'uid',
+		group_attr TEXT NOT NULL DEFAULT 'memberOf',
+		default_role TEXT CHECK(default_role IN ('admin','manager','user')), -- role for users in no mapped group (NULL = deny)
+		insecure_skip_verify BOOLEAN NOT NULL DEFAULT 0,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS ldap_group_roles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		group_dn TEXT NOT NULL,
+		role TEXT NOT NULL CHECK(role IN ('admin','manager','user')),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		UNIQUE(company_id, group_dn)
+	);
+
+	-- TOTP two-factor authentication (see twofactor.go). enabled_at is NULL until setup is confirmed.
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY,
+		secret_enc BLOB NOT NULL,         -- AES-GCM sealed with STATHQ_2FA_KEY
+		created_at TEXT NOT NULL,
+		enabled_at TEXT,
+		last_step INTEGER NOT NULL DEFAULT 0, -- newest time step used, so a code works only once
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Passkeys (see webauthn.go). public_key is the COSE key from the authenticator.
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		credential_id TEXT NOT NULL UNIQUE, -- base64url
+		public_key BLOB NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		last_used_at TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	-- Outstanding registration and login ceremonies; user_id is NULL for a passkey login without a username.
+	CREATE TABLE IF NOT EXISTS webauthn_challenges (
+		challenge_hash TEXT PRIMARY KEY,
+		kind TEXT NOT NULL CHECK (kind IN ('register', 'login')),
+		company_id INTEGER NOT NULL,
+		user_id INTEGER,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Identity providers a company allows for single sign-on (see oidc.go).
+	CREATE TABLE IF NOT EXISTS company_sso_providers (
+		company_id INTEGER NOT NULL,
+		provider TEXT NOT NULL CHECK(provider IN ('google','microsoft')),
+		tenant_id TEXT,                   -- Microsoft Entra tenant whose accounts are accepted
+		email_domain TEXT,                -- NULL = any verified email of a company user
+		PRIMARY KEY (company_id, provider),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Subscription state per company (mirrored from Stripe webhooks). Missing row = free plan.
+	CREATE TABLE IF NOT EXISTS company_billing (
+		company_id INTEGER PRIMARY KEY,
+		plan TEXT NOT NULL DEFAULT 'free',
+		seats INTEGER NOT NULL DEFAULT 2,
+		status TEXT NOT NULL DEFAULT 'active',  -- Stripe subscription status (active, trialing, past_due, canceled...)
+		current_period_end TEXT,
+		stripe_customer_id TEXT UNIQUE,
+		stripe_subscription_id TEXT,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Which currency stats receive imported accounting totals (kind: income | expenses).
+	CREATE TABLE IF NOT EXISTS accounting_mappings (
+		company_id INTEGER NOT NULL,
+		kind TEXT NOT NULL CHECK(kind IN ('income','expenses')),
+		stat_id INTEGER NOT NULL,
+		PRIMARY KEY (company_id, kind),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+
+	-- Time-clock employees (export employee ID or name, lower-cased) and the personal hours stat each feeds.
+	CREATE TABLE IF NOT EXISTS timeclock_mappings (
+		company_id INTEGER NOT NULL,
+		employee TEXT NOT NULL,
+		stat_id INTEGER NOT NULL,
+		PRIMARY KEY (company_id, employee),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+
+	-- Append-only feed of changed stats, values and quotas, written by triggers (see changes.go).
+	-- id is the cursor handed to polling clients; company_id is NULL once the stat is gone.
+	CREATE TABLE IF NOT EXISTS change_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER,
+		kind TEXT NOT NULL,
+		stat_id INTEGER NOT NULL,
+		key TEXT NOT NULL DEFAULT '',
+		changed_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+	);
+	CREATE INDEX IF NOT EXISTS idx_change_log_company ON change_log(company_id, id);
+	CREATE INDEX IF NOT EXISTS idx_change_log_changed_at ON change_log(changed_at);
+
+	-- Stats published by the business-metric exporter (see metricsexport.go).
+	CREATE TABLE IF NOT EXISTS metric_export_stats (
+		stat_id INTEGER PRIMARY KEY,
+		company_id INTEGER NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Daily API request counts per company and API client (family_id 0 = browser sessions), see apiquota.go.
+	CREATE TABLE IF NOT EXISTS api_usage (
+		company_id INTEGER NOT NULL,
+		family_id INTEGER NOT NULL,
+		day TEXT NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		rejected INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (company_id, family_id, day),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Companies loaded from another instance's archive; manifest holds the old -> new id mapping (see companyimport.go).
+	CREATE TABLE IF NOT EXISTS company_imports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		source_company TEXT NOT NULL,
+		source TEXT NOT NULL DEFAULT '',
+		imported_at TEXT NOT NULL,
+		manifest TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Company settings not kept on companies itself (see settings.go); no row means the defaults.
+	CREATE TABLE IF NOT EXISTS company_settings (
+		company_id INTEGER PRIMARY KEY,
+		default_currency TEXT NOT NULL DEFAULT 'USD',   -- ISO 4217
+		week_ending_day INTEGER NOT NULL DEFAULT 4 CHECK(week_ending_day BETWEEN 0 AND 6), -- 0 = Sunday, 4 = Thursday
+		updated_at TEXT,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Exchange rates into the company's default currency (see currency.go).
+	CREATE TABLE IF NOT EXISTS currency_rates (
+		company_id INTEGER NOT NULL,
+		currency TEXT NOT NULL,         -- ISO 4217
+		rate REAL NOT NULL,             -- units of the default currency per unit of currency
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (company_id, currency),
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Weeks opened by the rollover job (see weekrollover.go), one row per company and W/E.
+	CREATE TABLE IF NOT EXISTS company_weeks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		opened_at TEXT NOT NULL,
+		opened_by INTEGER,              -- NULL when opened by the schedule
+		quotas_carried INTEGER NOT NULL DEFAULT 0,
+		placeholders INTEGER NOT NULL DEFAULT 0,
+		notified INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (opened_by) REFERENCES users(id) ON DELETE SET NULL,
+		UNIQUE(company_id, week_ending)
+	);
+
+	-- Expected weekly submissions, created when a week opens; submitted_at is set by trigger.
+	CREATE TABLE IF NOT EXISTS week_submissions (
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		submitted_at TEXT,
+		PRIMARY KEY (stat_id, week_ending, user_id),
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Super-admin support sessions acting as a company admin (see superadmin.go).
+	CREATE TABLE IF NOT EXISTS impersonations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		superadmin_user_id INTEGER NOT NULL,
+		target_user_id INTEGER NOT NULL,
+		company_id INTEGER NOT NULL,
+		started_at TEXT NOT NULL,
+		ended_at TEXT,
+		ip TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (superadmin_user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (target_user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Per-stat secrets used by devices posting to /ingest. Only the SHA-256 of the token is stored.
+	CREATE TABLE IF NOT EXISTS stat_ingest_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		label TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		created_by INTEGER,
+		last_used_at TEXT,
+		revoked_at TEXT,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+
+	-- Per-stat QR entry links for shop-floor phones (see qrentry.go). Only the SHA-256 of the token is stored.
+	CREATE TABLE IF NOT EXISTS stat_qr_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		label TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		created_by INTEGER,
+		last_used_at TEXT,
+		revoked_at TEXT,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+
+	-- Self-service trial companies; deleted by the cleanup job after expires_at plus a grace period.
+	CREATE TABLE IF NOT EXISTS company_trials (
+		company_id INTEGER PRIMARY KEY,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- Data change log behind /api/changes. stat_id deliberately has no FK so history survives deletes.
+	CREATE TABLE IF NOT EXISTS activity_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		user_id INTEGER,
+		action TEXT NOT NULL,
+		stat_id INTEGER,
+		stat_short_id TEXT,
+		week_ending TEXT,
+		detail TEXT,            -- JSON
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_activity_company_week ON activity_log(company_id, week_ending);
+	CREATE INDEX IF NOT EXISTS idx_activity_company_created ON activity_log(company_id, created_at);
+
+	-- Why-and-handling notes for stats that went down; required before a user can complete the week.
+	CREATE TABLE IF NOT EXISTS stat_explanations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		why TEXT NOT NULL,
+		handling TEXT NOT NULL,
+		author_user_id INTEGER,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (author_user_id) REFERENCES users(id) ON DELETE SET NULL,
+		UNIQUE(stat_id, week_ending)
+	);
+
+	CREATE TABLE IF NOT EXISTS week_completions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		completed_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(user_id, week_ending)
+	);
+
+	-- Weekly conditions assigned to stats and their formula checklists. user_id/division_id are the
+	-- stat's assignment at the time the condition was assigned.
+	CREATE TABLE IF NOT EXISTS stat_conditions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		user_id INTEGER,
+		division_id INTEGER,
+		assigned_by INTEGER,
+		assigned_at TEXT NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+		FOREIGN KEY (division_id) REFERENCES divisions(id) ON DELETE SET NULL,
+		FOREIGN KEY (assigned_by) REFERENCES users(id) ON DELETE SET NULL,
+		UNIQUE(stat_id, week_ending)
+	);
+
+	CREATE TABLE IF NOT EXISTS condition_steps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		condition_id INTEGER NOT NULL,
+		step_no INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		due_date TEXT NOT NULL,
+		completed_at TEXT,
+		completed_by INTEGER,
+		note TEXT,
+		FOREIGN KEY (condition_id) REFERENCES stat_conditions(id) ON DELETE CASCADE,
+		FOREIGN KEY (completed_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+
+	-- Graph event markers (campaigns, price changes, personnel changes) shown as vertical lines.
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		label TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL CHECK(scope IN ('company','division','stat')),
+		division_id INTEGER,
+		stat_id INTEGER,
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (division_id) REFERENCES divisions(id) ON DELETE CASCADE,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_events_company_date ON events(company_id, date);
+
+	-- Derived-stat recalculation queue (see recalc.go). week_ending NULL = every week.
+	CREATE TABLE IF NOT EXISTS recalc_jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT,
+		status TEXT NOT NULL,            -- pending | running | done | failed
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		run_after TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		started_at TEXT,
+		finished_at TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_recalc_jobs_status ON recalc_jobs(status, run_after);
+
+	-- Per-division weekly dashboard aggregates (see aggregates.go). division_id 0 = unassigned.
+	CREATE TABLE IF NOT EXISTS division_week_aggregates (
+		company_id INTEGER NOT NULL,
+		division_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		value_type TEXT NOT NULL,
+		currency TEXT NOT NULL DEFAULT '', -- the stats' currency for value_type currency, '' otherwise
+		stat_count INTEGER NOT NULL,
+		reported_count INTEGER NOT NULL,
+		quota_count INTEGER NOT NULL,
+		quota_met_count INTEGER NOT NULL,
+		up_count INTEGER NOT NULL,
+		down_count INTEGER NOT NULL,
+		level_count INTEGER NOT NULL,
+		total INTEGER NOT NULL,          -- sum of non-calculated stats, in the value type's storage unit
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (company_id, division_id, week_ending, value_type, currency)
+	);
+	CREATE TABLE IF NOT EXISTS aggregate_dirty (
+		company_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		PRIMARY KEY (company_id, week_ending)
+	);
+
+	-- Scheduled VACUUM/ANALYZE/integrity_check runs (see maintenance.go).
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at TEXT NOT NULL,
+		finished_at TEXT,
+		trigger TEXT NOT NULL,
+		status TEXT NOT NULL,
+		integrity_check TEXT,            -- JSON array of PRAGMA integrity_check lines
+		app_checks TEXT,                 -- JSON object: integrity check name -> offending rows
+		size_before INTEGER NOT NULL,
+		size_after INTEGER,
+		error TEXT,
+		steps TEXT                       -- JSON array of {name, duration, error}
+	);
+
+	-- Who held a stat from which date; written by bulk reassignment.
+	CREATE TABLE IF NOT EXISTS stat_assignment_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		from_user_id INTEGER,
+		to_user_id INTEGER,
+		effective_date TEXT NOT NULL,    -- YYYY-MM-DD
+		changed_by INTEGER,
+		changed_at TEXT NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_stat_assignment_history_stat ON stat_assignment_history(stat_id, effective_date);
+
+	-- Users who manage a division (see manage.go).
+	CREATE TABLE IF NOT EXISTS division_managers (
+		division_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (division_id, user_id),
+		FOREIGN KEY (division_id) REFERENCES divisions(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Outstanding email verification links (see email.go). Only the token hash is stored.
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Outstanding welcome links for users created without a password (see welcome.go).
+	CREATE TABLE IF NOT EXISTS welcome_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Outstanding emailed sign-in links (see magiclink.go), at most one per user.
+	CREATE TABLE IF NOT EXISTS login_links (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL UNIQUE,
+		email TEXT NOT NULL,             -- the address it was sent to
+		remember BOOLEAN NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Telegram chats linked to users (see telegram.go), and outstanding link codes (hash only).
+	CREATE TABLE IF NOT EXISTS telegram_links (
+		user_id INTEGER PRIMARY KEY,
+		chat_id INTEGER NOT NULL UNIQUE,
+		linked_at TEXT NOT NULL,
+		last_reminder_week TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS telegram_link_codes (
+		code_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Shared entry devices (see kiosk.go). Only the SHA-256 of the device token is stored.
+	CREATE TABLE IF NOT EXISTS kiosks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		label TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		created_by INTEGER,
+		last_used_at TEXT,
+		revoked_at TEXT,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+	-- Kiosk PINs; a PIN identifies one user within the company.
+	CREATE TABLE IF NOT EXISTS kiosk_pins (
+		user_id INTEGER PRIMARY KEY,
+		company_id INTEGER NOT NULL,
+		pin_hash TEXT NOT NULL,
+		set_at TEXT NOT NULL,
+		UNIQUE (company_id, pin_hash),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+	-- Kiosk audit: identify | submit | pin_failed | locked. user_id is NULL for failed PINs.
+	CREATE TABLE IF NOT EXISTS kiosk_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kiosk_id INTEGER NOT NULL,
+		user_id INTEGER,
+		action TEXT NOT NULL,
+		detail TEXT,
+		ip TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (kiosk_id) REFERENCES kiosks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_kiosk_events_kiosk ON kiosk_events(kiosk_id, id);
+
+	-- Login attempts (see logins.go). user_id is NULL when the username did not match a user.
+	CREATE TABLE IF NOT EXISTS login_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		company_code TEXT NOT NULL,
+		username TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		method TEXT NOT NULL,            -- password | ldap | token | jwt | oidc | passkey | magic_link
+		success BOOLEAN NOT NULL,
+		reason TEXT,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_login_events_user ON login_events(user_id, id);
+	CREATE INDEX IF NOT EXISTS idx_login_events_ip ON login_events(ip, created_at);
+	CREATE INDEX IF NOT EXISTS idx_login_events_company ON login_events(company_code, created_at);
+
+	-- Suspicious sign-in activity found in login_events (see securityevents.go). subject is what the
+	-- event is about ("ip:203.0.113.9", "user:bob") and keeps one burst from raising several events.
+	CREATE TABLE IF NOT EXISTS security_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,              -- failed_login_burst | new_ip | new_country
+		subject TEXT NOT NULL,
+		user_id INTEGER,
+		username TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		country TEXT,
+		detail TEXT NOT NULL,            -- JSON
+		notified INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_security_events_company ON security_events(company_id, created_at);
+
+	-- Address ranges a company's users may connect from (see ipallowlist.go). No rows = anywhere.
+	CREATE TABLE IF NOT EXISTS company_ip_allowlist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		cidr TEXT NOT NULL,               -- normalised, e.g. 203.0.113.0/24 or 2001:db8::/32
+		label TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		UNIQUE(company_id, cidr)
+	);
+
+	-- Per-company session lifetimes (see sessionpolicy.go). Missing row = server defaults.
+	CREATE TABLE IF NOT EXISTS company_session_policy (
+		company_id INTEGER PRIMARY KEY,
+		session_hours INTEGER NOT NULL,
+		remember_days INTEGER NOT NULL,
+		idle_minutes INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
+
+	-- API client tokens (see tokens.go). A family is one client login; refresh tokens rotate within it.
+	CREATE TABLE IF NOT EXISTS api_token_families (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		client_name TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		last_used_at TEXT,
+		revoked_at TEXT,
+		revoked_reason TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS api_refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		family_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		used_at TEXT,                    -- set when exchanged; presenting it again revokes the family
+		FOREIGN KEY (family_id) REFERENCES api_token_families(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS api_access_tokens (
+		token_hash TEXT PRIMARY KEY,
+		family_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (family_id) REFERENCES api_token_families(id) ON DELETE CASCADE
+	);
+
+	-- Long-lived API tokens for machine clients (see apitokens.go). Only the token hash is stored.
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,        -- the token acts as this user, within its scopes
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		token_hint TEXT NOT NULL,        -- last characters, to tell tokens apart
+		scopes TEXT NOT NULL,            -- comma separated: read, write, admin
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		expires_at TEXT,
+		last_used_at TEXT,
+		revoked_at TEXT,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	-- Invite codes for self-registration (see invites.go). Only the code hash is stored.
+	CREATE TABLE IF NOT EXISTS registration_invites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code_hash TEXT NOT NULL UNIQUE,
+		label TEXT NOT NULL DEFAULT '',
+		max_uses INTEGER NOT NULL DEFAULT 1,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at TEXT NOT NULL,
+		created_by INTEGER,              -- NULL when created with -create-invite
+		created_at TEXT NOT NULL,
+		revoked_at TEXT
+	);
+
+	-- Categories a stat's weekly value is broken down into (e.g. EXPENSES: payroll, rent, supplies),
+	-- and the categorized parts of each week. The stat's weekly_stats row holds their total; see
+	-- breakdown.go. Parts keep the category name so removing a category keeps past weeks intact.
+	CREATE TABLE IF NOT EXISTS stat_categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(stat_id, name),
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS weekly_stat_components (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		category TEXT NOT NULL,
+		value INTEGER NOT NULL,
+		author_user_id INTEGER,
+		updated_at TEXT NOT NULL,
+		UNIQUE(stat_id, week_ending, category),
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+
+	-- Signed corrections to a closed week's value. The weekly_stats row keeps the original figure;
+	-- series report it next to the adjusted total. See adjustments.go.
+	CREATE TABLE IF NOT EXISTS weekly_adjustments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stat_id INTEGER NOT NULL,
+		week_ending TEXT NOT NULL,
+		amount INTEGER NOT NULL,         -- same integer form as weekly_stats.value, may be negative
+		reason TEXT NOT NULL,
+		author_user_id INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE,
+		FOREIGN KEY (author_user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_weekly_adjustments_stat_week ON weekly_adjustments(stat_id, week_ending);
+
+	-- Validation rules per stat (see rules.go). Bounds and step use the weekly_stats integer form.
+	CREATE TABLE IF NOT EXISTS stat_rules (
+		stat_id INTEGER PRIMARY KEY,
+		min_value INTEGER,
+		max_value INTEGER,
+		max_change_pct INTEGER,         -- largest allowed change from the previous week, in percent
+		step INTEGER,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE CASCADE
+	);
+
+	-- Targets, the battle plan (see targets.go). target_value is in the stat's storage units.
+	CREATE TABLE IF NOT EXISTS targets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		company_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		owner_user_id INTEGER,
+		stat_id INTEGER,
+		target_value INTEGER,
+		due_date TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open', -- open | done | dropped
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		completed_at TEXT,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE,
+		FOREIGN KEY (owner_user_id) REFERENCES users(id) ON DELETE SET NULL,
+		FOREIGN KEY (stat_id) REFERENCES stats(id) ON DELETE SET NULL,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_targets_company ON targets(company_id, status, due_date);
+
+	-- Billing plans (see billing.go). max_users is the seats included; a subscription's quantity
+	-- overrides it per company. 0 means unlimited.
+	CREATE TABLE IF NOT EXISTS plans (
+		name TEXT PRIMARY KEY,
+		max_users INTEGER NOT NULL,
+		max_stats INTEGER NOT NULL DEFAULT 0,
+		history_weeks INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT OR IGNORE INTO plans (name, max_users, max_stats, history_weeks) VALUES
+		('free', 2, 10, 26),
+		('team', 10, 100, 0),
+		('business', 25, 0, 0);
+
+	-- Server-side sessions (see sessionstore.go); the cookie holds the id, only its hash is stored.
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER,
+		data BLOB NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		ip TEXT,
+		user_agent TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+	-- Onboarding wizard position per company. Companies without a row finished (or predate) onboarding.
+	CREATE TABLE IF NOT EXISTS company_onboarding (
+		company_id INTEGER PRIMARY KEY,
+		step TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+	);
 	`)
 	if err != nil {
 		log.Fatalf("failed to create tables: %v", err)
 	}
 
+	// Columns added after the initial schema. ALTER TABLE cannot be made idempotent in SQLite,
+	// so ensureColumn checks table_info first.
+	ensureColumn("weekly_stats", "submitted_at", "TEXT") // RFC3339 time the row was first written
+	ensureColumn("stats", "company_id", "INTEGER REFERENCES companies(id) ON DELETE CASCADE")
+	ensureColumn("divisions", "company_id", "INTEGER REFERENCES companies(id) ON DELETE CASCADE")
+	ensureColumn("companies", "locale", "TEXT NOT NULL DEFAULT 'en-US'") // number input locale, see locale.go
+	ensureColumn("companies", "timezone", "TEXT NOT NULL DEFAULT 'UTC'")  // IANA zone for week deadlines, see week.go
+	// Optimistic concurrency, see concurrency.go
+	ensureColumn("weekly_stats", "version", "INTEGER NOT NULL DEFAULT 1")
+	ensureColumn("weekly_stats", "updated_at", "TEXT")
+	ensureColumn("daily_stats", "version", "INTEGER NOT NULL DEFAULT 1")
+	ensureColumn("daily_stats", "updated_at", "TEXT")
+	ensureColumn("users", "email", "TEXT")
+	ensureColumn("users", "email_verified_at", "TEXT") // NULL until the address is confirmed, see email.go
+	ensureColumn("users", "last_login_at", "TEXT")
+	ensureColumn("companies", "invite_id", "INTEGER") // registration_invites row the company registered with
+	ensureColumn("users", "last_seen_at", "TEXT")
+	ensureColumn("users", "failed_logins", "INTEGER NOT NULL DEFAULT 0") // consecutive, see loginlimit.go
+	ensureColumn("users", "locked_until", "TEXT")
+	ensureColumn("companies", "fiscal_year_start", "TEXT NOT NULL DEFAULT '01-01'") // MM-DD, see fiscal.go
+	ensureColumn("stat_calculations", "sign", "INTEGER NOT NULL DEFAULT 1") // -1 subtracts the dependency, see derived.go
+	ensureColumn("stat_calculations", "divisor", "INTEGER NOT NULL DEFAULT 0") // 1 puts the dependency in the denominator
+	ensureColumn("companies", "metrics_token_hash", "TEXT") // SHA-256 of the /metrics/business scrape token
+	ensureColumn("companies", "suspended_at", "TEXT") // set by a super-admin; users cannot sign in while set
+	ensureColumn("companies", "suspended_reason", "TEXT")
+	ensureColumn("company_settings", "require_edit_reason", "BOOLEAN NOT NULL DEFAULT 0") // see valuehistory.go
+	ensureColumn("company_settings", "trend_weeks", "INTEGER") // NULL = STATHQ_TREND_WEEKS, see trends.go
+	ensureColumn("company_settings", "trend_steep_percent", "REAL") // NULL = STATHQ_TREND_STEEP
+	ensureColumn("company_settings", "trend_level_percent", "REAL") // NULL = STATHQ_TREND_LEVEL
+	ensureColumn("weekly_stats_history", "reason", "TEXT")
+	ensureColumn("users", "active", "BOOLEAN NOT NULL DEFAULT 1") // see deactivation.go
+	ensureColumn("users", "deactivated_at", "TEXT")
+	ensureColumn("users", "anonymized_at", "TEXT") // see userdata.go
+	ensureColumn("stats", "archived_at", "TEXT")
+	ensureColumn("stats", "deleted_at", "TEXT") // in the trash, see trash.go
+	ensureColumn("stats", "calc_operator", "TEXT NOT NULL DEFAULT 'sum'") // sum | average, see derived.go
+	ensureColumn("login_events", "country", "TEXT") // from STATHQ_COUNTRY_HEADER, see securityevents.go
+	ensureColumn("stats", "decimal_places", "INTEGER") // NULL = the value type's, see statformat.go
+	ensureColumn("stats", "unit_label", "TEXT")
+	ensureColumn("stats", "currency", "TEXT") // currency stats; NULL = the company's default_currency
+	ensureColumn("stats", "thousands_separator", "BOOLEAN NOT NULL DEFAULT 1")
+	ensureColumn("stat_rules", "allow_negative", "BOOLEAN NOT NULL DEFAULT 1") // see rules.go
+	ensureColumn("weekly_stats", "numerator", "INTEGER") // ratio stats, see valuetypes.go
+	ensureColumn("weekly_stats", "denominator", "INTEGER")
+	ensureColumn("daily_stats", "numerator", "INTEGER")
+	ensureColumn("daily_stats", "denominator", "INTEGER")
+	for _, table := range []string{"users", "company_ldap", "ldap_group_roles"} {
+		widenCheck(table, `IN ('admin','user')`, `IN ('admin','manager','user')`, "the manager role") // see permissions.go
+	}
+	widenCheck("stats", `IN ('number','currency','percentage')`, `IN ('number','currency','percentage','decimal','ratio')`, "decimal and ratio values")
+	widenCheck("stats", `IN ('number','currency','percentage','decimal','ratio')`, `IN ('number','currency','percentage','decimal','ratio','duration')`, "duration values")
+	backfillCompanyIDs()
+	if _, err := DB.Exec(changeLogTriggers()); err != nil {
+		log.Fatalf("failed to create change_log triggers: %v", err)
+	}
+	if _, err := DB.Exec(weekSubmissionTriggers); err != nil {
+		log.Fatalf("failed to create week_submissions triggers: %v", err)
+	}
+	if _, err := DB.Exec(weeklyHistoryTrigger); err != nil {
+		log.Fatalf("failed to create weekly_stats_history trigger: %v", err)
+	}
+
 	// Log init complete
 	log.Println("DB initialized (clean schema): stats, weekly_stats, daily_stats, assignments, users, divisions")
 }
 
-// RegisterCompany creates a company and its admin user
-func RegisterCompany(companyID, companyName, adminUsername, adminPassword string) error {
+// ensureColumn adds a column to an existing table if it is not already present.
+func ensureColumn(table, column, decl string) {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Fatalf("failed to read table_info for %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			log.Fatalf("failed to scan table_info for %s: %v", table, err)
+		}
+		if strings.EqualFold(name, column) {
+			return
+		}
+	}
+	rows.Close()
+	if _, err := DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl)); err != nil {
+		log.Fatalf("failed to add column %s.%s: %v", table, column, err)
+	}
+	log.Printf("Added column %s.%s", table, column)
+}
+
+// widenCheck rebuilds a table whose CHECK list (oldList) predates values the code now allows
+// (newList). SQLite cannot change a constraint in place, so the table is recreated from its stored
+// definition with the longer list and its rows, indexes and triggers are carried over.
+func widenCheck(table, oldList, newList, allow string) {
+	var def string
+	if err := DB.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&def); err != nil {
+		log.Fatalf("failed to read the definition of %s: %v", table, err)
+	}
+	if !strings.Contains(def, oldList) {
+		return
+	}
+	var extras []string
+	rows, err := DB.Query(`SELECT sql FROM sqlite_master WHERE type IN ('index', 'trigger') AND tbl_name = ? AND sql IS NOT NULL`, table)
+	if err != nil {
+		log.Fatalf("failed to read indexes of %s: %v", table, err)
+	}
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			log.Fatalf("failed to read indexes of %s: %v", table, err)
+		}
+		extras = append(extras, stmt)
+	}
+	rows.Close()
+
+	// Foreign keys must be off while the referenced table is briefly missing; the pragma is per
+	// connection and ignored inside a transaction.
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		log.Fatalf("failed to rebuild %s: %v", table, err)
+	}
+	defer conn.Close()
+	for _, pragma := range []string{`PRAGMA foreign_keys = OFF`, `PRAGMA legacy_alter_table = ON`} {
+		if _, err := conn.ExecContext(ctx, pragma); err != nil {
+			log.Fatalf("failed to rebuild %s: %v", table, err)
+		}
+	}
+	defer conn.ExecContext(ctx, `PRAGMA legacy_alter_table = OFF`)
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatalf("failed to rebuild %s: %v", table, err)
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		strings.Replace(strings.Replace(def, table, table+"_rebuild", 1), oldList, newList, -1),
+		fmt.Sprintf(`INSERT INTO %s_rebuild SELECT * FROM %s`, table, table),
+		fmt.Sprintf(`DROP TABLE %s`, table),
+		fmt.Sprintf(`ALTER TABLE %s_rebuild RENAME TO %s`, table, table),
+	}
+	for _, stmt := range append(stmts, extras...) {
+		if _, err := tx.Exec(stmt); err != nil {
+			log.Fatalf("failed to rebuild %s: %v", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("failed to rebuild %s: %v", table, err)
+	}
+	log.Printf("Rebuilt %s to allow %s", table, allow)
+}
+
+// backfillCompanyIDs assigns a company to stats/divisions created before those columns existed:
+// stats take their assigned user's company, and on single-company installs everything left over
+// belongs to that company.
+func backfillCompanyIDs() {
+	if _, err := DB.Exec(`
+		UPDATE stats SET company_id = (SELECT u.company_id FROM users u WHERE u.id = stats.assigned_user_id)
+		WHERE company_id IS NULL AND assigned_user_id IS NOT NULL
+	`); err != nil {
+		log.Printf("warning: failed to backfill stats.company_id: %v", err)
+	}
+
+	var count int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM companies`).Scan(&count); err != nil || count != 1 {
+		return
+	}
+	for _, table := range []string{"stats", "divisions"} {
+		if _, err := DB.Exec(fmt.Sprintf(`UPDATE %s SET company_id = (SELECT id FROM companies) WHERE company_id IS NULL`, table)); err != nil {
+			log.Printf("warning: failed to backfill %s.company_id: %v", table, err)
+		}
+	}
+}
+
+// companyDBID resolves the public company_id (as stored in the session context) to companies.id.
+func companyDBID(companyID string) (int, error) {
+	var id int
+	if err := DB.QueryRow("SELECT id FROM companies WHERE company_id = ?", companyID).Scan(&id); err != nil {
+		return 0, fmt.Errorf("company not found: %v", err)
+	}
+	return id, nil
+}
+
+// RegisterCompany creates a company and its admin user. Registration is invite-only: inviteCode is
+// spent in the same transaction, and errInvalidInvite is returned when it cannot be used.
+func RegisterCompany(companyID, companyName, adminUsername, adminPassword, inviteCode string) error {
 	tx, err := DB.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
+	defer tx.Rollback()
+
+	inviteID, err := claimInvite(tx, inviteCode)
+	if err != nil {
+		return err
+	}
+	companyDBID, err := createCompanyTx(tx, companyID, companyName, adminUsername, adminPassword)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE companies SET invite_id = ? WHERE id = ?`, inviteID, companyDBID); err != nil {
+		return fmt.Errorf("failed to record invite: %v", err)
+	}
+
+	return tx.Commit()
+}
 
+// createCompanyTx inserts a company, its admin user and its onboarding state inside tx and
+// returns the new companies.id.
+func createCompanyTx(tx *sql.Tx, companyID, companyName, adminUsername, adminPassword string) (int64, error) {
 	// Insert company
 	res, err := tx.Exec(`
 		INSERT INTO companies (company_id, name)
 		VALUES (?, ?)
 	`, companyID, companyName)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to insert company: %v", err)
+		return 0, fmt.Errorf("failed to insert company: %v", err)
 	}
 
 	companyDBID, err := res.LastInsertId()
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to get company ID: %v", err)
+		return 0, fmt.Errorf("failed to get company ID: %v", err)
 	}
 
 	// Hash admin password
 	hash, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to hash password: %v", err)
+		return 0, fmt.Errorf("failed to hash password: %v", err)
 	}
 
 	adminUsername = strings.ToLower(strings.TrimSpace(adminUsername))
-	
+
 	// Insert admin user
 	_, err = tx.Exec(`
 		INSERT INTO users (company_id, username, password_hash, role)
 		VALUES (?, ?, ?, 'admin')
 	`, companyDBID, adminUsername, hash)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to insert admin user: %v", err)
+		return 0, fmt.Errorf("failed to insert admin user: %v", err)
 	}
 
-	return tx.Commit()
+	if err := setOnboardingStep(tx, companyDBID, onboardingSteps[0]); err != nil {
+		return 0, fmt.Errorf("failed to start onboarding: %v", err)
+	}
+	return companyDBID, nil
 }
 
 // RegisterUser adds a new user to an existing company
 func RegisterUser(companyID, username, password, role string) error {
 	// Validate role
-	if role != "admin" && role != "user" && role != "manager" {
+	if !validRole(role) {
 		return fmt.Errorf("invalid role: %s", role)
 	}
 
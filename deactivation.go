@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deactivation: a departing user is switched off rather than deleted, so the values they authored
+// keep their author. POST /api/users/{id}/deactivate clears users.active, ends their sessions and
+// client logins, and from then on every sign-in method and every session or token of theirs is
+// refused; POST /api/users/{id}/reactivate lets them back in.
+//
+// Deleting a user (DELETE /api/users/{id}) can take care of their stats first:
+// ?stats=reassign&to={id} hands everything they hold to another user (see reassign.go) and
+// ?stats=archive archives their personal stats (stats.archived_at) instead of leaving them
+// unassigned.
+
+const accountDeactivatedMessage = "This account is deactivated"
+
+// userActive reports whether a user exists and is active.
+func userActive(userID int) bool {
+	var active bool
+	err := DB.QueryRow(`SELECT active FROM users WHERE id = ?`, userID).Scan(&active)
+	return err == nil && active
+}
+
+// accountActive refuses a sign-in for a deactivated user, recording the attempt and writing the
+// response. Call it once the credentials are verified.
+func accountActive(w http.ResponseWriter, r *http.Request, companyCode, username string, userID int, method string) bool {
+	if userActive(userID) {
+		return true
+	}
+	recordLogin(r, companyCode, username, userID, method, false, "deactivated")
+	http.Error(w, `{"message": "`+accountDeactivatedMessage+`"}`, http.StatusForbidden)
+	return false
+}
+
+// archiveUserStats archives the personal stats a user holds and returns them.
+func archiveUserStats(tx *sql.Tx, companyDBID, userID int, actor interface{}) ([]int, error) {
+	held, err := userStatIDs(tx, companyDBID, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	archived := []int{}
+	for _, statID := range held {
+		res, err := tx.Exec(`UPDATE stats SET archived_at = ? WHERE id = ? AND type = 'personal' AND archived_at IS NULL`, now, statID)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := logActivity(tx, actor, activityStatArchived, statID, "", map[string]interface{}{"user_id": userID}); err != nil {
+			return nil, err
+		}
+		archived = append(archived, statID)
+	}
+	return archived, nil
+}
+
+// setUserActive switches a company user on or off, returning false when the user is not found.
+func setUserActive(r *http.Request, userID int, active bool) (bool, error) {
+	var deactivatedAt interface{}
+	if !active {
+		deactivatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE users SET active = ?, deactivated_at = ?
+		WHERE id = ? AND company_id = (SELECT id FROM companies WHERE company_id = ?)
+	`, active, deactivatedAt, userID, r.Context().Value("company_id"))
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if !active {
+		// Sign them out everywhere; API tokens stay but are refused while the user is inactive.
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`DELETE FROM api_token_families WHERE user_id = ?`, userID); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func userActivationHandler(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, `{"message":"invalid user id"}`, http.StatusBadRequest)
+			return
+		}
+		if userID == r.Context().Value("user_id").(int) {
+			http.Error(w, `{"message":"Cannot deactivate own account"}`, http.StatusForbidden)
+			return
+		}
+		if active {
+			// A reactivated user takes a seat again.
+			companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+			if err != nil {
+				webFail("Failed to resolve company", w, err)
+				return
+			}
+			if ok, msg, err := checkBillingLimit(companyDBID, "user"); err != nil {
+				webFail("Failed to check plan limits", w, err)
+				return
+			} else if !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusPaymentRequired)
+				json.NewEncoder(w).Encode(map[string]string{"message": msg})
+				return
+			}
+		}
+		found, err := setUserActive(r, userID, active)
+		if err != nil {
+			webFail("Failed to update user", w, err)
+			return
+		}
+		if !found {
+			http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("User %v set active=%t for user %d", r.Context().Value("user_id"), active, userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "active": active})
+	}
+}
+
+// ---------- POST /api/users/{id}/deactivate ----------
+var DeactivateUserHandler = userActivationHandler(false)
+
+// ---------- POST /api/users/{id}/reactivate ----------
+var ReactivateUserHandler = userActivationHandler(true)
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Calculation dependency graph: which stats feed a stat (upstream, recursively through calculated
+// stats) and which calculated stats it feeds (downstream), with any cycles among them. Editing a
+// stat's terms into a cycle is refused (calcCycleMessage); cycles that predate the check are
+// reported here and make the recalculation of the stats downstream of them fail, rather than
+// showing up as odd values. The recalculation worker uses downstreamOrder to compute a chain of
+// calculated stats inputs first.
+
+type depNode struct {
+	ID              int    `json:"id"`
+	ShortID         string `json:"short_id"`
+	FullName        string `json:"full_name"`
+	Type            string `json:"type"`
+	ValueType       string `json:"value_type"`
+	IsCalculated    bool   `json:"is_calculated"`
+	Operator        string `json:"operator,omitempty"`         // calculated stats: sum or average
+	UpstreamDepth   *int   `json:"upstream_depth,omitempty"`   // steps from the stat towards its inputs
+	DownstreamDepth *int   `json:"downstream_depth,omitempty"` // steps from the stat towards what it feeds
+}
+
+// depEdge says From is a term of the calculated stat To.
+type depEdge struct {
+	From    int  `json:"from"`
+	To      int  `json:"to"`
+	Sign    int  `json:"sign"`
+	Divisor bool `json:"divisor,omitempty"`
+}
+
+// calcGraph is a company's stat_calculations as adjacency lists.
+type calcGraph struct {
+	terms map[int][]depEdge // calculated stat -> its terms
+	users map[int][]depEdge // stat -> calculated stats it is a term of
+}
+
+func loadCalcGraph(q queryer, companyDBID int) (*calcGraph, error) {
+	rows, err := q.Query(`
+		SELECT sc.dependent_stat_id, sc.stat_id, sc.sign, sc.divisor
+		FROM stat_calculations sc JOIN stats s ON s.id = sc.stat_id
+		WHERE s.company_id = ?
+		ORDER BY sc.stat_id, sc.dependent_stat_id
+	`, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	g := &calcGraph{terms: map[int][]depEdge{}, users: map[int][]depEdge{}}
+	for rows.Next() {
+		var e depEdge
+		if err := rows.Scan(&e.From, &e.To, &e.Sign, &e.Divisor); err != nil {
+			return nil, err
+		}
+		g.terms[e.To] = append(g.terms[e.To], e)
+		g.users[e.From] = append(g.users[e.From], e)
+	}
+	return g, rows.Err()
+}
+
+// walk visits everything reachable from start along next, returning each stat's distance and the
+// edges followed.
+func (g *calcGraph) walk(start int, next func(int) []depEdge, far func(depEdge) int) (map[int]int, []depEdge) {
+	depth := map[int]int{start: 0}
+	var edges []depEdge
+	queue := []int{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, e := range next(id) {
+			edges = append(edges, e)
+			n := far(e)
+			if _, seen := depth[n]; !seen {
+				depth[n] = depth[id] + 1
+				queue = append(queue, n)
+			}
+		}
+	}
+	return depth, edges
+}
+
+// cycles returns the strongly connected components among ids that form a cycle (Tarjan), each
+// sorted by stat id.
+func (g *calcGraph) cycles(ids []int) [][]int {
+	in := map[int]bool{}
+	for _, id := range ids {
+		in[id] = true
+	}
+	index, low := map[int]int{}, map[int]int{}
+	onStack := map[int]bool{}
+	var stack []int
+	var out [][]int
+	counter := 0
+	var strong func(v int)
+	strong = func(v int) {
+		index[v], low[v] = counter, counter
+		counter++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, e := range g.terms[v] {
+			w := e.From
+			if !in[w] {
+				continue
+			}
+			if _, seen := index[w]; !seen {
+				strong(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var comp []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			comp = append(comp, w)
+			if w == v {
+				break
+			}
+		}
+		selfLoop := false
+		for _, e := range g.terms[v] {
+			if e.From == v {
+				selfLoop = true
+			}
+		}
+		if len(comp) > 1 || selfLoop {
+			sort.Ints(comp)
+			out = append(out, comp)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if _, seen := index[id]; !seen {
+			strong(id)
+		}
+	}
+	return out
+}
+
+// cycleThrough returns the stats in a cycle with statID, sorted by id, or nil when there is none.
+func (g *calcGraph) cycleThrough(statID int) []int {
+	up, _ := g.walk(statID, func(id int) []depEdge { return g.terms[id] }, func(e depEdge) int { return e.From })
+	ids := make([]int, 0, len(up))
+	for id := range up {
+		ids = append(ids, id)
+	}
+	for _, c := range g.cycles(ids) {
+		for _, id := range c {
+			if id == statID {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// inputsFirst orders the stats in set so each comes after those of its terms that are in set
+// (Kahn's algorithm), so recomputing them in turn uses up-to-date inputs. It fails when they
+// include a cycle.
+func (g *calcGraph) inputsFirst(set map[int]int) ([]int, error) {
+	waiting := map[int]int{} // terms in set not yet ordered
+	var ready []int
+	for id := range set {
+		for _, e := range g.terms[id] {
+			if _, ok := set[e.From]; ok {
+				waiting[id]++
+			}
+		}
+		if waiting[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	sort.Ints(ready)
+	order := make([]int, 0, len(set))
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, id)
+		for _, e := range g.users[id] {
+			if _, ok := set[e.To]; !ok {
+				continue
+			}
+			if waiting[e.To]--; waiting[e.To] == 0 {
+				ready = append(ready, e.To)
+			}
+		}
+	}
+	if len(order) < len(set) {
+		var stuck []int
+		for id := range set {
+			if waiting[id] > 0 {
+				stuck = append(stuck, id)
+			}
+		}
+		sort.Ints(stuck)
+		return nil, fmt.Errorf("circular calculation among stats %v", stuck)
+	}
+	return order, nil
+}
+
+// downstreamOrder lists the calculated stats built on start, directly or through other calculated
+// stats, inputs first.
+func (g *calcGraph) downstreamOrder(start int) ([]int, error) {
+	down, _ := g.walk(start, func(id int) []depEdge { return g.users[id] }, func(e depEdge) int { return e.To })
+	order, err := g.inputsFirst(down)
+	if err != nil {
+		return nil, err
+	}
+	return order[1:], nil // start, the only one without terms in down
+}
+
+// calculatedOrder lists every calculated stat of the graph, inputs first.
+func (g *calcGraph) calculatedOrder() ([]int, error) {
+	set := map[int]int{}
+	for id := range g.terms {
+		set[id] = 0
+	}
+	return g.inputsFirst(set)
+}
+
+// calcCycleMessage reports, as a message for the client, when statID's terms as written in tx make
+// it depend on itself; it is empty otherwise.
+func calcCycleMessage(tx *sql.Tx, companyDBID, statID int) (string, error) {
+	g, err := loadCalcGraph(tx, companyDBID)
+	if err != nil {
+		return "", err
+	}
+	cycle := g.cycleThrough(statID)
+	if cycle == nil {
+		return "", nil
+	}
+	names := make([]string, len(cycle))
+	for i, id := range cycle {
+		if err := tx.QueryRow(`SELECT short_id FROM stats WHERE id = ?`, id).Scan(&names[i]); err != nil {
+			return "", err
+		}
+	}
+	return "These terms would make a circular calculation among " + strings.Join(names, ", "), nil
+}
+
+// ---------- GET /api/stats/{id}/dependencies ----------
+func StatDependenciesHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	g, err := loadCalcGraph(DB, companyDBID)
+	if err != nil {
+		webFail("Failed to load calculations", w, err)
+		return
+	}
+	up, upEdges := g.walk(statID, func(id int) []depEdge { return g.terms[id] }, func(e depEdge) int { return e.From })
+	down, downEdges := g.walk(statID, func(id int) []depEdge { return g.users[id] }, func(e depEdge) int { return e.To })
+
+	var ids []int
+	seen := map[int]bool{}
+	for _, m := range []map[int]int{up, down} {
+		for id := range m {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	nodes := []depNode{}
+	for _, id := range ids {
+		n := depNode{ID: id}
+		if err := DB.QueryRow(`SELECT short_id, full_name, type, value_type, is_calculated, calc_operator FROM stats WHERE id = ?`, id).
+			Scan(&n.ShortID, &n.FullName, &n.Type, &n.ValueType, &n.IsCalculated, &n.Operator); err != nil {
+			n.ShortID = "(missing)"
+		}
+		if !n.IsCalculated {
+			n.Operator = ""
+		}
+		if d, ok := up[id]; ok {
+			n.UpstreamDepth = &d
+		}
+		if d, ok := down[id]; ok {
+			n.DownstreamDepth = &d
+		}
+		nodes = append(nodes, n)
+	}
+	cycles := g.cycles(ids)
+	if cycles == nil {
+		cycles = [][]int{}
+	}
+	if upEdges == nil {
+		upEdges = []depEdge{}
+	}
+	if downEdges == nil {
+		downEdges = []depEdge{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat_id":          statID,
+		"nodes":            nodes,
+		"upstream_edges":   upEdges,
+		"downstream_edges": downEdges,
+		"upstream_count":   len(up) - 1,
+		"downstream_count": len(down) - 1,
+		"has_cycle":        len(cycles) > 0,
+		"cycles":           cycles,
+	})
+}
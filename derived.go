@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Derived stats. A calculated stat adds its calculated_from dependencies and subtracts its
+// calculated_minus ones (stat_calculations.sign = -1), so "A minus B" stats such as Profit are
+// written by the recalculation worker every week like any other calculated stat. The built-in Profit
+// stat is GI minus EXPENSES; POST /api/stats/profit creates it once both exist.
+//
+// Dependencies in calculated_divide_by (stat_calculations.divisor = 1) make the stat a ratio: the
+// signed sum of the other terms over the sum of the divisor terms, e.g. VSD / GI as a percentage
+// stat. A week whose denominator is zero has no value rather than an error.
+//
+// stats.calc_operator "average" (calc_operator in the create and update payloads) makes the stat the
+// mean of the calculated_from terms that have a value, e.g. the average close rate of several
+// salesmen; it takes no minus or divisor terms. evalCalc is the one place these rules live: the
+// recalculation worker, the daily grid, the OIC board and the what-if simulator all use it.
+
+const (
+	profitShortID   = "PROFIT"
+	profitFullName  = "Profit"
+	profitIncomeID  = "GI"
+	profitExpenseID = "EXPENSES"
+)
+
+const (
+	calcOpSum     = "sum"     // signed sum of the terms, a ratio when some are divisors
+	calcOpAverage = "average" // mean of the terms that have a value
+)
+
+// calcTerm is one dependency of a calculated stat: its value is added (Sign 1) or subtracted (-1),
+// in the denominator when Divisor is set.
+type calcTerm struct {
+	StatID  int  `json:"stat_id"`
+	Sign    int  `json:"sign"`
+	Divisor bool `json:"divisor,omitempty"`
+}
+
+// isRatio reports whether any term is a divisor.
+func isRatio(terms []calcTerm) bool {
+	for _, t := range terms {
+		if t.Divisor {
+			return true
+		}
+	}
+	return false
+}
+
+// calcResult turns a calculated stat's summed numerator and denominator into its stored value.
+// Ratios are scaled to the stat's value type: a percentage stores hundredths of a percent (0.25 is
+// 2500), currency the minor units of the stat's currency (cents, or whole yen), decimal and ratio
+// ten-thousandths. ok is false when a ratio's denominator is zero.
+func calcResult(num, den int64, ratio bool, valueType, currency string) (int64, bool) {
+	if !ratio {
+		return num, true
+	}
+	if den == 0 {
+		return 0, false
+	}
+	scale := 1.0
+	switch valueType {
+	case "percentage":
+		scale = 10000
+	case "currency":
+		scale = math.Pow10(currencyOf(currency).Places)
+	case "decimal", "ratio":
+		scale = decimalScale
+	}
+	return int64(math.Round(float64(num) * scale / float64(den))), true
+}
+
+// evalCalc combines the values of a calculated stat's terms (values[i] is nil when terms[i] has no
+// value) into its stored value. ok is false when the stat has no value: none of the non-divisor
+// terms has one, or a ratio's denominator is zero.
+func evalCalc(op string, terms []calcTerm, values []*int64, valueType, currency string) (int64, bool) {
+	var num, den int64
+	found := 0
+	for i, t := range terms {
+		if values[i] == nil {
+			continue
+		}
+		if t.Divisor {
+			den += *values[i] * int64(t.Sign)
+		} else {
+			num += *values[i] * int64(t.Sign)
+			found++
+		}
+	}
+	if found == 0 {
+		return 0, false
+	}
+	if op == calcOpAverage {
+		return int64(math.Round(float64(num) / float64(found))), true
+	}
+	return calcResult(num, den, isRatio(terms), valueType, currency)
+}
+
+// checkCalcOperator validates a calculated stat's operator against its terms, returning the
+// operator to store ("sum" when empty) or a message for the client.
+func checkCalcOperator(op string, minus, divideBy []int) (string, string) {
+	switch op {
+	case "", calcOpSum:
+		return calcOpSum, ""
+	case calcOpAverage:
+		if len(minus) > 0 || len(divideBy) > 0 {
+			return "", "an average takes only calculated_from terms"
+		}
+		return op, ""
+	}
+	return "", fmt.Sprintf("calc_operator must be %q or %q", calcOpSum, calcOpAverage)
+}
+
+// calcTerms loads a calculated stat's terms, leaving out dependencies in the trash (see trash.go).
+func calcTerms(q queryer, statID int) ([]calcTerm, error) {
+	rows, err := q.Query(`
+		SELECT c.dependent_stat_id, c.sign, c.divisor FROM stat_calculations c JOIN stats d ON d.id = c.dependent_stat_id
+		WHERE c.stat_id = ? AND d.deleted_at IS NULL ORDER BY c.dependent_stat_id
+	`, statID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var terms []calcTerm
+	for rows.Next() {
+		var t calcTerm
+		if err := rows.Scan(&t.StatID, &t.Sign, &t.Divisor); err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+	}
+	return terms, rows.Err()
+}
+
+// calcOperator returns a stat's operator.
+func calcOperator(q rowQueryer, statID int) (string, error) {
+	var op string
+	err := q.QueryRow(`SELECT calc_operator FROM stats WHERE id = ?`, statID).Scan(&op)
+	return op, err
+}
+
+// insertCalculationTerms writes a calculated stat's dependencies. A stat listed in both plus and
+// minus is subtracted; one listed in divideBy is always a divisor.
+func insertCalculationTerms(tx *sql.Tx, statID int, plus, minus, divideBy []int) error {
+	for _, depID := range plus {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO stat_calculations (stat_id, dependent_stat_id, sign) VALUES (?, ?, 1)`, statID, depID); err != nil {
+			return err
+		}
+	}
+	for _, depID := range minus {
+		if _, err := tx.Exec(`
+			INSERT INTO stat_calculations (stat_id, dependent_stat_id, sign) VALUES (?, ?, -1)
+			ON CONFLICT (stat_id, dependent_stat_id) DO UPDATE SET sign = -1
+		`, statID, depID); err != nil {
+			return err
+		}
+	}
+	for _, depID := range divideBy {
+		if _, err := tx.Exec(`
+			INSERT INTO stat_calculations (stat_id, dependent_stat_id, sign, divisor) VALUES (?, ?, 1, 1)
+			ON CONFLICT (stat_id, dependent_stat_id) DO UPDATE SET sign = 1, divisor = 1
+		`, statID, depID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureProfitStat creates the company's PROFIT stat (GI - EXPENSES) when GI and EXPENSES exist and
+// PROFIT does not. It returns the PROFIT stat id, 0 when the inputs are missing, and whether it was
+// created.
+func ensureProfitStat(companyDBID int, userID interface{}) (int, bool, error) {
+	var existing int
+	err := DB.QueryRow(`SELECT id FROM stats WHERE company_id = ? AND upper(short_id) = ?`, companyDBID, profitShortID).Scan(&existing)
+	if err == nil {
+		return existing, false, nil
+	} else if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	var gi, expenses int
+	var divisionID sql.NullInt64
+	err = DB.QueryRow(`SELECT id, assigned_division_id FROM stats WHERE company_id = ? AND upper(short_id) = ?`, companyDBID, profitIncomeID).Scan(&gi, &divisionID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	err = DB.QueryRow(`SELECT id FROM stats WHERE company_id = ? AND upper(short_id) = ?`, companyDBID, profitExpenseID).Scan(&expenses)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		INSERT INTO stats (short_id, full_name, type, value_type, assigned_division_id, is_calculated, company_id)
+		VALUES (?, ?, 'main', 'currency', ?, 1, ?)
+	`, profitShortID, profitFullName, divisionID, companyDBID)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+	if err := insertCalculationTerms(tx, int(id), []int{gi}, []int{expenses}, nil); err != nil {
+		return 0, false, err
+	}
+	if divisionID.Valid {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO stat_division_assignments (stat_id, division_id) VALUES (?, ?)`, id, divisionID.Int64); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := logActivity(tx, userID, activityStatCreated, int(id), "", map[string]string{
+		"full_name": profitFullName, "formula": fmt.Sprintf("%s - %s", profitIncomeID, profitExpenseID),
+	}); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+
+	if err := enqueueRecalcStat(DB, int(id), ""); err != nil {
+		log.Printf("Failed to queue recalculation of stat %d: %v", id, err)
+	}
+	if err := markStatCompanyAggregatesDirty(int(id)); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", id, err)
+	}
+	return int(id), true, nil
+}
+
+// ---------- POST /api/stats/profit ----------
+// Creates the built-in PROFIT stat (GI - EXPENSES) if the company does not have one yet.
+func CreateProfitStatHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if ok, msg, err := checkBillingLimit(companyDBID, "stat"); err != nil {
+		webFail("Failed to check plan limits", w, err)
+		return
+	} else if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+		return
+	}
+	id, created, err := ensureProfitStat(companyDBID, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to create profit stat", w, err)
+		return
+	}
+	if id == 0 {
+		http.Error(w, `{"message":"Profit needs stats with short IDs GI and EXPENSES"}`, http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"stat_id": id, "created": created})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Profile email addresses. An address is stored on the user as soon as it is set but counts as
+// unverified until the user opens the tokenized link mailed to it; verifiedEmail is the only way
+// other features (password reset, report delivery) should look an address up.
+//
+// Mail goes through STATHQ_SMTP_ADDR (host:port) as STATHQ_SMTP_FROM, authenticating with
+// STATHQ_SMTP_USERNAME / STATHQ_SMTP_PASSWORD when set. Without STATHQ_SMTP_ADDR the message is
+// written to the log instead, which is enough for development. Links are built from
+// STATHQ_PUBLIC_URL, falling back to the host of the request.
+
+const emailVerificationTTL = 48 * time.Hour
+
+// sendMail delivers a plain-text message.
+func sendMail(to, subject, body string) error {
+	addr := envString("STATHQ_SMTP_ADDR", "")
+	from := envString("STATHQ_SMTP_FROM", "stathq@localhost")
+	if addr == "" {
+		log.Printf("Mail to %s (SMTP not configured): %s\n%s", to, subject, body)
+		return nil
+	}
+	var auth smtp.Auth
+	if user := envString("STATHQ_SMTP_USERNAME", ""); user != "" {
+		host := addr
+		if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", user, envString("STATHQ_SMTP_PASSWORD", ""), host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		from, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
+
+// publicURL is the externally visible base URL used in mailed links.
+func publicURL(r *http.Request) string {
+	if u := envString("STATHQ_PUBLIC_URL", ""); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// verifiedEmail returns the user's address only when it has been verified.
+func verifiedEmail(userID int) (string, bool) {
+	var email, verifiedAt sql.NullString
+	err := DB.QueryRow(`SELECT email, email_verified_at FROM users WHERE id = ?`, userID).Scan(&email, &verifiedAt)
+	if err != nil || !email.Valid || !verifiedAt.Valid {
+		return "", false
+	}
+	return email.String, true
+}
+
+// sendEmailVerification replaces any outstanding token for the user and mails a new link.
+func sendEmailVerification(r *http.Request, userID int, email string) error {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if _, err := DB.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO email_verifications (token_hash, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+	`, hash, userID, email, now.Format(time.RFC3339), now.Add(emailVerificationTTL).Format(time.RFC3339)); err != nil {
+		return err
+	}
+	link := shardLink(publicURL(r) + "/verify-email?token=" + token)
+	body := fmt.Sprintf("Confirm this address for your StatHQ account by opening:\n\n%s\n\nThe link expires in %d hours. If you did not ask for this, ignore this message.\n",
+		link, int(emailVerificationTTL.Hours()))
+	return sendMail(email, "Confirm your StatHQ email address", body)
+}
+
+type emailStatus struct {
+	Email       string `json:"email,omitempty"`
+	Verified    bool   `json:"verified"`
+	VerifiedAt  string `json:"verified_at,omitempty"`
+	PendingSent string `json:"verification_sent_at,omitempty"`
+}
+
+func loadEmailStatus(userID int) (emailStatus, error) {
+	var st emailStatus
+	var email, verifiedAt, sent sql.NullString
+	err := DB.QueryRow(`
+		SELECT u.email, u.email_verified_at, (SELECT MAX(created_at) FROM email_verifications WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, userID).Scan(&email, &verifiedAt, &sent)
+	st.Email, st.Verified, st.VerifiedAt = email.String, verifiedAt.Valid, verifiedAt.String
+	if !st.Verified {
+		st.PendingSent = sent.String
+	}
+	return st, err
+}
+
+// ---------- GET /api/user/email ----------
+func EmailStatusHandler(w http.ResponseWriter, r *http.Request) {
+	st, err := loadEmailStatus(r.Context().Value("user_id").(int))
+	if err != nil {
+		webFail("Failed to load email status", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// ---------- PUT /api/user/email ----------
+// Sets (or clears, with "") the caller's address. A new address starts unverified and a link is sent.
+func UpdateEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	email := strings.TrimSpace(req.Email)
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			http.Error(w, `{"message":"Invalid email address"}`, http.StatusBadRequest)
+			return
+		}
+		email = strings.ToLower(email)
+	}
+
+	current, err := loadEmailStatus(userID)
+	if err != nil {
+		webFail("Failed to load email status", w, err)
+		return
+	}
+	if email != current.Email {
+		if _, err := DB.Exec(`UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?`, nullIfEmpty(email), userID); err != nil {
+			webFail("Failed to update email", w, err)
+			return
+		}
+		DB.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID)
+		if email != "" {
+			if err := sendEmailVerification(r, userID, email); err != nil {
+				webFail("Failed to send verification email", w, err)
+				return
+			}
+		}
+	}
+	st, err := loadEmailStatus(userID)
+	if err != nil {
+		webFail("Failed to load email status", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// ---------- POST /api/user/email/resend ----------
+func ResendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	st, err := loadEmailStatus(userID)
+	if err != nil {
+		webFail("Failed to load email status", w, err)
+		return
+	}
+	if st.Email == "" {
+		http.Error(w, `{"message":"No email address set"}`, http.StatusBadRequest)
+		return
+	}
+	if st.Verified {
+		http.Error(w, `{"message":"Email address already verified"}`, http.StatusConflict)
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, st.PendingSent); err == nil && time.Since(t) < time.Minute {
+		http.Error(w, `{"message":"Please wait a minute before requesting another email"}`, http.StatusTooManyRequests)
+		return
+	}
+	if err := sendEmailVerification(r, userID, st.Email); err != nil {
+		webFail("Failed to send verification email", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// ---------- GET /verify-email?token=... ----------
+// The link target. Public: the token is the credential.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+	var userID int
+	var email, expires string
+	err := DB.QueryRow(`SELECT user_id, email, expires_at FROM email_verifications WHERE token_hash = ?`, hashSecretToken(token)).Scan(&userID, &email, &expires)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This link is invalid or has already been used.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webFail("Failed to look up token", w, err)
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, expires); err != nil || time.Now().After(t) {
+		DB.Exec(`DELETE FROM email_verifications WHERE token_hash = ?`, hashSecretToken(token))
+		http.Error(w, "This link has expired. Request a new one from your profile.", http.StatusGone)
+		return
+	}
+	// The address may have changed since the link was sent; only the address it was sent to verifies.
+	res, err := DB.Exec(`UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ?`, time.Now().UTC().Format(time.RFC3339), userID, email)
+	if err != nil {
+		webFail("Failed to verify email", w, err)
+		return
+	}
+	DB.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID)
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "This link is for an address no longer on the account.", http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!doctype html><title>Email verified</title><p>Your email address is verified. <a href="/">Return to StatHQ</a></p>`)
+}
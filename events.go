@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Live events: writes publish small JSON events to every dashboard of the same company that holds
+// GET /api/events open, so the OIC screen can refresh without polling. Delivery is best effort:
+// a subscriber that falls behind drops events rather than blocking the writer.
+
+const (
+	eventStatWritten      = "stat-written"
+	eventReportSubmitted  = "report-submitted"
+	eventAlertFired       = "alert-fired"
+	eventConditionChanged = "condition-changed"
+	eventWeekOpened       = "week-opened"
+)
+
+type liveEvent struct {
+	Type       string      `json:"type"`
+	StatID     int         `json:"stat_id"`
+	Date       string      `json:"date,omitempty"`
+	WeekEnding string      `json:"week_ending,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	At         string      `json:"at"`
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[int]map[chan liveEvent]struct{} // company db id -> subscribers
+}
+
+var events = &eventHub{subs: map[int]map[chan liveEvent]struct{}{}}
+
+func (h *eventHub) subscribe(companyID int) chan liveEvent {
+	ch := make(chan liveEvent, 32)
+	h.mu.Lock()
+	if h.subs[companyID] == nil {
+		h.subs[companyID] = map[chan liveEvent]struct{}{}
+	}
+	h.subs[companyID][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(companyID int, ch chan liveEvent) {
+	h.mu.Lock()
+	delete(h.subs[companyID], ch)
+	if len(h.subs[companyID]) == 0 {
+		delete(h.subs, companyID)
+	}
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(companyID int, ev liveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[companyID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishStatEvent routes an event to the company owning the stat. Errors are only logged;
+// a missing live update must never fail the write that triggered it.
+func publishStatEvent(ev liveEvent) {
+	var companyID int
+	if err := DB.QueryRow(`SELECT COALESCE(company_id, 0) FROM stats WHERE id = ?`, ev.StatID).Scan(&companyID); err != nil {
+		log.Printf("Live event %s for stat %d not published: %v", ev.Type, ev.StatID, err)
+		return
+	}
+	ev.At = time.Now().UTC().Format(time.RFC3339)
+	events.publish(companyID, ev)
+}
+
+// publishWeeklyEvents announces a submitted weekly value and, when the week has a quota the value
+// misses, an alert. A crash is also sent to linked Telegram chats.
+func publishWeeklyEvents(statID int, weekEnding string, value int64) {
+	var valueType string
+	var reversed bool
+	if err := DB.QueryRow(`SELECT value_type, reversed FROM stats WHERE id = ?`, statID).Scan(&valueType, &reversed); err != nil {
+		log.Printf("Live events for stat %d not published: %v", statID, err)
+		return
+	}
+	currency := statCurrency(statID)
+	publishStatEvent(liveEvent{Type: eventReportSubmitted, StatID: statID, WeekEnding: weekEnding,
+		Data: map[string]string{"value": formatStatValue(value, valueType, currency)}})
+	notifyTelegramCrash(statID, weekEnding, value, valueType, reversed)
+
+	var quota int64
+	if err := DB.QueryRow(`SELECT value FROM stat_quotas WHERE stat_id = ? AND week_ending = ?`, statID, weekEnding).Scan(&quota); err != nil {
+		return
+	}
+	if !quotaMet(value, quota, reversed) {
+		publishStatEvent(liveEvent{Type: eventAlertFired, StatID: statID, WeekEnding: weekEnding,
+			Data: map[string]string{
+				"reason": "quota_missed",
+				"value":  formatStatValue(value, valueType, currency),
+				"quota":  formatStatValue(quota, valueType, currency),
+			}})
+	}
+}
+
+// ---------- GET /api/events ----------
+// Server-sent events stream for the caller's company. Each message is "event: <type>" with the
+// liveEvent as JSON data; a comment line is sent every 25s to keep proxies from closing the stream.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"message":"Streaming unsupported"}`, http.StatusInternalServerError)
+		return
+	}
+	companyID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	ch := events.subscribe(companyID)
+	defer events.unsubscribe(companyID, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(25 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
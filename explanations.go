@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Explanations: when a stat goes down against the previous week (or crashes, i.e. falls by at least
+// STATHQ_CRASH_PERCENT, default 25) the assigned user must say why and how it is being handled.
+// A user cannot mark their week complete while any of their stats has an outstanding explanation.
+
+type outstandingExplanation struct {
+	StatID     int    `json:"stat_id"`
+	ShortID    string `json:"short_id"`
+	FullName   string `json:"full_name"`
+	WeekEnding string `json:"week_ending"`
+	Trend      string `json:"trend"` // down | crashed
+	Value      string `json:"value"`
+	Previous   string `json:"previous"`
+	UserID     *int   `json:"assigned_user_id,omitempty"`
+	Username   string `json:"assigned_username,omitempty"`
+}
+
+type statExplanation struct {
+	ID         int    `json:"id"`
+	StatID     int    `json:"stat_id"`
+	WeekEnding string `json:"week_ending"`
+	Why        string `json:"why"`
+	Handling   string `json:"handling"`
+	AuthorID   *int   `json:"author_user_id,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// weekTrend classifies a change from prev to cur as "up", "level", "down" or "crashed",
+// taking reversed (lower is better) stats into account.
+func weekTrend(cur, prev int64, reversed bool) string {
+	if cur == prev {
+		return "level"
+	}
+	if (cur > prev) != reversed {
+		return "up"
+	}
+	if prev != 0 {
+		drop := float64(cur-prev) / float64(prev) * 100
+		if drop < 0 {
+			drop = -drop
+		}
+		if drop >= float64(envInt("STATHQ_CRASH_PERCENT", 25)) {
+			return "crashed"
+		}
+	}
+	return "down"
+}
+
+// outstandingExplanations lists the company's stats that went down in week and have no
+// explanation yet. When userID is non-zero only stats assigned to that user are considered.
+func outstandingExplanations(companyDBID, userID int, week string) ([]outstandingExplanation, error) {
+	we, err := time.Parse("2006-01-02", week)
+	if err != nil {
+		return nil, err
+	}
+	prevWeek := we.AddDate(0, 0, -7).Format("2006-01-02")
+
+	query := `
+		SELECT s.id, s.short_id, s.full_name, s.value_type, s.reversed, s.assigned_user_id, COALESCE(u.username, ''),
+		       cur.value, prev.value
+		FROM stats s
+		JOIN weekly_stats cur ON cur.stat_id = s.id AND cur.week_ending = ?
+		JOIN weekly_stats prev ON prev.stat_id = s.id AND prev.week_ending = ?
+		LEFT JOIN users u ON u.id = s.assigned_user_id
+		WHERE s.company_id = ?
+		  AND NOT EXISTS (SELECT 1 FROM stat_explanations e WHERE e.stat_id = s.id AND e.week_ending = ?)`
+	args := []interface{}{week, prevWeek, companyDBID, week}
+	if userID != 0 {
+		query += ` AND s.assigned_user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := DB.Query(query+` ORDER BY s.short_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []outstandingExplanation{}
+	for rows.Next() {
+		var o outstandingExplanation
+		var valueType string
+		var reversed bool
+		var assigned sql.NullInt64
+		var cur, prev int64
+		if err := rows.Scan(&o.StatID, &o.ShortID, &o.FullName, &valueType, &reversed, &assigned, &o.Username, &cur, &prev); err != nil {
+			return nil, err
+		}
+		o.Trend = weekTrend(cur, prev, reversed)
+		if o.Trend != "down" && o.Trend != "crashed" {
+			continue
+		}
+		o.WeekEnding = week
+		currency := statCurrency(o.StatID)
+		o.Value = formatStatValue(cur, valueType, currency)
+		o.Previous = formatStatValue(prev, valueType, currency)
+		if assigned.Valid {
+			id := int(assigned.Int64)
+			o.UserID = &id
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// explanationWeek reads and validates the ?week= parameter, defaulting to the current week.
+func explanationWeek(r *http.Request) (string, error) {
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		return currentWeekEnding(time.Now(), requestWeekEndingDay(r)), nil
+	}
+	return week, checkIfValidWE(r.Context().Value("company_id").(string), week)
+}
+
+// ---------- GET /api/explanations/outstanding?week=YYYY-MM-DD ----------
+// Admins see every stat of the company; other users only their own.
+func OutstandingExplanationsHandler(w http.ResponseWriter, r *http.Request) {
+	week, err := explanationWeek(r)
+	if err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	if can(r.Context().Value("role").(string), permAllStats) {
+		userID = 0
+	}
+	out, err := outstandingExplanations(companyDBID, userID, week)
+	if err != nil {
+		webFail("Failed to find outstanding explanations", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week_ending": week,
+		"outstanding": out,
+	})
+}
+
+// ---------- POST /api/stats/{id}/explanations ----------
+// Body: { "week_ending": "YYYY-MM-DD", "why": "...", "handling": "..." }. Assigned user or admin.
+func SubmitExplanationHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		WeekEnding string `json:"week_ending"`
+		Why        string `json:"why"`
+		Handling   string `json:"handling"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.Why, req.Handling = strings.TrimSpace(req.Why), strings.TrimSpace(req.Handling)
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), req.WeekEnding); err != nil {
+		http.Error(w, `{"message":"week_ending must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Why == "" || req.Handling == "" {
+		http.Error(w, `{"message":"both why and handling are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if status, msg := checkStatAccess(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+
+	userID := r.Context().Value("user_id")
+	_, err = DB.Exec(`
+		INSERT INTO stat_explanations (stat_id, week_ending, why, handling, author_user_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(stat_id, week_ending) DO UPDATE SET why = excluded.why, handling = excluded.handling,
+			author_user_id = excluded.author_user_id, created_at = excluded.created_at
+	`, statID, req.WeekEnding, req.Why, req.Handling, userID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		webFail("Failed to save explanation", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Explanation saved"})
+}
+
+// ---------- GET /api/stats/{id}/explanations ----------
+func ListExplanationsHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	rows, err := DB.Query(`SELECT id, stat_id, week_ending, why, handling, author_user_id, created_at FROM stat_explanations WHERE stat_id = ? ORDER BY week_ending DESC`, statID)
+	if err != nil {
+		webFail("Failed to query explanations", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []statExplanation{}
+	for rows.Next() {
+		var e statExplanation
+		var author sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.StatID, &e.WeekEnding, &e.Why, &e.Handling, &author, &e.CreatedAt); err != nil {
+			webFail("Failed to scan explanation", w, err)
+			return
+		}
+		if author.Valid {
+			id := int(author.Int64)
+			e.AuthorID = &id
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/weeks/complete?week=YYYY-MM-DD ----------
+// Marks the caller's week complete. Refused with 409 while explanations are outstanding.
+func CompleteWeekHandler(w http.ResponseWriter, r *http.Request) {
+	week, err := explanationWeek(r)
+	if err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	out, err := outstandingExplanations(companyDBID, userID, week)
+	if err != nil {
+		webFail("Failed to find outstanding explanations", w, err)
+		return
+	}
+	if len(out) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":     "Explain every down or crashed stat before completing the week",
+			"outstanding": out,
+		})
+		return
+	}
+	completedAt := time.Now().UTC().Format(time.RFC3339)
+	if _, err := DB.Exec(`INSERT OR IGNORE INTO week_completions (user_id, week_ending, completed_at) VALUES (?, ?, ?)`, userID, week, completedAt); err != nil {
+		webFail("Failed to complete week", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Week completed", "week_ending": week})
+}
+
+// checkStatCompany returns a non-zero HTTP status when the stat does not belong to the caller's company.
+func checkStatCompany(r *http.Request, statID int) (int, string) {
+	var companyID string
+	err := DB.QueryRow(`SELECT c.company_id FROM stats s JOIN companies c ON c.id = s.company_id WHERE s.id = ? AND s.deleted_at IS NULL`, statID).Scan(&companyID)
+	if err != nil || companyID != r.Context().Value("company_id") {
+		return http.StatusNotFound, "stat not found"
+	}
+	return 0, ""
+}
+
+// checkStatAccess is checkStatCompany plus: without permAllStats a user may only act on stats
+// assigned to them.
+func checkStatAccess(r *http.Request, statID int) (int, string) {
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		return status, msg
+	}
+	if can(r.Context().Value("role").(string), permAllStats) {
+		return 0, ""
+	}
+	var assigned sql.NullInt64
+	DB.QueryRow(`SELECT assigned_user_id FROM stats WHERE id = ?`, statID).Scan(&assigned)
+	if !assigned.Valid || int(assigned.Int64) != r.Context().Value("user_id") {
+		return http.StatusForbidden, "only the assigned user or an admin can do this"
+	}
+	return 0, ""
+}
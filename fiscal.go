@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Fiscal calendar. Each company has a fiscal year start (companies.fiscal_year_start, "MM-DD",
+// default "01-01"). Week 1 of a fiscal year is the first W/E on or after its start, and the year is
+// named after the calendar year it ends in, so with a July start the W/E 2023-07-06 is FY24-W01.
+// Weeks end on the company's W/E weekday (see settings.go).
+// Series, dashboard and report responses carry this label next to the W/E date, and the division
+// dashboard can add fiscal year-to-date totals.
+
+const defaultFiscalYearStart = "01-01"
+
+type fiscalCalendar struct {
+	Month   time.Month
+	Day     int
+	Weekday time.Weekday // W/E weekday
+}
+
+// parseFiscalStart parses "MM-DD". February 29 is refused (2001 is not a leap year), since most
+// years lack it.
+func parseFiscalStart(s string) (fiscalCalendar, error) {
+	t, err := time.Parse("2006-01-02", "2001-"+s)
+	if err != nil {
+		return fiscalCalendar{}, fmt.Errorf("fiscal year start must be MM-DD")
+	}
+	return fiscalCalendar{Month: t.Month(), Day: t.Day(), Weekday: defaultWeekEndingDay}, nil
+}
+
+func (fc fiscalCalendar) String() string {
+	return fmt.Sprintf("%02d-%02d", int(fc.Month), fc.Day)
+}
+
+// companyFiscal returns a company's (by database id) fiscal calendar, or the calendar year.
+func companyFiscal(companyDBID int) fiscalCalendar {
+	var start string
+	DB.QueryRow(`SELECT fiscal_year_start FROM companies WHERE id = ?`, companyDBID).Scan(&start)
+	fc, err := parseFiscalStart(start)
+	if err != nil {
+		fc, _ = parseFiscalStart(defaultFiscalYearStart)
+	}
+	fc.Weekday = weekEndingDayOf(companyDBID)
+	return fc
+}
+
+// statFiscal is companyFiscal for the company owning statID.
+func statFiscal(statID int) fiscalCalendar {
+	var companyDBID int
+	DB.QueryRow(`SELECT COALESCE(company_id, 0) FROM stats WHERE id = ?`, statID).Scan(&companyDBID)
+	return companyFiscal(companyDBID)
+}
+
+// firstWeek returns the first W/E of the fiscal year containing the W/E we.
+func (fc fiscalCalendar) firstWeek(we time.Time) time.Time {
+	start := time.Date(we.Year(), fc.Month, fc.Day, 0, 0, 0, 0, time.UTC)
+	first := start.AddDate(0, 0, (int(fc.Weekday)-int(start.Weekday())+7)%7)
+	if first.After(we) {
+		start = start.AddDate(-1, 0, 0)
+		first = start.AddDate(0, 0, (int(fc.Weekday)-int(start.Weekday())+7)%7)
+	}
+	return first
+}
+
+// week returns the fiscal year (named by the calendar year it ends in) and week number of a W/E.
+func (fc fiscalCalendar) week(weekEnding string) (int, int, error) {
+	we, err := time.Parse("2006-01-02", weekEnding)
+	if err != nil {
+		return 0, 0, err
+	}
+	first := fc.firstWeek(we)
+	start := time.Date(first.Year(), fc.Month, fc.Day, 0, 0, 0, 0, time.UTC)
+	if start.After(first) {
+		start = start.AddDate(-1, 0, 0)
+	}
+	year := start.AddDate(1, 0, -1).Year()
+	return year, int(we.Sub(first).Hours()/24)/7 + 1, nil
+}
+
+// label formats a W/E as "FY24-W07", or "" for an invalid date.
+func (fc fiscalCalendar) label(weekEnding string) string {
+	year, week, err := fc.week(weekEnding)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("FY%02d-W%02d", year%100, week)
+}
+
+// yearStartWeek returns the first W/E of the fiscal year containing weekEnding.
+func (fc fiscalCalendar) yearStartWeek(weekEnding string) (string, error) {
+	we, err := time.Parse("2006-01-02", weekEnding)
+	if err != nil {
+		return "", err
+	}
+	return fc.firstWeek(we).Format("2006-01-02"), nil
+}
+
+// ---------- GET /api/company/fiscal-year ----------
+func GetFiscalYearHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	fc := companyFiscal(companyDBID)
+	current := currentWeekEnding(time.Now(), fc.Weekday)
+	first, _ := fc.yearStartWeek(current)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"start":              fc.String(),
+		"current_week":       current,
+		"current_week_label": fc.label(current),
+		"year_first_week":    first,
+	})
+}
+
+// ---------- PUT /api/company/fiscal-year ----------
+// Body: {"start": "07-01"}
+func UpdateFiscalYearHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Start string `json:"start"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Start == "" {
+		req.Start = defaultFiscalYearStart
+	}
+	fc, err := parseFiscalStart(req.Start)
+	if err != nil {
+		http.Error(w, `{"message":"start must be MM-DD, e.g. 07-01"}`, http.StatusBadRequest)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET fiscal_year_start = ? WHERE company_id = ?`, fc.String(), r.Context().Value("company_id")); err != nil {
+		webFail("Failed to update fiscal year", w, err)
+		return
+	}
+	GetFiscalYearHandler(w, r)
+}
+
+// weekEndingsBetween returns the W/E dates from first to last inclusive, oldest first.
+func weekEndingsBetween(first, last string) ([]string, error) {
+	f, err := time.Parse("2006-01-02", first)
+	if err != nil {
+		return nil, err
+	}
+	l, err := time.Parse("2006-01-02", last)
+	if err != nil {
+		return nil, err
+	}
+	return lastWeekEndings(last, int(l.Sub(f).Hours()/24)/7+1)
+}
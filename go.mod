@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	github.com/gorilla/handlers v1.5.2
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.4.0
 	github.com/jinzhu/now v1.1.5
 	github.com/mattn/go-sqlite3 v1.14.32
@@ -13,5 +14,4 @@ require (
 
 require (
 	github.com/felixge/httpsnoop v1.0.3 // indirect
-	github.com/gorilla/securecookie v1.1.2 // indirect
 )
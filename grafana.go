@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Grafana simple-JSON datasource support.
+// Grafana calls these endpoints server-side with an API token (see apitokens.go) sent as
+// "Authorization: Bearer ..." from the datasource's custom headers, so they go through
+// AuthMiddleware like any other API call. The datasource reads every stat of the company with POST
+// requests, so it needs a token with the admin scope for a manager or admin (permAllStats).
+
+// ---------- GET /grafana/ (datasource "Test connection") ----------
+func GrafanaTestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"message":"ok"}`)
+}
+
+// ---------- POST /grafana/search ----------
+// Returns [{ "text": "GI - Gross Income", "value": "12" }, ...] filtered by the optional "target" substring.
+func GrafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	// Grafana may send an empty body; treat it as "list everything".
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	filter := "%" + strings.ToLower(strings.TrimSpace(req.Target)) + "%"
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, short_id, full_name
+		FROM stats
+		WHERE company_id = ? AND deleted_at IS NULL AND (lower(short_id) LIKE ? OR lower(full_name) LIKE ?)
+		ORDER BY short_id
+	`, companyDBID, filter, filter)
+	if err != nil {
+		webFail("Failed to query stats", w, err)
+		return
+	}
+	defer rows.Close()
+
+	type option struct {
+		Text  string `json:"text"`
+		Value string `json:"value"`
+	}
+	out := []option{}
+	for rows.Next() {
+		var id int
+		var shortID, fullName string
+		if err := rows.Scan(&id, &shortID, &fullName); err != nil {
+			webFail("Failed to scan stat", w, err)
+			return
+		}
+		out = append(out, option{Text: shortID + " - " + fullName, Value: strconv.Itoa(id)})
+	}
+	if err := rows.Err(); err != nil {
+		webFail("Error iterating stats", w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /grafana/query ----------
+// Each target is a stat id (as returned by /grafana/search) or a stat short_id.
+// Weekly values are returned as time series with one point per W/E date.
+func GrafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets []struct {
+			Target string `json:"target"`
+			RefID  string `json:"refId"`
+		} `json:"targets"`
+		MaxDataPoints int `json:"maxDataPoints"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	from := req.Range.From.UTC().Format("2006-01-02")
+	to := req.Range.To.UTC().Format("2006-01-02")
+	if req.Range.To.IsZero() {
+		to = "9999-12-31"
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	type series struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	out := []series{}
+
+	for _, t := range req.Targets {
+		target := strings.TrimSpace(t.Target)
+		if target == "" {
+			continue
+		}
+
+		var statID int
+		var shortID, valueType string
+		var err error
+		if id, convErr := strconv.Atoi(target); convErr == nil {
+			err = DB.QueryRow(`SELECT id, short_id, value_type FROM stats WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, id, companyDBID).
+				Scan(&statID, &shortID, &valueType)
+		} else {
+			err = DB.QueryRow(`
+				SELECT id, short_id, value_type FROM stats
+				WHERE upper(short_id) = upper(?) AND company_id = ? AND deleted_at IS NULL ORDER BY id LIMIT 1
+			`, target, companyDBID).Scan(&statID, &shortID, &valueType)
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf(`{"message":"unknown target %q"}`, target), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			webFail("Failed to resolve target", w, err)
+			return
+		}
+
+		rows, err := DB.Query(`
+			SELECT week_ending, value
+			FROM weekly_stats
+			WHERE stat_id = ? AND week_ending BETWEEN ? AND ?
+			ORDER BY week_ending
+		`, statID, from, to)
+		if err != nil {
+			webFail("Failed to query weekly series", w, err)
+			return
+		}
+		s := series{Target: shortID, Datapoints: [][2]float64{}}
+		currency := statCurrency(statID)
+		for rows.Next() {
+			var we string
+			var v int64
+			if err := rows.Scan(&we, &v); err != nil {
+				rows.Close()
+				webFail("Failed to scan weekly row", w, err)
+				return
+			}
+			ts, err := time.Parse("2006-01-02", we)
+			if err != nil {
+				continue
+			}
+			s.Datapoints = append(s.Datapoints, [2]float64{statValueToFloat(v, valueType, currency), float64(ts.UnixMilli())})
+		}
+		rows.Close()
+		if req.MaxDataPoints > 0 && len(s.Datapoints) > req.MaxDataPoints {
+			s.Datapoints = s.Datapoints[len(s.Datapoints)-req.MaxDataPoints:]
+		}
+		out = append(out, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Graph event markers: dated labels (a campaign, a price change, a new hire) that graphs draw as
+// vertical lines. An event applies to the whole company, to one division's stats, or to one stat.
+// They live under /api/graph-events because /api/events is the live update stream.
+
+type graphEvent struct {
+	ID          int    `json:"id"`
+	Date        string `json:"date"`
+	Label       string `json:"label"`
+	Description string `json:"description,omitempty"`
+	Scope       string `json:"scope"` // company | division | stat
+	DivisionID  *int   `json:"division_id,omitempty"`
+	StatID      *int   `json:"stat_id,omitempty"`
+}
+
+type graphEventRequest struct {
+	Date        string `json:"date"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Scope       string `json:"scope"`
+	DivisionID  *int   `json:"division_id"`
+	StatID      *int   `json:"stat_id"`
+}
+
+// validate checks the request and that any referenced division/stat belongs to the company.
+func (req *graphEventRequest) validate(companyDBID int) string {
+	req.Label = strings.TrimSpace(req.Label)
+	req.Description = strings.TrimSpace(req.Description)
+	if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+		return "date must be YYYY-MM-DD"
+	}
+	if req.Label == "" {
+		return "label is required"
+	}
+	var n int
+	switch req.Scope {
+	case "company":
+		req.DivisionID, req.StatID = nil, nil
+		return ""
+	case "division":
+		req.StatID = nil
+		if req.DivisionID == nil {
+			return "division_id is required for division scope"
+		}
+		DB.QueryRow(`SELECT COUNT(*) FROM divisions WHERE id = ? AND company_id = ?`, *req.DivisionID, companyDBID).Scan(&n)
+	case "stat":
+		req.DivisionID = nil
+		if req.StatID == nil {
+			return "stat_id is required for stat scope"
+		}
+		DB.QueryRow(`SELECT COUNT(*) FROM stats WHERE id = ? AND company_id = ?`, *req.StatID, companyDBID).Scan(&n)
+	default:
+		return "scope must be company, division or stat"
+	}
+	if n == 0 {
+		return req.Scope + " not found"
+	}
+	return ""
+}
+
+func scanGraphEvents(rows *sql.Rows) ([]graphEvent, error) {
+	defer rows.Close()
+	out := []graphEvent{}
+	for rows.Next() {
+		var e graphEvent
+		var divID, statID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Date, &e.Label, &e.Description, &e.Scope, &divID, &statID); err != nil {
+			return nil, err
+		}
+		if divID.Valid {
+			id := int(divID.Int64)
+			e.DivisionID = &id
+		}
+		if statID.Valid {
+			id := int(statID.Int64)
+			e.StatID = &id
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+const graphEventColumns = `id, date, label, description, scope, division_id, stat_id`
+
+// statGraphEvents returns the events shown on a stat's graph: company-wide ones, its division's
+// and its own.
+func statGraphEvents(statID int) ([]graphEvent, error) {
+	rows, err := DB.Query(`
+		SELECT e.`+strings.ReplaceAll(graphEventColumns, ", ", ", e.")+`
+		FROM events e JOIN stats s ON s.id = ?
+		WHERE e.company_id = s.company_id
+		  AND (e.scope = 'company'
+		       OR (e.scope = 'division' AND e.division_id = s.assigned_division_id)
+		       OR (e.scope = 'stat' AND e.stat_id = s.id))
+		ORDER BY e.date, e.id
+	`, statID)
+	if err != nil {
+		return nil, err
+	}
+	return scanGraphEvents(rows)
+}
+
+// ---------- GET /api/graph-events?scope=&division_id=&stat_id= ----------
+func ListGraphEventsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	q := r.URL.Query()
+	where := []string{`company_id = ?`}
+	args := []interface{}{companyDBID}
+	if v := q.Get("scope"); v != "" {
+		where = append(where, `scope = ?`)
+		args = append(args, v)
+	}
+	for _, col := range []string{"division_id", "stat_id"} {
+		if v := q.Get(col); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, `{"message":"invalid `+col+`"}`, http.StatusBadRequest)
+				return
+			}
+			where = append(where, col+` = ?`)
+			args = append(args, id)
+		}
+	}
+	rows, err := DB.Query(`SELECT `+graphEventColumns+` FROM events WHERE `+strings.Join(where, " AND ")+` ORDER BY date, id`, args...)
+	if err != nil {
+		webFail("Failed to query events", w, err)
+		return
+	}
+	out, err := scanGraphEvents(rows)
+	if err != nil {
+		webFail("Failed to scan events", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- GET /api/stats/{id}/graph-events ----------
+func StatGraphEventsHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	out, err := statGraphEvents(statID)
+	if err != nil {
+		webFail("Failed to query events", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/graph-events ----------
+// Body: { "date": "YYYY-MM-DD", "label": "...", "description": "...", "scope": "company|division|stat", "division_id": n, "stat_id": n }
+func CreateGraphEventHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphEventRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if msg := req.validate(companyDBID); msg != "" {
+		http.Error(w, `{"message":"`+msg+`"}`, http.StatusBadRequest)
+		return
+	}
+	res, err := DB.Exec(`
+		INSERT INTO events (company_id, date, label, description, scope, division_id, stat_id, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, companyDBID, req.Date, req.Label, req.Description, req.Scope, req.DivisionID, req.StatID,
+		r.Context().Value("user_id"), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		webFail("Failed to create event", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(graphEvent{ID: int(id), Date: req.Date, Label: req.Label, Description: req.Description,
+		Scope: req.Scope, DivisionID: req.DivisionID, StatID: req.StatID})
+}
+
+// ---------- PUT /api/graph-events/{id} ----------
+func UpdateGraphEventHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid event id"}`, http.StatusBadRequest)
+		return
+	}
+	var req graphEventRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if msg := req.validate(companyDBID); msg != "" {
+		http.Error(w, `{"message":"`+msg+`"}`, http.StatusBadRequest)
+		return
+	}
+	res, err := DB.Exec(`
+		UPDATE events SET date = ?, label = ?, description = ?, scope = ?, division_id = ?, stat_id = ?
+		WHERE id = ? AND company_id = ?
+	`, req.Date, req.Label, req.Description, req.Scope, req.DivisionID, req.StatID, id, companyDBID)
+	if err != nil {
+		webFail("Failed to update event", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"event not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graphEvent{ID: id, Date: req.Date, Label: req.Label, Description: req.Description,
+		Scope: req.Scope, DivisionID: req.DivisionID, StatID: req.StatID})
+}
+
+// ---------- DELETE /api/graph-events/{id} ----------
+func DeleteGraphEventHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid event id"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	res, err := DB.Exec(`DELETE FROM events WHERE id = ? AND company_id = ?`, id, companyDBID)
+	if err != nil {
+		webFail("Failed to delete event", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"event not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Event deleted"})
+}
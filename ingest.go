@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Device ingestion: door counters, phone systems and production machines POST increments to
+// /ingest with a per-stat token, and the increments accumulate into that day's daily_stats row.
+// Tokens are minted by admins per stat; only their SHA-256 is stored.
+
+// newSecretToken returns a random hex token and its storage hash.
+func newSecretToken() (token, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// ---------- POST /ingest ----------
+// Body: { "stat_token": "...", "timestamp": "RFC3339" | unix seconds (optional, default now), "increment": 1 }
+func IngestHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		StatToken string          `json:"stat_token"`
+		Timestamp json.RawMessage `json:"timestamp"`
+		Increment *float64        `json:"increment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if req.StatToken == "" {
+		http.Error(w, `{"message":"stat_token is required"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var tokenID, statID, companyDBID int
+	var valueType string
+	var isCalculated bool
+	err := DB.QueryRow(`
+		SELECT t.id, s.id, s.company_id, s.value_type, s.is_calculated
+		FROM stat_ingest_tokens t JOIN stats s ON s.id = t.stat_id
+		WHERE t.token_hash = ? AND t.revoked_at IS NULL AND s.deleted_at IS NULL
+	`, hashSecretToken(req.StatToken)).Scan(&tokenID, &statID, &companyDBID, &valueType, &isCalculated)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Invalid stat_token"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		webFail("Failed to look up ingest token", w, err)
+		return
+	}
+	if refuseLockedCompany(w, companyDBID) {
+		return
+	}
+	if isCalculated {
+		http.Error(w, `{"message":"Calculated stats cannot receive values"}`, http.StatusBadRequest)
+		return
+	}
+
+	increment := 1.0
+	if req.Increment != nil {
+		increment = *req.Increment
+	}
+	currency := statCurrency(statID)
+	delta, err := parseStatValue(strconv.FormatFloat(increment, 'f', -1, 64), valueType, currency)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":"invalid increment for %s stat"}`, valueType), http.StatusBadRequest)
+		return
+	}
+
+	ts, err := parseIngestTimestamp(req.Timestamp)
+	if err != nil {
+		http.Error(w, `{"message":"timestamp must be RFC3339 or unix seconds"}`, http.StatusBadRequest)
+		return
+	}
+	date := ts.UTC().Format("2006-01-02")
+
+	value, err := writeDailyValue(statID, date, delta, true)
+	if _, ok := err.(*ruleViolation); ok {
+		writeRuleViolation(w, err)
+		return
+	} else if err == errStatArchived {
+		writeArchivedError(w)
+		return
+	} else if err != nil {
+		webFail("Failed to accumulate daily value", w, err)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE stat_ingest_tokens SET last_used_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), tokenID); err != nil {
+		log.Printf("Failed to update ingest token %d usage: %v", tokenID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat_id": statID,
+		"date":    date,
+		"value":   formatStatValue(value, valueType, currency),
+	})
+}
+
+// writeDailyValue adds v to (accumulate) or replaces the stat's daily_stats value for date
+// and returns the resulting stored value. A result that breaks the stat's rules is not written
+// and the *ruleViolation is returned.
+func writeDailyValue(statID int, date string, v int64, accumulate bool) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var valueType string
+	var archived bool
+	if err := tx.QueryRow(`SELECT value_type, archived_at IS NOT NULL FROM stats WHERE id = ? AND deleted_at IS NULL`, statID).Scan(&valueType, &archived); err != nil {
+		return 0, err
+	}
+	if archived {
+		return 0, errStatArchived
+	}
+	var rowID, value int64
+	err = tx.QueryRow(`SELECT id, value FROM daily_stats WHERE stat_id = ? AND date = ? LIMIT 1`, statID, date).Scan(&rowID, &value)
+	switch {
+	case err == sql.ErrNoRows:
+		value = v
+		if err = checkDailyRules(tx, statID, value, valueType); err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`INSERT INTO daily_stats (stat_id, date, value, updated_at) VALUES (?, ?, ?, ?)`, statID, date, value, time.Now().UTC().Format(time.RFC3339))
+	case err == nil:
+		if accumulate {
+			value += v
+		} else {
+			value = v
+		}
+		if err = checkDailyRules(tx, statID, value, valueType); err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`UPDATE daily_stats SET value = ?, numerator = NULL, denominator = NULL, version = version + 1, updated_at = ? WHERE id = ?`, value, time.Now().UTC().Format(time.RFC3339), rowID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	publishStatEvent(liveEvent{Type: eventStatWritten, StatID: statID, Date: date})
+	return value, nil
+}
+
+func parseIngestTimestamp(raw json.RawMessage) (time.Time, error) {
+	s := strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	if s == "" || s == "null" {
+		return time.Now(), nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+type ingestToken struct {
+	ID         int     `json:"id"`
+	StatID     int     `json:"stat_id"`
+	Label      string  `json:"label"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at,omitempty"`
+	Token      string  `json:"token,omitempty"` // only returned on creation
+}
+
+// ---------- POST /api/stats/{id}/ingest-tokens ----------
+// Body: { "label": "Front door counter" }. The plaintext token is returned once.
+func CreateIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Label string `json:"label"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate token", w, err)
+		return
+	}
+	created := time.Now().UTC().Format(time.RFC3339)
+	res, err := DB.Exec(`INSERT INTO stat_ingest_tokens (stat_id, token_hash, label, created_at, created_by) VALUES (?, ?, ?, ?, ?)`,
+		statID, hash, strings.TrimSpace(req.Label), created, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to save ingest token", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	log.Printf("Created ingest token %d for stat %d", id, statID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ingestToken{ID: int(id), StatID: statID, Label: strings.TrimSpace(req.Label), CreatedAt: created, Token: token})
+}
+
+// ---------- GET /api/stats/{id}/ingest-tokens ----------
+func ListIngestTokensHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	rows, err := DB.Query(`SELECT id, stat_id, label, created_at, last_used_at FROM stat_ingest_tokens WHERE stat_id = ? AND revoked_at IS NULL ORDER BY id`, statID)
+	if err != nil {
+		webFail("Failed to query ingest tokens", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []ingestToken{}
+	for rows.Next() {
+		var t ingestToken
+		var lastUsed sql.NullString
+		if err := rows.Scan(&t.ID, &t.StatID, &t.Label, &t.CreatedAt, &lastUsed); err != nil {
+			webFail("Failed to scan ingest token", w, err)
+			return
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.String
+		}
+		out = append(out, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ingestTokenCompanyStat returns the stat of token id when the stat belongs to the caller's company.
+func ingestTokenCompanyStat(r *http.Request, id int) (int, bool) {
+	var statID int
+	if err := DB.QueryRow(`SELECT stat_id FROM stat_ingest_tokens WHERE id = ? AND revoked_at IS NULL`, id).Scan(&statID); err != nil {
+		return 0, false
+	}
+	status, _ := checkStatCompany(r, statID)
+	return statID, status == 0
+}
+
+// ---------- DELETE /api/ingest-tokens/{id} ----------
+func RevokeIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid token id"}`, http.StatusBadRequest)
+		return
+	}
+	if _, ok := ingestTokenCompanyStat(r, id); !ok {
+		http.Error(w, `{"message":"token not found"}`, http.StatusNotFound)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE stat_ingest_tokens SET revoked_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), id); err != nil {
+		webFail("Failed to revoke ingest token", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked"})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Integrity check: finds rows the schema's foreign keys should have prevented but older databases
+// (created before PRAGMA foreign_keys was enabled, or before the unique weekly index) may contain.
+
+type integrityCheck struct {
+	Name        string
+	Description string
+	Find        string // SELECT returning the ids of offending rows
+	Repair      string // statement fixing every offending row
+}
+
+var integrityChecks = []integrityCheck{
+	{"orphan_daily_stats", "daily values referencing missing stats",
+		`SELECT id FROM daily_stats WHERE stat_id NOT IN (SELECT id FROM stats)`,
+		`DELETE FROM daily_stats WHERE stat_id NOT IN (SELECT id FROM stats)`},
+	{"orphan_weekly_stats", "weekly values referencing missing stats",
+		`SELECT id FROM weekly_stats WHERE stat_id NOT IN (SELECT id FROM stats)`,
+		`DELETE FROM weekly_stats WHERE stat_id NOT IN (SELECT id FROM stats)`},
+	{"orphan_quotas", "quotas referencing missing stats",
+		`SELECT id FROM stat_quotas WHERE stat_id NOT IN (SELECT id FROM stats)`,
+		`DELETE FROM stat_quotas WHERE stat_id NOT IN (SELECT id FROM stats)`},
+	{"orphan_calculations", "calculated-stat links referencing missing stats",
+		`SELECT id FROM stat_calculations WHERE stat_id NOT IN (SELECT id FROM stats) OR dependent_stat_id NOT IN (SELECT id FROM stats)`,
+		`DELETE FROM stat_calculations WHERE stat_id NOT IN (SELECT id FROM stats) OR dependent_stat_id NOT IN (SELECT id FROM stats)`},
+	{"stats_deleted_user", "stats assigned to deleted users (repair unassigns them)",
+		`SELECT id FROM stats WHERE assigned_user_id IS NOT NULL AND assigned_user_id NOT IN (SELECT id FROM users)`,
+		`UPDATE stats SET assigned_user_id = NULL WHERE assigned_user_id IS NOT NULL AND assigned_user_id NOT IN (SELECT id FROM users)`},
+	{"stats_deleted_division", "stats assigned to deleted divisions (repair unassigns them)",
+		`SELECT id FROM stats WHERE assigned_division_id IS NOT NULL AND assigned_division_id NOT IN (SELECT id FROM divisions)`,
+		`UPDATE stats SET assigned_division_id = NULL WHERE assigned_division_id IS NOT NULL AND assigned_division_id NOT IN (SELECT id FROM divisions)`},
+	{"orphan_user_assignments", "historical user assignments referencing missing stats or users",
+		`SELECT stat_id FROM stat_user_assignments WHERE stat_id NOT IN (SELECT id FROM stats) OR user_id NOT IN (SELECT id FROM users)`,
+		`DELETE FROM stat_user_assignments WHERE stat_id NOT IN (SELECT id FROM stats) OR user_id NOT IN (SELECT id FROM users)`},
+	{"orphan_division_assignments", "historical division assignments referencing missing stats or divisions",
+		`SELECT stat_id FROM stat_division_assignments WHERE stat_id NOT IN (SELECT id FROM stats) OR division_id NOT IN (SELECT id FROM divisions)`,
+		`DELETE FROM stat_division_assignments WHERE stat_id NOT IN (SELECT id FROM stats) OR division_id NOT IN (SELECT id FROM divisions)`},
+	{"duplicate_weekly_stats", "duplicate weekly rows for the same stat and week (repair keeps the newest)",
+		`SELECT id FROM weekly_stats w WHERE EXISTS (SELECT 1 FROM weekly_stats n WHERE n.stat_id = w.stat_id AND n.week_ending = w.week_ending AND n.id > w.id)`,
+		`DELETE FROM weekly_stats WHERE EXISTS (SELECT 1 FROM weekly_stats n WHERE n.stat_id = weekly_stats.stat_id AND n.week_ending = weekly_stats.week_ending AND n.id > weekly_stats.id)`},
+	{"duplicate_daily_stats", "duplicate daily rows for the same stat and date (repair keeps the newest)",
+		`SELECT id FROM daily_stats d WHERE EXISTS (SELECT 1 FROM daily_stats n WHERE n.stat_id = d.stat_id AND n.date = d.date AND n.id > d.id)`,
+		`DELETE FROM daily_stats WHERE EXISTS (SELECT 1 FROM daily_stats n WHERE n.stat_id = daily_stats.stat_id AND n.date = daily_stats.date AND n.id > daily_stats.id)`},
+	{"stats_without_company", "stats with no company (repair backfills from the assigned user, or the only company)",
+		`SELECT id FROM stats WHERE company_id IS NULL`, ""},
+	{"divisions_without_company", "divisions with no company (repair backfills on single-company installs)",
+		`SELECT id FROM divisions WHERE company_id IS NULL`, ""},
+}
+
+type integrityResult struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Count       int     `json:"count"`
+	SampleIDs   []int64 `json:"sample_ids,omitempty"`
+	Repaired    int64   `json:"repaired,omitempty"`
+}
+
+func findIntegrityIssues(q string) (int, []int64, error) {
+	rows, err := DB.Query(q)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	count := 0
+	var sample []int64
+	for rows.Next() {
+		var id sql.NullInt64
+		if err := rows.Scan(&id); err != nil {
+			return 0, nil, err
+		}
+		count++
+		if len(sample) < 20 && id.Valid {
+			sample = append(sample, id.Int64)
+		}
+	}
+	return count, sample, rows.Err()
+}
+
+// ---------- POST /api/admin/integrity-check?repair=true ----------
+// Reports every check; with repair=true the offending rows are fixed in one transaction. Orphaned
+// rows belong to no company, so the checks run over the whole database and the route is for
+// super-admins only.
+func IntegrityCheckHandler(w http.ResponseWriter, r *http.Request) {
+	repair, _ := strconv.ParseBool(r.URL.Query().Get("repair"))
+
+	results := make([]integrityResult, 0, len(integrityChecks))
+	for _, c := range integrityChecks {
+		count, sample, err := findIntegrityIssues(c.Find)
+		if err != nil {
+			webFail("Integrity check "+c.Name+" failed", w, err)
+			return
+		}
+		results = append(results, integrityResult{Name: c.Name, Description: c.Description, Count: count, SampleIDs: sample})
+	}
+
+	if repair {
+		tx, err := DB.Begin()
+		if err != nil {
+			webFail("Failed to start transaction", w, err)
+			return
+		}
+		defer tx.Rollback()
+		for i, c := range integrityChecks {
+			if c.Repair == "" || results[i].Count == 0 {
+				continue
+			}
+			res, err := tx.Exec(c.Repair)
+			if err != nil {
+				webFail("Repair "+c.Name+" failed", w, err)
+				return
+			}
+			results[i].Repaired, _ = res.RowsAffected()
+		}
+		if err := tx.Commit(); err != nil {
+			webFail("Failed to commit repairs", w, err)
+			return
+		}
+
+		// Company backfill reuses the InitDB logic; report what it managed to fix.
+		backfillCompanyIDs()
+		for i, c := range integrityChecks {
+			if c.Repair != "" || results[i].Count == 0 {
+				continue
+			}
+			remaining, _, err := findIntegrityIssues(c.Find)
+			if err != nil {
+				webFail("Integrity check "+c.Name+" failed", w, err)
+				return
+			}
+			results[i].Repaired = int64(results[i].Count - remaining)
+		}
+		log.Printf("Integrity repair run by %v", r.Context().Value("username"))
+	}
+
+	total := 0
+	for _, res := range results {
+		total += res.Count
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"repair": repair,
+		"issues": total,
+		"checks": results,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Invite-gated registration: POST /register creates a company only with a valid invite code. Codes
+// are issued by super-admins, the admins of the operator companies listed in
+// STATHQ_OPERATOR_COMPANIES (comma separated company codes, see superadmin.go), or on the host with
+// -create-invite. Each code has a use limit and an
+// expiry; only its hash is stored and the plaintext is shown once.
+
+var errInvalidInvite = errors.New("invalid or expired invite code")
+
+type registrationInvite struct {
+	ID        int      `json:"id"`
+	Label     string   `json:"label"`
+	MaxUses   int      `json:"max_uses"`
+	Uses      int      `json:"uses"`
+	ExpiresAt string   `json:"expires_at"`
+	CreatedAt string   `json:"created_at"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+	Companies []string `json:"companies"`
+	Code      string   `json:"code,omitempty"` // only returned on creation
+}
+
+// createInvite stores a new invite code and returns it with its plaintext code.
+func createInvite(label string, maxUses int, ttl time.Duration, createdBy interface{}) (registrationInvite, error) {
+	code, hash, err := newSecretToken()
+	if err != nil {
+		return registrationInvite{}, err
+	}
+	now := time.Now().UTC()
+	inv := registrationInvite{
+		Label:     label,
+		MaxUses:   maxUses,
+		ExpiresAt: now.Add(ttl).Format(time.RFC3339),
+		CreatedAt: now.Format(time.RFC3339),
+		Companies: []string{},
+		Code:      code,
+	}
+	res, err := DB.Exec(`
+		INSERT INTO registration_invites (code_hash, label, max_uses, expires_at, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, hash, label, maxUses, inv.ExpiresAt, createdBy, inv.CreatedAt)
+	if err != nil {
+		return registrationInvite{}, err
+	}
+	id, _ := res.LastInsertId()
+	inv.ID = int(id)
+	return inv, nil
+}
+
+// claimInvite spends one use of the code inside tx, failing when it is unknown, revoked, expired or
+// used up.
+func claimInvite(tx *sql.Tx, code string) (int, error) {
+	var id int
+	err := tx.QueryRow(`
+		SELECT id FROM registration_invites
+		WHERE code_hash = ? AND revoked_at IS NULL AND uses < max_uses AND expires_at > ?
+	`, hashSecretToken(strings.TrimSpace(code)), time.Now().UTC().Format(time.RFC3339)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidInvite
+	} else if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE registration_invites SET uses = uses + 1 WHERE id = ?`, id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// createInviteFromCLI is the -create-invite entry point: one use, valid for a week.
+func createInviteFromCLI(label string) error {
+	inv, err := createInvite(label, 1, 7*24*time.Hour, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Invite code: %s\nValid for one registration until %s\n", inv.Code, inv.ExpiresAt)
+	return nil
+}
+
+// ---------- POST /api/admin/invites ----------
+// Body: {"label": "...", "max_uses": 1, "expires_in_days": 7}
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Label         string `json:"label"`
+		MaxUses       int    `json:"max_uses"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}{MaxUses: 1, ExpiresInDays: 7}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 1 || req.MaxUses > 1000 {
+		http.Error(w, `{"message":"max_uses must be between 1 and 1000"}`, http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > 365 {
+		http.Error(w, `{"message":"expires_in_days must be between 1 and 365"}`, http.StatusBadRequest)
+		return
+	}
+	inv, err := createInvite(strings.TrimSpace(req.Label), req.MaxUses, time.Duration(req.ExpiresInDays)*24*time.Hour, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to create invite", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// ---------- GET /api/admin/invites ----------
+func ListInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query(`
+		SELECT i.id, i.label, i.max_uses, i.uses, i.expires_at, i.created_at, COALESCE(i.revoked_at, ''),
+		       COALESCE((SELECT group_concat(c.company_id) FROM companies c WHERE c.invite_id = i.id), '')
+		FROM registration_invites i ORDER BY i.id DESC
+	`)
+	if err != nil {
+		webFail("Failed to query invites", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []registrationInvite{}
+	for rows.Next() {
+		var inv registrationInvite
+		var companies string
+		if err := rows.Scan(&inv.ID, &inv.Label, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedAt, &inv.RevokedAt, &companies); err != nil {
+			webFail("Failed to scan invites", w, err)
+			return
+		}
+		inv.Companies = []string{}
+		if companies != "" {
+			inv.Companies = strings.Split(companies, ",")
+		}
+		out = append(out, inv)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/admin/invites/{id} ----------
+func RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`UPDATE registration_invites SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), mux.Vars(r)["id"])
+	if err != nil {
+		webFail("Failed to revoke invite", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"Invite not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invite revoked"})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// IP allowlist: a company can restrict its users to address ranges (office, VPN) with
+// PUT /api/company/ip-allowlist. AuthMiddleware refuses requests from elsewhere with 403, for
+// sessions and tokens alike; an empty list allows any address. Addresses come from clientIP, so set
+// STATHQ_TRUST_PROXY behind a reverse proxy.
+//
+// Saving a list that excludes the caller's own address is refused unless "force" is set. Super-admins
+// are never restricted, including while impersonating, and can clear a company's list with
+// DELETE /api/admin/companies/{id}/ip-allowlist when its admins have locked themselves out.
+
+const maxIPAllowlistEntries = 100
+
+type ipAllowEntry struct {
+	CIDR  string `json:"cidr"`
+	Label string `json:"label"`
+}
+
+// parseAllowedRange accepts a CIDR or a single address and returns the network.
+func parseAllowedRange(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an address or CIDR range", s)
+	}
+	return n, nil
+}
+
+func loadIPAllowlist(companyCode string) ([]ipAllowEntry, error) {
+	rows, err := DB.Query(`
+		SELECT a.cidr, a.label FROM company_ip_allowlist a JOIN companies c ON c.id = a.company_id
+		WHERE c.company_id = ? ORDER BY a.id
+	`, companyCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ipAllowEntry{}
+	for rows.Next() {
+		var e ipAllowEntry
+		if err := rows.Scan(&e.CIDR, &e.Label); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// ipInAllowlist reports whether ip falls in one of the entries; an empty list admits everything.
+func ipInAllowlist(list []ipAllowEntry, ip string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, e := range list {
+		if n, err := parseAllowedRange(e.CIDR); err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed checks the request's address against the company's allowlist. A list that cannot be
+// read fails closed.
+func ipAllowed(r *http.Request, companyCode string) bool {
+	list, err := loadIPAllowlist(companyCode)
+	if err != nil {
+		log.Printf("Failed to load IP allowlist for %s: %v", companyCode, err)
+		return false
+	}
+	return ipInAllowlist(list, clientIP(r))
+}
+
+// ---------- GET /api/company/ip-allowlist ----------
+func GetIPAllowlistHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := loadIPAllowlist(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to load IP allowlist", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ranges":    list,
+		"client_ip": clientIP(r),
+	})
+}
+
+// ---------- PUT /api/company/ip-allowlist ----------
+// Body: {"ranges": [{"cidr": "203.0.113.0/24", "label": "Office"}, ...], "force": false}. Replaces the
+// whole list; [] removes the restriction.
+func UpdateIPAllowlistHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ranges []ipAllowEntry `json:"ranges"`
+		Force  bool           `json:"force"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Ranges) > maxIPAllowlistEntries {
+		http.Error(w, fmt.Sprintf(`{"message":"at most %d ranges"}`, maxIPAllowlistEntries), http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	list := []ipAllowEntry{}
+	for _, e := range req.Ranges {
+		n, err := parseAllowedRange(e.CIDR)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if cidr := n.String(); !seen[cidr] {
+			seen[cidr] = true
+			list = append(list, ipAllowEntry{CIDR: cidr, Label: strings.TrimSpace(e.Label)})
+		}
+	}
+	_, impersonating := r.Context().Value("impersonator_id").(int)
+	if ip := clientIP(r); !req.Force && !impersonating && !ipInAllowlist(list, ip) {
+		http.Error(w, fmt.Sprintf(`{"message":"Your address %s is not in the list; saving it would lock you out. Send \"force\": true to save anyway."}`, ip), http.StatusConflict)
+		return
+	}
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM company_ip_allowlist WHERE company_id = ?`, companyDBID); err != nil {
+		webFail("Failed to save IP allowlist", w, err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, e := range list {
+		if _, err := tx.Exec(`INSERT INTO company_ip_allowlist (company_id, cidr, label, created_at) VALUES (?, ?, ?, ?)`,
+			companyDBID, e.CIDR, e.Label, now); err != nil {
+			webFail("Failed to save IP allowlist", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to save IP allowlist", w, err)
+		return
+	}
+	log.Printf("User %v set the IP allowlist of %v to %d ranges", r.Context().Value("user_id"), r.Context().Value("company_id"), len(list))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ranges": list})
+}
+
+// ---------- DELETE /api/admin/companies/{id}/ip-allowlist ----------
+// Super-admin emergency bypass: removes the company's restriction entirely.
+func ClearIPAllowlistHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`DELETE FROM company_ip_allowlist WHERE company_id = ?`, mux.Vars(r)["id"])
+	if err != nil {
+		webFail("Failed to clear IP allowlist", w, err)
+		return
+	}
+	n, _ := res.RowsAffected()
+	log.Printf("Super-admin %v cleared the IP allowlist of company %s (%d ranges)", r.Context().Value("user_id"), mux.Vars(r)["id"], n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "IP allowlist cleared", "removed": n})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stateless login for native and mobile clients: POST /login with "jwt": true returns a signed JWT
+// (HS256; claims user_id, company_id, role, iat, exp) instead of setting the session cookie. The
+// client sends it as "Authorization: Bearer ...". Nothing is stored server side, so a JWT cannot be
+// revoked on its own; it expires after STATHQ_JWT_TTL (12h). Tokens are signed with a key derived
+// from the session secrets (see sessionkeys.go) and older secrets still verify, so rotating them
+// works as for cookies, and dropping a secret ends every JWT it signed. The role claim is for the
+// client's display only: AuthMiddleware reads the current role from users, as for sessions.
+
+var jwtKeys [][]byte // newest first; set by newSessionStore
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type jwtClaims struct {
+	UserID    int    `json:"user_id"`
+	CompanyID string `json:"company_id"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func jwtKeysFrom(secrets []string) [][]byte {
+	var keys [][]byte
+	for _, s := range secrets {
+		key := sha256.Sum256([]byte("stathq jwt\x00" + s))
+		keys = append(keys, key[:])
+	}
+	return keys
+}
+
+// looksLikeJWT tells JWTs apart from the opaque bearer tokens, which contain no dots.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func signJWT(claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, jwtKeys[0])
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseJWT verifies the signature against every key and checks expiry.
+func parseJWT(token string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	valid := false
+	for _, key := range jwtKeys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return claims, errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.UserID == 0 {
+		return claims, errTokenInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("jwt expired")
+	}
+	return claims, nil
+}
+
+// jwtAuth resolves a JWT to its user. A token whose company no longer matches the user's is
+// rejected.
+func jwtAuth(token string) (bearerAuth, error) {
+	claims, err := parseJWT(token)
+	if err != nil {
+		return bearerAuth{}, err
+	}
+	user, err := loadAuthUser(claims.UserID)
+	if err != nil || user.CompanyID != claims.CompanyID {
+		return bearerAuth{}, errTokenInvalid
+	}
+	return bearerAuth{UserID: claims.UserID}, nil
+}
+
+// writeJWTLogin answers a successful /login with a JWT instead of a session cookie.
+func writeJWTLogin(w http.ResponseWriter, userID int, companyID, role string) {
+	ttl := envDuration("STATHQ_JWT_TTL", 12*time.Hour)
+	now := time.Now()
+	token, err := signJWT(jwtClaims{
+		UserID:    userID,
+		CompanyID: companyID,
+		Role:      role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		webFail("Failed to sign token", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Login successful",
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+	})
+}
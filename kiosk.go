@@ -0,0 +1,566 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kiosk mode: a shared device enrolled with a kiosk token ("Authorization: Kiosk <token>") stays
+// on an entry screen, and staff identify with a short PIN to enter today's daily values for their
+// assigned stats. A PIN maps to exactly one user in the company. PINs are hashed with the company
+// id, which only keeps them from being read off the database; what protects them is the lockout:
+// after kioskMaxFailures wrong PINs within kioskFailureWindow the device is refused for that long.
+// Every identification, submission, failure and lockout is written to kiosk_events.
+
+const (
+	kioskMaxFailures   = 5
+	kioskFailureWindow = 10 * time.Minute
+)
+
+var (
+	kioskFailMu   sync.Mutex
+	kioskFailures = map[int][]time.Time{} // kiosk id -> recent wrong PINs
+)
+
+type kiosk struct {
+	ID         int     `json:"id"`
+	Label      string  `json:"label"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at,omitempty"`
+	Token      string  `json:"token,omitempty"` // only returned on creation
+}
+
+func kioskPinHash(companyDBID int, pin string) string {
+	return hashSecretToken(fmt.Sprintf("%d:%s", companyDBID, pin))
+}
+
+func validKioskPin(pin string) bool {
+	if len(pin) < 4 || len(pin) > 8 {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// kioskLocked reports whether the kiosk has too many recent wrong PINs, and until when.
+func kioskLocked(kioskID int, now time.Time) (bool, time.Time) {
+	kioskFailMu.Lock()
+	defer kioskFailMu.Unlock()
+	recent := kioskFailures[kioskID][:0]
+	for _, t := range kioskFailures[kioskID] {
+		if now.Sub(t) < kioskFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	kioskFailures[kioskID] = recent
+	if len(recent) >= kioskMaxFailures {
+		return true, recent[len(recent)-kioskMaxFailures].Add(kioskFailureWindow)
+	}
+	return false, time.Time{}
+}
+
+func kioskRecordFailure(kioskID int, now time.Time) {
+	kioskFailMu.Lock()
+	kioskFailures[kioskID] = append(kioskFailures[kioskID], now)
+	kioskFailMu.Unlock()
+}
+
+func recordKioskEvent(r *http.Request, kioskID, userID int, action string, detail interface{}) {
+	var uid, detailJSON interface{}
+	if userID != 0 {
+		uid = userID
+	}
+	if detail != nil {
+		if b, err := json.Marshal(detail); err == nil {
+			detailJSON = string(b)
+		}
+	}
+	if _, err := DB.Exec(`INSERT INTO kiosk_events (kiosk_id, user_id, action, detail, ip, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		kioskID, uid, action, detailJSON, clientIP(r), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Printf("Failed to record kiosk event for kiosk %d: %v", kioskID, err)
+	}
+}
+
+// ---------- PIN management ----------
+
+// setKioskPin sets (or with "" clears) a user's PIN, answering the request.
+func setKioskPin(w http.ResponseWriter, r *http.Request, companyDBID, userID int) {
+	var req struct {
+		Pin string `json:"pin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.Pin = strings.TrimSpace(req.Pin)
+	if req.Pin == "" {
+		if _, err := DB.Exec(`DELETE FROM kiosk_pins WHERE user_id = ?`, userID); err != nil {
+			webFail("Failed to clear PIN", w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Kiosk PIN removed"})
+		return
+	}
+	if !validKioskPin(req.Pin) {
+		http.Error(w, `{"message":"PIN must be 4 to 8 digits"}`, http.StatusBadRequest)
+		return
+	}
+	hash := kioskPinHash(companyDBID, req.Pin)
+	var other int
+	err := DB.QueryRow(`SELECT user_id FROM kiosk_pins WHERE company_id = ? AND pin_hash = ?`, companyDBID, hash).Scan(&other)
+	if err == nil && other != userID {
+		http.Error(w, `{"message":"Choose a different PIN"}`, http.StatusConflict)
+		return
+	} else if err != nil && err != sql.ErrNoRows {
+		webFail("Failed to check PIN", w, err)
+		return
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO kiosk_pins (user_id, company_id, pin_hash, set_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET company_id = excluded.company_id, pin_hash = excluded.pin_hash, set_at = excluded.set_at
+	`, userID, companyDBID, hash, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		webFail("Failed to save PIN", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Kiosk PIN saved"})
+}
+
+// ---------- PUT /api/user/kiosk-pin ----------
+// Body: {"pin": "4821"}; "" removes it.
+func SetOwnKioskPinHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	setKioskPin(w, r, companyDBID, r.Context().Value("user_id").(int))
+}
+
+// ---------- DELETE /api/user/kiosk-pin ----------
+func DeleteOwnKioskPinHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := DB.Exec(`DELETE FROM kiosk_pins WHERE user_id = ?`, r.Context().Value("user_id")); err != nil {
+		webFail("Failed to clear PIN", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Kiosk PIN removed"})
+}
+
+// ---------- PUT /api/users/{id}/kiosk-pin ----------
+// Admins set PINs for staff who do not sign in themselves.
+func SetUserKioskPinHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var exists int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND company_id = ?`, userID, companyDBID).Scan(&exists); err != nil || exists == 0 {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	setKioskPin(w, r, companyDBID, userID)
+}
+
+// ---------- Kiosk devices ----------
+
+// ---------- POST /api/kiosks ----------
+// Body: {"label": "Warehouse tablet"}. The device token is returned once.
+func CreateKioskHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label string `json:"label"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate token", w, err)
+		return
+	}
+	created := time.Now().UTC().Format(time.RFC3339)
+	label := strings.TrimSpace(req.Label)
+	res, err := DB.Exec(`INSERT INTO kiosks (company_id, token_hash, label, created_at, created_by) VALUES (?, ?, ?, ?, ?)`,
+		companyDBID, hash, label, created, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to save kiosk", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	log.Printf("Created kiosk %d for company %d", id, companyDBID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(kiosk{ID: int(id), Label: label, CreatedAt: created, Token: token})
+}
+
+// ---------- GET /api/kiosks ----------
+func ListKiosksHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`SELECT id, label, created_at, last_used_at FROM kiosks WHERE company_id = ? AND revoked_at IS NULL ORDER BY id`, companyDBID)
+	if err != nil {
+		webFail("Failed to query kiosks", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []kiosk{}
+	for rows.Next() {
+		var k kiosk
+		var lastUsed sql.NullString
+		if err := rows.Scan(&k.ID, &k.Label, &k.CreatedAt, &lastUsed); err != nil {
+			webFail("Failed to scan kiosk", w, err)
+			return
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.String
+		}
+		out = append(out, k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/kiosks/{id} ----------
+func RevokeKioskHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid kiosk id"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	res, err := DB.Exec(`UPDATE kiosks SET revoked_at = ? WHERE id = ? AND company_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), id, companyDBID)
+	if err != nil {
+		webFail("Failed to revoke kiosk", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"kiosk not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Kiosk revoked"})
+}
+
+// ---------- GET /api/kiosks/{id}/events?limit=100 ----------
+// The kiosk's audit trail, newest first.
+func KioskEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid kiosk id"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	rows, err := DB.Query(`
+		SELECT e.id, e.user_id, COALESCE(u.username, ''), e.action, COALESCE(e.detail, ''), e.ip, e.created_at
+		FROM kiosk_events e JOIN kiosks k ON k.id = e.kiosk_id LEFT JOIN users u ON u.id = e.user_id
+		WHERE e.kiosk_id = ? AND k.company_id = ?
+		ORDER BY e.id DESC LIMIT ?
+	`, id, companyDBID, limit)
+	if err != nil {
+		webFail("Failed to query kiosk events", w, err)
+		return
+	}
+	defer rows.Close()
+	type event struct {
+		ID        int             `json:"id"`
+		UserID    *int            `json:"user_id,omitempty"`
+		Username  string          `json:"username,omitempty"`
+		Action    string          `json:"action"`
+		Detail    json.RawMessage `json:"detail,omitempty"`
+		IP        string          `json:"ip"`
+		CreatedAt string          `json:"created_at"`
+	}
+	out := []event{}
+	for rows.Next() {
+		var e event
+		var uid sql.NullInt64
+		var detail string
+		if err := rows.Scan(&e.ID, &uid, &e.Username, &e.Action, &detail, &e.IP, &e.CreatedAt); err != nil {
+			webFail("Failed to scan kiosk event", w, err)
+			return
+		}
+		if uid.Valid {
+			v := int(uid.Int64)
+			e.UserID = &v
+		}
+		if detail != "" {
+			e.Detail = json.RawMessage(detail)
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- Kiosk entry ----------
+
+type kioskStat struct {
+	StatID    int     `json:"stat_id"`
+	ShortID   string  `json:"short_id"`
+	FullName  string  `json:"full_name"`
+	ValueType string  `json:"value_type"`
+	Value     *string `json:"value"`
+	currency  string
+}
+
+// kioskAuth resolves the device token and the PIN to a kiosk, company and user, answering the
+// request itself (and returning ok false) when either is wrong or the kiosk is locked out.
+func kioskAuth(w http.ResponseWriter, r *http.Request, pin string) (kioskID, companyDBID, userID int, ok bool) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Kiosk "))
+	if token == "" {
+		http.Error(w, `{"message":"kiosk token required"}`, http.StatusUnauthorized)
+		return
+	}
+	err := DB.QueryRow(`SELECT id, company_id FROM kiosks WHERE token_hash = ? AND revoked_at IS NULL`, hashSecretToken(token)).Scan(&kioskID, &companyDBID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Invalid kiosk token"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		webFail("Failed to look up kiosk", w, err)
+		return
+	}
+	now := time.Now()
+	if locked, until := kioskLocked(kioskID, now); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+		http.Error(w, `{"message":"Too many wrong PINs; try again later"}`, http.StatusTooManyRequests)
+		return
+	}
+	DB.Exec(`UPDATE kiosks SET last_used_at = ? WHERE id = ?`, now.UTC().Format(time.RFC3339), kioskID)
+
+	pin = strings.TrimSpace(pin)
+	err = sql.ErrNoRows
+	if validKioskPin(pin) {
+		err = DB.QueryRow(`
+			SELECT p.user_id FROM kiosk_pins p JOIN users u ON u.id = p.user_id
+			WHERE p.company_id = ? AND p.pin_hash = ? AND u.active = 1
+		`, companyDBID, kioskPinHash(companyDBID, pin)).Scan(&userID)
+	}
+	if err == sql.ErrNoRows {
+		kioskRecordFailure(kioskID, now)
+		recordKioskEvent(r, kioskID, 0, "pin_failed", nil)
+		if locked, _ := kioskLocked(kioskID, now); locked {
+			recordKioskEvent(r, kioskID, 0, "locked", nil)
+			log.Printf("Kiosk %d locked after %d wrong PINs", kioskID, kioskMaxFailures)
+		}
+		http.Error(w, `{"message":"Unknown PIN"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		webFail("Failed to look up PIN", w, err)
+		return
+	}
+	return kioskID, companyDBID, userID, true
+}
+
+// kioskToday is today's date in the company's timezone.
+func kioskToday(companyDBID int) time.Time {
+	var code string
+	DB.QueryRow(`SELECT company_id FROM companies WHERE id = ?`, companyDBID).Scan(&code)
+	now := time.Now().In(companyLocation(code))
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// loadKioskStats lists the user's non-calculated assigned stats with their value for date.
+func loadKioskStats(userID int, date string) ([]kioskStat, error) {
+	rows, err := DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.value_type, COALESCE(s.currency, cs.default_currency, ?),
+		       (SELECT value FROM daily_stats WHERE stat_id = s.id AND date = ? LIMIT 1)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id
+		WHERE s.is_calculated = 0 AND s.archived_at IS NULL AND s.deleted_at IS NULL
+		  AND (s.assigned_user_id = ? OR s.id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?))
+		ORDER BY s.short_id
+	`, defaultCurrency, date, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []kioskStat{}
+	for rows.Next() {
+		var s kioskStat
+		var value sql.NullInt64
+		if err := rows.Scan(&s.StatID, &s.ShortID, &s.FullName, &s.ValueType, &s.currency, &value); err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			v := formatStatValue(value.Int64, s.ValueType, s.currency)
+			s.Value = &v
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func writeKioskUser(w http.ResponseWriter, userID int, date time.Time, saved int) {
+	day := date.Format("2006-01-02")
+	stats, err := loadKioskStats(userID, day)
+	if err != nil {
+		webFail("Failed to load stats", w, err)
+		return
+	}
+	var username string
+	var companyDBID int
+	DB.QueryRow(`SELECT username, company_id FROM users WHERE id = ?`, userID).Scan(&username, &companyDBID)
+	out := map[string]interface{}{
+		"user_id":     userID,
+		"username":    username,
+		"date":        day,
+		"week_ending": currentWeekEnding(date, weekEndingDayOf(companyDBID)),
+		"stats":       stats,
+	}
+	if saved >= 0 {
+		out["saved"] = saved
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /kiosk/identify ----------
+// Header: Authorization: Kiosk <token>. Body: {"pin": "4821"}. Returns the user's stats and
+// today's values for the entry screen.
+func KioskIdentifyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pin string `json:"pin"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	kioskID, companyDBID, userID, ok := kioskAuth(w, r, req.Pin)
+	if !ok {
+		return
+	}
+	recordKioskEvent(r, kioskID, userID, "identify", nil)
+	writeKioskUser(w, userID, kioskToday(companyDBID), -1)
+}
+
+// ---------- POST /kiosk/entries ----------
+// Header: Authorization: Kiosk <token>. Body: {"pin": "4821", "values": [{"stat_id": 12, "value": "40"}]}.
+// Each value replaces today's value of one of the user's stats; blank values are skipped.
+func KioskEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pin    string `json:"pin"`
+		Values []struct {
+			StatID int    `json:"stat_id"`
+			Value  string `json:"value"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	kioskID, companyDBID, userID, ok := kioskAuth(w, r, req.Pin)
+	if !ok || refuseLockedCompany(w, companyDBID) {
+		return
+	}
+	date := kioskToday(companyDBID)
+	if wd := date.Weekday(); wd == time.Saturday || wd == time.Sunday {
+		http.Error(w, `{"message":"Daily values are entered Monday to Friday"}`, http.StatusBadRequest)
+		return
+	}
+	day, week := date.Format("2006-01-02"), currentWeekEnding(date, weekEndingDayOf(companyDBID))
+
+	stats, err := loadKioskStats(userID, day)
+	if err != nil {
+		webFail("Failed to load stats", w, err)
+		return
+	}
+	mine := map[int]kioskStat{}
+	for _, s := range stats {
+		mine[s.StatID] = s
+	}
+	var code string
+	DB.QueryRow(`SELECT company_id FROM companies WHERE id = ?`, companyDBID).Scan(&code)
+	locale := companyLocale(code)
+
+	type parsed struct {
+		stat  kioskStat
+		value int64
+	}
+	var values []parsed
+	for _, v := range req.Values {
+		s, ok := mine[v.StatID]
+		if !ok {
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d is not assigned to you"}`, v.StatID), http.StatusForbidden)
+			return
+		}
+		if strings.TrimSpace(v.Value) == "" {
+			continue
+		}
+		n, err := parseStatValue(normalizeNumber(v.Value, locale, statInputPlaces(s.StatID)), s.ValueType, s.currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":"invalid value for %s"}`, s.ShortID), http.StatusBadRequest)
+			return
+		}
+		values = append(values, parsed{s, n})
+	}
+
+	entered := map[string]string{}
+	for _, v := range values {
+		stored, err := writeDailyValue(v.stat.StatID, day, v.value, false)
+		if _, ok := err.(*ruleViolation); ok {
+			writeRuleViolation(w, err)
+			return
+		} else if err == errStatArchived {
+			writeArchivedError(w)
+			return
+		} else if err != nil {
+			webFail("Failed to save daily value", w, err)
+			return
+		}
+		entered[v.stat.ShortID] = formatStatValue(stored, v.stat.ValueType, v.stat.currency)
+		if err := logActivity(DB, userID, activityDailySaved, v.stat.StatID, week, map[string]interface{}{
+			"values": map[string]string{date.Weekday().String(): entered[v.stat.ShortID]},
+			"source": "kiosk",
+		}); err != nil {
+			log.Printf("Failed to log kiosk entry for stat %d: %v", v.stat.StatID, err)
+		}
+		if err := markAggregatesDirty(DB, v.stat.StatID, week); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", v.stat.StatID, err)
+		}
+	}
+	recordKioskEvent(r, kioskID, userID, "submit", entered)
+	writeKioskUser(w, userID, date, len(values))
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Optional per-company LDAP / Active Directory authentication.
+//
+// When enabled for a company, LoginHandler first tries a simple bind against the directory using
+// bind_dn_template (e.g. "uid=%s,ou=people,dc=example,dc=com" or "%s@corp.example.com" for AD),
+// then looks the user up under base_dn by user_attr to read their group memberships (group_attr,
+// usually memberOf). Groups are mapped to StatHQ roles via ldap_group_roles. If the directory
+// rejects the credentials or is unreachable, login falls back to the local bcrypt users. A directory
+// user signing in for the first time takes a seat; when the plan has none left the login is refused.
+
+type ldapConfig struct {
+	Enabled        bool               `json:"enabled"`
+	URL            string             `json:"url"`
+	BindDNTemplate string             `json:"bind_dn_template"`
+	BaseDN         string             `json:"base_dn"`
+	UserAttr       string             `json:"user_attr"`
+	GroupAttr      string             `json:"group_attr"`
+	DefaultRole    string             `json:"default_role"`
+	InsecureTLS    bool               `json:"insecure_skip_verify"`
+	GroupRoles     []ldapGroupRoleRow `json:"group_roles"`
+}
+
+type ldapGroupRoleRow struct {
+	GroupDN string `json:"group_dn"`
+	Role    string `json:"role"`
+}
+
+const ldapTimeout = 10 * time.Second
+
+// loadLDAPConfig returns the company's LDAP config, or nil if none is stored.
+func loadLDAPConfig(companyDBID int) (*ldapConfig, error) {
+	var c ldapConfig
+	var defaultRole sql.NullString
+	err := DB.QueryRow(`
+		SELECT enabled, url, bind_dn_template, base_dn, user_attr, group_attr, default_role, insecure_skip_verify
+		FROM company_ldap WHERE company_id = ?
+	`, companyDBID).Scan(&c.Enabled, &c.URL, &c.BindDNTemplate, &c.BaseDN, &c.UserAttr, &c.GroupAttr, &defaultRole, &c.InsecureTLS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.DefaultRole = defaultRole.String
+
+	rows, err := DB.Query(`SELECT group_dn, role FROM ldap_group_roles WHERE company_id = ? ORDER BY group_dn`, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c.GroupRoles = []ldapGroupRoleRow{}
+	for rows.Next() {
+		var g ldapGroupRoleRow
+		if err := rows.Scan(&g.GroupDN, &g.Role); err != nil {
+			return nil, err
+		}
+		c.GroupRoles = append(c.GroupRoles, g)
+	}
+	return &c, rows.Err()
+}
+
+// ldapLogin authenticates username/password against the company's directory.
+// ok is false when LDAP is not configured, the bind fails, or the user maps to no role;
+// callers should then fall back to local authentication. refused is set when the directory
+// accepted the user but the company has no seat left for a new one: callers answer it with
+// 402 Payment Required instead of falling back.
+func ldapLogin(companyID, username, password string) (userID int, role, refused string, ok bool) {
+	if password == "" {
+		return 0, "", "", false // an empty simple bind is an anonymous bind and always "succeeds"
+	}
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		return 0, "", "", false
+	}
+	cfg, err := loadLDAPConfig(companyDBID)
+	if err != nil {
+		log.Printf("Failed to load LDAP config for company %s: %v", companyID, err)
+		return 0, "", "", false
+	}
+	if cfg == nil || !cfg.Enabled {
+		return 0, "", "", false
+	}
+
+	groups, err := ldapAuthenticate(cfg, username, password)
+	if err != nil {
+		log.Printf("LDAP authentication failed for %s/%s: %v", companyID, username, err)
+		return 0, "", "", false
+	}
+
+	role = cfg.DefaultRole
+	for _, g := range cfg.GroupRoles {
+		for _, member := range groups {
+			if strings.EqualFold(strings.TrimSpace(member), strings.TrimSpace(g.GroupDN)) && (role == "" || roleAtLeast(g.Role, role)) {
+				role = g.Role
+			}
+		}
+	}
+	if role == "" {
+		log.Printf("LDAP user %s/%s is not in any mapped group", companyID, username)
+		return 0, "", "", false
+	}
+
+	userID, refused, err = provisionLDAPUser(companyDBID, username, role)
+	if err != nil {
+		log.Printf("Failed to provision LDAP user %s/%s: %v", companyID, username, err)
+		return 0, "", "", false
+	}
+	if refused != "" {
+		log.Printf("LDAP user %s/%s not provisioned: %s", companyID, username, refused)
+		return 0, "", refused, false
+	}
+	return userID, role, "", true
+}
+
+// provisionLDAPUser creates or updates the local shadow row for a directory user. Shadow users get an
+// unusable random password hash so they cannot log in locally unless an admin resets their password.
+func provisionLDAPUser(companyDBID int, username, role string) (id int, refused string, err error) {
+	err = DB.QueryRow(`SELECT id FROM users WHERE company_id = ? AND lower(username) = ?`, companyDBID, username).Scan(&id)
+	if err == nil {
+		_, err = DB.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+		return id, "", err
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	// A new shadow row takes a seat like any other user.
+	if ok, msg, err := checkBillingLimit(companyDBID, "user"); err != nil {
+		return 0, "", err
+	} else if !ok {
+		return 0, msg + "; ask an administrator to free a seat before signing in", nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(buf)), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, "", err
+	}
+	res, err := DB.Exec(`INSERT INTO users (company_id, username, password_hash, role) VALUES (?, ?, ?, ?)`, companyDBID, username, string(hash), role)
+	if err != nil {
+		return 0, "", err
+	}
+	newID, err := res.LastInsertId()
+	return int(newID), "", err
+}
+
+// ldapAuthenticate binds as the user and returns the values of the configured group attribute.
+func ldapAuthenticate(cfg *ldapConfig, username, password string) ([]string, error) {
+	conn, err := ldapDial(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	bindDN := strings.ReplaceAll(cfg.BindDNTemplate, "%s", ldapEscapeDN(username))
+	if err := ldapBind(conn, 1, bindDN, password); err != nil {
+		return nil, err
+	}
+
+	userAttr := cfg.UserAttr
+	if userAttr == "" {
+		userAttr = "uid"
+	}
+	groupAttr := cfg.GroupAttr
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	groups, err := ldapSearchAttr(conn, 2, cfg.BaseDN, userAttr, username, groupAttr)
+	conn.Write(berWrap(0x30, append(berInt(0x02, 3), 0x42, 0x00))) // unbind
+	return groups, err
+}
+
+func ldapDial(cfg *ldapConfig) (net.Conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP url: %v", err)
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: cfg.InsecureTLS})
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		return dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("unsupported LDAP scheme %q", u.Scheme)
+	}
+}
+
+// ldapBind performs a simple bind and returns an error unless the server answers success (0).
+func ldapBind(conn net.Conn, msgID int, dn, password string) error {
+	op := berWrap(0x60, bytes.Join([][]byte{
+		berInt(0x02, 3),
+		berWrap(0x04, []byte(dn)),
+		berWrap(0x80, []byte(password)),
+	}, nil))
+	if _, err := conn.Write(berWrap(0x30, append(berInt(0x02, msgID), op...))); err != nil {
+		return err
+	}
+	tag, body, err := ldapReadResponse(conn)
+	if err != nil {
+		return err
+	}
+	if tag != 0x61 {
+		return fmt.Errorf("unexpected LDAP response tag 0x%x", tag)
+	}
+	return ldapResultError(body)
+}
+
+// ldapSearchAttr searches the subtree at base for (attr=value) and collects the values of want.
+func ldapSearchAttr(conn net.Conn, msgID int, base, attr, value, want string) ([]string, error) {
+	filter := berWrap(0xa3, append(berWrap(0x04, []byte(attr)), berWrap(0x04, []byte(value))...))
+	op := berWrap(0x63, bytes.Join([][]byte{
+		berWrap(0x04, []byte(base)),
+		berInt(0x0a, 2), // scope: wholeSubtree
+		berInt(0x0a, 0), // derefAliases: never
+		berInt(0x02, 1), // sizeLimit
+		berInt(0x02, int(ldapTimeout/time.Second)),
+		{0x01, 0x01, 0x00}, // typesOnly: false
+		filter,
+		berWrap(0x30, berWrap(0x04, []byte(want))),
+	}, nil))
+	if _, err := conn.Write(berWrap(0x30, append(berInt(0x02, msgID), op...))); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	found := false
+	for {
+		tag, body, err := ldapReadResponse(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64: // SearchResultEntry
+			found = true
+			elems, err := berChildren(body)
+			if err != nil || len(elems) < 2 {
+				return nil, errors.New("malformed search entry")
+			}
+			attrs, err := berChildren(elems[1].data)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range attrs {
+				parts, err := berChildren(a.data)
+				if err != nil || len(parts) < 2 || !strings.EqualFold(string(parts[0].data), want) {
+					continue
+				}
+				vals, err := berChildren(parts[1].data)
+				if err != nil {
+					continue
+				}
+				for _, v := range vals {
+					values = append(values, string(v.data))
+				}
+			}
+		case 0x73: // SearchResultReference – ignored
+		case 0x65: // SearchResultDone
+			if err := ldapResultError(body); err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, fmt.Errorf("user %s not found under %s", value, base)
+			}
+			return values, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response tag 0x%x", tag)
+		}
+	}
+}
+
+// ldapReadResponse reads one LDAPMessage and returns its protocolOp tag and contents.
+func ldapReadResponse(r io.Reader) (byte, []byte, error) {
+	tag, msg, err := berRead(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, fmt.Errorf("unexpected LDAP message tag 0x%x", tag)
+	}
+	elems, err := berChildren(msg)
+	if err != nil || len(elems) < 2 {
+		return 0, nil, errors.New("malformed LDAP message")
+	}
+	return elems[1].tag, elems[1].data, nil
+}
+
+// ldapResultError decodes an LDAPResult (resultCode, matchedDN, diagnosticMessage).
+func ldapResultError(body []byte) error {
+	elems, err := berChildren(body)
+	if err != nil || len(elems) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	code := 0
+	for _, b := range elems[0].data {
+		code = code<<8 | int(b)
+	}
+	if code != 0 {
+		return fmt.Errorf("LDAP result code %d: %s", code, string(elems[2].data))
+	}
+	return nil
+}
+
+// ldapEscapeDN escapes the characters RFC 4514 reserves in attribute values.
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ---- minimal BER encoding ----
+
+type berElem struct {
+	tag  byte
+	data []byte
+}
+
+func berLen(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var out []byte
+	for n > 0 {
+		out = append([]byte{byte(n)}, out...)
+		n >>= 8
+	}
+	return append([]byte{0x80 | byte(len(out))}, out...)
+}
+
+func berWrap(tag byte, data []byte) []byte {
+	return append(append([]byte{tag}, berLen(len(data))...), data...)
+}
+
+func berInt(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 && b[0]&0x80 == 0 {
+			break
+		}
+	}
+	return berWrap(tag, b)
+}
+
+func berRead(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		lenBytes := make([]byte, n&0x7f)
+		if len(lenBytes) > 4 {
+			return 0, nil, errors.New("BER length too large")
+		}
+		if _, err := io.ReadFull(r, lenBytes); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range lenBytes {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return hdr[0], data, err
+}
+
+func berChildren(data []byte) ([]berElem, error) {
+	var out []berElem
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		tag, d, err := berRead(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, berElem{tag: tag, data: d})
+	}
+	return out, nil
+}
+
+// ---------- GET /api/company/ldap ----------
+func GetLDAPConfigHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	cfg, err := loadLDAPConfig(companyDBID)
+	if err != nil {
+		webFail("Failed to load LDAP config", w, err)
+		return
+	}
+	if cfg == nil {
+		cfg = &ldapConfig{UserAttr: "uid", GroupAttr: "memberOf", GroupRoles: []ldapGroupRoleRow{}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// ---------- PUT /api/company/ldap ----------
+// Replaces the company's LDAP configuration and group-to-role mappings.
+func UpdateLDAPConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var req ldapConfig
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Enabled {
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			http.Error(w, `{"message":"url must be ldap://host[:port] or ldaps://host[:port]"}`, http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(req.BindDNTemplate, "%s") {
+			http.Error(w, `{"message":"bind_dn_template must contain %s"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DefaultRole != "" && !validRole(req.DefaultRole) {
+		http.Error(w, `{"message":"default_role must be admin, manager, user or empty"}`, http.StatusBadRequest)
+		return
+	}
+	for _, g := range req.GroupRoles {
+		if strings.TrimSpace(g.GroupDN) == "" || !validRole(g.Role) {
+			http.Error(w, `{"message":"each group role needs a group_dn and a role of admin, manager or user"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.UserAttr == "" {
+		req.UserAttr = "uid"
+	}
+	if req.GroupAttr == "" {
+		req.GroupAttr = "memberOf"
+	}
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	var defaultRole interface{}
+	if req.DefaultRole != "" {
+		defaultRole = req.DefaultRole
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO company_ldap (company_id, enabled, url, bind_dn_template, base_dn, user_attr, group_attr, default_role, insecure_skip_verify)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET
+			enabled = excluded.enabled, url = excluded.url, bind_dn_template = excluded.bind_dn_template,
+			base_dn = excluded.base_dn, user_attr = excluded.user_attr, group_attr = excluded.group_attr,
+			default_role = excluded.default_role, insecure_skip_verify = excluded.insecure_skip_verify
+	`, companyDBID, req.Enabled, req.URL, req.BindDNTemplate, req.BaseDN, req.UserAttr, req.GroupAttr, defaultRole, req.InsecureTLS); err != nil {
+		tx.Rollback()
+		webFail("Failed to save LDAP config", w, err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM ldap_group_roles WHERE company_id = ?`, companyDBID); err != nil {
+		tx.Rollback()
+		webFail("Failed to clear LDAP group roles", w, err)
+		return
+	}
+	for _, g := range req.GroupRoles {
+		if _, err := tx.Exec(`INSERT INTO ldap_group_roles (company_id, group_dn, role) VALUES (?, ?, ?)`, companyDBID, strings.TrimSpace(g.GroupDN), g.Role); err != nil {
+			tx.Rollback()
+			webFail("Failed to insert LDAP group role", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit LDAP config", w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "LDAP configuration saved"})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Legacy CSV migration. Before the database, weekly figures lived in CSV files with one row per
+// week and one column per stat (see SingleWeeklyStat: we, gi, vsd, expenses, scheduled, sites,
+// outstanding). -migrate-legacy-csv loads such files into weekly_stats for one company:
+//
+//	stathq -migrate-legacy-csv ./old-data -company 946-1 [-dry-run]
+//
+// Each column other than the week ending is matched to a stat by short_id (case-insensitive); a
+// column with no stat gets a new company-wide "main" stat, currency for the legacy money columns and
+// for columns whose values have cents, number otherwise. Existing values that differ are
+// overwritten. Everything runs in one transaction, and a dry run rolls it back after printing the
+// report. The legacy profit column is not loaded; PROFIT is created as a derived stat instead.
+
+// legacyCurrencyColumns are the SingleWeeklyStat money fields.
+var legacyCurrencyColumns = map[string]bool{"gi": true, "vsd": true, "expenses": true}
+
+// legacyWeekColumns name the week ending column in the files seen in the wild.
+var legacyWeekColumns = map[string]bool{"we": true, "w/e": true, "weekending": true, "week_ending": true}
+
+type legacyColumn struct {
+	Name      string
+	StatID    int
+	ValueType string
+	Currency  string
+	Created   bool
+	Archived  bool
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Skipped   int
+}
+
+type legacyReport struct {
+	Files   []string
+	Weeks   int
+	Columns []*legacyColumn
+	Errors  []string
+}
+
+// legacyDate accepts YYYY-MM-DD and the US M/D/YYYY form, and requires the company's W/E weekday.
+func legacyDate(s string, weekday time.Weekday) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006-01-02", "1/2/2006", "01/02/2006", "1/2/06"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			we := t.Format("2006-01-02")
+			if checkWeekEndingOn(we, weekday) != nil {
+				return "", fmt.Errorf("%s is not a %s", we, weekday)
+			}
+			return we, nil
+		}
+	}
+	return "", fmt.Errorf("unrecognized date %q", s)
+}
+
+// legacyValue normalizes a legacy cell ("1,234.50", "$12", "7.0") for parseStatValue.
+func legacyValue(raw, valueType string) string {
+	s := strings.NewReplacer("$", "", ",", "", " ", "").Replace(strings.TrimSpace(raw))
+	if valueType == "number" && strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+func legacyFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.csv"))
+	sort.Strings(files)
+	return files, err
+}
+
+// readLegacyCSV returns the header (lower-cased) and rows of a legacy file.
+func readLegacyCSV(path string) ([]string, [][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: reading header: %v", path, err)
+	}
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	}
+	var rows [][]string
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rows = append(rows, rec)
+	}
+	return header, rows, nil
+}
+
+// migrateLegacyCSV loads the files at path into the company's weekly_stats.
+func migrateLegacyCSV(path, companyCode string, dryRun bool, out io.Writer) error {
+	companyDBID, err := companyDBID(companyCode)
+	if err != nil {
+		return fmt.Errorf("company %s: %v", companyCode, err)
+	}
+	files, err := legacyFiles(path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no .csv files in %s", path)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	report := legacyReport{Files: files}
+	weekday := weekEndingDayOf(companyDBID)
+	columns := map[string]*legacyColumn{}
+	weeks := map[string]bool{}
+	touched := map[int][]string{}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, file := range files {
+		header, rows, err := readLegacyCSV(file)
+		if err != nil {
+			return err
+		}
+		weCol := -1
+		for i, h := range header {
+			if legacyWeekColumns[h] {
+				weCol = i
+			}
+		}
+		if weCol < 0 {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: no week ending column, skipped", file))
+			continue
+		}
+		for i, h := range header {
+			if i == weCol || h == "" || h == "profit" || columns[h] != nil {
+				continue // profit was always derived from gi and expenses
+			}
+			col, err := resolveLegacyColumn(tx, companyDBID, h, i, rows)
+			if err != nil {
+				return err
+			}
+			columns[h] = col
+			report.Columns = append(report.Columns, col)
+			if col.Archived {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s: %v", filepath.Base(file), h, errStatArchived))
+			}
+		}
+
+		for n, rec := range rows {
+			if weCol >= len(rec) || strings.TrimSpace(rec[weCol]) == "" {
+				continue
+			}
+			we, err := legacyDate(rec[weCol], weekday)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s line %d: %v", filepath.Base(file), n+2, err))
+				continue
+			}
+			weeks[we] = true
+			for i, h := range header {
+				col := columns[h]
+				if col == nil || i >= len(rec) || strings.TrimSpace(rec[i]) == "" {
+					continue
+				}
+				if col.Archived {
+					col.Skipped++
+					continue
+				}
+				value, err := parseStatValue(legacyValue(rec[i], col.ValueType), col.ValueType, col.Currency)
+				if err != nil {
+					col.Skipped++
+					report.Errors = append(report.Errors, fmt.Sprintf("%s line %d: %s: invalid value %q", filepath.Base(file), n+2, h, rec[i]))
+					continue
+				}
+				if err := checkWeeklyRules(tx, col.StatID, we, value, col.ValueType, false); err != nil {
+					v, ok := err.(*ruleViolation)
+					if !ok {
+						return err
+					}
+					col.Skipped++
+					report.Errors = append(report.Errors, fmt.Sprintf("%s line %d: %s: %s", filepath.Base(file), n+2, h, v.Message))
+					continue
+				}
+				var existingID, existing int64
+				err = tx.QueryRow(`SELECT id, value FROM weekly_stats WHERE stat_id = ? AND week_ending = ? ORDER BY id DESC LIMIT 1`, col.StatID, we).Scan(&existingID, &existing)
+				switch {
+				case err == sql.ErrNoRows:
+					_, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, updated_at) VALUES (?, ?, ?, ?)`, col.StatID, we, value, now)
+					col.Inserted++
+				case err == nil && existing == value:
+					col.Unchanged++
+					continue
+				case err == nil:
+					// The migration has no way to give a reason, so locked companies keep their logged weeks.
+					if verr := checkEditReason(tx, col.StatID, ""); verr != nil {
+						v, ok := verr.(*ruleViolation)
+						if !ok {
+							return verr
+						}
+						col.Skipped++
+						report.Errors = append(report.Errors, fmt.Sprintf("%s line %d: %s: W/E %s: %s", filepath.Base(file), n+2, h, we, v.Message))
+						continue
+					}
+					_, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, version = version + 1, updated_at = ? WHERE id = ?`, value, now, existingID)
+					col.Updated++
+				}
+				if err != nil {
+					return err
+				}
+				if err := logActivity(tx, nil, activityValueImported, col.StatID, we, map[string]string{
+					"source": "legacy_csv", "file": filepath.Base(file),
+				}); err != nil {
+					return err
+				}
+				touched[col.StatID] = append(touched[col.StatID], we)
+			}
+		}
+	}
+	report.Weeks = len(weeks)
+	printLegacyReport(out, report, dryRun)
+	if dryRun {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	markCompanyAggregatesDirty(DB, companyDBID)
+	for statID, wes := range touched {
+		for _, we := range wes {
+			enqueueRecalc(DB, statID, we)
+		}
+	}
+	if id, created, err := ensureProfitStat(companyDBID, nil); err != nil {
+		return err
+	} else if created {
+		fmt.Fprintf(out, "\nCreated PROFIT (#%d) as GI - EXPENSES.\n", id)
+	}
+	return nil
+}
+
+// resolveLegacyColumn finds the stat for a column, creating it when there is none.
+func resolveLegacyColumn(tx *sql.Tx, companyDBID int, name string, idx int, rows [][]string) (*legacyColumn, error) {
+	col := &legacyColumn{Name: name}
+	err := tx.QueryRow(`
+		SELECT id, value_type, COALESCE(currency, (SELECT default_currency FROM company_settings WHERE company_id = ?), ?), archived_at IS NOT NULL
+		FROM stats WHERE company_id = ? AND lower(short_id) = ? AND deleted_at IS NULL ORDER BY id LIMIT 1
+	`, companyDBID, defaultCurrency, companyDBID, name).Scan(&col.StatID, &col.ValueType, &col.Currency, &col.Archived)
+	if err == nil {
+		return col, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	col.ValueType, col.Currency = "number", companyCurrency(companyDBID)
+	if legacyCurrencyColumns[name] {
+		col.ValueType = "currency"
+	} else {
+		for _, rec := range rows {
+			if idx < len(rec) && strings.Contains(legacyValue(rec[idx], "number"), ".") {
+				col.ValueType = "currency"
+				break
+			}
+		}
+	}
+	res, err := tx.Exec(`INSERT INTO stats (short_id, full_name, type, value_type, company_id) VALUES (?, ?, 'main', ?, ?)`,
+		strings.ToUpper(name), strings.ToUpper(name), col.ValueType, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	col.StatID = int(id)
+	col.Created = true
+	if err := logActivity(tx, nil, activityStatCreated, col.StatID, "", map[string]string{"source": "legacy_csv"}); err != nil {
+		return nil, err
+	}
+	return col, nil
+}
+
+func printLegacyReport(out io.Writer, report legacyReport, dryRun bool) {
+	if dryRun {
+		fmt.Fprintln(out, "DRY RUN: nothing was written.")
+	}
+	fmt.Fprintf(out, "%d file(s), %d week(s)\n\n", len(report.Files), report.Weeks)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tSTAT\tTYPE\tINSERT\tUPDATE\tSAME\tBAD")
+	for _, c := range report.Columns {
+		stat := fmt.Sprintf("#%d", c.StatID)
+		if c.Created {
+			stat += " (new)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", c.Name, stat, c.ValueType, c.Inserted, c.Updated, c.Unchanged, c.Skipped)
+	}
+	tw.Flush()
+	if len(report.Errors) > 0 {
+		fmt.Fprintf(out, "\n%d problem(s):\n", len(report.Errors))
+		for _, e := range report.Errors {
+			fmt.Fprintln(out, "  "+e)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Continuous replication: when STATHQ_LITESTREAM_REPLICA is set, the server runs Litestream
+// (https://litestream.io) as a supervised child process that streams the SQLite WAL to object
+// storage, so a lost host costs seconds of entries rather than everything since the last nightly
+// backup. The database is switched to WAL mode, which Litestream requires.
+//
+// Configuration:
+//   STATHQ_LITESTREAM_REPLICA        replica URL, e.g. s3://bucket/stathq (credentials via the
+//                                    usual LITESTREAM_ACCESS_KEY_ID / AWS_* variables)
+//   STATHQ_LITESTREAM_CONFIG         use this litestream.yml instead of generating one
+//   STATHQ_LITESTREAM_BIN            default "litestream"
+//   STATHQ_LITESTREAM_SYNC_INTERVAL  default 1s
+//   STATHQ_LITESTREAM_METRICS_ADDR   default 127.0.0.1:9091 (polled for the health report)
+//   STATHQ_LITESTREAM_RESTORE        default true: restore from the replica on boot when the
+//                                    database file is missing
+
+type litestreamConfig struct {
+	Bin         string
+	ConfigPath  string
+	Replica     string
+	MetricsAddr string
+	Restore     bool
+}
+
+type litestreamStatus struct {
+	Enabled    bool               `json:"enabled"`
+	Running    bool               `json:"running"`
+	PID        int                `json:"pid,omitempty"`
+	Replica    string             `json:"replica,omitempty"`
+	StartedAt  time.Time          `json:"started_at,omitempty"`
+	Restarts   int                `json:"restarts"`
+	LastExit   string             `json:"last_exit,omitempty"`
+	Restored   bool               `json:"restored_on_boot"`
+	Output     []string           `json:"recent_output,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+	MetricsErr string             `json:"metrics_error,omitempty"`
+}
+
+var (
+	litestreamMu    sync.Mutex
+	litestreamState litestreamStatus
+	litestreamCmd   *exec.Cmd
+	litestreamCfg   *litestreamConfig
+)
+
+const litestreamOutputLines = 20
+
+func loadLitestreamConfig() (*litestreamConfig, error) {
+	replica := envString("STATHQ_LITESTREAM_REPLICA", "")
+	configPath := envString("STATHQ_LITESTREAM_CONFIG", "")
+	if replica == "" && configPath == "" {
+		return nil, nil
+	}
+	cfg := &litestreamConfig{
+		Bin:         envString("STATHQ_LITESTREAM_BIN", "litestream"),
+		ConfigPath:  configPath,
+		Replica:     replica,
+		MetricsAddr: envString("STATHQ_LITESTREAM_METRICS_ADDR", "127.0.0.1:9091"),
+		Restore:     envBool("STATHQ_LITESTREAM_RESTORE", true),
+	}
+	if _, err := exec.LookPath(cfg.Bin); err != nil {
+		return nil, fmt.Errorf("litestream binary %q not found: %v", cfg.Bin, err)
+	}
+	if cfg.ConfigPath == "" {
+		abs, err := filepath.Abs(dbFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ConfigPath = filepath.Join(filepath.Dir(abs), "litestream.yml")
+		yml := fmt.Sprintf("addr: %q\ndbs:\n  - path: %q\n    replicas:\n      - url: %q\n        sync-interval: %s\n",
+			cfg.MetricsAddr, abs, cfg.Replica, envDuration("STATHQ_LITESTREAM_SYNC_INTERVAL", time.Second))
+		if err := os.WriteFile(cfg.ConfigPath, []byte(yml), 0o600); err != nil {
+			return nil, fmt.Errorf("writing %s: %v", cfg.ConfigPath, err)
+		}
+	}
+	return cfg, nil
+}
+
+// PrepareLitestream runs before InitDB: it loads the configuration and, when the database file is
+// missing, restores it from the replica.
+func PrepareLitestream() {
+	cfg, err := loadLitestreamConfig()
+	if err != nil {
+		log.Printf("Replication disabled: %v", err)
+		return
+	}
+	if cfg == nil {
+		return
+	}
+	litestreamCfg = cfg
+	litestreamMu.Lock()
+	litestreamState.Enabled = true
+	litestreamState.Replica = cfg.Replica
+	litestreamMu.Unlock()
+
+	if _, err := os.Stat(dbFile); err == nil || !cfg.Restore {
+		return
+	}
+	log.Printf("Database %s missing; restoring from replica", dbFile)
+	out, err := exec.Command(cfg.Bin, "restore", "-config", cfg.ConfigPath, "-if-replica-exists", "-o", dbFile, mustAbs(dbFile)).CombinedOutput()
+	if err != nil {
+		log.Fatalf("Litestream restore failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(dbFile); err == nil {
+		litestreamMu.Lock()
+		litestreamState.Restored = true
+		litestreamMu.Unlock()
+		log.Printf("Restored %s from replica", dbFile)
+	} else {
+		log.Printf("No replica found; starting with an empty database")
+	}
+}
+
+func mustAbs(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+// StartLitestream switches the database to WAL mode and supervises `litestream replicate`,
+// restarting it with backoff if it exits. SIGINT/SIGTERM stop the child before the server exits
+// so a restart doesn't leave two replicators on the same database.
+func StartLitestream() {
+	cfg := litestreamCfg
+	if cfg == nil {
+		return
+	}
+	var mode string
+	if err := DB.QueryRow(`PRAGMA journal_mode = WAL`).Scan(&mode); err != nil || !strings.EqualFold(mode, "wal") {
+		log.Printf("Replication disabled: could not enable WAL mode (got %q, %v)", mode, err)
+		return
+	}
+
+	go func() {
+		backoff := time.Second
+		for {
+			started := time.Now()
+			err := runLitestream(cfg)
+			litestreamMu.Lock()
+			litestreamState.Running = false
+			litestreamState.PID = 0
+			litestreamState.LastExit = fmt.Sprintf("%s: %v", time.Now().UTC().Format(time.RFC3339), err)
+			litestreamState.Restarts++
+			litestreamMu.Unlock()
+			log.Printf("Litestream exited: %v", err)
+			if time.Since(started) > time.Minute {
+				backoff = time.Second
+			} else if backoff < time.Minute {
+				backoff *= 2
+			}
+			time.Sleep(backoff)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		litestreamMu.Lock()
+		if litestreamCmd != nil && litestreamCmd.Process != nil {
+			litestreamCmd.Process.Signal(os.Interrupt)
+		}
+		litestreamMu.Unlock()
+		time.Sleep(2 * time.Second)
+		os.Exit(0)
+	}()
+	log.Printf("Replicating %s to %s", dbFile, cfg.Replica)
+}
+
+func runLitestream(cfg *litestreamConfig) error {
+	cmd := exec.Command(cfg.Bin, "replicate", "-config", cfg.ConfigPath)
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	litestreamMu.Lock()
+	litestreamCmd = cmd
+	litestreamState.Running = true
+	litestreamState.PID = cmd.Process.Pid
+	litestreamState.StartedAt = time.Now().UTC()
+	litestreamMu.Unlock()
+
+	go func() {
+		sc := bufio.NewScanner(pr)
+		for sc.Scan() {
+			litestreamMu.Lock()
+			litestreamState.Output = append(litestreamState.Output, sc.Text())
+			if n := len(litestreamState.Output); n > litestreamOutputLines {
+				litestreamState.Output = litestreamState.Output[n-litestreamOutputLines:]
+			}
+			litestreamMu.Unlock()
+		}
+	}()
+	err := cmd.Wait()
+	pw.Close()
+	if err == nil {
+		err = errors.New("exited")
+	}
+	return err
+}
+
+// litestreamMetrics scrapes the litestream_* series from the Prometheus endpoint.
+func litestreamMetrics(addr string) (map[string]float64, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+	out := map[string]float64{}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "litestream_") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			out[line[:i]] = v
+		}
+	}
+	return out, sc.Err()
+}
+
+// ---------- GET /api/admin/replication ----------
+// Replication is of the whole instance, so this is for super-admins.
+func ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	litestreamMu.Lock()
+	st := litestreamState
+	st.Output = append([]string(nil), litestreamState.Output...)
+	litestreamMu.Unlock()
+	if st.Running && litestreamCfg != nil {
+		m, err := litestreamMetrics(litestreamCfg.MetricsAddr)
+		if err != nil {
+			st.MetricsErr = err.Error()
+		} else {
+			st.Metrics = m
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
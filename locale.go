@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Number input locale. Companies whose locale writes decimals with a comma ("1.234,56") get their
+// entries normalized to the canonical "1234.56" form before validation and storage, so
+// StringToMoney/strconv only ever see plain decimals. Other locales drop "," as a group separator.
+
+// decimalCommaLanguages are the language subtags whose locales use "," as the decimal separator.
+var decimalCommaLanguages = map[string]bool{
+	"de": true, "fr": true, "es": true, "it": true, "nl": true, "pt": true, "pl": true, "sv": true,
+	"da": true, "nb": true, "no": true, "fi": true, "cs": true, "sk": true, "hu": true, "ro": true,
+	"ru": true, "uk": true, "tr": true, "el": true, "id": true, "vi": true,
+}
+
+const defaultLocale = "en-US"
+
+func usesDecimalComma(locale string) bool {
+	lang := strings.ToLower(strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0])
+	return decimalCommaLanguages[lang]
+}
+
+// normalizeNumber rewrites a user-entered number in the given locale to plain decimal form,
+// dropping currency symbols and group separators. Input that is already canonical is unchanged.
+// places is how many decimals the stat's canonical values have (see statInputPlaces), -1 if unknown.
+func normalizeNumber(raw, locale string, places int) string {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return s
+	}
+	s = strings.NewReplacer("$", "", "€", "", "£", "", " ", "", "\u00a0", "", "\u202f", "", "'", "").Replace(s)
+	if usesDecimalComma(locale) {
+		// Values echoed back by the grids are canonical ("1234.50"); a single dot that is not
+		// followed by exactly three digits cannot be a group separator, so keep it as the decimal.
+		// Nor can one followed by as many digits as the stat's values have ("1.234" at 3 places).
+		if digits := len(s) - strings.Index(s, ".") - 1; !strings.Contains(s, ",") && strings.Count(s, ".") == 1 && (digits != 3 || digits == places) {
+			return s
+		}
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.ReplaceAll(s, ",", ".")
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	return s
+}
+
+// companyLocale returns the locale of a company (by public company_id), or the default.
+func companyLocale(companyID string) string {
+	var locale string
+	if err := DB.QueryRow(`SELECT locale FROM companies WHERE company_id = ?`, companyID).Scan(&locale); err != nil || locale == "" {
+		return defaultLocale
+	}
+	return locale
+}
+
+// requestLocale is companyLocale for the authenticated caller.
+func requestLocale(r *http.Request) string {
+	companyID, _ := r.Context().Value("company_id").(string)
+	return companyLocale(companyID)
+}
+
+// ---------- GET /api/company/locale ----------
+func GetCompanyLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"locale":        locale,
+		"decimal_comma": usesDecimalComma(locale),
+	})
+}
+
+// ---------- PUT /api/company/locale ----------
+// Body: { "locale": "de-DE" }
+func UpdateCompanyLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Locale string `json:"locale"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.Locale = strings.TrimSpace(req.Locale)
+	if req.Locale == "" || len(req.Locale) > 35 {
+		http.Error(w, `{"message":"locale is required (e.g. en-US, de-DE)"}`, http.StatusBadRequest)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET locale = ? WHERE company_id = ?`, req.Locale, r.Context().Value("company_id")); err != nil {
+		webFail("Failed to update locale", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"locale":        req.Locale,
+		"decimal_comma": usesDecimalComma(req.Locale),
+	})
+}
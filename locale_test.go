@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestNormalizeNumber(t *testing.T) {
+	tests := []struct {
+		raw, locale string
+		places      int
+		want        string
+	}{
+		{"", "de-DE", 2, ""},
+		{"  ", "en-US", 2, ""},
+		{"1234", "de-DE", 0, "1234"},
+		{"1.234,56", "de-DE", 2, "1234.56"},
+		{"12,5", "de-DE", 2, "12.5"},
+		{"€ 12,5", "de-DE", 2, "12.5"},
+		{"1.234", "de-DE", 2, "1234"},
+		{"1.234", "de-DE", 0, "1234"},
+		{"1.234", "de-DE", -1, "1234"},
+		{"1.234", "de-DE", 3, "1.234"},
+		{"1.234.567", "de-DE", 3, "1234567"},
+		{"1234.50", "de-DE", 2, "1234.50"},
+		{"0.5", "de-DE", 2, "0.5"},
+		{"1 234,56", "fr-FR", 2, "1234.56"},
+		{"1'234.56", "en-US", 2, "1234.56"},
+		{"1,234.56", "en-US", 2, "1234.56"},
+		{"$1,234", "en-US", 0, "1234"},
+		{"1.234", "en-US", 2, "1.234"},
+	}
+	for _, tt := range tests {
+		if got := normalizeNumber(tt.raw, tt.locale, tt.places); got != tt.want {
+			t.Errorf("normalizeNumber(%q, %q, %d) = %q, want %q", tt.raw, tt.locale, tt.places, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Brute-force protection for password logins (/login and the token password grant).
+//
+// Per address: more than STATHQ_LOGIN_MAX_PER_IP failed attempts (20) within STATHQ_LOGIN_WINDOW
+// (15m), counted from login_events, and the address gets 429 until the window moves on.
+// Per user: STATHQ_LOGIN_MAX_FAILURES consecutive failures (5) lock the account for
+// STATHQ_LOGIN_LOCKOUT (15m); users.failed_logins and users.locked_until hold the state, a successful
+// login resets it and an admin can unlock early with POST /api/users/{id}/unlock. Attempts during a
+// lockout are refused without checking the password.
+
+type loginLimits struct {
+	MaxPerIP    int
+	Window      time.Duration
+	MaxFailures int
+	Lockout     time.Duration
+}
+
+func loadLoginLimits() loginLimits {
+	return loginLimits{
+		MaxPerIP:    envInt("STATHQ_LOGIN_MAX_PER_IP", 20),
+		Window:      envDuration("STATHQ_LOGIN_WINDOW", 15*time.Minute),
+		MaxFailures: envInt("STATHQ_LOGIN_MAX_FAILURES", 5),
+		Lockout:     envDuration("STATHQ_LOGIN_LOCKOUT", 15*time.Minute),
+	}
+}
+
+// loginCredentialFailure reports whether a failed login reason counts towards the user's lockout.
+func loginCredentialFailure(reason string) bool {
+	return reason == "wrong password" || reason == "wrong 2fa code"
+}
+
+// loginAllowed refuses a login attempt from a throttled address or for a locked user, writing the
+// response. It runs before the password is checked.
+func loginAllowed(w http.ResponseWriter, r *http.Request, companyCode, username, method string) bool {
+	limits := loadLoginLimits()
+	now := time.Now().UTC()
+	ip := clientIP(r)
+	if limits.MaxPerIP > 0 {
+		var failures int
+		DB.QueryRow(`SELECT COUNT(*) FROM login_events WHERE ip = ? AND success = 0 AND created_at > ?`,
+			ip, now.Add(-limits.Window).Format(time.RFC3339)).Scan(&failures)
+		if failures >= limits.MaxPerIP {
+			log.Printf("Login throttled for %s: %d failures in %s", ip, failures, limits.Window)
+			w.Header().Set("Retry-After", strconv.Itoa(int(limits.Window.Seconds())))
+			http.Error(w, `{"message": "Too many failed logins, try again later"}`, http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	var userID int
+	var lockedUntil string
+	err := DB.QueryRow(`
+		SELECT u.id, COALESCE(u.locked_until, '') FROM users u JOIN companies c ON u.company_id = c.id
+		WHERE c.company_id = ? AND lower(u.username) = ?
+	`, companyCode, username).Scan(&userID, &lockedUntil)
+	if err != nil || lockedUntil == "" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, lockedUntil)
+	if err != nil || !now.Before(until) {
+		return true
+	}
+	recordLogin(r, companyCode, username, userID, method, false, "locked")
+	w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	fmt.Fprintf(w, `{"message": "Account locked after too many failed logins", "locked_until": %q}`, lockedUntil)
+	return false
+}
+
+// noteLoginOutcome keeps the user's consecutive failure count, locking the account at the limit.
+// recordLogin calls it for every attempt that resolved to a user.
+func noteLoginOutcome(userID int, success bool, reason string) {
+	if success {
+		DB.Exec(`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ? AND failed_logins > 0`, userID)
+		return
+	}
+	if !loginCredentialFailure(reason) {
+		return
+	}
+	limits := loadLoginLimits()
+	var failures int
+	if err := DB.QueryRow(`UPDATE users SET failed_logins = failed_logins + 1 WHERE id = ? RETURNING failed_logins`, userID).Scan(&failures); err != nil {
+		log.Printf("Failed to count failed login for user %d: %v", userID, err)
+		return
+	}
+	if limits.MaxFailures > 0 && failures >= limits.MaxFailures {
+		until := time.Now().UTC().Add(limits.Lockout).Format(time.RFC3339)
+		DB.Exec(`UPDATE users SET failed_logins = 0, locked_until = ? WHERE id = ?`, until, userID)
+		log.Printf("User %d locked until %s after %d failed logins", userID, until, failures)
+	}
+}
+
+// ---------- POST /api/users/{id}/unlock ----------
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`
+		UPDATE users SET failed_logins = 0, locked_until = NULL
+		WHERE id = ? AND company_id = (SELECT id FROM companies WHERE company_id = ?)
+	`, mux.Vars(r)["id"], r.Context().Value("company_id"))
+	if err != nil {
+		webFail("Failed to unlock user", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	log.Printf("User %v unlocked user %s", r.Context().Value("user_id"), mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unlocked"})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Login audit: every login attempt, successful or not, is written to login_events with the client
+// address, user agent and (behind a CDN) country, and checked for bursts of failures and unfamiliar
+// places (see securityevents.go). users.last_login_at is set on success and users.last_seen_at is
+// refreshed by AuthMiddleware (at most every lastSeenInterval per user, to keep writes off the hot
+// path).
+
+const lastSeenInterval = 5 * time.Minute
+
+var (
+	lastSeenMu    sync.Mutex
+	lastSeenTouch = map[int]time.Time{}
+)
+
+// clientIP is the request's remote address, or the first X-Forwarded-For hop when the server runs
+// behind a proxy (STATHQ_TRUST_PROXY=true).
+func clientIP(r *http.Request) string {
+	if envBool("STATHQ_TRUST_PROXY", false) {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordLogin writes a login attempt. userID is 0 when the username did not resolve to a user.
+func recordLogin(r *http.Request, companyCode, username string, userID int, method string, success bool, reason string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var uid interface{}
+	if userID != 0 {
+		uid = userID
+	}
+	ua := r.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	ip, country := clientIP(r), clientCountry(r)
+	res, err := DB.Exec(`
+		INSERT INTO login_events (user_id, company_code, username, ip, user_agent, method, success, reason, created_at, country)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, uid, companyCode, username, ip, ua, method, success, nullIfEmpty(reason), now, nullIfEmpty(country))
+	if err != nil {
+		log.Printf("Failed to record login for %s/%s: %v", companyCode, username, err)
+	} else if eventID, err := res.LastInsertId(); err == nil {
+		detectLoginAnomalies(companyCode, username, userID, ip, country, method, success, eventID)
+	}
+	if userID != 0 {
+		noteLoginOutcome(userID, success, reason)
+	}
+	if success && userID != 0 {
+		DB.Exec(`UPDATE users SET last_login_at = ?, last_seen_at = ? WHERE id = ?`, now, now, userID)
+		lastSeenMu.Lock()
+		lastSeenTouch[userID] = time.Now()
+		lastSeenMu.Unlock()
+	}
+}
+
+// touchLastSeen refreshes users.last_seen_at for an authenticated request.
+func touchLastSeen(userID int) {
+	lastSeenMu.Lock()
+	if time.Since(lastSeenTouch[userID]) < lastSeenInterval {
+		lastSeenMu.Unlock()
+		return
+	}
+	lastSeenTouch[userID] = time.Now()
+	lastSeenMu.Unlock()
+	if _, err := DB.Exec(`UPDATE users SET last_seen_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), userID); err != nil {
+		log.Printf("Failed to update last_seen_at for user %d: %v", userID, err)
+	}
+}
+
+type loginEvent struct {
+	ID        int    `json:"id"`
+	At        string `json:"at"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Method    string `json:"method"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ---------- GET /api/user/logins?limit=20 ----------
+// The caller's own recent login attempts, newest first. Failed attempts are matched by username
+// as well, so a user can see someone guessing at their password.
+func MyLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, `{"message":"limit must be between 1 and 200"}`, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	userID := r.Context().Value("user_id").(int)
+	companyCode := r.Context().Value("company_id").(string)
+	username := r.Context().Value("username").(string)
+	rows, err := DB.Query(`
+		SELECT id, created_at, ip, user_agent, method, success, reason
+		FROM login_events
+		WHERE user_id = ? OR (user_id IS NULL AND company_code = ? AND username = ?)
+		ORDER BY id DESC LIMIT ?
+	`, userID, companyCode, strings.ToLower(username), limit)
+	if err != nil {
+		webFail("Failed to query logins", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []loginEvent{}
+	for rows.Next() {
+		var e loginEvent
+		var reason sql.NullString
+		if err := rows.Scan(&e.ID, &e.At, &e.IP, &e.UserAgent, &e.Method, &e.Success, &reason); err != nil {
+			webFail("Failed to scan logins", w, err)
+			return
+		}
+		e.Reason = reason.String
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Magic-link login for staff who enter a stat a week and never remember their password.
+// POST /login/magic with {"company_id": "ACME", "username": "..."} (the username or the verified email
+// address) mails a one-time link to /login/magic/confirm; opening it shows a "Sign in" button, and
+// pressing that starts an ordinary session. The button is there because mail scanners open links:
+// only the POST uses the link up.
+//
+// The answer is the same whether or not a link was sent, so the endpoint does not reveal accounts.
+// Links go only to verified addresses (see email.go), not to deactivated users or users with 2FA
+// (their code would be skipped), at most one a minute per user. A link lasts STATHQ_MAGIC_LINK_TTL
+// (15m), works once, and a new one replaces it. Set STATHQ_MAGIC_LINK=false to turn the feature off.
+
+const (
+	magicLinkInterval = time.Minute
+	magicLinkSent     = `{"message": "If the account has a verified email address, a sign-in link is on its way"}`
+)
+
+type magicLinkView struct {
+	Username string
+	Company  string
+	Error    string
+}
+
+var magicLinkPage = template.Must(template.New("magic").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to StatHQ</title>
+<style>body{font-family:sans-serif;max-width:28em;margin:2em auto;padding:0 1em}button{font-size:1.2em;width:100%;margin:.3em 0;padding:.4em}.err{color:#b00}</style>
+</head><body>
+<h1>Sign in to StatHQ</h1>
+{{if .Error}}<p class="err">{{.Error}}</p><p><a href="/login">Back to the login page</a></p>
+{{else}}<p>Sign in to {{.Company}} as <strong>{{.Username}}</strong>.</p>
+<form method="post"><button type="submit">Sign in</button></form>{{end}}
+</body></html>`))
+
+func renderMagicLink(w http.ResponseWriter, status int, view magicLinkView) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := magicLinkPage.Execute(w, view); err != nil {
+		log.Printf("Failed to render sign-in link page: %v", err)
+	}
+}
+
+// sendMagicLink replaces the user's outstanding link and mails a new one, unless one was sent
+// within the last minute.
+func sendMagicLink(r *http.Request, userID int, username, email, company string, remember bool) error {
+	now := time.Now().UTC()
+	var recent int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM login_links WHERE user_id = ? AND created_at > ?`,
+		userID, now.Add(-magicLinkInterval).Format(time.RFC3339)).Scan(&recent); err != nil {
+		return err
+	}
+	if recent > 0 {
+		log.Printf("Sign-in link for user %d not sent: one was sent less than a minute ago", userID)
+		return nil
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	ttl := envDuration("STATHQ_MAGIC_LINK_TTL", 15*time.Minute)
+	if _, err := DB.Exec(`
+		INSERT INTO login_links (token_hash, user_id, email, remember, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET token_hash = excluded.token_hash, email = excluded.email,
+			remember = excluded.remember, created_at = excluded.created_at, expires_at = excluded.expires_at
+	`, hash, userID, email, remember, now.Format(time.RFC3339), now.Add(ttl).Format(time.RFC3339)); err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Sign in to %s on StatHQ as %s:\n\n%s\n\nThe link works once and expires in %d minutes. If you did not ask for it, ignore this email.\n",
+		company, username, shardLink(publicURL(r)+"/login/magic/confirm?token="+token), int(ttl.Minutes()))
+	return sendMail(email, "Your StatHQ sign-in link", body)
+}
+
+// ---------- POST /login/magic ----------
+// Body: {"company_id": "ACME", "username": "name or email", "remember_me": false}
+func MagicLinkRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if !envBool("STATHQ_MAGIC_LINK", true) {
+		http.Error(w, `{"message": "Sign-in links are disabled"}`, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		CompanyID string `json:"company_id"`
+		Username  string `json:"username"`
+		Remember  bool   `json:"remember_me"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	login := strings.ToLower(strings.TrimSpace(req.Username))
+	if req.CompanyID == "" || login == "" {
+		http.Error(w, `{"message": "company_id and username are required"}`, http.StatusBadRequest)
+		return
+	}
+	if companySuspended(req.CompanyID) {
+		http.Error(w, `{"message": "This company is suspended"}`, http.StatusForbidden)
+		return
+	}
+	if !loginAllowed(w, r, req.CompanyID, login, "magic_link") {
+		return
+	}
+
+	var userID int
+	var username, email, company string
+	err := DB.QueryRow(`
+		SELECT u.id, u.username, u.email, c.name FROM users u JOIN companies c ON c.id = u.company_id
+		WHERE c.company_id = ? AND (lower(u.username) = ? OR lower(u.email) = ?)
+			AND u.email_verified_at IS NOT NULL AND u.active = 1
+		ORDER BY lower(u.username) = ? DESC LIMIT 1
+	`, req.CompanyID, login, login, login).Scan(&userID, &username, &email, &company)
+	switch {
+	case err == sql.ErrNoRows:
+		log.Printf("Sign-in link for %s/%s not sent: no active user with a verified email", req.CompanyID, login)
+	case err != nil:
+		webFail("Failed to look up user", w, err)
+		return
+	case twoFactorEnabled(userID):
+		log.Printf("Sign-in link for user %d not sent: 2FA is enabled", userID)
+	default:
+		if err := sendMagicLink(r, userID, username, email, company, req.Remember); err != nil {
+			log.Printf("Failed to send sign-in link to user %d: %v", userID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, magicLinkSent)
+}
+
+// magicLinkLookup resolves a link without using it up.
+func magicLinkLookup(token string) (view magicLinkView, ok bool) {
+	var expires string
+	err := DB.QueryRow(`
+		SELECT l.expires_at, u.username, c.name
+		FROM login_links l JOIN users u ON u.id = l.user_id JOIN companies c ON c.id = u.company_id
+		WHERE l.token_hash = ?
+	`, hashSecretToken(token)).Scan(&expires, &view.Username, &view.Company)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to look up sign-in link: %v", err)
+		}
+		return view, false
+	}
+	t, err := time.Parse(time.RFC3339, expires)
+	return view, err == nil && time.Now().Before(t)
+}
+
+const magicLinkInvalid = "This sign-in link is invalid, used or expired. Request a new one from the login page."
+
+// ---------- GET /login/magic/confirm?token=... ----------
+func MagicLinkPageHandler(w http.ResponseWriter, r *http.Request) {
+	view, ok := magicLinkLookup(r.URL.Query().Get("token"))
+	if !ok {
+		renderMagicLink(w, http.StatusNotFound, magicLinkView{Error: magicLinkInvalid})
+		return
+	}
+	renderMagicLink(w, http.StatusOK, view)
+}
+
+// ---------- POST /login/magic/confirm?token=... ----------
+// Uses the link up and signs the user in, redirecting to the app.
+func MagicLinkConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	var userID int
+	var email, expires, username, companyCode string
+	var remember bool
+	err := DB.QueryRow(`
+		DELETE FROM login_links WHERE token_hash = ? RETURNING user_id, email, remember, expires_at
+	`, hashSecretToken(r.URL.Query().Get("token"))).Scan(&userID, &email, &remember, &expires)
+	if err == nil {
+		err = DB.QueryRow(`
+			SELECT u.username, c.company_id FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ?
+		`, userID).Scan(&username, &companyCode)
+	}
+	if err == sql.ErrNoRows {
+		renderMagicLink(w, http.StatusNotFound, magicLinkView{Error: magicLinkInvalid})
+		return
+	}
+	if err != nil {
+		webFail("Failed to look up sign-in link", w, err)
+		return
+	}
+	refuse := func(reason, message string) {
+		recordLogin(r, companyCode, username, userID, "magic_link", false, reason)
+		renderMagicLink(w, http.StatusForbidden, magicLinkView{Error: message})
+	}
+	if t, err := time.Parse(time.RFC3339, expires); err != nil || time.Now().After(t) {
+		refuse("link expired", magicLinkInvalid)
+		return
+	}
+	// Things may have changed since the link was sent.
+	var verified int
+	DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND email = ? AND email_verified_at IS NOT NULL`, userID, email).Scan(&verified)
+	switch {
+	case verified == 0:
+		refuse("email changed", magicLinkInvalid)
+		return
+	case companySuspended(companyCode):
+		refuse("company suspended", "This company is suspended.")
+		return
+	case !userActive(userID):
+		refuse("deactivated", accountDeactivatedMessage+".")
+		return
+	case twoFactorEnabled(userID):
+		refuse("2fa enabled", "This account uses two-factor authentication. Sign in with your password and code.")
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	startSession(session, userID, companyCode, remember)
+	if err := session.Save(r, w); err != nil {
+		webFail("Failed to save session", w, err)
+		return
+	}
+	recordLogin(r, companyCode, username, userID, "magic_link", true, "")
+	log.Printf("Successful sign-in link login for %s/%s", companyCode, username)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
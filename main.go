@@ -5,11 +5,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -25,7 +26,7 @@ import (
 )
 
 var (
-	store *sessions.CookieStore
+	store *dbSessionStore
 )
 
 // webFail – centralised error responder
@@ -47,77 +48,125 @@ func webFail(msg string, w http.ResponseWriter, err error, data ...interface{})
 }
 
 // Updated AuthMiddleware: put username and role into request context so handlers
-// (e.g., handleGetWeeklyStats) can check role without extra DB lookups.
-func AuthMiddleware(requireRole string, next http.Handler) http.Handler {
+// (e.g., handleGetWeeklyStats) can check role without extra DB lookups. permission is what the
+// route needs (see permissions.go), "" for any signed-in user.
+func AuthMiddleware(permission string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, "session-name")
+		// API clients send an access token or API token (see tokens.go, apitokens.go); browsers use
+		// the session cookie.
+		bearer, viaToken, err := bearerTokenUser(r)
+		userID, familyID := bearer.UserID, bearer.FamilyID
 		if err != nil {
-			log.Printf("Session error: %v", err)
-			http.Error(w, `{"message": "Session error"}`, http.StatusInternalServerError)
+			log.Printf("Rejected bearer token for %s: %v", r.URL.Path, err)
+			http.Error(w, `{"message": "Invalid or expired access token"}`, http.StatusUnauthorized)
 			return
 		}
+		var session *sessions.Session
+		if !viaToken {
+			session, err = store.Get(r, "session-name")
+			if err != nil {
+				log.Printf("Session error: %v", err)
+				http.Error(w, `{"message": "Session error"}`, http.StatusInternalServerError)
+				return
+			}
 
-		userID, ok := session.Values["user_id"].(int)
-		if !ok || userID == 0 {
-			log.Printf("No user_id in session for %s", r.URL.Path)
-			http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
-			return
+			var ok bool
+			userID, ok = session.Values["user_id"].(int)
+			if !ok || userID == 0 {
+				log.Printf("No user_id in session for %s", r.URL.Path)
+				http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
 		}
 
-		var companyID string
-		var username, role string
-		err = DB.QueryRow("SELECT c.company_id, u.username, u.role FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?", userID).Scan(&companyID, &username, &role)
+		user, err := loadAuthUser(userID)
 		if err != nil {
 			log.Printf("User not found for id %d: %v", userID, err)
 			http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
 			return
 		}
 
-		if requireRole != "" && role != requireRole {
-			log.Printf("User %s (role %s) not authorized for %s (requires %s)", username, role, r.URL.Path, requireRole)
+		// A super-admin's session may be switched to a company admin (see superadmin.go). Routes
+		// for the platform keep acting as the real user.
+		sessionCompany := user.CompanyID
+		impersonatorID := 0
+		if session != nil && user.Role == roleSuperadmin {
+			if target, ok := session.Values["impersonate_user_id"].(int); ok && target != 0 {
+				if targetUser, err := loadAuthUser(target); err == nil {
+					impersonatorID = userID
+					if permission != permManagePlatform {
+						userID, user = target, targetUser
+					}
+				}
+			}
+		}
+		companyID, username, role := user.CompanyID, user.Username, user.Role
+		if bearer.Scopes != nil {
+			if role = apiTokenRole(role, bearer.Scopes); !apiTokenAllows(bearer.Scopes, r.Method) {
+				http.Error(w, `{"message": "This API token is read-only"}`, http.StatusForbidden)
+				return
+			}
+		}
+
+		if permission != "" && !can(role, permission) {
+			log.Printf("User %s (role %s) not authorized for %s (requires %s)", username, role, r.URL.Path, permission)
 			http.Error(w, `{"message": "Forbidden"}`, http.StatusForbidden)
 			return
 		}
+		if user.Suspended && impersonatorID == 0 {
+			http.Error(w, `{"message": "This company is suspended"}`, http.StatusForbidden)
+			return
+		}
+		if !user.Active {
+			http.Error(w, `{"message": "`+accountDeactivatedMessage+`"}`, http.StatusUnauthorized)
+			return
+		}
+		// Super-admins bypass company IP allowlists (see ipallowlist.go).
+		if user.Role != roleSuperadmin && impersonatorID == 0 && !ipAllowed(r, companyID) {
+			log.Printf("User %s of %s refused from %s: not in the IP allowlist", username, companyID, clientIP(r))
+			http.Error(w, `{"message": "Access from this address is not allowed"}`, http.StatusForbidden)
+			return
+		}
 
+		if session != nil && !enforceSessionLifetime(w, r, session, sessionCompany) {
+			http.Error(w, `{"message": "Session expired"}`, http.StatusUnauthorized)
+			return
+		}
+		touchLastSeen(userID)
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, "company_id", companyID)
 		ctx = context.WithValue(ctx, "user_id", userID)
 		ctx = context.WithValue(ctx, "username", username)
 		ctx = context.WithValue(ctx, "role", role) // <-- added so handlers can check role from context
-		next.ServeHTTP(w, r.WithContext(ctx))
+		ctx = context.WithValue(ctx, "token_family_id", familyID)
+		if bearer.APITokenID != 0 {
+			ctx = context.WithValue(ctx, "api_token_id", bearer.APITokenID)
+		}
+		if impersonatorID != 0 {
+			ctx = context.WithValue(ctx, "impersonator_id", impersonatorID)
+		}
+		apiQuotaGuard(trialGuard(billingGuard(next))).ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// UserInfoHandler returns the current user's information including numeric id
+// UserInfoHandler returns the current user's information including numeric id. Super-admins are
+// reported with role admin and "superadmin": true, which is what the frontend's role checks expect.
+// While a super-admin impersonates a company admin this is the impersonated user, with
+// impersonator_id set. permissions lists what the role may do (see permissions.go).
 func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := store.Get(r, "session-name")
-	if err != nil {
-		log.Printf("Session error: %v", err)
-		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
-		return
-	}
-
-	userID, ok := session.Values["user_id"].(int)
-	if !ok || userID == 0 {
-		log.Printf("No user_id in session for %s", r.URL.Path)
-		http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
-		return
+	role := r.Context().Value("role").(string)
+	response := map[string]interface{}{
+		"id":          r.Context().Value("user_id"),
+		"company_id":  r.Context().Value("company_id"),
+		"username":    r.Context().Value("username"),
+		"role":        role,
+		"permissions": permissionsOf(role),
 	}
-
-	var companyID string
-	var username, role string
-	err = DB.QueryRow("SELECT c.company_id, u.username, u.role FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?", userID).Scan(&companyID, &username, &role)
-	if err != nil {
-		log.Printf("User not found for id %d: %v", userID, err)
-		http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
-		return
+	if role == roleSuperadmin {
+		response["role"], response["superadmin"] = "admin", true
 	}
-
-	response := map[string]interface{}{
-		"id":         userID,
-		"company_id": companyID,
-		"username":   username,
-		"role":       role,
+	if id, ok := r.Context().Value("impersonator_id").(int); ok {
+		response["impersonator_id"] = id
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -139,11 +188,17 @@ func ListAssignedStatsHandler(w http.ResponseWriter, r *http.Request) {
 			u.username,
 			s.assigned_division_id,
 			d.name AS division_name,
-			s.is_calculated
+			s.is_calculated,
+			s.decimal_places,
+			COALESCE(s.unit_label, ''),
+			s.thousands_separator,
+			COALESCE(s.currency, ''),
+			s.archived_at
 		FROM stats s
 		LEFT JOIN users u ON s.assigned_user_id = u.id
 		LEFT JOIN divisions d ON s.assigned_division_id = d.id
-		WHERE s.assigned_user_id = ? OR s.id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?)
+		WHERE s.archived_at IS NULL AND s.deleted_at IS NULL
+		  AND (s.assigned_user_id = ? OR s.id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?))
 		ORDER BY s.short_id
 	`, uid, uid)
 	if err != nil {
@@ -159,8 +214,10 @@ func ListAssignedStatsHandler(w http.ResponseWriter, r *http.Request) {
 		var assignedUsername sqlNullString
 		var assignedDiv sqlNullInt64
 		var divName sqlNullString
+		var places sqlNullInt64
+		var archivedAt sqlNullString
 		if err := rows.Scan(&s.ID, &s.ShortID, &s.FullName, &s.Type, &s.ValueType, &s.Reversed,
-			&assignedUID, &assignedUsername, &assignedDiv, &divName, &s.IsCalculated); err != nil {
+			&assignedUID, &assignedUsername, &assignedDiv, &divName, &s.IsCalculated, &places, &s.UnitLabel, &s.ThousandsSeparator, &s.Currency, &archivedAt); err != nil {
 			webFail("Failed to scan assigned stat row", w, err)
 			return
 		}
@@ -180,6 +237,13 @@ func ListAssignedStatsHandler(w http.ResponseWriter, r *http.Request) {
 			dn := divName.String
 			s.AssignedDivName = &dn
 		}
+		if places.Valid {
+			n := int(places.Int64)
+			s.DecimalPlaces = &n
+		}
+		if archivedAt.Valid {
+			s.ArchivedAt = &archivedAt.String
+		}
 		out = append(out, s)
 	}
 	if err := rows.Err(); err != nil {
@@ -204,7 +268,7 @@ func handleGetDailyStats(w http.ResponseWriter, r *http.Request) {
 		webFail("date and (stat_id or stat) are required", w, errors.New("missing params"))
 		return
 	}
-	if err := checkIfValidWE(thisWeek); err != nil {
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), thisWeek); err != nil {
 		webFail("Invalid W/E date", w, err)
 		return
 	}
@@ -216,7 +280,7 @@ func handleGetDailyStats(w http.ResponseWriter, r *http.Request) {
 		webFail("Invalid stat_id", w, err)
 		return
 	}
-	if err := DB.QueryRow(`SELECT s.short_id, s.type, u.username, s.value_type, s.is_calculated FROM stats s LEFT JOIN users u on s.assigned_user_id = u.id WHERE s.id = ? LIMIT 1`, id).Scan(&nameLower, &statType, &userName, &valueType, &isCalculated); err != nil {
+	if err := DB.QueryRow(`SELECT s.short_id, s.type, u.username, s.value_type, s.is_calculated FROM stats s LEFT JOIN users u on s.assigned_user_id = u.id WHERE s.id = ? AND s.deleted_at IS NULL LIMIT 1`, id).Scan(&nameLower, &statType, &userName, &valueType, &isCalculated); err != nil {
 		if err == sql.ErrNoRows {
 			webFail("Stat not found", w, err)
 			return
@@ -224,48 +288,56 @@ func handleGetDailyStats(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat", w, err)
 		return
 	}
+	if refuseArchived(w, r, id) {
+		return
+	}
 	nameLower = strings.ToLower(nameLower)
 
-	we, _ := time.Parse("2006-01-02", thisWeek)
-	dates := map[string]string{
-		"Thursday":  we.Format("2006-01-02"),
-		"Friday":    we.AddDate(0, 0, 1).Format("2006-01-02"),
-		"Monday":    we.AddDate(0, 0, 4).Format("2006-01-02"),
-		"Tuesday":   we.AddDate(0, 0, 5).Format("2006-01-02"),
-		"Wednesday": we.AddDate(0, 0, 6).Format("2006-01-02"),
-	}
+	dates := weekGridDates(thisWeek)
+	places, currency := statDecimalPlaces(id), statCurrency(id)
 
 	if isCalculated {
 		calculatedFrom := getCalculatedFrom(id)
-		var rowDaily = DailyStat{Name: strings.ToUpper(nameLower), Quota: ""}
+		op, err := calcOperator(DB, id)
+		if err != nil {
+			webFail("Failed to query stat", w, err)
+			return
+		}
+		var rowDaily = DailyStat{Name: strings.ToUpper(nameLower), Quota: loadQuotaString(id, thisWeek, valueType)}
 		for day, dateStr := range dates {
 			var total float64
-			for _, depID := range calculatedFrom {
-				var depValue sql.NullInt64
-				err := DB.QueryRow(`SELECT value FROM daily_stats WHERE stat_id=? AND date=? LIMIT 1`, depID, dateStr).Scan(&depValue)
-				if err != nil && err != sql.ErrNoRows {
+			values := make([]*int64, len(calculatedFrom))
+			for i, dep := range calculatedFrom {
+				var depValue int64
+				err := DB.QueryRow(`SELECT value FROM daily_stats WHERE stat_id=? AND date=? LIMIT 1`, dep.StatID, dateStr).Scan(&depValue)
+				if err == nil {
+					values[i] = &depValue
+				} else if err != sql.ErrNoRows {
 					webFail("Failed to query dependent stat", w, err)
 					return
 				}
-				if depValue.Valid {
-					switch valueType {
-					case "currency":
-						total += float64(depValue.Int64) / 100.0
-					case "number":
-						total += float64(depValue.Int64)
-					case "percentage":
-						total += float64(depValue.Int64) / 100.0
-					}
-				}
 			}
-			formatted := ""
+			// A day without inputs, or a ratio over a zero denominator, is left blank.
+			value, ok := evalCalc(op, calculatedFrom, values, valueType, currency)
 			switch valueType {
-			case "currency":
-				formatted = ToUSD(total).String()
+			case "percentage":
+				total = float64(value) / 100.0
 			case "number":
+				total = float64(value)
+			}
+			formatted := ""
+			switch {
+			case !ok:
+			case valueType == "currency":
+				formatted = formatStatValue(value, valueType, currency)
+			case valueType == "number":
 				formatted = fmt.Sprintf("%.0f", total)
-			case "percentage":
+			case valueType == "percentage":
 				formatted = fmt.Sprintf("%.2f", total)
+			case valueType == "decimal", valueType == "ratio":
+				formatted = formatDecimal(value, places)
+			case valueType == "duration":
+				formatted = formatDuration(value)
 			}
 			switch day {
 			case "Thursday":
@@ -288,12 +360,18 @@ func handleGetDailyStats(w http.ResponseWriter, r *http.Request) {
 	// Original logic for non-calculated stats (unchanged)
 	var rowDaily = DailyStat{
 		Name:  strings.ToUpper(nameLower),
-		Quota: "",
+		Quota: loadQuotaString(id, thisWeek, valueType),
+	}
+
+	rowDaily.Version, err = dailyWeekVersion(DB, id, []string{dates["Thursday"], dates["Friday"], dates["Monday"], dates["Tuesday"], dates["Wednesday"]})
+	if err != nil {
+		webFail("Failed to read daily row versions", w, err)
+		return
 	}
 
 	for day, dateStr := range dates {
-		var v sql.NullInt64
-		err = DB.QueryRow(`SELECT value FROM daily_stats WHERE stat_id=? AND date=? LIMIT 1`, statIDStr, dateStr).Scan(&v)
+		var v, num, den sql.NullInt64
+		err = DB.QueryRow(`SELECT value, numerator, denominator FROM daily_stats WHERE stat_id=? AND date=? LIMIT 1`, statIDStr, dateStr).Scan(&v, &num, &den)
 		if err != nil && err != sql.ErrNoRows {
 			webFail("Failed to query daily_stats", w, err)
 			return
@@ -303,9 +381,28 @@ func handleGetDailyStats(w http.ResponseWriter, r *http.Request) {
 		}
 
 		switch valueType {
+		case "decimal", "ratio", "duration":
+			formatted := formatDecimal(v.Int64, places)
+			switch valueType {
+			case "ratio":
+				formatted = formatRatio(v.Int64, num, den)
+			case "duration":
+				formatted = formatDuration(v.Int64)
+			}
+			switch day {
+			case "Thursday":
+				rowDaily.Thursday = formatted
+			case "Friday":
+				rowDaily.Friday = formatted
+			case "Monday":
+				rowDaily.Monday = formatted
+			case "Tuesday":
+				rowDaily.Tuesday = formatted
+			case "Wednesday":
+				rowDaily.Wednesday = formatted
+			}
 		case "currency":
-			usd := USD(v.Int64)
-			formatted := usd.String()
+			formatted := formatStatValue(v.Int64, valueType, currency)
 			switch day {
 			case "Thursday":
 				rowDaily.Thursday = formatted
@@ -356,14 +453,13 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		webFail("thisWeek query param required", w, errors.New("missing thisWeek"))
 		return
 	}
-	if err := checkIfValidWE(thisWeek); err != nil {
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), thisWeek); err != nil {
 		webFail("Invalid W/E date", w, err)
 		return
 	}
 
 	var rawRows []map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&rawRows); err != nil {
-		webFail("Failed to decode body", w, err)
+	if !decodeJSONBody(w, r, &rawRows) || tooManyRows(w, len(rawRows)) {
 		return
 	}
 
@@ -376,6 +472,8 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		Tuesday   string
 		Wednesday string
 		Quota     string
+		Version   string // concurrency token from getDailyStats; empty skips the check
+		Reason    string // required to change logged days when the company locks values
 	}
 	rows := make([]Row, 0, len(rawRows))
 
@@ -383,7 +481,7 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		rw := Row{}
 		v, ok := rr["StatID"]
 		if !ok || v == nil {
-			webFail(fmt.Sprintf("Missing StatID in payload row %d", idx), w, errors.New("StatID required"))
+			writeInvalidRow(w, idx, "Missing StatID in payload row %d", idx)
 			return
 		}
 		switch vv := v.(type) {
@@ -394,12 +492,12 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		case string:
 			id, err := strconv.Atoi(vv)
 			if err != nil {
-				webFail(fmt.Sprintf("Invalid StatID value in row %d", idx), w, err)
+				writeInvalidRow(w, idx, "Invalid StatID value in row %d", idx)
 				return
 			}
 			rw.StatID = id
 		default:
-			webFail(fmt.Sprintf("Invalid StatID type in row %d", idx), w, errors.New("invalid StatID"))
+			writeInvalidRow(w, idx, "Invalid StatID type in row %d", idx)
 			return
 		}
 		if n, ok := rr["Name"].(string); ok {
@@ -423,16 +521,31 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		if qv, ok := rr["Quota"].(string); ok {
 			rw.Quota = qv
 		}
+		if vv, ok := rr["Version"].(string); ok {
+			rw.Version = vv
+		}
+		if rv, ok := rr["Reason"].(string); ok {
+			rw.Reason = rv
+		}
 		rows = append(rows, rw)
 	}
 
-	for _, v := range rows {
+	// Normalize locale-formatted input ("1.234,56") to canonical decimals before validation.
+	locale := requestLocale(r)
+	for i := range rows {
+		places := statInputPlaces(rows[i].StatID)
+		for _, f := range []*string{&rows[i].Thursday, &rows[i].Friday, &rows[i].Monday, &rows[i].Tuesday, &rows[i].Wednesday, &rows[i].Quota} {
+			*f = normalizeNumber(*f, locale, places)
+		}
+	}
+
+	for idx, v := range rows {
 		var shortID, valueType, statType string
 		var isCalculated bool
-		err := DB.QueryRow(`SELECT short_id, value_type, type, is_calculated FROM stats WHERE id = ? LIMIT 1`, v.StatID).Scan(&shortID, &valueType, &statType, &isCalculated)
+		err := DB.QueryRow(`SELECT short_id, value_type, type, is_calculated FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, v.StatID).Scan(&shortID, &valueType, &statType, &isCalculated)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				webFail(fmt.Sprintf("Stat not found for StatID %d", v.StatID), w, err)
+				writeInvalidRow(w, idx, "Stat not found for StatID %d", v.StatID)
 				return
 			}
 			webFail("Failed to query stat metadata", w, err)
@@ -440,7 +553,10 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if isCalculated {
-			webFail(fmt.Sprintf("Cannot save calculated stat %s (id=%d)", shortID, v.StatID), w, errors.New("calculated stat"))
+			writeInvalidRow(w, idx, "Cannot save calculated stat %s (id=%d)", shortID, v.StatID)
+			return
+		}
+		if refuseArchivedWrite(w, v.StatID) {
 			return
 		}
 
@@ -455,7 +571,7 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err := validateDailyStatByType(shortID, valueType, ds); err != nil {
-			webFail("Validation failed for daily stat", w, err)
+			writeInvalidRow(w, idx, "Validation failed for daily stat: %v", err)
 			return
 		}
 	}
@@ -466,21 +582,16 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	we, _ := time.Parse("2006-01-02", thisWeek)
-	dates := map[string]string{
-		"Thursday":  we.Format("2006-01-02"),
-		"Friday":    we.AddDate(0, 0, 1).Format("2006-01-02"),
-		"Monday":    we.AddDate(0, 0, 4).Format("2006-01-02"),
-		"Tuesday":   we.AddDate(0, 0, 5).Format("2006-01-02"),
-		"Wednesday": we.AddDate(0, 0, 6).Format("2006-01-02"),
-	}
+	dates := weekGridDates(thisWeek)
+	weekDates := []string{dates["Thursday"], dates["Friday"], dates["Monday"], dates["Tuesday"], dates["Wednesday"]}
+	now := time.Now().UTC().Format(time.RFC3339)
 
-	for _, row := range rows {
-		var shortID string
-		if err := DB.QueryRow(`SELECT short_id FROM stats WHERE id = ? LIMIT 1`, row.StatID).Scan(&shortID); err != nil {
+	for idx, row := range rows {
+		var shortID, valueType string
+		if err := DB.QueryRow(`SELECT short_id, value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, row.StatID).Scan(&shortID, &valueType); err != nil {
 			if err == sql.ErrNoRows {
 				tx.Rollback()
-				webFail(fmt.Sprintf("Stat not found for StatID %d", row.StatID), w, err)
+				writeInvalidRow(w, idx, "Stat not found for StatID %d", row.StatID)
 				return
 			}
 			tx.Rollback()
@@ -488,10 +599,20 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if _, err := tx.Exec(`DELETE FROM daily_stats WHERE stat_id=? AND date IN (?,?,?,?,?)`, row.StatID, dates["Thursday"], dates["Friday"], dates["Monday"], dates["Tuesday"], dates["Wednesday"]); err != nil {
-			tx.Rollback()
-			webFail("Failed to clear existing daily rows", w, err)
-			return
+		currency := statCurrency(row.StatID)
+		if row.Version != "" {
+			current, err := dailyWeekVersion(tx, row.StatID, weekDates)
+			if err != nil {
+				tx.Rollback()
+				webFail("Failed to read daily row versions", w, err)
+				return
+			}
+			if current != row.Version {
+				tx.Rollback()
+				writeConflict(w, fmt.Sprintf("%s was changed by someone else since you loaded it; reload and re-enter your changes", shortID),
+					map[string]interface{}{"stat_id": row.StatID, "Version": current})
+				return
+			}
 		}
 
 		dayValues := map[string]string{
@@ -501,61 +622,224 @@ func handleSave7R(w http.ResponseWriter, r *http.Request) {
 			"Tuesday":   row.Tuesday,
 			"Wednesday": row.Wednesday,
 		}
+
+		// Changing or clearing a logged day needs a reason when the company locks values.
+		existing := map[string]int64{}
+		existingRows, err := tx.Query(`SELECT date, value FROM daily_stats WHERE stat_id=? AND date IN (?,?,?,?,?)`, row.StatID, dates["Thursday"], dates["Friday"], dates["Monday"], dates["Tuesday"], dates["Wednesday"])
+		if err != nil {
+			tx.Rollback()
+			webFail("Failed to read existing daily rows", w, err)
+			return
+		}
+		for existingRows.Next() {
+			var date string
+			var value int64
+			if err := existingRows.Scan(&date, &value); err != nil {
+				existingRows.Close()
+				tx.Rollback()
+				webFail("Failed to read existing daily rows", w, err)
+				return
+			}
+			existing[date] = value
+		}
+		existingRows.Close()
+		replaced := len(existing)
+		changed := false
+		for day, raw := range dayValues {
+			old, ok := existing[dates[day]]
+			if !ok {
+				continue
+			}
+			v, err := parseStatValue(strings.TrimSpace(raw), valueType, currency)
+			if strings.TrimSpace(raw) == "" || err != nil || v != old {
+				changed = true
+			}
+		}
+		if changed {
+			if err := checkEditReason(tx, row.StatID, row.Reason); err != nil {
+				tx.Rollback()
+				writeRuleViolation(w, err)
+				return
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM daily_stats WHERE stat_id=? AND date IN (?,?,?,?,?)`, row.StatID, dates["Thursday"], dates["Friday"], dates["Monday"], dates["Tuesday"], dates["Wednesday"]); err != nil {
+			tx.Rollback()
+			webFail("Failed to clear existing daily rows", w, err)
+			return
+		}
+
 		for day, raw := range dayValues {
 			raw = strings.TrimSpace(raw)
 			if raw == "" {
 				continue
 			}
-			valueInt := 0
-			if m, err := StringToMoney(raw); err == nil {
-				valueInt = int(m.MoneyToUSD())
-			} else {
-				if i, err := strconv.Atoi(raw); err == nil {
-					valueInt = i
-				} else {
-					tx.Rollback()
-					webFail(fmt.Sprintf("Invalid numeric value for stat %d on %s: %s", row.StatID, day, raw), w, errors.New("invalid numeric"))
-					return
-				}
+			valueInt, err := parseStatValue(raw, valueType, currency)
+			if err != nil {
+				tx.Rollback()
+				writeInvalidRow(w, idx, "Invalid numeric value for stat %d on %s: %s", row.StatID, day, raw)
+				return
+			}
+			if err := checkDailyRules(tx, row.StatID, valueInt, valueType); err != nil {
+				tx.Rollback()
+				writeRuleViolation(w, err)
+				return
 			}
 			dateStr := dates[day]
-			if _, err := tx.Exec(`INSERT INTO daily_stats (stat_id, date, value) VALUES (?, ?, ?)`, row.StatID, dateStr, valueInt); err != nil {
+			num, den := ratioParts(raw, valueType)
+			if _, err := tx.Exec(`INSERT INTO daily_stats (stat_id, date, value, numerator, denominator, author_user_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`, row.StatID, dateStr, valueInt, num, den, r.Context().Value("user_id"), now); err != nil {
 				tx.Rollback()
 				webFail("Failed to insert daily row", w, err)
 				return
 			}
 		}
+
+		// Persist the week's quota so attainment can be computed later.
+		var oldQuota sql.NullInt64
+		if err := tx.QueryRow(`SELECT value FROM stat_quotas WHERE stat_id = ? AND week_ending = ?`, row.StatID, thisWeek).Scan(&oldQuota); err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			webFail("Failed to read quota", w, err)
+			return
+		}
+		if err := saveQuota(tx, row.StatID, thisWeek, row.Quota, r.Context().Value("user_id")); err != nil {
+			tx.Rollback()
+			webFail(fmt.Sprintf("Failed to save quota for stat %d", row.StatID), w, err)
+			return
+		}
+
+		oldQuotaStr := ""
+		if oldQuota.Valid {
+			oldQuotaStr = formatStatValue(oldQuota.Int64, valueType, currency)
+		}
+		newQuotaStr := ""
+		if q, err := parseStatValue(row.Quota, valueType, currency); err == nil && strings.TrimSpace(row.Quota) != "" {
+			newQuotaStr = formatStatValue(q, valueType, currency)
+		}
+		if oldQuotaStr != newQuotaStr {
+			if err := logActivity(tx, r.Context().Value("user_id"), activityQuotaChanged, row.StatID, thisWeek, map[string]string{"old": oldQuotaStr, "new": newQuotaStr}); err != nil {
+				tx.Rollback()
+				webFail("Failed to log quota change", w, err)
+				return
+			}
+		}
+		detail := map[string]interface{}{
+			"values":   dayValues,
+			"replaced": replaced,
+		}
+		if reason := strings.TrimSpace(row.Reason); changed && reason != "" {
+			detail["reason"] = reason
+		}
+		if err := logActivity(tx, r.Context().Value("user_id"), activityDailySaved, row.StatID, thisWeek, detail); err != nil {
+			tx.Rollback()
+			webFail("Failed to log daily values", w, err)
+			return
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		webFail("Failed to commit daily rows", w, err)
 		return
 	}
+	versions := map[int]string{}
+	for _, row := range rows {
+		publishStatEvent(liveEvent{Type: eventStatWritten, StatID: row.StatID, WeekEnding: thisWeek})
+		// The grid also saves quotas, which feed the quota counts.
+		if err := markAggregatesDirty(DB, row.StatID, thisWeek); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", row.StatID, err)
+		}
+		if v, err := dailyWeekVersion(DB, row.StatID, weekDates); err == nil {
+			versions[row.StatID] = v
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"message":"Saved 7R grid"}`)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Saved 7R grid", "versions": versions})
 }
 
 func main() {
+	restore := flag.String("restore-backup", "", "restore the database from an offsite backup (\"latest\" or an object key) and exit")
+	exportCompany := flag.String("export-company", "", "write the company with this code to its own database file under STATHQ_SHARD_DIR and exit")
+	importCompany := flag.String("import-company", "", "load a company archive (an exported company database) as a new company and exit; -company renames it")
+	createInviteLabel := flag.String("create-invite", "", "create a single-use registration invite code with this label, print it and exit")
+	legacyCSV := flag.String("migrate-legacy-csv", "", "load legacy weekly CSV files (a file or a directory of .csv) into -company and exit")
+	legacyCompany := flag.String("company", "", "company code for -migrate-legacy-csv, or the new code for -import-company")
+	dryRun := flag.Bool("dry-run", false, "with -migrate-legacy-csv, print the report without writing anything")
+	serveCompany := flag.String("serve-company", "", "serve only this company's database file under STATHQ_SHARD_DIR (started by the sharded router)")
+	flag.Parse()
+
+	if *restore != "" {
+		if err := RestoreBackup(*restore, dbFile); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
+	}
+
+	if *exportCompany != "" {
+		InitDB()
+		if err := exportCompanyShardByCode(*exportCompany); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+
+	if *importCompany != "" {
+		InitDB()
+		if err := importCompanyFromCLI(*importCompany, *legacyCompany); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		return
+	}
+
+	if *legacyCSV != "" {
+		if *legacyCompany == "" {
+			log.Fatalf("-migrate-legacy-csv requires -company")
+		}
+		InitDB()
+		if err := migrateLegacyCSV(*legacyCSV, *legacyCompany, *dryRun, os.Stdout); err != nil {
+			log.Fatalf("Legacy CSV migration failed: %v", err)
+		}
+		return
+	}
+
+	if *createInviteLabel != "" {
+		InitDB()
+		if err := createInviteFromCLI(*createInviteLabel); err != nil {
+			log.Fatalf("Creating invite failed: %v", err)
+		}
+		return
+	}
+
 	f := CreateLog()
 	defer f.Close()
 
-	InitDB()
-
-	store = sessions.NewCookieStore([]byte("super-secret-key"))
-	store.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600 * 8,
-		HttpOnly: true,
-		Secure:   false,
+	if *serveCompany != "" {
+		serveCompanyShard(*serveCompany)
+	} else if shardedMode() {
+		log.Fatal(runShardRouter(":9090"))
 	}
 
+	PrepareLitestream()
+	InitDB()
+	StartLitestream()
+	StartBackupJob()
+	StartMQTTBridge()
+	StartTelegramBot()
+	StartStatsDExporter()
+	StartTrialCleanupJob()
+	StartRecalcWorker()
+	StartAggregateJob()
+	StartAPIUsageJob()
+	StartMaintenanceJob()
+	StartWeekRolloverJob()
+	StartTrashPurgeJob()
+
+	store = newSessionStore()
+
 	router := mux.NewRouter()
 
 	corsMiddleware := handlers.CORS(
 		handlers.AllowedOrigins([]string{"https://stat-hq.com", "http://localhost:3000"}),  // Add production domain
-		handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
 		handlers.AllowCredentials(),
 	)
 
@@ -566,11 +850,14 @@ func main() {
 	router.Handle("/services/save7R", AuthMiddleware("", http.HandlerFunc(handleSave7R)))
 	router.Handle("/services/saveWeeklyEdit", AuthMiddleware("", http.HandlerFunc(handleSaveWeeklyEdit)))
 	router.Handle("/services/logWeeklyStats", AuthMiddleware("", http.HandlerFunc(handleLogWeeklyStats)))
+	router.Handle("/api/quick-entry", AuthMiddleware("", http.HandlerFunc(QuickEntryHandler))).Methods("POST")
 
-	// Admin-only endpoints
-	router.Handle("/api/divisions/{id}", AuthMiddleware("admin", http.HandlerFunc(DeleteDivisionHandler))).Methods("DELETE")
-	router.Handle("/api/divisions/{id}", AuthMiddleware("admin", http.HandlerFunc(UpdateDivisionHandler))).Methods("PATCH")
+	// Endpoints needing a permission beyond signing in (see permissions.go)
+	router.Handle("/api/divisions/{id}", AuthMiddleware(permManageDivisions, http.HandlerFunc(DeleteDivisionHandler))).Methods("DELETE")
+	router.Handle("/api/divisions/{id}", AuthMiddleware(permManageDivisions, http.HandlerFunc(UpdateDivisionHandler))).Methods("PATCH")
 	router.Handle("/api/divisions", AuthMiddleware("", http.HandlerFunc(ListDivisionsHandler))).Methods("GET")
+	router.Handle("/api/divisions/{id}/managers", AuthMiddleware(permManageDivisions, http.HandlerFunc(SetDivisionManagersHandler))).Methods("PUT")
+	router.Handle("/api/manage/overview", AuthMiddleware("", http.HandlerFunc(ManagerOverviewHandler))).Methods("GET")
 	router.Handle("/api/users", AuthMiddleware("", http.HandlerFunc(ListUsersHandler))).Methods("GET")
 	router.Handle("/api/stats/{id}/series", AuthMiddleware("", http.HandlerFunc(GetStatSeriesHandler))).Methods("GET")
 	router.Handle("/api/stats/view/all", AuthMiddleware("", http.HandlerFunc(ListAllStatsHandler))).Methods("GET")
@@ -578,50 +865,247 @@ func main() {
 	router.Handle("/api/public/stats/{id}/series", AuthMiddleware("", http.HandlerFunc(PublicGetStatSeriesHandler))).Methods("GET")
 	router.Handle("/api/public/stats/view/all", AuthMiddleware("", http.HandlerFunc(PublicListAllStatsHandler))).Methods("GET")
 
-	router.Handle("/users", AuthMiddleware("admin", http.HandlerFunc(UserHandler)))
-	router.Handle("/api/users", AuthMiddleware("admin", http.HandlerFunc(ListUsersHandler)))
-	router.Handle("/api/users/reset-password", AuthMiddleware("admin", http.HandlerFunc(ResetPasswordHandler)))
-	router.Handle("/api/users/{id}", AuthMiddleware("admin", http.HandlerFunc(DeleteUserHandler)))
-	router.Handle("/api/users/{id}/role", AuthMiddleware("admin", http.HandlerFunc(UpdateUserRoleHandler)))
-	router.Handle("/api/stats", AuthMiddleware("admin", http.HandlerFunc(CreateStatHandler))).Methods("POST")
-	router.Handle("/api/stats/{id}", AuthMiddleware("admin", http.HandlerFunc(UpdateStatHandler))).Methods("PATCH")
-	router.Handle("/api/stats/{id}", AuthMiddleware("admin", http.HandlerFunc(DeleteStatHandler))).Methods("DELETE")
-	router.Handle("/api/stats/all", AuthMiddleware("admin", http.HandlerFunc(ListAllStatsHandler))).Methods("GET")
+	router.Handle("/users", AuthMiddleware(permManageUsers, http.HandlerFunc(UserHandler)))
+	router.Handle("/api/users", AuthMiddleware(permManageUsers, http.HandlerFunc(ListUsersHandler)))
+	router.Handle("/api/users/reset-password", AuthMiddleware(permManageUsers, http.HandlerFunc(ResetPasswordHandler)))
+	router.Handle("/api/users/{id}", AuthMiddleware(permManageUsers, http.HandlerFunc(DeleteUserHandler)))
+	router.Handle("/api/users/{id}/role", AuthMiddleware(permManageUsers, http.HandlerFunc(UpdateUserRoleHandler)))
+	router.Handle("/api/users/{id}/sessions", AuthMiddleware(permManageUsers, http.HandlerFunc(RevokeUserSessionsHandler))).Methods("DELETE")
+	router.Handle("/api/users/{id}/deactivate", AuthMiddleware(permManageUsers, http.HandlerFunc(DeactivateUserHandler))).Methods("POST")
+	router.Handle("/api/users/{id}/reactivate", AuthMiddleware(permManageUsers, http.HandlerFunc(ReactivateUserHandler))).Methods("POST")
+	router.Handle("/api/users/{id}/unlock", AuthMiddleware(permManageUsers, http.HandlerFunc(UnlockUserHandler))).Methods("POST")
+	router.Handle("/api/users/{id}/welcome", AuthMiddleware(permManageUsers, http.HandlerFunc(ResendWelcomeHandler))).Methods("POST")
+	router.Handle("/api/admin/sessions", AuthMiddleware(permManageUsers, http.HandlerFunc(ListSessionsHandler))).Methods("GET")
+	router.Handle("/api/admin/sessions/{id}", AuthMiddleware(permManageUsers, http.HandlerFunc(RevokeSessionHandler))).Methods("DELETE")
+	router.Handle("/api/users/{id}/reassign", AuthMiddleware(permManageUsers, http.HandlerFunc(ReassignUserStatsHandler))).Methods("POST")
+	router.Handle("/api/users/{id}/transfer", AuthMiddleware(permManageUsers, http.HandlerFunc(TransferUserStatsHandler))).Methods("POST")
+	router.Handle("/api/users/{id}/export", AuthMiddleware(permManageUsers, http.HandlerFunc(ExportUserDataHandler))).Methods("GET")
+	router.Handle("/api/users/{id}/anonymize", AuthMiddleware(permManageUsers, http.HandlerFunc(AnonymizeUserHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/assignment-history", AuthMiddleware("", http.HandlerFunc(StatAssignmentHistoryHandler))).Methods("GET")
+	router.Handle("/api/stats/conditions", AuthMiddleware(permAllStats, http.HandlerFunc(StatConditionsHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/attainment", AuthMiddleware("", http.HandlerFunc(StatAttainmentHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/history", AuthMiddleware(permAllStats, http.HandlerFunc(StatValueHistoryHandler))).Methods("GET")
+	router.Handle("/api/users/{id}/summary", AuthMiddleware("", http.HandlerFunc(UserSummaryHandler))).Methods("GET")
+	router.Handle("/api/events", AuthMiddleware("", http.HandlerFunc(EventsHandler))).Methods("GET")
+	router.Handle("/ws", AuthMiddleware("", http.HandlerFunc(WebSocketHandler))).Methods("GET")
+	router.Handle("/api/changes", AuthMiddleware("", http.HandlerFunc(ChangesHandler))).Methods("GET")
+	router.Handle("/api/presence", AuthMiddleware("", http.HandlerFunc(ListPresenceHandler))).Methods("GET")
+	router.Handle("/api/presence", AuthMiddleware("", http.HandlerFunc(PresenceHeartbeatHandler))).Methods("POST")
+	router.Handle("/api/presence", AuthMiddleware("", http.HandlerFunc(PresenceLeaveHandler))).Methods("DELETE")
+	router.Handle("/api/targets", AuthMiddleware("", http.HandlerFunc(ListTargetsHandler))).Methods("GET")
+	router.Handle("/api/targets", AuthMiddleware("", http.HandlerFunc(CreateTargetHandler))).Methods("POST")
+	router.Handle("/api/targets/rollup", AuthMiddleware("", http.HandlerFunc(TargetRollupHandler))).Methods("GET")
+	router.Handle("/api/targets/{id}", AuthMiddleware("", http.HandlerFunc(UpdateTargetHandler))).Methods("PUT")
+	router.Handle("/api/targets/{id}", AuthMiddleware("", http.HandlerFunc(DeleteTargetHandler))).Methods("DELETE")
+	router.Handle("/api/graph-events", AuthMiddleware("", http.HandlerFunc(ListGraphEventsHandler))).Methods("GET")
+	router.Handle("/api/graph-events", AuthMiddleware(permManageStats, http.HandlerFunc(CreateGraphEventHandler))).Methods("POST")
+	router.Handle("/api/graph-events/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(UpdateGraphEventHandler))).Methods("PUT")
+	router.Handle("/api/graph-events/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(DeleteGraphEventHandler))).Methods("DELETE")
+	router.Handle("/api/stats/{id}/graph-events", AuthMiddleware("", http.HandlerFunc(StatGraphEventsHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/dependencies", AuthMiddleware("", http.HandlerFunc(StatDependenciesHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/recalculate", AuthMiddleware(permManageStats, http.HandlerFunc(RecalculateStatHandler))).Methods("POST")
+	router.Handle("/api/stats/recalculate", AuthMiddleware(permManageStats, http.HandlerFunc(RecalculateAllStatsHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/recalculate/preview", AuthMiddleware(permManageStats, http.HandlerFunc(PreviewRecalculateHandler))).Methods("GET")
+	router.Handle("/api/recalc/status", AuthMiddleware("", http.HandlerFunc(RecalcStatusHandler))).Methods("GET")
+	router.Handle("/api/dashboard/divisions", AuthMiddleware("", http.HandlerFunc(DivisionAggregatesHandler))).Methods("GET")
+	router.Handle("/api/reports/oic.pdf", AuthMiddleware("", http.HandlerFunc(OICReportHandler))).Methods("GET")
+	router.Handle("/api/reports/data-quality", AuthMiddleware(permAllStats, http.HandlerFunc(DataQualityHandler))).Methods("GET")
+	router.Handle("/api/whatif", AuthMiddleware("", http.HandlerFunc(WhatIfHandler))).Methods("POST")
+	router.Handle("/api/explanations/outstanding", AuthMiddleware("", http.HandlerFunc(OutstandingExplanationsHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/explanations", AuthMiddleware("", http.HandlerFunc(SubmitExplanationHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/explanations", AuthMiddleware("", http.HandlerFunc(ListExplanationsHandler))).Methods("GET")
+	router.Handle("/api/weeks/complete", AuthMiddleware("", http.HandlerFunc(CompleteWeekHandler))).Methods("POST")
+
+	// Condition formula checklists
+	router.Handle("/api/conditions/formulas", AuthMiddleware("", http.HandlerFunc(ConditionFormulasHandler))).Methods("GET")
+	router.Handle("/api/conditions", AuthMiddleware("", http.HandlerFunc(ListConditionsHandler))).Methods("GET")
+	router.Handle("/api/conditions/steps/{id}", AuthMiddleware("", http.HandlerFunc(UpdateConditionStepHandler))).Methods("PATCH")
+	router.Handle("/api/stats/{id}/conditions", AuthMiddleware(permManageStats, http.HandlerFunc(AssignConditionHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/categories", AuthMiddleware(permManageStats, http.HandlerFunc(SetStatCategoriesHandler))).Methods("PUT")
+	router.Handle("/api/stats/{id}/breakdown", AuthMiddleware("", http.HandlerFunc(GetStatBreakdownHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/breakdown", AuthMiddleware("", http.HandlerFunc(SaveStatBreakdownHandler))).Methods("PUT")
+	router.Handle("/api/stats/{id}/adjustments", AuthMiddleware("", http.HandlerFunc(CreateAdjustmentHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/adjustments", AuthMiddleware("", http.HandlerFunc(ListAdjustmentsHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/rules", AuthMiddleware("", http.HandlerFunc(GetStatRulesHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/rules", AuthMiddleware(permManageStats, http.HandlerFunc(UpdateStatRulesHandler))).Methods("PUT")
+	router.Handle("/api/stats", AuthMiddleware(permManageStats, http.HandlerFunc(CreateStatHandler))).Methods("POST")
+	router.Handle("/api/stats/profit", AuthMiddleware(permManageStats, http.HandlerFunc(CreateProfitStatHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(UpdateStatHandler))).Methods("PATCH")
+	router.Handle("/api/stats/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(DeleteStatHandler))).Methods("DELETE")
+	router.Handle("/api/stats/{id}/archive", AuthMiddleware(permManageStats, http.HandlerFunc(ArchiveStatHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/unarchive", AuthMiddleware(permManageStats, http.HandlerFunc(UnarchiveStatHandler))).Methods("POST")
+	router.Handle("/api/stats/trash", AuthMiddleware(permManageStats, http.HandlerFunc(ListTrashHandler))).Methods("GET")
+	router.Handle("/api/stats/{id}/restore", AuthMiddleware(permManageStats, http.HandlerFunc(RestoreStatHandler))).Methods("POST")
+	router.Handle("/api/stats/all", AuthMiddleware(permAllStats, http.HandlerFunc(ListAllStatsHandler))).Methods("GET")
 	// NEW: assigned stats endpoint for non-admin users
 	router.Handle("/api/stats/assigned", AuthMiddleware("", http.HandlerFunc(ListAssignedStatsHandler))).Methods("GET")
 	// Add after your other API routes:)
 
-	router.Handle("/api/divisions", AuthMiddleware("admin", http.HandlerFunc(CreateDivisionHandler))).Methods("POST")
+	router.Handle("/api/divisions", AuthMiddleware(permManageDivisions, http.HandlerFunc(CreateDivisionHandler))).Methods("POST")
 	// User info endpoint
 	router.Handle("/api/user", AuthMiddleware("", http.HandlerFunc(UserInfoHandler)))
+	router.Handle("/api/user/logins", AuthMiddleware("", http.HandlerFunc(MyLoginsHandler))).Methods("GET")
+	router.Handle("/api/user/export", AuthMiddleware("", http.HandlerFunc(ExportOwnDataHandler))).Methods("GET")
+	router.Handle("/api/auth/clients", AuthMiddleware("", http.HandlerFunc(ListTokenFamiliesHandler))).Methods("GET")
+	router.Handle("/api/usage", AuthMiddleware(permManageCompany, http.HandlerFunc(APIUsageHandler))).Methods("GET")
+	router.Handle("/api/auth/clients/{id}", AuthMiddleware("", http.HandlerFunc(RevokeTokenFamilyHandler))).Methods("DELETE")
+	router.Handle("/api/user/email", AuthMiddleware("", http.HandlerFunc(EmailStatusHandler))).Methods("GET")
+	router.Handle("/api/user/email", AuthMiddleware("", http.HandlerFunc(UpdateEmailHandler))).Methods("PUT")
+	router.Handle("/api/user/email/resend", AuthMiddleware("", http.HandlerFunc(ResendEmailVerificationHandler))).Methods("POST")
+	router.Handle("/api/user/telegram", AuthMiddleware("", http.HandlerFunc(TelegramStatusHandler))).Methods("GET")
+	router.Handle("/api/user/telegram", AuthMiddleware("", http.HandlerFunc(UnlinkTelegramHandler))).Methods("DELETE")
+	router.Handle("/api/user/telegram/link", AuthMiddleware("", http.HandlerFunc(CreateTelegramLinkHandler))).Methods("POST")
+	router.Handle("/api/user/kiosk-pin", AuthMiddleware("", http.HandlerFunc(SetOwnKioskPinHandler))).Methods("PUT")
+	router.Handle("/api/user/kiosk-pin", AuthMiddleware("", http.HandlerFunc(DeleteOwnKioskPinHandler))).Methods("DELETE")
+	router.Handle("/api/users/{id}/kiosk-pin", AuthMiddleware(permManageUsers, http.HandlerFunc(SetUserKioskPinHandler))).Methods("PUT")
+	router.Handle("/api/kiosks", AuthMiddleware(permManageUsers, http.HandlerFunc(ListKiosksHandler))).Methods("GET")
+	router.Handle("/api/kiosks", AuthMiddleware(permManageUsers, http.HandlerFunc(CreateKioskHandler))).Methods("POST")
+	router.Handle("/api/kiosks/{id}", AuthMiddleware(permManageUsers, http.HandlerFunc(RevokeKioskHandler))).Methods("DELETE")
+	router.Handle("/api/kiosks/{id}/events", AuthMiddleware(permManageUsers, http.HandlerFunc(KioskEventsHandler))).Methods("GET")
+	router.HandleFunc("/kiosk/identify", KioskIdentifyHandler).Methods("POST")
+	router.HandleFunc("/kiosk/entries", KioskEntriesHandler).Methods("POST")
+
+	// Company number input locale
+	router.Handle("/api/company/locale", AuthMiddleware("", http.HandlerFunc(GetCompanyLocaleHandler))).Methods("GET")
+	router.Handle("/api/company/locale", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateCompanyLocaleHandler))).Methods("PUT")
+	router.Handle("/api/company/timezone", AuthMiddleware("", http.HandlerFunc(GetCompanyTimezoneHandler))).Methods("GET")
+	router.Handle("/api/company/timezone", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateCompanyTimezoneHandler))).Methods("PUT")
+	router.Handle("/api/company/fiscal-year", AuthMiddleware("", http.HandlerFunc(GetFiscalYearHandler))).Methods("GET")
+	router.Handle("/api/company/fiscal-year", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateFiscalYearHandler))).Methods("PUT")
+	router.Handle("/api/company/settings", AuthMiddleware("", http.HandlerFunc(GetCompanySettingsHandler))).Methods("GET")
+	router.Handle("/api/company/settings", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateCompanySettingsHandler))).Methods("PATCH")
+	router.Handle("/api/currency-rates", AuthMiddleware("", http.HandlerFunc(ListCurrencyRatesHandler))).Methods("GET")
+	router.Handle("/api/currency-rates/{currency}", AuthMiddleware(permManageCompany, http.HandlerFunc(SetCurrencyRateHandler))).Methods("PUT")
+	router.Handle("/api/currency-rates/{currency}", AuthMiddleware(permManageCompany, http.HandlerFunc(DeleteCurrencyRateHandler))).Methods("DELETE")
+	router.Handle("/api/week/current", AuthMiddleware("", http.HandlerFunc(CurrentWeekHandler))).Methods("GET")
+	router.Handle("/api/weeks", AuthMiddleware(permManageCompany, http.HandlerFunc(ListCompanyWeeksHandler))).Methods("GET")
+	router.Handle("/api/weeks/open", AuthMiddleware(permManageCompany, http.HandlerFunc(OpenWeekHandler))).Methods("POST")
+
+	// Company cloning and onboarding wizard
+	router.Handle("/api/company/clone", AuthMiddleware(permManageCompany, http.HandlerFunc(CloneCompanyHandler))).Methods("POST")
+	router.Handle("/api/onboarding/state", AuthMiddleware(permManageCompany, http.HandlerFunc(GetOnboardingStateHandler))).Methods("GET")
+	router.Handle("/api/onboarding/advance", AuthMiddleware(permManageCompany, http.HandlerFunc(AdvanceOnboardingHandler))).Methods("POST")
+
+	// Company sign-in and access configuration (admin)
+	router.Handle("/api/company/ldap", AuthMiddleware(permManageCompany, http.HandlerFunc(GetLDAPConfigHandler))).Methods("GET")
+	router.Handle("/api/company/session-policy", AuthMiddleware(permManageCompany, http.HandlerFunc(GetSessionPolicyHandler))).Methods("GET")
+	router.Handle("/api/company/session-policy", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateSessionPolicyHandler))).Methods("PUT")
+	router.Handle("/api/company/ldap", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateLDAPConfigHandler))).Methods("PUT")
+	router.Handle("/api/company/sso", AuthMiddleware(permManageCompany, http.HandlerFunc(GetCompanySSOHandler))).Methods("GET")
+	router.Handle("/api/company/sso", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateCompanySSOHandler))).Methods("PUT")
+	router.Handle("/api/company/ip-allowlist", AuthMiddleware(permManageCompany, http.HandlerFunc(GetIPAllowlistHandler))).Methods("GET")
+	router.Handle("/api/company/ip-allowlist", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateIPAllowlistHandler))).Methods("PUT")
+	router.Handle("/api/security/events", AuthMiddleware(permManageCompany, http.HandlerFunc(SecurityEventsHandler))).Methods("GET")
+
+	// Device ingestion (token-authenticated) and its token management (admin)
+	router.HandleFunc("/ingest", IngestHandler).Methods("POST")
+	router.Handle("/api/stats/{id}/ingest-tokens", AuthMiddleware(permManageStats, http.HandlerFunc(CreateIngestTokenHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/ingest-tokens", AuthMiddleware(permManageStats, http.HandlerFunc(ListIngestTokensHandler))).Methods("GET")
+	router.Handle("/api/ingest-tokens/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(RevokeIngestTokenHandler))).Methods("DELETE")
+	router.Handle("/api/stats/{id}/qr-tokens", AuthMiddleware(permManageStats, http.HandlerFunc(CreateQRTokenHandler))).Methods("POST")
+	router.Handle("/api/stats/{id}/qr-tokens", AuthMiddleware(permManageStats, http.HandlerFunc(ListQRTokensHandler))).Methods("GET")
+	router.Handle("/api/qr-tokens/{id}", AuthMiddleware(permManageStats, http.HandlerFunc(RevokeQRTokenHandler))).Methods("DELETE")
+	router.Handle("/api/qr-tokens/{id}/print", AuthMiddleware(permManageStats, http.HandlerFunc(PrintQRTokenHandler))).Methods("GET")
+	router.HandleFunc("/q/{token}", QREntryPageHandler).Methods("GET")
+	router.HandleFunc("/q/{token}", QREntrySubmitHandler).Methods("POST")
+
+	// Accounting imports (admin)
+	router.Handle("/api/import/accounting/mappings", AuthMiddleware(permImportData, http.HandlerFunc(GetAccountingMappingsHandler))).Methods("GET")
+	router.Handle("/api/import/accounting/mappings", AuthMiddleware(permImportData, http.HandlerFunc(UpdateAccountingMappingsHandler))).Methods("PUT")
+	router.Handle("/api/import/accounting", AuthMiddleware(permImportData, http.HandlerFunc(ImportAccountingHandler))).Methods("POST")
+	router.Handle("/api/import/timeclock/mappings", AuthMiddleware(permImportData, http.HandlerFunc(GetTimeclockMappingsHandler))).Methods("GET")
+	router.Handle("/api/import/timeclock/mappings", AuthMiddleware(permImportData, http.HandlerFunc(UpdateTimeclockMappingsHandler))).Methods("PUT")
+	router.Handle("/api/import/timeclock", AuthMiddleware(permImportData, http.HandlerFunc(ImportTimeclockHandler))).Methods("POST")
+	router.Handle("/api/import/ndjson", AuthMiddleware(permImportData, http.HandlerFunc(ImportNDJSONHandler))).Methods("POST")
+	router.Handle("/api/export/weekly-template", AuthMiddleware("", http.HandlerFunc(WeeklyTemplateHandler))).Methods("GET")
+	router.Handle("/api/import/weekly-csv", AuthMiddleware("", http.HandlerFunc(ImportWeeklyCSVHandler))).Methods("POST")
+
+	// Billing
+	router.Handle("/api/billing", AuthMiddleware(permManageBilling, http.HandlerFunc(GetBillingHandler))).Methods("GET")
+	router.Handle("/api/company/usage", AuthMiddleware(permManageBilling, http.HandlerFunc(CompanyUsageHandler))).Methods("GET")
+	router.Handle("/api/billing/portal", AuthMiddleware(permManageBilling, http.HandlerFunc(BillingPortalHandler))).Methods("POST")
+	router.HandleFunc("/api/billing/webhook", StripeWebhookHandler).Methods("POST")
+
+	// Offsite backup status (super-admin: the backups are of the whole instance)
+	router.Handle("/api/admin/backups", AuthMiddleware(permManagePlatform, http.HandlerFunc(BackupStatusHandler))).Methods("GET")
+	router.Handle("/api/admin/invites", AuthMiddleware(permManagePlatform, http.HandlerFunc(ListInvitesHandler))).Methods("GET")
+	router.Handle("/api/admin/invites", AuthMiddleware(permManagePlatform, http.HandlerFunc(CreateInviteHandler))).Methods("POST")
+	router.Handle("/api/admin/invites/{id}", AuthMiddleware(permManagePlatform, http.HandlerFunc(RevokeInviteHandler))).Methods("DELETE")
+	router.Handle("/api/admin/companies", AuthMiddleware(permManagePlatform, http.HandlerFunc(ListAdminCompaniesHandler))).Methods("GET")
+	router.Handle("/api/admin/companies/{id}", AuthMiddleware(permManagePlatform, http.HandlerFunc(DeleteAdminCompanyHandler))).Methods("DELETE")
+	router.Handle("/api/admin/companies/{id}/suspend", AuthMiddleware(permManagePlatform, http.HandlerFunc(SuspendCompanyHandler))).Methods("POST")
+	router.Handle("/api/admin/companies/{id}/suspend", AuthMiddleware(permManagePlatform, http.HandlerFunc(UnsuspendCompanyHandler))).Methods("DELETE")
+	router.Handle("/api/admin/companies/{id}/impersonate", AuthMiddleware(permManagePlatform, http.HandlerFunc(ImpersonateHandler))).Methods("POST")
+	router.Handle("/api/admin/companies/{id}/ip-allowlist", AuthMiddleware(permManagePlatform, http.HandlerFunc(ClearIPAllowlistHandler))).Methods("DELETE")
+	router.Handle("/api/admin/impersonate", AuthMiddleware(permManagePlatform, http.HandlerFunc(EndImpersonationHandler))).Methods("DELETE")
+	router.Handle("/api/admin/company-db", AuthMiddleware(permManageCompany, http.HandlerFunc(CompanyShardDownloadHandler))).Methods("GET")
+	router.Handle("/api/admin/import-company", AuthMiddleware(permManagePlatform, http.HandlerFunc(ImportCompanyHandler))).Methods("POST")
+	router.Handle("/api/company/export", AuthMiddleware(permManageCompany, http.HandlerFunc(CompanyExportHandler))).Methods("GET")
+	router.Handle("/api/company/import", AuthMiddleware(permManageCompany, http.HandlerFunc(CompanyImportHandler))).Methods("POST")
+	router.Handle("/api/admin/replication", AuthMiddleware(permManagePlatform, http.HandlerFunc(ReplicationStatusHandler))).Methods("GET")
+	router.Handle("/api/admin/maintenance", AuthMiddleware(permManagePlatform, http.HandlerFunc(MaintenanceStatusHandler))).Methods("GET")
+	router.Handle("/api/admin/maintenance", AuthMiddleware(permManagePlatform, http.HandlerFunc(RunMaintenanceHandler))).Methods("POST")
+
+	// Orphaned data / integrity check (super-admin: the checks and repairs span every company)
+	router.Handle("/api/admin/integrity-check", AuthMiddleware(permManagePlatform, http.HandlerFunc(IntegrityCheckHandler))).Methods("POST")
 
 	// Change password endpoint (for any authenticated user)
 	router.Handle("/api/change-password", AuthMiddleware("", http.HandlerFunc(ChangePasswordHandler)))
 
+	// Grafana simple-JSON datasource (session or API token)
+	router.Handle("/grafana/", AuthMiddleware(permAllStats, http.HandlerFunc(GrafanaTestHandler))).Methods("GET")
+	router.Handle("/grafana/search", AuthMiddleware(permAllStats, http.HandlerFunc(GrafanaSearchHandler))).Methods("POST")
+	router.Handle("/grafana/query", AuthMiddleware(permAllStats, http.HandlerFunc(GrafanaQueryHandler))).Methods("POST")
+
+	// Business-metric exporter (Prometheus scrape with a per-company token; StatsD push)
+	router.Handle("/api/metrics/exporter", AuthMiddleware(permManageCompany, http.HandlerFunc(GetMetricsExporterHandler))).Methods("GET")
+	router.Handle("/api/metrics/exporter", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateMetricsExporterHandler))).Methods("PUT")
+	router.Handle("/api/metrics/exporter/token", AuthMiddleware(permManageCompany, http.HandlerFunc(RotateMetricsTokenHandler))).Methods("POST")
+	router.Handle("/api/metrics/exporter/token", AuthMiddleware(permManageCompany, http.HandlerFunc(RevokeMetricsTokenHandler))).Methods("DELETE")
+	router.HandleFunc("/metrics/business", BusinessMetricsHandler).Methods("GET")
+
 	// Auth endpoints (unprotected)
 	router.HandleFunc("/login", LoginHandler)
+	router.HandleFunc("/api/auth/token", TokenHandler).Methods("POST")
+	router.HandleFunc("/auth/oidc/start", OIDCStartHandler).Methods("GET")
+	router.HandleFunc("/auth/oidc/callback", OIDCCallbackHandler).Methods("GET")
+	router.HandleFunc("/login/magic", MagicLinkRequestHandler).Methods("POST")
+	router.HandleFunc("/login/magic/confirm", MagicLinkPageHandler).Methods("GET")
+	router.HandleFunc("/login/magic/confirm", MagicLinkConfirmHandler).Methods("POST")
+	router.HandleFunc("/auth/passkey/begin", PasskeyLoginBeginHandler).Methods("POST")
+	router.HandleFunc("/auth/passkey/finish", PasskeyLoginFinishHandler).Methods("POST")
+	router.HandleFunc("/api/auth/revoke", RevokeTokenHandler).Methods("POST")
 	router.HandleFunc("/logout", LogoutHandler)
-	// router.HandleFunc("/register", RegisterHandler)
-
-	// Static file handlers left as-is
-	cssHandler := http.FileServer(http.Dir("public/css"))
-	router.PathPrefix("/public/css/").Handler(http.StripPrefix("/public/css", addHeaders(cssHandler, "text/css", "public/css")))
+	router.HandleFunc("/verify-email", VerifyEmailHandler).Methods("GET")
+	router.HandleFunc("/welcome", WelcomePageHandler).Methods("GET")
+	router.HandleFunc("/welcome", WelcomeSubmitHandler).Methods("POST")
+	router.HandleFunc("/register", RegisterHandler)
+	router.HandleFunc("/api/trial/register", TrialRegisterHandler).Methods("POST")
+	router.HandleFunc("/api/password-policy", PasswordPolicyHandler).Methods("GET")
 
-	jsHandler := http.FileServer(http.Dir("public/js"))
-	router.PathPrefix("/public/js/").Handler(http.StripPrefix("/public/js", addHeaders(jsHandler, "application/javascript", "public/js")))
-
-	semanticHandler := http.FileServer(http.Dir("public/Semantic-UI-2.3.0/dist"))
-	router.PathPrefix("/public/Semantic-UI-2.3.0/dist/").Handler(http.StripPrefix("/public/Semantic-UI-2.3.0/dist", addHeaders(semanticHandler, "", "public/Semantic-UI-2.3.0/dist")))
+	// API tokens for machine clients (admin)
+	router.Handle("/api/tokens", AuthMiddleware(permManageCompany, http.HandlerFunc(ListAPITokensHandler))).Methods("GET")
+	router.Handle("/api/tokens", AuthMiddleware(permManageCompany, http.HandlerFunc(CreateAPITokenHandler))).Methods("POST")
+	router.Handle("/api/tokens/{id}", AuthMiddleware(permManageCompany, http.HandlerFunc(UpdateAPITokenHandler))).Methods("PATCH")
+	router.Handle("/api/tokens/{id}", AuthMiddleware(permManageCompany, http.HandlerFunc(RevokeAPITokenHandler))).Methods("DELETE")
 
-	videoHandler := http.FileServer(http.Dir("public/AV"))
-	router.PathPrefix("/public/AV/").Handler(http.StripPrefix("/public/AV", addHeaders(videoHandler, "video/mp4", "public/AV")))
+	// Two-factor authentication for the signed-in user
+	router.Handle("/api/2fa", AuthMiddleware("", http.HandlerFunc(TwoFactorStatusHandler))).Methods("GET")
+	router.Handle("/api/2fa/setup", AuthMiddleware("", http.HandlerFunc(TwoFactorSetupHandler))).Methods("POST")
+	router.Handle("/api/2fa/verify", AuthMiddleware("", http.HandlerFunc(TwoFactorVerifyHandler))).Methods("POST")
+	router.Handle("/api/2fa/disable", AuthMiddleware("", http.HandlerFunc(TwoFactorDisableHandler))).Methods("POST")
+	router.Handle("/api/user/passkeys", AuthMiddleware("", http.HandlerFunc(ListPasskeysHandler))).Methods("GET")
+	router.Handle("/api/user/passkeys/register/begin", AuthMiddleware("", http.HandlerFunc(PasskeyRegisterBeginHandler))).Methods("POST")
+	router.Handle("/api/user/passkeys/register/finish", AuthMiddleware("", http.HandlerFunc(PasskeyRegisterFinishHandler))).Methods("POST")
+	router.Handle("/api/user/passkeys/{id}", AuthMiddleware("", http.HandlerFunc(DeletePasskeyHandler))).Methods("DELETE")
 
-	publicHandler := http.FileServer(http.Dir("public"))
-	router.PathPrefix("/public/").Handler(http.StripPrefix("/public", addHeaders(publicHandler, "", "public")))
+	registerStaticRoutes(router)
 
-	router.PathPrefix("/").HandlerFunc(handleIndex)
+	http.Handle("/", limitBodies(corsMiddleware(router)))
 
-	http.Handle("/", corsMiddleware(router))
+	if servedCompany != "" {
+		log.Fatal(http.Serve(shardWorkerListener(), nil))
+	}
 
 	port := ":9090"
 	fmt.Printf("Running Stat HQ on %s\n", port)
@@ -645,6 +1129,13 @@ func CreateStatHandler(w http.ResponseWriter, r *http.Request) {
 		DivisionIDs    []int  `json:"division_ids"`
 		IsCalculated   bool   `json:"is_calculated"`
 		CalculatedFrom []int  `json:"calculated_from"`
+		CalculatedMinus []int `json:"calculated_minus"`
+		CalculatedDivideBy []int `json:"calculated_divide_by"`
+		CalcOperator   string `json:"calc_operator"` // sum (default) or average, see derived.go
+		DecimalPlaces  *int   `json:"decimal_places"` // display, see statformat.go
+		UnitLabel      string `json:"unit_label"`
+		ThousandsSeparator *bool `json:"thousands_separator"` // default true
+		Currency       string `json:"currency"` // currency stats, ISO 4217; empty = the company's default, see currency.go
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		webFail("Invalid JSON payload", w, err)
@@ -664,6 +1155,46 @@ func CreateStatHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !validValueType(req.ValueType) {
+		http.Error(w, fmt.Sprintf(`{"message":"value_type must be one of %s"}`, strings.Join(valueTypes, ", ")), http.StatusBadRequest)
+		return
+	}
+	calcOp, msg := checkCalcOperator(req.CalcOperator, req.CalculatedMinus, req.CalculatedDivideBy)
+	if msg == "" {
+		msg = checkDecimalPlaces(req.DecimalPlaces)
+	}
+	req.UnitLabel = strings.TrimSpace(req.UnitLabel)
+	if msg == "" && len(req.UnitLabel) > maxUnitLabel {
+		msg = fmt.Sprintf("unit_label must be at most %d characters", maxUnitLabel)
+	}
+	separator := req.ThousandsSeparator == nil || *req.ThousandsSeparator
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if msg == "" && req.Currency != "" {
+		if req.ValueType != "currency" {
+			msg = "currency only applies to currency stats"
+		} else if !validCurrencyCode(req.Currency) {
+			msg = "currency must be an ISO 4217 code such as USD or EUR"
+		}
+	}
+	if msg != "" {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if ok, msg, err := checkBillingLimit(companyDBID, "stat"); err != nil {
+		webFail("Failed to check plan limits", w, err)
+		return
+	} else if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+		return
+	}
 
 	tx, err := DB.Begin()
 	if err != nil {
@@ -672,10 +1203,11 @@ func CreateStatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	res, err := tx.Exec(`
-		INSERT INTO stats (short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO stats (short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated, calc_operator,
+			decimal_places, unit_label, thousands_separator, currency, company_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, req.ShortID, req.FullName, req.Type, req.ValueType, req.Reversed,
-		nullIntPtr(req.UserIDs), nullIntPtr(req.DivisionIDs), req.IsCalculated)
+		nullIntPtr(req.UserIDs), nullIntPtr(req.DivisionIDs), req.IsCalculated, calcOp, req.DecimalPlaces, nullIfEmpty(req.UnitLabel), separator, nullIfEmpty(req.Currency), companyDBID)
 	if err != nil {
 		tx.Rollback()
 		webFail("Failed to insert stat", w, err)
@@ -689,12 +1221,10 @@ func CreateStatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if req.IsCalculated && len(req.CalculatedFrom) > 0 {
-		for _, depID := range req.CalculatedFrom {
-			if _, err := tx.Exec(`INSERT OR IGNORE INTO stat_calculations (stat_id, dependent_stat_id) VALUES (?, ?)`, statID, depID); err != nil {
-				tx.Rollback()
-				webFail("Failed to insert stat_calculation", w, err)
-				return
-			}
+		if err := insertCalculationTerms(tx, int(statID), req.CalculatedFrom, req.CalculatedMinus, req.CalculatedDivideBy); err != nil {
+			tx.Rollback()
+			webFail("Failed to insert stat_calculation", w, err)
+			return
 		}
 	}
 
@@ -711,10 +1241,28 @@ func CreateStatHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err := logActivity(tx, r.Context().Value("user_id"), activityStatCreated, int(statID), "", map[string]interface{}{
+		"full_name":   req.FullName,
+		"user_id":     nullIntPtr(req.UserIDs),
+		"division_id": nullIntPtr(req.DivisionIDs),
+	}); err != nil {
+		tx.Rollback()
+		webFail("Failed to log stat creation", w, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		webFail("Failed to commit", w, err)
 		return
 	}
+	if req.IsCalculated {
+		if err := enqueueRecalcStat(DB, int(statID), ""); err != nil {
+			log.Printf("Failed to queue recalculation of stat %d: %v", statID, err)
+		}
+	}
+	if err := markStatCompanyAggregatesDirty(int(statID)); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -753,6 +1301,13 @@ func UpdateStatHandler(w http.ResponseWriter, r *http.Request) {
 		DivisionIDs    []int  `json:"division_ids"`
 		IsCalculated   bool   `json:"is_calculated"`
 		CalculatedFrom []int  `json:"calculated_from"`
+		CalculatedMinus []int `json:"calculated_minus"`
+		CalculatedDivideBy []int `json:"calculated_divide_by"`
+		CalcOperator   string `json:"calc_operator"` // sum (default) or average, see derived.go
+		DecimalPlaces  *int   `json:"decimal_places"` // display, see statformat.go
+		UnitLabel      string `json:"unit_label"`
+		ThousandsSeparator *bool `json:"thousands_separator"` // default true
+		Currency       string `json:"currency"` // currency stats, ISO 4217; empty = the company's default, see currency.go
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		webFail("Invalid JSON payload", w, err)
@@ -772,6 +1327,37 @@ func UpdateStatHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !validValueType(req.ValueType) {
+		http.Error(w, fmt.Sprintf(`{"message":"value_type must be one of %s"}`, strings.Join(valueTypes, ", ")), http.StatusBadRequest)
+		return
+	}
+	calcOp, msg := checkCalcOperator(req.CalcOperator, req.CalculatedMinus, req.CalculatedDivideBy)
+	if msg == "" {
+		msg = checkDecimalPlaces(req.DecimalPlaces)
+	}
+	req.UnitLabel = strings.TrimSpace(req.UnitLabel)
+	if msg == "" && len(req.UnitLabel) > maxUnitLabel {
+		msg = fmt.Sprintf("unit_label must be at most %d characters", maxUnitLabel)
+	}
+	separator := req.ThousandsSeparator == nil || *req.ThousandsSeparator
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if msg == "" && req.Currency != "" {
+		if req.ValueType != "currency" {
+			msg = "currency only applies to currency stats"
+		} else if !validCurrencyCode(req.Currency) {
+			msg = "currency must be an ISO 4217 code such as USD or EUR"
+		}
+	}
+	if msg != "" {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+	if req.ValueType == "currency" {
+		if msg := checkStatCurrencyChange(id, req.Currency); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusConflict)
+			return
+		}
+	}
 
 	tx, err := DB.Begin()
 	if err != nil {
@@ -779,9 +1365,20 @@ func UpdateStatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE stats SET short_id=?, full_name=?, type=?, value_type=?, reversed=?, assigned_user_id=?, assigned_division_id=?, is_calculated=? WHERE id = ?`,
+	var oldUser, oldDiv sql.NullInt64
+	if err := tx.QueryRow(`SELECT assigned_user_id, assigned_division_id FROM stats WHERE id = ? AND deleted_at IS NULL`, id).Scan(&oldUser, &oldDiv); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
+			return
+		}
+		webFail("Failed to load stat", w, err)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE stats SET short_id=?, full_name=?, type=?, value_type=?, reversed=?, assigned_user_id=?, assigned_division_id=?, is_calculated=?, calc_operator=?, decimal_places=?, unit_label=?, thousands_separator=?, currency=? WHERE id = ?`,
 		req.ShortID, req.FullName, req.Type, req.ValueType, req.Reversed,
-		nullIntPtr(req.UserIDs), nullIntPtr(req.DivisionIDs), req.IsCalculated, id)
+		nullIntPtr(req.UserIDs), nullIntPtr(req.DivisionIDs), req.IsCalculated, calcOp, req.DecimalPlaces, nullIfEmpty(req.UnitLabel), separator, nullIfEmpty(req.Currency), id)
 	if err != nil {
 		tx.Rollback()
 		webFail("Failed to update stat", w, err)
@@ -793,12 +1390,26 @@ func UpdateStatHandler(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to clear stat_calculations", w, err)
 		return
 	}
-	for _, depID := range req.CalculatedFrom {
-		if _, err := tx.Exec(`INSERT OR IGNORE INTO stat_calculations (stat_id, dependent_stat_id) VALUES (?, ?)`, id, depID); err != nil {
-			tx.Rollback()
-			webFail("Failed to insert stat_calculation", w, err)
-			return
-		}
+	if err := insertCalculationTerms(tx, id, req.CalculatedFrom, req.CalculatedMinus, req.CalculatedDivideBy); err != nil {
+		tx.Rollback()
+		webFail("Failed to insert stat_calculation", w, err)
+		return
+	}
+	// A new stat has nothing built on it yet; an edited one can be made to depend on itself.
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		tx.Rollback()
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if msg, err := calcCycleMessage(tx, companyDBID, id); err != nil {
+		tx.Rollback()
+		webFail("Failed to check calculations", w, err)
+		return
+	} else if msg != "" {
+		tx.Rollback()
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+		return
 	}
 
 	if _, err := tx.Exec(`DELETE FROM stat_user_assignments WHERE stat_id = ?`, id); err != nil {
@@ -827,15 +1438,40 @@ func UpdateStatHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	action := activityStatUpdated
+	detail := map[string]interface{}{"short_id": req.ShortID, "full_name": req.FullName}
+	newUser, newDiv := nullIntPtr(req.UserIDs), nullIntPtr(req.DivisionIDs)
+	if nullInt64Value(oldUser) != newUser || nullInt64Value(oldDiv) != newDiv {
+		action = activityStatReassigned
+		detail["from_user_id"], detail["to_user_id"] = nullInt64Value(oldUser), newUser
+		detail["from_division_id"], detail["to_division_id"] = nullInt64Value(oldDiv), newDiv
+	}
+	if err := logActivity(tx, r.Context().Value("user_id"), action, id, "", detail); err != nil {
+		tx.Rollback()
+		webFail("Failed to log stat update", w, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		webFail("Failed to commit update", w, err)
 		return
 	}
+	// Both the stat's own formula and anything summing it may have changed.
+	if err := enqueueRecalcStat(DB, id, ""); err != nil {
+		log.Printf("Failed to queue recalculation of stat %d: %v", id, err)
+	}
+	if err := enqueueRecalc(DB, id, ""); err != nil {
+		log.Printf("Failed to queue recalculation of stats depending on %d: %v", id, err)
+	}
+	if err := markStatCompanyAggregatesDirty(id); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", id, err)
+	}
 
 	json.NewEncoder(w).Encode(map[string]string{"message": "Stat updated"})
 }
 
 // ---------- DELETE STAT ----------
+// Moves the stat to the trash (see trash.go); it is purged for good after the retention window.
 func DeleteStatHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodDelete {
         http.Error(w, `{"message":"Method not allowed"}`, http.StatusMethodNotAllowed)
@@ -844,19 +1480,63 @@ func DeleteStatHandler(w http.ResponseWriter, r *http.Request) {
 
     idStr := mux.Vars(r)["id"]
     id, _ := strconv.Atoi(idStr)
+    if status, msg := checkStatCompany(r, id); status != 0 {
+        http.Error(w, `{"message":"`+msg+`"}`, status)
+        return
+    }
 
-    _, err := DB.Exec(`DELETE FROM stats WHERE id=?`, id)
+    companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+    if err != nil {
+        webFail("Failed to resolve company", w, err)
+        return
+    }
+
+    tx, err := DB.Begin()
+    if err != nil {
+        webFail("Failed to start transaction", w, err)
+        return
+    }
+    defer tx.Rollback()
+    deletedAt := time.Now().UTC().Format(time.RFC3339)
+    res, err := tx.Exec(`UPDATE stats SET deleted_at = ? WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, deletedAt, id, companyDBID)
     if err != nil {
         webFail("Failed to delete stat", w, err, "id", id)
         return
     }
+    if n, _ := res.RowsAffected(); n == 0 {
+        // Deleted by someone else since the check above.
+        http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
+        return
+    }
+    if err := logActivity(tx, r.Context().Value("user_id"), activityStatDeleted, id, "", nil); err != nil {
+        webFail("Failed to log activity", w, err)
+        return
+    }
+    // The stats that summed this one now leave it out (see calcTerms).
+    if err := enqueueRecalc(tx, id, ""); err != nil {
+        webFail("Failed to queue recalculation", w, err)
+        return
+    }
+    if err := markCompanyAggregatesDirty(tx, companyDBID); err != nil {
+        webFail("Failed to mark aggregates", w, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        webFail("Failed to delete stat", w, err, "id", id)
+        return
+    }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Stat deleted"})
+    json.NewEncoder(w).Encode(map[string]string{"message": "Stat moved to the trash", "deleted_at": deletedAt, "purge_at": trashPurgeAt(deletedAt)})
 }
 
 // ---------- LIST ALL STATS (with assignments) ----------
 func ListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
 	rows, err := DB.Query(`
 		SELECT 
 			s.id,
@@ -869,12 +1549,18 @@ func ListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 			u.username,
 			s.assigned_division_id,
 			d.name AS division_name,
-			s.is_calculated
+			s.is_calculated,
+			s.decimal_places,
+			COALESCE(s.unit_label, ''),
+			s.thousands_separator,
+			COALESCE(s.currency, ''),
+			s.archived_at
 		FROM stats s
 		LEFT JOIN users u ON s.assigned_user_id = u.id
 		LEFT JOIN divisions d ON s.assigned_division_id = d.id
+		WHERE s.company_id = ? AND s.deleted_at IS NULL AND (? OR s.archived_at IS NULL)
 		ORDER BY u.username, s.type
-	`)
+	`, companyDBID, includeArchived(r))
 	if err != nil {
 		webFail("Failed to query stats", w, err)
 		return
@@ -888,8 +1574,10 @@ func ListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 		var assignedUsername sqlNullString
 		var assignedDiv sqlNullInt64
 		var divName sqlNullString
+		var places sqlNullInt64
+		var archivedAt sqlNullString
 		if err := rows.Scan(&s.ID, &s.ShortID, &s.FullName, &s.Type, &s.ValueType, &s.Reversed,
-			&assignedUID, &assignedUsername, &assignedDiv, &divName, &s.IsCalculated); err != nil {
+			&assignedUID, &assignedUsername, &assignedDiv, &divName, &s.IsCalculated, &places, &s.UnitLabel, &s.ThousandsSeparator, &s.Currency, &archivedAt); err != nil {
 			webFail("Failed to scan stat row", w, err)
 			return
 		}
@@ -909,6 +1597,13 @@ func ListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 			dn := divName.String
 			s.AssignedDivName = &dn
 		}
+		if places.Valid {
+			n := int(places.Int64)
+			s.DecimalPlaces = &n
+		}
+		if archivedAt.Valid {
+			s.ArchivedAt = &archivedAt.String
+		}
 		out = append(out, s)
 	}
 	if err := rows.Err(); err != nil {
@@ -937,7 +1632,7 @@ func splitInt(s string) []int {
 func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
 	companyID := r.Context().Value("company_id").(string)
 	rows, err := DB.Query(`
-		SELECT u.id, u.username, u.role
+		SELECT u.id, u.username, u.role, u.last_login_at, u.last_seen_at, u.active
 		FROM users u
 		JOIN companies c ON u.company_id = c.id
 		WHERE c.company_id = ?
@@ -953,14 +1648,19 @@ func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var id int
 		var username, role string
-		if err := rows.Scan(&id, &username, &role); err != nil {
+		var lastLogin, lastSeen sql.NullString
+		var active bool
+		if err := rows.Scan(&id, &username, &role, &lastLogin, &lastSeen, &active); err != nil {
 			log.Printf("Error scanning user: %v", err)
 			continue
 		}
 		users = append(users, map[string]interface{}{
-			"id":       id,
-			"username": username,
-			"role":     role,
+			"id":            id,
+			"username":      username,
+			"role":          role,
+			"last_login_at": nullStringValue(lastLogin),
+			"last_seen_at":  nullStringValue(lastSeen),
+			"active":        active,
 		})
 	}
 
@@ -986,6 +1686,9 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(int)
+	if passwordRejected(w, "new_password", reqPass.NewPassword, r.Context().Value("username").(string)) {
+		return
+	}
 
 	var passwordHash string
 	err := DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
@@ -1038,13 +1741,16 @@ func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	companyID := r.Context().Value("company_id").(string)
-    var userCompanyID string
-    err := DB.QueryRow("SELECT c.company_id FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?", reqPass.UserID).Scan(&userCompanyID)
+    var userCompanyID, username string
+    err := DB.QueryRow("SELECT c.company_id, u.username FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?", reqPass.UserID).Scan(&userCompanyID, &username)
     if err != nil || userCompanyID != companyID {
         log.Printf("User %d not found or not in company %s: %v", reqPass.UserID, companyID, err)
         http.Error(w, `{"message": "User not found"}`, http.StatusNotFound)
         return
     }
+	if passwordRejected(w, "new_password", reqPass.NewPassword, username) {
+		return
+	}
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(reqPass.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
@@ -1087,16 +1793,63 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	_, err = DB.Exec("DELETE FROM users WHERE id = ?", userID)
+	// Optionally keep the user's stats going first (see deactivation.go).
+	id, _ := strconv.Atoi(userID)
+	companyDB, err := companyDBID(companyID)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	var moved []int
+	switch mode := r.URL.Query().Get("stats"); mode {
+	case "":
+	case "reassign":
+		toID, err := strconv.Atoi(r.URL.Query().Get("to"))
+		var n int
+		if err == nil && toID != id {
+			tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND company_id = ?`, toID, companyDB).Scan(&n)
+		}
+		if n == 0 {
+			http.Error(w, `{"message": "to must be another user of the company"}`, http.StatusBadRequest)
+			return
+		}
+		if moved, err = reassignUserStats(tx, companyDB, id, toID, time.Now().UTC().Format("2006-01-02"), adminID); err != nil {
+			webFail("Failed to reassign stats", w, err)
+			return
+		}
+	case "archive":
+		if moved, err = archiveUserStats(tx, companyDB, id, adminID); err != nil {
+			webFail("Failed to archive stats", w, err)
+			return
+		}
+	default:
+		http.Error(w, `{"message": "stats must be reassign or archive"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		log.Printf("Error deleting user %s: %v", userID, err)
 		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Deleted user %s from company %s", userID, companyID)
+	log.Printf("Deleted user %s from company %s (%d stats kept)", userID, companyID, len(moved))
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"message": "User deleted successfully"}`)
+	if moved == nil {
+		fmt.Fprint(w, `{"message": "User deleted successfully"}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "User deleted successfully", "stat_ids": moved})
 }
 
 // UpdateUserRoleHandler updates a user's role
@@ -1119,7 +1872,7 @@ func UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if reqRole.Role != "user" && reqRole.Role != "admin" {
+	if !validRole(reqRole.Role) {
 		log.Printf("Invalid role: %s", reqRole.Role)
 		http.Error(w, `{"message": "Invalid role"}`, http.StatusBadRequest)
 		return
@@ -1169,6 +1922,9 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		CompanyID string `json:"company_id"`
 		Username  string `json:"username"`
 		Password  string `json:"password"`
+		Remember  bool   `json:"remember_me"`
+		JWT       bool   `json:"jwt"` // answer with a JWT instead of a session cookie (see jwt.go)
+		OTP       string `json:"otp"` // two-factor code, when the user has 2FA (see twofactor.go)
 	}
 	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 		log.Printf("Invalid login request: %v", err)
@@ -1176,7 +1932,48 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	creds.Username = strings.ToLower(strings.TrimSpace(creds.Username))
+	creds.Username = strings.ToLower(strings.TrimSpace(creds.Username))
+	if companySuspended(creds.CompanyID) {
+		recordLogin(r, creds.CompanyID, creds.Username, 0, "password", false, "company suspended")
+		http.Error(w, `{"message": "This company is suspended"}`, http.StatusForbidden)
+		return
+	}
+	if !loginAllowed(w, r, creds.CompanyID, creds.Username, "password") {
+		return
+	}
+
+	// Directory login first when the company has LDAP enabled; otherwise (or on failure) use local users.
+	if userID, role, refused, ok := ldapLogin(creds.CompanyID, creds.Username, creds.Password); refused != "" {
+		recordLogin(r, creds.CompanyID, creds.Username, 0, "ldap", false, "no seat left")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": refused})
+		return
+	} else if ok {
+		if !accountActive(w, r, creds.CompanyID, creds.Username, userID, "ldap") {
+			return
+		}
+		if !requireSecondFactor(w, r, creds.CompanyID, creds.Username, userID, "ldap", creds.OTP) {
+			return
+		}
+		if creds.JWT {
+			recordLogin(r, creds.CompanyID, creds.Username, userID, "ldap", true, "")
+			writeJWTLogin(w, userID, creds.CompanyID, role)
+			return
+		}
+		session, _ := store.Get(r, "session-name")
+		startSession(session, userID, creds.CompanyID, creds.Remember)
+		if err := session.Save(r, w); err != nil {
+			log.Printf("Failed to save session: %v", err)
+			http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
+			return
+		}
+		recordLogin(r, creds.CompanyID, creds.Username, userID, "ldap", true, "")
+		log.Printf("Successful LDAP login for %s/%s (role %s)", creds.CompanyID, creds.Username, role)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"message": "Login successful"}`)
+		return
+	}
 
 	// Fetch user
 	var userID int
@@ -1189,6 +1986,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	`, creds.CompanyID, creds.Username).Scan(&userID, &hash, &role)
 	if err != nil {
 		log.Printf("Invalid credentials for %s/%s: %v", creds.CompanyID, creds.Username, err)
+		recordLogin(r, creds.CompanyID, creds.Username, 0, "password", false, "unknown user")
 		http.Error(w, `{"message": "Invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
@@ -1196,19 +1994,33 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	// Compare password
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Password)); err != nil {
 		log.Printf("Password mismatch for %s/%s", creds.CompanyID, creds.Username)
+		recordLogin(r, creds.CompanyID, creds.Username, userID, "password", false, "wrong password")
 		http.Error(w, `{"message": "Invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
 
+	if !accountActive(w, r, creds.CompanyID, creds.Username, userID, "password") {
+		return
+	}
+	if !requireSecondFactor(w, r, creds.CompanyID, creds.Username, userID, "password", creds.OTP) {
+		return
+	}
+	if creds.JWT {
+		recordLogin(r, creds.CompanyID, creds.Username, userID, "jwt", true, "")
+		writeJWTLogin(w, userID, creds.CompanyID, role)
+		return
+	}
+
 	// Set session
 	session, _ := store.Get(r, "session-name")
-	session.Values["user_id"] = userID
+	startSession(session, userID, creds.CompanyID, creds.Remember)
 	if err := session.Save(r, w); err != nil {
 		log.Printf("Failed to save session: %v", err)
 		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
 		return
 	}
 
+	recordLogin(r, creds.CompanyID, creds.Username, userID, "password", true, "")
 	log.Printf("Successful login for %s/%s (role %s)", creds.CompanyID, creds.Username, role)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, `{"message": "Login successful"}`)
@@ -1258,20 +2070,35 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		CompanyName string `json:"company_name"`
 		Username    string `json:"username"`
 		Password    string `json:"password"`
+		InviteCode  string `json:"invite_code"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
 		log.Printf("Invalid register request: %v", err)
 		http.Error(w, `{"message": "Invalid request"}`, http.StatusBadRequest)
 		return
 	}
+	req.CompanyID = strings.TrimSpace(req.CompanyID)
+	req.CompanyName = strings.TrimSpace(req.CompanyName)
+	if req.CompanyID == "" || req.CompanyName == "" || strings.TrimSpace(req.Username) == "" {
+		http.Error(w, `{"message": "company_id, company_name and username are required"}`, http.StatusBadRequest)
+		return
+	}
+	if passwordRejected(w, "password", req.Password, req.Username) {
+		return
+	}
 
-	if err := RegisterCompany(req.CompanyID, req.CompanyName, req.Username, req.Password); err != nil {
+	if err := RegisterCompany(req.CompanyID, req.CompanyName, req.Username, req.Password, req.InviteCode); err == errInvalidInvite {
+		log.Printf("Registration for %s rejected: %v", req.CompanyID, err)
+		http.Error(w, `{"message": "Invalid or expired invite code"}`, http.StatusForbidden)
+		return
+	} else if err != nil {
 		log.Printf("Registration failed for %s/%s: %v", req.CompanyID, req.Username, err)
 		http.Error(w, `{"message": "Registration failed"}`, http.StatusBadRequest)
 		return
 	}
 
 	log.Printf("Registered company %s and admin %s", req.CompanyID, req.Username)
+	createStripeCustomerAsync(req.CompanyID)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, `{"message": "Registration successful"}`)
 }
@@ -1288,6 +2115,7 @@ func UserHandler(w http.ResponseWriter, r *http.Request) {
 		Username  string `json:"username"`
 		Password  string `json:"password"`
 		Role      string `json:"role"`
+		Email     string `json:"email"` // with no password, the user sets one from a welcome email (see welcome.go)
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("Invalid user creation request: %v", err)
@@ -1295,11 +2123,79 @@ func UserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email != "" {
+		if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			http.Error(w, `{"message": "Invalid email address"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	invite := req.Email != "" && req.Password == ""
+	if !invite && passwordRejected(w, "password", req.Password, req.Username) {
+		return
+	}
+
+	// Users are always created in the caller's company; company_id in the body is only accepted when
+	// it names that company.
+	company := r.Context().Value("company_id").(string)
+	if req.CompanyID != "" && !strings.EqualFold(strings.TrimSpace(req.CompanyID), company) {
+		http.Error(w, `{"message": "Users can only be created in your own company"}`, http.StatusForbidden)
+		return
+	}
+	req.CompanyID = company
+	companyDBID, err := companyDBID(company)
+	if err != nil {
+		log.Printf("Failed to resolve company %s: %v", company, err)
+		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if ok, msg, err := checkBillingLimit(companyDBID, "user"); err != nil {
+		log.Printf("Failed to check plan limits for %s: %v", company, err)
+		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+		return
+	}
+
+	if invite {
+		userID, err := createInvitedUser(req.CompanyID, req.Username, req.Email, req.Role)
+		if err != nil {
+			log.Printf("User creation failed for %s/%s: %v", req.CompanyID, req.Username, err)
+			http.Error(w, `{"message": "User creation failed"}`, http.StatusBadRequest)
+			return
+		}
+		if err := sendWelcomeEmail(r, userID, req.Email); err != nil {
+			log.Printf("Failed to send welcome email to user %d: %v", userID, err)
+			http.Error(w, `{"message": "User created, but the welcome email could not be sent; resend it from the user list"}`, http.StatusBadGateway)
+			return
+		}
+		log.Printf("Created user %s (role %s) for company %s and sent a welcome email", req.Username, req.Role, req.CompanyID)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"message": "User created, welcome email sent"}`)
+		return
+	}
+
 	if err := RegisterUser(req.CompanyID, req.Username, req.Password, req.Role); err != nil {
 		log.Printf("User creation failed for %s/%s: %v", req.CompanyID, req.Username, err)
 		http.Error(w, `{"message": "User creation failed"}`, http.StatusBadRequest)
 		return
 	}
+	if req.Email != "" {
+		var userID int
+		err := DB.QueryRow(`
+			UPDATE users SET email = ? WHERE lower(username) = ? AND company_id = (SELECT id FROM companies WHERE company_id = ?)
+			RETURNING id
+		`, req.Email, strings.ToLower(strings.TrimSpace(req.Username)), req.CompanyID).Scan(&userID)
+		if err == nil {
+			err = sendEmailVerification(r, userID, req.Email)
+		}
+		if err != nil {
+			log.Printf("Failed to set email of new user %s/%s: %v", req.CompanyID, req.Username, err)
+		}
+	}
 
 	log.Printf("Created user %s (role %s) for company %s", req.Username, req.Role, req.CompanyID)
 	w.Header().Set("Content-Type", "application/json")
@@ -1308,7 +2204,12 @@ func UserHandler(w http.ResponseWriter, r *http.Request) {
 
 // ---------- LIST ALL DIVISIONS ----------
 func ListDivisionsHandler(w http.ResponseWriter, r *http.Request) {
-    rows, err := DB.Query(`SELECT id, name FROM divisions ORDER BY name`)
+    companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+    if err != nil {
+        webFail("Failed to resolve company", w, err)
+        return
+    }
+    rows, err := DB.Query(`SELECT id, name FROM divisions WHERE company_id = ? ORDER BY name`, companyDBID)
     if err != nil {
         webFail("Failed to query divisions", w, err)
         return
@@ -1358,7 +2259,13 @@ func CreateDivisionHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    i, err := DB.Exec(`INSERT INTO divisions (name) VALUES (?)`, req.Name)
+    companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+    if err != nil {
+        webFail("Failed to resolve company", w, err)
+        return
+    }
+
+    i, err := DB.Exec(`INSERT INTO divisions (name, company_id) VALUES (?, ?)`, req.Name, companyDBID)
     if err != nil {
         webFail("Failed to create division", w, err)
         return
@@ -1438,6 +2345,27 @@ func addHeaders(fs http.Handler, mimeType, baseDir string) http.HandlerFunc {
 }
 
 // handleIndex serves the React app
+// registerStaticRoutes serves the front end; the sharded router serves it too (see shardrouter.go).
+func registerStaticRoutes(router *mux.Router) {
+	// Static file handlers left as-is
+	cssHandler := http.FileServer(http.Dir("public/css"))
+	router.PathPrefix("/public/css/").Handler(http.StripPrefix("/public/css", addHeaders(cssHandler, "text/css", "public/css")))
+
+	jsHandler := http.FileServer(http.Dir("public/js"))
+	router.PathPrefix("/public/js/").Handler(http.StripPrefix("/public/js", addHeaders(jsHandler, "application/javascript", "public/js")))
+
+	semanticHandler := http.FileServer(http.Dir("public/Semantic-UI-2.3.0/dist"))
+	router.PathPrefix("/public/Semantic-UI-2.3.0/dist/").Handler(http.StripPrefix("/public/Semantic-UI-2.3.0/dist", addHeaders(semanticHandler, "", "public/Semantic-UI-2.3.0/dist")))
+
+	videoHandler := http.FileServer(http.Dir("public/AV"))
+	router.PathPrefix("/public/AV/").Handler(http.StripPrefix("/public/AV", addHeaders(videoHandler, "video/mp4", "public/AV")))
+
+	publicHandler := http.FileServer(http.Dir("public"))
+	router.PathPrefix("/public/").Handler(http.StripPrefix("/public", addHeaders(publicHandler, "", "public")))
+
+	router.PathPrefix("/").HandlerFunc(handleIndex)
+}
+
 func handleIndex(w http.ResponseWriter, r *http.Request) {
     // Serve index.html for all routes to support React Router
     http.ServeFile(w, r, "public/build/index.html")
@@ -1554,10 +2482,16 @@ type SingleWeeklyStat struct {
 	Profit     float64 `csv:"-"`
 }
 
-// Checks that the weekending date passed in is the correct format and that it is a Thursday. It returns nil upon success.
-func checkIfValidWE(we string) error {
+// Checks that the weekending date passed in is the correct format and that it falls on the company's W/E weekday
+// (Thursday unless changed in the company settings). It returns nil upon success.
+func checkIfValidWE(companyID, we string) error {
+	return checkWeekEndingOn(we, companyWeekEndingDay(companyID))
+}
+
+// checkWeekEndingOn is checkIfValidWE for a known W/E weekday.
+func checkWeekEndingOn(we string, weekday time.Weekday) error {
 	t, err := time.Parse("2006-01-02", we)
-	if err != nil || t.Weekday() != time.Thursday {
+	if err != nil || t.Weekday() != weekday {
 		return fmt.Errorf("The weekending date is invalid")
 	}
 	return nil
@@ -1649,20 +2583,21 @@ func (m *Money) MoneyToUSD() USD {
 	return USD(c)
 }
 
-func getWeeks(n int) []string {
-	now.WeekStartDay = time.Friday
+func getWeeks(companyID string, n int) []string {
+	weekday := companyWeekEndingDay(companyID)
+	now.WeekStartDay = (weekday + 1) % 7
 	var week = now.EndOfWeek()
 	year, month, day := week.Date()
-	nextThursday := time.Date(year, time.Month(month), day, 14, 0, 0, 0, time.UTC)
+	nextWE := time.Date(year, time.Month(month), day, 14, 0, 0, 0, time.UTC)
 
 	var weeks []string
-	if time.Now().Format("Monday") == "Thursday" {
-		weeks = append(weeks, nextThursday.Add(time.Hour*24*7).Format("2006-01-02"))
+	if time.Now().Weekday() == weekday {
+		weeks = append(weeks, nextWE.Add(time.Hour*24*7).Format("2006-01-02"))
 	}
-	weeks = append(weeks, nextThursday.Format("2006-01-02"))
+	weeks = append(weeks, nextWE.Format("2006-01-02"))
 	for i := 0; i < n; i++ {
-		nextThursday = nextThursday.Add(time.Hour * -24 * 7)
-		weeks = append(weeks, nextThursday.Format("2006-01-02"))
+		nextWE = nextWE.Add(time.Hour * -24 * 7)
+		weeks = append(weeks, nextWE.Format("2006-01-02"))
 	}
 
 	return weeks
@@ -1701,6 +2636,7 @@ type DailyStat struct {
 	Tuesday   string `csv:"Tuesday" json:"Tuesday"`
 	Wednesday string `csv:"Wednesday" json:"Wednesday"`
 	Quota     string `csv:"Quotas" json:"Quota"`
+	Version   string `csv:"-" json:"Version,omitempty"` // concurrency token for the week's daily rows
 }
 
 // ... (rest of the code: CreateLog, FileExists, DailyStat, validateDailyStats, StringToMoney, getWeeks, checkIfValidWE, webFail, handleClassifications, handleDivisions, handleStats, handleDailyStatsRequest, handleWeeklyStatsRequest, handleSave7R, handleLogWeeklyStats, handleSaveWeeklyEdit remain unchanged from artifact version 54392640-368e-42c1-b319-d3e4ba07984e)
@@ -1735,6 +2671,12 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		// they should call UpdateStatHandler instead. We'll ignore these for matching.
 		UserID *int `json:"user_id,omitempty"`
 		DivID  *int `json:"division_id,omitempty"`
+		// Version of the row the client loaded (0 = expected new); omitted skips the check.
+		Version *int `json:"version,omitempty"`
+		// Confirm accepts a value flagged by the stat's max_change_pct rule.
+		Confirm bool `json:"confirm,omitempty"`
+		// Reason explains a change to a logged week; required when the company locks values.
+		Reason string `json:"reason,omitempty"`
 	}
 	if strings.HasPrefix(ct, "application/json") {
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -1760,13 +2702,21 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 				payload.DivID = &id
 			}
 		}
+		if v := r.FormValue("version"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				payload.Version = &n
+			}
+		}
+		payload.Confirm, _ = strconv.ParseBool(r.FormValue("confirm"))
+		payload.Reason = r.FormValue("reason")
 	}
 
 	if payload.StatID == 0 {
 		webFail("stat_id is required", w, fmt.Errorf("stat_id required"))
 		return
 	}
-	if err := checkIfValidWE(payload.Date); err != nil {
+	payload.Value = normalizeNumber(payload.Value, requestLocale(r), statInputPlaces(payload.StatID))
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), payload.Date); err != nil {
 		webFail("Invalid weekending date", w, err)
 		return
 	}
@@ -1780,7 +2730,7 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 
 	// Resolve stat type and value_type for validation
 	var statType, valueType string
-	if err := DB.QueryRow(`SELECT type, value_type FROM stats WHERE id = ? LIMIT 1`, payload.StatID).Scan(&statType, &valueType); err != nil {
+	if err := DB.QueryRow(`SELECT type, value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, payload.StatID).Scan(&statType, &valueType); err != nil {
 		if err == sql.ErrNoRows {
 			webFail("Stat not found", w, err)
 			return
@@ -1788,6 +2738,9 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat metadata", w, err)
 		return
 	}
+	if refuseArchivedWrite(w, payload.StatID) {
+		return
+	}
 
 	// validate and convert the provided value into storage form
 	if err := validateWeeklyValueByType(payload.Value, valueType); err != nil {
@@ -1795,15 +2748,16 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	currency := statCurrency(payload.StatID)
 	var storeVal int64
 	switch valueType {
 	case "currency":
-		m, err := StringToMoney(payload.Value)
+		v, err := parseStatValue(payload.Value, valueType, currency)
 		if err != nil {
 			webFail("Invalid currency", w, err)
 			return
 		}
-		storeVal = int64(m.MoneyToUSD())
+		storeVal = v
 	case "number":
 		i, err := strconv.Atoi(strings.TrimSpace(payload.Value))
 		if err != nil {
@@ -1818,10 +2772,22 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		storeVal = int64((f * 100) + 0.5)
+	case "decimal", "ratio", "duration":
+		v, err := parseValueByType(payload.Value, valueType)
+		if err != nil {
+			webFail("Invalid "+valueType, w, err)
+			return
+		}
+		storeVal = v
 	default:
 		webFail("Unknown value type", w, fmt.Errorf("value_type=%s", valueType))
 		return
 	}
+	num, den := ratioParts(payload.Value, valueType)
+	if err := checkWeeklyRules(DB, payload.StatID, payload.Date, storeVal, valueType, payload.Confirm); err != nil {
+		writeRuleViolation(w, err)
+		return
+	}
 
 	// Upsert by stat_id + week_ending (single canonical row)
 	tx, err := DB.Begin()
@@ -1835,72 +2801,120 @@ func handleLogWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	var existingID int64
-	err = tx.QueryRow(`SELECT id FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, payload.StatID, payload.Date).Scan(&existingID)
+	var existingID, existingVal int64
+	var existingVersion int
+	err = tx.QueryRow(`SELECT id, value, version FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, payload.StatID, payload.Date).Scan(&existingID, &existingVal, &existingVersion)
 	if err != nil && err != sql.ErrNoRows {
 		tx.Rollback()
 		webFail("Failed to query weekly_stats", w, err)
 		return
 	}
+	if payload.Version != nil && *payload.Version != existingVersion {
+		tx.Rollback()
+		current := map[string]interface{}{"version": existingVersion}
+		if existingVersion != 0 {
+			current["value"] = formatStatValue(existingVal, valueType, currency)
+		}
+		writeConflict(w, "This week's value was changed by someone else since you loaded it", current)
+		return
+	}
+	if err == nil && existingVal != storeVal {
+		if rerr := checkEditReason(tx, payload.StatID, payload.Reason); rerr != nil {
+			tx.Rollback()
+			writeRuleViolation(w, rerr)
+			return
+		}
+	}
+	newVersion := existingVersion + 1
+	now := time.Now().UTC().Format(time.RFC3339)
 
 	if err == nil {
 		// update existing single canonical row
-		if _, err = tx.Exec(`UPDATE weekly_stats SET value = ?, author_user_id = ? WHERE id = ?`, storeVal, authorID, existingID); err != nil {
+		if _, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = ?, denominator = ?, author_user_id = ?, version = ?, updated_at = ? WHERE id = ?`, storeVal, num, den, authorID, newVersion, now, existingID); err != nil {
 			tx.Rollback()
 			webFail("Failed to update weekly_stats", w, err)
 			return
 		}
+		if existingVal != storeVal {
+			if err = recordEditReason(tx, payload.StatID, payload.Date, payload.Reason); err != nil {
+				tx.Rollback()
+				webFail("Failed to record edit reason", w, err)
+				return
+			}
+			detail := map[string]string{
+				"old": formatStatValue(existingVal, valueType, currency),
+				"new": formatStatValue(storeVal, valueType, currency),
+			}
+			if reason := strings.TrimSpace(payload.Reason); reason != "" {
+				detail["reason"] = reason
+			}
+			if err = logActivity(tx, authorID, activityValueEdited, payload.StatID, payload.Date, detail); err != nil {
+				tx.Rollback()
+				webFail("Failed to log weekly edit", w, err)
+				return
+			}
+		}
 	} else {
 		// insert new canonical row (we do NOT set user_id/division_id here)
-		if _, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, author_user_id) VALUES (?, ?, ?, ?)`, payload.StatID, payload.Date, storeVal, authorID); err != nil {
+		if _, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, numerator, denominator, author_user_id, submitted_at, version, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)`, payload.StatID, payload.Date, storeVal, num, den, authorID, now, now); err != nil {
 			tx.Rollback()
 			webFail("Failed to insert weekly_stats", w, err)
 			return
 		}
+		if err = logActivity(tx, authorID, activityValueEntered, payload.StatID, payload.Date, map[string]string{
+			"new": formatStatValue(storeVal, valueType, currency),
+		}); err != nil {
+			tx.Rollback()
+			webFail("Failed to log weekly entry", w, err)
+			return
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		webFail("Failed to commit weekly_stats", w, err)
 		return
 	}
+	publishWeeklyEvents(payload.StatID, payload.Date, storeVal)
+	if err := enqueueRecalc(DB, payload.StatID, payload.Date); err != nil {
+		log.Printf("Failed to queue recalculation of stats depending on %d: %v", payload.StatID, err)
+	}
+	if err := markAggregatesDirty(DB, payload.StatID, payload.Date); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", payload.StatID, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"message":"Weekly value saved"}`)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Weekly value saved", "version": newVersion})
 }
 
 // ---------- POST /services/saveWeeklyEdit ----------
-// Strict StatID-based bulk upsert for personal weekly stats.
-// Payload: JSON array of { StatID:int, Weekending:"YYYY-MM-DD", Value:"string" }
+// Strict StatID-based bulk upsert for personal weekly stats: each row replaces the stat's value for
+// the week (one canonical row per stat and week), so the history trigger, edit reasons and rules apply
+// as for a single weekly entry. Blank values are skipped.
+// Payload: JSON array of { StatID:int, Weekending:"YYYY-MM-DD", Value:"string", Reason:"string" }
 func handleSaveWeeklyEdit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, `{"message":"Method not allowed"}`, http.StatusMethodNotAllowed)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		webFail("Failed to read request body", w, err)
-		return
-	}
-
 	var payload []struct {
-		StatID    int    `json:"StatID"`
+		StatID     int    `json:"StatID"`
 		Weekending string `json:"Weekending"`
-		Value     string `json:"Value"`
+		Value      string `json:"Value"`
+		Reason     string `json:"Reason"` // required to change a logged week when the company locks values
 	}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		webFail("Failed to unmarshal payload", w, err)
+	if !decodeJSONBody(w, r, &payload) || tooManyRows(w, len(payload)) {
 		return
 	}
 	if len(payload) == 0 {
-		webFail("Empty payload", w, fmt.Errorf("no rows provided"))
+		http.Error(w, `{"message":"Empty payload"}`, http.StatusUnprocessableEntity)
 		return
 	}
 
 	// Validate all weekending dates first
-	for _, row := range payload {
-		if err := checkIfValidWE(row.Weekending); err != nil {
-			webFail(fmt.Sprintf("W/E date %s invalid", row.Weekending), w, err)
+	for idx, row := range payload {
+		if err := checkIfValidWE(r.Context().Value("company_id").(string), row.Weekending); err != nil {
+			writeInvalidRow(w, idx, "W/E date %s invalid", row.Weekending)
 			return
 		}
 	}
@@ -1910,113 +2924,154 @@ func handleSaveWeeklyEdit(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to start transaction", w, err)
 		return
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	sessionUserID := r.Context().Value("user_id").(int)
-
-	// Collect unique weekendings from payload to remove existing personal rows for those weeks
-	weSet := make(map[string]struct{})
-	for _, row := range payload {
-		weSet[row.Weekending] = struct{}{}
-	}
-	weList := make([]interface{}, 0, len(weSet))
-	for we := range weSet {
-		weList = append(weList, we)
-	}
-	placeholders := strings.Repeat("?,", len(weList))
-	placeholders = placeholders[:len(placeholders)-1]
+	defer tx.Rollback()
 
-	// Clear existing personal rows for these week endings
-	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM weekly_stats WHERE user_id = ? AND week_ending IN (%s)", placeholders), append([]interface{}{sessionUserID}, weList...)...); err != nil {
-		tx.Rollback()
-		webFail("Failed to clear personal weekly_stats", w, err)
-		return
+	authorID := r.Context().Value("user_id")
+	now := time.Now().UTC().Format(time.RFC3339)
+	type savedWeek struct {
+		statID int
+		week   string
+		value  int64
 	}
+	var saved []savedWeek
 
-	// Insert each payload row (only personal stats allowed)
-	for _, row := range payload {
+	for idx, row := range payload {
+		if strings.TrimSpace(row.Value) == "" {
+			continue
+		}
+		if status, _ := checkStatCompany(r, row.StatID); status != 0 {
+			writeInvalidRow(w, idx, "Stat not found for StatID %d", row.StatID)
+			return
+		}
 		// Resolve stat metadata by id
 		var shortID, valueType, statType string
-		if err := DB.QueryRow(`SELECT short_id, value_type, type FROM stats WHERE id = ? LIMIT 1`, row.StatID).Scan(&shortID, &valueType, &statType); err != nil {
-			tx.Rollback()
+		if err := tx.QueryRow(`SELECT short_id, value_type, type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, row.StatID).Scan(&shortID, &valueType, &statType); err != nil {
 			if err == sql.ErrNoRows {
-				webFail(fmt.Sprintf("Stat not found for StatID %d", row.StatID), w, err)
+				writeInvalidRow(w, idx, "Stat not found for StatID %d", row.StatID)
 				return
 			}
 			webFail("Failed to query stat metadata", w, err)
 			return
 		}
 		if statType != "personal" {
-			tx.Rollback()
-			webFail(fmt.Sprintf("Stat %s (id=%d) is not personal and cannot be written via this endpoint", shortID, row.StatID), w, fmt.Errorf("invalid stat scope"))
+			writeInvalidRow(w, idx, "Stat %s (id=%d) is not personal and cannot be written via this endpoint", shortID, row.StatID)
+			return
+		}
+		if refuseArchivedWrite(w, row.StatID) {
 			return
 		}
 
 		// validate value
 		if err := validateWeeklyValueByType(row.Value, valueType); err != nil {
-			tx.Rollback()
-			webFail(fmt.Sprintf("Invalid value for stat %s: %v", shortID, err), w, err)
+			writeInvalidRow(w, idx, "Invalid value for stat %s: %v", shortID, err)
 			return
 		}
 
 		// convert to stored integer
+		currency := statCurrency(row.StatID)
 		var storeVal int64
 		switch valueType {
 		case "currency":
-			if strings.TrimSpace(row.Value) == "" {
-				continue
-			}
-			m, err := StringToMoney(row.Value)
+			v, err := parseStatValue(row.Value, valueType, currency)
 			if err != nil {
-				tx.Rollback()
-				webFail("Invalid currency", w, err)
+				writeInvalidRow(w, idx, "Invalid currency for stat %s: %v", shortID, err)
 				return
 			}
-			storeVal = int64(m.MoneyToUSD())
+			storeVal = v
 		case "number":
-			if strings.TrimSpace(row.Value) == "" {
-				continue
-			}
 			i, err := strconv.Atoi(row.Value)
 			if err != nil {
-				tx.Rollback()
-				webFail("Invalid integer", w, err)
+				writeInvalidRow(w, idx, "Invalid integer for stat %s", shortID)
 				return
 			}
 			storeVal = int64(i)
 		case "percentage":
-			if strings.TrimSpace(row.Value) == "" {
-				continue
-			}
 			f, err := strconv.ParseFloat(row.Value, 64)
 			if err != nil {
-				tx.Rollback()
-				webFail("Invalid percentage", w, err)
+				writeInvalidRow(w, idx, "Invalid percentage for stat %s", shortID)
 				return
 			}
 			storeVal = int64((f * 100) + 0.5)
+		case "decimal", "ratio", "duration":
+			v, err := parseValueByType(row.Value, valueType)
+			if err != nil {
+				writeInvalidRow(w, idx, "Invalid %s for stat %s", valueType, shortID)
+				return
+			}
+			storeVal = v
 		default:
-			tx.Rollback()
 			webFail("Unknown value type", w, fmt.Errorf("value_type=%s", valueType))
 			return
 		}
+		if err := checkWeeklyRules(tx, row.StatID, row.Weekending, storeVal, valueType, false); err != nil {
+			writeRuleViolation(w, err)
+			return
+		}
 
-		// Insert user-scoped weekly row
-		if _, err := tx.Exec(`INSERT INTO weekly_stats (name, week_ending, value, user_id) VALUES (?, ?, ?, ?)`, strings.ToLower(shortID), row.Weekending, storeVal, sessionUserID); err != nil {
-			tx.Rollback()
-			webFail("Failed to insert weekly row", w, err)
+		// Upsert the stat's single canonical row for the week.
+		num, den := ratioParts(row.Value, valueType)
+		var existingID, existingVal int64
+		err := tx.QueryRow(`SELECT id, value FROM weekly_stats WHERE stat_id = ? AND week_ending = ? ORDER BY id DESC LIMIT 1`, row.StatID, row.Weekending).Scan(&existingID, &existingVal)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, numerator, denominator, author_user_id, submitted_at, version, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)`,
+				row.StatID, row.Weekending, storeVal, num, den, authorID, now, now); err != nil {
+				webFail("Failed to insert weekly row", w, err)
+				return
+			}
+			if err := logActivity(tx, authorID, activityValueEntered, row.StatID, row.Weekending, map[string]string{
+				"new": formatStatValue(storeVal, valueType, currency),
+			}); err != nil {
+				webFail("Failed to log weekly entry", w, err)
+				return
+			}
+		case err != nil:
+			webFail("Failed to query weekly_stats", w, err)
 			return
+		case existingVal == storeVal:
+			continue
+		default:
+			if err := checkEditReason(tx, row.StatID, row.Reason); err != nil {
+				writeRuleViolation(w, err)
+				return
+			}
+			if _, err := tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = ?, denominator = ?, author_user_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+				storeVal, num, den, authorID, now, existingID); err != nil {
+				webFail("Failed to update weekly row", w, err)
+				return
+			}
+			if err := recordEditReason(tx, row.StatID, row.Weekending, row.Reason); err != nil {
+				webFail("Failed to record edit reason", w, err)
+				return
+			}
+			detail := map[string]string{
+				"old": formatStatValue(existingVal, valueType, currency),
+				"new": formatStatValue(storeVal, valueType, currency),
+			}
+			if reason := strings.TrimSpace(row.Reason); reason != "" {
+				detail["reason"] = reason
+			}
+			if err := logActivity(tx, authorID, activityValueEdited, row.StatID, row.Weekending, detail); err != nil {
+				webFail("Failed to log weekly edit", w, err)
+				return
+			}
 		}
+		saved = append(saved, savedWeek{row.StatID, row.Weekending, storeVal})
 	}
 
 	if err := tx.Commit(); err != nil {
 		webFail("Failed to commit weekly edits", w, err)
 		return
 	}
+	for _, s := range saved {
+		publishWeeklyEvents(s.statID, s.week, s.value)
+		if err := enqueueRecalc(DB, s.statID, s.week); err != nil {
+			log.Printf("Failed to queue recalculation of stats depending on %d: %v", s.statID, err)
+		}
+		if err := markAggregatesDirty(DB, s.statID, s.week); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", s.statID, err)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, `{"message":"Saved Weekly stat data"}`)
@@ -2038,7 +3093,7 @@ func handleGetWeeklyStats(w http.ResponseWriter, r *http.Request) {
 
 	// Resolve stat and value_type
 	var statType, valueType string
-	if err := DB.QueryRow(`SELECT type, value_type FROM stats WHERE id = ? LIMIT 1`, statID).Scan(&statType, &valueType); err != nil {
+	if err := DB.QueryRow(`SELECT type, value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, statID).Scan(&statType, &valueType); err != nil {
 		if err == sql.ErrNoRows {
 			webFail("Stat not found", w, err)
 			return
@@ -2046,17 +3101,23 @@ func handleGetWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat metadata", w, err)
 		return
 	}
+	if refuseArchived(w, r, statID) {
+		return
+	}
 
 	type WeeklyValue struct {
 		WeekEnding   string `json:"Weekending"`
 		Value        float64 `json:"Value"`
+		Formatted    string `json:"formatted_value"` // see statformat.go
 		AuthorUserID *int   `json:"author_user_id,omitempty"`
+		Version      int    `json:"version"`
 	}
+	format := loadStatFormat(statID, requestLocale(r))
 
 	out := []WeeklyValue{}
 
 	rows, err := DB.Query(`
-		SELECT week_ending, value, author_user_id
+		SELECT week_ending, value, author_user_id, version
 		FROM weekly_stats
 		WHERE stat_id = ?
 		ORDER BY week_ending
@@ -2071,18 +3132,23 @@ func handleGetWeeklyStats(w http.ResponseWriter, r *http.Request) {
 		var we string
 		var v int64
 		var author sql.NullInt64
-		if err := rows.Scan(&we, &v, &author); err != nil {
+		var version int
+		if err := rows.Scan(&we, &v, &author, &version); err != nil {
 			webFail("Failed to scan weekly_stats", w, err)
 			return
 		}
 		var val float64
 		switch valueType {
 		case "currency":
-			val = float64(v) / 100.0
+			val = statValueToFloat(v, valueType, format.Currency)
 		case "number":
 			val = float64(v)
 		case "percentage":
 			val = float64(v) / 100.0
+		case "decimal", "ratio":
+			val = float64(v) / decimalScale
+		case "duration":
+			val = float64(v) / 3600
 		default:
 			val = float64(v) / 100.0
 		}
@@ -2091,7 +3157,7 @@ func handleGetWeeklyStats(w http.ResponseWriter, r *http.Request) {
 			t := int(author.Int64)
 			auth = &t
 		}
-		out = append(out, WeeklyValue{WeekEnding: we, Value: val, AuthorUserID: auth})
+		out = append(out, WeeklyValue{WeekEnding: we, Value: val, Formatted: format.format(v), AuthorUserID: auth, Version: version})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -2108,11 +3174,11 @@ type sqlNullString struct {
 }
 
 // validateDailyStatByType validates the daily row fields according to value_type.
-// valueType must be "currency", "number", or "percentage".
+// valueType must be one of valueTypes (see valuetypes.go).
 func validateDailyStatByType(name, valueType string, row DailyStat) error {
     // helper to build messages
     fieldErr := func(field, val, msg string) error {
-        return fmt.Errorf("Value %v on %s for stat %s is invalid: %s", val, field, msg)
+        return fmt.Errorf("Value %v on %s for stat %s is invalid: %s", val, field, name, msg)
     }
 
     switch valueType {
@@ -2180,6 +3246,25 @@ func validateDailyStatByType(name, valueType string, row DailyStat) error {
         }
         return nil
 
+    case "decimal", "ratio", "duration":
+        days := map[string]string{
+            "Thursday":  row.Thursday,
+            "Friday":    row.Friday,
+            "Monday":    row.Monday,
+            "Tuesday":   row.Tuesday,
+            "Wednesday": row.Wednesday,
+            "Quota":     row.Quota,
+        }
+        for field, val := range days {
+            if val == "" {
+                continue
+            }
+            if _, err := parseValueByType(val, valueType); err != nil {
+                return fieldErr(field, val, err.Error())
+            }
+        }
+        return nil
+
     default:
         return fmt.Errorf("Unknown value_type %s for stat %s", valueType, name)
     }
@@ -2207,6 +3292,11 @@ func validateWeeklyValueByType(valueStr, valueType string) error {
 			return fmt.Errorf("invalid percentage value: %v", err)
 		}
 		return nil
+	case "decimal", "ratio", "duration":
+		if _, err := parseValueByType(valueStr, valueType); err != nil {
+			return fmt.Errorf("invalid %s value: %v", valueType, err)
+		}
+		return nil
 	default:
 		return fmt.Errorf("unknown value_type: %s", valueType)
 	}
@@ -2215,7 +3305,12 @@ func validateWeeklyValueByType(valueStr, valueType string) error {
 // GetStatSeriesHandler returns time series for a stat.
 // Route: GET /api/stats/{id}/series?view=weekly[&user_id=...]
 // Currently implements only view=weekly and returns JSON:
-// [{ "Weekending":"YYYY-MM-DD", "Value": <number>, "author_user_id": <int|null> }, ...]
+// [{ "Weekending":"YYYY-MM-DD", "week_label":"FY24-W07", "Value": <number>, "Adjustment": <number>, "Adjusted": <number>, "author_user_id": <int|null> }, ...]
+// Value is the original entry; Adjusted adds the week's adjustments (see adjustments.go).
+// Durations are reported in hours. "formatted_value" is Adjusted as the stat displays it (units,
+// places, separators; see statformat.go), e.g. "1,250 units" or "7:45". Currency stats also report
+// their currency; convert=1 reports them in the company's default currency (see currency.go).
+// Archived stats answer 410 unless include_archived=1 (see archive.go).
 func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 	// require auth (router will wrap via AuthMiddleware)
 	vars := mux.Vars(r)
@@ -2229,6 +3324,10 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
 		return
 	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
 
 	// view param (only weekly supported now)
 	view := r.URL.Query().Get("view")
@@ -2252,7 +3351,7 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// get stat value_type for conversion
 	var valueType string
-	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? LIMIT 1`, statID).Scan(&valueType); err != nil {
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, statID).Scan(&valueType); err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
 			return
@@ -2260,9 +3359,31 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat metadata", w, err)
 		return
 	}
+	if refuseArchived(w, r, statID) {
+		return
+	}
+
+	fiscal := statFiscal(statID)
+	format := loadStatFormat(statID, requestLocale(r))
+	// convert=1 reports a currency stat in the company's default currency, see currency.go.
+	conv := func(v int64) int64 { return v }
+	if convert, _ := strconv.ParseBool(r.URL.Query().Get("convert")); convert {
+		companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+		if err != nil {
+			webFail("Failed to resolve company", w, err)
+			return
+		}
+		if conv, err = currencyConversion(companyDBID, &format); err != nil {
+			writeConversionError(w, err)
+			return
+		}
+	}
 
-	// Query canonical weekly rows for the stat
-	rows, err := DB.Query(`SELECT week_ending, value, author_user_id FROM weekly_stats WHERE stat_id = ? ORDER BY week_ending`, statID)
+	// Query canonical weekly rows for the stat, with the sum of their adjustments
+	rows, err := DB.Query(`
+		SELECT w.week_ending, w.value, w.author_user_id,
+		       COALESCE((SELECT SUM(a.amount) FROM weekly_adjustments a WHERE a.stat_id = w.stat_id AND a.week_ending = w.week_ending), 0)
+		FROM weekly_stats w WHERE w.stat_id = ? ORDER BY w.week_ending`, statID)
 	if err != nil {
 		webFail("Failed to query weekly series", w, err)
 		return
@@ -2271,8 +3392,13 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 
 	type seriesRow struct {
 		Weekending   string   `json:"Weekending"`
+		WeekLabel    string   `json:"week_label"` // fiscal week, e.g. FY24-W07
 		Value        float64  `json:"Value"`
+		Adjustment   float64  `json:"Adjustment"`
+		Adjusted     float64  `json:"Adjusted"` // Value plus Adjustment
 		AuthorUserID *int     `json:"author_user_id,omitempty"`
+		Formatted    string   `json:"formatted_value"` // Adjusted as the stat displays it, see statformat.go
+		Currency     string   `json:"currency,omitempty"` // currency stats
 	}
 
 	out := make([]seriesRow, 0)
@@ -2280,7 +3406,8 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		var we string
 		var v sql.NullInt64
 		var author sql.NullInt64
-		if err := rows.Scan(&we, &v, &author); err != nil {
+		var adjustment int64
+		if err := rows.Scan(&we, &v, &author, &adjustment); err != nil {
 			webFail("Failed to scan weekly row", w, err)
 			return
 		}
@@ -2288,17 +3415,24 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 			// skip null values (shouldn't happen for weekly_stats)
 			continue
 		}
+		v.Int64, adjustment = conv(v.Int64), conv(adjustment)
 
 		var value float64
 		switch valueType {
 		case "currency":
-			// stored as cents -> return dollars float
-			value = float64(v.Int64) / 100.0
+			// stored in the currency's minor units -> units of the currency
+			value = statValueToFloat(v.Int64, valueType, format.Currency)
 		case "number":
 			value = float64(v.Int64)
 		case "percentage":
 			// stored as percent * 100 (e.g., 1234 -> 12.34)
 			value = float64(v.Int64) / 100.0
+		case "decimal", "ratio":
+			// stored as ten-thousandths, see valuetypes.go
+			value = float64(v.Int64) / decimalScale
+		case "duration":
+			// stored as seconds -> hours
+			value = float64(v.Int64) / 3600
 		default:
 			value = float64(v.Int64)
 		}
@@ -2308,13 +3442,32 @@ func GetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 			t := int(author.Int64)
 			au = &t
 		}
-		out = append(out, seriesRow{Weekending: we, Value: value, AuthorUserID: au})
+		var currency string
+		if valueType == "currency" {
+			currency = format.Currency
+		}
+		out = append(out, seriesRow{Weekending: we, WeekLabel: fiscal.label(we), Value: value, AuthorUserID: au, Currency: currency,
+			Adjustment: statValueToFloat(adjustment, valueType, format.Currency),
+			Adjusted:   statValueToFloat(v.Int64+adjustment, valueType, format.Currency),
+			Formatted:  format.format(v.Int64 + adjustment)})
 	}
 	if err := rows.Err(); err != nil {
 		webFail("Error iterating series rows", w, err)
 		return
 	}
 
+	// include_events=true wraps the series with the graph markers that apply to this stat.
+	if include, _ := strconv.ParseBool(r.URL.Query().Get("include_events")); include {
+		events, err := statGraphEvents(statID)
+		if err != nil {
+			webFail("Failed to query graph events", w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"series": out, "events": events})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
@@ -2357,6 +3510,11 @@ func UpdateDivisionHandler(w http.ResponseWriter, r *http.Request) {
 
 // ---------- PUBLIC LIST ALL STATS (divisional only for Home.js) ----------
 func PublicListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
 	rows, err := DB.Query(`
 		SELECT 
 			s.id,
@@ -2368,13 +3526,18 @@ func PublicListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 			s.assigned_user_id,
 			u.username,
 			s.assigned_division_id,
-			d.name AS division_name
+			d.name AS division_name,
+			s.decimal_places,
+			COALESCE(s.unit_label, ''),
+			s.thousands_separator,
+			COALESCE(s.currency, ''),
+			s.archived_at
 		FROM stats s
 		LEFT JOIN users u ON s.assigned_user_id = u.id
 		LEFT JOIN divisions d ON s.assigned_division_id = d.id
-		WHERE s.type = 'divisional'
+		WHERE s.company_id = ? AND s.type = 'divisional' AND s.deleted_at IS NULL AND (? OR s.archived_at IS NULL)
 		ORDER BY s.short_id
-	`)
+	`, companyDBID, includeArchived(r))
 	if err != nil {
 		webFail("Failed to query stats", w, err)
 		return
@@ -2388,8 +3551,10 @@ func PublicListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 		var assignedUsername sqlNullString
 		var assignedDiv sqlNullInt64
 		var divName sqlNullString
+		var places sqlNullInt64
+		var archivedAt sqlNullString
 		if err := rows.Scan(&s.ID, &s.ShortID, &s.FullName, &s.Type, &s.ValueType, &s.Reversed,
-			&assignedUID, &assignedUsername, &assignedDiv, &divName); err != nil {
+			&assignedUID, &assignedUsername, &assignedDiv, &divName, &places, &s.UnitLabel, &s.ThousandsSeparator, &s.Currency, &archivedAt); err != nil {
 			webFail("Failed to scan stat row", w, err)
 			return
 		}
@@ -2409,6 +3574,13 @@ func PublicListAllStatsHandler(w http.ResponseWriter, r *http.Request) {
 			dn := divName.String
 			s.AssignedDivName = &dn
 		}
+		if places.Valid {
+			n := int(places.Int64)
+			s.DecimalPlaces = &n
+		}
+		if archivedAt.Valid {
+			s.ArchivedAt = &archivedAt.String
+		}
 		out = append(out, s)
 	}
 	if err := rows.Err(); err != nil {
@@ -2446,7 +3618,7 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// get stat value_type for conversion
 	var valueType string
-	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? LIMIT 1`, statID).Scan(&valueType); err != nil {
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, statID).Scan(&valueType); err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
 			return
@@ -2454,9 +3626,18 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat metadata", w, err)
 		return
 	}
+	if refuseArchived(w, r, statID) {
+		return
+	}
+
+	fiscal := statFiscal(statID)
+	format := loadStatFormat(statID, requestLocale(r))
 
-	// Query canonical weekly rows for the stat
-	rows, err := DB.Query(`SELECT week_ending, value, author_user_id FROM weekly_stats WHERE stat_id = ? ORDER BY week_ending`, statID)
+	// Query canonical weekly rows for the stat, with the sum of their adjustments
+	rows, err := DB.Query(`
+		SELECT w.week_ending, w.value, w.author_user_id,
+		       COALESCE((SELECT SUM(a.amount) FROM weekly_adjustments a WHERE a.stat_id = w.stat_id AND a.week_ending = w.week_ending), 0)
+		FROM weekly_stats w WHERE w.stat_id = ? ORDER BY w.week_ending`, statID)
 	if err != nil {
 		webFail("Failed to query weekly series", w, err)
 		return
@@ -2465,8 +3646,12 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 
 	type seriesRow struct {
 		Weekending   string   `json:"Weekending"`
+		WeekLabel    string   `json:"week_label"` // fiscal week, e.g. FY24-W07
 		Value        float64  `json:"Value"`
+		Adjustment   float64  `json:"Adjustment"`
+		Adjusted     float64  `json:"Adjusted"` // Value plus Adjustment
 		AuthorUserID *int     `json:"author_user_id,omitempty"`
+		Formatted    string   `json:"formatted_value"` // Adjusted as the stat displays it, see statformat.go
 	}
 
 	out := make([]seriesRow, 0)
@@ -2474,7 +3659,8 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		var we string
 		var v sql.NullInt64
 		var author sql.NullInt64
-		if err := rows.Scan(&we, &v, &author); err != nil {
+		var adjustment int64
+		if err := rows.Scan(&we, &v, &author, &adjustment); err != nil {
 			webFail("Failed to scan weekly row", w, err)
 			return
 		}
@@ -2486,13 +3672,19 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 		var value float64
 		switch valueType {
 		case "currency":
-			// stored as cents -> return dollars float
-			value = float64(v.Int64) / 100.0
+			// stored in the currency's minor units -> units of the currency
+			value = statValueToFloat(v.Int64, valueType, format.Currency)
 		case "number":
 			value = float64(v.Int64)
 		case "percentage":
 			// stored as percent * 100 (e.g., 1234 -> 12.34)
 			value = float64(v.Int64) / 100.0
+		case "decimal", "ratio":
+			// stored as ten-thousandths, see valuetypes.go
+			value = float64(v.Int64) / decimalScale
+		case "duration":
+			// stored as seconds -> hours
+			value = float64(v.Int64) / 3600
 		default:
 			value = float64(v.Int64)
 		}
@@ -2502,7 +3694,10 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 			t := int(author.Int64)
 			au = &t
 		}
-		out = append(out, seriesRow{Weekending: we, Value: value, AuthorUserID: au})
+		out = append(out, seriesRow{Weekending: we, WeekLabel: fiscal.label(we), Value: value, AuthorUserID: au,
+			Adjustment: statValueToFloat(adjustment, valueType, format.Currency),
+			Adjusted:   statValueToFloat(v.Int64+adjustment, valueType, format.Currency),
+			Formatted:  format.format(v.Int64 + adjustment)})
 	}
 	if err := rows.Err(); err != nil {
 		webFail("Error iterating series rows", w, err)
@@ -2513,18 +3708,10 @@ func PublicGetStatSeriesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(out)
 }
 
-func getCalculatedFrom(statID int) []int {
-	rows, err := DB.Query(`SELECT dependent_stat_id FROM stat_calculations WHERE stat_id = ? ORDER BY dependent_stat_id`, statID)
+func getCalculatedFrom(statID int) []calcTerm {
+	deps, err := calcTerms(DB, statID)
 	if err != nil {
-		return []int{}
-	}
-	defer rows.Close()
-	var deps []int
-	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err == nil {
-			deps = append(deps, id)
-		}
+		return []calcTerm{}
 	}
 	return deps
 }
@@ -2541,6 +3728,11 @@ type statOut struct {
 	AssignedDivision *int   `json:"division_id,omitempty"`
 	AssignedDivName  *string `json:"division_name,omitempty"`
 	IsCalculated     bool   `json:"is_calculated"`
+	DecimalPlaces    *int   `json:"decimal_places,omitempty"`
+	UnitLabel        string `json:"unit_label,omitempty"`
+	ThousandsSeparator bool `json:"thousands_separator"`
+	Currency         string `json:"currency,omitempty"` // the stat's own; the company's default when empty
+	ArchivedAt       *string `json:"archived_at,omitempty"` // see archive.go
 }
 
 var req struct {
@@ -2555,17 +3747,40 @@ var req struct {
 	CalculatedFrom []int  `json:"calculated_from"`  // Still accept in payload for creation
 }
 
-// Add this helper (place near other helpers)
-func convertStoredIntToFloat(v int64, valueType string) float64 {
+// parseValueByType converts a user-entered value into its stored integer form
+// (cents for currency, hundredths for percentage, plain integer for number,
+// ten-thousandths for decimal and ratio, seconds for duration, see valuetypes.go).
+// Values for a stat go through parseStatValue, which stores amounts in the stat's currency.
+func parseValueByType(raw, valueType string) (int64, error) {
+	raw = strings.TrimSpace(raw)
 	switch valueType {
 	case "currency":
-		return float64(v) / 100.0
+		m, err := StringToMoney(raw)
+		if err != nil {
+			return 0, err
+		}
+		return int64(m.MoneyToUSD()), nil
 	case "number":
-		return float64(v)
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, err
+		}
+		return int64(i), nil
 	case "percentage":
-		return float64(v) / 100.0
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64((f * 100) + 0.5), nil
+	case "decimal":
+		return parseDecimal(raw)
+	case "ratio":
+		v, _, _, err := parseRatio(raw)
+		return v, err
+	case "duration":
+		return parseDuration(raw)
 	default:
-		return float64(v)
+		return 0, fmt.Errorf("unknown value_type: %s", valueType)
 	}
 }
 
@@ -2612,9 +3827,9 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 	// Resolve endWeek: if empty, try latest week_ending for stat
 	var endWeek string
 	if endParam != "" {
-		// validate: must be a Thursday
-		if err := checkIfValidWE(endParam); err != nil {
-			webFail("Invalid end week (must be Thursday YYYY-MM-DD)", w, err)
+		// validate: must be a W/E date
+		if err := checkIfValidWE(r.Context().Value("company_id").(string), endParam); err != nil {
+			webFail("Invalid end week (must be a W/E date YYYY-MM-DD)", w, err)
 			return
 		}
 		endWeek = endParam
@@ -2626,18 +3841,14 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if endWeek == "" {
-			// fallback to current week's Thursday
-			nowUTC := time.Now().UTC()
-			dow := int(nowUTC.Weekday()) // 0=Sun..6=Sat
-			daysUntilThu := (4 - dow + 7) % 7
-			thu := nowUTC.AddDate(0, 0, daysUntilThu)
-			endWeek = thu.Format("2006-01-02")
+			// fallback to the current week's W/E
+			endWeek = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
 		}
 	}
 
 	// Get value_type to convert integer sums to floats
 	var valueType string
-	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? LIMIT 1`, statID).Scan(&valueType); err != nil {
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? AND deleted_at IS NULL LIMIT 1`, statID).Scan(&valueType); err != nil {
 		if err == sql.ErrNoRows {
 			webFail("Stat not found", w, err)
 			return
@@ -2645,11 +3856,34 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 		webFail("Failed to query stat metadata", w, err)
 		return
 	}
+	if refuseArchived(w, r, statID) {
+		return
+	}
 
-	// Response shape: []{ Weekending: string, Value: float64 }
+	// Response shape: []{ Weekending: string, Value: float64, formatted_value: string, currency: string }
 	type outRow struct {
 		Weekending string  `json:"Weekending"`
 		Value      float64 `json:"Value"`
+		Formatted  string  `json:"formatted_value"` // see statformat.go
+		Currency   string  `json:"currency,omitempty"` // currency stats
+	}
+	format := loadStatFormat(statID, requestLocale(r))
+	// convert=1 reports a currency stat in the company's default currency, see currency.go.
+	conv := func(v int64) int64 { return v }
+	if convert, _ := strconv.ParseBool(r.URL.Query().Get("convert")); convert {
+		companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+		if err != nil {
+			webFail("Failed to resolve company", w, err)
+			return
+		}
+		if conv, err = currencyConversion(companyDBID, &format); err != nil {
+			writeConversionError(w, err)
+			return
+		}
+	}
+	var currency string
+	if valueType == "currency" {
+		currency = format.Currency
 	}
 
 	out := []outRow{}
@@ -2681,8 +3915,9 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 			if !v.Valid {
 				continue
 			}
-			val := convertStoredIntToFloat(v.Int64, valueType)
-			tmp = append(tmp, outRow{Weekending: we, Value: val})
+			v.Int64 = conv(v.Int64)
+			val := statValueToFloat(v.Int64, valueType, format.Currency)
+			tmp = append(tmp, outRow{Weekending: we, Value: val, Formatted: format.format(v.Int64), Currency: currency})
 		}
 		// Reverse to ascending
 		for i := len(tmp) - 1; i >= 0; i-- {
@@ -2692,13 +3927,14 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 	case "monthly":
 		// Group by month (YYYY-MM)
 		rows, err := DB.Query(`
-			SELECT strftime('%Y-%m', week_ending) as period, SUM(value) as total
+			SELECT strftime('%Y-%m', week_ending) as period, SUM(value) as total,
+			       SUM(COALESCE(numerator, value)), SUM(COALESCE(denominator, ?))
 			FROM weekly_stats
 			WHERE stat_id = ? AND week_ending <= ?
 			GROUP BY period
 			ORDER BY period DESC
 			LIMIT ?
-		`, statID, endWeek, limit)
+		`, decimalScale, statID, endWeek, limit)
 		if err != nil {
 			webFail("Failed to query monthly stats", w, err)
 			return
@@ -2709,15 +3945,21 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var period string
 			var total sql.NullInt64
-			if err := rows.Scan(&period, &total); err != nil {
+			var num, den int64
+			if err := rows.Scan(&period, &total, &num, &den); err != nil {
 				webFail("Failed to scan monthly row", w, err)
 				return
 			}
+			if valueType == "ratio" && total.Valid {
+				// summed parts, not summed quotients (see valuetypes.go)
+				total.Int64, total.Valid = ratioValue(num, den)
+			}
 			if !total.Valid {
 				continue
 			}
-			val := convertStoredIntToFloat(total.Int64, valueType)
-			tmp = append(tmp, outRow{Weekending: period, Value: val})
+			total.Int64 = conv(total.Int64)
+			val := statValueToFloat(total.Int64, valueType, format.Currency)
+			tmp = append(tmp, outRow{Weekending: period, Value: val, Formatted: format.format(total.Int64), Currency: currency})
 		}
 		for i := len(tmp) - 1; i >= 0; i-- {
 			out = append(out, tmp[i])
@@ -2725,13 +3967,14 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 
 	case "yearly":
 		rows, err := DB.Query(`
-			SELECT strftime('%Y', week_ending) as period, SUM(value) as total
+			SELECT strftime('%Y', week_ending) as period, SUM(value) as total,
+			       SUM(COALESCE(numerator, value)), SUM(COALESCE(denominator, ?))
 			FROM weekly_stats
 			WHERE stat_id = ? AND week_ending <= ?
 			GROUP BY period
 			ORDER BY period DESC
 			LIMIT ?
-		`, statID, endWeek, limit)
+		`, decimalScale, statID, endWeek, limit)
 		if err != nil {
 			webFail("Failed to query yearly stats", w, err)
 			return
@@ -2742,15 +3985,21 @@ func handleGetStatsData(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var period string
 			var total sql.NullInt64
-			if err := rows.Scan(&period, &total); err != nil {
+			var num, den int64
+			if err := rows.Scan(&period, &total, &num, &den); err != nil {
 				webFail("Failed to scan yearly row", w, err)
 				return
 			}
+			if valueType == "ratio" && total.Valid {
+				// summed parts, not summed quotients (see valuetypes.go)
+				total.Int64, total.Valid = ratioValue(num, den)
+			}
 			if !total.Valid {
 				continue
 			}
-			val := convertStoredIntToFloat(total.Int64, valueType)
-			tmp = append(tmp, outRow{Weekending: period, Value: val})
+			total.Int64 = conv(total.Int64)
+			val := statValueToFloat(total.Int64, valueType, format.Currency)
+			tmp = append(tmp, outRow{Weekending: period, Value: val, Formatted: format.format(total.Int64), Currency: currency})
 		}
 		for i := len(tmp) - 1; i >= 0; i-- {
 			out = append(out, tmp[i])
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled maintenance: every STATHQ_MAINTENANCE_INTERVAL (default weekly) at
+// STATHQ_MAINTENANCE_HOUR (UTC, default 3) the job runs PRAGMA integrity_check, the application
+// integrity checks (report only), ANALYZE and VACUUM, and records the outcome in maintenance_runs.
+// VACUUM rewrites the whole file and blocks writers while it runs, hence the off-peak hour.
+// Set STATHQ_MAINTENANCE_INTERVAL=0 to disable the schedule; POST /api/admin/maintenance still runs
+// it on demand. Maintenance covers the whole database, so its routes are for super-admins.
+
+type maintenanceRun struct {
+	ID             int             `json:"id"`
+	StartedAt      string          `json:"started_at"`
+	FinishedAt     string          `json:"finished_at,omitempty"`
+	Trigger        string          `json:"trigger"` // schedule | manual
+	Status         string          `json:"status"`  // running | ok | problems | failed
+	IntegrityCheck []string        `json:"integrity_check,omitempty"`
+	AppChecks      map[string]int  `json:"app_checks,omitempty"`
+	SizeBefore     int64           `json:"size_before"`
+	SizeAfter      int64           `json:"size_after,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Steps          json.RawMessage `json:"steps,omitempty"`
+}
+
+var errMaintenanceRunning = errors.New("maintenance already running")
+
+var (
+	maintenanceMu      sync.Mutex
+	maintenanceRunning bool
+	maintenanceNext    time.Time
+)
+
+// nextMaintenance returns the first time at hour (UTC) at least interval after last.
+func nextMaintenance(last time.Time, interval time.Duration, hour int) time.Time {
+	t := last.Add(interval).UTC()
+	at := time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, time.UTC)
+	if at.Before(t) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at
+}
+
+func StartMaintenanceJob() {
+	interval := envDuration("STATHQ_MAINTENANCE_INTERVAL", 7*24*time.Hour)
+	hour := envInt("STATHQ_MAINTENANCE_HOUR", 3)
+	if interval <= 0 {
+		log.Printf("Scheduled maintenance disabled")
+		return
+	}
+	if hour < 0 || hour > 23 {
+		hour = 3
+	}
+	go func() {
+		for {
+			last := time.Now().Add(-interval)
+			var lastStr string
+			if err := DB.QueryRow(`SELECT started_at FROM maintenance_runs ORDER BY id DESC LIMIT 1`).Scan(&lastStr); err == nil {
+				if t, err := time.Parse(time.RFC3339, lastStr); err == nil {
+					last = t
+				}
+			}
+			next := nextMaintenance(last, interval, hour)
+			maintenanceMu.Lock()
+			maintenanceNext = next
+			maintenanceMu.Unlock()
+			time.Sleep(time.Until(next))
+			if _, err := runMaintenance("schedule"); err != nil {
+				log.Printf("Scheduled maintenance: %v", err)
+				time.Sleep(time.Hour)
+			}
+		}
+	}()
+}
+
+func dbFileSize() int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal"} {
+		if fi, err := os.Stat(dbFile + suffix); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// runMaintenance performs one maintenance pass and records it. It refuses to start while another
+// pass is running.
+func runMaintenance(trigger string) (*maintenanceRun, error) {
+	maintenanceMu.Lock()
+	if maintenanceRunning {
+		maintenanceMu.Unlock()
+		return nil, errMaintenanceRunning
+	}
+	maintenanceRunning = true
+	maintenanceMu.Unlock()
+	defer func() {
+		maintenanceMu.Lock()
+		maintenanceRunning = false
+		maintenanceMu.Unlock()
+	}()
+
+	run := &maintenanceRun{
+		StartedAt:  time.Now().UTC().Format(time.RFC3339),
+		Trigger:    trigger,
+		Status:     "running",
+		SizeBefore: dbFileSize(),
+	}
+	res, err := DB.Exec(`INSERT INTO maintenance_runs (started_at, trigger, status, size_before) VALUES (?, ?, ?, ?)`,
+		run.StartedAt, run.Trigger, run.Status, run.SizeBefore)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	run.ID = int(id)
+	log.Printf("Maintenance %d started (%s)", run.ID, trigger)
+
+	type step struct {
+		Name     string `json:"name"`
+		Duration string `json:"duration"`
+		Error    string `json:"error,omitempty"`
+	}
+	var steps []step
+	timed := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		s := step{Name: name, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		steps = append(steps, s)
+		return err
+	}
+
+	var failed []string
+	timed("integrity_check", func() error {
+		rows, err := DB.Query(`PRAGMA integrity_check`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				return err
+			}
+			run.IntegrityCheck = append(run.IntegrityCheck, line)
+		}
+		return rows.Err()
+	})
+	timed("app_checks", func() error {
+		run.AppChecks = map[string]int{}
+		for _, c := range integrityChecks {
+			n, _, err := findIntegrityIssues(c.Find)
+			if err != nil {
+				return fmt.Errorf("%s: %v", c.Name, err)
+			}
+			if n > 0 {
+				run.AppChecks[c.Name] = n
+			}
+		}
+		return nil
+	})
+	timed("prune_change_log", pruneChangeLog)
+	timed("prune_sessions", pruneExpiredSessions)
+	for _, s := range []struct{ name, sql string }{
+		{"analyze", `ANALYZE`},
+		{"vacuum", `VACUUM`},
+		{"optimize", `PRAGMA optimize`},
+	} {
+		stmt := s.sql
+		timed(s.name, func() error {
+			_, err := DB.Exec(stmt)
+			return err
+		})
+	}
+	for _, s := range steps {
+		if s.Error != "" {
+			failed = append(failed, s.Name+": "+s.Error)
+		}
+	}
+
+	run.SizeAfter = dbFileSize()
+	run.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	switch {
+	case len(failed) > 0:
+		run.Status = "failed"
+		run.Error = strings.Join(failed, "; ")
+	case len(run.IntegrityCheck) != 1 || run.IntegrityCheck[0] != "ok" || len(run.AppChecks) > 0:
+		run.Status = "problems"
+	default:
+		run.Status = "ok"
+	}
+	run.Steps, _ = json.Marshal(steps)
+	integrity, _ := json.Marshal(run.IntegrityCheck)
+	appChecks, _ := json.Marshal(run.AppChecks)
+	if _, err := DB.Exec(`
+		UPDATE maintenance_runs SET finished_at = ?, status = ?, integrity_check = ?, app_checks = ?, size_after = ?, error = ?, steps = ?
+		WHERE id = ?
+	`, run.FinishedAt, run.Status, string(integrity), string(appChecks), run.SizeAfter, nullIfEmpty(run.Error), string(run.Steps), run.ID); err != nil {
+		return run, err
+	}
+	log.Printf("Maintenance %d finished: %s, %d -> %d bytes", run.ID, run.Status, run.SizeBefore, run.SizeAfter)
+	return run, nil
+}
+
+// ---------- GET /api/admin/maintenance ----------
+// The schedule and the last 20 runs.
+func MaintenanceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query(`
+		SELECT id, started_at, COALESCE(finished_at, ''), trigger, status, COALESCE(integrity_check, 'null'),
+		       COALESCE(app_checks, 'null'), size_before, COALESCE(size_after, 0), COALESCE(error, ''), COALESCE(steps, 'null')
+		FROM maintenance_runs ORDER BY id DESC LIMIT 20
+	`)
+	if err != nil {
+		webFail("Failed to query maintenance runs", w, err)
+		return
+	}
+	defer rows.Close()
+	runs := []maintenanceRun{}
+	for rows.Next() {
+		var m maintenanceRun
+		var integrity, appChecks, steps string
+		if err := rows.Scan(&m.ID, &m.StartedAt, &m.FinishedAt, &m.Trigger, &m.Status, &integrity, &appChecks,
+			&m.SizeBefore, &m.SizeAfter, &m.Error, &steps); err != nil {
+			webFail("Failed to scan maintenance runs", w, err)
+			return
+		}
+		json.Unmarshal([]byte(integrity), &m.IntegrityCheck)
+		json.Unmarshal([]byte(appChecks), &m.AppChecks)
+		if steps != "null" {
+			m.Steps = json.RawMessage(steps)
+		}
+		runs = append(runs, m)
+	}
+
+	maintenanceMu.Lock()
+	status := map[string]interface{}{"running": maintenanceRunning, "db_size": dbFileSize(), "runs": runs}
+	if !maintenanceNext.IsZero() {
+		status["next_run"] = maintenanceNext.Format(time.RFC3339)
+	}
+	maintenanceMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// ---------- POST /api/admin/maintenance ----------
+// Runs maintenance now and returns the result. VACUUM blocks writes for its duration.
+func RunMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	run, err := runMaintenance("manual")
+	if err == errMaintenanceRunning {
+		http.Error(w, `{"message":"Maintenance is already running"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		webFail("Failed to record maintenance run", w, err)
+		return
+	}
+	log.Printf("Maintenance run %d triggered by %v", run.ID, r.Context().Value("username"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
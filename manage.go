@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Managers: a user becomes a manager of a division through a row in division_managers (set by an
+// admin). Management is per division rather than a third users.role value, so a manager keeps their
+// own personal stats and sees only the divisions they were given. Admins see every division.
+
+// managedDivisionIDs returns the divisions the caller may oversee: every division in the company for
+// roles that manage divisions (admins, managers), otherwise the ones listed in division_managers.
+func managedDivisionIDs(r *http.Request) ([]int, error) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		return nil, err
+	}
+	q := `SELECT d.id FROM division_managers m JOIN divisions d ON d.id = m.division_id WHERE d.company_id = ? AND m.user_id = ? ORDER BY d.id`
+	args := []interface{}{companyDBID, r.Context().Value("user_id")}
+	if can(r.Context().Value("role").(string), permManageDivisions) {
+		q = `SELECT id FROM divisions WHERE company_id = ? ORDER BY id`
+		args = args[:1]
+	}
+	rows, err := DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ---------- PUT /api/divisions/{id}/managers ----------
+// Body: {"user_ids": [..]} replaces the division's managers.
+func SetDivisionManagersHandler(w http.ResponseWriter, r *http.Request) {
+	divisionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid division id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		UserIDs []int `json:"user_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM divisions WHERE id = ? AND company_id = ?`, divisionID, companyDBID).Scan(&n)
+	if n == 0 {
+		http.Error(w, `{"message":"Division not found"}`, http.StatusNotFound)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM division_managers WHERE division_id = ?`, divisionID); err != nil {
+		webFail("Failed to clear division managers", w, err)
+		return
+	}
+	for _, uid := range req.UserIDs {
+		var ok int
+		tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND company_id = ?`, uid, companyDBID).Scan(&ok)
+		if ok == 0 {
+			http.Error(w, `{"message":"User `+strconv.Itoa(uid)+` not found"}`, http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO division_managers (division_id, user_id) VALUES (?, ?)`, divisionID, uid); err != nil {
+			webFail("Failed to add division manager", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to save division managers", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"division_id": divisionID, "user_ids": req.UserIDs})
+}
+
+type managedStat struct {
+	StatID       int     `json:"stat_id"`
+	ShortID      string  `json:"short_id"`
+	FullName     string  `json:"full_name"`
+	ValueType    string  `json:"value_type"`
+	Reversed     bool    `json:"reversed"`
+	UserID       int     `json:"user_id"`
+	Username     string  `json:"username"`
+	DivisionID   int     `json:"division_id"`
+	DivisionName string  `json:"division_name"`
+	Value        *string `json:"value"`
+	Previous     *string `json:"previous"`
+	Quota        *string `json:"quota"`
+	QuotaMet     *bool   `json:"quota_met"`
+	Submitted    bool    `json:"submitted"`
+	SubmittedAt  string  `json:"submitted_at,omitempty"`
+	Late         bool    `json:"late"`
+	Trend        string  `json:"trend,omitempty"` // up | down | level, in the stat's good direction
+}
+
+// ---------- GET /api/manage/overview?week=YYYY-MM-DD ----------
+// Every personal stat assigned to a division the caller manages, with the week's value, submission
+// status and trend against the previous week. Stats outside those divisions are never returned, even
+// when the same user holds them.
+func ManagerOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	divisions, err := managedDivisionIDs(r)
+	if err != nil {
+		webFail("Failed to query managed divisions", w, err)
+		return
+	}
+	if len(divisions) == 0 {
+		http.Error(w, `{"message":"You do not manage any divisions"}`, http.StatusForbidden)
+		return
+	}
+	prevWeek := week
+	if t, err := time.Parse("2006-01-02", week); err == nil {
+		prevWeek = t.AddDate(0, 0, -7).Format("2006-01-02")
+	}
+	deadline, _ := weekDeadline(week, companyLocation(r.Context().Value("company_id").(string)))
+
+	args := []interface{}{week, week, prevWeek, week}
+	for _, id := range divisions {
+		args = append(args, id)
+	}
+	rows, err := DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.value_type, s.reversed, u.id, u.username, d.id, d.name,
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT submitted_at FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT value FROM stat_quotas WHERE stat_id = s.id AND week_ending = ?)
+		FROM stats s
+		JOIN users u ON u.id = s.assigned_user_id
+		JOIN divisions d ON d.id = s.assigned_division_id
+		WHERE s.type = 'personal' AND s.deleted_at IS NULL AND s.archived_at IS NULL AND s.assigned_division_id IN (?`+strings.Repeat(",?", len(divisions)-1)+`)
+		ORDER BY d.name, u.username, s.short_id
+	`, args...)
+	if err != nil {
+		webFail("Failed to query managed stats", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []managedStat{}
+	for rows.Next() {
+		var m managedStat
+		var cur, prev, quota sql.NullInt64
+		var submitted sql.NullString
+		if err := rows.Scan(&m.StatID, &m.ShortID, &m.FullName, &m.ValueType, &m.Reversed, &m.UserID, &m.Username,
+			&m.DivisionID, &m.DivisionName, &cur, &submitted, &prev, &quota); err != nil {
+			webFail("Failed to scan managed stats", w, err)
+			return
+		}
+		currency := statCurrency(m.StatID)
+		display := func(v sql.NullInt64) *string {
+			if !v.Valid {
+				return nil
+			}
+			s := formatStatValue(v.Int64, m.ValueType, currency)
+			return &s
+		}
+		m.Value, m.Previous, m.Quota = display(cur), display(prev), display(quota)
+		m.Submitted = cur.Valid
+		if submitted.Valid {
+			m.SubmittedAt = submitted.String
+			if at, err := time.Parse(time.RFC3339, submitted.String); err == nil && !deadline.IsZero() {
+				m.Late = at.After(deadline)
+			}
+		} else if !cur.Valid && !deadline.IsZero() {
+			m.Late = time.Now().After(deadline)
+		}
+		if cur.Valid && quota.Valid {
+			met := quotaMet(cur.Int64, quota.Int64, m.Reversed)
+			m.QuotaMet = &met
+		}
+		if cur.Valid && prev.Valid {
+			switch {
+			case cur.Int64 == prev.Int64:
+				m.Trend = "level"
+			case (cur.Int64 > prev.Int64) != m.Reversed:
+				m.Trend = "up"
+			default:
+				m.Trend = "down"
+			}
+		}
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		webFail("Error reading managed stats", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"week_ending": week, "division_ids": divisions, "stats": out})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Business-metric exporter: admins pick stats to publish, and their values are exposed as gauges for
+// the company's monitoring stack, separately from server health. Two outlets share the same gauges:
+//
+//   GET /metrics/business   Prometheus text format; scrape with "Authorization: Bearer <token>",
+//                           the token coming from POST /api/metrics/exporter/token.
+//   StatsD                  every STATHQ_STATSD_INTERVAL (1m) gauges are pushed over UDP to
+//                           STATHQ_STATSD_ADDR (host:port, disabled when empty) under
+//                           STATHQ_STATSD_PREFIX (default "stathq").
+//
+// Per stat: this week's value, last week's value, this week's quota and whether it is reported.
+// Per division: the sum of the division's exported, non-calculated stats of each value type, and of
+// each currency for currency stats. Currency and percentage values are exported in display units
+// (dollars, yen, percent).
+
+type businessGauge struct {
+	Name   string
+	Help   string
+	Labels [][2]string
+	Value  float64
+}
+
+type metricsExporterConfig struct {
+	StatIDs  []int `json:"stat_ids"`
+	TokenSet bool  `json:"token_set"`
+	StatsD   bool  `json:"statsd"`
+}
+
+func storedToFloat(v int64, valueType string) float64 {
+	switch valueType {
+	case "currency", "percentage":
+		return float64(v) / 100.0
+	case "decimal", "ratio":
+		return float64(v) / decimalScale
+	case "duration":
+		return float64(v) / 3600 // hours
+	}
+	return float64(v)
+}
+
+// businessMetrics builds the gauges for a company's exported stats.
+func businessMetrics(companyDBID int) ([]businessGauge, error) {
+	var code string
+	if err := DB.QueryRow(`SELECT company_id FROM companies WHERE id = ?`, companyDBID).Scan(&code); err != nil {
+		return nil, err
+	}
+	week := enteringWeek(companyLocation(code), weekEndingDayOf(companyDBID), time.Now())
+	we, _ := time.Parse("2006-01-02", week)
+	lastWeek := we.AddDate(0, 0, -7).Format("2006-01-02")
+
+	rows, err := DB.Query(`
+		SELECT s.short_id, s.full_name, s.type, s.value_type, COALESCE(s.currency, cs.default_currency, ?), s.is_calculated, COALESCE(d.name, ''),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ?),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ?),
+		       (SELECT value FROM stat_quotas WHERE stat_id = s.id AND week_ending = ?)
+		FROM metric_export_stats m
+		JOIN stats s ON s.id = m.stat_id
+		LEFT JOIN divisions d ON d.id = s.assigned_division_id
+		LEFT JOIN company_settings cs ON cs.company_id = s.company_id
+		WHERE m.company_id = ? AND s.company_id = ?
+		ORDER BY s.short_id
+	`, defaultCurrency, week, lastWeek, week, companyDBID, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Currency stats are summed per currency.
+	type divKey struct{ division, valueType, currency string }
+	divCur, divLast := map[divKey]int64{}, map[divKey]int64{}
+	var divKeys []divKey
+	var gauges []businessGauge
+	for rows.Next() {
+		var shortID, name, typ, valueType, currency, division string
+		var isCalculated bool
+		var cur, last, quota sql.NullInt64
+		if err := rows.Scan(&shortID, &name, &typ, &valueType, &currency, &isCalculated, &division, &cur, &last, &quota); err != nil {
+			return nil, err
+		}
+		labels := [][2]string{{"company", code}, {"stat", shortID}, {"name", name}, {"type", typ}, {"division", division}}
+		reported := 0.0
+		if cur.Valid {
+			reported = 1
+			gauges = append(gauges, businessGauge{"stathq_stat_value", "Value of the stat for the week being entered.", labels, statValueToFloat(cur.Int64, valueType, currency)})
+		}
+		if last.Valid {
+			gauges = append(gauges, businessGauge{"stathq_stat_last_week_value", "Value of the stat for the previous week.", labels, statValueToFloat(last.Int64, valueType, currency)})
+		}
+		if quota.Valid {
+			gauges = append(gauges, businessGauge{"stathq_stat_quota", "Quota of the stat for the week being entered.", labels, statValueToFloat(quota.Int64, valueType, currency)})
+		}
+		gauges = append(gauges, businessGauge{"stathq_stat_reported", "1 when the stat has a value for the week being entered.", labels, reported})
+
+		if isCalculated || division == "" {
+			continue
+		}
+		k := divKey{division, valueType, ""}
+		if valueType == "currency" {
+			k.currency = currency
+		}
+		if _, ok := divCur[k]; !ok {
+			divKeys = append(divKeys, k)
+			divCur[k], divLast[k] = 0, 0
+		}
+		divCur[k] += cur.Int64
+		divLast[k] += last.Int64
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, k := range divKeys {
+		labels := [][2]string{{"company", code}, {"division", k.division}, {"value_type", k.valueType}}
+		if k.currency != "" {
+			labels = append(labels, [2]string{"currency", k.currency})
+		}
+		gauges = append(gauges,
+			businessGauge{"stathq_division_value", "Sum of the division's exported stats for the week being entered.", labels, statValueToFloat(divCur[k], k.valueType, k.currency)},
+			businessGauge{"stathq_division_last_week_value", "Sum of the division's exported stats for the previous week.", labels, statValueToFloat(divLast[k], k.valueType, k.currency)})
+	}
+	return gauges, nil
+}
+
+// writePrometheus renders gauges in the Prometheus text exposition format, grouped by metric name.
+func writePrometheus(w http.ResponseWriter, gauges []businessGauge) {
+	sort.SliceStable(gauges, func(i, j int) bool { return gauges[i].Name < gauges[j].Name })
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	for i, g := range gauges {
+		if i == 0 || gauges[i-1].Name != g.Name {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", g.Name, g.Help, g.Name)
+		}
+		b.WriteString(g.Name)
+		b.WriteByte('{')
+		for j, l := range g.Labels {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, l[0], escape.Replace(l[1]))
+		}
+		fmt.Fprintf(&b, "} %g\n", g.Value)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// ---------- GET /metrics/business ----------
+func BusinessMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	var companyDBID int
+	err := DB.QueryRow(`SELECT id FROM companies WHERE metrics_token_hash = ?`,
+		hashSecretToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))).Scan(&companyDBID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		webFail("Failed to check metrics token", w, err)
+		return
+	}
+	gauges, err := businessMetrics(companyDBID)
+	if err != nil {
+		webFail("Failed to collect business metrics", w, err)
+		return
+	}
+	writePrometheus(w, gauges)
+}
+
+// statsdName turns a label value into a dot-free StatsD path segment.
+func statsdName(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// StartStatsDExporter pushes every company's business gauges to StatsD on a ticker.
+func StartStatsDExporter() {
+	addr := envString("STATHQ_STATSD_ADDR", "")
+	if addr == "" {
+		return
+	}
+	prefix := envString("STATHQ_STATSD_PREFIX", "stathq")
+	interval := envDuration("STATHQ_STATSD_INTERVAL", time.Minute)
+	log.Printf("Pushing business metrics to StatsD at %s every %s", addr, interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := pushStatsD(addr, prefix); err != nil {
+				log.Printf("StatsD export: %v", err)
+			}
+		}
+	}()
+}
+
+func pushStatsD(addr, prefix string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := DB.Query(`SELECT DISTINCT company_id FROM metric_export_stats`)
+	if err != nil {
+		return err
+	}
+	var companies []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		companies = append(companies, id)
+	}
+	rows.Close()
+
+	for _, companyDBID := range companies {
+		gauges, err := businessMetrics(companyDBID)
+		if err != nil {
+			return err
+		}
+		// Keep packets under a typical MTU; StatsD accepts several newline-separated metrics each.
+		var packet strings.Builder
+		for _, g := range gauges {
+			label := map[string]string{}
+			for _, l := range g.Labels {
+				label[l[0]] = l[1]
+			}
+			path := []string{prefix, statsdName(label["company"])}
+			if label["stat"] != "" {
+				path = append(path, "stat", statsdName(label["stat"]), strings.TrimPrefix(g.Name, "stathq_stat_"))
+			} else {
+				path = append(path, "division", statsdName(label["division"]), label["value_type"], strings.TrimPrefix(g.Name, "stathq_division_"))
+			}
+			line := fmt.Sprintf("%s:%g|g\n", strings.Join(path, "."), g.Value)
+			if packet.Len()+len(line) > 1400 {
+				conn.Write([]byte(packet.String()))
+				packet.Reset()
+			}
+			packet.WriteString(line)
+		}
+		if packet.Len() > 0 {
+			conn.Write([]byte(packet.String()))
+		}
+	}
+	return nil
+}
+
+// ---------- GET /api/metrics/exporter ----------
+func GetMetricsExporterHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	cfg := metricsExporterConfig{StatIDs: []int{}, StatsD: envString("STATHQ_STATSD_ADDR", "") != ""}
+	var hash sql.NullString
+	if err := DB.QueryRow(`SELECT metrics_token_hash FROM companies WHERE id = ?`, companyDBID).Scan(&hash); err != nil {
+		webFail("Failed to load company", w, err)
+		return
+	}
+	cfg.TokenSet = hash.Valid && hash.String != ""
+	rows, err := DB.Query(`SELECT stat_id FROM metric_export_stats WHERE company_id = ? ORDER BY stat_id`, companyDBID)
+	if err != nil {
+		webFail("Failed to query exported stats", w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			webFail("Failed to scan exported stat", w, err)
+			return
+		}
+		cfg.StatIDs = append(cfg.StatIDs, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// ---------- PUT /api/metrics/exporter ----------
+// Body: { "stat_ids": [1, 2] } replaces the set of exported stats.
+func UpdateMetricsExporterHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		StatIDs []int `json:"stat_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	for _, id := range req.StatIDs {
+		if status, msg := checkStatCompany(r, id); status != 0 {
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d: %s"}`, id, msg), status)
+			return
+		}
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to begin transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM metric_export_stats WHERE company_id = ?`, companyDBID); err != nil {
+		webFail("Failed to clear exported stats", w, err)
+		return
+	}
+	for _, id := range req.StatIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO metric_export_stats (stat_id, company_id) VALUES (?, ?)`, id, companyDBID); err != nil {
+			webFail("Failed to save exported stats", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit", w, err)
+		return
+	}
+	GetMetricsExporterHandler(w, r)
+}
+
+// ---------- POST /api/metrics/exporter/token ----------
+// Issues a new scrape token for /metrics/business, replacing the previous one. It is returned once.
+func RotateMetricsTokenHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate token", w, err)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET metrics_token_hash = ? WHERE id = ?`, hash, companyDBID); err != nil {
+		webFail("Failed to save metrics token", w, err)
+		return
+	}
+	log.Printf("Rotated business metrics token for company %d", companyDBID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token, "url": shardLink(publicURL(r) + "/metrics/business")})
+}
+
+// ---------- DELETE /api/metrics/exporter/token ----------
+func RevokeMetricsTokenHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET metrics_token_hash = NULL WHERE id = ?`, companyDBID); err != nil {
+		webFail("Failed to revoke metrics token", w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
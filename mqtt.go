@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MQTT ingestion bridge: subscribes to shop-floor sensor topics and writes numeric payloads into
+// daily_stats for the mapped stat. Only what a QoS 0 subscriber needs of MQTT 3.1.1 is implemented.
+//
+//   STATHQ_MQTT_BROKER     tcp://host:1883 or ssl://host:8883 (bridge disabled when empty)
+//   STATHQ_MQTT_USERNAME / STATHQ_MQTT_PASSWORD
+//   STATHQ_MQTT_CLIENT_ID  default "stathq"
+//   STATHQ_MQTT_TOPICS     comma-separated topic=stat_id[:set], e.g. "plant/line1/count=12,plant/door=15:set"
+//                          (MQTT wildcards + and # are allowed). Payloads are added to the day's value,
+//                          or replace it with ":set".
+
+type mqttMapping struct {
+	Topic  string
+	StatID int
+	Set    bool
+}
+
+type mqttConfig struct {
+	Broker   *url.URL
+	Username string
+	Password string
+	ClientID string
+	Mappings []mqttMapping
+}
+
+const mqttKeepAlive = 60 * time.Second
+
+func loadMQTTConfig() (*mqttConfig, error) {
+	broker := envString("STATHQ_MQTT_BROKER", "")
+	if broker == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid STATHQ_MQTT_BROKER %q", broker)
+	}
+	cfg := &mqttConfig{
+		Broker:   u,
+		Username: envString("STATHQ_MQTT_USERNAME", ""),
+		Password: envString("STATHQ_MQTT_PASSWORD", ""),
+		ClientID: envString("STATHQ_MQTT_CLIENT_ID", "stathq"),
+	}
+	for _, entry := range strings.Split(envString("STATHQ_MQTT_TOPICS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid STATHQ_MQTT_TOPICS entry %q (want topic=stat_id)", entry)
+		}
+		m := mqttMapping{Topic: entry[:i]}
+		target := entry[i+1:]
+		if strings.HasSuffix(target, ":set") {
+			m.Set = true
+			target = strings.TrimSuffix(target, ":set")
+		}
+		if m.StatID, err = strconv.Atoi(target); err != nil {
+			return nil, fmt.Errorf("invalid stat id in STATHQ_MQTT_TOPICS entry %q", entry)
+		}
+		cfg.Mappings = append(cfg.Mappings, m)
+	}
+	if len(cfg.Mappings) == 0 {
+		return nil, errors.New("STATHQ_MQTT_TOPICS is empty")
+	}
+	return cfg, nil
+}
+
+// StartMQTTBridge connects to the configured broker in the background, reconnecting with backoff.
+func StartMQTTBridge() {
+	cfg, err := loadMQTTConfig()
+	if err != nil {
+		log.Printf("MQTT bridge disabled: %v", err)
+		return
+	}
+	if cfg == nil {
+		return
+	}
+	go func() {
+		backoff := time.Second
+		for {
+			start := time.Now()
+			err := mqttRun(cfg)
+			log.Printf("MQTT bridge disconnected: %v", err)
+			if time.Since(start) > time.Minute {
+				backoff = time.Second
+			}
+			time.Sleep(backoff)
+			if backoff < 2*time.Minute {
+				backoff *= 2
+			}
+		}
+	}()
+	log.Printf("MQTT bridge starting for %s (%d topic mappings)", cfg.Broker.Host, len(cfg.Mappings))
+}
+
+// mqttRun holds one broker session until it fails.
+func mqttRun(cfg *mqttConfig) error {
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+	var conn net.Conn
+	var err error
+	switch cfg.Broker.Scheme {
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.Broker.Host, &tls.Config{ServerName: cfg.Broker.Hostname()})
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", cfg.Broker.Host)
+	default:
+		return fmt.Errorf("unsupported broker scheme %q", cfg.Broker.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// CONNECT
+	flags := byte(0x02) // clean session
+	payload := mqttString(cfg.ClientID)
+	if cfg.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(cfg.Username)...)
+		if cfg.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(cfg.Password)...)
+		}
+	}
+	vh := append(mqttString("MQTT"), 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	if err := mqttWrite(conn, 0x10, append(vh, payload...)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	typ, body, err := mqttRead(r)
+	if err != nil {
+		return err
+	}
+	if typ>>4 != 2 || len(body) < 2 {
+		return errors.New("expected CONNACK")
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("broker refused connection (code %d)", body[1])
+	}
+
+	// SUBSCRIBE to every mapped topic at QoS 0
+	sub := []byte{0, 1}
+	for _, m := range cfg.Mappings {
+		sub = append(sub, mqttString(m.Topic)...)
+		sub = append(sub, 0)
+	}
+	if err := mqttWrite(conn, 0x82, sub); err != nil {
+		return err
+	}
+	log.Printf("MQTT bridge connected to %s", cfg.Broker.Host)
+
+	pingPending := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive / 2))
+		typ, body, err := mqttRead(r)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if pingPending {
+				return errors.New("broker did not answer PINGREQ")
+			}
+			if err := mqttWrite(conn, 0xc0, nil); err != nil {
+				return err
+			}
+			pingPending = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pingPending = false
+
+		switch typ >> 4 {
+		case 3: // PUBLISH
+			qos := (typ >> 1) & 0x03
+			if len(body) < 2 {
+				continue
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+n {
+				continue
+			}
+			topic := string(body[2 : 2+n])
+			rest := body[2+n:]
+			if qos > 0 && len(rest) >= 2 {
+				if err := mqttWrite(conn, 0x40, rest[:2]); err != nil { // PUBACK
+					return err
+				}
+				rest = rest[2:]
+			}
+			mqttHandleMessage(cfg, topic, rest)
+		case 9, 13: // SUBACK, PINGRESP
+		}
+	}
+}
+
+// mqttHandleMessage writes a numeric payload into every stat mapped to the topic.
+func mqttHandleMessage(cfg *mqttConfig, topic string, payload []byte) {
+	raw := strings.TrimSpace(string(payload))
+	var obj struct {
+		Value *float64 `json:"value"`
+	}
+	if strings.HasPrefix(raw, "{") {
+		if err := json.Unmarshal([]byte(raw), &obj); err != nil || obj.Value == nil {
+			log.Printf("MQTT %s: payload has no numeric value: %q", topic, raw)
+			return
+		}
+		raw = strconv.FormatFloat(*obj.Value, 'f', -1, 64)
+	}
+
+	date := time.Now().UTC().Format("2006-01-02")
+	for _, m := range cfg.Mappings {
+		if !mqttTopicMatch(m.Topic, topic) {
+			continue
+		}
+		var valueType string
+		var isCalculated bool
+		var companyDBID int
+		if err := DB.QueryRow(`SELECT value_type, is_calculated, company_id FROM stats WHERE id = ? AND deleted_at IS NULL`, m.StatID).Scan(&valueType, &isCalculated, &companyDBID); err != nil {
+			log.Printf("MQTT %s: stat %d not found: %v", topic, m.StatID, err)
+			continue
+		}
+		if status, msg, err := companyWritable(companyDBID); err != nil {
+			log.Printf("MQTT %s: failed to check the company of stat %d: %v", topic, m.StatID, err)
+			continue
+		} else if status != 0 {
+			log.Printf("MQTT %s: stat %d not written: %s", topic, m.StatID, msg)
+			continue
+		}
+		if isCalculated {
+			log.Printf("MQTT %s: stat %d is calculated and cannot receive values", topic, m.StatID)
+			continue
+		}
+		v, err := parseStatValue(raw, valueType, statCurrency(m.StatID))
+		if err != nil {
+			log.Printf("MQTT %s: invalid %s payload %q", topic, valueType, raw)
+			continue
+		}
+		if _, err := writeDailyValue(m.StatID, date, v, !m.Set); err != nil {
+			log.Printf("MQTT %s: failed to write stat %d: %v", topic, m.StatID, err)
+		}
+	}
+}
+
+// mqttTopicMatch reports whether topic matches filter, honouring + and # wildcards.
+func mqttTopicMatch(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttWrite(w io.Writer, header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(pkt, body...))
+	return err
+}
+
+func mqttRead(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i >= 3 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		mult *= 128
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("MQTT packet too large")
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
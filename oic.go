@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Printable OIC board: GET /api/reports/oic.pdf renders every division's stats for a week as
+// cards with a 12-week mini-graph, coloured by the stat's assigned condition (or, when none is
+// assigned, by its trend against the previous week). Divisions are columns, as on the wall board.
+
+var oicPageSizes = map[string][2]float64{
+	"a3":      {1190.55, 841.89}, // landscape
+	"a4":      {841.89, 595.28},
+	"tabloid": {1224, 792},
+	"letter":  {792, 612},
+}
+
+// conditionColors are the card colours per condition or trend.
+var conditionColors = map[string][3]float64{
+	"power":         {0.13, 0.55, 0.13},
+	"power_change":  {0.20, 0.60, 0.20},
+	"affluence":     {0.40, 0.75, 0.30},
+	"normal":        {0.65, 0.85, 0.55},
+	"up":            {0.65, 0.85, 0.55},
+	"level":         {0.95, 0.90, 0.55},
+	"emergency":     {0.98, 0.80, 0.35},
+	"down":          {0.98, 0.80, 0.35},
+	"danger":        {0.95, 0.45, 0.35},
+	"crashed":       {0.95, 0.45, 0.35},
+	"non_existence": {0.75, 0.25, 0.25},
+	"liability":     {0.60, 0.60, 0.60},
+	"doubt":         {0.55, 0.55, 0.55},
+	"enemy":         {0.45, 0.45, 0.45},
+	"treason":       {0.40, 0.40, 0.40},
+	"confusion":     {0.35, 0.35, 0.35},
+	"":              {0.92, 0.92, 0.92},
+}
+
+type oicStat struct {
+	ID        int
+	ShortID   string
+	FullName  string
+	ValueType string
+	Reversed  bool
+	Values    []*int64 // one per week, oldest first; nil = not reported
+	Condition string
+}
+
+type oicDivision struct {
+	Name  string
+	Stats []*oicStat
+}
+
+// ---------- GET /api/reports/oic.pdf?week=YYYY-MM-DD&size=a3 ----------
+func OICReportHandler(w http.ResponseWriter, r *http.Request) {
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	size, ok := oicPageSizes[strings.ToLower(r.URL.Query().Get("size"))]
+	if !ok {
+		size = oicPageSizes["a3"]
+	}
+	companyID := r.Context().Value("company_id").(string)
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	weeks, err := lastWeekEndings(week, 12)
+	if err != nil {
+		webFail("Failed to compute weeks", w, err)
+		return
+	}
+	divs, err := loadOICBoard(companyDBID, weeks)
+	if err != nil {
+		webFail("Failed to load OIC board", w, err)
+		return
+	}
+	var companyName string
+	DB.QueryRow(`SELECT name FROM companies WHERE id = ?`, companyDBID).Scan(&companyName)
+
+	doc := renderOICBoard(size[0], size[1], companyName, week, divs)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="oic-%s.pdf"`, week))
+	w.Write(doc.Bytes())
+}
+
+// loadOICBoard loads the company's stats grouped by division with their values for weeks.
+func loadOICBoard(companyDBID int, weeks []string) ([]*oicDivision, error) {
+	week := weeks[len(weeks)-1]
+	byID := map[int]*oicDivision{}
+	var divs []*oicDivision
+	rows, err := DB.Query(`SELECT id, name FROM divisions WHERE company_id = ? ORDER BY name`, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		d := &oicDivision{}
+		if err := rows.Scan(&id, &d.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byID[id] = d
+		divs = append(divs, d)
+	}
+	rows.Close()
+	unassigned := &oicDivision{Name: "Unassigned"}
+
+	rows, err = DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.value_type, s.reversed, s.assigned_division_id, s.is_calculated, COALESCE(c.condition, '')
+		FROM stats s LEFT JOIN stat_conditions c ON c.stat_id = s.id AND c.week_ending = ?
+		WHERE s.company_id = ? AND s.deleted_at IS NULL AND s.archived_at IS NULL
+		ORDER BY s.short_id
+	`, week, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		stat       *oicStat
+		divID      sql.NullInt64
+		calculated bool
+	}
+	var all []row
+	for rows.Next() {
+		var rw row
+		rw.stat = &oicStat{}
+		if err := rows.Scan(&rw.stat.ID, &rw.stat.ShortID, &rw.stat.FullName, &rw.stat.ValueType, &rw.stat.Reversed, &rw.divID, &rw.calculated, &rw.stat.Condition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		all = append(all, rw)
+	}
+	rows.Close()
+
+	for _, rw := range all {
+		sources, op := []calcTerm{{StatID: rw.stat.ID, Sign: 1}}, calcOpSum
+		if rw.calculated {
+			sources = getCalculatedFrom(rw.stat.ID)
+			if op, err = calcOperator(DB, rw.stat.ID); err != nil {
+				return nil, err
+			}
+		}
+		currency := statCurrency(rw.stat.ID)
+		rw.stat.Values = make([]*int64, len(weeks))
+		for i, we := range weeks {
+			values := make([]*int64, len(sources))
+			for j, src := range sources {
+				var v int64
+				err := DB.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, src.StatID, we).Scan(&v)
+				if err == nil {
+					values[j] = &v
+				} else if err != sql.ErrNoRows {
+					return nil, err
+				}
+			}
+			if v, ok := evalCalc(op, sources, values, rw.stat.ValueType, currency); ok {
+				rw.stat.Values[i] = &v
+			}
+		}
+		if rw.stat.Condition == "" {
+			n := len(weeks)
+			if cur, prev := rw.stat.Values[n-1], rw.stat.Values[n-2]; cur != nil && prev != nil {
+				rw.stat.Condition = weekTrend(*cur, *prev, rw.stat.Reversed)
+			}
+		}
+
+		d := unassigned
+		if rw.divID.Valid && byID[int(rw.divID.Int64)] != nil {
+			d = byID[int(rw.divID.Int64)]
+		}
+		d.Stats = append(d.Stats, rw.stat)
+	}
+	if len(unassigned.Stats) > 0 {
+		divs = append(divs, unassigned)
+	}
+	return divs, nil
+}
+
+// renderOICBoard lays out divisions as columns of stat cards, paginating across and down.
+func renderOICBoard(pageW, pageH float64, companyName, week string, divs []*oicDivision) *pdfDoc {
+	const margin, headerH, divHeaderH, cardH, gap = 28.0, 40.0, 22.0, 92.0, 6.0
+	colW := 210.0
+	cols := int((pageW - 2*margin + gap) / (colW + gap))
+	if cols < 1 {
+		cols = 1
+	}
+	colW = (pageW - 2*margin - float64(cols-1)*gap) / float64(cols)
+	rowsPerPage := int((pageH - 2*margin - headerH - divHeaderH + gap) / (cardH + gap))
+	if rowsPerPage < 1 {
+		rowsPerPage = 1
+	}
+
+	doc := newPDF(pageW, pageH)
+	pageNo := 0
+	header := func() {
+		doc.AddPage()
+		pageNo++
+		doc.FillColor(0, 0, 0)
+		doc.Text(margin, margin+16, 18, true, fmt.Sprintf("%s - Org Board Stats", companyName))
+		doc.Text(pageW-margin-170, margin+16, 11, false, fmt.Sprintf("W/E %s   page %d", week, pageNo))
+	}
+
+	if len(divs) == 0 {
+		header()
+		doc.Text(margin, margin+headerH+20, 12, false, "No stats.")
+		return doc
+	}
+
+	for start := 0; start < len(divs); start += cols {
+		group := divs[start:]
+		if len(group) > cols {
+			group = group[:cols]
+		}
+		maxRows := 0
+		for _, d := range group {
+			if len(d.Stats) > maxRows {
+				maxRows = len(d.Stats)
+			}
+		}
+		for first := 0; first == 0 || first < maxRows; first += rowsPerPage {
+			header()
+			for ci, d := range group {
+				x := margin + float64(ci)*(colW+gap)
+				y := margin + headerH
+				doc.FillColor(0.15, 0.2, 0.35)
+				doc.Rect(x, y, colW, divHeaderH-4, true, false)
+				doc.FillColor(1, 1, 1)
+				doc.Text(x+6, y+13, 11, true, doc.FitText(d.Name, 11, colW-12))
+				y += divHeaderH
+				for i := first; i < len(d.Stats) && i < first+rowsPerPage; i++ {
+					drawOICCard(doc, x, y, colW, cardH, d.Stats[i])
+					y += cardH + gap
+				}
+			}
+			if maxRows == 0 {
+				break
+			}
+		}
+	}
+	return doc
+}
+
+func drawOICCard(doc *pdfDoc, x, y, w, h float64, s *oicStat) {
+	c, ok := conditionColors[s.Condition]
+	if !ok {
+		c = conditionColors[""]
+	}
+	doc.FillColor(c[0], c[1], c[2])
+	doc.StrokeColor(0.3, 0.3, 0.3)
+	doc.LineWidth(0.5)
+	doc.Rect(x, y, w, h, true, true)
+
+	doc.FillColor(0, 0, 0)
+	doc.Text(x+6, y+13, 10, true, doc.FitText(s.ShortID, 10, w*0.45))
+	value := "-"
+	if v := s.Values[len(s.Values)-1]; v != nil {
+		value = formatStatValue(*v, s.ValueType, statCurrency(s.ID))
+	}
+	doc.Text(x+w-6-doc.TextWidth(value, 10), y+13, 10, true, value)
+	doc.Text(x+6, y+25, 7, false, doc.FitText(s.FullName, 7, w-12))
+	if s.Condition != "" {
+		label := strings.ToUpper(strings.ReplaceAll(s.Condition, "_", " "))
+		doc.Text(x+w-6-doc.TextWidth(label, 6), y+25, 6, false, label)
+	}
+
+	// Mini-graph of the reported weeks.
+	gx, gy, gw, gh := x+6, y+32, w-12, h-38
+	doc.FillColor(1, 1, 1)
+	doc.Rect(gx, gy, gw, gh, true, false)
+	var vals []int64
+	for _, v := range s.Values {
+		if v != nil {
+			vals = append(vals, *v)
+		}
+	}
+	if len(vals) == 0 {
+		return
+	}
+	sorted := append([]int64(nil), vals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	lo, hi := float64(sorted[0]), float64(sorted[len(sorted)-1])
+	if hi == lo {
+		hi, lo = hi+1, lo-1
+	}
+	step := gw / float64(len(s.Values)-1)
+	var pts []float64
+	doc.StrokeColor(0.1, 0.1, 0.5)
+	doc.LineWidth(1.2)
+	for i, v := range s.Values {
+		if v == nil {
+			doc.Polyline(pts...)
+			pts = nil
+			continue
+		}
+		px := gx + float64(i)*step
+		py := gy + gh - 3 - (float64(*v)-lo)/(hi-lo)*(gh-6)
+		pts = append(pts, px, py)
+	}
+	if len(pts) == 2 {
+		doc.Rect(pts[0]-1, pts[1]-1, 2, 2, true, false)
+	}
+	doc.Polyline(pts...)
+}
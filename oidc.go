@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Single sign-on with Google and Microsoft (OpenID Connect, authorization code flow with PKCE).
+//
+// The login page sends the browser to /auth/oidc/start?company_id=ACME&provider=google; the
+// provider returns to /auth/oidc/callback, which signs in the company user whose verified StatHQ
+// email matches the account's email. Nobody is created by SSO: users are invited as before and must
+// have verified their address (see email.go). Each company chooses its providers with
+// /api/company/sso; Microsoft additionally needs the company's Entra tenant id, since an email in a
+// Microsoft account is only as trustworthy as the tenant that issued it. An optional email domain
+// limits SSO to company addresses.
+//
+// The ID token comes straight from the provider's token endpoint over TLS, which OIDC accepts in
+// place of checking its signature; issuer, audience, expiry and nonce are still checked.
+//
+//   STATHQ_OIDC_GOOGLE_CLIENT_ID, STATHQ_OIDC_GOOGLE_CLIENT_SECRET
+//   STATHQ_OIDC_MICROSOFT_CLIENT_ID, STATHQ_OIDC_MICROSOFT_CLIENT_SECRET
+//
+// The redirect URI to register with the providers is <STATHQ_PUBLIC_URL>/auth/oidc/callback.
+
+const oidcStateCookie = "oidc-state"
+
+type oidcProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
+var oidcIssuers = map[string]string{
+	"google":    "https://accounts.google.com",
+	"microsoft": "https://login.microsoftonline.com/organizations/v2.0",
+}
+
+// oidcProviderConfig returns a provider configured on this server.
+func oidcProviderConfig(name string) (oidcProvider, bool) {
+	issuer, ok := oidcIssuers[name]
+	if !ok {
+		return oidcProvider{}, false
+	}
+	key := "STATHQ_OIDC_" + strings.ToUpper(name)
+	p := oidcProvider{
+		Name:         name,
+		Issuer:       issuer,
+		ClientID:     envString(key+"_CLIENT_ID", ""),
+		ClientSecret: envString(key+"_CLIENT_SECRET", ""),
+	}
+	return p, p.ClientID != "" && p.ClientSecret != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var (
+	oidcClient     = &http.Client{Timeout: 15 * time.Second}
+	oidcDiscoverMu sync.Mutex
+	oidcDiscovered = map[string]oidcDiscovery{}
+)
+
+// oidcDiscover fetches (once) the provider's OpenID configuration.
+func oidcDiscover(p oidcProvider) (oidcDiscovery, error) {
+	oidcDiscoverMu.Lock()
+	defer oidcDiscoverMu.Unlock()
+	if d, ok := oidcDiscovered[p.Name]; ok {
+		return d, nil
+	}
+	resp, err := oidcClient.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return oidcDiscovery{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oidcDiscovery{}, fmt.Errorf("discovery for %s: %s", p.Name, resp.Status)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return oidcDiscovery{}, err
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return oidcDiscovery{}, fmt.Errorf("discovery for %s: missing endpoints", p.Name)
+	}
+	oidcDiscovered[p.Name] = d
+	return d, nil
+}
+
+type companySSOProvider struct {
+	Provider    string `json:"provider"`
+	TenantID    string `json:"tenant_id,omitempty"`
+	EmailDomain string `json:"email_domain,omitempty"`
+}
+
+// loadCompanySSOProvider returns the company's settings for a provider; sql.ErrNoRows means the
+// company does not allow it.
+func loadCompanySSOProvider(companyDBID int, provider string) (companySSOProvider, error) {
+	c := companySSOProvider{Provider: provider}
+	err := DB.QueryRow(`SELECT COALESCE(tenant_id, ''), COALESCE(email_domain, '') FROM company_sso_providers WHERE company_id = ? AND provider = ?`,
+		companyDBID, provider).Scan(&c.TenantID, &c.EmailDomain)
+	return c, err
+}
+
+// oidcState travels in a signed, encrypted cookie between start and callback.
+type oidcState struct {
+	State     string
+	Nonce     string
+	Verifier  string
+	Provider  string
+	Company   string
+	Remember  bool
+	CreatedAt int64
+}
+
+func oidcRandom() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// oidcFail sends the browser back to the login page with an error code the page can show.
+func oidcFail(w http.ResponseWriter, r *http.Request, code, logMsg string) {
+	log.Printf("SSO login failed (%s): %s", code, logMsg)
+	http.Redirect(w, r, "/login?sso_error="+url.QueryEscape(code), http.StatusFound)
+}
+
+// ---------- GET /auth/oidc/start?company_id=&provider=&remember_me= ----------
+func OIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code := strings.TrimSpace(q.Get("company_id"))
+	p, ok := oidcProviderConfig(q.Get("provider"))
+	if !ok {
+		http.Error(w, `{"message":"Unknown or unconfigured provider"}`, http.StatusNotFound)
+		return
+	}
+	companyDBID, err := companyDBID(code)
+	if err != nil {
+		oidcFail(w, r, "not_enabled", "unknown company "+code)
+		return
+	}
+	if _, err := loadCompanySSOProvider(companyDBID, p.Name); err != nil {
+		oidcFail(w, r, "not_enabled", fmt.Sprintf("%s not enabled for %s: %v", p.Name, code, err))
+		return
+	}
+	d, err := oidcDiscover(p)
+	if err != nil {
+		oidcFail(w, r, "provider_unavailable", err.Error())
+		return
+	}
+
+	st := oidcState{
+		State:     oidcRandom(),
+		Nonce:     oidcRandom(),
+		Verifier:  oidcRandom(),
+		Provider:  p.Name,
+		Company:   code,
+		Remember:  q.Get("remember_me") == "1" || q.Get("remember_me") == "true",
+		CreatedAt: time.Now().Unix(),
+	}
+	encoded, err := securecookie.EncodeMulti(oidcStateCookie, st, store.Codecs...)
+	if err != nil {
+		webFail("Failed to start sign-in", w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    encoded,
+		Path:     "/auth/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   store.Options.Secure,
+		SameSite: http.SameSiteLaxMode, // sent on the provider's top-level redirect back
+	})
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {publicURL(r) + "/auth/oidc/callback"},
+		"scope":                 {"openid email profile"},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"prompt":                {"select_account"},
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+}
+
+type oidcIDClaims struct {
+	Issuer            string          `json:"iss"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     interface{}     `json:"email_verified"` // bool, or "true" from some providers
+	TenantID          string          `json:"tid"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+func (c oidcIDClaims) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	for _, a := range many {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcExchange redeems the authorization code and returns the ID token's claims.
+func oidcExchange(p oidcProvider, d oidcDiscovery, r *http.Request, code, verifier string) (oidcIDClaims, error) {
+	var claims oidcIDClaims
+	resp, err := oidcClient.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {publicURL(r) + "/auth/oidc/callback"},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return claims, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return claims, err
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return claims, fmt.Errorf("token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	parts := strings.Split(tok.IDToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id_token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
+
+// ---------- GET /auth/oidc/callback ----------
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	var st oidcState
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || securecookie.DecodeMulti(oidcStateCookie, c.Value, &st, store.Codecs...) != nil {
+		oidcFail(w, r, "expired", "missing or invalid state cookie")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1})
+	q := r.URL.Query()
+	if q.Get("state") != st.State || time.Now().Unix()-st.CreatedAt > 600 {
+		oidcFail(w, r, "expired", "state mismatch or expired")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		oidcFail(w, r, "denied", e+": "+q.Get("error_description"))
+		return
+	}
+	p, ok := oidcProviderConfig(st.Provider)
+	if !ok {
+		oidcFail(w, r, "not_enabled", "provider no longer configured")
+		return
+	}
+	companyDBID, err := companyDBID(st.Company)
+	if err != nil {
+		oidcFail(w, r, "not_enabled", "unknown company "+st.Company)
+		return
+	}
+	cfg, err := loadCompanySSOProvider(companyDBID, p.Name)
+	if err != nil {
+		oidcFail(w, r, "not_enabled", fmt.Sprintf("%s not enabled for %s", p.Name, st.Company))
+		return
+	}
+	d, err := oidcDiscover(p)
+	if err != nil {
+		oidcFail(w, r, "provider_unavailable", err.Error())
+		return
+	}
+	claims, err := oidcExchange(p, d, r, q.Get("code"), st.Verifier)
+	if err != nil {
+		oidcFail(w, r, "provider_unavailable", err.Error())
+		return
+	}
+
+	issuer := strings.Replace(d.Issuer, "{tenantid}", claims.TenantID, 1)
+	if claims.Issuer != issuer || !claims.hasAudience(p.ClientID) || claims.Nonce != st.Nonce || time.Now().Unix() >= claims.ExpiresAt {
+		oidcFail(w, r, "invalid_token", fmt.Sprintf("id_token checks failed (iss %q)", claims.Issuer))
+		return
+	}
+	email := claims.Email
+	switch p.Name {
+	case "google":
+		if v, _ := claims.EmailVerified.(bool); !v && claims.EmailVerified != "true" {
+			email = ""
+		}
+	case "microsoft":
+		if !strings.EqualFold(claims.TenantID, cfg.TenantID) {
+			oidcFail(w, r, "wrong_tenant", fmt.Sprintf("tenant %s is not allowed for %s", claims.TenantID, st.Company))
+			return
+		}
+		if email == "" && strings.Contains(claims.PreferredUsername, "@") {
+			email = claims.PreferredUsername
+		}
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		oidcFail(w, r, "no_email", "provider returned no verified email")
+		return
+	}
+	if cfg.EmailDomain != "" && !strings.HasSuffix(email, "@"+cfg.EmailDomain) {
+		oidcFail(w, r, "wrong_domain", email+" is outside "+cfg.EmailDomain)
+		return
+	}
+	if companySuspended(st.Company) {
+		recordLogin(r, st.Company, email, 0, "oidc", false, "company suspended")
+		oidcFail(w, r, "suspended", st.Company+" is suspended")
+		return
+	}
+
+	var userID int
+	var username string
+	err = DB.QueryRow(`
+		SELECT id, username FROM users
+		WHERE company_id = ? AND lower(email) = ? AND email_verified_at IS NOT NULL
+	`, companyDBID, email).Scan(&userID, &username)
+	if err == sql.ErrNoRows {
+		recordLogin(r, st.Company, email, 0, "oidc", false, "no user with this verified email")
+		oidcFail(w, r, "no_user", email+" matches no verified user in "+st.Company)
+		return
+	} else if err != nil {
+		webFail("Failed to look up user", w, err)
+		return
+	}
+	if !userActive(userID) {
+		recordLogin(r, st.Company, username, userID, "oidc", false, "deactivated")
+		oidcFail(w, r, "deactivated", username+" is deactivated")
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	startSession(session, userID, st.Company, st.Remember)
+	if err := session.Save(r, w); err != nil {
+		webFail("Failed to save session", w, err)
+		return
+	}
+	recordLogin(r, st.Company, username, userID, "oidc", true, "")
+	log.Printf("Successful %s SSO login for %s/%s", p.Name, st.Company, username)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// ---------- GET /api/company/sso ----------
+// The company's allowed providers, plus which providers this server has credentials for.
+func GetCompanySSOHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`SELECT provider, COALESCE(tenant_id, ''), COALESCE(email_domain, '') FROM company_sso_providers WHERE company_id = ? ORDER BY provider`, companyDBID)
+	if err != nil {
+		webFail("Failed to query SSO providers", w, err)
+		return
+	}
+	defer rows.Close()
+	providers := []companySSOProvider{}
+	for rows.Next() {
+		var p companySSOProvider
+		if err := rows.Scan(&p.Provider, &p.TenantID, &p.EmailDomain); err != nil {
+			webFail("Failed to scan SSO providers", w, err)
+			return
+		}
+		providers = append(providers, p)
+	}
+	available := []string{}
+	for _, name := range []string{"google", "microsoft"} {
+		if _, ok := oidcProviderConfig(name); ok {
+			available = append(available, name)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"providers": providers, "available": available})
+}
+
+// ---------- PUT /api/company/sso ----------
+// Body: {"providers": [{"provider": "microsoft", "tenant_id": "...", "email_domain": "acme.com"}]}
+// replaces the company's allowed providers; an empty list turns SSO off.
+func UpdateCompanySSOHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Providers []companySSOProvider `json:"providers"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	for i := range req.Providers {
+		p := &req.Providers[i]
+		p.Provider = strings.ToLower(strings.TrimSpace(p.Provider))
+		p.TenantID = strings.TrimSpace(p.TenantID)
+		p.EmailDomain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(p.EmailDomain), "@"))
+		if _, ok := oidcIssuers[p.Provider]; !ok || seen[p.Provider] {
+			http.Error(w, `{"message":"provider must be google or microsoft, each at most once"}`, http.StatusBadRequest)
+			return
+		}
+		seen[p.Provider] = true
+		if p.Provider == "microsoft" && p.TenantID == "" {
+			http.Error(w, `{"message":"microsoft needs the tenant_id of your Entra directory"}`, http.StatusBadRequest)
+			return
+		}
+		if p.Provider != "microsoft" {
+			p.TenantID = ""
+		}
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM company_sso_providers WHERE company_id = ?`, companyDBID); err != nil {
+		webFail("Failed to save SSO providers", w, err)
+		return
+	}
+	for _, p := range req.Providers {
+		if _, err := tx.Exec(`INSERT INTO company_sso_providers (company_id, provider, tenant_id, email_domain) VALUES (?, ?, ?, ?)`,
+			companyDBID, p.Provider, nullIfEmpty(p.TenantID), nullIfEmpty(p.EmailDomain)); err != nil {
+			webFail("Failed to save SSO providers", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to save SSO providers", w, err)
+		return
+	}
+	log.Printf("User %v set SSO providers for company %v: %d", r.Context().Value("user_id"), r.Context().Value("company_id"), len(req.Providers))
+	GetCompanySSOHandler(w, r)
+}
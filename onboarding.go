@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Onboarding: a new company walks through divisions -> stats -> users -> quotas -> done. The
+// frontend reads /api/onboarding/state and calls /api/onboarding/advance once a step's
+// requirement is met; optional steps can be skipped. Cloning an existing company copies its
+// structure (divisions, stats, calculated-stat links and quotas, but no values or users) so the
+// new company starts at the users step.
+
+var onboardingSteps = []string{"divisions", "stats", "users", "quotas", "done"}
+
+// onboardingOptional lists the steps that may be skipped.
+var onboardingOptional = map[string]bool{"users": true, "quotas": true}
+
+type onboardingState struct {
+	Step      string          `json:"step"`
+	Steps     []string        `json:"steps"`
+	Complete  map[string]bool `json:"complete"` // whether each step's requirement is currently met
+	CanSkip   bool            `json:"can_skip"`
+	UpdatedAt string          `json:"updated_at,omitempty"`
+}
+
+func setOnboardingStep(tx *sql.Tx, companyDBID int64, step string) error {
+	_, err := tx.Exec(`
+		INSERT INTO company_onboarding (company_id, step, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET step = excluded.step, updated_at = excluded.updated_at
+	`, companyDBID, step, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// onboardingRequirements reports which steps have their requirement met for the company.
+func onboardingRequirements(companyDBID int) (map[string]bool, error) {
+	counts := map[string]string{
+		"divisions": `SELECT COUNT(*) FROM divisions WHERE company_id = ?`,
+		"stats":     `SELECT COUNT(*) FROM stats WHERE company_id = ? AND deleted_at IS NULL`,
+		"users":     `SELECT COUNT(*) - 1 FROM users WHERE company_id = ?`, // beyond the first admin
+		"quotas":    `SELECT COUNT(*) FROM stat_quotas q JOIN stats s ON s.id = q.stat_id WHERE s.company_id = ?`,
+	}
+	out := map[string]bool{"done": true}
+	for step, query := range counts {
+		var n int
+		if err := DB.QueryRow(query, companyDBID).Scan(&n); err != nil {
+			return nil, err
+		}
+		out[step] = n > 0
+	}
+	return out, nil
+}
+
+func loadOnboardingState(companyDBID int) (onboardingState, error) {
+	st := onboardingState{Step: "done", Steps: onboardingSteps}
+	var updated string
+	err := DB.QueryRow(`SELECT step, updated_at FROM company_onboarding WHERE company_id = ?`, companyDBID).Scan(&st.Step, &updated)
+	if err != nil && err != sql.ErrNoRows {
+		return st, err
+	}
+	st.UpdatedAt = updated
+	if st.Complete, err = onboardingRequirements(companyDBID); err != nil {
+		return st, err
+	}
+	st.CanSkip = onboardingOptional[st.Step]
+	return st, nil
+}
+
+// ---------- GET /api/onboarding/state ----------
+func GetOnboardingStateHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	st, err := loadOnboardingState(companyDBID)
+	if err != nil {
+		webFail("Failed to load onboarding state", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// ---------- POST /api/onboarding/advance ----------
+// Body (optional): { "skip": true } to pass an optional step whose requirement is not met.
+func AdvanceOnboardingHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Skip bool `json:"skip"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	st, err := loadOnboardingState(companyDBID)
+	if err != nil {
+		webFail("Failed to load onboarding state", w, err)
+		return
+	}
+	if st.Step == "done" {
+		http.Error(w, `{"message":"Onboarding is already complete"}`, http.StatusConflict)
+		return
+	}
+	if !st.Complete[st.Step] && !(req.Skip && onboardingOptional[st.Step]) {
+		http.Error(w, fmt.Sprintf(`{"message":"Step %s is not complete yet"}`, st.Step), http.StatusConflict)
+		return
+	}
+
+	next := "done"
+	for i, s := range onboardingSteps {
+		if s == st.Step && i+1 < len(onboardingSteps) {
+			next = onboardingSteps[i+1]
+		}
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if err := setOnboardingStep(tx, int64(companyDBID), next); err != nil {
+		webFail("Failed to save onboarding step", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to save onboarding step", w, err)
+		return
+	}
+
+	st, err = loadOnboardingState(companyDBID)
+	if err != nil {
+		webFail("Failed to load onboarding state", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// ---------- POST /api/company/clone ----------
+// Body: { "company_id": "acme2", "company_name": "Acme West", "admin_username": "...", "admin_password": "..." }
+// Creates a new company with the caller's company structure and the given admin.
+func CloneCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CompanyID     string `json:"company_id"`
+		CompanyName   string `json:"company_name"`
+		AdminUsername string `json:"admin_username"`
+		AdminPassword string `json:"admin_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req.CompanyID = strings.TrimSpace(req.CompanyID)
+	req.CompanyName = strings.TrimSpace(req.CompanyName)
+	if req.CompanyID == "" || req.CompanyName == "" || strings.TrimSpace(req.AdminUsername) == "" || req.AdminPassword == "" {
+		http.Error(w, `{"message":"company_id, company_name, admin_username and admin_password are required"}`, http.StatusBadRequest)
+		return
+	}
+	if passwordRejected(w, "admin_password", req.AdminPassword, req.AdminUsername) {
+		return
+	}
+	if _, err := companyDBID(req.CompanyID); err == nil {
+		http.Error(w, `{"message":"company_id is already taken"}`, http.StatusConflict)
+		return
+	}
+
+	sourceID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if billingEnabled() {
+		_, stats, err := billingUsage(sourceID)
+		if err != nil {
+			webFail("Failed to count stats", w, err)
+			return
+		}
+		free, err := loadBillingPlan("free")
+		if err != nil {
+			webFail("Failed to load plan", w, err)
+			return
+		}
+		if max := free.MaxStats; max > 0 && stats > max {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("A new company starts on the free plan, which allows %d stats; this structure has %d", max, stats)})
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	newID, err := createCompanyTx(tx, req.CompanyID, req.CompanyName, req.AdminUsername, req.AdminPassword)
+	if err != nil {
+		webFail("Failed to create company", w, err)
+		return
+	}
+	counts, err := cloneCompanyStructure(tx, int64(sourceID), newID)
+	if err != nil {
+		webFail("Failed to clone company structure", w, err)
+		return
+	}
+	if err := setOnboardingStep(tx, newID, "users"); err != nil {
+		webFail("Failed to start onboarding", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit cloned company", w, err)
+		return
+	}
+	log.Printf("Cloned company %s into %s (%v)", r.Context().Value("company_id"), req.CompanyID, counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Company created",
+		"company_id": req.CompanyID,
+		"copied":     counts,
+	})
+}
+
+// cloneCompanyStructure copies divisions, stats, calculated-stat links and quotas from one company
+// to another. Stat assignments to users are dropped because users are not copied.
+func cloneCompanyStructure(tx *sql.Tx, fromID, toID int64) (map[string]int, error) {
+	counts := map[string]int{}
+
+	divMap := map[int64]int64{}
+	rows, err := tx.Query(`SELECT id, name FROM divisions WHERE company_id = ? ORDER BY id`, fromID)
+	if err != nil {
+		return nil, err
+	}
+	type division struct {
+		id   int64
+		name string
+	}
+	var divs []division
+	for rows.Next() {
+		var d division
+		if err := rows.Scan(&d.id, &d.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		divs = append(divs, d)
+	}
+	rows.Close()
+	for _, d := range divs {
+		res, err := tx.Exec(`INSERT INTO divisions (name, company_id) VALUES (?, ?)`, d.name, toID)
+		if err != nil {
+			return nil, err
+		}
+		divMap[d.id], _ = res.LastInsertId()
+	}
+	counts["divisions"] = len(divs)
+
+	statMap := map[int64]int64{}
+	rows, err = tx.Query(`SELECT id, short_id, full_name, type, value_type, reversed, assigned_division_id, is_calculated, calc_operator, decimal_places,
+		unit_label, thousands_separator, currency FROM stats WHERE company_id = ? AND deleted_at IS NULL ORDER BY id`, fromID)
+	if err != nil {
+		return nil, err
+	}
+	type stat struct {
+		id                                       int64
+		shortID, fullName, typ, valueTyp, calcOp string
+		reversed, isCalculated, separator        bool
+		divID, decimalPlaces                     sql.NullInt64
+		unitLabel, currency                      sql.NullString
+	}
+	var stats []stat
+	for rows.Next() {
+		var s stat
+		if err := rows.Scan(&s.id, &s.shortID, &s.fullName, &s.typ, &s.valueTyp, &s.reversed, &s.divID, &s.isCalculated, &s.calcOp, &s.decimalPlaces, &s.unitLabel, &s.separator, &s.currency); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	rows.Close()
+	for _, s := range stats {
+		var divID interface{}
+		if s.divID.Valid {
+			if mapped, ok := divMap[s.divID.Int64]; ok {
+				divID = mapped
+			}
+		}
+		res, err := tx.Exec(`
+			INSERT INTO stats (short_id, full_name, type, value_type, reversed, assigned_user_id, assigned_division_id, is_calculated, calc_operator,
+				decimal_places, unit_label, thousands_separator, currency, company_id)
+			VALUES (?, ?, ?, ?, ?, NULL, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, s.shortID, s.fullName, s.typ, s.valueTyp, s.reversed, divID, s.isCalculated, s.calcOp, s.decimalPlaces, s.unitLabel, s.separator, s.currency, toID)
+		if err != nil {
+			return nil, err
+		}
+		statMap[s.id], _ = res.LastInsertId()
+	}
+	counts["stats"] = len(stats)
+
+	type pair struct{ a, b, sign, divisor int64 }
+	var calcs []pair
+	rows, err = tx.Query(`SELECT c.stat_id, c.dependent_stat_id, c.sign, c.divisor FROM stat_calculations c JOIN stats s ON s.id = c.stat_id WHERE s.company_id = ?`, fromID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p pair
+		if err := rows.Scan(&p.a, &p.b, &p.sign, &p.divisor); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		calcs = append(calcs, p)
+	}
+	rows.Close()
+	for _, p := range calcs {
+		a, okA := statMap[p.a]
+		b, okB := statMap[p.b]
+		if !okA || !okB {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO stat_calculations (stat_id, dependent_stat_id, sign, divisor) VALUES (?, ?, ?, ?)`, a, b, p.sign, p.divisor); err != nil {
+			return nil, err
+		}
+	}
+
+	type quota struct {
+		statID int64
+		we     string
+		value  int64
+	}
+	var quotas []quota
+	rows, err = tx.Query(`SELECT q.stat_id, q.week_ending, q.value FROM stat_quotas q JOIN stats s ON s.id = q.stat_id WHERE s.company_id = ?`, fromID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var q quota
+		if err := rows.Scan(&q.statID, &q.we, &q.value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		quotas = append(quotas, q)
+	}
+	rows.Close()
+	for _, q := range quotas {
+		if _, err := tx.Exec(`INSERT INTO stat_quotas (stat_id, week_ending, value) VALUES (?, ?, ?)`, statMap[q.statID], q.we, q.value); err != nil {
+			return nil, err
+		}
+	}
+	counts["quotas"] = len(quotas)
+
+	return counts, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Password policy, checked by checkPassword wherever a password is chosen (registration, user
+// creation, change and reset). Violations come back as 400 with field-level errors:
+//
+//   {"message": "Password does not meet the policy", "errors": {"new_password": ["...", ...]}}
+//
+//   STATHQ_PASSWORD_MIN_LENGTH   minimum length in characters (8)
+//   STATHQ_PASSWORD_MIN_CLASSES  how many of lower case, upper case, digits and symbols (2)
+//   STATHQ_PASSWORD_BREACH_LIST  file of passwords to refuse, one per line: plain text or the
+//                                SHA-1 hex of one ("HASH:count" lines from Have I Been Pwned work)
+//
+// A short list of the most common passwords is always refused. bcrypt only reads 72 bytes, so
+// longer passwords are refused rather than silently truncated.
+
+const maxPasswordBytes = 72
+
+var commonPasswords = []string{
+	"password", "password1", "password123", "12345678", "123456789", "1234567890", "qwerty123",
+	"qwertyuiop", "iloveyou", "letmein1", "welcome1", "admin123", "abc12345", "11111111",
+	"00000000", "passw0rd", "football", "baseball", "sunshine", "princess", "changeme",
+}
+
+type passwordPolicy struct {
+	MinLength  int `json:"min_length"`
+	MinClasses int `json:"min_classes"`
+	MaxBytes   int `json:"max_bytes"`
+}
+
+func loadPasswordPolicy() passwordPolicy {
+	return passwordPolicy{
+		MinLength:  envInt("STATHQ_PASSWORD_MIN_LENGTH", 8),
+		MinClasses: envInt("STATHQ_PASSWORD_MIN_CLASSES", 2),
+		MaxBytes:   maxPasswordBytes,
+	}
+}
+
+var (
+	breachListOnce sync.Once
+	breachList     map[string]bool // SHA-1 hex, upper case
+)
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreachList reads STATHQ_PASSWORD_BREACH_LIST once, on first use.
+func loadBreachList() map[string]bool {
+	breachListOnce.Do(func() {
+		breachList = map[string]bool{}
+		for _, p := range commonPasswords {
+			breachList[passwordSHA1(p)] = true
+		}
+		path := envString("STATHQ_PASSWORD_BREACH_LIST", "")
+		if path == "" {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("warning: cannot read STATHQ_PASSWORD_BREACH_LIST: %v", err)
+			return
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if i := strings.IndexByte(line, ':'); i == 40 {
+				line = line[:40]
+			}
+			if line == "" {
+				continue
+			}
+			if _, err := hex.DecodeString(line); err == nil && len(line) == 40 {
+				breachList[strings.ToUpper(line)] = true
+			} else {
+				breachList[passwordSHA1(line)] = true
+			}
+		}
+		if err := sc.Err(); err != nil {
+			log.Printf("warning: reading STATHQ_PASSWORD_BREACH_LIST: %v", err)
+		}
+		log.Printf("Loaded %d refused passwords", len(breachList))
+	})
+	return breachList
+}
+
+// checkPassword returns the policy violations of a password, empty when it is acceptable.
+func checkPassword(password, username string) []string {
+	p := loadPasswordPolicy()
+	var problems []string
+	if n := len([]rune(password)); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(password) > p.MaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", p.MaxBytes))
+	}
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lower case, upper case, digits and symbols", p.MinClasses))
+	}
+	if u := strings.ToLower(strings.TrimSpace(username)); len(u) >= 3 && strings.Contains(strings.ToLower(password), u) {
+		problems = append(problems, "must not contain the username")
+	}
+	if password != "" && loadBreachList()[passwordSHA1(password)] {
+		problems = append(problems, "is too common or has appeared in a data breach")
+	}
+	return problems
+}
+
+// passwordRejected checks a password and, when it breaks the policy, writes the 400 response with
+// the problems under field.
+func passwordRejected(w http.ResponseWriter, field, password, username string) bool {
+	problems := checkPassword(password, username)
+	if len(problems) == 0 {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Password does not meet the policy",
+		"errors":  map[string][]string{field: problems},
+	})
+	return true
+}
+
+// ---------- GET /api/password-policy ----------
+// The current rules, so forms can explain them before submitting.
+func PasswordPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadPasswordPolicy())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDoc is a minimal PDF 1.4 writer for generated reports: pages of text in the standard
+// Helvetica fonts, filled rectangles and lines. Coordinates are in points with the origin at the
+// top-left corner (converted to PDF's bottom-left origin on output).
+
+type pdfDoc struct {
+	W, H  float64
+	pages []*bytes.Buffer
+	cur   *bytes.Buffer
+}
+
+func newPDF(w, h float64) *pdfDoc {
+	return &pdfDoc{W: w, H: h}
+}
+
+func (d *pdfDoc) AddPage() {
+	d.cur = &bytes.Buffer{}
+	d.pages = append(d.pages, d.cur)
+}
+
+func (d *pdfDoc) y(top float64) float64 { return d.H - top }
+
+// Text draws s with its baseline at (x, y). bold selects Helvetica-Bold.
+func (d *pdfDoc) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.cur, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y(y), pdfEscape(s))
+}
+
+// TextWidth approximates the width of s in Helvetica at size (average glyph width 0.5em).
+func (d *pdfDoc) TextWidth(s string, size float64) float64 {
+	return float64(len(s)) * size * 0.5
+}
+
+// FitText truncates s with "..." so it fits in width at size.
+func (d *pdfDoc) FitText(s string, size, width float64) string {
+	if d.TextWidth(s, size) <= width {
+		return s
+	}
+	max := int(width/(size*0.5)) - 3
+	if max < 1 {
+		return ""
+	}
+	return s[:max] + "..."
+}
+
+func (d *pdfDoc) FillColor(r, g, b float64) {
+	fmt.Fprintf(d.cur, "%.3f %.3f %.3f rg\n", r, g, b)
+}
+
+func (d *pdfDoc) StrokeColor(r, g, b float64) {
+	fmt.Fprintf(d.cur, "%.3f %.3f %.3f RG\n", r, g, b)
+}
+
+func (d *pdfDoc) LineWidth(w float64) {
+	fmt.Fprintf(d.cur, "%.2f w\n", w)
+}
+
+// Rect draws a rectangle with its top-left corner at (x, y); fill and/or stroke it.
+func (d *pdfDoc) Rect(x, y, w, h float64, fill, stroke bool) {
+	op := "S"
+	switch {
+	case fill && stroke:
+		op = "B"
+	case fill:
+		op = "f"
+	}
+	fmt.Fprintf(d.cur, "%.2f %.2f %.2f %.2f re %s\n", x, d.y(y+h), w, h, op)
+}
+
+// Polyline strokes a connected line through the points (x0, y0, x1, y1, ...).
+func (d *pdfDoc) Polyline(pts ...float64) {
+	if len(pts) < 4 {
+		return
+	}
+	fmt.Fprintf(d.cur, "%.2f %.2f m\n", pts[0], d.y(pts[1]))
+	for i := 2; i+1 < len(pts); i += 2 {
+		fmt.Fprintf(d.cur, "%.2f %.2f l\n", pts[i], d.y(pts[i+1]))
+	}
+	d.cur.WriteString("S\n")
+}
+
+// Bytes serializes the document.
+func (d *pdfDoc) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 pages, 3-4 fonts, then a page and content object per page.
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			d.W, d.H, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.Len(), p.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape escapes a string for a PDF literal, replacing characters outside Latin-1 with "?".
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteByte(' ')
+		case r < 256:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
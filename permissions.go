@@ -0,0 +1,70 @@
+package main
+
+import "sort"
+
+// Permissions: routes and handlers ask can(role, permission) instead of comparing role names, so
+// rolePermissions below is the one place that decides who may do what. AuthMiddleware takes the
+// permission a route needs ("" for any signed-in user).
+//
+//   user        log, explain and review values of the stats assigned to them
+//   manager     + every stat's values, creating and editing stats, rules, conditions, graph
+//                 events, divisions, device tokens and data imports
+//   admin       + users, sessions and kiosks, company settings and security, API tokens, billing
+//                 and exports
+//   superadmin  + the installation: companies, invites, impersonation, database maintenance,
+//                 backups and replication (see superadmin.go)
+//
+// Division managers (manage.go) are separate: any user can oversee the divisions they were given.
+
+const (
+	permAllStats        = "stats.all"        // act on every stat, not just the ones assigned to you
+	permManageStats     = "stats.manage"     // create, edit and delete stats and their configuration
+	permManageDivisions = "divisions.manage" // create, edit and delete divisions
+	permImportData      = "data.import"      // accounting, timeclock and NDJSON imports
+	permManageUsers     = "users.manage"     // users, roles, sessions, kiosks
+	permManageCompany   = "company.manage"   // settings, security, tokens, exports, maintenance
+	permManageBilling   = "billing.manage"   // plan, usage and the billing portal
+	permManagePlatform  = "platform.manage"  // super-admin routes
+)
+
+// assignableRoles are the roles a company can give its users.
+var assignableRoles = []string{"user", "manager", "admin"}
+
+var rolePermissions = func() map[string]map[string]bool {
+	manager := []string{permAllStats, permManageStats, permManageDivisions, permImportData}
+	admin := append(append([]string{}, manager...), permManageUsers, permManageCompany, permManageBilling)
+	superadmin := append(append([]string{}, admin...), permManagePlatform)
+	m := map[string]map[string]bool{"user": {}}
+	for role, perms := range map[string][]string{"manager": manager, "admin": admin, roleSuperadmin: superadmin} {
+		m[role] = map[string]bool{}
+		for _, p := range perms {
+			m[role][p] = true
+		}
+	}
+	return m
+}()
+
+// can reports whether role grants permission.
+func can(role, permission string) bool {
+	return rolePermissions[role][permission]
+}
+
+// permissionsOf lists a role's permissions, sorted, for clients that adapt their UI.
+func permissionsOf(role string) []string {
+	out := []string{}
+	for p := range rolePermissions[role] {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// validRole reports whether role can be given to a user.
+func validRole(role string) bool {
+	for _, r := range assignableRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Edit presence: while a user has a week open in the grid the client heartbeats
+// POST /api/presence every ~20s. Presence expires after presenceTTL without a heartbeat, so a
+// closed tab cleans itself up. The response lists everyone else editing the same week (and stat),
+// and joins/leaves are published on /api/events so open grids can warn before anyone types.
+// Presence is in memory only; it is advisory, the version checks in concurrency.go are what stop
+// an overwrite.
+
+const (
+	eventEditingStarted = "editing-started"
+	eventEditingStopped = "editing-stopped"
+)
+
+var presenceTTL = 60 * time.Second
+
+type presenceKey struct {
+	CompanyID  int
+	WeekEnding string
+	StatID     int // 0 = the whole week (7R grid)
+	UserID     int
+}
+
+type presenceEntry struct {
+	UserID     int    `json:"user_id"`
+	Username   string `json:"username"`
+	WeekEnding string `json:"week_ending"`
+	StatID     int    `json:"stat_id,omitempty"`
+	Since      string `json:"since"`
+	seen       time.Time
+}
+
+type presenceTracker struct {
+	mu      sync.Mutex
+	entries map[presenceKey]*presenceEntry
+}
+
+var presence = &presenceTracker{entries: map[presenceKey]*presenceEntry{}}
+
+// touch records a heartbeat and reports whether it started a new editing session.
+func (p *presenceTracker) touch(k presenceKey, username string) bool {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[k]; ok && now.Sub(e.seen) < presenceTTL {
+		e.seen = now
+		return false
+	}
+	p.entries[k] = &presenceEntry{UserID: k.UserID, Username: username, WeekEnding: k.WeekEnding, StatID: k.StatID,
+		Since: now.UTC().Format(time.RFC3339), seen: now}
+	return true
+}
+
+// leave removes a session and reports whether there was one.
+func (p *presenceTracker) leave(k presenceKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.entries[k]
+	delete(p.entries, k)
+	return ok
+}
+
+// list returns the live sessions of a company's week, dropping (and announcing) expired ones.
+func (p *presenceTracker) list(companyID int, week string) []presenceEntry {
+	now := time.Now()
+	var expired []presenceKey
+	out := []presenceEntry{}
+	p.mu.Lock()
+	for k, e := range p.entries {
+		if now.Sub(e.seen) >= presenceTTL {
+			delete(p.entries, k)
+			expired = append(expired, k)
+			continue
+		}
+		if k.CompanyID == companyID && (week == "" || k.WeekEnding == week) {
+			out = append(out, *e)
+		}
+	}
+	p.mu.Unlock()
+	for _, k := range expired {
+		publishPresence(k, eventEditingStopped, "")
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Since < out[j].Since })
+	return out
+}
+
+func publishPresence(k presenceKey, typ, username string) {
+	events.publish(k.CompanyID, liveEvent{Type: typ, StatID: k.StatID, WeekEnding: k.WeekEnding,
+		Data: map[string]interface{}{"user_id": k.UserID, "username": username},
+		At:   time.Now().UTC().Format(time.RFC3339)})
+}
+
+// presenceRequest reads week_ending (defaults to the current week) and optional stat_id from the
+// query string or JSON body and builds the caller's key.
+func presenceRequest(w http.ResponseWriter, r *http.Request) (presenceKey, bool) {
+	var body struct {
+		WeekEnding string `json:"week_ending"`
+		StatID     int    `json:"stat_id"`
+	}
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return presenceKey{}, false
+		}
+	}
+	if v := r.URL.Query().Get("week"); v != "" {
+		body.WeekEnding = v
+	}
+	if v := r.URL.Query().Get("stat_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid stat_id"}`, http.StatusBadRequest)
+			return presenceKey{}, false
+		}
+		body.StatID = id
+	}
+	if body.WeekEnding == "" {
+		body.WeekEnding = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(r.Context().Value("company_id").(string), body.WeekEnding); err != nil {
+		http.Error(w, `{"message":"week_ending must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return presenceKey{}, false
+	}
+	companyID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return presenceKey{}, false
+	}
+	if body.StatID != 0 {
+		var n int
+		DB.QueryRow(`SELECT COUNT(*) FROM stats WHERE id = ? AND company_id = ?`, body.StatID, companyID).Scan(&n)
+		if n == 0 {
+			http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
+			return presenceKey{}, false
+		}
+	}
+	userID, _ := r.Context().Value("user_id").(int)
+	return presenceKey{CompanyID: companyID, WeekEnding: body.WeekEnding, StatID: body.StatID, UserID: userID}, true
+}
+
+// ---------- POST /api/presence ----------
+// Body (or query): { "week_ending": "YYYY-MM-DD", "stat_id": n }. Heartbeat; returns the other
+// users editing the same week whose scope overlaps (whole week, or the same stat).
+func PresenceHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	k, ok := presenceRequest(w, r)
+	if !ok {
+		return
+	}
+	username, _ := r.Context().Value("username").(string)
+	if presence.touch(k, username) {
+		publishPresence(k, eventEditingStarted, username)
+	}
+	others := []presenceEntry{}
+	for _, e := range presence.list(k.CompanyID, k.WeekEnding) {
+		if e.UserID == k.UserID {
+			continue
+		}
+		if k.StatID == 0 || e.StatID == 0 || e.StatID == k.StatID {
+			others = append(others, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week_ending":   k.WeekEnding,
+		"expires_in":    int(presenceTTL.Seconds()),
+		"other_editors": others,
+		"conflict":      len(others) > 0,
+	})
+}
+
+// ---------- DELETE /api/presence?week=&stat_id= ----------
+func PresenceLeaveHandler(w http.ResponseWriter, r *http.Request) {
+	k, ok := presenceRequest(w, r)
+	if !ok {
+		return
+	}
+	if presence.leave(k) {
+		username, _ := r.Context().Value("username").(string)
+		publishPresence(k, eventEditingStopped, username)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Left"})
+}
+
+// ---------- GET /api/presence?week= ----------
+// Everyone currently editing the week (all weeks when week is omitted).
+func ListPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	week := r.URL.Query().Get("week")
+	if week != "" {
+		if err := checkIfValidWE(r.Context().Value("company_id").(string), week); err != nil {
+			http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	companyID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presence.list(companyID, week))
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qrCode is a minimal QR Code encoder for printed entry links: byte mode, error correction level M,
+// versions 1 to 10 (up to 213 bytes). Only what a URL needs is implemented.
+
+type qrCode struct {
+	Size    int
+	modules [][]bool // [y][x], true is dark
+	isFunc  [][]bool
+}
+
+// Level M block structure per version: EC codewords per block, then the number of blocks and data
+// codewords per block in each of up to two groups.
+var qrVersionsM = [...]struct {
+	ecPerBlock int
+	groups     [][2]int
+}{
+	{10, [][2]int{{1, 16}}},
+	{16, [][2]int{{1, 28}}},
+	{26, [][2]int{{1, 44}}},
+	{18, [][2]int{{2, 32}}},
+	{24, [][2]int{{2, 43}}},
+	{16, [][2]int{{4, 27}}},
+	{18, [][2]int{{4, 31}}},
+	{22, [][2]int{{2, 38}, {2, 39}}},
+	{22, [][2]int{{3, 36}, {2, 37}}},
+	{26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+var qrAlignment = [...][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+func qrDataCodewords(version int) int {
+	n := 0
+	for _, g := range qrVersionsM[version-1].groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+// encodeQR encodes data in the smallest version that holds it.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= len(qrVersionsM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= qrDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code", len(data))
+	}
+
+	// Byte mode segment, terminator and padding.
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 == 1)
+		}
+	}
+	put(0x4, 4)
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		put(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	q := newQRGrid(version)
+	q.drawCodewords(qrInterleave(version, codewords))
+
+	// Keep the mask with the lowest penalty.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// qrInterleave splits data into blocks, appends each block's Reed-Solomon codewords and
+// interleaves the result.
+func qrInterleave(version int, data []byte) []byte {
+	spec := qrVersionsM[version-1]
+	var blocks, ecs [][]byte
+	for _, g := range spec.groups {
+		for i := 0; i < g[0]; i++ {
+			blocks = append(blocks, data[:g[1]])
+			data = data[g[1]:]
+		}
+	}
+	gen := qrGenerator(spec.ecPerBlock)
+	for _, b := range blocks {
+		ecs = append(ecs, qrRemainder(b, gen))
+	}
+	var out []byte
+	for i := 0; ; i++ {
+		added := false
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// qrMul multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z & 0x80
+		z <<= 1
+		if hi != 0 {
+			z ^= 0x1D
+		}
+		if (y>>i)&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// qrGenerator returns the coefficients (highest first, leading 1 omitted) of the product of
+// (x - a^i) for i < degree.
+func qrGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range gen {
+			gen[j] = qrMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = qrMul(root, 0x02)
+	}
+	return gen
+}
+
+func qrRemainder(data, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i := range rem {
+			rem[i] ^= qrMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+// newQRGrid draws the function patterns of a version: finders, timing, alignment, version
+// information and the space reserved for format information.
+func newQRGrid(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{Size: size, modules: make([][]bool, size), isFunc: make([][]bool, size)}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.isFunc[y] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := qrMax(qrAbs(dx), qrAbs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignment[version-1]
+	for i, cy := range pos {
+		for j, cx := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue // finder corners
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0) // reserve; redrawn with the chosen mask
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (bits>>i)&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+	return q
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunc[y][x] = true
+}
+
+// drawFormat writes both copies of the format information (level M, mask) and the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	data := mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.Size-15+i, bit(i))
+	}
+	q.set(8, q.Size-8, true)
+}
+
+// drawCodewords places the data in the two-module-wide zigzag from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert // upward
+				}
+				if !q.isFunc[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunc[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the standard's four rules: long runs, 2x2 blocks, finder-like
+// patterns and dark/light imbalance.
+func (q *qrCode) penalty() int {
+	n := q.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	score, dark := 0, 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= n; x++ {
+				match := true
+				for k, f := range finder {
+					if at(x+k, y, transpose) != f {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				light := func(from, to int) bool {
+					for k := from; k < to; k++ {
+						if k >= 0 && k < n && at(k, y, transpose) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					score += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	score += qrAbs(dark*20-n*n*10) / (n * n) * 10
+	return score
+}
+
+// SVG renders the symbol with a four-module quiet zone, scaled to px pixels per module.
+func (q *qrCode) SVG(px int) string {
+	dim := (q.Size + 8) * px
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		dim, dim, q.Size+8, q.Size+8)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// Draw paints the symbol on a PDF page with its top-left corner at (x, y), width points wide
+// (quiet zone not included).
+func (q *qrCode) Draw(d *pdfDoc, x, y, width float64) {
+	m := width / float64(q.Size)
+	d.FillColor(0, 0, 0)
+	for row := 0; row < q.Size; row++ {
+		for col := 0; col < q.Size; col++ {
+			if q.modules[row][col] {
+				d.Rect(x+float64(col)*m, y+float64(row)*m, m, m, true, false)
+			}
+		}
+	}
+}
+
+func qrAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
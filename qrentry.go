@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// QR entry: an admin mints a token for a stat and prints its QR code; scanning it opens /q/{token},
+// a one-field page that adds to (or sets) today's daily value of that stat without signing in.
+// The token is the credential and is limited to the one stat. Only its SHA-256 is stored, so the
+// printable sheet is rendered from the token the admin still holds.
+
+type qrToken struct {
+	ID         int     `json:"id"`
+	StatID     int     `json:"stat_id"`
+	Label      string  `json:"label"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at,omitempty"`
+	Token      string  `json:"token,omitempty"` // only returned on creation
+	URL        string  `json:"url,omitempty"`
+	SVG        string  `json:"svg,omitempty"`
+}
+
+// ---------- POST /api/stats/{id}/qr-tokens ----------
+// Body: { "label": "Packing line" }. The token, entry URL and QR code (SVG) are returned once.
+func CreateQRTokenHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var req struct {
+		Label string `json:"label"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	var isCalculated bool
+	if err := DB.QueryRow(`SELECT is_calculated FROM stats WHERE id = ? AND deleted_at IS NULL`, statID).Scan(&isCalculated); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	if isCalculated {
+		http.Error(w, `{"message":"Calculated stats cannot receive values"}`, http.StatusBadRequest)
+		return
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate token", w, err)
+		return
+	}
+	created := time.Now().UTC().Format(time.RFC3339)
+	label := strings.TrimSpace(req.Label)
+	res, err := DB.Exec(`INSERT INTO stat_qr_tokens (stat_id, token_hash, label, created_at, created_by) VALUES (?, ?, ?, ?, ?)`,
+		statID, hash, label, created, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to save QR token", w, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	url := shardLink(publicURL(r) + "/q/" + token)
+	qr, err := encodeQR([]byte(url))
+	if err != nil {
+		webFail("Failed to encode QR code", w, err)
+		return
+	}
+	log.Printf("Created QR entry token %d for stat %d", id, statID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(qrToken{ID: int(id), StatID: statID, Label: label, CreatedAt: created, Token: token, URL: url, SVG: qr.SVG(8)})
+}
+
+// ---------- GET /api/stats/{id}/qr-tokens ----------
+func ListQRTokensHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	rows, err := DB.Query(`SELECT id, stat_id, label, created_at, last_used_at FROM stat_qr_tokens WHERE stat_id = ? AND revoked_at IS NULL ORDER BY id`, statID)
+	if err != nil {
+		webFail("Failed to query QR tokens", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []qrToken{}
+	for rows.Next() {
+		var t qrToken
+		var lastUsed sql.NullString
+		if err := rows.Scan(&t.ID, &t.StatID, &t.Label, &t.CreatedAt, &lastUsed); err != nil {
+			webFail("Failed to scan QR token", w, err)
+			return
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.String
+		}
+		out = append(out, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// qrTokenCompanyStat returns the stat of token id when the stat belongs to the caller's company.
+func qrTokenCompanyStat(r *http.Request, id int) (int, bool) {
+	var statID int
+	if err := DB.QueryRow(`SELECT stat_id FROM stat_qr_tokens WHERE id = ? AND revoked_at IS NULL`, id).Scan(&statID); err != nil {
+		return 0, false
+	}
+	status, _ := checkStatCompany(r, statID)
+	return statID, status == 0
+}
+
+// ---------- DELETE /api/qr-tokens/{id} ----------
+func RevokeQRTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid token id"}`, http.StatusBadRequest)
+		return
+	}
+	if _, ok := qrTokenCompanyStat(r, id); !ok {
+		http.Error(w, `{"message":"token not found"}`, http.StatusNotFound)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE stat_qr_tokens SET revoked_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), id); err != nil {
+		webFail("Failed to revoke QR token", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked"})
+}
+
+// ---------- GET /api/qr-tokens/{id}/print?token=...[&size=a4] ----------
+// A printable page with the stat's name and QR code. token must be the one returned on creation.
+func PrintQRTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid token id"}`, http.StatusBadRequest)
+		return
+	}
+	statID, ok := qrTokenCompanyStat(r, id)
+	if !ok {
+		http.Error(w, `{"message":"token not found"}`, http.StatusNotFound)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	var label string
+	if err := DB.QueryRow(`SELECT label FROM stat_qr_tokens WHERE id = ? AND token_hash = ?`, id, hashSecretToken(token)).Scan(&label); err != nil {
+		http.Error(w, `{"message":"token does not match"}`, http.StatusBadRequest)
+		return
+	}
+	var shortID, fullName string
+	if err := DB.QueryRow(`SELECT short_id, full_name FROM stats WHERE id = ? AND deleted_at IS NULL`, statID).Scan(&shortID, &fullName); err == sql.ErrNoRows {
+		http.Error(w, `{"message":"token not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	url := shardLink(publicURL(r) + "/q/" + token)
+	qr, err := encodeQR([]byte(url))
+	if err != nil {
+		webFail("Failed to encode QR code", w, err)
+		return
+	}
+
+	pw, ph := 612.0, 792.0 // US Letter
+	if r.URL.Query().Get("size") == "a4" {
+		pw, ph = 595.0, 842.0
+	}
+	doc := newPDF(pw, ph)
+	doc.AddPage()
+	side := 360.0
+	left := (pw - side) / 2
+	title := doc.FitText(fullName, 28, pw-80)
+	doc.FillColor(0, 0, 0)
+	doc.Text((pw-doc.TextWidth(title, 28))/2, 110, 28, true, title)
+	sub := shortID
+	if label != "" {
+		sub += " - " + label
+	}
+	doc.Text((pw-doc.TextWidth(sub, 16))/2, 140, 16, false, sub)
+	qr.Draw(doc, left, 180, side)
+	hint := "Scan to log today's value"
+	doc.Text((pw-doc.TextWidth(hint, 16))/2, 180+side+50, 16, false, hint)
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="qr-%s.pdf"`, shortID))
+	w.Write(doc.Bytes())
+}
+
+var qrEntryPage = template.Must(template.New("qr").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.ShortID}} - StatHQ</title>
+<style>body{font-family:sans-serif;max-width:28em;margin:2em auto;padding:0 1em}input,button{font-size:1.5em;width:100%;box-sizing:border-box;margin:.3em 0;padding:.4em}.err{color:#b00}.ok{color:#070}</style>
+</head><body>
+<h1>{{.FullName}}</h1>
+<p>{{.ShortID}}{{if .Label}} &middot; {{.Label}}{{end}} &middot; {{.Date}}</p>
+<p>Today so far: <strong>{{.Today}}</strong></p>
+{{if .Error}}<p class="err">{{.Error}}</p>{{end}}{{if .Saved}}<p class="ok">Saved.</p>{{end}}
+<form method="post">
+<input name="value" inputmode="decimal" autocomplete="off" autofocus required placeholder="Value">
+<label><input type="checkbox" name="set" value="1" style="width:auto"> Replace today's total</label>
+<button type="submit">Add</button>
+</form>
+</body></html>`))
+
+type qrEntryView struct {
+	ShortID, FullName, Label, Date, Today, Error string
+	Saved                                        bool
+}
+
+// qrEntryLookup resolves an entry token to its stat. ok is false for unknown or revoked tokens.
+func qrEntryLookup(token string) (tokenID, statID int, view qrEntryView, valueType, companyCode string, ok bool) {
+	err := DB.QueryRow(`
+		SELECT t.id, s.id, s.short_id, s.full_name, t.label, s.value_type, c.company_id
+		FROM stat_qr_tokens t JOIN stats s ON s.id = t.stat_id JOIN companies c ON c.id = s.company_id
+		WHERE t.token_hash = ? AND t.revoked_at IS NULL AND s.deleted_at IS NULL
+	`, hashSecretToken(token)).Scan(&tokenID, &statID, &view.ShortID, &view.FullName, &view.Label, &valueType, &companyCode)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to look up QR token: %v", err)
+	}
+	return tokenID, statID, view, valueType, companyCode, err == nil
+}
+
+func renderQREntry(w http.ResponseWriter, status int, statID int, valueType string, day string, view qrEntryView) {
+	view.Date = day
+	view.Today = "-"
+	var today int64
+	if err := DB.QueryRow(`SELECT value FROM daily_stats WHERE stat_id = ? AND date = ? LIMIT 1`, statID, day).Scan(&today); err == nil {
+		view.Today = formatStatValue(today, valueType, statCurrency(statID))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := qrEntryPage.Execute(w, view); err != nil {
+		log.Printf("Failed to render QR entry page: %v", err)
+	}
+}
+
+func qrEntryToday(companyCode string) string {
+	return time.Now().In(companyLocation(companyCode)).Format("2006-01-02")
+}
+
+// ---------- GET /q/{token} ----------
+// Public: the token is the credential.
+func QREntryPageHandler(w http.ResponseWriter, r *http.Request) {
+	_, statID, view, valueType, companyCode, ok := qrEntryLookup(mux.Vars(r)["token"])
+	if !ok {
+		http.Error(w, "This code is not valid any more.", http.StatusNotFound)
+		return
+	}
+	renderQREntry(w, http.StatusOK, statID, valueType, qrEntryToday(companyCode), view)
+}
+
+// ---------- POST /q/{token} ----------
+// Form: value, set=1 to replace today's value instead of adding to it.
+func QREntrySubmitHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID, statID, view, valueType, companyCode, ok := qrEntryLookup(mux.Vars(r)["token"])
+	if !ok {
+		http.Error(w, "This code is not valid any more.", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	day := qrEntryToday(companyCode)
+	id, err := companyDBID(companyCode)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if status, msg, err := companyWritable(id); err != nil {
+		webFail("Failed to check company status", w, err)
+		return
+	} else if status != 0 {
+		view.Error = msg
+		renderQREntry(w, status, statID, valueType, day, view)
+		return
+	}
+	raw := normalizeNumber(r.FormValue("value"), companyLocale(companyCode), statInputPlaces(statID))
+	set := r.FormValue("set") == "1"
+	v, err := parseSignedValue(raw, valueType, statCurrency(statID))
+	if err != nil || strings.TrimSpace(raw) == "" || (set && v < 0) {
+		view.Error = fmt.Sprintf("%q is not a valid value.", r.FormValue("value"))
+		renderQREntry(w, http.StatusBadRequest, statID, valueType, day, view)
+		return
+	}
+	value, err := writeDailyValue(statID, day, v, !set)
+	if vio, ok := err.(*ruleViolation); ok {
+		view.Error = vio.Message
+		renderQREntry(w, http.StatusUnprocessableEntity, statID, valueType, day, view)
+		return
+	} else if err == errStatArchived {
+		view.Error = "This stat is archived and no longer takes values."
+		renderQREntry(w, http.StatusGone, statID, valueType, day, view)
+		return
+	} else if err != nil {
+		webFail("Failed to save daily value", w, err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := DB.Exec(`UPDATE stat_qr_tokens SET last_used_at = ? WHERE id = ?`, now, tokenID); err != nil {
+		log.Printf("Failed to update QR token %d usage: %v", tokenID, err)
+	}
+	d, _ := time.Parse("2006-01-02", day)
+	week := currentWeekEnding(d, companyWeekEndingDay(companyCode))
+	if err := logActivity(DB, nil, activityDailySaved, statID, week, map[string]interface{}{
+		"values": map[string]string{d.Weekday().String(): formatStatValue(value, valueType, statCurrency(statID))},
+		"source": "qr",
+	}); err != nil {
+		log.Printf("Failed to log QR entry for stat %d: %v", statID, err)
+	}
+	if err := markAggregatesDirty(DB, statID, week); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+	}
+	view.Saved = true
+	renderQREntry(w, http.StatusOK, statID, valueType, day, view)
+}
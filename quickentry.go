@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quick entry logs one value for one stat with nothing else to fill in, for one-field mobile
+// screens and shortcut apps. A stat that has daily values in the last eight weeks is entered by
+// day (replacing that day's value, or adding to it with "add"); any other stat is entered by week.
+// Without a date the value goes to today, or to the week currently being entered, in the company's
+// timezone. The stat's validation rules apply as in the grids.
+
+const quickEntryDailyLookback = 8 * 7 // days
+
+// ---------- POST /api/quick-entry ----------
+// Body: {"stat": "GI" | 12, "value": "1250", "date": "2024-01-02", "add": false, "confirm": false, "reason": ""}
+func QuickEntryHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Stat    json.RawMessage `json:"stat"`
+		StatID  int             `json:"stat_id"`
+		ShortID string          `json:"short_id"`
+		Value   string          `json:"value"`
+		Date    string          `json:"date"`
+		Add     bool            `json:"add"`
+		Confirm bool            `json:"confirm"`
+		Reason  string          `json:"reason"` // required to change a logged week when the company locks values
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Stat) > 0 {
+		if err := json.Unmarshal(req.Stat, &req.StatID); err != nil {
+			if err := json.Unmarshal(req.Stat, &req.ShortID); err != nil {
+				http.Error(w, `{"message":"stat must be a stat id or short_id"}`, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	companyID := r.Context().Value("company_id").(string)
+	userID := r.Context().Value("user_id").(int)
+
+	statID, err := resolveQuickEntryStat(companyID, userID, req.StatID, req.ShortID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Stat not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		webFail("Failed to look up stat", w, err)
+		return
+	}
+	if status, msg := checkStatAccess(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var shortID, valueType string
+	var isCalculated bool
+	if err := DB.QueryRow(`SELECT short_id, value_type, is_calculated FROM stats WHERE id = ?`, statID).Scan(&shortID, &valueType, &isCalculated); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	if isCalculated {
+		http.Error(w, `{"message":"Calculated stats cannot receive values"}`, http.StatusBadRequest)
+		return
+	}
+	currency := statCurrency(statID)
+	value, err := parseStatValue(normalizeNumber(req.Value, requestLocale(r), statInputPlaces(statID)), valueType, currency)
+	if err != nil || strings.TrimSpace(req.Value) == "" {
+		http.Error(w, fmt.Sprintf(`{"message":"invalid value for %s stat"}`, valueType), http.StatusBadRequest)
+		return
+	}
+
+	loc, weekday := companyLocation(companyID), companyWeekEndingDay(companyID)
+	now := time.Now().In(loc)
+	var date time.Time
+	if req.Date != "" {
+		if date, err = time.Parse("2006-01-02", req.Date); err != nil {
+			http.Error(w, `{"message":"date must be YYYY-MM-DD"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var daily int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM daily_stats WHERE stat_id = ? AND date >= date(?, ?)`,
+		statID, now.Format("2006-01-02"), fmt.Sprintf("-%d days", quickEntryDailyLookback)).Scan(&daily); err != nil {
+		webFail("Failed to check daily values", w, err)
+		return
+	}
+
+	out := map[string]interface{}{"stat_id": statID, "short_id": shortID}
+	if daily > 0 {
+		if date.IsZero() {
+			date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		if wd := date.Weekday(); wd == time.Saturday || wd == time.Sunday {
+			http.Error(w, `{"message":"Daily values are entered Monday to Friday"}`, http.StatusBadRequest)
+			return
+		}
+		day, week := date.Format("2006-01-02"), currentWeekEnding(date, weekday)
+		stored, err := writeDailyValue(statID, day, value, req.Add)
+		if _, ok := err.(*ruleViolation); ok {
+			writeRuleViolation(w, err)
+			return
+		} else if err == errStatArchived {
+			writeArchivedError(w)
+			return
+		} else if err != nil {
+			webFail("Failed to save daily value", w, err)
+			return
+		}
+		if err := logActivity(DB, userID, activityDailySaved, statID, week, map[string]interface{}{
+			"values": map[string]string{date.Weekday().String(): formatStatValue(stored, valueType, currency)},
+			"source": "quick-entry",
+		}); err != nil {
+			log.Printf("Failed to log quick entry for stat %d: %v", statID, err)
+		}
+		if err := markAggregatesDirty(DB, statID, week); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+		}
+		out["mode"], out["date"], out["week_ending"], out["value"] = "daily", day, week, formatStatValue(stored, valueType, currency)
+	} else {
+		week := enteringWeek(loc, weekday, now)
+		if !date.IsZero() {
+			week = currentWeekEnding(date, weekday)
+		}
+		if req.Add {
+			var existing int64
+			if err := DB.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, statID, week).Scan(&existing); err != nil && err != sql.ErrNoRows {
+				webFail("Failed to load weekly value", w, err)
+				return
+			}
+			value += existing
+		}
+		version, err := writeWeeklyValue(statID, week, value, userID, req.Confirm, req.Reason)
+		if _, ok := err.(*ruleViolation); ok {
+			writeRuleViolation(w, err)
+			return
+		} else if err == errStatArchived {
+			writeArchivedError(w)
+			return
+		} else if err != nil {
+			webFail("Failed to save weekly value", w, err)
+			return
+		}
+		out["mode"], out["week_ending"], out["value"], out["version"] = "weekly", week, formatStatValue(value, valueType, currency), version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// resolveQuickEntryStat finds a company stat by id or short_id. Personal stats can share a short_id
+// across users, so the caller's own stat is preferred.
+func resolveQuickEntryStat(companyID string, userID, statID int, shortID string) (int, error) {
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		return 0, err
+	}
+	if statID == 0 {
+		shortID = strings.TrimSpace(shortID)
+		if shortID == "" {
+			return 0, sql.ErrNoRows
+		}
+		if id, err := strconv.Atoi(shortID); err == nil {
+			var found int
+			if DB.QueryRow(`SELECT id FROM stats WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, id, companyDBID).Scan(&found) == nil {
+				return found, nil
+			}
+		}
+		err = DB.QueryRow(`
+			SELECT id FROM stats
+			WHERE company_id = ? AND upper(short_id) = upper(?) AND deleted_at IS NULL
+			ORDER BY (assigned_user_id = ? OR id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?)) DESC, id
+			LIMIT 1
+		`, companyDBID, shortID, userID, userID).Scan(&statID)
+		return statID, err
+	}
+	err = DB.QueryRow(`SELECT id FROM stats WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, statID, companyDBID).Scan(&statID)
+	return statID, err
+}
+
+// writeWeeklyValue checks value against the stat's rules and upserts it as the stat's value for
+// week, logging the entry or edit (with reason, see valuehistory.go), and returns the row's new
+// version. A value that breaks a rule is not written and the *ruleViolation is returned.
+func writeWeeklyValue(statID int, week string, value int64, authorID interface{}, confirmed bool, reason string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var valueType, currency string
+	var archived bool
+	if err := tx.QueryRow(`
+		SELECT s.value_type, COALESCE(s.currency, cs.default_currency, ?), s.archived_at IS NOT NULL
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ? AND s.deleted_at IS NULL
+	`, defaultCurrency, statID).Scan(&valueType, &currency, &archived); err != nil {
+		return 0, err
+	}
+	if archived {
+		return 0, errStatArchived
+	}
+	if err := checkWeeklyRules(tx, statID, week, value, valueType, confirmed); err != nil {
+		return 0, err
+	}
+	var existingID, existingVal int64
+	var version int
+	now := time.Now().UTC().Format(time.RFC3339)
+	err = tx.QueryRow(`SELECT id, value, version FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, statID, week).Scan(&existingID, &existingVal, &version)
+	switch {
+	case err == sql.ErrNoRows:
+		version = 1
+		if _, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, author_user_id, submitted_at, version, updated_at) VALUES (?, ?, ?, ?, ?, 1, ?)`,
+			statID, week, value, authorID, now, now); err != nil {
+			return 0, err
+		}
+		err = logActivity(tx, authorID, activityValueEntered, statID, week, map[string]string{"new": formatStatValue(value, valueType, currency)})
+	case err == nil:
+		if existingVal != value {
+			if err := checkEditReason(tx, statID, reason); err != nil {
+				return 0, err
+			}
+		}
+		version++
+		if _, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, author_user_id = ?, version = ?, updated_at = ? WHERE id = ?`,
+			value, authorID, version, now, existingID); err != nil {
+			return 0, err
+		}
+		if existingVal != value {
+			if err = recordEditReason(tx, statID, week, reason); err != nil {
+				return 0, err
+			}
+			detail := map[string]string{
+				"old": formatStatValue(existingVal, valueType, currency),
+				"new": formatStatValue(value, valueType, currency),
+			}
+			if reason = strings.TrimSpace(reason); reason != "" {
+				detail["reason"] = reason
+			}
+			err = logActivity(tx, authorID, activityValueEdited, statID, week, detail)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	publishWeeklyEvents(statID, week, value)
+	if err := enqueueRecalc(DB, statID, week); err != nil {
+		log.Printf("Failed to queue recalculation of stats depending on %d: %v", statID, err)
+	}
+	if err := markAggregatesDirty(DB, statID, week); err != nil {
+		log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// saveQuota upserts the weekly quota for a stat. An empty quota removes any stored value.
+// The quota is converted with the stat's value_type so it can be compared directly against weekly_stats.value.
+func saveQuota(tx *sql.Tx, statID int, weekEnding, raw string, authorID interface{}) error {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		_, err := tx.Exec(`DELETE FROM stat_quotas WHERE stat_id = ? AND week_ending = ?`, statID, weekEnding)
+		return err
+	}
+
+	var valueType, currency string
+	if err := tx.QueryRow(`
+		SELECT s.value_type, COALESCE(s.currency, cs.default_currency, ?)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ? LIMIT 1
+	`, defaultCurrency, statID).Scan(&valueType, &currency); err != nil {
+		return err
+	}
+	v, err := parseStatValue(raw, valueType, currency)
+	if err != nil {
+		return fmt.Errorf("invalid quota %q: %v", raw, err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO stat_quotas (stat_id, week_ending, value, author_user_id)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(stat_id, week_ending) DO UPDATE SET value = excluded.value, author_user_id = excluded.author_user_id
+	`, statID, weekEnding, v, authorID)
+	return err
+}
+
+// loadQuotaString returns the stored quota for a stat/week formatted for the 7R grid, or "" if none is set.
+func loadQuotaString(statID int, weekEnding, valueType string) string {
+	var v sql.NullInt64
+	if err := DB.QueryRow(`SELECT value FROM stat_quotas WHERE stat_id = ? AND week_ending = ?`, statID, weekEnding).Scan(&v); err != nil || !v.Valid {
+		return ""
+	}
+	return formatStatValue(v.Int64, valueType, statCurrency(statID))
+}
+
+// formatStoredValue renders a stored integer the way the entry grids expect it. Currency amounts
+// depend on the stat's currency and go through formatStatValue instead.
+func formatStoredValue(v int64, valueType string) string {
+	switch valueType {
+	case "percentage":
+		return fmt.Sprintf("%.2f", float64(v)/100.0)
+	case "decimal", "ratio":
+		return formatDecimal(v, -1)
+	case "duration":
+		return formatDuration(v)
+	default:
+		return fmt.Sprintf("%d", v)
+	}
+}
+
+// quotaMet reports whether a weekly value satisfies its quota. Reversed stats (lower is better)
+// meet quota when the value is at or below it.
+func quotaMet(value, quota int64, reversed bool) bool {
+	if reversed {
+		return value <= quota
+	}
+	return value >= quota
+}
+
+// currentWeekEnding returns the W/E for the week containing t (today or the next W/E weekday).
+func currentWeekEnding(t time.Time, weekday time.Weekday) string {
+	t = t.UTC()
+	daysUntil := (int(weekday) - int(t.Weekday()) + 7) % 7
+	return t.AddDate(0, 0, daysUntil).Format("2006-01-02")
+}
+
+// weekDeadline is the time by which a week's values are due: one day after the 14:00 week close
+// in the company's timezone, where weekState turns a week from "due" to "locked".
+func weekDeadline(weekEnding string, loc *time.Location) (time.Time, error) {
+	closes, err := weekCloseIn(weekEnding, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return closes.Add(24 * time.Hour), nil
+}
+
+// lastWeekEndings returns n W/E dates ending at (and including) end, oldest first.
+func lastWeekEndings(end string, n int) ([]string, error) {
+	t, err := time.Parse("2006-01-02", end)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, n)
+	for i := n - 1; i >= 0; i-- {
+		out[i] = t.Format("2006-01-02")
+		t = t.AddDate(0, 0, -7)
+	}
+	return out, nil
+}
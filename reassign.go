@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Bulk reassignment: when a post changes hands every stat held by one user moves to another in a
+// single transaction — the canonical stats.assigned_user_id and the stat_user_assignments rows.
+// The effective date is kept in stat_assignment_history (and the activity log) so weeks before it
+// are still attributed to the previous holder.
+//
+// POST /api/users/{id}/transfer is the same for a departing user's personal stats only, with
+// "preview" to list what would move before anything changes; run it before deactivating or
+// deleting the user.
+
+type reassignResult struct {
+	FromUserID    int    `json:"from_user_id"`
+	ToUserID      int    `json:"to_user_id"`
+	EffectiveDate string `json:"effective_date"`
+	StatIDs       []int  `json:"stat_ids"`
+}
+
+// ---------- POST /api/users/{id}/reassign?to={other_id}&effective=YYYY-MM-DD ----------
+// effective defaults to today. The body may carry {"effective_date": "..."} instead.
+func ReassignUserStatsHandler(w http.ResponseWriter, r *http.Request) {
+	fromID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	toID, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, `{"message":"to must be a user id"}`, http.StatusBadRequest)
+		return
+	}
+	if fromID == toID {
+		http.Error(w, `{"message":"cannot reassign a user's stats to themselves"}`, http.StatusBadRequest)
+		return
+	}
+	effective := r.URL.Query().Get("effective")
+	if effective == "" && r.ContentLength > 0 {
+		var body struct {
+			EffectiveDate string `json:"effective_date"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		effective = body.EffectiveDate
+	}
+	if effective == "" {
+		effective = time.Now().UTC().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", effective); err != nil {
+		http.Error(w, `{"message":"effective date must be YYYY-MM-DD"}`, http.StatusBadRequest)
+		return
+	}
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id IN (?, ?) AND company_id = ?`, fromID, toID, companyDBID).Scan(&n)
+	if n != 2 {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	result := reassignResult{FromUserID: fromID, ToUserID: toID, EffectiveDate: effective}
+	if result.StatIDs, err = reassignUserStats(tx, companyDBID, fromID, toID, effective, r.Context().Value("user_id")); err != nil {
+		webFail("Failed to reassign stats", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit reassignment", w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// heldStatsQuery selects the stats a user holds, canonically or through stat_user_assignments.
+// Arguments: company, user, company, user.
+const heldStatsQuery = `
+	SELECT id FROM stats WHERE company_id = ? AND assigned_user_id = ?
+	UNION SELECT a.stat_id FROM stat_user_assignments a JOIN stats s ON s.id = a.stat_id WHERE s.company_id = ? AND a.user_id = ?
+`
+
+// userStatIDs lists the stats a user holds.
+func userStatIDs(q queryer, companyDBID, userID int) ([]int, error) {
+	rows, err := q.Query(heldStatsQuery+` ORDER BY 1`, companyDBID, userID, companyDBID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// reassignUserStats moves every stat held by fromID to toID within tx, recording the assignment
+// history and activity, and returns the stats moved.
+func reassignUserStats(tx *sql.Tx, companyDBID, fromID, toID int, effective string, actor interface{}) ([]int, error) {
+	statIDs, err := userStatIDs(tx, companyDBID, fromID)
+	if err != nil {
+		return nil, err
+	}
+	return statIDs, reassignStats(tx, statIDs, fromID, toID, effective, actor)
+}
+
+// reassignStats moves the given stats from fromID to toID within tx.
+func reassignStats(tx *sql.Tx, statIDs []int, fromID, toID int, effective string, actor interface{}) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, statID := range statIDs {
+		if _, err := tx.Exec(`UPDATE stats SET assigned_user_id = ? WHERE id = ? AND assigned_user_id = ?`, toID, statID, fromID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM stat_user_assignments WHERE stat_id = ? AND user_id = ?`, statID, fromID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO stat_user_assignments (stat_id, user_id) VALUES (?, ?)`, statID, toID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO stat_assignment_history (stat_id, from_user_id, to_user_id, effective_date, changed_by, changed_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, statID, fromID, toID, effective, actor, now); err != nil {
+			return err
+		}
+		if err := logActivity(tx, actor, activityStatReassigned, statID, "", map[string]interface{}{
+			"from_user_id": fromID, "to_user_id": toID, "effective_date": effective, "bulk": true,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type transferStat struct {
+	ID         int    `json:"id"`
+	ShortID    string `json:"short_id"`
+	FullName   string `json:"full_name"`
+	Canonical  bool   `json:"canonical"`  // stats.assigned_user_id is the user
+	Assignment bool   `json:"assignment"` // a stat_user_assignments row names the user
+}
+
+type transferResult struct {
+	FromUserID    int            `json:"from_user_id"`
+	ToUserID      int            `json:"to_user_id"`
+	EffectiveDate string         `json:"effective_date"`
+	Preview       bool           `json:"preview"`
+	Stats         []transferStat `json:"stats"`
+}
+
+// personalStatsHeld lists the personal stats a user holds and how they hold them.
+func personalStatsHeld(q queryer, companyDBID, userID int) ([]transferStat, error) {
+	rows, err := q.Query(`
+		SELECT s.id, s.short_id, s.full_name, COALESCE(s.assigned_user_id = ?, 0),
+		       EXISTS (SELECT 1 FROM stat_user_assignments a WHERE a.stat_id = s.id AND a.user_id = ?)
+		FROM stats s WHERE s.type = 'personal' AND s.id IN (`+heldStatsQuery+`)
+		ORDER BY s.short_id
+	`, userID, userID, companyDBID, userID, companyDBID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []transferStat{}
+	for rows.Next() {
+		var s transferStat
+		if err := rows.Scan(&s.ID, &s.ShortID, &s.FullName, &s.Canonical, &s.Assignment); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// ---------- POST /api/users/{id}/transfer ----------
+// Body: {"to_user_id": 7, "effective_date": "YYYY-MM-DD" (default today), "preview": false}.
+// With preview (or ?preview=1) nothing changes and the response lists what would move.
+func TransferUserStatsHandler(w http.ResponseWriter, r *http.Request) {
+	fromID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		ToUserID      int    `json:"to_user_id"`
+		EffectiveDate string `json:"effective_date"`
+		Preview       bool   `json:"preview"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if v := r.URL.Query().Get("preview"); v != "" {
+		req.Preview, _ = strconv.ParseBool(v)
+	}
+	if req.ToUserID == 0 || req.ToUserID == fromID {
+		http.Error(w, `{"message":"to_user_id must be another user"}`, http.StatusBadRequest)
+		return
+	}
+	if req.EffectiveDate == "" {
+		req.EffectiveDate = time.Now().UTC().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", req.EffectiveDate); err != nil {
+		http.Error(w, `{"message":"effective_date must be YYYY-MM-DD"}`, http.StatusBadRequest)
+		return
+	}
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND company_id = ?`, fromID, companyDBID).Scan(&n)
+	if n == 0 {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	var toActive bool
+	if err := DB.QueryRow(`SELECT active FROM users WHERE id = ? AND company_id = ?`, req.ToUserID, companyDBID).Scan(&toActive); err != nil {
+		http.Error(w, `{"message":"to_user_id is not a user of the company"}`, http.StatusBadRequest)
+		return
+	}
+	if !toActive {
+		http.Error(w, `{"message":"cannot transfer stats to a deactivated user"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	result := transferResult{FromUserID: fromID, ToUserID: req.ToUserID, EffectiveDate: req.EffectiveDate, Preview: req.Preview}
+	if result.Stats, err = personalStatsHeld(tx, companyDBID, fromID); err != nil {
+		webFail("Failed to list personal stats", w, err)
+		return
+	}
+	if !req.Preview {
+		ids := make([]int, len(result.Stats))
+		for i, s := range result.Stats {
+			ids[i] = s.ID
+		}
+		if err := reassignStats(tx, ids, fromID, req.ToUserID, req.EffectiveDate, r.Context().Value("user_id")); err != nil {
+			webFail("Failed to transfer stats", w, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			webFail("Failed to commit transfer", w, err)
+			return
+		}
+		log.Printf("User %v transferred %d personal stats from user %d to user %d", r.Context().Value("user_id"), len(ids), fromID, req.ToUserID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type assignmentHistoryEntry struct {
+	FromUserID    *int   `json:"from_user_id"`
+	FromUsername  string `json:"from_username,omitempty"`
+	ToUserID      *int   `json:"to_user_id"`
+	ToUsername    string `json:"to_username,omitempty"`
+	EffectiveDate string `json:"effective_date"`
+	ChangedAt     string `json:"changed_at"`
+}
+
+// ---------- GET /api/stats/{id}/assignment-history ----------
+func StatAssignmentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, `{"message":"`+msg+`"}`, status)
+		return
+	}
+	rows, err := DB.Query(`
+		SELECT h.from_user_id, COALESCE(f.username, ''), h.to_user_id, COALESCE(t.username, ''), h.effective_date, h.changed_at
+		FROM stat_assignment_history h
+		LEFT JOIN users f ON f.id = h.from_user_id
+		LEFT JOIN users t ON t.id = h.to_user_id
+		WHERE h.stat_id = ?
+		ORDER BY h.effective_date, h.id
+	`, statID)
+	if err != nil {
+		webFail("Failed to query assignment history", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []assignmentHistoryEntry{}
+	for rows.Next() {
+		var e assignmentHistoryEntry
+		var from, to sql.NullInt64
+		if err := rows.Scan(&from, &e.FromUsername, &to, &e.ToUsername, &e.EffectiveDate, &e.ChangedAt); err != nil {
+			webFail("Failed to scan assignment history", w, err)
+			return
+		}
+		if from.Valid {
+			id := int(from.Int64)
+			e.FromUserID = &id
+		}
+		if to.Valid {
+			id := int(to.Int64)
+			e.ToUserID = &id
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Recalculation queue: a calculated stat's weekly value is computed from its dependencies' (see
+// evalCalc: Profit = GI - Expenses, ratios, averages). Instead of recomputing inside the request that changed
+// a dependency (or edited stat_calculations), the request enqueues a recalc_jobs row and a
+// background worker writes the derived weekly_stats rows. Failed jobs are retried with backoff up to
+// recalcMaxAttempts; finished jobs are kept a week. A job also recomputes, for the weeks that
+// changed, the calculated stats built on its stat, in dependency order (see downstreamOrder), so
+// A = B + C with B = C - D is computed after B, and once. A circular calculation fails the job.
+//
+// After importing history or fixing a formula, POST /api/stats/{id}/recalculate recomputes every
+// week of one calculated stat (optionally previewed first) and POST /api/stats/recalculate every
+// calculated stat of the company.
+
+const recalcMaxAttempts = 5
+
+// recalcWake nudges the worker after an enqueue so jobs don't wait for the next poll.
+var recalcWake = make(chan struct{}, 1)
+
+func wakeRecalcWorker() {
+	select {
+	case recalcWake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueRecalcStat queues a recompute of a calculated stat for one week, or for every week when
+// weekEnding is empty. A pending job that already covers it is reused.
+func enqueueRecalcStat(ex execer, calcStatID int, weekEnding string) error {
+	_, err := ex.Exec(`
+		INSERT INTO recalc_jobs (company_id, stat_id, week_ending, status, attempts, run_after, created_at)
+		SELECT s.company_id, s.id, ?, 'pending', 0, ?, ? FROM stats s
+		WHERE s.id = ? AND s.is_calculated = 1
+		  AND NOT EXISTS (SELECT 1 FROM recalc_jobs j WHERE j.stat_id = s.id AND j.status = 'pending'
+		                  AND (j.week_ending IS NULL OR j.week_ending = ?))
+	`, nullIfEmpty(weekEnding), time.Now().UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339),
+		calcStatID, weekEnding)
+	if err == nil {
+		wakeRecalcWorker()
+	}
+	return err
+}
+
+// enqueueRecalc queues every calculated stat that has statID as a term.
+func enqueueRecalc(ex execer, statID int, weekEnding string) error {
+	rows, err := DB.Query(`SELECT stat_id FROM stat_calculations WHERE dependent_stat_id = ?`, statID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := enqueueRecalcStat(ex, id, weekEnding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRecalcWorker processes the queue in the background, one job at a time.
+func StartRecalcWorker() {
+	// Jobs left running by a previous process are picked up again.
+	if _, err := DB.Exec(`UPDATE recalc_jobs SET status = 'pending' WHERE status = 'running'`); err != nil {
+		log.Printf("Recalc worker: failed to reset running jobs: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		var lastPrune time.Time
+		for {
+			for runNextRecalcJob() {
+			}
+			if time.Since(lastPrune) > time.Hour {
+				cutoff := time.Now().UTC().AddDate(0, 0, -7).Format(time.RFC3339)
+				DB.Exec(`DELETE FROM recalc_jobs WHERE status = 'done' AND finished_at < ?`, cutoff)
+				lastPrune = time.Now()
+			}
+			select {
+			case <-ticker.C:
+			case <-recalcWake:
+			}
+		}
+	}()
+}
+
+// runNextRecalcJob claims and runs the oldest due job; it reports whether there was one.
+func runNextRecalcJob() bool {
+	now := time.Now().UTC()
+	var id, statID, attempts int
+	var week sql.NullString
+	err := DB.QueryRow(`
+		SELECT id, stat_id, week_ending, attempts FROM recalc_jobs
+		WHERE status = 'pending' AND run_after <= ? ORDER BY id LIMIT 1
+	`, now.Format(time.RFC3339)).Scan(&id, &statID, &week, &attempts)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Recalc worker: failed to fetch job: %v", err)
+		return false
+	}
+	res, err := DB.Exec(`UPDATE recalc_jobs SET status = 'running', attempts = attempts + 1, started_at = ? WHERE id = ? AND status = 'pending'`,
+		now.Format(time.RFC3339), id)
+	if err != nil {
+		log.Printf("Recalc worker: failed to claim job %d: %v", id, err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return true
+	}
+	attempts++
+
+	err = recalcChain(statID, week.String)
+
+	finished := time.Now().UTC().Format(time.RFC3339)
+	switch {
+	case err == nil:
+		DB.Exec(`UPDATE recalc_jobs SET status = 'done', last_error = NULL, finished_at = ? WHERE id = ?`, finished, id)
+	case attempts >= recalcMaxAttempts:
+		log.Printf("Recalc job %d (stat %d) failed permanently: %v", id, statID, err)
+		DB.Exec(`UPDATE recalc_jobs SET status = 'failed', last_error = ?, finished_at = ? WHERE id = ?`, err.Error(), finished, id)
+	default:
+		retry := time.Now().UTC().Add(time.Duration(1<<attempts) * 10 * time.Second).Format(time.RFC3339)
+		DB.Exec(`UPDATE recalc_jobs SET status = 'pending', last_error = ?, run_after = ? WHERE id = ?`, err.Error(), retry, id)
+	}
+	return true
+}
+
+// recalcChain recomputes a stat for week (all weeks when empty) and then, in dependency order, the
+// calculated stats built on it for the weeks whose inputs changed. A stat that fails on the way is
+// left to a job of its own, so its retries do not hold up the rest of the chain.
+func recalcChain(statID int, week string) error {
+	var companyDBID int
+	if err := DB.QueryRow(`SELECT company_id FROM stats WHERE id = ?`, statID).Scan(&companyDBID); err != nil {
+		return err
+	}
+	g, err := loadCalcGraph(DB, companyDBID)
+	if err != nil {
+		return err
+	}
+	order, err := g.downstreamOrder(statID)
+	if err != nil {
+		return err
+	}
+	changed, err := recalcStat(statID, week)
+	if err != nil {
+		return err
+	}
+	dirty := map[int][]string{statID: changed}
+	for _, id := range order {
+		weeks := map[string]bool{}
+		for _, e := range g.terms[id] {
+			for _, we := range dirty[e.From] {
+				weeks[we] = true
+			}
+		}
+		sorted := make([]string, 0, len(weeks))
+		for we := range weeks {
+			sorted = append(sorted, we)
+		}
+		sort.Strings(sorted)
+		for _, we := range sorted {
+			c, err := recalcStat(id, we)
+			if err != nil {
+				log.Printf("Recalc of stat %d for %s failed, queued on its own: %v", id, we, err)
+				if err := enqueueRecalcStat(DB, id, we); err != nil {
+					return err
+				}
+				continue
+			}
+			dirty[id] = append(dirty[id], c...)
+		}
+	}
+	return nil
+}
+
+// recalcChange is one week a recalculation writes: Old is nil for a new row, New is nil when the
+// row is removed (no dependency values, or a zero denominator).
+type recalcChange struct {
+	WeekEnding string
+	Old        *int64
+	New        *int64
+	rowID      int64
+}
+
+// planRecalc computes a calculated stat's weekly values for week (all weeks when empty) from its
+// dependencies (see evalCalc) and returns the weeks that differ from what is stored, without writing
+// anything.
+func planRecalc(tx *sql.Tx, statID int, week string) ([]recalcChange, string, error) {
+	var valueType, currency, op string
+	if err := tx.QueryRow(`
+		SELECT s.value_type, COALESCE(s.currency, cs.default_currency, ?), s.calc_operator
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ?
+	`, defaultCurrency, statID).Scan(&valueType, &currency, &op); err != nil {
+		return nil, "", err
+	}
+	terms, err := calcTerms(tx, statID)
+	if err != nil {
+		return nil, "", err
+	}
+	weeks := []string{week}
+	if week == "" {
+		rows, err := tx.Query(`
+			SELECT week_ending FROM weekly_stats WHERE stat_id IN (SELECT dependent_stat_id FROM stat_calculations WHERE stat_id = ?)
+			UNION SELECT week_ending FROM weekly_stats WHERE stat_id = ?
+			ORDER BY 1
+		`, statID, statID)
+		if err != nil {
+			return nil, "", err
+		}
+		weeks = nil
+		for rows.Next() {
+			var we string
+			if err := rows.Scan(&we); err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			weeks = append(weeks, we)
+		}
+		rows.Close()
+	}
+
+	var changes []recalcChange
+	for _, we := range weeks {
+		values := make([]*int64, len(terms))
+		for i, t := range terms {
+			var v int64
+			err := tx.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, t.StatID, we).Scan(&v)
+			if err == nil {
+				values[i] = &v
+			} else if err != sql.ErrNoRows {
+				return nil, "", err
+			}
+		}
+		total, ok := evalCalc(op, terms, values, valueType, currency)
+		c := recalcChange{WeekEnding: we}
+		if ok {
+			c.New = &total
+		}
+		var existing int64
+		err := tx.QueryRow(`SELECT id, value FROM weekly_stats WHERE stat_id = ? AND week_ending = ? LIMIT 1`, statID, we).Scan(&c.rowID, &existing)
+		switch {
+		case err == sql.ErrNoRows:
+			if !ok {
+				continue
+			}
+		case err != nil:
+			return nil, "", err
+		case ok && existing == total:
+			continue
+		default:
+			c.Old = &existing
+		}
+		changes = append(changes, c)
+	}
+	return changes, valueType, nil
+}
+
+// errRecalcPlanChanged is returned by applyRecalc when the data moved since the preview.
+var errRecalcPlanChanged = errors.New("the recalculation differs from the preview")
+
+// recalcPlanToken identifies a set of changes, so a preview can be committed only as shown.
+func recalcPlanToken(changes []recalcChange) string {
+	h := sha256.New()
+	for _, c := range changes {
+		fmt.Fprintf(h, "%s:", c.WeekEnding)
+		for _, v := range []*int64{c.Old, c.New} {
+			if v == nil {
+				fmt.Fprint(h, "-;")
+			} else {
+				fmt.Fprintf(h, "%d;", *v)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// recalcStat rewrites a calculated stat's weekly_stats rows for week (all weeks when empty), see
+// planRecalc, and returns the weeks whose value changed.
+func recalcStat(statID int, week string) ([]string, error) {
+	return applyRecalc(statID, week, "")
+}
+
+// applyRecalc is recalcStat that, given a preview token, fails with errRecalcPlanChanged unless
+// the changes are still the ones previewed.
+func applyRecalc(statID int, week, expect string) ([]string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	changes, _, err := planRecalc(tx, statID, week)
+	if err != nil {
+		return nil, err
+	}
+	if expect != "" && recalcPlanToken(changes) != expect {
+		return nil, errRecalcPlanChanged
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var changed []string
+	for _, c := range changes {
+		switch {
+		case c.Old == nil:
+			_, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, submitted_at, version, updated_at) VALUES (?, ?, ?, ?, 1, ?)`,
+				statID, c.WeekEnding, *c.New, now, now)
+		case c.New == nil:
+			_, err = tx.Exec(`DELETE FROM weekly_stats WHERE id = ?`, c.rowID)
+		default:
+			_, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, version = version + 1, updated_at = ? WHERE id = ?`, *c.New, now, c.rowID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("week %s: %w", c.WeekEnding, err)
+		}
+		changed = append(changed, c.WeekEnding)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, we := range changed {
+		publishStatEvent(liveEvent{Type: eventStatWritten, StatID: statID, WeekEnding: we})
+		if err := markAggregatesDirty(DB, statID, we); err != nil {
+			log.Printf("Failed to mark aggregates for stat %d: %v", statID, err)
+		}
+	}
+	return changed, nil
+}
+
+type recalcJob struct {
+	ID         int    `json:"id"`
+	StatID     int    `json:"stat_id"`
+	ShortID    string `json:"short_id"`
+	WeekEnding string `json:"week_ending,omitempty"` // empty = all weeks
+	Status     string `json:"status"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"last_error,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// ---------- GET /api/recalc/status?stat_id= ----------
+// Queue counts for the company and its 50 most recent jobs.
+func RecalcStatusHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	where := `j.company_id = ?`
+	args := []interface{}{companyDBID}
+	if v := r.URL.Query().Get("stat_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid stat_id"}`, http.StatusBadRequest)
+			return
+		}
+		where += ` AND j.stat_id = ?`
+		args = append(args, id)
+	}
+
+	counts := map[string]int{"pending": 0, "running": 0, "done": 0, "failed": 0}
+	rows, err := DB.Query(`SELECT status, COUNT(*) FROM recalc_jobs j WHERE `+where+` GROUP BY status`, args...)
+	if err != nil {
+		webFail("Failed to query recalc jobs", w, err)
+		return
+	}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			rows.Close()
+			webFail("Failed to scan recalc jobs", w, err)
+			return
+		}
+		counts[status] = n
+	}
+	rows.Close()
+
+	rows, err = DB.Query(`
+		SELECT j.id, j.stat_id, COALESCE(s.short_id, ''), COALESCE(j.week_ending, ''), j.status, j.attempts,
+		       COALESCE(j.last_error, ''), j.created_at, COALESCE(j.finished_at, '')
+		FROM recalc_jobs j LEFT JOIN stats s ON s.id = j.stat_id
+		WHERE `+where+` ORDER BY j.id DESC LIMIT 50`, args...)
+	if err != nil {
+		webFail("Failed to query recalc jobs", w, err)
+		return
+	}
+	defer rows.Close()
+	jobs := []recalcJob{}
+	for rows.Next() {
+		var j recalcJob
+		if err := rows.Scan(&j.ID, &j.StatID, &j.ShortID, &j.WeekEnding, &j.Status, &j.Attempts, &j.LastError, &j.CreatedAt, &j.FinishedAt); err != nil {
+			webFail("Failed to scan recalc jobs", w, err)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"counts": counts, "jobs": jobs})
+}
+
+// recalcTarget resolves the {id} of a recalculation request to a calculated stat of the caller's
+// company, answering the error itself when it is not one.
+func recalcTarget(w http.ResponseWriter, r *http.Request) (int, bool) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return 0, false
+	}
+	var isCalculated bool
+	if err := DB.QueryRow(`SELECT is_calculated FROM stats WHERE id = ? AND company_id = ?`, statID, companyDBID).Scan(&isCalculated); err != nil {
+		http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
+		return 0, false
+	}
+	if !isCalculated {
+		http.Error(w, `{"message":"stat is not calculated"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	return statID, true
+}
+
+// ---------- GET /api/stats/{id}/recalculate/preview ----------
+// The weeks a full recompute would change, with their stored and recomputed values. Pass the
+// returned token to POST /api/stats/{id}/recalculate?preview= to commit exactly this diff.
+func PreviewRecalculateHandler(w http.ResponseWriter, r *http.Request) {
+	statID, ok := recalcTarget(w, r)
+	if !ok {
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	changes, valueType, err := planRecalc(tx, statID, "")
+	if err != nil {
+		webFail("Failed to compute recalculation", w, err)
+		return
+	}
+
+	type weekDiff struct {
+		WeekEnding string  `json:"week_ending"`
+		Action     string  `json:"action"` // insert, update or delete
+		Old        *string `json:"old"`
+		New        *string `json:"new"`
+	}
+	currency := statCurrency(statID)
+	format := func(v *int64) *string {
+		if v == nil {
+			return nil
+		}
+		s := formatStatValue(*v, valueType, currency)
+		return &s
+	}
+	counts := map[string]int{"insert": 0, "update": 0, "delete": 0}
+	weeks := []weekDiff{}
+	for _, c := range changes {
+		d := weekDiff{WeekEnding: c.WeekEnding, Action: "update", Old: format(c.Old), New: format(c.New)}
+		switch {
+		case c.Old == nil:
+			d.Action = "insert"
+		case c.New == nil:
+			d.Action = "delete"
+		}
+		counts[d.Action]++
+		weeks = append(weeks, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat_id": statID,
+		"token":   recalcPlanToken(changes),
+		"counts":  counts,
+		"weeks":   weeks,
+	})
+}
+
+// ---------- POST /api/stats/{id}/recalculate[?preview=token] ----------
+// Queues a full recompute of a calculated stat. With the token of a preview the recompute runs
+// now and only if it still matches the preview (409 otherwise); the stats built on this one are
+// then queued as usual.
+func RecalculateStatHandler(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("preview"); token != "" {
+		statID, ok := recalcTarget(w, r)
+		if !ok {
+			return
+		}
+		changed, err := applyRecalc(statID, "", token)
+		if err == errRecalcPlanChanged {
+			http.Error(w, `{"message":"The data changed since the preview; preview again"}`, http.StatusConflict)
+			return
+		} else if err != nil {
+			webFail("Failed to recalculate", w, err)
+			return
+		}
+		for _, we := range changed {
+			if err := enqueueRecalc(DB, statID, we); err != nil {
+				log.Printf("Failed to queue recalculation of stats depending on %d: %v", statID, err)
+			}
+		}
+		if changed == nil {
+			changed = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Recalculated", "weeks": changed})
+		return
+	}
+	statID, ok := recalcTarget(w, r)
+	if !ok {
+		return
+	}
+	if err := enqueueRecalcStat(DB, statID, ""); err != nil {
+		webFail("Failed to queue recalculation", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Recalculation queued"})
+}
+
+// ---------- POST /api/stats/recalculate ----------
+// Queues a full recompute of every calculated stat of the company, inputs first.
+func RecalculateAllStatsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	g, err := loadCalcGraph(DB, companyDBID)
+	if err != nil {
+		webFail("Failed to load calculations", w, err)
+		return
+	}
+	order, err := g.calculatedOrder()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, "Fix the "+err.Error()+" first (see GET /api/stats/{id}/dependencies)"), http.StatusConflict)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	// Jobs run in id order, so queuing inputs first computes each stat from fresh terms.
+	for _, id := range order {
+		if err := enqueueRecalcStat(tx, id, ""); err != nil {
+			webFail("Failed to queue recalculation", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to queue recalculation", w, err)
+		return
+	}
+	wakeRecalcWorker()
+	log.Printf("User %v queued recalculation of %d calculated stats of %v", r.Context().Value("user_id"), len(order), r.Context().Value("company_id"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Recalculation queued", "stats": len(order)})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Validation rules per stat, checked wherever weekly values are written: a minimum and maximum, a
+// maximum change from the previous week (percent), a step the value must be a multiple of and
+// whether it may be negative (allow_negative, true by default). The bounds are in the stored
+// integer form (cents, hundredths). A change beyond max_change_pct is usually a typo but can be
+// real, so interactive entry accepts it when the client confirms; imports reject it. Daily values
+// are checked against the step, the sign and the maximum (a day cannot exceed what the whole week
+// may be); the minimum describes a week and is left out.
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type statRules struct {
+	Min           sql.NullInt64
+	Max           sql.NullInt64
+	MaxChangePct  sql.NullInt64
+	Step          sql.NullInt64
+	AllowNegative bool
+}
+
+// ruleViolation is a value rejected by a stat's rules. Confirmable violations are accepted when
+// the user confirms the value.
+type ruleViolation struct {
+	StatID      int    `json:"stat_id"`
+	Rule        string `json:"rule"`
+	Message     string `json:"message"`
+	Confirmable bool   `json:"confirmable,omitempty"`
+}
+
+func (v *ruleViolation) Error() string { return v.Message }
+
+func loadStatRules(q rowQueryer, statID int) (statRules, error) {
+	sr := statRules{AllowNegative: true}
+	err := q.QueryRow(`SELECT min_value, max_value, max_change_pct, step, allow_negative FROM stat_rules WHERE stat_id = ?`, statID).
+		Scan(&sr.Min, &sr.Max, &sr.MaxChangePct, &sr.Step, &sr.AllowNegative)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return sr, err
+}
+
+// checkWeeklyRules validates a weekly value for week against the stat's rules. It returns a
+// *ruleViolation when the value breaks one, or a database error.
+func checkWeeklyRules(q rowQueryer, statID int, week string, value int64, valueType string, confirmed bool) error {
+	sr, err := loadStatRules(q, statID)
+	if err != nil {
+		return err
+	}
+	if err := checkStep(statID, sr, value, valueType); err != nil {
+		return err
+	}
+	if err := checkSign(statID, sr, value, valueType); err != nil {
+		return err
+	}
+	if sr.Min.Valid && value < sr.Min.Int64 {
+		return &ruleViolation{StatID: statID, Rule: "min",
+			Message: fmt.Sprintf("%s is below the minimum of %s", ruleValue(statID, value, valueType), ruleValue(statID, sr.Min.Int64, valueType))}
+	}
+	if sr.Max.Valid && value > sr.Max.Int64 {
+		return &ruleViolation{StatID: statID, Rule: "max",
+			Message: fmt.Sprintf("%s is above the maximum of %s", ruleValue(statID, value, valueType), ruleValue(statID, sr.Max.Int64, valueType))}
+	}
+	if !sr.MaxChangePct.Valid || confirmed {
+		return nil
+	}
+	var prev int64
+	err = q.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = date(?, '-7 days')`, statID, week).Scan(&prev)
+	if err == sql.ErrNoRows || (err == nil && prev == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	change := math.Abs(float64(value-prev)) * 100 / math.Abs(float64(prev))
+	if change > float64(sr.MaxChangePct.Int64) {
+		return &ruleViolation{StatID: statID, Rule: "max_change", Confirmable: true,
+			Message: fmt.Sprintf("%s is a %.0f%% change from last week's %s (limit %d%%); confirm if it is correct",
+				ruleValue(statID, value, valueType), change, ruleValue(statID, prev, valueType), sr.MaxChangePct.Int64)}
+	}
+	return nil
+}
+
+// checkDailyRules validates a daily value against the stat's step.
+func checkDailyRules(q rowQueryer, statID int, value int64, valueType string) error {
+	sr, err := loadStatRules(q, statID)
+	if err != nil {
+		return err
+	}
+	if err := checkStep(statID, sr, value, valueType); err != nil {
+		return err
+	}
+	if err := checkSign(statID, sr, value, valueType); err != nil {
+		return err
+	}
+	if sr.Max.Valid && value > sr.Max.Int64 {
+		return &ruleViolation{StatID: statID, Rule: "max",
+			Message: fmt.Sprintf("%s is above the maximum of %s", ruleValue(statID, value, valueType), ruleValue(statID, sr.Max.Int64, valueType))}
+	}
+	return nil
+}
+
+func checkSign(statID int, sr statRules, value int64, valueType string) error {
+	if !sr.AllowNegative && value < 0 {
+		return &ruleViolation{StatID: statID, Rule: "allow_negative",
+			Message: fmt.Sprintf("%s is negative, which this stat does not allow", ruleValue(statID, value, valueType))}
+	}
+	return nil
+}
+
+func checkStep(statID int, sr statRules, value int64, valueType string) error {
+	if sr.Step.Valid && sr.Step.Int64 > 0 && value%sr.Step.Int64 != 0 {
+		return &ruleViolation{StatID: statID, Rule: "step",
+			Message: fmt.Sprintf("%s is not a multiple of %s", ruleValue(statID, value, valueType), ruleValue(statID, sr.Step.Int64, valueType))}
+	}
+	return nil
+}
+
+// ruleValue writes a value of the stat for a violation message.
+func ruleValue(statID int, v int64, valueType string) string {
+	return formatStatValue(v, valueType, statCurrency(statID))
+}
+
+// writeRuleViolation answers 422 with the violation, or 500 for any other error.
+func writeRuleViolation(w http.ResponseWriter, err error) {
+	v, ok := err.(*ruleViolation)
+	if !ok {
+		webFail("Failed to check validation rules", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(v)
+}
+
+type statRulesJSON struct {
+	Min           *string `json:"min"`
+	Max           *string `json:"max"`
+	MaxChangePct  *int    `json:"max_change_pct"`
+	Step          *string `json:"step"`
+	AllowNegative *bool   `json:"allow_negative"`
+}
+
+// ---------- GET /api/stats/{id}/rules ----------
+func GetStatRulesHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var valueType string
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ?`, statID).Scan(&valueType); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	sr, err := loadStatRules(DB, statID)
+	if err != nil {
+		webFail("Failed to load rules", w, err)
+		return
+	}
+	out, currency := statRulesJSON{}, statCurrency(statID)
+	format := func(v sql.NullInt64) *string {
+		if !v.Valid {
+			return nil
+		}
+		s := formatStatValue(v.Int64, valueType, currency)
+		return &s
+	}
+	out.Min, out.Max, out.Step = format(sr.Min), format(sr.Max), format(sr.Step)
+	if sr.MaxChangePct.Valid {
+		pct := int(sr.MaxChangePct.Int64)
+		out.MaxChangePct = &pct
+	}
+	out.AllowNegative = &sr.AllowNegative
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- PUT /api/stats/{id}/rules ----------
+// Body: {"min": "0", "max": "50000.00", "max_change_pct": 300, "step": null, "allow_negative": false}.
+// Values are in the stat's display form; null or a missing field removes that rule (allow_negative
+// goes back to true).
+func UpdateStatRulesHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"Invalid stat ID"}`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkStatCompany(r, statID); status != 0 {
+		http.Error(w, fmt.Sprintf(`{"message":"%s"}`, msg), status)
+		return
+	}
+	var req statRulesJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	var valueType string
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ?`, statID).Scan(&valueType); err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	locale, currency := requestLocale(r), statCurrency(statID)
+	parse := func(field string, raw *string) (interface{}, bool) {
+		if raw == nil || *raw == "" {
+			return nil, true
+		}
+		v, err := parseSignedValue(normalizeNumber(*raw, locale, statInputPlaces(statID)), valueType, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":"invalid %s"}`, field), http.StatusBadRequest)
+			return nil, false
+		}
+		return v, true
+	}
+	minV, ok := parse("min", req.Min)
+	if !ok {
+		return
+	}
+	maxV, ok := parse("max", req.Max)
+	if !ok {
+		return
+	}
+	step, ok := parse("step", req.Step)
+	if !ok {
+		return
+	}
+	if minV != nil && maxV != nil && minV.(int64) > maxV.(int64) {
+		http.Error(w, `{"message":"min must not exceed max"}`, http.StatusBadRequest)
+		return
+	}
+	if step != nil && step.(int64) <= 0 {
+		http.Error(w, `{"message":"step must be positive"}`, http.StatusBadRequest)
+		return
+	}
+	allowNegative := req.AllowNegative == nil || *req.AllowNegative
+	if !allowNegative && ((minV != nil && minV.(int64) < 0) || (maxV != nil && maxV.(int64) < 0)) {
+		http.Error(w, `{"message":"min and max must not be negative when allow_negative is false"}`, http.StatusBadRequest)
+		return
+	}
+	var maxChange interface{}
+	if req.MaxChangePct != nil {
+		if *req.MaxChangePct <= 0 {
+			http.Error(w, `{"message":"max_change_pct must be positive"}`, http.StatusBadRequest)
+			return
+		}
+		maxChange = *req.MaxChangePct
+	}
+
+	if minV == nil && maxV == nil && step == nil && maxChange == nil && allowNegative {
+		_, err = DB.Exec(`DELETE FROM stat_rules WHERE stat_id = ?`, statID)
+	} else {
+		_, err = DB.Exec(`
+			INSERT INTO stat_rules (stat_id, min_value, max_value, max_change_pct, step, allow_negative) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (stat_id) DO UPDATE SET min_value = excluded.min_value, max_value = excluded.max_value,
+				max_change_pct = excluded.max_change_pct, step = excluded.step, allow_negative = excluded.allow_negative
+		`, statID, minV, maxV, maxChange, step, allowNegative)
+	}
+	if err != nil {
+		webFail("Failed to save rules", w, err)
+		return
+	}
+	GetStatRulesHandler(w, r)
+}
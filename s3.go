@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3-compatible client (AWS, MinIO, Backblaze B2, Wasabi...) using
+// path-style URLs and AWS Signature Version 4. It implements only what backups need.
+type s3Client struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	HTTP      *http.Client
+}
+
+type s3Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func (c *s3Client) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(c.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+// do signs and sends a request. body may be nil; payloadHash must be the hex SHA-256 of body.
+func (c *s3Client) do(method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u, err := c.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if payloadHash == "" {
+		payloadHash = hex.EncodeToString(sha256Sum(nil))
+	}
+	c.sign(req, payloadHash, time.Now().UTC())
+
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *s3Client) PutObject(key string, body io.Reader, size int64, payloadHash string) error {
+	resp, err := c.do(http.MethodPut, key, nil, body, size, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObject returns the object body; the caller must close it.
+func (c *s3Client) GetObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) DeleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjects returns every object under prefix, sorted by key.
+func (c *s3Client) ListObjects(prefix string) ([]s3Object, error) {
+	var out []s3Object
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", q, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range result.Contents {
+			out = append(out, s3Object{Key: o.Key, Size: o.Size, LastModified: o.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
+
+// sign adds AWS SigV4 headers to req.
+func (c *s3Client) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := req.URL.Host
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	// S3 expects the query string sorted and encoded with %20 rather than "+".
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sha256Sum([]byte(canonicalRequest)))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), day)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -1,10 +1,13 @@
 package main
 
-import "log"
+import (
+    "log"
+    "os"
+)
 
 func main() {
     InitDB()  // Or run init_db.go first
-    err := RegisterCompany("946-1", "Bryan Fire & Safety", "admin", "10200mille")
+    err := RegisterCompany("946-1", "Bryan Fire & Safety", "admin", "10200mille", os.Getenv("STATHQ_INVITE_CODE"))
     if err != nil {
         log.Fatal(err)
     }
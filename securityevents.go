@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security events: every login attempt recorded by recordLogin is checked for signs of trouble,
+// which are written to security_events and sent to the company's admins by email (verified
+// addresses) and Telegram (linked chats):
+//
+//   failed_login_burst  STATHQ_SECURITY_BURST (10) failed logins within STATHQ_SECURITY_WINDOW (10m)
+//                       from one address, or against one username; one event per burst
+//   new_country         a successful login from a country the user has not signed in from before
+//   new_ip              a successful login from an address the user has not used before
+//
+// A user's first login raises nothing. Countries come from a header set by the CDN or proxy,
+// STATHQ_COUNTRY_HEADER (CF-IPCountry), read only with STATHQ_TRUST_PROXY; without it only new
+// addresses are reported. STATHQ_SECURITY_NOTIFY lists the kinds admins are told about (all three by
+// default, empty for none); every event is kept either way and listed by GET /api/security/events.
+
+const (
+	securityFailedBurst = "failed_login_burst"
+	securityNewCountry  = "new_country"
+	securityNewIP       = "new_ip"
+)
+
+// clientCountry is the two-letter country of the request, when a trusted proxy supplies it.
+func clientCountry(r *http.Request) string {
+	if !envBool("STATHQ_TRUST_PROXY", false) {
+		return ""
+	}
+	c := strings.ToUpper(strings.TrimSpace(r.Header.Get(envString("STATHQ_COUNTRY_HEADER", "CF-IPCountry"))))
+	if len(c) != 2 || c == "XX" {
+		return ""
+	}
+	return c
+}
+
+type securityEvent struct {
+	ID        int             `json:"id"`
+	Kind      string          `json:"kind"`
+	Subject   string          `json:"subject"`
+	UserID    *int            `json:"user_id"`
+	Username  string          `json:"username"`
+	IP        string          `json:"ip"`
+	Country   string          `json:"country,omitempty"`
+	Detail    json.RawMessage `json:"detail"`
+	Notified  int             `json:"notified"`
+	CreatedAt string          `json:"created_at"`
+}
+
+// detectLoginAnomalies looks at a login attempt just written to login_events as eventID.
+func detectLoginAnomalies(companyCode, username string, userID int, ip, country, method string, success bool, eventID int64) {
+	companyDBID, err := companyDBID(companyCode)
+	if err != nil {
+		return // not a company: nobody to tell
+	}
+	ev := securityEvent{Username: username, IP: ip, Country: country}
+	if userID != 0 {
+		ev.UserID = &userID
+	}
+	if !success {
+		window := envDuration("STATHQ_SECURITY_WINDOW", 10*time.Minute)
+		now := time.Now().UTC()
+		since := now.Add(-window).Format(time.RFC3339)
+		for _, by := range []struct{ name, column, value string }{{"ip", "ip", ip}, {"user", "username", username}} {
+			if by.value == "" {
+				continue
+			}
+			var failures, raised int
+			DB.QueryRow(`SELECT COUNT(*) FROM login_events WHERE company_code = ? AND success = 0 AND created_at > ? AND `+by.column+` = ?`,
+				companyCode, since, by.value).Scan(&failures)
+			if failures < envInt("STATHQ_SECURITY_BURST", 10) {
+				continue
+			}
+			ev.Kind, ev.Subject = securityFailedBurst, by.name+":"+by.value
+			DB.QueryRow(`SELECT COUNT(*) FROM security_events WHERE company_id = ? AND kind = ? AND subject = ? AND created_at > ?`,
+				companyDBID, ev.Kind, ev.Subject, since).Scan(&raised)
+			if raised == 0 {
+				raiseSecurityEvent(companyDBID, companyCode, ev, map[string]interface{}{
+					"by": by.name, "failures": failures, "window": window.String(), "method": method,
+				})
+			}
+		}
+		return
+	}
+	if userID == 0 {
+		return
+	}
+	var earlier, fromIP, fromCountry, withCountry int
+	err = DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(ip = ?), 0), COALESCE(SUM(country = ?), 0), COUNT(country)
+		FROM login_events WHERE user_id = ? AND success = 1 AND id < ?
+	`, ip, country, userID, eventID).Scan(&earlier, &fromIP, &fromCountry, &withCountry)
+	if err != nil || earlier == 0 {
+		return
+	}
+	ev.Subject = "user:" + username
+	switch {
+	case country != "" && withCountry > 0 && fromCountry == 0:
+		ev.Kind = securityNewCountry
+	case fromIP == 0:
+		ev.Kind = securityNewIP
+	default:
+		return
+	}
+	raiseSecurityEvent(companyDBID, companyCode, ev, map[string]interface{}{"method": method})
+}
+
+// raiseSecurityEvent stores an event and notifies the company's admins in the background.
+func raiseSecurityEvent(companyDBID int, companyCode string, ev securityEvent, detail map[string]interface{}) {
+	raw, _ := json.Marshal(detail)
+	ev.Detail = raw
+	ev.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	var userID interface{}
+	if ev.UserID != nil {
+		userID = *ev.UserID
+	}
+	err := DB.QueryRow(`
+		INSERT INTO security_events (company_id, kind, subject, user_id, username, ip, country, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id
+	`, companyDBID, ev.Kind, ev.Subject, userID, ev.Username, ev.IP, nullIfEmpty(ev.Country), string(raw), ev.CreatedAt).Scan(&ev.ID)
+	if err != nil {
+		log.Printf("Failed to record security event %s for %s: %v", ev.Kind, companyCode, err)
+		return
+	}
+	log.Printf("Security event %d for %s: %s %s from %s", ev.ID, companyCode, ev.Kind, ev.Subject, ev.IP)
+	notify := false
+	for _, kind := range strings.Split(envString("STATHQ_SECURITY_NOTIFY", "failed_login_burst,new_country,new_ip"), ",") {
+		notify = notify || strings.TrimSpace(kind) == ev.Kind
+	}
+	if notify {
+		go notifySecurityEvent(companyDBID, companyCode, ev, detail)
+	}
+}
+
+func securityEventMessage(companyCode string, ev securityEvent, detail map[string]interface{}) string {
+	switch ev.Kind {
+	case securityFailedBurst:
+		if detail["by"] == "ip" {
+			return fmt.Sprintf("%v failed logins to %s from %s within %v.", detail["failures"], companyCode, ev.IP, detail["window"])
+		}
+		return fmt.Sprintf("%v failed logins as %s at %s within %v.", detail["failures"], ev.Username, companyCode, detail["window"])
+	case securityNewCountry:
+		return fmt.Sprintf("%s at %s signed in from a new country, %s (%s).", ev.Username, companyCode, ev.Country, ev.IP)
+	}
+	return fmt.Sprintf("%s at %s signed in from a new address, %s.", ev.Username, companyCode, ev.IP)
+}
+
+// notifySecurityEvent tells the active users who manage the company, and records how many it reached.
+func notifySecurityEvent(companyDBID int, companyCode string, ev securityEvent, detail map[string]interface{}) {
+	rows, err := DB.Query(`SELECT id, role FROM users WHERE company_id = ? AND active = 1`, companyDBID)
+	if err != nil {
+		log.Printf("Security event %d notifications: %v", ev.ID, err)
+		return
+	}
+	var admins []int
+	for rows.Next() {
+		var id int
+		var role string
+		if rows.Scan(&id, &role) == nil && can(role, permManageCompany) {
+			admins = append(admins, id)
+		}
+	}
+	rows.Close()
+
+	msg := "StatHQ security: " + securityEventMessage(companyCode, ev, detail)
+	notified := 0
+	for _, userID := range admins {
+		reached := false
+		var chatID int64
+		if telegramToken() != "" && DB.QueryRow(`SELECT chat_id FROM telegram_links WHERE user_id = ?`, userID).Scan(&chatID) == nil {
+			if err := telegramSend(chatID, msg); err != nil {
+				log.Printf("Security event %d message to user %d failed: %v", ev.ID, userID, err)
+			} else {
+				reached = true
+			}
+		}
+		if addr, ok := verifiedEmail(userID); ok {
+			if err := sendMail(addr, "StatHQ security alert for "+companyCode, msg); err != nil {
+				log.Printf("Security event %d mail to user %d failed: %v", ev.ID, userID, err)
+			} else {
+				reached = true
+			}
+		}
+		if reached {
+			notified++
+		}
+	}
+	if _, err := DB.Exec(`UPDATE security_events SET notified = ? WHERE id = ?`, notified, ev.ID); err != nil {
+		log.Printf("Security event %d: %v", ev.ID, err)
+	}
+}
+
+// ---------- GET /api/security/events?kind=new_ip&since=2026-01-01&limit=100 ----------
+// The company's security events, newest first.
+func SecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, `{"message":"limit must be between 1 and 1000"}`, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query := `SELECT e.id, e.kind, e.subject, e.user_id, e.username, e.ip, e.country, e.detail, e.notified, e.created_at
+		FROM security_events e JOIN companies c ON c.id = e.company_id WHERE c.company_id = ?`
+	args := []interface{}{r.Context().Value("company_id")}
+	if kind := q.Get("kind"); kind != "" {
+		query += ` AND e.kind = ?`
+		args = append(args, kind)
+	}
+	if since := q.Get("since"); since != "" {
+		if _, err := time.Parse("2006-01-02", since); err != nil {
+			if _, err := time.Parse(time.RFC3339, since); err != nil {
+				http.Error(w, `{"message":"since must be YYYY-MM-DD or RFC 3339"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		query += ` AND e.created_at >= ?`
+		args = append(args, since)
+	}
+	rows, err := DB.Query(query+` ORDER BY e.id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		webFail("Failed to query security events", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []securityEvent{}
+	for rows.Next() {
+		var ev securityEvent
+		var userID sql.NullInt64
+		var country sql.NullString
+		var detail string
+		if err := rows.Scan(&ev.ID, &ev.Kind, &ev.Subject, &userID, &ev.Username, &ev.IP, &country, &detail, &ev.Notified, &ev.CreatedAt); err != nil {
+			webFail("Failed to read security events", w, err)
+			return
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			ev.UserID = &id
+		}
+		ev.Country, ev.Detail = country.String, json.RawMessage(detail)
+		out = append(out, ev)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
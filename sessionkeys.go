@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Session cookie keys and options.
+//
+// Session cookies are signed and encrypted with keys derived from the secrets in STATHQ_SESSION_KEYS
+// (comma separated) or STATHQ_SESSION_KEYS_FILE (one per line, # comments allowed). The first secret
+// signs new cookies; the rest are still accepted, so a key is rotated by putting the new secret
+// first. Sessions in use are re-issued under it (see sessionstore.go); idle ones need the old secret
+// listed until they expire. Without a secret a random one is
+// generated at start-up, which signs everyone out on every restart; production mode refuses to
+// start without one.
+//
+//   STATHQ_MODE               production or development (default development)
+//   STATHQ_COOKIE_SECURE      send the cookie over HTTPS only (default true in production)
+//   STATHQ_COOKIE_SAMESITE    lax, strict or none (default lax; none implies Secure)
+//   STATHQ_COOKIE_DOMAIN      cookie domain (default the request host)
+
+const minSessionSecretLen = 32
+
+func productionMode() bool {
+	return strings.EqualFold(envString("STATHQ_MODE", "development"), "production")
+}
+
+// loadSessionSecrets returns the configured secrets, newest first.
+func loadSessionSecrets() ([]string, error) {
+	var raw []string
+	if path := envString("STATHQ_SESSION_KEYS_FILE", ""); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = strings.Split(string(b), "\n")
+	} else {
+		raw = strings.Split(envString("STATHQ_SESSION_KEYS", ""), ",")
+	}
+	var secrets []string
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if len(s) < minSessionSecretLen {
+			return nil, fmt.Errorf("session secrets must be at least %d characters", minSessionSecretLen)
+		}
+		secrets = append(secrets, s)
+	}
+	return secrets, nil
+}
+
+// sessionKeyPairs derives a signing and an encryption key from each secret, in the order
+// securecookie expects.
+func sessionKeyPairs(secrets []string) [][]byte {
+	var pairs [][]byte
+	for _, s := range secrets {
+		hash := sha256.Sum256([]byte("stathq session signing\x00" + s))
+		block := sha256.Sum256([]byte("stathq session encryption\x00" + s))
+		pairs = append(pairs, hash[:], block[:])
+	}
+	return pairs
+}
+
+// sessionCookieOptions returns the cookie options for the deployment mode.
+func sessionCookieOptions() *sessions.Options {
+	opts := &sessions.Options{
+		Path:     "/",
+		Domain:   envString("STATHQ_COOKIE_DOMAIN", ""),
+		MaxAge:   3600 * defaultSessionPolicy().SessionHours,
+		HttpOnly: true,
+		Secure:   envBool("STATHQ_COOKIE_SECURE", productionMode()),
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(envString("STATHQ_COOKIE_SAMESITE", "lax")) {
+	case "lax":
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		opts.SameSite = http.SameSiteNoneMode
+		opts.Secure = true // browsers drop SameSite=None cookies without Secure
+	default:
+		log.Printf("warning: invalid STATHQ_COOKIE_SAMESITE, using lax")
+	}
+	return opts
+}
+
+// newSessionStore builds the session store (see sessionstore.go) from the configuration.
+func newSessionStore() *dbSessionStore {
+	secrets, err := loadSessionSecrets()
+	if err != nil {
+		log.Fatalf("Invalid session keys: %v", err)
+	}
+	if len(secrets) == 0 {
+		if productionMode() {
+			log.Fatalf("STATHQ_SESSION_KEYS or STATHQ_SESSION_KEYS_FILE must be set in production mode")
+		}
+		log.Printf("warning: no session keys configured; using a random key, sessions end when the server restarts")
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("Failed to generate session key: %v", err)
+		}
+		secrets = []string{fmt.Sprintf("%x", buf)}
+	}
+	// A sharded worker's keys are its company's own, so cookies and tokens don't carry between companies.
+	if servedCompany != "" {
+		for i := range secrets {
+			secrets[i] += "\x00" + servedCompany
+		}
+	}
+	jwtKeys = jwtKeysFrom(secrets)
+	s := newDBSessionStore(sessionKeyPairs(secrets)...)
+	s.Options = sessionCookieOptions()
+	return s
+}
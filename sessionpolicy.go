@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Session lifetime. Each company chooses how long a normal session lasts, how long a remember-me
+// session lasts and how long a session may sit idle; companies without a row in
+// company_session_policy use STATHQ_SESSION_HOURS (8), STATHQ_REMEMBER_DAYS (30) and
+// STATHQ_SESSION_IDLE_MINUTES (0 = no idle timeout).
+//
+// The session cookie carries when it was issued and last used. Remember-me sessions are re-issued
+// with a fresh id and expiry once a day while in use (rotation), up to the remember-me lifetime
+// after the last rotation, so a copied cookie stops working once it falls idle.
+
+type sessionPolicy struct {
+	SessionHours int `json:"session_hours"`
+	RememberDays int `json:"remember_days"` // 0 disables remember-me for the company
+	IdleMinutes  int `json:"idle_minutes"`  // 0 = no idle timeout
+}
+
+const (
+	sessionRotateEvery = 24 * time.Hour
+	sessionTouchEvery  = time.Minute
+)
+
+func defaultSessionPolicy() sessionPolicy {
+	return sessionPolicy{
+		SessionHours: envInt("STATHQ_SESSION_HOURS", 8),
+		RememberDays: envInt("STATHQ_REMEMBER_DAYS", 30),
+		IdleMinutes:  envInt("STATHQ_SESSION_IDLE_MINUTES", 0),
+	}
+}
+
+// loadSessionPolicy returns the company's policy, or the defaults.
+func loadSessionPolicy(companyCode string) sessionPolicy {
+	p := defaultSessionPolicy()
+	DB.QueryRow(`
+		SELECT p.session_hours, p.remember_days, p.idle_minutes
+		FROM company_session_policy p JOIN companies c ON c.id = p.company_id
+		WHERE c.company_id = ?
+	`, companyCode).Scan(&p.SessionHours, &p.RememberDays, &p.IdleMinutes)
+	return p
+}
+
+func newSessionID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// startSession fills a freshly authenticated session and sets its cookie lifetime from the company's
+// policy. The caller saves it.
+func startSession(session *sessions.Session, userID int, companyCode string, remember bool) {
+	p := loadSessionPolicy(companyCode)
+	now := time.Now().Unix()
+	remember = remember && p.RememberDays > 0
+	session.Values["user_id"] = userID
+	session.Values["sid"] = newSessionID()
+	session.Values["issued_at"] = now
+	session.Values["rotated_at"] = now
+	session.Values["seen_at"] = now
+	session.Values["remember"] = remember
+	delete(session.Values, "impersonate_user_id")
+	opts := *store.Options
+	opts.MaxAge = p.SessionHours * 3600
+	if remember {
+		opts.MaxAge = p.RememberDays * 24 * 3600
+	}
+	session.Options = &opts
+}
+
+// enforceSessionLifetime checks an authenticated session against the company policy and refreshes
+// its activity time, rotating remember-me sessions. It returns false when the session has expired,
+// after clearing the cookie.
+func enforceSessionLifetime(w http.ResponseWriter, r *http.Request, session *sessions.Session, companyCode string) bool {
+	p := loadSessionPolicy(companyCode)
+	now := time.Now()
+	issued, _ := session.Values["issued_at"].(int64)
+	if issued == 0 {
+		// Sessions from before lifetimes were tracked: start the clock now.
+		userID, _ := session.Values["user_id"].(int)
+		startSession(session, userID, companyCode, false)
+		session.Save(r, w)
+		return true
+	}
+	remember, _ := session.Values["remember"].(bool)
+	rotated, _ := session.Values["rotated_at"].(int64)
+	seen, _ := session.Values["seen_at"].(int64)
+
+	expired := false
+	if remember {
+		expired = p.RememberDays <= 0 || now.After(time.Unix(rotated, 0).Add(time.Duration(p.RememberDays)*24*time.Hour))
+	} else {
+		expired = now.After(time.Unix(issued, 0).Add(time.Duration(p.SessionHours) * time.Hour))
+	}
+	if !expired && p.IdleMinutes > 0 && now.Sub(time.Unix(seen, 0)) > time.Duration(p.IdleMinutes)*time.Minute {
+		expired = true
+	}
+	if expired {
+		session.Values["user_id"] = 0
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+		return false
+	}
+
+	if now.Sub(time.Unix(seen, 0)) < sessionTouchEvery {
+		return true
+	}
+	session.Values["seen_at"] = now.Unix()
+	if remember && now.Sub(time.Unix(rotated, 0)) >= sessionRotateEvery {
+		session.Values["sid"] = newSessionID()
+		session.Values["rotated_at"] = now.Unix()
+		opts := *store.Options
+		opts.MaxAge = p.RememberDays * 24 * 3600
+		session.Options = &opts
+	} else if !remember {
+		// Keep the cookie's expiry where login put it rather than the store default.
+		opts := *store.Options
+		opts.MaxAge = int(time.Until(time.Unix(issued, 0).Add(time.Duration(p.SessionHours) * time.Hour)).Seconds())
+		session.Options = &opts
+	}
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to refresh session: %v", err)
+	}
+	return true
+}
+
+// ---------- GET /api/company/session-policy ----------
+func GetSessionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadSessionPolicy(r.Context().Value("company_id").(string)))
+}
+
+// ---------- PUT /api/company/session-policy ----------
+// Applies to sessions from their next request; shortening a lifetime can log users out.
+func UpdateSessionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var p sessionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if p.SessionHours < 1 || p.SessionHours > 24*14 {
+		http.Error(w, `{"message":"session_hours must be between 1 and 336"}`, http.StatusBadRequest)
+		return
+	}
+	if p.RememberDays < 0 || p.RememberDays > 365 {
+		http.Error(w, `{"message":"remember_days must be between 0 and 365"}`, http.StatusBadRequest)
+		return
+	}
+	if p.IdleMinutes < 0 || p.IdleMinutes > 24*60*30 {
+		http.Error(w, `{"message":"idle_minutes must be between 0 and 43200"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO company_session_policy (company_id, session_hours, remember_days, idle_minutes) VALUES (?, ?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET session_hours = excluded.session_hours,
+			remember_days = excluded.remember_days, idle_minutes = excluded.idle_minutes
+	`, companyDBID, p.SessionHours, p.RememberDays, p.IdleMinutes); err != nil {
+		webFail("Failed to save session policy", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Server-side sessions: the cookie only carries the session id (the "sid" value, see
+// sessionpolicy.go), signed and encrypted with the session keys (see sessionkeys.go); the values
+// live in the sessions table, keyed by the SHA-256 of the id. Admins can therefore list and revoke
+// sessions. Cookies signed with an older key are still read and are re-issued under the newest key
+// the next time the session is saved, so sessions in use carry over a key rotation. A new sid
+// (login, remember-me rotation) moves the row to the new id. Roles are read from users on every
+// request (loadAuthUser), so role changes apply immediately.
+
+type dbSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newDBSessionStore(keyPairs ...[]byte) *dbSessionStore {
+	return &dbSessionStore{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", MaxAge: 86400 * 30},
+	}
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the session for the request, cached for the rest of the request.
+func (s *dbSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie, or returns a new one when there is no
+// valid cookie or the session has expired or been revoked.
+func (s *dbSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		// Forged, or signed with a key that has since been removed: start over.
+		return session, nil
+	}
+	var data []byte
+	err = DB.QueryRow(`SELECT data FROM sessions WHERE id_hash = ? AND expires_at > ?`,
+		hashSessionID(id), time.Now().UTC().Format(time.RFC3339)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session row and cookie; a negative MaxAge deletes both.
+func (s *dbSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := DB.Exec(`DELETE FROM sessions WHERE id_hash = ?`, hashSessionID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	id, _ := session.Values["sid"].(string)
+	if id == "" {
+		id = newSessionID()
+		session.Values["sid"] = id
+	}
+	if session.ID != "" && session.ID != id {
+		if _, err := DB.Exec(`DELETE FROM sessions WHERE id_hash = ?`, hashSessionID(session.ID)); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	userID, _ := session.Values["user_id"].(int)
+	var user interface{}
+	if userID != 0 {
+		user = userID
+	}
+	now := time.Now().UTC()
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge // browser-session cookie; the row still needs an expiry
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO sessions (id_hash, user_id, data, created_at, updated_at, expires_at, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id_hash) DO UPDATE SET
+			user_id = excluded.user_id, data = excluded.data, updated_at = excluded.updated_at,
+			expires_at = excluded.expires_at, ip = excluded.ip
+	`, hashSessionID(id), user, buf.Bytes(), now.Format(time.RFC3339), now.Format(time.RFC3339),
+		now.Add(time.Duration(maxAge)*time.Second).Format(time.RFC3339), clientIP(r), r.UserAgent()); err != nil {
+		return err
+	}
+	session.ID = id
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), id, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// pruneExpiredSessions deletes expired session rows; it runs with scheduled maintenance.
+func pruneExpiredSessions() error {
+	_, err := DB.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+type activeSession struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+	LastSeen  string `json:"last_seen"`
+	ExpiresAt string `json:"expires_at"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Current   bool   `json:"current"`
+}
+
+// ---------- GET /api/admin/sessions?user_id= ----------
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.Context().Value("company_id").(string)
+	userFilter, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	current := ""
+	if session, err := store.Get(r, "session-name"); err == nil && session.ID != "" {
+		current = hashSessionID(session.ID)
+	}
+	rows, err := DB.Query(`
+		SELECT s.id, s.id_hash, u.id, u.username, s.created_at, s.updated_at, s.expires_at, COALESCE(s.ip, ''), COALESCE(s.user_agent, '')
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		JOIN companies c ON c.id = u.company_id
+		WHERE c.company_id = ? AND s.expires_at > ? AND (? = 0 OR u.id = ?)
+		ORDER BY s.updated_at DESC
+	`, companyID, time.Now().UTC().Format(time.RFC3339), userFilter, userFilter)
+	if err != nil {
+		webFail("Failed to query sessions", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []activeSession{}
+	for rows.Next() {
+		var s activeSession
+		var idHash string
+		if err := rows.Scan(&s.ID, &idHash, &s.UserID, &s.Username, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt, &s.IP, &s.UserAgent); err != nil {
+			webFail("Failed to scan sessions", w, err)
+			return
+		}
+		s.Current = idHash == current
+		out = append(out, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/admin/sessions/{id} ----------
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`
+		DELETE FROM sessions WHERE id = ? AND user_id IN (
+			SELECT u.id FROM users u JOIN companies c ON c.id = u.company_id WHERE c.company_id = ?)
+	`, mux.Vars(r)["id"], r.Context().Value("company_id"))
+	if err != nil {
+		webFail("Failed to revoke session", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"Session not found"}`, http.StatusNotFound)
+		return
+	}
+	log.Printf("User %v revoked session %s", r.Context().Value("user_id"), mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// ---------- DELETE /api/users/{id}/sessions ----------
+// Signs the user out everywhere.
+func RevokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`
+		DELETE FROM sessions WHERE user_id = (
+			SELECT u.id FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ? AND c.company_id = ?)
+	`, mux.Vars(r)["id"], r.Context().Value("company_id"))
+	if err != nil {
+		webFail("Failed to revoke sessions", w, err)
+		return
+	}
+	n, _ := res.RowsAffected()
+	log.Printf("User %v revoked %d sessions of user %s", r.Context().Value("user_id"), n, mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revoked": n})
+}
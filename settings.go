@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Company settings in one place: GET /api/company/settings returns them and PATCH changes any
+// subset. Name, locale, timezone and fiscal year start live on companies (and keep their own
+// endpoints); the default currency (of currency stats without their own, and the one reports convert
+// to, see currency.go), the W/E weekday and the trend thresholds (see trends.go) are
+// in company_settings, whose row is only written once an admin changes one of them.
+
+const (
+	defaultCurrency      = "USD"
+	defaultWeekEndingDay = time.Thursday
+)
+
+type companySettings struct {
+	Name            string `json:"name"`
+	DefaultCurrency string `json:"default_currency"`
+	Timezone        string `json:"timezone"`
+	WeekEndingDay   string `json:"week_ending_day"`
+	Locale          string `json:"locale"`
+	FiscalYearStart string `json:"fiscal_year_start"`
+	// RequireEditReason locks logged weekly values: changing one needs a reason (see valuehistory.go).
+	RequireEditReason bool `json:"require_edit_reason"`
+	// Trend thresholds in effect, the defaults unless the company set its own.
+	TrendWeeks        int     `json:"trend_weeks"`
+	TrendSteepPercent float64 `json:"trend_steep_percent"`
+	TrendLevelPercent float64 `json:"trend_level_percent"`
+}
+
+func loadCompanySettings(companyDBID int) (companySettings, error) {
+	var s companySettings
+	var currency sql.NullString
+	var weekday sql.NullInt64
+	var requireReason sql.NullBool
+	err := DB.QueryRow(`
+		SELECT c.name, c.timezone, c.locale, c.fiscal_year_start, cs.default_currency, cs.week_ending_day, cs.require_edit_reason
+		FROM companies c LEFT JOIN company_settings cs ON cs.company_id = c.id
+		WHERE c.id = ?
+	`, companyDBID).Scan(&s.Name, &s.Timezone, &s.Locale, &s.FiscalYearStart, &currency, &weekday, &requireReason)
+	if err != nil {
+		return s, err
+	}
+	s.RequireEditReason = requireReason.Bool
+	s.DefaultCurrency = defaultCurrency
+	if currency.Valid && currency.String != "" {
+		s.DefaultCurrency = currency.String
+	}
+	s.WeekEndingDay = defaultWeekEndingDay.String()
+	if weekday.Valid && weekday.Int64 >= 0 && weekday.Int64 <= 6 {
+		s.WeekEndingDay = time.Weekday(weekday.Int64).String()
+	}
+	tr := companyTrendRules(companyDBID)
+	s.TrendWeeks, s.TrendSteepPercent, s.TrendLevelPercent = tr.Weeks, tr.SteepPercent, tr.LevelPercent
+	return s, nil
+}
+
+// weekEndingDayOf returns a company's (by database id) W/E weekday, Thursday unless configured.
+func weekEndingDayOf(companyDBID int) time.Weekday {
+	var day int
+	if err := DB.QueryRow(`SELECT week_ending_day FROM company_settings WHERE company_id = ?`, companyDBID).Scan(&day); err != nil || day < 0 || day > 6 {
+		return defaultWeekEndingDay
+	}
+	return time.Weekday(day)
+}
+
+// companyWeekEndingDay is weekEndingDayOf by public company_id.
+func companyWeekEndingDay(companyID string) time.Weekday {
+	id, err := companyDBID(companyID)
+	if err != nil {
+		return defaultWeekEndingDay
+	}
+	return weekEndingDayOf(id)
+}
+
+// requestWeekEndingDay is companyWeekEndingDay for the authenticated caller.
+func requestWeekEndingDay(r *http.Request) time.Weekday {
+	companyID, _ := r.Context().Value("company_id").(string)
+	return companyWeekEndingDay(companyID)
+}
+
+// parseWeekday accepts an English weekday name or its first three letters, in any case.
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || (len(s) == 3 && strings.HasPrefix(name, s)) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+// ---------- GET /api/company/settings ----------
+func GetCompanySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	s, err := loadCompanySettings(companyDBID)
+	if err != nil {
+		webFail("Failed to load company settings", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// ---------- PATCH /api/company/settings ----------
+// Body: any of {"name", "default_currency", "timezone", "week_ending_day", "locale",
+// "fiscal_year_start", "require_edit_reason", "trend_weeks", "trend_steep_percent", "trend_level_percent"};
+// fields left out are unchanged and a trend threshold of 0 goes back to the default. The W/E weekday
+// cannot change once the company has weekly values, since they are keyed by their W/E date, nor the
+// default currency to one with other places while stats in it have values (see currency.go).
+func UpdateCompanySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name              *string  `json:"name"`
+		DefaultCurrency   *string  `json:"default_currency"`
+		Timezone          *string  `json:"timezone"`
+		WeekEndingDay     *string  `json:"week_ending_day"`
+		Locale            *string  `json:"locale"`
+		FiscalYearStart   *string  `json:"fiscal_year_start"`
+		RequireEditReason *bool    `json:"require_edit_reason"`
+		TrendWeeks        *int     `json:"trend_weeks"`
+		TrendSteepPercent *float64 `json:"trend_steep_percent"`
+		TrendLevelPercent *float64 `json:"trend_level_percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 200 {
+			http.Error(w, `{"message":"name must be 1-200 characters"}`, http.StatusBadRequest)
+			return
+		}
+		sets, args = append(sets, "name = ?"), append(args, name)
+	}
+	if req.Timezone != nil {
+		tz := strings.TrimSpace(*req.Timezone)
+		if tz == "" {
+			tz = defaultTimezone
+		}
+		if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+			http.Error(w, `{"message":"timezone must be an IANA name such as Europe/London"}`, http.StatusBadRequest)
+			return
+		}
+		sets, args = append(sets, "timezone = ?"), append(args, tz)
+	}
+	if req.Locale != nil {
+		locale := strings.TrimSpace(*req.Locale)
+		if locale == "" || len(locale) > 35 {
+			http.Error(w, `{"message":"locale is required (e.g. en-US, de-DE)"}`, http.StatusBadRequest)
+			return
+		}
+		sets, args = append(sets, "locale = ?"), append(args, locale)
+	}
+	if req.FiscalYearStart != nil {
+		start := *req.FiscalYearStart
+		if start == "" {
+			start = defaultFiscalYearStart
+		}
+		fc, err := parseFiscalStart(start)
+		if err != nil {
+			http.Error(w, `{"message":"fiscal_year_start must be MM-DD, e.g. 07-01"}`, http.StatusBadRequest)
+			return
+		}
+		sets, args = append(sets, "fiscal_year_start = ?"), append(args, fc.String())
+	}
+	var currency *string
+	if req.DefaultCurrency != nil {
+		c := strings.ToUpper(strings.TrimSpace(*req.DefaultCurrency))
+		if c == "" {
+			c = defaultCurrency
+		}
+		if !validCurrencyCode(c) {
+			http.Error(w, `{"message":"default_currency must be an ISO 4217 code such as USD or EUR"}`, http.StatusBadRequest)
+			return
+		}
+		if msg := checkDefaultCurrencyChange(companyDBID, c); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusConflict)
+			return
+		}
+		currency = &c
+	}
+	var weekday *time.Weekday
+	if req.WeekEndingDay != nil {
+		d, err := parseWeekday(*req.WeekEndingDay)
+		if err != nil {
+			http.Error(w, `{"message":"week_ending_day must be a weekday name such as Thursday"}`, http.StatusBadRequest)
+			return
+		}
+		if d != weekEndingDayOf(companyDBID) {
+			var values int
+			if err := DB.QueryRow(`SELECT COUNT(*) FROM weekly_stats w JOIN stats s ON s.id = w.stat_id WHERE s.company_id = ?`, companyDBID).Scan(&values); err != nil {
+				webFail("Failed to check weekly values", w, err)
+				return
+			}
+			if values > 0 {
+				http.Error(w, `{"message":"week_ending_day cannot change once the company has weekly values"}`, http.StatusConflict)
+				return
+			}
+		}
+		weekday = &d
+	}
+	// The thresholds are checked together, as they will be in effect afterwards.
+	trendSets := map[string]interface{}{}
+	if req.TrendWeeks != nil || req.TrendSteepPercent != nil || req.TrendLevelPercent != nil {
+		tr, def := companyTrendRules(companyDBID), defaultTrendRules()
+		if req.TrendWeeks != nil {
+			tr.Weeks, trendSets["trend_weeks"] = *req.TrendWeeks, *req.TrendWeeks
+			if *req.TrendWeeks == 0 {
+				tr.Weeks, trendSets["trend_weeks"] = def.Weeks, nil
+			}
+		}
+		if req.TrendSteepPercent != nil {
+			tr.SteepPercent, trendSets["trend_steep_percent"] = *req.TrendSteepPercent, *req.TrendSteepPercent
+			if *req.TrendSteepPercent == 0 {
+				tr.SteepPercent, trendSets["trend_steep_percent"] = def.SteepPercent, nil
+			}
+		}
+		if req.TrendLevelPercent != nil {
+			tr.LevelPercent, trendSets["trend_level_percent"] = *req.TrendLevelPercent, *req.TrendLevelPercent
+			if *req.TrendLevelPercent == 0 {
+				tr.LevelPercent, trendSets["trend_level_percent"] = def.LevelPercent, nil
+			}
+		}
+		if msg := tr.check(); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to update company settings", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if len(sets) > 0 {
+		if _, err := tx.Exec(`UPDATE companies SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, companyDBID)...); err != nil {
+			webFail("Failed to update company settings", w, err)
+			return
+		}
+	}
+	if currency != nil || weekday != nil || req.RequireEditReason != nil || len(trendSets) > 0 {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO company_settings (company_id) VALUES (?)`, companyDBID); err != nil {
+			webFail("Failed to update company settings", w, err)
+			return
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		if currency != nil {
+			if _, err := tx.Exec(`UPDATE company_settings SET default_currency = ?, updated_at = ? WHERE company_id = ?`, *currency, now, companyDBID); err != nil {
+				webFail("Failed to update company settings", w, err)
+				return
+			}
+			// Division totals are kept per currency.
+			if err := markCompanyAggregatesDirty(tx, companyDBID); err != nil {
+				webFail("Failed to mark aggregates", w, err)
+				return
+			}
+		}
+		if weekday != nil {
+			if _, err := tx.Exec(`UPDATE company_settings SET week_ending_day = ?, updated_at = ? WHERE company_id = ?`, int(*weekday), now, companyDBID); err != nil {
+				webFail("Failed to update company settings", w, err)
+				return
+			}
+		}
+		if req.RequireEditReason != nil {
+			if _, err := tx.Exec(`UPDATE company_settings SET require_edit_reason = ?, updated_at = ? WHERE company_id = ?`, *req.RequireEditReason, now, companyDBID); err != nil {
+				webFail("Failed to update company settings", w, err)
+				return
+			}
+		}
+		for column, v := range trendSets {
+			if _, err := tx.Exec(`UPDATE company_settings SET `+column+` = ?, updated_at = ? WHERE company_id = ?`, v, now, companyDBID); err != nil {
+				webFail("Failed to update company settings", w, err)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to update company settings", w, err)
+		return
+	}
+	GetCompanySettingsHandler(w, r)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Per-company database files: a company's rows can be split out of the shared database into its
+// own SQLite file with the same schema, under STATHQ_SHARD_DIR (default ./companies) as
+// <company code>.db. The file is a complete, self-contained database for that one company, so it
+// doubles as a per-company backup and as the unit a dedicated install would serve.
+//
+// Which rows belong to a company is worked out from the columns each table has (company_id,
+// stat_id, user_id, division_id, condition_id), so tables added later are picked up without
+// changes here. In sharded mode each company is served from its file (see shardrouter.go). The file
+// is also the archive format for moving a company to another instance (see companyimport.go).
+
+var shardCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func shardDir() string {
+	return envString("STATHQ_SHARD_DIR", "./companies")
+}
+
+// companyShardPath is where a company's database file lives.
+func companyShardPath(code string) (string, error) {
+	if !shardCodePattern.MatchString(code) {
+		return "", fmt.Errorf("company code %q cannot be used as a file name", code)
+	}
+	return filepath.Join(shardDir(), code+".db"), nil
+}
+
+// contextQueryer is a *sql.Conn or *sql.Tx.
+type contextQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// shardFilter returns the WHERE clause selecting a company's rows from table (with ? bound to the
+// company db id), or "" when the table holds no per-company data.
+func shardFilter(conn contextQueryer, table string) (string, error) {
+	if table == "companies" {
+		return `id = ?`, nil
+	}
+	rows, err := conn.QueryContext(context.Background(), fmt.Sprintf("PRAGMA main.table_info(%s)", table))
+	if err != nil {
+		return "", err
+	}
+	cols := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return "", err
+		}
+		cols[name] = true
+	}
+	rows.Close()
+	switch {
+	case cols["company_id"]:
+		return `company_id = ?`, nil
+	case cols["stat_id"]:
+		return `stat_id IN (SELECT id FROM main.stats WHERE company_id = ?)`, nil
+	case cols["condition_id"]:
+		return `condition_id IN (SELECT c.id FROM main.stat_conditions c JOIN main.stats s ON s.id = c.stat_id WHERE s.company_id = ?)`, nil
+	case cols["user_id"]:
+		return `user_id IN (SELECT id FROM main.users WHERE company_id = ?)`, nil
+	case cols["division_id"]:
+		return `division_id IN (SELECT id FROM main.divisions WHERE company_id = ?)`, nil
+	}
+	return "", nil
+}
+
+// exportCompanyShard writes the company's rows to a new database file at path, replacing any
+// existing file. It returns the number of rows copied per table.
+func exportCompanyShard(companyDBID int, path string) (map[string]int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	// Copy the schema first, in creation order so foreign keys resolve.
+	var schema []string
+	rows, err := DB.Query(`SELECT sql FROM sqlite_master WHERE type IN ('table', 'index') AND sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		schema = append(schema, stmt)
+	}
+	rows.Close()
+	shard, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range schema {
+		if _, err := shard.Exec(stmt); err != nil {
+			shard.Close()
+			return nil, fmt.Errorf("creating schema: %v", err)
+		}
+	}
+	shard.Close()
+
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS shard`, tmp); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE shard`)
+
+	var tables []string
+	trows, err := conn.QueryContext(ctx, `SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	for trows.Next() {
+		var name string
+		if err := trows.Scan(&name); err != nil {
+			trows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	trows.Close()
+
+	counts := map[string]int64{}
+	for _, table := range tables {
+		if table == "sessions" {
+			continue // live logins stay on this instance
+		}
+		where, err := shardFilter(conn, table)
+		if err != nil {
+			return nil, err
+		}
+		if where == "" {
+			continue
+		}
+		res, err := conn.ExecContext(ctx, fmt.Sprintf(`INSERT INTO shard.%s SELECT * FROM main.%s WHERE %s`, table, table, where), companyDBID)
+		if err != nil {
+			return nil, fmt.Errorf("copying %s: %v", table, err)
+		}
+		counts[table], _ = res.RowsAffected()
+	}
+	if err := writeArchiveInfo(ctx, conn, companyDBID); err != nil {
+		return nil, fmt.Errorf("writing archive info: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, `DETACH DATABASE shard`); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// exportCompanyShardByCode is the -export-company entry point.
+func exportCompanyShardByCode(code string) error {
+	id, err := companyDBID(code)
+	if err != nil {
+		return fmt.Errorf("company %s: %v", code, err)
+	}
+	path, err := companyShardPath(code)
+	if err != nil {
+		return err
+	}
+	counts, err := exportCompanyShard(id, path)
+	if err != nil {
+		return err
+	}
+	var parts []string
+	for table, n := range counts {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", table, n))
+		}
+	}
+	log.Printf("Exported company %s to %s (%s)", code, path, strings.Join(parts, ", "))
+	return nil
+}
+
+// ---------- GET /api/admin/company-db ----------
+// Downloads the caller's company as a standalone SQLite database.
+func CompanyShardDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.Context().Value("company_id").(string)
+	companyDBID, err := companyDBID(code)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	dir, err := os.MkdirTemp("", "stathq-shard-")
+	if err != nil {
+		webFail("Failed to create temp dir", w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "company.db")
+	if _, err := exportCompanyShard(companyDBID, path); err != nil {
+		webFail("Failed to export company database", w, err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		webFail("Failed to open company database", w, err)
+		return
+	}
+	defer f.Close()
+	name := fmt.Sprintf("stathq-%s-%s.db", strings.ToLower(code), time.Now().UTC().Format("20060102"))
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, name))
+	http.ServeContent(w, r, name, time.Now(), f)
+}
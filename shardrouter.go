@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Sharded mode (STATHQ_SHARDED=true): every company is served from its own database file (see
+// shard.go) instead of the shared stats.db. The process the operator starts does not open a database;
+// it listens on :9090 and forwards each request to a worker for the caller's company: the same binary
+// run with -serve-company <code>, on <STATHQ_SHARD_DIR>/<code>.db, listening on a loopback socket the
+// router hands it. Everything a worker does, background jobs included, reads and writes that one file.
+//
+// The company of a request is taken from, in order:
+//   - the X-Stathq-Company header or ?company= parameter (API clients, devices, webhooks; links a
+//     worker hands out, such as QR codes and email links, carry the parameter, see shardLink)
+//   - the company_id of the sign-in forms (JSON body, or the query of /auth/oidc/start)
+//   - the stathq_company cookie, which the router sets once a request routed by one of the above
+//     succeeds
+// Only the routing relies on these. The worker still authenticates the caller against its own users,
+// and its session and token keys are derived for its company (see newSessionStore), so a cookie or
+// token issued for one company is rejected by every other.
+//
+// Workers for all existing files start with the router, so each company's jobs run; a worker that
+// exits is started again on the next request. Sign-up is closed in sharded mode: a company is
+// registered or imported into the shared database as usual and moved over with -export-company. Offsite backups run per company under STATHQ_BACKUP_PREFIX/<code>/; Litestream,
+// the Telegram bot and the MQTT bridge are single-database features and stay off in workers.
+
+const shardCompanyCookie = "stathq_company"
+
+// servedCompany is the company a worker serves ("" outside sharded mode).
+var servedCompany string
+
+func shardedMode() bool {
+	return envBool("STATHQ_SHARDED", false)
+}
+
+// serveCompanyShard switches this process to serving one company's file (-serve-company).
+func serveCompanyShard(code string) {
+	path, err := companyShardPath(code)
+	if err != nil {
+		log.Fatalf("Cannot serve company: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("Cannot serve company %s: %v", code, err)
+	}
+	servedCompany, dbFile = code, path
+	log.SetPrefix("[" + code + "] ")
+	os.Setenv("STATHQ_BACKUP_PREFIX", envString("STATHQ_BACKUP_PREFIX", "stathq/")+code+"/")
+	for _, key := range []string{"STATHQ_LITESTREAM_REPLICA", "STATHQ_LITESTREAM_CONFIG", "STATHQ_TELEGRAM_TOKEN", "STATHQ_MQTT_BROKER"} {
+		os.Unsetenv(key)
+	}
+}
+
+// shardWorkerListener is the socket the router passed to this worker.
+func shardWorkerListener() net.Listener {
+	ln, err := net.FileListener(os.NewFile(3, "listener"))
+	if err != nil {
+		log.Fatalf("Worker for %s has no listener: %v", servedCompany, err)
+	}
+	return ln
+}
+
+// shardLink adds the routing parameter to a link a worker hands out, so the router can send it to
+// the right company without a cookie.
+func shardLink(link string) string {
+	if servedCompany == "" {
+		return link
+	}
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
+	}
+	return link + sep + "company=" + url.QueryEscape(servedCompany)
+}
+
+type shardWorker struct {
+	cmd   *exec.Cmd
+	proxy *httputil.ReverseProxy
+}
+
+type shardRouter struct {
+	mu      sync.Mutex
+	workers map[string]*shardWorker
+	static  *mux.Router
+}
+
+// runShardRouter starts a worker for every company file and forwards requests to them.
+func runShardRouter(addr string) error {
+	if err := os.MkdirAll(shardDir(), 0o700); err != nil {
+		return err
+	}
+	for _, key := range []string{"STATHQ_LITESTREAM_REPLICA", "STATHQ_LITESTREAM_CONFIG", "STATHQ_TELEGRAM_TOKEN", "STATHQ_MQTT_BROKER"} {
+		if envString(key, "") != "" {
+			log.Printf("warning: %s is ignored in sharded mode", key)
+		}
+	}
+	rt := &shardRouter{workers: map[string]*shardWorker{}, static: mux.NewRouter()}
+	registerStaticRoutes(rt.static)
+	entries, err := os.ReadDir(shardDir())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		code := strings.TrimSuffix(e.Name(), ".db")
+		if e.IsDir() || code == e.Name() || !shardCodePattern.MatchString(code) {
+			continue
+		}
+		if _, err := rt.worker(code); err != nil {
+			log.Printf("Failed to start worker for %s: %v", code, err)
+		}
+	}
+	fmt.Printf("Running Stat HQ (sharded, %d companies) on %s\n", len(rt.workers), addr)
+	return http.ListenAndServe(addr, rt)
+}
+
+// worker returns the running worker for a company, starting it if needed. It returns nil when the
+// company has no file.
+func (rt *shardRouter) worker(code string) (*shardWorker, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if wk := rt.workers[code]; wk != nil {
+		return wk, nil
+	}
+	path, err := companyShardPath(code)
+	if err != nil {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	// The router binds the socket and hands it over, so requests queue on it while the worker starts.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	lf, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	cmd := exec.Command(exe, "-serve-company", code)
+	cmd.ExtraFiles = []*os.File{lf}
+	cmd.Stdout, cmd.Stderr = log.Writer(), log.Writer()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	wk := &shardWorker{cmd: cmd, proxy: httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: ln.Addr().String()})}
+	wk.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Worker for %s failed %s: %v", code, r.URL.Path, err)
+		http.Error(w, `{"message": "Service unavailable"}`, http.StatusBadGateway)
+	}
+	rt.workers[code] = wk
+	log.Printf("Started worker for %s (pid %d)", code, cmd.Process.Pid)
+
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Worker for %s exited: %v", code, err)
+		rt.mu.Lock()
+		if rt.workers[code] == wk {
+			delete(rt.workers, code)
+		}
+		rt.mu.Unlock()
+	}()
+	return wk, nil
+}
+
+func (rt *shardRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/register" || r.URL.Path == "/api/trial/register" {
+		http.Error(w, `{"message": "Registration is closed on this instance"}`, http.StatusForbidden)
+		return
+	}
+	code, fromCookie := requestCompany(r)
+	if code == "" {
+		// Nothing to route by: the page and its assets need no company; the API needs a sign-in.
+		if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/services/") {
+			rt.static.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	wk, err := rt.worker(code)
+	if err != nil {
+		log.Printf("Failed to start worker for %s: %v", code, err)
+		http.Error(w, `{"message": "Service unavailable"}`, http.StatusServiceUnavailable)
+		return
+	}
+	if wk == nil {
+		if fromCookie {
+			http.SetCookie(w, &http.Cookie{Name: shardCompanyCookie, Path: "/", MaxAge: -1})
+		}
+		http.Error(w, `{"message": "Unknown company"}`, http.StatusNotFound)
+		return
+	}
+	if !fromCookie {
+		w = &shardCookieWriter{ResponseWriter: w, code: code}
+	}
+	wk.proxy.ServeHTTP(w, r)
+}
+
+// shardCookieWriter remembers the company for the browser once a request routed to it succeeds.
+type shardCookieWriter struct {
+	http.ResponseWriter
+	code string
+}
+
+func (w *shardCookieWriter) WriteHeader(status int) {
+	if status < 400 {
+		opts := sessionCookieOptions()
+		http.SetCookie(w.ResponseWriter, &http.Cookie{
+			Name: shardCompanyCookie, Value: w.code, Path: "/", MaxAge: opts.MaxAge,
+			Domain: opts.Domain, Secure: opts.Secure, HttpOnly: true, SameSite: opts.SameSite,
+		})
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *shardCookieWriter) Write(b []byte) (int, error) {
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets the proxy reach the connection for streaming and websocket upgrades.
+func (w *shardCookieWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// shardSignInPaths carry the company in their form.
+var shardSignInPaths = map[string]bool{
+	"/login":              true,
+	"/api/auth/token":     true,
+	"/login/magic":        true,
+	"/auth/passkey/begin": true,
+	"/auth/oidc/start":    true,
+}
+
+// requestCompany works out which company a request is for; fromCookie reports that only the routing
+// cookie said so.
+func requestCompany(r *http.Request) (code string, fromCookie bool) {
+	if code = strings.TrimSpace(r.Header.Get("X-Stathq-Company")); code != "" {
+		return code, false
+	}
+	if code = strings.TrimSpace(r.URL.Query().Get("company")); code != "" {
+		return code, false
+	}
+	if shardSignInPaths[r.URL.Path] {
+		if code = strings.TrimSpace(r.URL.Query().Get("company_id")); code != "" {
+			return code, false
+		}
+		if code = bodyCompany(r); code != "" {
+			return code, false
+		}
+	}
+	if c, err := r.Cookie(shardCompanyCookie); err == nil {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// bodyCompany reads company_id from a JSON body and puts the body back for the worker.
+func bodyCompany(r *http.Request) string {
+	if r.Body == nil || r.Method != http.MethodPost {
+		return ""
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+	if err != nil {
+		return ""
+	}
+	var form struct {
+		CompanyID string `json:"company_id"`
+	}
+	json.Unmarshal(buf, &form)
+	return strings.TrimSpace(form.CompanyID)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Display formatting. Each stat says how its values are written for people:
+//
+//   unit_label           appended after a space ("1,250 units"); none when empty
+//   decimal_places       places shown (0-4); when unset the value type's own, 0 for numbers and 2
+//                        for the rest (durations are always H:MM)
+//   thousands_separator  group the digits in threes, on by default
+//
+// Percentages get a "%" and currencies their symbol and, by default, their own places ("¥1,250",
+// "€1,250.00"; see currency.go). The series endpoints return a formatted_value next to each raw value so
+// every client renders the same text; separators follow the company's locale (see locale.go), so a
+// decimal-comma company sees "1.250,50". The entry grids keep their plain, re-enterable form.
+
+const maxUnitLabel = 32
+
+type statFormat struct {
+	ValueType          string
+	DecimalPlaces      *int
+	UnitLabel          string
+	ThousandsSeparator bool
+	Locale             string
+	Currency           string // currency stats: the stat's currency, or the company's default
+}
+
+// loadStatFormat reads a stat's formatting fields, for a reader in the given locale.
+func loadStatFormat(statID int, locale string) statFormat {
+	f := statFormat{ThousandsSeparator: true, Locale: locale}
+	var places sql.NullInt64
+	var unit sql.NullString
+	if err := DB.QueryRow(`
+		SELECT s.value_type, s.decimal_places, s.unit_label, s.thousands_separator, COALESCE(s.currency, cs.default_currency, ?)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ?
+	`, defaultCurrency, statID).Scan(&f.ValueType, &places, &unit, &f.ThousandsSeparator, &f.Currency); err != nil {
+		return f
+	}
+	if places.Valid {
+		n := int(places.Int64)
+		f.DecimalPlaces = &n
+	}
+	f.UnitLabel = unit.String
+	return f
+}
+
+func (f statFormat) places() int {
+	switch {
+	case f.DecimalPlaces != nil:
+		return *f.DecimalPlaces
+	case f.ValueType == "number":
+		return 0
+	case f.ValueType == "currency":
+		return currencyOf(f.Currency).Places
+	}
+	return defaultDecimalPlaces
+}
+
+// format renders a stored value.
+func (f statFormat) format(v int64) string {
+	var s string
+	if f.ValueType == "duration" {
+		s = formatDuration(v)
+	} else {
+		s = f.groupDigits(strconv.FormatFloat(statValueToFloat(v, f.ValueType, f.Currency), 'f', f.places(), 64))
+	}
+	switch f.ValueType {
+	case "percentage":
+		s += "%"
+	case "currency":
+		s = currencyOf(f.Currency).withSymbol(s)
+	}
+	if f.UnitLabel != "" {
+		s += " " + f.UnitLabel
+	}
+	return s
+}
+
+// groupDigits rewrites a plain decimal ("-1250.5") with the locale's separators.
+func (f statFormat) groupDigits(plain string) string {
+	group, point := ",", "."
+	if usesDecimalComma(f.Locale) {
+		group, point = ".", ","
+	}
+	sign := ""
+	if strings.HasPrefix(plain, "-") {
+		sign, plain = "-", plain[1:]
+	}
+	whole, frac, hasFrac := strings.Cut(plain, ".")
+	if f.ThousandsSeparator {
+		var b strings.Builder
+		for i, c := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				b.WriteString(group)
+			}
+			b.WriteRune(c)
+		}
+		whole = b.String()
+	}
+	if hasFrac {
+		return sign + whole + point + frac
+	}
+	return sign + whole
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Stripe API calls for billing.go: every company gets a Stripe customer when it registers (or the
+// first time an admin opens the billing portal), and POST /api/billing/portal returns a Stripe
+// customer portal link where admins subscribe, change plan or update their card. Nothing is sent
+// to Stripe unless STATHQ_STRIPE_SECRET_KEY is set.
+//
+//   STATHQ_STRIPE_SECRET_KEY    Stripe API secret key (sk_...)
+
+const stripeAPI = "https://api.stripe.com/v1"
+
+var stripeClient = &http.Client{Timeout: 30 * time.Second}
+
+func stripeEnabled() bool {
+	return envString("STATHQ_STRIPE_SECRET_KEY", "") != ""
+}
+
+// stripePost calls a Stripe API method with form-encoded params and decodes the response into out.
+func stripePost(path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, stripeAPI+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+envString("STATHQ_STRIPE_SECRET_KEY", ""))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := stripeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("stripe %s: %s: %s", path, resp.Status, e.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ensureStripeCustomer returns the company's Stripe customer id, creating the customer first when
+// the company has none. The company code is stored as metadata.company_id, which the webhook falls
+// back to when it does not know the customer yet.
+func ensureStripeCustomer(companyDBID int) (string, error) {
+	b, err := loadCompanyBilling(companyDBID)
+	if err != nil {
+		return "", err
+	}
+	if b.StripeCustomerID != "" {
+		return b.StripeCustomerID, nil
+	}
+	var code, name string
+	if err := DB.QueryRow(`SELECT company_id, name FROM companies WHERE id = ?`, companyDBID).Scan(&code, &name); err != nil {
+		return "", err
+	}
+	params := url.Values{"name": {name}, "metadata[company_id]": {code}}
+	var email string
+	DB.QueryRow(`SELECT COALESCE(email, '') FROM users WHERE company_id = ? AND role = 'admin' AND email_verified_at IS NOT NULL ORDER BY id LIMIT 1`, companyDBID).Scan(&email)
+	if email != "" {
+		params.Set("email", email)
+	}
+	var customer struct {
+		ID string `json:"id"`
+	}
+	if err := stripePost("/customers", params, &customer); err != nil {
+		return "", err
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO company_billing (company_id, plan, seats, stripe_customer_id)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(company_id) DO UPDATE SET stripe_customer_id = excluded.stripe_customer_id
+	`, companyDBID, b.Plan, b.Seats, customer.ID); err != nil {
+		return "", err
+	}
+	log.Printf("Created Stripe customer %s for company %s", customer.ID, code)
+	return customer.ID, nil
+}
+
+// createStripeCustomerAsync creates the Stripe customer of a newly registered company in the
+// background, so registration does not wait on Stripe. A failure is retried by the billing portal.
+func createStripeCustomerAsync(code string) {
+	if !stripeEnabled() {
+		return
+	}
+	go func() {
+		id, err := companyDBID(code)
+		if err == nil {
+			_, err = ensureStripeCustomer(id)
+		}
+		if err != nil {
+			log.Printf("Failed to create Stripe customer for company %s: %v", code, err)
+		}
+	}()
+}
+
+// ---------- POST /api/billing/portal ----------
+// Returns {"url": ...}, a short-lived Stripe customer portal session that comes back to the app.
+func BillingPortalHandler(w http.ResponseWriter, r *http.Request) {
+	if !stripeEnabled() {
+		http.Error(w, `{"message":"Billing is not configured"}`, http.StatusNotFound)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	customer, err := ensureStripeCustomer(companyDBID)
+	if err != nil {
+		webFail("Failed to create billing customer", w, err)
+		return
+	}
+	var session struct {
+		URL string `json:"url"`
+	}
+	if err := stripePost("/billing_portal/sessions", url.Values{
+		"customer":   {customer},
+		"return_url": {publicURL(r) + "/"},
+	}, &session); err != nil {
+		webFail("Failed to open billing portal", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": session.URL})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trendCounts counts week-over-week movements in the stat's good direction,
+// so a falling reversed stat counts as Up.
+type trendCounts struct {
+	Up    int `json:"up"`
+	Down  int `json:"down"`
+	Level int `json:"level"`
+}
+
+type statSummary struct {
+	StatID          int         `json:"stat_id"`
+	ShortID         string      `json:"short_id"`
+	FullName        string      `json:"full_name"`
+	ValueType       string      `json:"value_type"`
+	Reversed        bool        `json:"reversed"`
+	WeeksReported   int         `json:"weeks_reported"`
+	WeeksWithQuota  int         `json:"weeks_with_quota"`
+	WeeksQuotaMet   int         `json:"weeks_quota_met"`
+	OnTime          int         `json:"on_time"`
+	Late            int         `json:"late"`
+	Trend           trendCounts `json:"trend"`
+	QuotaAttainment *float64    `json:"quota_attainment_rate"`
+	OnTimeRate      *float64    `json:"on_time_rate"`
+}
+
+type userSummary struct {
+	UserID          int           `json:"user_id"`
+	Username        string        `json:"username"`
+	From            string        `json:"from"`
+	To              string        `json:"to"`
+	FromLabel       string        `json:"from_label"`
+	ToLabel         string        `json:"to_label"`
+	Weeks           int           `json:"weeks"`
+	StatCount       int           `json:"stat_count"`
+	QuotaAttainment *float64      `json:"quota_attainment_rate"`
+	OnTimeRate      *float64      `json:"on_time_rate"`
+	SubmissionRate  *float64      `json:"submission_rate"`
+	Trend           trendCounts   `json:"trend"`
+	Stats           []statSummary `json:"stats"`
+}
+
+// rate returns n/d, or nil when there is nothing to divide by.
+func rate(n, d int) *float64 {
+	if d == 0 {
+		return nil
+	}
+	v := float64(n) / float64(d)
+	return &v
+}
+
+// parseRangeWeeks accepts "12", "12w", "6m" (months, as 4-week blocks) or "1y" (52 weeks).
+func parseRangeWeeks(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 12, nil
+	}
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "w"):
+		s = strings.TrimSuffix(s, "w")
+	case strings.HasSuffix(s, "m"):
+		s, mult = strings.TrimSuffix(s, "m"), 4
+	case strings.HasSuffix(s, "y"):
+		s, mult = strings.TrimSuffix(s, "y"), 52
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q", s)
+	}
+	n *= mult
+	if n > 520 {
+		n = 520
+	}
+	return n, nil
+}
+
+// ---------- GET /api/users/{id}/summary?range=12w[&end=YYYY-MM-DD] ----------
+// Aggregates all of a user's personal stats over the range: quota attainment, on-time submission and trend counts.
+// Admins may view any user in their company; other users may only view themselves.
+func UserSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid user id"}`, http.StatusBadRequest)
+		return
+	}
+
+	companyID := r.Context().Value("company_id").(string)
+	callerID := r.Context().Value("user_id").(int)
+	role := r.Context().Value("role").(string)
+	if !can(role, permAllStats) && callerID != userID {
+		http.Error(w, `{"message": "Forbidden"}`, http.StatusForbidden)
+		return
+	}
+
+	var username, userCompanyID string
+	err = DB.QueryRow("SELECT u.username, c.company_id FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?", userID).Scan(&username, &userCompanyID)
+	if err != nil || userCompanyID != companyID {
+		log.Printf("User %d not found or not in company %s: %v", userID, companyID, err)
+		http.Error(w, `{"message": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	nWeeks, err := parseRangeWeeks(q.Get("range"))
+	if err != nil {
+		http.Error(w, `{"message":"invalid range (use e.g. 12, 12w, 6m, 1y)"}`, http.StatusBadRequest)
+		return
+	}
+	end := q.Get("end")
+	if end == "" {
+		end = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	} else if err := checkIfValidWE(companyID, end); err != nil {
+		http.Error(w, `{"message":"invalid end week (must be a W/E date YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	weeks, err := lastWeekEndings(end, nWeeks)
+	if err != nil {
+		webFail("Failed to compute weeks", w, err)
+		return
+	}
+	from, to := weeks[0], weeks[len(weeks)-1]
+
+	rows, err := DB.Query(`
+		SELECT id, short_id, full_name, value_type, reversed
+		FROM stats
+		WHERE type = 'personal' AND archived_at IS NULL AND deleted_at IS NULL
+		  AND (assigned_user_id = ? OR id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?))
+		ORDER BY short_id
+	`, userID, userID)
+	if err != nil {
+		webFail("Failed to query personal stats", w, err)
+		return
+	}
+	var stats []statSummary
+	for rows.Next() {
+		var s statSummary
+		if err := rows.Scan(&s.StatID, &s.ShortID, &s.FullName, &s.ValueType, &s.Reversed); err != nil {
+			rows.Close()
+			webFail("Failed to scan personal stat", w, err)
+			return
+		}
+		stats = append(stats, s)
+	}
+	rows.Close()
+
+	out := userSummary{UserID: userID, Username: username, From: from, To: to, Weeks: nWeeks, Stats: []statSummary{}}
+	if companyDBID, err := companyDBID(companyID); err == nil {
+		fiscal := companyFiscal(companyDBID)
+		out.FromLabel, out.ToLabel = fiscal.label(from), fiscal.label(to)
+	}
+	loc := companyLocation(companyID)
+	var totalMet, totalWithQuota, totalOnTime, totalTimed, totalReported int
+	for _, s := range stats {
+		if err := summarizeStat(&s, from, to, loc); err != nil {
+			webFail(fmt.Sprintf("Failed to summarize stat %d", s.StatID), w, err)
+			return
+		}
+		totalMet += s.WeeksQuotaMet
+		totalWithQuota += s.WeeksWithQuota
+		totalOnTime += s.OnTime
+		totalTimed += s.OnTime + s.Late
+		totalReported += s.WeeksReported
+		out.Trend.Up += s.Trend.Up
+		out.Trend.Down += s.Trend.Down
+		out.Trend.Level += s.Trend.Level
+		out.Stats = append(out.Stats, s)
+	}
+	out.StatCount = len(out.Stats)
+	out.QuotaAttainment = rate(totalMet, totalWithQuota)
+	out.OnTimeRate = rate(totalOnTime, totalTimed)
+	out.SubmissionRate = rate(totalReported, nWeeks*len(out.Stats))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// summarizeStat fills the counters of s from weekly_stats and stat_quotas between from and to (inclusive).
+// Submissions are late after the week's deadline in loc, the company's timezone.
+func summarizeStat(s *statSummary, from, to string, loc *time.Location) error {
+	rows, err := DB.Query(`
+		SELECT w.week_ending, w.value, w.submitted_at, q.value
+		FROM weekly_stats w
+		LEFT JOIN stat_quotas q ON q.stat_id = w.stat_id AND q.week_ending = w.week_ending
+		WHERE w.stat_id = ? AND w.week_ending BETWEEN ? AND ?
+		ORDER BY w.week_ending
+	`, s.StatID, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var prev *int64
+	for rows.Next() {
+		var we string
+		var v int64
+		var submitted sql.NullString
+		var quota sql.NullInt64
+		if err := rows.Scan(&we, &v, &submitted, &quota); err != nil {
+			return err
+		}
+		s.WeeksReported++
+
+		if quota.Valid {
+			s.WeeksWithQuota++
+			if quotaMet(v, quota.Int64, s.Reversed) {
+				s.WeeksQuotaMet++
+			}
+		}
+
+		if submitted.Valid {
+			at, perr := time.Parse(time.RFC3339, submitted.String)
+			deadline, derr := weekDeadline(we, loc)
+			if perr == nil && derr == nil {
+				if at.After(deadline) {
+					s.Late++
+				} else {
+					s.OnTime++
+				}
+			}
+		}
+
+		if prev != nil {
+			switch {
+			case v == *prev:
+				s.Trend.Level++
+			case (v > *prev) != s.Reversed:
+				s.Trend.Up++
+			default:
+				s.Trend.Down++
+			}
+		}
+		cur := v
+		prev = &cur
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.QuotaAttainment = rate(s.WeeksQuotaMet, s.WeeksWithQuota)
+	s.OnTimeRate = rate(s.OnTime, s.OnTime+s.Late)
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Super-admins run the installation: they are the admins of the operator companies listed in
+// STATHQ_OPERATOR_COMPANIES. Roles form a hierarchy (user < manager < admin < superadmin) and each
+// has the permissions of the ones below it (see permissions.go). Super-admins can list, suspend and delete companies and
+// impersonate a company's admin for support; impersonation lasts until it is ended or the session
+// expires, and every start and end is kept in impersonations.
+
+const roleSuperadmin = "superadmin"
+
+var roleRanks = map[string]int{"user": 1, "manager": 2, "admin": 3, roleSuperadmin: 4}
+
+// roleAtLeast reports whether role includes the permissions of required.
+func roleAtLeast(role, required string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[required]
+}
+
+// isOperatorCompany reports whether a company (by public company_id) is listed in
+// STATHQ_OPERATOR_COMPANIES.
+func isOperatorCompany(code string) bool {
+	for _, c := range strings.Split(envString("STATHQ_OPERATOR_COMPANIES", ""), ",") {
+		if c = strings.TrimSpace(c); c != "" && c == code {
+			return true
+		}
+	}
+	return false
+}
+
+type authUser struct {
+	CompanyID string
+	Username  string
+	Role      string // effective role, superadmin for operator company admins
+	Suspended bool   // the user's company is suspended
+	Active    bool   // false once deactivated, see deactivation.go
+}
+
+func loadAuthUser(userID int) (authUser, error) {
+	var u authUser
+	var suspendedAt sql.NullString
+	err := DB.QueryRow(`
+		SELECT c.company_id, u.username, u.role, c.suspended_at, u.active
+		FROM users u JOIN companies c ON u.company_id = c.id WHERE u.id = ?
+	`, userID).Scan(&u.CompanyID, &u.Username, &u.Role, &suspendedAt, &u.Active)
+	if err != nil {
+		return u, err
+	}
+	if u.Role == "admin" && isOperatorCompany(u.CompanyID) {
+		u.Role = roleSuperadmin
+	}
+	u.Suspended = suspendedAt.Valid
+	return u, nil
+}
+
+// companySuspended reports whether a company (by public company_id) is suspended.
+func companySuspended(code string) bool {
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM companies WHERE company_id = ? AND suspended_at IS NOT NULL`, code).Scan(&n)
+	return n > 0
+}
+
+type adminCompany struct {
+	ID              int     `json:"id"`
+	CompanyID       string  `json:"company_id"`
+	Name            string  `json:"name"`
+	Users           int     `json:"users"`
+	Stats           int     `json:"stats"`
+	LastLoginAt     *string `json:"last_login_at"`
+	TrialExpiresAt  *string `json:"trial_expires_at,omitempty"`
+	SuspendedAt     *string `json:"suspended_at,omitempty"`
+	SuspendedReason string  `json:"suspended_reason,omitempty"`
+	Operator        bool    `json:"operator"`
+}
+
+// adminCompanyID reads {id}, the company's database id, and checks it exists.
+func adminCompanyID(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid company id"}`, http.StatusBadRequest)
+		return 0, "", false
+	}
+	var code string
+	if err := DB.QueryRow(`SELECT company_id FROM companies WHERE id = ?`, id).Scan(&code); err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Company not found"}`, http.StatusNotFound)
+		return 0, "", false
+	} else if err != nil {
+		webFail("Failed to load company", w, err)
+		return 0, "", false
+	}
+	return id, code, true
+}
+
+// ---------- GET /api/admin/companies?q= ----------
+func ListAdminCompaniesHandler(w http.ResponseWriter, r *http.Request) {
+	q := "%" + strings.TrimSpace(r.URL.Query().Get("q")) + "%"
+	rows, err := DB.Query(`
+		SELECT c.id, c.company_id, c.name,
+		       (SELECT COUNT(*) FROM users WHERE company_id = c.id),
+		       (SELECT COUNT(*) FROM stats WHERE company_id = c.id),
+		       (SELECT MAX(last_login_at) FROM users WHERE company_id = c.id),
+		       (SELECT expires_at FROM company_trials WHERE company_id = c.id),
+		       c.suspended_at, COALESCE(c.suspended_reason, '')
+		FROM companies c
+		WHERE c.company_id LIKE ? OR c.name LIKE ?
+		ORDER BY c.id
+	`, q, q)
+	if err != nil {
+		webFail("Failed to query companies", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []adminCompany{}
+	for rows.Next() {
+		var c adminCompany
+		var lastLogin, trial, suspended sql.NullString
+		if err := rows.Scan(&c.ID, &c.CompanyID, &c.Name, &c.Users, &c.Stats, &lastLogin, &trial, &suspended, &c.SuspendedReason); err != nil {
+			webFail("Failed to scan companies", w, err)
+			return
+		}
+		if lastLogin.Valid {
+			c.LastLoginAt = &lastLogin.String
+		}
+		if trial.Valid {
+			c.TrialExpiresAt = &trial.String
+		}
+		if suspended.Valid {
+			c.SuspendedAt = &suspended.String
+		}
+		c.Operator = isOperatorCompany(c.CompanyID)
+		out = append(out, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/admin/companies/{id}/suspend ----------
+// Body (optional): {"reason": "..."}. Users of a suspended company cannot sign in or use the API.
+func SuspendCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	id, code, ok := adminCompanyID(w, r)
+	if !ok {
+		return
+	}
+	if isOperatorCompany(code) {
+		http.Error(w, `{"message":"operator companies cannot be suspended"}`, http.StatusConflict)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := DB.Exec(`UPDATE companies SET suspended_at = COALESCE(suspended_at, ?), suspended_reason = ? WHERE id = ?`,
+		now, strings.TrimSpace(req.Reason), id); err != nil {
+		webFail("Failed to suspend company", w, err)
+		return
+	}
+	log.Printf("Company %s suspended by user %v: %s", code, r.Context().Value("user_id"), req.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "company_id": code, "suspended": true})
+}
+
+// ---------- DELETE /api/admin/companies/{id}/suspend ----------
+func UnsuspendCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	id, code, ok := adminCompanyID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET suspended_at = NULL, suspended_reason = NULL WHERE id = ?`, id); err != nil {
+		webFail("Failed to lift suspension", w, err)
+		return
+	}
+	log.Printf("Company %s unsuspended by user %v", code, r.Context().Value("user_id"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "company_id": code, "suspended": false})
+}
+
+// ---------- DELETE /api/admin/companies/{id}?dry_run=1 ----------
+// Offboards a company: its users, divisions, stats, values and every other row it owns are removed
+// in one transaction. With dry_run the deletion is rolled back and only the row counts are returned.
+func DeleteAdminCompanyHandler(w http.ResponseWriter, r *http.Request) {
+	id, code, ok := adminCompanyID(w, r)
+	if !ok {
+		return
+	}
+	if isOperatorCompany(code) {
+		http.Error(w, `{"message":"operator companies cannot be deleted"}`, http.StatusConflict)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to delete company", w, err)
+		return
+	}
+	defer tx.Rollback()
+	counts, err := deleteCompanyTx(tx, int64(id))
+	if err != nil {
+		webFail("Failed to delete company", w, err)
+		return
+	}
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			webFail("Failed to delete company", w, err)
+			return
+		}
+		log.Printf("Company %s deleted by user %v", code, r.Context().Value("user_id"))
+	}
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": id, "company_id": code, "dry_run": dryRun, "deleted": !dryRun, "rows": counts, "total_rows": total,
+	})
+}
+
+// deleteCompanyTx removes a company and everything it owns, returning the rows deleted per table.
+// Rows are found the same way as for a company export (see shardFilter). Tables are emptied in
+// reverse creation order so children go before the stats, users and divisions their filters join
+// through, and before rows that reference users without a cascade (weekly_stats, daily_stats).
+// Deleting values fires the change_log triggers, so a second pass clears what they wrote.
+func deleteCompanyTx(tx *sql.Tx, companyDBID int64) (map[string]int64, error) {
+	rows, err := tx.Query(`SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid DESC`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	counts := map[string]int64{}
+	for pass := 0; pass < 2; pass++ {
+		for _, table := range tables {
+			where, err := shardFilter(tx, table)
+			if err != nil {
+				return nil, err
+			}
+			if where == "" {
+				continue
+			}
+			res, err := tx.Exec(fmt.Sprintf(`DELETE FROM main.%s WHERE %s`, table, where), companyDBID)
+			if err != nil {
+				return nil, fmt.Errorf("deleting from %s: %v", table, err)
+			}
+			if n, _ := res.RowsAffected(); n > 0 && pass == 0 {
+				counts[table] = n
+			}
+		}
+	}
+	return counts, nil
+}
+
+// ---------- POST /api/admin/companies/{id}/impersonate?user_id= ----------
+// Switches the caller's session to an admin of the company (the given one, or the oldest) until
+// DELETE /api/admin/impersonate. Only browser sessions can impersonate.
+func ImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	id, code, ok := adminCompanyID(w, r)
+	if !ok {
+		return
+	}
+	if _, isImpersonating := r.Context().Value("impersonator_id").(int); isImpersonating {
+		http.Error(w, `{"message":"end the current impersonation first"}`, http.StatusConflict)
+		return
+	}
+	session, err := store.Get(r, "session-name")
+	if err != nil || session.IsNew {
+		http.Error(w, `{"message":"impersonation needs a browser session"}`, http.StatusBadRequest)
+		return
+	}
+	var target int
+	if s := r.URL.Query().Get("user_id"); s != "" {
+		target, _ = strconv.Atoi(s)
+		err = DB.QueryRow(`SELECT id FROM users WHERE id = ? AND company_id = ? AND role = 'admin'`, target, id).Scan(&target)
+	} else {
+		err = DB.QueryRow(`SELECT id FROM users WHERE company_id = ? AND role = 'admin' ORDER BY id LIMIT 1`, id).Scan(&target)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"no such admin in this company"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		webFail("Failed to find company admin", w, err)
+		return
+	}
+
+	superadmin := r.Context().Value("user_id").(int)
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := DB.Exec(`INSERT INTO impersonations (superadmin_user_id, target_user_id, company_id, started_at, ip) VALUES (?, ?, ?, ?, ?)`,
+		superadmin, target, id, now, clientIP(r)); err != nil {
+		webFail("Failed to record impersonation", w, err)
+		return
+	}
+	session.Values["impersonate_user_id"] = target
+	if err := session.Save(r, w); err != nil {
+		webFail("Failed to save session", w, err)
+		return
+	}
+	log.Printf("User %d is impersonating user %d of company %s", superadmin, target, code)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"company_id": code, "user_id": target, "impersonating": true})
+}
+
+// ---------- DELETE /api/admin/impersonate ----------
+func EndImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	superadmin, ok := r.Context().Value("impersonator_id").(int)
+	if !ok {
+		http.Error(w, `{"message":"not impersonating"}`, http.StatusBadRequest)
+		return
+	}
+	session, err := store.Get(r, "session-name")
+	if err != nil {
+		webFail("Session error", w, err)
+		return
+	}
+	delete(session.Values, "impersonate_user_id")
+	if err := session.Save(r, w); err != nil {
+		webFail("Failed to save session", w, err)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE impersonations SET ended_at = ? WHERE superadmin_user_id = ? AND ended_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), superadmin); err != nil {
+		log.Printf("Failed to close impersonation of user %d: %v", superadmin, err)
+	}
+	log.Printf("User %d stopped impersonating user %v", superadmin, r.Context().Value("user_id"))
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"impersonating": false}`)
+}
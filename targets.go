@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Targets: the weekly battle plan, kept next to the stats it is meant to move. A target has a
+// title, an owner, a due date and a status (open, done or dropped) and may be linked to a stat
+// with the value the stat should reach by then; the value is entered and stored like a quota, in
+// the stat's value_type. Anyone in the company can read the plan; managers of stats write it, and
+// a target's owner may update their own.
+//
+// GET /api/targets/rollup reads each open linked target against its stat: the latest value and
+// the trend (see trends.go) projected to the due date.
+//
+//   achieved   the latest value already meets the target
+//   on_track   the trend reaches it by the due date
+//   at_risk    the stat moves the right way, but too slowly
+//   off_track  the stat is level or moving away from it
+//   overdue    the due date has passed without meeting it
+//   no_data    not enough values for a trend
+//
+// Targets without a stat or value are listed as untracked; only their status says how they went.
+
+const (
+	targetOpen    = "open"
+	targetDone    = "done"
+	targetDropped = "dropped"
+)
+
+const (
+	targetAchieved  = "achieved"
+	targetOnTrack   = "on_track"
+	targetAtRisk    = "at_risk"
+	targetOffTrack  = "off_track"
+	targetOverdue   = "overdue"
+	targetNoData    = "no_data"
+	targetUntracked = "untracked"
+)
+
+type target struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	OwnerID     *int   `json:"owner_user_id"`
+	Owner       string `json:"owner,omitempty"`
+	StatID      *int   `json:"stat_id"`
+	ShortID     string `json:"short_id,omitempty"`
+	TargetValue string `json:"target_value,omitempty"`
+	DueDate     string `json:"due_date"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+
+	valueType   string
+	reversed    bool
+	targetValue *int64
+}
+
+type targetRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	OwnerID     *int   `json:"owner_user_id"`
+	StatID      *int   `json:"stat_id"`
+	TargetValue string `json:"target_value"`
+	DueDate     string `json:"due_date"`
+	Status      string `json:"status"`
+}
+
+// validate checks the request and that the owner and stat belong to the company, returning the
+// target value in the stat's storage units.
+func (req *targetRequest) validate(companyDBID int) (interface{}, string) {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Description = strings.TrimSpace(req.Description)
+	req.TargetValue = strings.TrimSpace(req.TargetValue)
+	if req.Title == "" || len(req.Title) > 200 {
+		return nil, "title must be 1-200 characters"
+	}
+	if _, err := time.Parse("2006-01-02", req.DueDate); err != nil {
+		return nil, "due_date must be YYYY-MM-DD"
+	}
+	switch req.Status {
+	case "":
+		req.Status = targetOpen
+	case targetOpen, targetDone, targetDropped:
+	default:
+		return nil, "status must be open, done or dropped"
+	}
+	if req.OwnerID != nil {
+		var n int
+		DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND company_id = ?`, *req.OwnerID, companyDBID).Scan(&n)
+		if n == 0 {
+			return nil, "owner not found"
+		}
+	}
+	if req.StatID == nil {
+		if req.TargetValue != "" {
+			return nil, "target_value needs a stat_id"
+		}
+		return nil, ""
+	}
+	var valueType string
+	if err := DB.QueryRow(`SELECT value_type FROM stats WHERE id = ? AND company_id = ?`, *req.StatID, companyDBID).Scan(&valueType); err != nil {
+		return nil, "stat not found"
+	}
+	if req.TargetValue == "" {
+		return nil, ""
+	}
+	v, err := parseSignedValue(req.TargetValue, valueType, statCurrency(*req.StatID))
+	if err != nil {
+		return nil, "invalid target_value for a " + valueType + " stat"
+	}
+	return v, ""
+}
+
+const targetColumns = `t.id, t.title, t.description, t.owner_user_id, COALESCE(u.username, ''), t.stat_id, COALESCE(s.short_id, ''),
+	COALESCE(s.value_type, ''), COALESCE(s.reversed, 0), t.target_value, t.due_date, t.status, t.created_at, t.updated_at, COALESCE(t.completed_at, '')`
+
+const targetFrom = ` FROM targets t LEFT JOIN users u ON u.id = t.owner_user_id LEFT JOIN stats s ON s.id = t.stat_id`
+
+func scanTargets(rows *sql.Rows) ([]*target, error) {
+	defer rows.Close()
+	out := []*target{}
+	for rows.Next() {
+		t := &target{}
+		var owner, stat, value sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &owner, &t.Owner, &stat, &t.ShortID, &t.valueType, &t.reversed,
+			&value, &t.DueDate, &t.Status, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt); err != nil {
+			return nil, err
+		}
+		if owner.Valid {
+			id := int(owner.Int64)
+			t.OwnerID = &id
+		}
+		if stat.Valid {
+			id := int(stat.Int64)
+			t.StatID = &id
+		}
+		if value.Valid && stat.Valid {
+			v := value.Int64
+			t.targetValue = &v
+			t.TargetValue = formatStatValue(v, t.valueType, statCurrency(int(stat.Int64)))
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// loadTarget returns one of the company's targets, or nil.
+func loadTarget(companyDBID, id int) (*target, error) {
+	rows, err := DB.Query(`SELECT `+targetColumns+targetFrom+` WHERE t.id = ? AND t.company_id = ?`, id, companyDBID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := scanTargets(rows)
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// ---------- GET /api/targets?status=open&owner_user_id=&stat_id= ----------
+// The company's targets by due date.
+func ListTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	q := r.URL.Query()
+	where := []string{`t.company_id = ?`}
+	args := []interface{}{companyDBID}
+	if v := q.Get("status"); v != "" {
+		where = append(where, `t.status = ?`)
+		args = append(args, v)
+	}
+	for _, col := range []string{"owner_user_id", "stat_id"} {
+		if v := q.Get(col); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, `{"message":"invalid `+col+`"}`, http.StatusBadRequest)
+				return
+			}
+			where = append(where, `t.`+col+` = ?`)
+			args = append(args, id)
+		}
+	}
+	rows, err := DB.Query(`SELECT `+targetColumns+targetFrom+` WHERE `+strings.Join(where, " AND ")+` ORDER BY t.due_date, t.id`, args...)
+	if err != nil {
+		webFail("Failed to query targets", w, err)
+		return
+	}
+	out, err := scanTargets(rows)
+	if err != nil {
+		webFail("Failed to scan targets", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/targets ----------
+// Body: {"title", "description", "owner_user_id", "stat_id", "target_value": "5000.00", "due_date": "YYYY-MM-DD", "status"}
+// The owner defaults to the caller.
+func CreateTargetHandler(w http.ResponseWriter, r *http.Request) {
+	var req targetRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	me := r.Context().Value("user_id").(int)
+	if req.OwnerID == nil {
+		req.OwnerID = &me
+	}
+	if *req.OwnerID != me && !can(r.Context().Value("role").(string), permManageStats) {
+		http.Error(w, `{"message":"only a stats manager can set targets for others"}`, http.StatusForbidden)
+		return
+	}
+	value, msg := req.validate(companyDBID)
+	if msg != "" {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var completed interface{}
+	if req.Status != targetOpen {
+		completed = now
+	}
+	var id int
+	err = DB.QueryRow(`
+		INSERT INTO targets (company_id, title, description, owner_user_id, stat_id, target_value, due_date, status,
+			created_by, created_at, updated_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id
+	`, companyDBID, req.Title, req.Description, req.OwnerID, req.StatID, value, req.DueDate, req.Status,
+		r.Context().Value("user_id"), now, now, completed).Scan(&id)
+	if err != nil {
+		webFail("Failed to create target", w, err)
+		return
+	}
+	t, err := loadTarget(companyDBID, id)
+	if err != nil {
+		webFail("Failed to load target", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// targetForWrite resolves {id} to a target the caller may change: any with permManageStats, their
+// own otherwise. It answers the error itself.
+func targetForWrite(w http.ResponseWriter, r *http.Request) (*target, int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid target id"}`, http.StatusBadRequest)
+		return nil, 0, false
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return nil, 0, false
+	}
+	t, err := loadTarget(companyDBID, id)
+	if err != nil {
+		webFail("Failed to load target", w, err)
+		return nil, 0, false
+	}
+	if t == nil {
+		http.Error(w, `{"message":"target not found"}`, http.StatusNotFound)
+		return nil, 0, false
+	}
+	if !can(r.Context().Value("role").(string), permManageStats) && (t.OwnerID == nil || *t.OwnerID != r.Context().Value("user_id")) {
+		http.Error(w, `{"message":"only the owner or a stats manager can change this target"}`, http.StatusForbidden)
+		return nil, 0, false
+	}
+	return t, companyDBID, true
+}
+
+// ---------- PUT /api/targets/{id} ----------
+// Body as for POST. Owners without permManageStats cannot hand their target to someone else.
+func UpdateTargetHandler(w http.ResponseWriter, r *http.Request) {
+	t, companyDBID, ok := targetForWrite(w, r)
+	if !ok {
+		return
+	}
+	var req targetRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if !can(r.Context().Value("role").(string), permManageStats) && (req.OwnerID == nil || *req.OwnerID != *t.OwnerID) {
+		http.Error(w, `{"message":"only a stats manager can change a target's owner"}`, http.StatusForbidden)
+		return
+	}
+	value, msg := req.validate(companyDBID)
+	if msg != "" {
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	completed := interface{}(nullIfEmpty(t.CompletedAt))
+	switch {
+	case req.Status == targetOpen:
+		completed = nil
+	case req.Status != t.Status:
+		completed = now
+	}
+	if _, err := DB.Exec(`
+		UPDATE targets SET title = ?, description = ?, owner_user_id = ?, stat_id = ?, target_value = ?, due_date = ?, status = ?,
+			updated_at = ?, completed_at = ?
+		WHERE id = ?
+	`, req.Title, req.Description, req.OwnerID, req.StatID, value, req.DueDate, req.Status, now, completed, t.ID); err != nil {
+		webFail("Failed to update target", w, err)
+		return
+	}
+	t, err := loadTarget(companyDBID, t.ID)
+	if err != nil {
+		webFail("Failed to load target", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// ---------- DELETE /api/targets/{id} ----------
+func DeleteTargetHandler(w http.ResponseWriter, r *http.Request) {
+	t, _, ok := targetForWrite(w, r)
+	if !ok {
+		return
+	}
+	if _, err := DB.Exec(`DELETE FROM targets WHERE id = ?`, t.ID); err != nil {
+		webFail("Failed to delete target", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Target deleted"})
+}
+
+type targetProgress struct {
+	*target
+	Progress  string   `json:"progress"`
+	Latest    string   `json:"latest_value,omitempty"`
+	LatestWE  string   `json:"latest_week_ending,omitempty"`
+	Projected string   `json:"projected_value,omitempty"` // at the due date, on the current trend
+	Trend     string   `json:"trend,omitempty"`
+	WeeksLeft *float64 `json:"weeks_left,omitempty"`
+}
+
+// targetProgressOf reads a linked target against its stat's last rules.Weeks weekly values up to week.
+func targetProgressOf(t *target, rules trendRules, week string, today time.Time) (targetProgress, error) {
+	p := targetProgress{target: t, Progress: targetUntracked}
+	if t.StatID == nil || t.targetValue == nil {
+		return p, nil
+	}
+	weeks, err := lastWeekEndings(week, rules.Weeks)
+	if err != nil {
+		return p, err
+	}
+	values := make([]*int64, len(weeks))
+	var latest *int64
+	for i, we := range weeks {
+		var v int64
+		err := DB.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, *t.StatID, we).Scan(&v)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return p, err
+		}
+		values[i], latest = &v, &v
+		p.LatestWE = we
+	}
+	goal, currency := *t.targetValue, statCurrency(*t.StatID)
+	due, _ := time.Parse("2006-01-02", t.DueDate)
+	if latest != nil {
+		p.Latest = formatStatValue(*latest, t.valueType, currency)
+		if quotaMet(*latest, goal, t.reversed) {
+			p.Progress = targetAchieved
+			return p, nil
+		}
+	}
+	if today.After(due.AddDate(0, 0, 1)) {
+		p.Progress = targetOverdue
+		return p, nil
+	}
+	p.Trend, _ = rules.statTrend(values, t.reversed)
+	slope, _, n := fitTrend(values)
+	if n < 2 {
+		p.Progress = targetNoData
+		return p, nil
+	}
+	last, _ := time.Parse("2006-01-02", p.LatestWE)
+	left := math.Round(due.Sub(last).Hours()/24/7*10) / 10
+	if left < 0 {
+		left = 0
+	}
+	p.WeeksLeft = &left
+	projected := *latest + int64(math.Round(slope*left))
+	p.Projected = formatStatValue(projected, t.valueType, currency)
+	switch {
+	case quotaMet(projected, goal, t.reversed):
+		p.Progress = targetOnTrack
+	case (slope > 0) != t.reversed && slope != 0:
+		p.Progress = targetAtRisk
+	default:
+		p.Progress = targetOffTrack
+	}
+	return p, nil
+}
+
+// ---------- GET /api/targets/rollup[?owner_user_id=] ----------
+// Open targets with their progress, by due date, and how many are in each state.
+func TargetRollupHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	query := `SELECT ` + targetColumns + targetFrom + ` WHERE t.company_id = ? AND t.status = ?`
+	args := []interface{}{companyDBID, targetOpen}
+	if v := r.URL.Query().Get("owner_user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid owner_user_id"}`, http.StatusBadRequest)
+			return
+		}
+		query += ` AND t.owner_user_id = ?`
+		args = append(args, id)
+	}
+	rows, err := DB.Query(query+` ORDER BY t.due_date, t.id`, args...)
+	if err != nil {
+		webFail("Failed to query targets", w, err)
+		return
+	}
+	targets, err := scanTargets(rows)
+	if err != nil {
+		webFail("Failed to scan targets", w, err)
+		return
+	}
+
+	rules := companyTrendRules(companyDBID)
+	now := time.Now().In(companyLocation(r.Context().Value("company_id").(string)))
+	week := currentWeekEnding(now, weekEndingDayOf(companyDBID))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	counts := map[string]int{}
+	for _, s := range []string{targetAchieved, targetOnTrack, targetAtRisk, targetOffTrack, targetOverdue, targetNoData, targetUntracked} {
+		counts[s] = 0
+	}
+	out := make([]targetProgress, 0, len(targets))
+	for _, t := range targets {
+		p, err := targetProgressOf(t, rules, week, today)
+		if err != nil {
+			webFail("Failed to read target progress", w, err)
+			return
+		}
+		counts[p.Progress]++
+		out = append(out, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"week_ending": week, "counts": counts, "targets": out})
+}
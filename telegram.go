@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Telegram bot: users link a chat to their account with a one-time code from
+// POST /api/user/telegram/link, then send "GI 4520.50" to log this week's value of a stat
+// (a trailing "!" confirms a value flagged by the max_change_pct rule). Linked users get a
+// reminder once a week closes with their stats still missing, and the assigned user and the
+// company's admins are told when a weekly value crashes (see weekTrend).
+//
+//   STATHQ_TELEGRAM_TOKEN     bot token from @BotFather (bot disabled when empty)
+//   STATHQ_TELEGRAM_BOT_NAME  bot username, used to build t.me deep links for linking
+//
+// Updates are fetched by long polling, so no public webhook URL is needed.
+
+const telegramLinkTTL = 15 * time.Minute
+
+var telegramAPI = "https://api.telegram.org"
+
+var telegramClient = &http.Client{Timeout: 70 * time.Second}
+
+func telegramToken() string {
+	return envString("STATHQ_TELEGRAM_TOKEN", "")
+}
+
+// telegramCall invokes a Bot API method and decodes its result into out (when non-nil).
+func telegramCall(method string, params, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := telegramClient.Post(telegramAPI+"/bot"+telegramToken()+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("telegram %s: %v", method, err)
+	}
+	if !res.OK {
+		return fmt.Errorf("telegram %s: %s", method, res.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
+
+func telegramSend(chatID int64, text string) error {
+	return telegramCall("sendMessage", map[string]interface{}{"chat_id": chatID, "text": text}, nil)
+}
+
+func StartTelegramBot() {
+	if telegramToken() == "" {
+		return
+	}
+	log.Printf("Telegram bot enabled")
+	go pollTelegram()
+	go func() {
+		for range time.Tick(15 * time.Minute) {
+			sendTelegramReminders(time.Now())
+		}
+	}()
+}
+
+func pollTelegram() {
+	offset := 0
+	for {
+		var updates []struct {
+			UpdateID int `json:"update_id"`
+			Message  *struct {
+				Chat struct {
+					ID int64 `json:"id"`
+				} `json:"chat"`
+				Text string `json:"text"`
+			} `json:"message"`
+		}
+		if err := telegramCall("getUpdates", map[string]interface{}{"offset": offset, "timeout": 50}, &updates); err != nil {
+			log.Printf("Telegram poll failed: %v", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || strings.TrimSpace(u.Message.Text) == "" {
+				continue
+			}
+			reply := handleTelegramMessage(u.Message.Chat.ID, u.Message.Text)
+			if err := telegramSend(u.Message.Chat.ID, reply); err != nil {
+				log.Printf("Telegram reply to chat %d failed: %v", u.Message.Chat.ID, err)
+			}
+		}
+	}
+}
+
+const telegramHelp = "Send a stat's short ID and this week's value, e.g. \"GI 4520.50\". " +
+	"Add \"!\" to confirm a value flagged as an unusual change. /unlink disconnects this chat."
+
+// handleTelegramMessage processes one chat message and returns the reply.
+func handleTelegramMessage(chatID int64, text string) string {
+	fields := strings.Fields(text)
+	switch strings.ToLower(strings.SplitN(fields[0], "@", 2)[0]) {
+	case "/start", "/link":
+		if len(fields) < 2 {
+			return "Get a link code under Profile > Telegram in StatHQ and send /link CODE."
+		}
+		return linkTelegramChat(chatID, fields[1])
+	case "/help":
+		return telegramHelp
+	case "/unlink":
+		if _, err := DB.Exec(`DELETE FROM telegram_links WHERE chat_id = ?`, chatID); err != nil {
+			log.Printf("Failed to unlink telegram chat %d: %v", chatID, err)
+			return "Something went wrong, please try again."
+		}
+		return "This chat is no longer linked to StatHQ."
+	}
+
+	var userID int
+	if err := DB.QueryRow(`SELECT user_id FROM telegram_links WHERE chat_id = ?`, chatID).Scan(&userID); err == sql.ErrNoRows {
+		return "This chat is not linked. Get a link code under Profile > Telegram in StatHQ and send /link CODE."
+	} else if err != nil {
+		log.Printf("Failed to look up telegram chat %d: %v", chatID, err)
+		return "Something went wrong, please try again."
+	}
+	if !userActive(userID) {
+		return "Your StatHQ account is deactivated."
+	}
+	if len(fields) != 2 {
+		return telegramHelp
+	}
+	return telegramEnterValue(userID, fields[0], fields[1])
+}
+
+func linkTelegramChat(chatID int64, code string) string {
+	hash := hashSecretToken(strings.ToUpper(strings.TrimSpace(code)))
+	var userID int
+	err := DB.QueryRow(`SELECT user_id FROM telegram_link_codes WHERE code_hash = ? AND expires_at > ?`,
+		hash, time.Now().UTC().Format(time.RFC3339)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "That code is invalid or has expired. Get a new one in StatHQ."
+	} else if err != nil {
+		log.Printf("Failed to look up telegram link code: %v", err)
+		return "Something went wrong, please try again."
+	}
+	tx, err := DB.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec(`DELETE FROM telegram_link_codes WHERE user_id = ?`, userID)
+	}
+	if err == nil {
+		// A chat belongs to one account; relinking moves it.
+		_, err = tx.Exec(`DELETE FROM telegram_links WHERE chat_id = ? OR user_id = ?`, chatID, userID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO telegram_links (user_id, chat_id, linked_at) VALUES (?, ?, ?)`,
+			userID, chatID, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to link telegram chat %d to user %d: %v", chatID, userID, err)
+		return "Something went wrong, please try again."
+	}
+	var username string
+	DB.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&username)
+	return fmt.Sprintf("Linked to %s. %s", username, telegramHelp)
+}
+
+// telegramEnterValue logs raw as the value of the user's stat shortID for the week being entered.
+func telegramEnterValue(userID int, shortID, raw string) string {
+	var role, companyCode string
+	var companyDBID int
+	if err := DB.QueryRow(`SELECT u.role, c.company_id, c.id FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ?`, userID).
+		Scan(&role, &companyCode, &companyDBID); err != nil {
+		log.Printf("Failed to load telegram user %d: %v", userID, err)
+		return "Something went wrong, please try again."
+	}
+	if status, msg, err := companyWritable(companyDBID); err != nil {
+		log.Printf("Failed to check company of telegram user %d: %v", userID, err)
+		return "Something went wrong, please try again."
+	} else if status != 0 {
+		return msg + "."
+	}
+	statID, err := resolveQuickEntryStat(companyCode, userID, 0, shortID)
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("There is no stat %s.", strings.ToUpper(shortID))
+	} else if err != nil {
+		log.Printf("Failed to resolve stat %q for telegram user %d: %v", shortID, userID, err)
+		return "Something went wrong, please try again."
+	}
+	var shortName, valueType string
+	var assigned sql.NullInt64
+	var isCalculated bool
+	if err := DB.QueryRow(`SELECT short_id, value_type, assigned_user_id, is_calculated FROM stats WHERE id = ?`, statID).
+		Scan(&shortName, &valueType, &assigned, &isCalculated); err != nil {
+		log.Printf("Failed to load stat %d: %v", statID, err)
+		return "Something went wrong, please try again."
+	}
+	if !can(role, permAllStats) && (!assigned.Valid || int(assigned.Int64) != userID) {
+		return fmt.Sprintf("%s is not assigned to you.", shortName)
+	}
+	if isCalculated {
+		return fmt.Sprintf("%s is calculated from other stats and cannot be entered.", shortName)
+	}
+	confirmed := strings.HasSuffix(raw, "!")
+	currency := statCurrency(statID)
+	value, err := parseStatValue(normalizeNumber(strings.TrimSuffix(raw, "!"), companyLocale(companyCode), statInputPlaces(statID)), valueType, currency)
+	if err != nil {
+		return fmt.Sprintf("%q is not a valid %s value.", raw, valueType)
+	}
+	loc := companyLocation(companyCode)
+	week := enteringWeek(loc, companyWeekEndingDay(companyCode), time.Now().In(loc))
+	if _, err := writeWeeklyValue(statID, week, value, userID, confirmed, ""); err != nil {
+		if err == errStatArchived {
+			return fmt.Sprintf("%s is archived and no longer takes values.", shortName)
+		}
+		if v, ok := err.(*ruleViolation); ok {
+			if v.Confirmable {
+				return fmt.Sprintf("%s Send \"%s %s!\" to confirm.", v.Message, shortName, strings.TrimSuffix(raw, "!"))
+			}
+			return v.Message
+		}
+		log.Printf("Failed to save telegram value for stat %d: %v", statID, err)
+		return "Something went wrong, please try again."
+	}
+	return fmt.Sprintf("%s for W/E %s (%s) saved: %s", shortName, week, companyFiscal(companyDBID).label(week), formatStatValue(value, valueType, currency))
+}
+
+// sendTelegramReminders reminds each linked user once per week, after the week closes, of the
+// stats they have not submitted for it yet.
+func sendTelegramReminders(now time.Time) {
+	rows, err := DB.Query(`
+		SELECT l.user_id, l.chat_id, COALESCE(l.last_reminder_week, ''), c.company_id
+		FROM telegram_links l JOIN users u ON u.id = l.user_id JOIN companies c ON c.id = u.company_id
+		WHERE u.active = 1
+	`)
+	if err != nil {
+		log.Printf("Telegram reminders: %v", err)
+		return
+	}
+	type link struct {
+		userID       int
+		chatID       int64
+		lastReminder string
+		companyCode  string
+	}
+	var links []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.userID, &l.chatID, &l.lastReminder, &l.companyCode); err != nil {
+			log.Printf("Telegram reminders: %v", err)
+			continue
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+
+	for _, l := range links {
+		loc := companyLocation(l.companyCode)
+		local := now.In(loc)
+		week := currentWeekEnding(time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC), companyWeekEndingDay(l.companyCode))
+		if weekState(week, loc, local) != "due" {
+			t, _ := time.Parse("2006-01-02", week)
+			if week = t.AddDate(0, 0, -7).Format("2006-01-02"); weekState(week, loc, local) != "due" {
+				continue
+			}
+		}
+		if l.lastReminder == week {
+			continue
+		}
+		info, err := loadWeekInfo(l.userID, week, loc, local)
+		if err != nil {
+			log.Printf("Telegram reminder for user %d: %v", l.userID, err)
+			continue
+		}
+		if info.Submitted < info.Total {
+			var missing []string
+			for _, s := range info.Stats {
+				if !s.Submitted {
+					missing = append(missing, s.ShortID)
+				}
+			}
+			deadline, _ := time.Parse(time.RFC3339, info.Deadline)
+			msg := fmt.Sprintf("W/E %s closed. Still missing: %s. Values are due by %s.",
+				week, strings.Join(missing, ", "), deadline.Format("Mon 15:04 MST"))
+			if err := telegramSend(l.chatID, msg); err != nil {
+				log.Printf("Telegram reminder to user %d failed: %v", l.userID, err)
+				continue
+			}
+		}
+		if _, err := DB.Exec(`UPDATE telegram_links SET last_reminder_week = ? WHERE user_id = ?`, week, l.userID); err != nil {
+			log.Printf("Telegram reminder for user %d: %v", l.userID, err)
+		}
+	}
+}
+
+// notifyTelegramCrash tells the stat's assigned user and the company's admins, when their chats
+// are linked, that a weekly value crashed against the previous week. It does not block the write.
+func notifyTelegramCrash(statID int, weekEnding string, value int64, valueType string, reversed bool) {
+	if telegramToken() == "" {
+		return
+	}
+	var prev int64
+	if err := DB.QueryRow(`SELECT value FROM weekly_stats WHERE stat_id = ? AND week_ending = date(?, '-7 days')`, statID, weekEnding).Scan(&prev); err != nil {
+		return
+	}
+	if weekTrend(value, prev, reversed) != "crashed" {
+		return
+	}
+	var shortID string
+	DB.QueryRow(`SELECT short_id FROM stats WHERE id = ?`, statID).Scan(&shortID)
+	rows, err := DB.Query(`
+		SELECT l.chat_id FROM telegram_links l
+		JOIN users u ON u.id = l.user_id
+		JOIN stats s ON s.id = ?
+		WHERE u.company_id = s.company_id AND u.active = 1 AND (u.role = 'admin' OR u.id = s.assigned_user_id)
+	`, statID)
+	if err != nil {
+		log.Printf("Telegram crash alert for stat %d: %v", statID, err)
+		return
+	}
+	var chats []int64
+	for rows.Next() {
+		var chatID int64
+		if rows.Scan(&chatID) == nil {
+			chats = append(chats, chatID)
+		}
+	}
+	rows.Close()
+	currency := statCurrency(statID)
+	msg := fmt.Sprintf("%s crashed for W/E %s: %s, down from %s.", shortID, weekEnding,
+		formatStatValue(value, valueType, currency), formatStatValue(prev, valueType, currency))
+	go func() {
+		for _, chatID := range chats {
+			if err := telegramSend(chatID, msg); err != nil {
+				log.Printf("Telegram crash alert to chat %d failed: %v", chatID, err)
+			}
+		}
+	}()
+}
+
+// ---------- GET /api/user/telegram ----------
+func TelegramStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var linkedAt sql.NullString
+	err := DB.QueryRow(`SELECT linked_at FROM telegram_links WHERE user_id = ?`, r.Context().Value("user_id")).Scan(&linkedAt)
+	if err != nil && err != sql.ErrNoRows {
+		webFail("Failed to load telegram link", w, err)
+		return
+	}
+	out := map[string]interface{}{"enabled": telegramToken() != "", "linked": linkedAt.Valid}
+	if linkedAt.Valid {
+		out["linked_at"] = linkedAt.String
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/user/telegram/link ----------
+// Issues a one-time code the user sends to the bot as "/link CODE" within 15 minutes.
+func CreateTelegramLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if telegramToken() == "" {
+		http.Error(w, `{"message":"Telegram is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+	token, _, err := newSecretToken()
+	if err != nil {
+		webFail("Failed to generate code", w, err)
+		return
+	}
+	code := strings.ToUpper(token[:8])
+	userID := r.Context().Value("user_id")
+	expires := time.Now().UTC().Add(telegramLinkTTL).Format(time.RFC3339)
+	if _, err := DB.Exec(`DELETE FROM telegram_link_codes WHERE user_id = ?`, userID); err != nil {
+		webFail("Failed to save code", w, err)
+		return
+	}
+	if _, err := DB.Exec(`INSERT INTO telegram_link_codes (code_hash, user_id, expires_at) VALUES (?, ?, ?)`, hashSecretToken(code), userID, expires); err != nil {
+		webFail("Failed to save code", w, err)
+		return
+	}
+	out := map[string]string{"code": code, "expires_at": expires}
+	if bot := envString("STATHQ_TELEGRAM_BOT_NAME", ""); bot != "" {
+		out["link"] = "https://t.me/" + strings.TrimPrefix(bot, "@") + "?start=" + code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/user/telegram ----------
+func UnlinkTelegramHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := DB.Exec(`DELETE FROM telegram_links WHERE user_id = ?`, r.Context().Value("user_id")); err != nil {
+		webFail("Failed to unlink telegram", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Telegram unlinked"})
+}
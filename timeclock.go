@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time-clock imports: hours from time-clock exports (CSV with an hours column or clock in/out
+// times) or posted as JSON entries are summed per employee and W/E week and written into each
+// employee's personal hours stat, replacing the value for each week covered. Employees are matched
+// by the export's employee ID or name through timeclock_mappings. Hours stats are number stats, so
+// each week's total is rounded to whole hours.
+
+type timeclockEntry struct {
+	Employee string `json:"employee"`
+	Date     string `json:"date"`
+	Hours    string `json:"hours"`
+}
+
+func timeclockKey(employee string) string {
+	return strings.ToLower(strings.TrimSpace(employee))
+}
+
+// ---------- GET /api/import/timeclock/mappings ----------
+func GetTimeclockMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`
+		SELECT m.employee, m.stat_id, s.short_id
+		FROM timeclock_mappings m JOIN stats s ON s.id = m.stat_id
+		WHERE m.company_id = ?
+		ORDER BY m.employee
+	`, companyDBID)
+	if err != nil {
+		webFail("Failed to query time-clock mappings", w, err)
+		return
+	}
+	defer rows.Close()
+
+	type mapping struct {
+		Employee string `json:"employee"`
+		StatID   int    `json:"stat_id"`
+		ShortID  string `json:"short_id"`
+	}
+	out := []mapping{}
+	for rows.Next() {
+		var m mapping
+		if err := rows.Scan(&m.Employee, &m.StatID, &m.ShortID); err != nil {
+			webFail("Failed to scan time-clock mapping", w, err)
+			return
+		}
+		out = append(out, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- PUT /api/import/timeclock/mappings ----------
+// Body: { "<employee id or name>": <stat_id|null>, ... }
+func UpdateTimeclockMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]*int
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	for employee, statID := range req {
+		key := timeclockKey(employee)
+		if key == "" {
+			http.Error(w, `{"message":"employee must not be empty"}`, http.StatusBadRequest)
+			return
+		}
+		if statID == nil {
+			if _, err := tx.Exec(`DELETE FROM timeclock_mappings WHERE company_id = ? AND employee = ?`, companyDBID, key); err != nil {
+				webFail("Failed to clear time-clock mapping", w, err)
+				return
+			}
+			continue
+		}
+		var statType, valueType string
+		var isCalculated bool
+		if err := tx.QueryRow(`SELECT type, value_type, is_calculated FROM stats WHERE id = ? AND company_id = ? AND deleted_at IS NULL`, *statID, companyDBID).
+			Scan(&statType, &valueType, &isCalculated); err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d not found"}`, *statID), http.StatusBadRequest)
+			return
+		}
+		if statType != "personal" || valueType != "number" || isCalculated {
+			http.Error(w, fmt.Sprintf(`{"message":"stat %d must be a non-calculated personal number stat"}`, *statID), http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO timeclock_mappings (company_id, employee, stat_id) VALUES (?, ?, ?)
+			ON CONFLICT(company_id, employee) DO UPDATE SET stat_id = excluded.stat_id
+		`, companyDBID, key, *statID); err != nil {
+			webFail("Failed to save time-clock mapping", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit time-clock mappings", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Time-clock mappings saved"})
+}
+
+// ---------- POST /api/import/timeclock[?date_format=mdy|dmy|ymd][&dry_run=1][&reason=...] ----------
+// Accepts a time-clock CSV export as the raw body or a multipart "file" field, or JSON
+// {"entries": [{"employee": "E102", "date": "2024-01-02", "hours": "7.5"}]} from an integration.
+// Hours are "7.5" or "7:30". When the company locks logged values, weeks that would change are
+// rejected unless a reason is given.
+func ImportTimeclockHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dateFormat := q.Get("date_format")
+	if dateFormat == "" {
+		dateFormat = "mdy"
+	}
+	dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+	reason := strings.TrimSpace(q.Get("reason"))
+
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+
+	var minutes map[string]map[string]int64
+	var skipped int
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var req struct {
+			Entries []timeclockEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		minutes, skipped = sumTimeclockEntries(req.Entries, dateFormat, weekEndingDayOf(companyDBID))
+	case strings.HasPrefix(contentType, "multipart/"):
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, `{"message":"multipart upload must include a file field"}`, http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		minutes, skipped, err = sumTimeclockCSV(file, dateFormat, weekEndingDayOf(companyDBID))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+	default:
+		minutes, skipped, err = sumTimeclockCSV(r.Body, dateFormat, weekEndingDayOf(companyDBID))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mappings := map[string]int{}
+	rows, err := DB.Query(`
+		SELECT m.employee, m.stat_id FROM timeclock_mappings m JOIN stats s ON s.id = m.stat_id
+		WHERE m.company_id = ? AND s.deleted_at IS NULL
+	`, companyDBID)
+	if err != nil {
+		webFail("Failed to query time-clock mappings", w, err)
+		return
+	}
+	for rows.Next() {
+		var employee string
+		var statID int
+		if err := rows.Scan(&employee, &statID); err != nil {
+			rows.Close()
+			webFail("Failed to scan time-clock mapping", w, err)
+			return
+		}
+		mappings[employee] = statID
+	}
+	rows.Close()
+
+	// Employees sharing a stat are added together.
+	totals := map[int]map[string]int64{}
+	unmatched := []string{}
+	for employee, weeks := range minutes {
+		statID, ok := mappings[employee]
+		if !ok {
+			unmatched = append(unmatched, employee)
+			continue
+		}
+		if totals[statID] == nil {
+			totals[statID] = map[string]int64{}
+		}
+		for we, m := range weeks {
+			totals[statID][we] += m
+		}
+	}
+	sort.Strings(unmatched)
+	statIDs := make([]int, 0, len(totals))
+	for id := range totals {
+		statIDs = append(statIDs, id)
+	}
+	sort.Ints(statIDs)
+
+	type weekResult struct {
+		StatID     int    `json:"stat_id"`
+		Weekending string `json:"Weekending"`
+		Hours      string `json:"hours"`
+		Previous   string `json:"previous,omitempty"`
+		Action     string `json:"action"`
+		Error      string `json:"error,omitempty"`
+	}
+
+	authorID := r.Context().Value("user_id")
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	results := []weekResult{}
+	for _, statID := range statIDs {
+		weeks := make([]string, 0, len(totals[statID]))
+		for we := range totals[statID] {
+			weeks = append(weeks, we)
+		}
+		sort.Strings(weeks)
+		for _, we := range weeks {
+			hours := int64(math.Round(float64(totals[statID][we]) / 60))
+			res := weekResult{StatID: statID, Weekending: we, Hours: formatStoredValue(hours, "number")}
+			if err := checkWeeklyRules(tx, statID, we, hours, "number", false); err != nil {
+				if v, ok := err.(*ruleViolation); ok {
+					res.Action, res.Error = "rejected", v.Message
+					results = append(results, res)
+					continue
+				}
+				webFail("Failed to check validation rules", w, err)
+				return
+			}
+			var existingID, existingVal int64
+			err := tx.QueryRow(`SELECT id, value FROM weekly_stats WHERE stat_id = ? AND week_ending = ?`, statID, we).Scan(&existingID, &existingVal)
+			switch {
+			case err == sql.ErrNoRows:
+				res.Action = "insert"
+				err = nil
+				if !dryRun {
+					_, err = tx.Exec(`INSERT INTO weekly_stats (stat_id, week_ending, value, author_user_id, submitted_at) VALUES (?, ?, ?, ?, ?)`,
+						statID, we, hours, authorID, time.Now().UTC().Format(time.RFC3339))
+				}
+			case err == nil:
+				res.Previous = formatStoredValue(existingVal, "number")
+				res.Action = "unchanged"
+				if existingVal != hours {
+					if verr := checkEditReason(tx, statID, reason); verr != nil {
+						if v, ok := verr.(*ruleViolation); ok {
+							res.Action, res.Error = "rejected", v.Message
+							results = append(results, res)
+							continue
+						}
+						webFail("Failed to check edit reason", w, verr)
+						return
+					}
+					res.Action = "update"
+					if !dryRun {
+						_, err = tx.Exec(`UPDATE weekly_stats SET value = ?, numerator = NULL, denominator = NULL, author_user_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+							hours, authorID, time.Now().UTC().Format(time.RFC3339), existingID)
+						if err == nil {
+							err = recordEditReason(tx, statID, we, reason)
+						}
+					}
+				}
+			}
+			if err == nil && !dryRun && res.Action != "unchanged" {
+				detail := map[string]string{"source": "timeclock", "old": res.Previous, "new": res.Hours}
+				if res.Action == "update" && reason != "" {
+					detail["reason"] = reason
+				}
+				err = logActivity(tx, authorID, activityValueImported, statID, we, detail)
+			}
+			if err != nil {
+				webFail("Failed to write imported week "+we, w, err)
+				return
+			}
+			results = append(results, res)
+		}
+	}
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			webFail("Failed to commit time-clock import", w, err)
+			return
+		}
+		log.Printf("Imported time-clock hours for %d stat weeks (%d unmatched employees)", len(results), len(unmatched))
+		for _, res := range results {
+			if res.Action == "insert" || res.Action == "update" {
+				publishStatEvent(liveEvent{Type: eventStatWritten, StatID: res.StatID, WeekEnding: res.Weekending})
+				if err := enqueueRecalc(DB, res.StatID, res.Weekending); err != nil {
+					log.Printf("Failed to queue recalculation of stats depending on %d: %v", res.StatID, err)
+				}
+				if err := markAggregatesDirty(DB, res.StatID, res.Weekending); err != nil {
+					log.Printf("Failed to mark aggregates for stat %d: %v", res.StatID, err)
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":             dryRun,
+		"weeks":               results,
+		"unmatched_employees": unmatched,
+		"skipped_rows":        skipped,
+	})
+}
+
+// sumTimeclockEntries totals JSON entries in minutes per employee key and W/E week.
+func sumTimeclockEntries(entries []timeclockEntry, dateFormat string, weekday time.Weekday) (map[string]map[string]int64, int) {
+	out := map[string]map[string]int64{}
+	skipped := 0
+	for _, e := range entries {
+		key := timeclockKey(e.Employee)
+		d, err := parseAccountingDate(e.Date, dateFormat)
+		m, herr := parseTimeclockHours(e.Hours)
+		if key == "" || err != nil || herr != nil {
+			skipped++
+			continue
+		}
+		addTimeclockMinutes(out, key, d, m, weekday)
+	}
+	return out, skipped
+}
+
+func addTimeclockMinutes(out map[string]map[string]int64, key string, d time.Time, m int64, weekday time.Weekday) {
+	if out[key] == nil {
+		out[key] = map[string]int64{}
+	}
+	out[key][currentWeekEnding(d, weekday)] += m
+}
+
+// sumTimeclockCSV totals a time-clock export in minutes per employee key and W/E week. It finds the
+// employee, date and hours columns by header name; without an hours column it uses clock in and
+// clock out times, a shift ending before it starts being overnight.
+func sumTimeclockCSV(r io.Reader, dateFormat string, weekday time.Weekday) (map[string]map[string]int64, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	employeeCol, dateCol, hoursCol, inCol, outCol := -1, -1, -1, -1, -1
+	out := map[string]map[string]int64{}
+	skipped := 0
+	header := false
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid CSV: %v", err)
+		}
+
+		if !header {
+			// Some exports start with a report title; keep scanning until the header row.
+			for i, h := range rec {
+				switch strings.ToLower(strings.TrimSpace(h)) {
+				case "employee id", "employee number", "payroll id", "employee", "employee name", "name", "staff":
+					if employeeCol < 0 {
+						employeeCol = i
+					}
+				case "date", "work date", "shift date", "day":
+					if dateCol < 0 {
+						dateCol = i
+					}
+				case "hours", "total hours", "hours worked", "paid hours", "duration":
+					if hoursCol < 0 {
+						hoursCol = i
+					}
+				case "clock in", "time in", "in", "start", "start time":
+					if inCol < 0 {
+						inCol = i
+					}
+				case "clock out", "time out", "out", "end", "end time":
+					if outCol < 0 {
+						outCol = i
+					}
+				}
+			}
+			if employeeCol >= 0 && dateCol >= 0 && (hoursCol >= 0 || (inCol >= 0 && outCol >= 0)) {
+				header = true
+			} else {
+				employeeCol, dateCol, hoursCol, inCol, outCol = -1, -1, -1, -1, -1
+			}
+			continue
+		}
+
+		field := func(i int) string {
+			if i < 0 || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+		key := timeclockKey(field(employeeCol))
+		d, err := parseAccountingDate(field(dateCol), dateFormat)
+		if key == "" || err != nil {
+			skipped++ // totals and blank lines
+			continue
+		}
+		var m int64
+		if hoursCol >= 0 {
+			m, err = parseTimeclockHours(field(hoursCol))
+		} else {
+			m, err = timeclockShiftMinutes(field(inCol), field(outCol))
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		addTimeclockMinutes(out, key, d, m, weekday)
+	}
+	if !header {
+		return nil, 0, fmt.Errorf("could not find employee, date and hours (or clock in/out) columns in CSV header")
+	}
+	return out, skipped, nil
+}
+
+// parseTimeclockHours parses "7.5" or "7:30" into minutes.
+func parseTimeclockHours(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if h, m, ok := strings.Cut(s, ":"); ok {
+		hours, err := strconv.Atoi(h)
+		if err != nil || hours < 0 {
+			return 0, fmt.Errorf("invalid hours %q", s)
+		}
+		mins, err := strconv.Atoi(m)
+		if err != nil || mins < 0 || mins > 59 {
+			return 0, fmt.Errorf("invalid hours %q", s)
+		}
+		return int64(hours*60 + mins), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid hours %q", s)
+	}
+	return int64(math.Round(f * 60)), nil
+}
+
+// timeclockShiftMinutes is the length of a shift from clock in and clock out times of day.
+func timeclockShiftMinutes(in, out string) (int64, error) {
+	start, err := parseClockTime(in)
+	if err != nil {
+		return 0, err
+	}
+	end, err := parseClockTime(out)
+	if err != nil {
+		return 0, err
+	}
+	if end.Before(start) {
+		end = end.Add(24 * time.Hour)
+	}
+	return int64(end.Sub(start).Minutes()), nil
+}
+
+func parseClockTime(s string) (time.Time, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if f := strings.Fields(s); len(f) > 1 && strings.ContainsAny(f[0], "-/") {
+		s = strings.Join(f[1:], " ") // "2024-01-02 09:00"
+	}
+	for _, l := range []string{"15:04", "15:04:05", "3:04PM", "3:04 PM", "3:04:05 PM"} {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", s)
+}
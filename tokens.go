@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Token authentication for API clients. POST /api/auth/token exchanges credentials for a
+// short-lived access token (sent as "Authorization: Bearer ...", accepted by AuthMiddleware) and a
+// refresh token. Each refresh returns a new pair and spends the old refresh token; the tokens issued
+// from one login form a family. Presenting a spent refresh token means it was copied, so the whole
+// family is revoked and the client has to log in again.
+//
+// Lifetimes: STATHQ_ACCESS_TOKEN_TTL (15m) and STATHQ_REFRESH_TOKEN_TTL (720h, counted from the last
+// refresh, so an integration that keeps running never has to re-enter credentials).
+
+var errTokenInvalid = errors.New("invalid token")
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// bearerAuth is the caller identified by a bearer token.
+type bearerAuth struct {
+	UserID     int
+	FamilyID   int      // access tokens: the client login they belong to
+	APITokenID int      // long-lived API tokens (see apitokens.go)
+	Scopes     []string // API tokens only; nil means the user's full rights
+}
+
+// bearerTokenUser resolves an Authorization: Bearer access token, API token or JWT (see jwt.go)
+// to its user. ok is
+// false when the request carries no bearer token at all.
+func bearerTokenUser(r *http.Request) (auth bearerAuth, ok bool, err error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return auth, false, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		auth, err = apiTokenAuth(token)
+		return auth, true, err
+	}
+	if looksLikeJWT(token) {
+		auth, err = jwtAuth(token)
+		return auth, true, err
+	}
+	var expires string
+	err = DB.QueryRow(`
+		SELECT a.user_id, a.family_id, a.expires_at FROM api_access_tokens a
+		JOIN api_token_families f ON f.id = a.family_id
+		WHERE a.token_hash = ? AND f.revoked_at IS NULL
+	`, hashSecretToken(token)).Scan(&auth.UserID, &auth.FamilyID, &expires)
+	if err == sql.ErrNoRows {
+		return bearerAuth{}, true, errTokenInvalid
+	}
+	if err != nil {
+		return bearerAuth{}, true, err
+	}
+	if t, perr := time.Parse(time.RFC3339, expires); perr != nil || time.Now().After(t) {
+		return bearerAuth{}, true, errors.New("access token expired")
+	}
+	return auth, true, nil
+}
+
+// issueTokenPair mints an access and refresh token in the family.
+func issueTokenPair(ex execer, familyID int64, userID int) (tokenPair, error) {
+	accessTTL := envDuration("STATHQ_ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTTL := envDuration("STATHQ_REFRESH_TOKEN_TTL", 720*time.Hour)
+	access, accessHash, err := newSecretToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	refresh, refreshHash, err := newSecretToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	now := time.Now().UTC()
+	if _, err := ex.Exec(`INSERT INTO api_access_tokens (token_hash, family_id, user_id, expires_at) VALUES (?, ?, ?, ?)`,
+		accessHash, familyID, userID, now.Add(accessTTL).Format(time.RFC3339)); err != nil {
+		return tokenPair{}, err
+	}
+	if _, err := ex.Exec(`INSERT INTO api_refresh_tokens (token_hash, family_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		refreshHash, familyID, now.Format(time.RFC3339), now.Add(refreshTTL).Format(time.RFC3339)); err != nil {
+		return tokenPair{}, err
+	}
+	if _, err := ex.Exec(`UPDATE api_token_families SET last_used_at = ? WHERE id = ?`, now.Format(time.RFC3339), familyID); err != nil {
+		return tokenPair{}, err
+	}
+	// Clear the family's expired access tokens.
+	if _, err := ex.Exec(`DELETE FROM api_access_tokens WHERE family_id = ? AND expires_at < ?`, familyID, now.Format(time.RFC3339)); err != nil {
+		return tokenPair{}, err
+	}
+	return tokenPair{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(accessTTL.Seconds()), RefreshToken: refresh}, nil
+}
+
+// revokeTokenFamily ends every token issued from one login.
+func revokeTokenFamily(ex execer, familyID int64, reason string) error {
+	if _, err := ex.Exec(`UPDATE api_token_families SET revoked_at = ?, revoked_reason = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), reason, familyID); err != nil {
+		return err
+	}
+	_, err := ex.Exec(`DELETE FROM api_access_tokens WHERE family_id = ?`, familyID)
+	return err
+}
+
+// ---------- POST /api/auth/token ----------
+// {"grant_type":"password","company_id":"...","username":"...","password":"...","client_name":"...","otp":"..."}
+// {"grant_type":"refresh_token","refresh_token":"..."}
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		GrantType    string `json:"grant_type"`
+		CompanyID    string `json:"company_id"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		ClientName   string `json:"client_name"`
+		RefreshToken string `json:"refresh_token"`
+		OTP          string `json:"otp"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	switch req.GrantType {
+	case "password":
+		tokenPasswordGrant(w, r, req.CompanyID, strings.ToLower(strings.TrimSpace(req.Username)), req.Password, req.ClientName, req.OTP)
+	case "refresh_token":
+		tokenRefreshGrant(w, req.RefreshToken)
+	default:
+		http.Error(w, `{"message":"grant_type must be password or refresh_token"}`, http.StatusBadRequest)
+	}
+}
+
+func tokenPasswordGrant(w http.ResponseWriter, r *http.Request, companyCode, username, password, clientName, otp string) {
+	if !loginAllowed(w, r, companyCode, username, "token") {
+		return
+	}
+	userID, _, refused, ok := ldapLogin(companyCode, username, password)
+	if refused != "" {
+		recordLogin(r, companyCode, username, 0, "token", false, "no seat left")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": refused})
+		return
+	}
+	if !ok {
+		var hash string
+		err := DB.QueryRow(`
+			SELECT u.id, u.password_hash FROM users u JOIN companies c ON u.company_id = c.id
+			WHERE c.company_id = ? AND lower(u.username) = ?
+		`, companyCode, username).Scan(&userID, &hash)
+		if err != nil {
+			recordLogin(r, companyCode, username, 0, "token", false, "unknown user")
+			http.Error(w, `{"message":"Invalid credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			recordLogin(r, companyCode, username, userID, "token", false, "wrong password")
+			http.Error(w, `{"message":"Invalid credentials"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+	if !accountActive(w, r, companyCode, username, userID, "token") {
+		return
+	}
+	if !requireSecondFactor(w, r, companyCode, username, userID, "token", otp) {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if clientName == "" {
+		clientName = r.UserAgent()
+	}
+	if len(clientName) > 200 {
+		clientName = clientName[:200]
+	}
+	res, err := tx.Exec(`INSERT INTO api_token_families (user_id, client_name, created_at) VALUES (?, ?, ?)`,
+		userID, clientName, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		webFail("Failed to create token family", w, err)
+		return
+	}
+	familyID, _ := res.LastInsertId()
+	pair, err := issueTokenPair(tx, familyID, userID)
+	if err != nil {
+		webFail("Failed to issue tokens", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to issue tokens", w, err)
+		return
+	}
+	recordLogin(r, companyCode, username, userID, "token", true, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(pair)
+}
+
+func tokenRefreshGrant(w http.ResponseWriter, refreshToken string) {
+	if refreshToken == "" {
+		http.Error(w, `{"message":"refresh_token is required"}`, http.StatusBadRequest)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var id, familyID int64
+	var userID int
+	var expires string
+	var usedAt, revokedAt sql.NullString
+	err = tx.QueryRow(`
+		SELECT t.id, t.family_id, f.user_id, t.expires_at, t.used_at, f.revoked_at
+		FROM api_refresh_tokens t JOIN api_token_families f ON f.id = t.family_id
+		WHERE t.token_hash = ?
+	`, hashSecretToken(refreshToken)).Scan(&id, &familyID, &userID, &expires, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows || revokedAt.Valid {
+		http.Error(w, `{"message":"Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		webFail("Failed to look up refresh token", w, err)
+		return
+	}
+	if usedAt.Valid {
+		// A spent token came back: someone else holds a copy of this family.
+		if err := revokeTokenFamily(tx, familyID, "refresh token reused"); err == nil {
+			tx.Commit()
+		}
+		log.Printf("Refresh token reuse for user %d, token family %d revoked", userID, familyID)
+		http.Error(w, `{"message":"Refresh token already used; all tokens from this login have been revoked"}`, http.StatusUnauthorized)
+		return
+	}
+	if t, perr := time.Parse(time.RFC3339, expires); perr != nil || time.Now().After(t) {
+		http.Error(w, `{"message":"Refresh token expired"}`, http.StatusUnauthorized)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE api_refresh_tokens SET used_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), id); err != nil {
+		webFail("Failed to spend refresh token", w, err)
+		return
+	}
+	pair, err := issueTokenPair(tx, familyID, userID)
+	if err != nil {
+		webFail("Failed to issue tokens", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to issue tokens", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// ---------- POST /api/auth/revoke ----------
+// {"refresh_token":"..."}: logs the client out by revoking its token family. Always 200, so the
+// endpoint does not reveal whether a token existed.
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	var familyID int64
+	if err := DB.QueryRow(`SELECT family_id FROM api_refresh_tokens WHERE token_hash = ?`, hashSecretToken(req.RefreshToken)).Scan(&familyID); err == nil {
+		if err := revokeTokenFamily(DB, familyID, "revoked by client"); err != nil {
+			webFail("Failed to revoke tokens", w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Revoked"})
+}
+
+type tokenFamily struct {
+	ID            int64  `json:"id"`
+	ClientName    string `json:"client_name"`
+	CreatedAt     string `json:"created_at"`
+	LastUsedAt    string `json:"last_used_at,omitempty"`
+	RevokedAt     string `json:"revoked_at,omitempty"`
+	RevokedReason string `json:"revoked_reason,omitempty"`
+}
+
+// ---------- GET /api/auth/clients ----------
+// The caller's API client logins, newest first.
+func ListTokenFamiliesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query(`
+		SELECT id, client_name, created_at, COALESCE(last_used_at, ''), COALESCE(revoked_at, ''), COALESCE(revoked_reason, '')
+		FROM api_token_families WHERE user_id = ? ORDER BY id DESC LIMIT 100
+	`, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to query API clients", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []tokenFamily{}
+	for rows.Next() {
+		var f tokenFamily
+		if err := rows.Scan(&f.ID, &f.ClientName, &f.CreatedAt, &f.LastUsedAt, &f.RevokedAt, &f.RevokedReason); err != nil {
+			webFail("Failed to scan API clients", w, err)
+			return
+		}
+		out = append(out, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/auth/clients/{id} ----------
+func RevokeTokenFamilyHandler(w http.ResponseWriter, r *http.Request) {
+	var familyID int64
+	err := DB.QueryRow(`SELECT id FROM api_token_families WHERE id = ? AND user_id = ?`, mux.Vars(r)["id"], r.Context().Value("user_id")).Scan(&familyID)
+	if err != nil {
+		http.Error(w, `{"message":"Client not found"}`, http.StatusNotFound)
+		return
+	}
+	if err := revokeTokenFamily(DB, familyID, "revoked by user"); err != nil {
+		webFail("Failed to revoke tokens", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Revoked"})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Trash. Deleting a stat (DELETE /api/stats/{id}) only sets stats.deleted_at: from then on the stat
+// answers 404 and is left out of lists, entry, aggregates and the calculated stats that summed it,
+// but its values, quotas and history are kept. GET /api/stats/trash lists a company's deleted stats
+// with when each will be purged, and POST /api/stats/{id}/restore brings one back as it was.
+//
+// The purge job deletes stats for good, with everything that cascades from them, once they have
+// been in the trash for STATHQ_TRASH_RETENTION (30 days by default).
+
+func trashRetention() time.Duration {
+	return envDuration("STATHQ_TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// trashPurgeAt is when a stat deleted at deletedAt (RFC 3339) will be purged.
+func trashPurgeAt(deletedAt string) string {
+	t, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		return ""
+	}
+	return t.Add(trashRetention()).UTC().Format(time.RFC3339)
+}
+
+type trashedStat struct {
+	ID        int    `json:"id"`
+	ShortID   string `json:"short_id"`
+	FullName  string `json:"full_name"`
+	Type      string `json:"type"`
+	ValueType string `json:"value_type"`
+	DeletedAt string `json:"deleted_at"`
+	PurgeAt   string `json:"purge_at"`
+}
+
+// ---------- GET /api/stats/trash ----------
+func ListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`
+		SELECT id, short_id, full_name, type, value_type, deleted_at FROM stats
+		WHERE company_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id
+	`, companyDBID)
+	if err != nil {
+		webFail("Failed to query trash", w, err)
+		return
+	}
+	defer rows.Close()
+	out := []trashedStat{}
+	for rows.Next() {
+		var s trashedStat
+		if err := rows.Scan(&s.ID, &s.ShortID, &s.FullName, &s.Type, &s.ValueType, &s.DeletedAt); err != nil {
+			webFail("Failed to read trash", w, err)
+			return
+		}
+		s.PurgeAt = trashPurgeAt(s.DeletedAt)
+		out = append(out, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- POST /api/stats/{id}/restore ----------
+func RestoreStatHandler(w http.ResponseWriter, r *http.Request) {
+	statID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"message":"invalid stat id"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	var deletedAt sql.NullString
+	err = DB.QueryRow(`SELECT deleted_at FROM stats WHERE id = ? AND company_id = ?`, statID, companyDBID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"stat not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		webFail("Failed to load stat", w, err)
+		return
+	}
+	if !deletedAt.Valid {
+		http.Error(w, `{"message":"stat is not in the trash"}`, http.StatusConflict)
+		return
+	}
+	if ok, msg, err := checkBillingLimit(companyDBID, "stat"); err != nil {
+		webFail("Failed to check plan limits", w, err)
+		return
+	} else if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE stats SET deleted_at = NULL WHERE id = ?`, statID); err != nil {
+		webFail("Failed to restore stat", w, err)
+		return
+	}
+	if err := logActivity(tx, r.Context().Value("user_id"), activityStatRestored, statID, "", nil); err != nil {
+		webFail("Failed to log activity", w, err)
+		return
+	}
+	// The stats that summed this one count it again.
+	if err := enqueueRecalc(tx, statID, ""); err != nil {
+		webFail("Failed to queue recalculation", w, err)
+		return
+	}
+	if err := markCompanyAggregatesDirty(tx, companyDBID); err != nil {
+		webFail("Failed to mark aggregates", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to restore stat", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": statID, "message": "Stat restored"})
+}
+
+// StartTrashPurgeJob deletes stats that have been in the trash longer than the retention.
+func StartTrashPurgeJob() {
+	retention := trashRetention()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			purgeTrash(retention)
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeTrash(retention time.Duration) {
+	cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339)
+	rows, err := DB.Query(`SELECT id FROM stats WHERE deleted_at IS NOT NULL AND deleted_at < ?`, cutoff)
+	if err != nil {
+		log.Printf("Trash purge failed: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		tx, err := DB.Begin()
+		if err != nil {
+			log.Printf("Trash purge failed: %v", err)
+			return
+		}
+		// Logged first: the entry takes the company and short id from the stat.
+		if err := logActivity(tx, nil, activityStatPurged, id, "", nil); err != nil {
+			tx.Rollback()
+			log.Printf("Failed to purge stat %d: %v", id, err)
+			continue
+		}
+		if err := deleteWithReferences(tx, "stats", "id = ?", id); err != nil {
+			tx.Rollback()
+			log.Printf("Failed to purge stat %d: %v", id, err)
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to purge stat %d: %v", id, err)
+			continue
+		}
+		log.Printf("Purged stat %d from the trash", id)
+	}
+}
+
+// deleteWithReferences deletes the rows of table matching where, after the rows that reference them
+// through the schema's foreign keys: ON DELETE CASCADE and SET NULL only run on connections with
+// foreign keys on, so the purge does their work itself (like deleteCompanyTx).
+func deleteWithReferences(tx *sql.Tx, table, where string, args ...interface{}) error {
+	rows, err := tx.Query(`
+		SELECT m.name, f."from", COALESCE(f."to", 'id'), f.on_delete
+		FROM main.sqlite_master m, pragma_foreign_key_list(m.name) f
+		WHERE m.type = 'table' AND f."table" = ? AND m.name != ?
+	`, table, table)
+	if err != nil {
+		return err
+	}
+	type reference struct{ child, from, to, onDelete string }
+	var refs []reference
+	for rows.Next() {
+		var ref reference
+		if err := rows.Scan(&ref.child, &ref.from, &ref.to, &ref.onDelete); err != nil {
+			rows.Close()
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+
+	for _, ref := range refs {
+		matching := fmt.Sprintf(`%s IN (SELECT %s FROM %s WHERE %s)`, ref.from, ref.to, table, where)
+		switch ref.onDelete {
+		case "CASCADE":
+			err = deleteWithReferences(tx, ref.child, matching, args...)
+		case "SET NULL":
+			_, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = NULL WHERE %s`, ref.child, ref.from, matching), args...)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", ref.child, err)
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`, table, where), args...)
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Trend conditions: the dashboard's reading of where each stat is heading. The engine fits a
+// straight line through the stat's last STATHQ_TREND_WEEKS (4) weekly values, up to and including
+// the W/E being looked at, and expresses its slope as a percentage of the stat's average size per
+// week. In the stat's good direction (falling is good for reversed stats) that is
+//
+//   steep_up    STATHQ_TREND_STEEP (15) percent a week or more
+//   up          STATHQ_TREND_LEVEL (2) percent or more
+//   level       within STATHQ_TREND_LEVEL percent either way
+//   down        down by less than STATHQ_TREND_STEEP percent
+//   steep_down  down by STATHQ_TREND_STEEP percent or more
+//
+// Weeks without a value are skipped; with fewer than two values there is no trend. Unlike the
+// conditions assigned in conditions.go these are computed, never stored.
+// GET /api/stats/conditions returns them for every stat of the company.
+//
+// The environment sets the defaults; a company can tune its own through the trend_weeks,
+// trend_steep_percent and trend_level_percent company settings (see settings.go).
+
+const (
+	trendSteepUp   = "steep_up"
+	trendUp        = "up"
+	trendLevel     = "level"
+	trendDown      = "down"
+	trendSteepDown = "steep_down"
+)
+
+// trendRules are the thresholds of the engine.
+type trendRules struct {
+	Weeks        int     `json:"weeks"`         // values looked at, the W/E included
+	SteepPercent float64 `json:"steep_percent"` // weekly change from which a trend is steep
+	LevelPercent float64 `json:"level_percent"` // weekly change below which a stat is level
+}
+
+const (
+	minTrendWeeks = 2
+	maxTrendWeeks = 52
+)
+
+func defaultTrendRules() trendRules {
+	return trendRules{
+		Weeks:        envInt("STATHQ_TREND_WEEKS", 4),
+		SteepPercent: float64(envInt("STATHQ_TREND_STEEP", 15)),
+		LevelPercent: float64(envInt("STATHQ_TREND_LEVEL", 2)),
+	}
+}
+
+// companyTrendRules returns a company's (by database id) thresholds: its own settings where it has
+// them, the defaults otherwise.
+func companyTrendRules(companyDBID int) trendRules {
+	tr := defaultTrendRules()
+	var weeks sql.NullInt64
+	var steep, level sql.NullFloat64
+	if err := DB.QueryRow(`SELECT trend_weeks, trend_steep_percent, trend_level_percent FROM company_settings WHERE company_id = ?`,
+		companyDBID).Scan(&weeks, &steep, &level); err != nil {
+		return tr
+	}
+	if weeks.Valid {
+		tr.Weeks = int(weeks.Int64)
+	}
+	if steep.Valid {
+		tr.SteepPercent = steep.Float64
+	}
+	if level.Valid {
+		tr.LevelPercent = level.Float64
+	}
+	return tr
+}
+
+// check returns why the rules cannot be used, or "".
+func (tr trendRules) check() string {
+	switch {
+	case tr.Weeks < minTrendWeeks || tr.Weeks > maxTrendWeeks:
+		return fmt.Sprintf("trend_weeks must be between %d and %d", minTrendWeeks, maxTrendWeeks)
+	case tr.LevelPercent <= 0:
+		return "trend_level_percent must be above 0"
+	case tr.SteepPercent <= tr.LevelPercent || tr.SteepPercent > 1000:
+		return "trend_steep_percent must be above trend_level_percent and at most 1000"
+	}
+	return ""
+}
+
+// fitTrend fits a least-squares line through a window of weekly values, oldest first (nil = not
+// reported), returning its slope per week, the average absolute value and how many weeks had one.
+func fitTrend(values []*int64) (slope, meanAbs float64, n int) {
+	var sumX, sumY, sumXY, sumXX, sumAbs float64
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		x, y := float64(i), float64(*v)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		sumAbs += math.Abs(y)
+	}
+	if n < 2 {
+		return 0, 0, n
+	}
+	fn := float64(n)
+	return (fn*sumXY - sumX*sumY) / (fn*sumXX - sumX*sumX), sumAbs / fn, n
+}
+
+// statTrend classifies a window of weekly values (see fitTrend), returning the trend and the weekly
+// change in percent, signed so that positive is good. The trend is empty when fewer than two weeks
+// have a value.
+func (tr trendRules) statTrend(values []*int64, reversed bool) (string, *float64) {
+	slope, meanAbs, n := fitTrend(values)
+	if n < 2 {
+		return "", nil
+	}
+	var pct float64
+	switch {
+	case slope == 0:
+	case meanAbs == 0:
+		pct = math.Inf(1)
+	default:
+		pct = slope / meanAbs * 100
+	}
+	if reversed {
+		pct = -pct
+	}
+	var trend string
+	switch {
+	case pct >= tr.SteepPercent:
+		trend = trendSteepUp
+	case pct >= tr.LevelPercent:
+		trend = trendUp
+	case pct > -tr.LevelPercent:
+		trend = trendLevel
+	case pct > -tr.SteepPercent:
+		trend = trendDown
+	default:
+		trend = trendSteepDown
+	}
+	if math.IsInf(pct, 0) {
+		return trend, nil // from all zeros: no meaningful percentage
+	}
+	pct = math.Round(pct*10) / 10
+	return trend, &pct
+}
+
+type statCondition struct {
+	StatID        int        `json:"stat_id"`
+	ShortID       string     `json:"short_id"`
+	FullName      string     `json:"full_name"`
+	Type          string     `json:"type"`
+	ValueType     string     `json:"value_type"`
+	Reversed      bool       `json:"reversed"`
+	DivisionID    *int       `json:"division_id"`
+	UserID        *int       `json:"assigned_user_id"`
+	Trend         string     `json:"trend"`          // empty with fewer than two values
+	ChangePercent *float64   `json:"change_percent"` // per week, positive is good
+	Values        []*float64 `json:"values"`         // oldest first, one per week
+}
+
+// ---------- GET /api/stats/conditions?week=YYYY-MM-DD[&division_id=] ----------
+// The trend of every active stat of the company over the weeks up to week (the current week by
+// default).
+func StatConditionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	end := q.Get("week")
+	if end == "" {
+		end = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	} else if err := checkIfValidWE(r.Context().Value("company_id").(string), end); err != nil {
+		http.Error(w, `{"message":"invalid week (must be a W/E date YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	query := `SELECT id, short_id, full_name, type, value_type, reversed, assigned_division_id, assigned_user_id
+		FROM stats WHERE company_id = ? AND archived_at IS NULL AND deleted_at IS NULL`
+	args := []interface{}{companyDBID}
+	if v := q.Get("division_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, `{"message":"invalid division_id"}`, http.StatusBadRequest)
+			return
+		}
+		query += ` AND assigned_division_id = ?`
+		args = append(args, id)
+	}
+	rules := companyTrendRules(companyDBID)
+	weeks, err := lastWeekEndings(end, rules.Weeks)
+	if err != nil {
+		webFail("Failed to compute weeks", w, err)
+		return
+	}
+
+	rows, err := DB.Query(query+` ORDER BY short_id`, args...)
+	if err != nil {
+		webFail("Failed to query stats", w, err)
+		return
+	}
+	out := []*statCondition{}
+	byID := map[int]*statCondition{}
+	for rows.Next() {
+		c := &statCondition{}
+		var div, user sql.NullInt64
+		if err := rows.Scan(&c.StatID, &c.ShortID, &c.FullName, &c.Type, &c.ValueType, &c.Reversed, &div, &user); err != nil {
+			rows.Close()
+			webFail("Failed to scan stats", w, err)
+			return
+		}
+		if div.Valid {
+			id := int(div.Int64)
+			c.DivisionID = &id
+		}
+		if user.Valid {
+			id := int(user.Int64)
+			c.UserID = &id
+		}
+		out = append(out, c)
+		byID[c.StatID] = c
+	}
+	rows.Close()
+
+	index := map[string]int{}
+	for i, we := range weeks {
+		index[we] = i
+	}
+	raw := map[int][]*int64{}
+	rows, err = DB.Query(`
+		SELECT w.stat_id, w.week_ending, w.value FROM weekly_stats w JOIN stats s ON s.id = w.stat_id
+		WHERE s.company_id = ? AND w.week_ending BETWEEN ? AND ?
+	`, companyDBID, weeks[0], end)
+	if err != nil {
+		webFail("Failed to query weekly values", w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var statID int
+		var we string
+		var v int64
+		if err := rows.Scan(&statID, &we, &v); err != nil {
+			webFail("Failed to scan weekly values", w, err)
+			return
+		}
+		i, ok := index[we]
+		if !ok || byID[statID] == nil {
+			continue
+		}
+		if raw[statID] == nil {
+			raw[statID] = make([]*int64, len(weeks))
+		}
+		raw[statID][i] = &v
+	}
+	if err := rows.Err(); err != nil {
+		webFail("Failed to scan weekly values", w, err)
+		return
+	}
+
+	for _, c := range out {
+		values := raw[c.StatID]
+		if values == nil {
+			values = make([]*int64, len(weeks))
+		}
+		c.Trend, c.ChangePercent = rules.statTrend(values, c.Reversed)
+		c.Values = make([]*float64, len(weeks))
+		for i, v := range values {
+			if v != nil {
+				f := statValueToFloat(*v, c.ValueType, statCurrency(c.StatID))
+				c.Values[i] = &f
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week_ending": end,
+		"weeks":       weeks,
+		"rules":       rules,
+		"stats":       out,
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Self-service trials: POST /api/trial/register creates a company with an expiry date. While the
+// trial runs, trialGuard caps how much data the company can create; once it expires the company is
+// read-only, and after a grace period the cleanup job deletes it with all of its data. A trial that
+// subscribes becomes a regular company: once its Stripe subscription is active the trial row is
+// removed (endTrial), which lifts the caps and takes it out of the cleanup.
+//
+//   STATHQ_TRIAL_REGISTRATION   allow trial sign-ups (default false)
+//   STATHQ_TRIAL_DAYS           trial length (default 14)
+//   STATHQ_TRIAL_GRACE          time after expiry before deletion (default 168h)
+//   STATHQ_TRIAL_MAX_STATS      default 10
+//   STATHQ_TRIAL_MAX_USERS      default 3
+//   STATHQ_TRIAL_MAX_VALUES     daily + weekly value rows (default 5000)
+
+type trialLimits struct {
+	MaxStats  int `json:"max_stats"`
+	MaxUsers  int `json:"max_users"`
+	MaxValues int `json:"max_values"`
+}
+
+func loadTrialLimits() trialLimits {
+	return trialLimits{
+		MaxStats:  envInt("STATHQ_TRIAL_MAX_STATS", 10),
+		MaxUsers:  envInt("STATHQ_TRIAL_MAX_USERS", 3),
+		MaxValues: envInt("STATHQ_TRIAL_MAX_VALUES", 5000),
+	}
+}
+
+// companyTrialExpiry returns the trial expiry of a company, or ok=false for regular companies.
+func companyTrialExpiry(companyDBID int) (expires time.Time, ok bool, err error) {
+	var raw string
+	err = DB.QueryRow(`SELECT expires_at FROM company_trials WHERE company_id = ?`, companyDBID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	expires, err = time.Parse(time.RFC3339, raw)
+	return expires, true, err
+}
+
+// ---------- POST /api/trial/register ----------
+// Body: { "company_id": "...", "company_name": "...", "username": "...", "password": "..." }
+func TrialRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !envBool("STATHQ_TRIAL_REGISTRATION", false) {
+		http.Error(w, `{"message":"Trial registration is disabled"}`, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		CompanyID   string `json:"company_id"`
+		CompanyName string `json:"company_name"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	req.CompanyID = strings.TrimSpace(req.CompanyID)
+	req.CompanyName = strings.TrimSpace(req.CompanyName)
+	if req.CompanyID == "" || req.CompanyName == "" || strings.TrimSpace(req.Username) == "" {
+		http.Error(w, `{"message":"company_id, company_name and username are required"}`, http.StatusBadRequest)
+		return
+	}
+	if passwordRejected(w, "password", req.Password, req.Username) {
+		return
+	}
+	if _, err := companyDBID(req.CompanyID); err == nil {
+		http.Error(w, `{"message":"company_id is already taken"}`, http.StatusConflict)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	id, err := createCompanyTx(tx, req.CompanyID, req.CompanyName, req.Username, req.Password)
+	if err != nil {
+		log.Printf("Trial registration failed for %s/%s: %v", req.CompanyID, req.Username, err)
+		http.Error(w, `{"message":"Registration failed"}`, http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	expires := now.AddDate(0, 0, envInt("STATHQ_TRIAL_DAYS", 14))
+	if _, err := tx.Exec(`INSERT INTO company_trials (company_id, created_at, expires_at) VALUES (?, ?, ?)`,
+		id, now.Format(time.RFC3339), expires.Format(time.RFC3339)); err != nil {
+		webFail("Failed to create trial", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to commit trial registration", w, err)
+		return
+	}
+
+	log.Printf("Registered trial company %s (expires %s)", req.CompanyID, expires.Format(time.RFC3339))
+	createStripeCustomerAsync(req.CompanyID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Trial created",
+		"company_id": req.CompanyID,
+		"expires_at": expires.Format(time.RFC3339),
+		"limits":     loadTrialLimits(),
+	})
+}
+
+// endTrial turns a trial company into a regular one; it does nothing for other companies.
+func endTrial(companyDBID int) error {
+	res, err := DB.Exec(`DELETE FROM company_trials WHERE company_id = ?`, companyDBID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Trial of company %d converted to a subscription", companyDBID)
+	}
+	return nil
+}
+
+// trialGuard enforces trial restrictions for authenticated requests: expired trials are read-only
+// and writes stop once a data cap is reached. Regular companies pass straight through.
+func trialGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		companyID, _ := r.Context().Value("company_id").(string)
+		id, err := companyDBID(companyID)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if msg, err := trialLockMessage(id, r.URL.Path, trialValuePath(r.URL.Path)); err != nil {
+			webFail("Failed to check trial", w, err)
+			return
+		} else if msg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"message": msg})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trialLockMessage explains why a trial company may not make a write to path, or is "" when it may
+// (and for regular companies). storesValues says the write stores values, which count against the
+// values cap.
+func trialLockMessage(companyDBID int, path string, storesValues bool) (string, error) {
+	expires, isTrial, err := companyTrialExpiry(companyDBID)
+	if err != nil || !isTrial {
+		return "", err
+	}
+	if time.Now().After(expires) {
+		return "Your trial has expired", nil
+	}
+	return trialCapExceeded(companyDBID, path, storesValues)
+}
+
+// trialCapExceeded returns a message when the write at path would exceed a trial cap.
+func trialCapExceeded(companyDBID int, path string, storesValues bool) (string, error) {
+	limits := loadTrialLimits()
+	users, stats, err := billingUsage(companyDBID)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case path == "/api/stats" && limits.MaxStats > 0 && stats >= limits.MaxStats:
+		return fmt.Sprintf("Trial companies are limited to %d stats", limits.MaxStats), nil
+	case (path == "/users" || strings.HasSuffix(path, "/reactivate")) && limits.MaxUsers > 0 && users >= limits.MaxUsers:
+		return fmt.Sprintf("Trial companies are limited to %d users", limits.MaxUsers), nil
+	}
+	if limits.MaxValues <= 0 || !storesValues {
+		return "", nil
+	}
+	var values int
+	err = DB.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM daily_stats d JOIN stats s ON s.id = d.stat_id WHERE s.company_id = ?)
+		     + (SELECT COUNT(*) FROM weekly_stats ws JOIN stats s ON s.id = ws.stat_id WHERE s.company_id = ?)
+	`, companyDBID, companyDBID).Scan(&values)
+	if err != nil {
+		return "", err
+	}
+	if values >= limits.MaxValues {
+		return fmt.Sprintf("Trial companies are limited to %d stored values", limits.MaxValues), nil
+	}
+	return "", nil
+}
+
+// trialValuePaths are the routes that store daily or weekly values. Only they count against the
+// values cap, so a company at the cap can still delete data, change passwords and so on.
+var trialValuePaths = map[string]bool{
+	"/services/save7R":         true,
+	"/services/saveWeeklyEdit": true,
+	"/services/logWeeklyStats": true,
+	"/api/quick-entry":         true,
+	"/api/import/accounting":   true,
+	"/api/import/timeclock":    true,
+	"/api/import/ndjson":       true,
+	"/api/import/weekly-csv":   true,
+	"/api/company/import":      true,
+}
+
+func trialValuePath(path string) bool {
+	return trialValuePaths[path] || (strings.HasPrefix(path, "/api/stats/") && strings.HasSuffix(path, "/breakdown"))
+}
+
+// StartTrialCleanupJob deletes trial companies whose grace period after expiry has passed.
+func StartTrialCleanupJob() {
+	grace := envDuration("STATHQ_TRIAL_GRACE", 7*24*time.Hour)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			cleanupExpiredTrials(grace)
+			<-ticker.C
+		}
+	}()
+}
+
+func cleanupExpiredTrials(grace time.Duration) {
+	cutoff := time.Now().UTC().Add(-grace).Format(time.RFC3339)
+	rows, err := DB.Query(`SELECT company_id FROM company_trials WHERE expires_at < ?`, cutoff)
+	if err != nil {
+		log.Printf("Trial cleanup failed: %v", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		tx, err := DB.Begin()
+		if err != nil {
+			log.Printf("Trial cleanup failed: %v", err)
+			return
+		}
+		// The company may have subscribed since it was listed.
+		var stillExpired int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM company_trials WHERE company_id = ? AND expires_at < ?`, id, cutoff).Scan(&stillExpired); err != nil || stillExpired == 0 {
+			tx.Rollback()
+			continue
+		}
+		if _, err := deleteCompanyTx(tx, id); err != nil {
+			tx.Rollback()
+			log.Printf("Failed to delete expired trial company %d: %v", id, err)
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to delete expired trial company %d: %v", id, err)
+			continue
+		}
+		log.Printf("Deleted expired trial company %d", id)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Two-factor authentication with authenticator apps (TOTP, RFC 6238: SHA-1, 6 digits, 30s).
+//
+// POST /api/2fa/setup returns a new secret (and otpauth:// URL for a QR code); POST /api/2fa/verify
+// with a code from the app turns 2FA on and returns ten one-time recovery codes, shown only then.
+// From then on /login and the password token grant want the code as "otp" next to the password,
+// answering 401 with "two_factor_required" when it is missing; a recovery code works in its place
+// once. POST /api/2fa/disable needs the password and a code. A code is accepted one step either
+// side of now, and never twice.
+//
+// Secrets are stored encrypted (AES-256-GCM) with STATHQ_2FA_KEY, 64 hex chars. Without it 2FA
+// cannot be set up, and users who have it enrolled cannot log in, so keep the key with the database
+// backups.
+
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+var errTwoFactorKey = errors.New("STATHQ_2FA_KEY is not set or not 64 hex characters")
+
+func twoFactorKey() ([]byte, error) {
+	key, err := hex.DecodeString(envString("STATHQ_2FA_KEY", ""))
+	if err != nil || len(key) != 32 {
+		return nil, errTwoFactorKey
+	}
+	return key, nil
+}
+
+func encryptTOTPSecret(secret []byte) ([]byte, error) {
+	key, err := twoFactorKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+func decryptTOTPSecret(sealed []byte) ([]byte, error) {
+	key, err := twoFactorKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed secret too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// totpCode computes the code for one time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// totpMatch returns the step a code belongs to (now ±1), or 0.
+func totpMatch(secret []byte, code string) int64 {
+	now := time.Now().Unix() / totpStep
+	for _, step := range []int64{now, now - 1, now + 1} {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+func normalizeOTP(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// userTOTP loads a user's 2FA row; enabled is false while setup is unconfirmed.
+func userTOTP(userID int) (secret []byte, enabled bool, lastStep int64, err error) {
+	var sealed []byte
+	var enabledAt sql.NullString
+	err = DB.QueryRow(`SELECT secret_enc, enabled_at, last_step FROM user_totp WHERE user_id = ?`, userID).Scan(&sealed, &enabledAt, &lastStep)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	secret, err = decryptTOTPSecret(sealed)
+	return secret, enabledAt.Valid, lastStep, err
+}
+
+func twoFactorEnabled(userID int) bool {
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL`, userID).Scan(&n)
+	return n > 0
+}
+
+// checkTOTP accepts an authenticator code (not seen before) or an unused recovery code, spending it.
+func checkTOTP(userID int, code string) (bool, error) {
+	code = normalizeOTP(code)
+	if code == "" {
+		return false, nil
+	}
+	if len(code) == totpDigits {
+		secret, _, lastStep, err := userTOTP(userID)
+		if err != nil {
+			return false, err
+		}
+		step := totpMatch(secret, code)
+		if step == 0 || step <= lastStep {
+			return false, nil
+		}
+		// The conditional update makes a concurrent replay of the same code lose.
+		res, err := DB.Exec(`UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?`, step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+	res, err := DB.Exec(`UPDATE user_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), userID, hashSecretToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 1 {
+		log.Printf("User %d used a 2FA recovery code", userID)
+	}
+	return n == 1, nil
+}
+
+// requireSecondFactor checks the login's otp when the user has 2FA enrolled. It writes the error
+// response and returns false when the login must stop.
+func requireSecondFactor(w http.ResponseWriter, r *http.Request, companyCode, username string, userID int, method, otp string) bool {
+	if !twoFactorEnabled(userID) {
+		return true
+	}
+	if strings.TrimSpace(otp) == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message": "Two-factor code required", "two_factor_required": true}`)
+		return false
+	}
+	ok, err := checkTOTP(userID, otp)
+	if err != nil {
+		webFail("Failed to check two-factor code", w, err)
+		return false
+	}
+	if !ok {
+		recordLogin(r, companyCode, username, userID, method, false, "wrong 2fa code")
+		http.Error(w, `{"message": "Invalid two-factor code", "two_factor_required": true}`, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the plaintexts.
+func newRecoveryCodes(ex execer, userID int) ([]string, error) {
+	if _, err := ex.Exec(`DELETE FROM user_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(enc.EncodeToString(buf))[:10]
+		if _, err := ex.Exec(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hashSecretToken(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+// ---------- GET /api/2fa ----------
+func TwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	var remaining int
+	DB.QueryRow(`SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&remaining)
+	_, keyErr := twoFactorKey()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  twoFactorEnabled(userID),
+		"available":                keyErr == nil,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// ---------- POST /api/2fa/setup ----------
+// Starts (or restarts) enrolment; 2FA stays off until /api/2fa/verify confirms a code.
+func TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	if twoFactorEnabled(userID) {
+		http.Error(w, `{"message":"Two-factor authentication is already on; disable it first"}`, http.StatusConflict)
+		return
+	}
+	if _, err := twoFactorKey(); err != nil {
+		http.Error(w, `{"message":"Two-factor authentication is not configured on this server"}`, http.StatusServiceUnavailable)
+		return
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		webFail("Failed to generate secret", w, err)
+		return
+	}
+	sealed, err := encryptTOTPSecret(secret)
+	if err != nil {
+		webFail("Failed to encrypt secret", w, err)
+		return
+	}
+	if _, err := DB.Exec(`
+		INSERT INTO user_totp (user_id, secret_enc, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret_enc = excluded.secret_enc, created_at = excluded.created_at, enabled_at = NULL, last_step = 0
+	`, userID, sealed, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		webFail("Failed to save secret", w, err)
+		return
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	label := fmt.Sprintf("StatHQ:%v/%v", r.Context().Value("company_id"), r.Context().Value("username"))
+	otpauth := (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: url.Values{"secret": {encoded}, "issuer": {"StatHQ"}, "digits": {"6"}, "period": {"30"}}.Encode(),
+	}).String()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"secret": encoded, "otpauth_url": otpauth})
+}
+
+// ---------- POST /api/2fa/verify ----------
+// Body: {"code": "123456"}. Confirms enrolment and returns the recovery codes.
+func TwoFactorVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	secret, enabled, _, err := userTOTP(userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"Start with /api/2fa/setup"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		webFail("Failed to load two-factor secret", w, err)
+		return
+	}
+	if enabled {
+		http.Error(w, `{"message":"Two-factor authentication is already on"}`, http.StatusConflict)
+		return
+	}
+	step := totpMatch(secret, normalizeOTP(req.Code))
+	if step == 0 {
+		http.Error(w, `{"message":"Invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE user_totp SET enabled_at = ?, last_step = ? WHERE user_id = ?`,
+		time.Now().UTC().Format(time.RFC3339), step, userID); err != nil {
+		webFail("Failed to enable two-factor authentication", w, err)
+		return
+	}
+	codes, err := newRecoveryCodes(tx, userID)
+	if err != nil {
+		webFail("Failed to create recovery codes", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to enable two-factor authentication", w, err)
+		return
+	}
+	log.Printf("User %d enabled two-factor authentication", userID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "recovery_codes": codes})
+}
+
+// ---------- POST /api/2fa/disable ----------
+// Body: {"password": "...", "code": "123456 or a recovery code"}.
+func TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	if !twoFactorEnabled(userID) {
+		http.Error(w, `{"message":"Two-factor authentication is not on"}`, http.StatusConflict)
+		return
+	}
+	var hash string
+	if err := DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		webFail("Failed to load user", w, err)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		http.Error(w, `{"message":"Wrong password"}`, http.StatusForbidden)
+		return
+	}
+	ok, err := checkTOTP(userID, req.Code)
+	if err != nil {
+		webFail("Failed to check two-factor code", w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"message":"Invalid code"}`, http.StatusForbidden)
+		return
+	}
+	if _, err := DB.Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID); err != nil {
+		webFail("Failed to disable two-factor authentication", w, err)
+		return
+	}
+	DB.Exec(`DELETE FROM user_recovery_codes WHERE user_id = ?`, userID)
+	log.Printf("User %d disabled two-factor authentication", userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": false})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Personal data requests. GET /api/users/{id}/export (or GET /api/user/export for yourself) returns
+// everything stored about a user as one JSON document: the profile, the values, quotas, adjustments
+// and explanations they authored, their audit and sign-in history, and their assignments. Secrets
+// (password and token hashes, 2FA seeds) are left out.
+//
+// POST /api/users/{id}/anonymize answers a deletion request without losing company statistics: the
+// user is deactivated and renamed deleted-user-{id}, their email, sign-in methods, sessions, links
+// and PINs are removed and addresses are blanked in the login and kiosk logs. Values keep pointing at
+// the (now anonymous) user, so history and totals do not change. It cannot be undone.
+
+const userExportFormat = 1
+
+// userExportSections select a user's rows, with ? bound to the user id.
+var userExportSections = []companyExportFile{
+	{"profile", `SELECT u.id, c.company_id, u.username, u.role, u.email, u.email_verified_at, u.last_login_at, u.last_seen_at,
+		u.active, u.deactivated_at, u.anonymized_at
+		FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ?`},
+	{"assigned_stats", `SELECT id, short_id, full_name, type, value_type FROM stats
+		WHERE assigned_user_id = ? OR id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?) ORDER BY id`},
+	{"division_managers", `SELECT division_id FROM division_managers WHERE user_id = ? ORDER BY division_id`},
+	{"weekly_stats", `SELECT id, stat_id, week_ending, value, submitted_at, updated_at FROM weekly_stats WHERE author_user_id = ? ORDER BY stat_id, week_ending`},
+	{"weekly_stats_history", `SELECT stat_id, week_ending, old_value, new_value, changed_at, reason FROM weekly_stats_history WHERE editor_user_id = ? ORDER BY id`},
+	{"daily_stats", `SELECT id, stat_id, date, value, updated_at FROM daily_stats WHERE author_user_id = ? ORDER BY stat_id, date`},
+	{"stat_quotas", `SELECT stat_id, week_ending, value FROM stat_quotas WHERE author_user_id = ? ORDER BY stat_id, week_ending`},
+	{"weekly_adjustments", `SELECT stat_id, week_ending, amount, reason, created_at FROM weekly_adjustments WHERE author_user_id = ? ORDER BY id`},
+	{"stat_explanations", `SELECT stat_id, week_ending, why, handling, created_at FROM stat_explanations WHERE author_user_id = ? ORDER BY id`},
+	{"weekly_stat_components", `SELECT stat_id, week_ending, category, value, updated_at FROM weekly_stat_components WHERE author_user_id = ? ORDER BY id`},
+	{"week_submissions", `SELECT stat_id, week_ending, created_at, submitted_at FROM week_submissions WHERE user_id = ? ORDER BY stat_id, week_ending`},
+	{"week_completions", `SELECT week_ending, completed_at FROM week_completions WHERE user_id = ? ORDER BY week_ending`},
+	{"targets", `SELECT id, title, description, stat_id, target_value, due_date, status, created_at, completed_at FROM targets
+		WHERE owner_user_id = ? OR created_by = ? ORDER BY id`},
+	{"condition_steps", `SELECT condition_id, step_no, text, completed_at, note FROM condition_steps WHERE completed_by = ? ORDER BY id`},
+	{"stat_assignment_history", `SELECT stat_id, from_user_id, to_user_id, effective_date, changed_at FROM stat_assignment_history
+		WHERE from_user_id = ? OR to_user_id = ? ORDER BY id`},
+	{"activity_log", `SELECT action, stat_id, stat_short_id, week_ending, detail, created_at FROM activity_log WHERE user_id = ? ORDER BY id`},
+	{"login_events", `SELECT method, success, reason, ip, country, user_agent, created_at FROM login_events WHERE user_id = ? ORDER BY id`},
+	{"security_events", `SELECT kind, ip, country, detail, created_at FROM security_events WHERE user_id = ? ORDER BY id`},
+	{"sessions", `SELECT created_at, updated_at, expires_at, ip, user_agent FROM sessions WHERE user_id = ? ORDER BY id`},
+	{"passkeys", `SELECT name, created_at, last_used_at FROM webauthn_credentials WHERE user_id = ? ORDER BY id`},
+	{"api_tokens", `SELECT name, scopes, created_at, last_used_at, revoked_at FROM api_tokens WHERE user_id = ? ORDER BY id`},
+	{"kiosk_events", `SELECT kiosk_id, action, detail, ip, created_at FROM kiosk_events WHERE user_id = ? ORDER BY id`},
+	{"telegram_links", `SELECT chat_id, linked_at FROM telegram_links WHERE user_id = ?`},
+}
+
+// writeUserExport streams a user's data as a JSON object with one array per section.
+func writeUserExport(w io.Writer, userID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	fmt.Fprintf(w, `{"format": %d, "user_id": %d, "exported_at": %q, "data": {`, userExportFormat, userID, time.Now().UTC().Format(time.RFC3339))
+	for i, s := range userExportSections {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, "\n%q: ", s.Name)
+		args := []interface{}{userID}
+		for n := countPlaceholders(s.Query); len(args) < n; {
+			args = append(args, userID)
+		}
+		if _, err := writeExportFile(tx, w, "json", s.Query, args...); err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+	}
+	_, err = io.WriteString(w, "}}\n")
+	return err
+}
+
+func countPlaceholders(query string) int {
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+		}
+	}
+	return n
+}
+
+func serveUserExport(w http.ResponseWriter, r *http.Request, userID int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d.json"`, userID))
+	if err := writeUserExport(w, userID); err != nil {
+		// Headers are gone; the truncated body is the signal.
+		log.Printf("User export %d: %v", userID, err)
+		return
+	}
+	log.Printf("Personal data of user %d exported by user %v", userID, r.Context().Value("user_id"))
+}
+
+// companyUserID resolves {id} to a user of the caller's company.
+func companyUserID(r *http.Request) (int, string, bool) {
+	var userID int
+	var username string
+	err := DB.QueryRow(`
+		SELECT u.id, u.username FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ? AND c.company_id = ?
+	`, mux.Vars(r)["id"], r.Context().Value("company_id")).Scan(&userID, &username)
+	return userID, username, err == nil
+}
+
+// ---------- GET /api/users/{id}/export ----------
+func ExportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := companyUserID(r)
+	if !ok {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	serveUserExport(w, r, userID)
+}
+
+// ---------- GET /api/user/export ----------
+func ExportOwnDataHandler(w http.ResponseWriter, r *http.Request) {
+	serveUserExport(w, r, r.Context().Value("user_id").(int))
+}
+
+// ---------- POST /api/users/{id}/anonymize ----------
+// Body: {"confirm_username": "..."}, the user's current username, as a guard against mistakes.
+func AnonymizeUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, username, ok := companyUserID(r)
+	if !ok {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	if userID == r.Context().Value("user_id").(int) {
+		http.Error(w, `{"message":"Cannot anonymize own account"}`, http.StatusForbidden)
+		return
+	}
+	var req struct {
+		ConfirmUsername string `json:"confirm_username"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.ConfirmUsername != username {
+		http.Error(w, `{"message":"confirm_username must be the user's current username"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	anonymous := "deleted-user-" + strconv.Itoa(userID)
+	stmts := []struct {
+		query string
+		args  []interface{}
+	}{
+		// An empty hash never matches, so no password works any more.
+		{`UPDATE users SET username = ?, email = NULL, email_verified_at = NULL, password_hash = '', last_login_at = NULL,
+			last_seen_at = NULL, failed_logins = 0, locked_until = NULL, active = 0,
+			deactivated_at = COALESCE(deactivated_at, ?), anonymized_at = ? WHERE id = ?`, []interface{}{anonymous, now, now, userID}},
+		{`UPDATE login_events SET username = ?, ip = '', country = NULL, user_agent = '' WHERE user_id = ?`, []interface{}{anonymous, userID}},
+		{`UPDATE security_events SET username = ?, subject = 'user:' || ?, ip = '', country = NULL WHERE user_id = ?`, []interface{}{anonymous, anonymous, userID}},
+		{`UPDATE kiosk_events SET ip = '' WHERE user_id = ?`, []interface{}{userID}},
+	}
+	for _, table := range []string{"sessions", "api_token_families", "api_access_tokens", "api_tokens", "user_totp", "user_recovery_codes", "webauthn_credentials",
+		"email_verifications", "welcome_tokens", "login_links", "telegram_links", "telegram_link_codes", "kiosk_pins", "division_managers"} {
+		stmts = append(stmts, struct {
+			query string
+			args  []interface{}
+		}{`DELETE FROM ` + table + ` WHERE user_id = ?`, []interface{}{userID}})
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			webFail("Failed to anonymize user", w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to anonymize user", w, err)
+		return
+	}
+	log.Printf("User %v anonymized user %d of %v", r.Context().Value("user_id"), userID, r.Context().Value("company_id"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": userID, "username": anonymous, "anonymized_at": now})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value types. Every value is stored as an integer in the value column:
+//
+//   number      the whole number itself
+//   currency    cents
+//   percentage  hundredths of a percent (12.5 is 1250)
+//   decimal     ten-thousandths (1.5 is 15000), entered with up to four places; the grids show
+//               the stat's decimal_places (0-4, 2 when unset), or more when a value has them, so
+//               saving a grid back never rounds it
+//   ratio       a numerator over a denominator, entered as "45/60"; value holds the quotient in
+//               ten-thousandths (0.75 is 7500) and the row keeps numerator and denominator, also in
+//               ten-thousandths
+//   duration    seconds, entered as "H:MM", "H:MM:SS" or hours ("1.5" is 1:30) and shown as H:MM
+//               (H:MM:SS when there are seconds); series report it in hours
+//
+// A ratio entered as a plain quotient (0.75) is stored as that quotient over 1. Monthly and yearly
+// views divide the summed numerators by the summed denominators rather than adding quotients, so
+// 1/2 and 30/40 make 31/42, not 1.25. Rows written without their parts (imports, integrations
+// that only know the quotient) count as their quotient over 1.
+
+var valueTypes = []string{"number", "currency", "percentage", "decimal", "ratio", "duration"}
+
+const (
+	decimalScale         = 10000 // stored units per 1 for decimal and ratio values
+	maxDecimalPlaces     = 4
+	defaultDecimalPlaces = 2
+)
+
+func validValueType(valueType string) bool {
+	for _, t := range valueTypes {
+		if t == valueType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDecimalPlaces returns why a stat's decimal_places cannot be used, or "".
+func checkDecimalPlaces(places *int) string {
+	if places != nil && (*places < 0 || *places > maxDecimalPlaces) {
+		return fmt.Sprintf("decimal_places must be between 0 and %d", maxDecimalPlaces)
+	}
+	return ""
+}
+
+// parseDecimal reads a plain decimal ("-12.5") into ten-thousandths, exactly.
+func parseDecimal(raw string) (int64, error) {
+	s := strings.TrimSpace(raw)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid decimal %q", raw)
+	}
+	if len(frac) > maxDecimalPlaces {
+		return 0, fmt.Errorf("%q has more than %d decimal places", raw, maxDecimalPlaces)
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid decimal %q", raw)
+		}
+	}
+	n, err := strconv.ParseInt(whole+frac+strings.Repeat("0", maxDecimalPlaces-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decimal %q", raw)
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// parseRatio reads "numerator/denominator", or a plain quotient, returning the quotient and its
+// parts in ten-thousandths.
+func parseRatio(raw string) (value, num, den int64, err error) {
+	n, d, found := strings.Cut(raw, "/")
+	if num, err = parseDecimal(n); err != nil {
+		return 0, 0, 0, err
+	}
+	den = decimalScale
+	if found {
+		if den, err = parseDecimal(d); err != nil {
+			return 0, 0, 0, err
+		}
+		if den <= 0 {
+			return 0, 0, 0, fmt.Errorf("the denominator of %q must be above zero", raw)
+		}
+	}
+	value, _ = ratioValue(num, den)
+	return value, num, den, nil
+}
+
+// ratioValue is the stored quotient of a numerator and denominator; ok is false when den is zero.
+func ratioValue(num, den int64) (int64, bool) {
+	if den == 0 {
+		return 0, false
+	}
+	return int64(math.Round(float64(num) * decimalScale / float64(den))), true
+}
+
+// ratioParts returns the numerator and denominator to store alongside a value entered as raw, or
+// nils for other value types.
+func ratioParts(raw, valueType string) (interface{}, interface{}) {
+	if valueType != "ratio" {
+		return nil, nil
+	}
+	_, num, den, err := parseRatio(raw)
+	if err != nil {
+		return nil, nil
+	}
+	return num, den
+}
+
+// formatDecimal renders ten-thousandths with at least the given number of places, and as many
+// more as the value needs; places -1 shows only those needed.
+func formatDecimal(v int64, places int) string {
+	need, rest := maxDecimalPlaces, v
+	for need > 0 && rest%10 == 0 {
+		need--
+		rest /= 10
+	}
+	return strconv.FormatFloat(float64(v)/decimalScale, 'f', max(places, need), 64)
+}
+
+// formatRatio renders a stored ratio as it was entered: "45/60", or the quotient when the parts
+// are unknown or the denominator is 1.
+func formatRatio(v int64, num, den sql.NullInt64) string {
+	if !num.Valid || !den.Valid || den.Int64 == decimalScale {
+		return formatDecimal(v, -1)
+	}
+	return formatDecimal(num.Int64, -1) + "/" + formatDecimal(den.Int64, -1)
+}
+
+// parseDuration reads "H:MM", "H:MM:SS" or a number of hours into seconds. Durations are never
+// negative in either form; signed amounts such as adjustments strip the sign first.
+func parseDuration(raw string) (int64, error) {
+	s := strings.TrimSpace(raw)
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		h, err := parseDecimal(s)
+		if err != nil || h < 0 {
+			return 0, fmt.Errorf("invalid duration %q (use H:MM or hours)", raw)
+		}
+		return int64(math.Round(float64(h) * 3600 / decimalScale)), nil
+	}
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration %q (use H:MM or H:MM:SS)", raw)
+	}
+	var secs int64
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 || (i > 0 && (len(p) != 2 || n > 59)) {
+			return 0, fmt.Errorf("invalid duration %q (use H:MM or H:MM:SS)", raw)
+		}
+		secs = secs*60 + n
+	}
+	if len(parts) == 2 {
+		secs *= 60
+	}
+	return secs, nil
+}
+
+// formatDuration renders seconds as H:MM, or H:MM:SS when there are seconds.
+func formatDuration(secs int64) string {
+	sign := ""
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	if secs%60 != 0 {
+		return fmt.Sprintf("%s%d:%02d:%02d", sign, secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%s%d:%02d", sign, secs/3600, secs/60%60)
+}
+
+// statInputPlaces is how many decimals the grids write a stat's values with: its decimal places,
+// its currency's minor unit, 2 for percentages and none otherwise.
+func statInputPlaces(statID int) int {
+	var valueType, currency string
+	var places sql.NullInt64
+	if err := DB.QueryRow(`
+		SELECT s.value_type, s.decimal_places, COALESCE(s.currency, cs.default_currency, ?)
+		FROM stats s LEFT JOIN company_settings cs ON cs.company_id = s.company_id WHERE s.id = ?
+	`, defaultCurrency, statID).Scan(&valueType, &places, &currency); err != nil {
+		return -1
+	}
+	switch valueType {
+	case "decimal", "ratio":
+		if !places.Valid {
+			return defaultDecimalPlaces
+		}
+		return int(places.Int64)
+	case "currency":
+		return currencyOf(currency).Places
+	case "percentage":
+		return 2
+	}
+	return 0
+}
+
+// statDecimalPlaces is how many places a decimal stat shows.
+func statDecimalPlaces(statID int) int {
+	var places sql.NullInt64
+	if err := DB.QueryRow(`SELECT decimal_places FROM stats WHERE id = ?`, statID).Scan(&places); err != nil || !places.Valid {
+		return defaultDecimalPlaces
+	}
+	return int(places.Int64)
+}
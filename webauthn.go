@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Passkeys (WebAuthn): users sign in with a phone, security key or the computer's own authenticator
+// instead of a password, which suits the shared stat-entry machines where typing passwords is the
+// weak spot. A signed-in user registers passkeys with POST /api/user/passkeys/register/begin and
+// .../finish and manages them with GET /api/user/passkeys and DELETE /api/user/passkeys/{id}. The
+// login page calls POST /auth/passkey/begin with the company (and optionally the username) and
+// POST /auth/passkey/finish with the assertion, which starts an ordinary session.
+//
+// Options and credentials travel in the WebAuthn JSON form (base64url fields), so browsers can use
+// PublicKeyCredential.parseCreationOptionsFromJSON / parseRequestOptionsFromJSON and toJSON().
+// User verification (PIN or biometric on the authenticator) is required, which is why a passkey
+// login skips the 2FA code. Attestation is not requested; ES256 and RS256 keys are accepted.
+//
+// The relying party id is the host of STATHQ_PUBLIC_URL (or of the request), overridable with
+// STATHQ_WEBAUTHN_RP_ID; the browser origin must equal the public URL.
+
+const (
+	webauthnChallengeTTL = 5 * time.Minute
+	maxPasskeyNameLen    = 100
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authFlagUP = 0x01 // user present
+	authFlagUV = 0x04 // user verified
+	authFlagAT = 0x40 // attested credential data included
+)
+
+var errCBOR = errors.New("malformed CBOR")
+
+func webauthnRPID(r *http.Request) string {
+	if id := envString("STATHQ_WEBAUTHN_RP_ID", ""); id != "" {
+		return id
+	}
+	u, err := url.Parse(publicURL(r))
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// decodeB64URL accepts base64url with or without padding, as browsers differ.
+func decodeB64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// cborDecode reads one CBOR item, in the subset authenticators produce, and returns it with the
+// remaining bytes. Maps come back as map[interface{}]interface{} keyed by int64 or string.
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, errCBOR
+		}
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, errCBOR // indefinite lengths are not used by authenticators
+	}
+	if major != 7 && n > 1<<62 {
+		return nil, nil, errCBOR
+	}
+	switch major {
+	case 0:
+		return int64(n), b, nil
+	case 1:
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n {
+			return nil, nil, errCBOR
+		}
+		if major == 3 {
+			return string(b[:n]), b[n:], nil
+		}
+		return append([]byte{}, b[:n]...), b[n:], nil
+	case 4:
+		arr := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			v, rest, err := cborDecode(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr, b = append(arr, v), rest
+		}
+		return arr, b, nil
+	case 5:
+		m := map[interface{}]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			k, rest, err := cborDecode(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			v, rest, err := cborDecode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k], b = v, rest
+		}
+		return m, b, nil
+	case 6:
+		return cborDecode(b) // tags are ignored
+	default:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+		return nil, b, nil // floats: the header already consumed the value
+	}
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte // COSE key, only in registration
+}
+
+func parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	ad := authenticatorData{RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.Flags&authFlagAT == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18])) // after the 16-byte AAGUID
+	rest = rest[18:]
+	if len(rest) < n {
+		return ad, errors.New("credential id truncated")
+	}
+	ad.CredentialID = rest[:n]
+	_, tail, err := cborDecode(rest[n:])
+	if err != nil {
+		return ad, fmt.Errorf("credential public key: %w", err)
+	}
+	ad.PublicKey = rest[n : len(rest)-len(tail)]
+	return ad, nil
+}
+
+// check verifies the data was made for this site with the user present and verified.
+func (ad authenticatorData) check(rpID string) error {
+	want := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, want[:]) {
+		return errors.New("passkey belongs to a different site")
+	}
+	if ad.Flags&authFlagUP == 0 || ad.Flags&authFlagUV == 0 {
+		return errors.New("user verification is required")
+	}
+	return nil
+}
+
+// parseCOSEKey returns the public key of an ES256 or RS256 COSE key.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, error) {
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errCBOR
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 key")
+		}
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, errors.New("invalid P-256 key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %d / algorithm %d", kty, alg)
+}
+
+func verifyPasskeySignature(pub crypto.PublicKey, signed, sig []byte) bool {
+	h := sha256.Sum256(signed)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, h[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	}
+	return false
+}
+
+// newWebAuthnChallenge records a challenge for one ceremony and returns it base64url-encoded.
+func newWebAuthnChallenge(kind string, companyDBID int, userID interface{}) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now().UTC()
+	if _, err := DB.Exec(`DELETE FROM webauthn_challenges WHERE expires_at < ?`, now.Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	_, err := DB.Exec(`INSERT INTO webauthn_challenges (challenge_hash, kind, company_id, user_id, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashSecretToken(challenge), kind, companyDBID, userID, now.Add(webauthnChallengeTTL).Format(time.RFC3339))
+	return challenge, err
+}
+
+// spendClientData checks clientDataJSON against the ceremony and uses up its challenge, returning
+// the company and (when the ceremony named one) the user it was issued for.
+func spendClientData(r *http.Request, raw []byte, kind string) (companyDBID int, userID sql.NullInt64, err error) {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return 0, userID, errors.New("invalid clientDataJSON")
+	}
+	wantType := map[string]string{"register": "webauthn.create", "login": "webauthn.get"}[kind]
+	if cd.Type != wantType {
+		return 0, userID, fmt.Errorf("clientDataJSON type is %q, want %q", cd.Type, wantType)
+	}
+	if cd.Origin != publicURL(r) {
+		return 0, userID, fmt.Errorf("origin %q is not %s", cd.Origin, publicURL(r))
+	}
+	err = DB.QueryRow(`
+		DELETE FROM webauthn_challenges WHERE challenge_hash = ? AND kind = ? AND expires_at > ?
+		RETURNING company_id, user_id
+	`, hashSecretToken(strings.TrimRight(cd.Challenge, "=")), kind, time.Now().UTC().Format(time.RFC3339)).Scan(&companyDBID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, userID, errors.New("unknown or expired challenge")
+	}
+	return companyDBID, userID, err
+}
+
+// passkeyCredential is PublicKeyCredential.toJSON() for both ceremonies.
+type passkeyCredential struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"` // registration
+		AuthenticatorData string `json:"authenticatorData"` // login
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+func passkeyCredentialIDs(userID int) ([]map[string]string, error) {
+	rows, err := DB.Query(`SELECT credential_id FROM webauthn_credentials WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []map[string]string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, map[string]string{"type": "public-key", "id": id})
+	}
+	return out, rows.Err()
+}
+
+// ---------- POST /api/user/passkeys/register/begin ----------
+func PasskeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if _, impersonating := r.Context().Value("impersonator_id").(int); impersonating {
+		http.Error(w, `{"message":"Passkeys cannot be added while impersonating"}`, http.StatusForbidden)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	username := r.Context().Value("username").(string)
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	exclude, err := passkeyCredentialIDs(userID)
+	if err != nil {
+		webFail("Failed to load passkeys", w, err)
+		return
+	}
+	challenge, err := newWebAuthnChallenge("register", companyDBID, userID)
+	if err != nil {
+		webFail("Failed to start passkey registration", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": webauthnRPID(r), "name": "StatHQ"},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID))),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":                webauthnChallengeTTL.Milliseconds(),
+		"attestation":            "none",
+		"excludeCredentials":     exclude,
+		"authenticatorSelection": map[string]string{"residentKey": "preferred", "userVerification": "required"},
+	}})
+}
+
+// ---------- POST /api/user/passkeys/register/finish ----------
+// Body: {"name": "Office kiosk key", "credential": <PublicKeyCredential.toJSON()>}
+func PasskeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	var req struct {
+		Name       string            `json:"name"`
+		Credential passkeyCredential `json:"credential"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyNameLen {
+		http.Error(w, fmt.Sprintf(`{"message":"name is limited to %d characters"}`, maxPasskeyNameLen), http.StatusBadRequest)
+		return
+	}
+	fail := func(err error) {
+		log.Printf("Passkey registration for user %d refused: %v", userID, err)
+		http.Error(w, fmt.Sprintf(`{"message":%q}`, "Passkey not accepted: "+err.Error()), http.StatusBadRequest)
+	}
+	clientData, err := decodeB64URL(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		fail(errors.New("invalid clientDataJSON"))
+		return
+	}
+	_, challengeUser, err := spendClientData(r, clientData, "register")
+	if err != nil {
+		fail(err)
+		return
+	}
+	if !challengeUser.Valid || int(challengeUser.Int64) != userID {
+		fail(errors.New("challenge was issued to another user"))
+		return
+	}
+	attObj, err := decodeB64URL(req.Credential.Response.AttestationObject)
+	if err != nil {
+		fail(errors.New("invalid attestationObject"))
+		return
+	}
+	v, _, err := cborDecode(attObj)
+	m, ok := v.(map[interface{}]interface{})
+	if err != nil || !ok {
+		fail(errors.New("invalid attestationObject"))
+		return
+	}
+	rawAuthData, _ := m["authData"].([]byte)
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := ad.check(webauthnRPID(r)); err != nil {
+		fail(err)
+		return
+	}
+	if ad.CredentialID == nil {
+		fail(errors.New("no credential in authenticator data"))
+		return
+	}
+	if _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		fail(err)
+		return
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(ad.CredentialID)
+	now := time.Now().UTC().Format(time.RFC3339)
+	var id int
+	err = DB.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name, created_at)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (credential_id) DO NOTHING RETURNING id
+	`, userID, credentialID, ad.PublicKey, ad.SignCount, name, now).Scan(&id)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"message":"This passkey is already registered"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		webFail("Failed to save passkey", w, err)
+		return
+	}
+	log.Printf("User %d registered passkey %d (%s)", userID, id, name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "name": name, "created_at": now})
+}
+
+// ---------- GET /api/user/passkeys ----------
+func ListPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query(`
+		SELECT id, name, created_at, last_used_at FROM webauthn_credentials WHERE user_id = ? ORDER BY id
+	`, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to load passkeys", w, err)
+		return
+	}
+	defer rows.Close()
+	type passkey struct {
+		ID         int     `json:"id"`
+		Name       string  `json:"name"`
+		CreatedAt  string  `json:"created_at"`
+		LastUsedAt *string `json:"last_used_at"`
+	}
+	out := []passkey{}
+	for rows.Next() {
+		var p passkey
+		var lastUsed sql.NullString
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			webFail("Failed to load passkeys", w, err)
+			return
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.String
+		}
+		out = append(out, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ---------- DELETE /api/user/passkeys/{id} ----------
+func DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := DB.Exec(`DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?`, mux.Vars(r)["id"], r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to delete passkey", w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"message":"Passkey not found"}`, http.StatusNotFound)
+		return
+	}
+	log.Printf("User %v deleted passkey %s", r.Context().Value("user_id"), mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"message":"Passkey deleted"}`)
+}
+
+// ---------- POST /auth/passkey/begin ----------
+// Body: {"company_id": "ACME", "username": "optional"}. Without a username the browser offers the
+// passkeys it holds for this site.
+func PasskeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CompanyID string `json:"company_id"`
+		Username  string `json:"username"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if companySuspended(req.CompanyID) {
+		http.Error(w, `{"message": "This company is suspended"}`, http.StatusForbidden)
+		return
+	}
+	companyDBID, err := companyDBID(req.CompanyID)
+	if err != nil {
+		http.Error(w, `{"message":"Unknown company"}`, http.StatusNotFound)
+		return
+	}
+	var userID interface{}
+	allow := []map[string]string{}
+	if username := strings.ToLower(strings.TrimSpace(req.Username)); username != "" {
+		var id int
+		if DB.QueryRow(`SELECT id FROM users WHERE company_id = ? AND lower(username) = ?`, companyDBID, username).Scan(&id) == nil {
+			userID = id
+			if allow, err = passkeyCredentialIDs(id); err != nil {
+				webFail("Failed to load passkeys", w, err)
+				return
+			}
+		}
+	}
+	challenge, err := newWebAuthnChallenge("login", companyDBID, userID)
+	if err != nil {
+		webFail("Failed to start passkey login", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             webauthnRPID(r),
+		"timeout":          webauthnChallengeTTL.Milliseconds(),
+		"allowCredentials": allow,
+		"userVerification": "required",
+	}})
+}
+
+// ---------- POST /auth/passkey/finish ----------
+// Body: {"credential": <PublicKeyCredential.toJSON()>, "remember_me": false}
+func PasskeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Credential passkeyCredential `json:"credential"`
+		Remember   bool              `json:"remember_me"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	invalid := func() {
+		http.Error(w, `{"message": "Invalid credentials"}`, http.StatusUnauthorized)
+	}
+	clientData, err := decodeB64URL(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		invalid()
+		return
+	}
+	companyDBID, challengeUser, err := spendClientData(r, clientData, "login")
+	if err != nil {
+		log.Printf("Passkey login refused: %v", err)
+		invalid()
+		return
+	}
+
+	var credID, userID int
+	var publicKey []byte
+	var signCount uint32
+	var username, role, companyCode string
+	err = DB.QueryRow(`
+		SELECT w.id, w.user_id, w.public_key, w.sign_count, u.username, u.role, c.company_id
+		FROM webauthn_credentials w JOIN users u ON u.id = w.user_id JOIN companies c ON c.id = u.company_id
+		WHERE w.credential_id = ? AND c.id = ?
+	`, strings.TrimRight(req.Credential.ID, "="), companyDBID).Scan(&credID, &userID, &publicKey, &signCount, &username, &role, &companyCode)
+	if err != nil {
+		DB.QueryRow(`SELECT company_id FROM companies WHERE id = ?`, companyDBID).Scan(&companyCode)
+		recordLogin(r, companyCode, "", 0, "passkey", false, "unknown passkey")
+		invalid()
+		return
+	}
+	if !loginAllowed(w, r, companyCode, username, "passkey") {
+		return
+	}
+	refuse := func(reason string) {
+		log.Printf("Passkey login for %s/%s refused: %s", companyCode, username, reason)
+		recordLogin(r, companyCode, username, userID, "passkey", false, reason)
+		invalid()
+	}
+	if challengeUser.Valid && int(challengeUser.Int64) != userID {
+		refuse("passkey of another user")
+		return
+	}
+	if h := req.Credential.Response.UserHandle; h != "" {
+		if handle, err := decodeB64URL(h); err != nil || string(handle) != strconv.Itoa(userID) {
+			refuse("user handle mismatch")
+			return
+		}
+	}
+	rawAuthData, err := decodeB64URL(req.Credential.Response.AuthenticatorData)
+	if err != nil {
+		refuse("invalid authenticator data")
+		return
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err == nil {
+		err = ad.check(webauthnRPID(r))
+	}
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	pub, err := parseCOSEKey(publicKey)
+	if err != nil {
+		webFail("Failed to read stored passkey", w, err)
+		return
+	}
+	sig, _ := decodeB64URL(req.Credential.Response.Signature)
+	clientHash := sha256.Sum256(clientData)
+	if !verifyPasskeySignature(pub, append(append([]byte{}, rawAuthData...), clientHash[:]...), sig) {
+		refuse("wrong passkey signature")
+		return
+	}
+	// A counter that does not grow means two copies of the key exist. Authenticators that do not
+	// count always send 0.
+	if (ad.SignCount != 0 || signCount != 0) && ad.SignCount <= signCount {
+		refuse("passkey counter went backwards")
+		return
+	}
+	if _, err := DB.Exec(`UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ?`,
+		ad.SignCount, time.Now().UTC().Format(time.RFC3339), credID); err != nil {
+		webFail("Failed to update passkey", w, err)
+		return
+	}
+	if companySuspended(companyCode) {
+		recordLogin(r, companyCode, username, userID, "passkey", false, "company suspended")
+		http.Error(w, `{"message": "This company is suspended"}`, http.StatusForbidden)
+		return
+	}
+	if !accountActive(w, r, companyCode, username, userID, "passkey") {
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	startSession(session, userID, companyCode, req.Remember)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save session: %v", err)
+		http.Error(w, `{"message": "Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	recordLogin(r, companyCode, username, userID, "passkey", true, "")
+	log.Printf("Successful passkey login for %s/%s (role %s)", companyCode, username, role)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"message": "Login successful"}`)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket live updates: GET /ws upgrades an authenticated session to a WebSocket (RFC 6455)
+// carrying the same liveEvents as /api/events (stat values, reports, alerts, conditions,
+// presence). Unlike SSE the client can narrow the stream by sending
+// {"types": [...], "stat_ids": [...]}; an empty list means everything. Only what the dashboard
+// needs is implemented: unfragmented text frames out, control frames and small text frames in.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsAllowedOrigins mirrors the CORS origins in main; browsers send cookies on cross-site
+// WebSocket handshakes, so other origins are refused.
+var wsAllowedOrigins = []string{"https://stat-hq.com", "http://localhost:3000"}
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mu   sync.Mutex // serializes writes
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126, byte(n>>8), byte(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readFrame reads one client frame. Client frames must be masked; payloads over 64KB are refused.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	op := h[0] & 0x0F
+	if h[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 64<<10 {
+		return 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // non-browser client
+	}
+	for _, o := range wsAllowedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFilter is the client's subscription; empty sets match everything.
+type wsFilter struct {
+	Types   []string `json:"types"`
+	StatIDs []int    `json:"stat_ids"`
+}
+
+func (f wsFilter) match(ev liveEvent) bool {
+	if len(f.Types) > 0 {
+		ok := false
+		for _, t := range f.Types {
+			ok = ok || t == ev.Type
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(f.StatIDs) > 0 && ev.StatID != 0 {
+		for _, id := range f.StatIDs {
+			if id == ev.StatID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ---------- GET /ws ----------
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, `{"message":"WebSocket upgrade required"}`, http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, `{"message":"Unsupported WebSocket version"}`, http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, `{"message":"Missing Sec-WebSocket-Key"}`, http.StatusBadRequest)
+		return
+	}
+	if !wsOriginAllowed(r) {
+		http.Error(w, `{"message":"Origin not allowed"}`, http.StatusForbidden)
+		return
+	}
+	companyID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, `{"message":"WebSocket unsupported"}`, http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		webFail("Failed to hijack connection", w, err)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	ws := &wsConn{conn: conn, br: rw.Reader}
+
+	ch := events.subscribe(companyID)
+	defer events.unsubscribe(companyID, ch)
+
+	var filterMu sync.Mutex
+	var filter wsFilter
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+			op, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpClose:
+				ws.writeFrame(wsOpClose, nil)
+				return
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			case wsOpText:
+				var f wsFilter
+				if json.Unmarshal(payload, &f) == nil {
+					filterMu.Lock()
+					filter = f
+					filterMu.Unlock()
+				}
+			}
+		}
+	}()
+
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			if ws.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		case ev := <-ch:
+			filterMu.Lock()
+			ok := filter.match(ev)
+			filterMu.Unlock()
+			if !ok {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if ws.writeFrame(wsOpText, data) != nil {
+				return
+			}
+		}
+	}
+}
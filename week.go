@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Week state for clients: which W/E is being entered, when it closes and when values are due, in the
+// company's timezone (companies.timezone, an IANA name, default UTC). A week is "open" until 14:00 on
+// its W/E day (Thursday unless changed in the company settings), "due" until 14:00 the day after and
+// "locked" after that; entries after the deadline are still accepted but count as late.
+
+const defaultTimezone = "UTC"
+
+// companyLocation returns the time zone of a company (by public company_id), or UTC.
+func companyLocation(companyID string) *time.Location {
+	var tz string
+	if err := DB.QueryRow(`SELECT timezone FROM companies WHERE company_id = ?`, companyID).Scan(&tz); err != nil || tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// weekCloseIn is the 14:00 close of a week on its W/E day in loc.
+func weekCloseIn(weekEnding string, loc *time.Location) (time.Time, error) {
+	we, err := time.Parse("2006-01-02", weekEnding)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(we.Year(), we.Month(), we.Day(), 14, 0, 0, 0, loc), nil
+}
+
+// weekState is open, due or locked at now.
+func weekState(weekEnding string, loc *time.Location, now time.Time) string {
+	closes, err := weekCloseIn(weekEnding, loc)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case now.Before(closes):
+		return "open"
+	case now.Before(closes.Add(24 * time.Hour)):
+		return "due"
+	}
+	return "locked"
+}
+
+type weekStatStatus struct {
+	StatID      int     `json:"stat_id"`
+	ShortID     string  `json:"short_id"`
+	FullName    string  `json:"full_name"`
+	Type        string  `json:"type"`
+	Submitted   bool    `json:"submitted"`
+	Value       *string `json:"value"`
+	SubmittedAt string  `json:"submitted_at,omitempty"`
+}
+
+type weekInfo struct {
+	WeekEnding string           `json:"week_ending"`
+	WeekLabel  string           `json:"week_label"`
+	ClosesAt   string           `json:"closes_at"`
+	Deadline   string           `json:"deadline"`
+	State      string           `json:"state"`
+	Completed  bool             `json:"completed"`
+	Submitted  int              `json:"submitted"`
+	Total      int              `json:"total"`
+	Stats      []weekStatStatus `json:"stats"`
+}
+
+// ---------- GET /api/week/current ----------
+// The week being entered and, while it is still due, the week before, each with the caller's
+// assigned stats and whether they have been submitted. Times are RFC3339 in the company timezone.
+func CurrentWeekHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.Context().Value("company_id").(string)
+	userID := r.Context().Value("user_id").(int)
+	loc := companyLocation(companyID)
+	now := time.Now().In(loc)
+
+	current := enteringWeek(loc, companyWeekEndingDay(companyID), now)
+	weeks := []string{current}
+	t, _ := time.Parse("2006-01-02", current)
+	if prev := t.AddDate(0, 0, -7).Format("2006-01-02"); weekState(prev, loc, now) == "due" {
+		weeks = append(weeks, prev)
+	}
+
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	fiscal := companyFiscal(companyDBID)
+	out := []weekInfo{}
+	for _, we := range weeks {
+		info, err := loadWeekInfo(userID, we, loc, now)
+		if err != nil {
+			webFail("Failed to load week status", w, err)
+			return
+		}
+		info.WeekLabel = fiscal.label(we)
+		out = append(out, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"now":         now.Format(time.RFC3339),
+		"timezone":    loc.String(),
+		"week_ending": current,
+		"weeks":       out,
+	})
+}
+
+// weekGridDates maps the working days of a W/E's daily grid to their dates: the W/E day itself and
+// the days after it up to the next W/E, leaving out Saturday and Sunday.
+func weekGridDates(weekEnding string) map[string]string {
+	we, _ := time.Parse("2006-01-02", weekEnding)
+	dates := map[string]string{}
+	for i := 0; i < 7; i++ {
+		d := we.AddDate(0, 0, i)
+		if wd := d.Weekday(); wd != time.Saturday && wd != time.Sunday {
+			dates[wd.String()] = d.Format("2006-01-02")
+		}
+	}
+	return dates
+}
+
+// enteringWeek is the W/E new values belong to at now: this week's, or next week's once this
+// week's close has passed.
+func enteringWeek(loc *time.Location, weekday time.Weekday, now time.Time) string {
+	current := currentWeekEnding(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), weekday)
+	if weekState(current, loc, now) != "open" {
+		t, _ := time.Parse("2006-01-02", current)
+		current = t.AddDate(0, 0, 7).Format("2006-01-02")
+	}
+	return current
+}
+
+func loadWeekInfo(userID int, weekEnding string, loc *time.Location, now time.Time) (weekInfo, error) {
+	closes, err := weekCloseIn(weekEnding, loc)
+	if err != nil {
+		return weekInfo{}, err
+	}
+	info := weekInfo{
+		WeekEnding: weekEnding,
+		ClosesAt:   closes.Format(time.RFC3339),
+		Deadline:   closes.Add(24 * time.Hour).Format(time.RFC3339),
+		State:      weekState(weekEnding, loc, now),
+		Stats:      []weekStatStatus{},
+	}
+	var completed int
+	DB.QueryRow(`SELECT COUNT(*) FROM week_completions WHERE user_id = ? AND week_ending = ?`, userID, weekEnding).Scan(&completed)
+	info.Completed = completed > 0
+
+	rows, err := DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.type, s.value_type,
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1),
+		       (SELECT submitted_at FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? ORDER BY id DESC LIMIT 1)
+		FROM stats s
+		WHERE s.is_calculated = 0 AND s.archived_at IS NULL AND s.deleted_at IS NULL
+		  AND (s.assigned_user_id = ? OR s.id IN (SELECT stat_id FROM stat_user_assignments WHERE user_id = ?))
+		ORDER BY s.short_id
+	`, weekEnding, weekEnding, userID, userID)
+	if err != nil {
+		return info, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s weekStatStatus
+		var valueType string
+		var value sql.NullInt64
+		var submitted sql.NullString
+		if err := rows.Scan(&s.StatID, &s.ShortID, &s.FullName, &s.Type, &valueType, &value, &submitted); err != nil {
+			return info, err
+		}
+		if value.Valid {
+			v := formatStatValue(value.Int64, valueType, statCurrency(s.StatID))
+			s.Value = &v
+			s.Submitted = true
+			info.Submitted++
+		}
+		if submitted.Valid {
+			if at, err := time.Parse(time.RFC3339, submitted.String); err == nil {
+				s.SubmittedAt = at.In(loc).Format(time.RFC3339)
+			}
+		}
+		info.Total++
+		info.Stats = append(info.Stats, s)
+	}
+	return info, rows.Err()
+}
+
+// ---------- GET /api/company/timezone ----------
+func GetCompanyTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"timezone": companyLocation(r.Context().Value("company_id").(string)).String()})
+}
+
+// ---------- PUT /api/company/timezone ----------
+// Body: { "timezone": "America/Los_Angeles" }
+func UpdateCompanyTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Timezone == "" {
+		req.Timezone = defaultTimezone
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "Local" {
+		http.Error(w, `{"message":"timezone must be an IANA name such as Europe/London"}`, http.StatusBadRequest)
+		return
+	}
+	if _, err := DB.Exec(`UPDATE companies SET timezone = ? WHERE company_id = ?`, req.Timezone, r.Context().Value("company_id")); err != nil {
+		webFail("Failed to update timezone", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"timezone": req.Timezone})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weekly entry by spreadsheet: GET /api/export/weekly-template lists every stat the caller reports
+// for a week with its quota and an empty value column; filled in, the same file is accepted by
+// POST /api/import/weekly-csv. Only week_ending (or ?week=), short_id or stat_id, and value are read
+// back, so the other columns can be left as they are and rows can be reordered or deleted.
+
+var weeklyTemplateHeader = []string{"week_ending", "stat_id", "short_id", "full_name", "quota", "value"}
+
+// ---------- GET /api/export/weekly-template?week=YYYY-MM-DD ----------
+func WeeklyTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.Context().Value("company_id").(string)
+	userID := r.Context().Value("user_id").(int)
+	loc := companyLocation(companyID)
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = enteringWeek(loc, companyWeekEndingDay(companyID), time.Now())
+	}
+	if err := checkIfValidWE(companyID, week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	info, err := loadWeekInfo(userID, week, loc, time.Now())
+	if err != nil {
+		webFail("Failed to load week", w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stathq-week-%s.csv"`, week))
+	out := csv.NewWriter(w)
+	out.Write(weeklyTemplateHeader)
+	for _, s := range info.Stats {
+		var quota sql.NullInt64
+		var valueType string
+		if err := DB.QueryRow(`
+			SELECT s.value_type, (SELECT value FROM stat_quotas WHERE stat_id = s.id AND week_ending = ?)
+			FROM stats s WHERE s.id = ?
+		`, week, s.StatID).Scan(&valueType, &quota); err != nil {
+			continue
+		}
+		q := ""
+		if quota.Valid {
+			q = formatStatValue(quota.Int64, valueType, statCurrency(s.StatID))
+		}
+		out.Write([]string{week, strconv.Itoa(s.StatID), s.ShortID, s.FullName, q, ""})
+	}
+	out.Flush()
+}
+
+// ---------- POST /api/import/weekly-csv?week=YYYY-MM-DD&confirm=1 ----------
+// Body: the CSV, raw or as the "file" field of a multipart form. Rows with an empty value are
+// skipped; ?week= applies to rows without a week_ending column. confirm=1 accepts values flagged by
+// a confirmable rule. An optional reason column explains changes to weeks already logged. Each row
+// is written on its own, so one bad row does not stop the rest.
+func ImportWeeklyCSVHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.Context().Value("company_id").(string)
+	userID := r.Context().Value("user_id").(int)
+	q := r.URL.Query()
+	defaultWeek := q.Get("week")
+	if defaultWeek != "" {
+		if err := checkIfValidWE(companyID, defaultWeek); err != nil {
+			http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	confirm := q.Get("confirm") == "1" || q.Get("confirm") == "true"
+	locale := requestLocale(r)
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, `{"message":"multipart upload must include a file field"}`, http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	in := csv.NewReader(body)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err != nil {
+		http.Error(w, `{"message":"CSV is empty"}`, http.StatusBadRequest)
+		return
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	_, hasShort := col["short_id"]
+	_, hasID := col["stat_id"]
+	_, hasValue := col["value"]
+	_, hasWeek := col["week_ending"]
+	if !hasValue || (!hasShort && !hasID) {
+		http.Error(w, `{"message":"CSV needs a value column and a short_id or stat_id column"}`, http.StatusBadRequest)
+		return
+	}
+	if !hasWeek && defaultWeek == "" {
+		http.Error(w, `{"message":"CSV has no week_ending column; pass ?week="}`, http.StatusBadRequest)
+		return
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	type rowResult struct {
+		Line       int    `json:"line"`
+		ShortID    string `json:"short_id,omitempty"`
+		StatID     int    `json:"stat_id,omitempty"`
+		WeekEnding string `json:"week_ending,omitempty"`
+		Value      string `json:"value,omitempty"`
+		Status     string `json:"status"` // written, skipped or error
+		Version    int    `json:"version,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}
+	results := []rowResult{}
+	counts := map[string]int{"written": 0, "skipped": 0, "error": 0}
+	for line := 2; ; line++ {
+		rec, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		res := rowResult{Line: line}
+		if err != nil {
+			res.Status, res.Error = "error", err.Error()
+			results = append(results, res)
+			counts["error"]++
+			continue
+		}
+		res.ShortID = field(rec, "short_id")
+		res.WeekEnding = field(rec, "week_ending")
+		if res.WeekEnding == "" {
+			res.WeekEnding = defaultWeek
+		}
+		raw := field(rec, "value")
+		fail := func(msg string) {
+			res.Status, res.Error = "error", msg
+			results = append(results, res)
+			counts["error"]++
+		}
+		if raw == "" {
+			res.Status = "skipped"
+			results = append(results, res)
+			counts["skipped"]++
+			continue
+		}
+		if err := checkIfValidWE(companyID, res.WeekEnding); err != nil {
+			fail("week_ending must be a W/E date (YYYY-MM-DD)")
+			continue
+		}
+		statID, _ := strconv.Atoi(field(rec, "stat_id"))
+		statID, err = resolveQuickEntryStat(companyID, userID, statID, res.ShortID)
+		if err != nil {
+			fail("unknown stat")
+			continue
+		}
+		res.StatID = statID
+		if status, msg := checkStatAccess(r, statID); status != 0 {
+			fail(msg)
+			continue
+		}
+		var valueType string
+		var isCalculated bool
+		if err := DB.QueryRow(`SELECT value_type, is_calculated FROM stats WHERE id = ?`, statID).Scan(&valueType, &isCalculated); err != nil {
+			fail("unknown stat")
+			continue
+		}
+		if isCalculated {
+			fail("calculated stats cannot receive values")
+			continue
+		}
+		currency := statCurrency(statID)
+		v, err := parseStatValue(normalizeNumber(raw, locale, statInputPlaces(statID)), valueType, currency)
+		if err != nil {
+			fail("invalid value: " + err.Error())
+			continue
+		}
+		res.Value = formatStatValue(v, valueType, currency)
+		version, err := writeWeeklyValue(statID, res.WeekEnding, v, userID, confirm, field(rec, "reason"))
+		if rv, ok := err.(*ruleViolation); ok {
+			fail(rv.Error())
+			continue
+		} else if err == errStatArchived {
+			fail(err.Error())
+			continue
+		} else if err != nil {
+			fail("failed to save value")
+			continue
+		}
+		res.Status, res.Version = "written", version
+		results = append(results, res)
+		counts["written"]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"counts": counts, "rows": results})
+}
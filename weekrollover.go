@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Week rollover: once a company's week closes (14:00 on its W/E day in its timezone, see week.go) the
+// job opens the next W/E for it. Opening a week records it in company_weeks, carries each stat's
+// quota forward from the latest earlier week that has one (a quota stays in effect until a later
+// week sets a new one; quotas already set for the new week are kept), adds a week_submissions row
+// for every stat and user expected to report, and tells those users the week is open over Telegram
+// and verified email, plus a week-opened live event for dashboards.
+//
+// The job checks every STATHQ_WEEK_ROLLOVER_INTERVAL (default 5m); STATHQ_WEEK_ROLLOVER=false turns
+// it off. Opening is idempotent, so POST /api/weeks/open can be used to open a week early or again.
+
+// weekSubmissionTriggers marks the placeholder submitted when the first value for the week arrives.
+const weekSubmissionTriggers = `
+CREATE TRIGGER IF NOT EXISTS week_submissions_submitted AFTER INSERT ON weekly_stats BEGIN
+	UPDATE week_submissions SET submitted_at = COALESCE(NEW.submitted_at, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+	WHERE stat_id = NEW.stat_id AND week_ending = NEW.week_ending AND submitted_at IS NULL;
+END;
+`
+
+type companyWeek struct {
+	WeekEnding    string `json:"week_ending"`
+	WeekLabel     string `json:"week_label"`
+	OpenedAt      string `json:"opened_at"`
+	OpenedBy      *int   `json:"opened_by"`
+	QuotasCarried int    `json:"quotas_carried"`
+	Placeholders  int    `json:"placeholders"`
+	Notified      int    `json:"notified"`
+	Submitted     int    `json:"submitted"`
+}
+
+// StartWeekRolloverJob opens each company's new week as soon as the previous one closes.
+func StartWeekRolloverJob() {
+	if !envBool("STATHQ_WEEK_ROLLOVER", true) {
+		return
+	}
+	interval := envDuration("STATHQ_WEEK_ROLLOVER_INTERVAL", 5*time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			rolloverWeeks(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func rolloverWeeks(now time.Time) {
+	rows, err := DB.Query(`SELECT id, company_id FROM companies`)
+	if err != nil {
+		log.Printf("Week rollover failed: %v", err)
+		return
+	}
+	type company struct {
+		id   int
+		code string
+	}
+	var companies []company
+	for rows.Next() {
+		var c company
+		if err := rows.Scan(&c.id, &c.code); err == nil {
+			companies = append(companies, c)
+		}
+	}
+	rows.Close()
+
+	for _, c := range companies {
+		week := enteringWeek(companyLocation(c.code), weekEndingDayOf(c.id), now)
+		opened, created, err := openWeek(c.id, c.code, week, nil)
+		if err != nil {
+			log.Printf("Week rollover for company %s: %v", c.code, err)
+			continue
+		}
+		if created {
+			log.Printf("Opened W/E %s for company %s: %d quotas carried, %d submissions expected, %d users notified",
+				week, c.code, opened.QuotasCarried, opened.Placeholders, opened.Notified)
+		}
+	}
+}
+
+// openWeek opens week for a company unless it already is. created is false when it was open.
+func openWeek(companyDBID int, companyCode, week string, openedBy interface{}) (companyWeek, bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return companyWeek{}, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	res, err := tx.Exec(`INSERT OR IGNORE INTO company_weeks (company_id, week_ending, opened_at, opened_by) VALUES (?, ?, ?, ?)`,
+		companyDBID, week, now, openedBy)
+	if err != nil {
+		return companyWeek{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		cw, err := loadCompanyWeek(companyDBID, week)
+		return cw, false, err
+	}
+
+	res, err = tx.Exec(`
+		INSERT OR IGNORE INTO stat_quotas (stat_id, week_ending, value, author_user_id)
+		SELECT s.id, ?, q.value, NULL
+		FROM stats s JOIN stat_quotas q ON q.stat_id = s.id
+		WHERE s.company_id = ? AND s.deleted_at IS NULL
+		  AND q.week_ending = (SELECT MAX(week_ending) FROM stat_quotas WHERE stat_id = s.id AND week_ending < ?)
+	`, week, companyDBID, week)
+	if err != nil {
+		return companyWeek{}, false, err
+	}
+	carried, _ := res.RowsAffected()
+
+	res, err = tx.Exec(`
+		INSERT OR IGNORE INTO week_submissions (stat_id, week_ending, user_id, created_at, submitted_at)
+		SELECT s.id, ?, a.user_id, ?, (SELECT submitted_at FROM weekly_stats WHERE stat_id = s.id AND week_ending = ? LIMIT 1)
+		FROM stats s JOIN (
+			SELECT id AS stat_id, assigned_user_id AS user_id FROM stats WHERE assigned_user_id IS NOT NULL
+			UNION SELECT stat_id, user_id FROM stat_user_assignments
+		) a ON a.stat_id = s.id
+		WHERE s.company_id = ? AND s.is_calculated = 0 AND s.deleted_at IS NULL AND s.archived_at IS NULL
+	`, week, now, week, companyDBID)
+	if err != nil {
+		return companyWeek{}, false, err
+	}
+	placeholders, _ := res.RowsAffected()
+
+	if _, err := tx.Exec(`UPDATE company_weeks SET quotas_carried = ?, placeholders = ? WHERE company_id = ? AND week_ending = ?`,
+		carried, placeholders, companyDBID, week); err != nil {
+		return companyWeek{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return companyWeek{}, false, err
+	}
+	if carried > 0 {
+		if err := markCompanyAggregatesDirty(DB, companyDBID); err != nil {
+			log.Printf("Failed to mark aggregates for company %d: %v", companyDBID, err)
+		}
+	}
+
+	notified := notifyWeekOpened(companyDBID, companyCode, week)
+	if _, err := DB.Exec(`UPDATE company_weeks SET notified = ? WHERE company_id = ? AND week_ending = ?`, notified, companyDBID, week); err != nil {
+		log.Printf("Week rollover for company %s: %v", companyCode, err)
+	}
+	cw, err := loadCompanyWeek(companyDBID, week)
+	return cw, true, err
+}
+
+// notifyWeekOpened tells every user with expected submissions which stats they report for the new
+// week, and returns how many users were reached.
+func notifyWeekOpened(companyDBID int, companyCode, week string) int {
+	fiscal := companyFiscal(companyDBID)
+	events.publish(companyDBID, liveEvent{Type: eventWeekOpened, WeekEnding: week,
+		Data: map[string]string{"week_label": fiscal.label(week)}, At: time.Now().UTC().Format(time.RFC3339)})
+
+	rows, err := DB.Query(`
+		SELECT w.user_id, s.short_id FROM week_submissions w JOIN stats s ON s.id = w.stat_id
+		WHERE s.company_id = ? AND w.week_ending = ? AND w.submitted_at IS NULL
+		ORDER BY w.user_id, s.short_id
+	`, companyDBID, week)
+	if err != nil {
+		log.Printf("Week opened notifications for company %s: %v", companyCode, err)
+		return 0
+	}
+	stats := map[int][]string{}
+	for rows.Next() {
+		var userID int
+		var shortID string
+		if err := rows.Scan(&userID, &shortID); err == nil {
+			stats[userID] = append(stats[userID], shortID)
+		}
+	}
+	rows.Close()
+
+	var users []int
+	for id := range stats {
+		users = append(users, id)
+	}
+	sort.Ints(users)
+	closes, _ := weekCloseIn(week, companyLocation(companyCode))
+	notified := 0
+	for _, userID := range users {
+		msg := fmt.Sprintf("W/E %s (%s) is open. Your stats: %s. The week closes %s.",
+			week, fiscal.label(week), strings.Join(stats[userID], ", "), closes.Format("Mon 2 Jan 15:04 MST"))
+		reached := false
+		var chatID int64
+		if telegramToken() != "" && DB.QueryRow(`SELECT chat_id FROM telegram_links WHERE user_id = ?`, userID).Scan(&chatID) == nil {
+			if err := telegramSend(chatID, msg); err != nil {
+				log.Printf("Week opened message to user %d failed: %v", userID, err)
+			} else {
+				reached = true
+			}
+		}
+		if addr, ok := verifiedEmail(userID); ok {
+			if err := sendMail(addr, fmt.Sprintf("StatHQ: W/E %s is open", week), msg); err != nil {
+				log.Printf("Week opened mail to user %d failed: %v", userID, err)
+			} else {
+				reached = true
+			}
+		}
+		if reached {
+			notified++
+		}
+	}
+	return notified
+}
+
+func loadCompanyWeek(companyDBID int, week string) (companyWeek, error) {
+	cw := companyWeek{WeekEnding: week, WeekLabel: companyFiscal(companyDBID).label(week)}
+	var openedBy sql.NullInt64
+	err := DB.QueryRow(`
+		SELECT opened_at, opened_by, quotas_carried, placeholders, notified,
+		       (SELECT COUNT(*) FROM week_submissions w JOIN stats s ON s.id = w.stat_id
+		        WHERE s.company_id = c.company_id AND w.week_ending = c.week_ending AND w.submitted_at IS NOT NULL)
+		FROM company_weeks c WHERE c.company_id = ? AND c.week_ending = ?
+	`, companyDBID, week).Scan(&cw.OpenedAt, &openedBy, &cw.QuotasCarried, &cw.Placeholders, &cw.Notified, &cw.Submitted)
+	if openedBy.Valid {
+		id := int(openedBy.Int64)
+		cw.OpenedBy = &id
+	}
+	return cw, err
+}
+
+// ---------- GET /api/weeks?limit=12 ----------
+// The weeks opened for the company, newest first, with how many expected submissions are in.
+func ListCompanyWeeksHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 12
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 520 {
+			http.Error(w, `{"message":"limit must be between 1 and 520"}`, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	companyDBID, err := companyDBID(r.Context().Value("company_id").(string))
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	rows, err := DB.Query(`SELECT week_ending FROM company_weeks WHERE company_id = ? ORDER BY week_ending DESC LIMIT ?`, companyDBID, limit)
+	if err != nil {
+		webFail("Failed to query weeks", w, err)
+		return
+	}
+	var weeks []string
+	for rows.Next() {
+		var we string
+		if err := rows.Scan(&we); err == nil {
+			weeks = append(weeks, we)
+		}
+	}
+	rows.Close()
+
+	out := []companyWeek{}
+	for _, we := range weeks {
+		cw, err := loadCompanyWeek(companyDBID, we)
+		if err != nil {
+			webFail("Failed to load week", w, err)
+			return
+		}
+		out = append(out, cw)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"weeks": out})
+}
+
+// ---------- POST /api/weeks/open?week=YYYY-MM-DD ----------
+// Opens a week now instead of waiting for the job; week defaults to the one being entered.
+// An already open week is returned unchanged with "created": false.
+func OpenWeekHandler(w http.ResponseWriter, r *http.Request) {
+	companyCode := r.Context().Value("company_id").(string)
+	week := r.URL.Query().Get("week")
+	if week == "" {
+		week = enteringWeek(companyLocation(companyCode), companyWeekEndingDay(companyCode), time.Now())
+	}
+	if err := checkIfValidWE(companyCode, week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(companyCode)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	cw, created, err := openWeek(companyDBID, companyCode, week, r.Context().Value("user_id"))
+	if err != nil {
+		webFail("Failed to open week", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"created": created, "week": cw})
+}
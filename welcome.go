@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Welcome emails: an admin can create a user with an email address instead of a password
+// (POST /users with "email" and no "password"). The user gets a random password nobody knows and
+// a mailed link to /welcome where they choose their own; opening it also verifies the address
+// (users.email_verified_at). POST /api/users/{id}/welcome sends a fresh link, e.g. when the first
+// one expired. Links last STATHQ_WELCOME_TTL (168h) and work once.
+
+type welcomeView struct {
+	Username string
+	Company  string
+	Errors   []string
+	Done     bool
+}
+
+var welcomePage = template.Must(template.New("welcome").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Welcome to StatHQ</title>
+<style>body{font-family:sans-serif;max-width:28em;margin:2em auto;padding:0 1em}input,button{font-size:1.2em;width:100%;box-sizing:border-box;margin:.3em 0;padding:.4em}.err{color:#b00}</style>
+</head><body>
+<h1>Welcome to StatHQ</h1>
+{{if .Done}}<p>Your password is set. <a href="/login">Log in</a> to {{.Company}} as <strong>{{.Username}}</strong>.</p>
+{{else}}<p>Choose a password for <strong>{{.Username}}</strong> at {{.Company}}.</p>
+{{range .Errors}}<p class="err">Password {{.}}.</p>{{end}}
+<form method="post">
+<input type="password" name="password" autocomplete="new-password" autofocus required placeholder="Password">
+<input type="password" name="confirm" autocomplete="new-password" required placeholder="Repeat password">
+<button type="submit">Set password</button>
+</form>{{end}}
+</body></html>`))
+
+// createInvitedUser adds a user who will pick their own password from the welcome email.
+func createInvitedUser(companyCode, username, email, role string) (int, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	if err := RegisterUser(companyCode, username, hex.EncodeToString(buf), role); err != nil {
+		return 0, err
+	}
+	var userID int
+	err := DB.QueryRow(`
+		UPDATE users SET email = ? WHERE lower(username) = ? AND company_id = (SELECT id FROM companies WHERE company_id = ?)
+		RETURNING id
+	`, email, strings.ToLower(strings.TrimSpace(username)), companyCode).Scan(&userID)
+	return userID, err
+}
+
+// sendWelcomeEmail replaces any outstanding welcome link for the user and mails a new one.
+func sendWelcomeEmail(r *http.Request, userID int, email string) error {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	var username, company string
+	if err := DB.QueryRow(`SELECT u.username, c.name FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ?`, userID).Scan(&username, &company); err != nil {
+		return err
+	}
+	ttl := envDuration("STATHQ_WELCOME_TTL", 168*time.Hour)
+	now := time.Now().UTC()
+	if _, err := DB.Exec(`DELETE FROM welcome_tokens WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := DB.Exec(`INSERT INTO welcome_tokens (token_hash, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hash, userID, email, now.Format(time.RFC3339), now.Add(ttl).Format(time.RFC3339)); err != nil {
+		return err
+	}
+	body := fmt.Sprintf("You have been added to %s on StatHQ as %s.\n\nChoose your password here:\n\n%s\n\nThe link expires in %d hours.\n",
+		company, username, shardLink(publicURL(r)+"/welcome?token="+token), int(ttl.Hours()))
+	return sendMail(email, "Welcome to StatHQ", body)
+}
+
+// welcomeLookup resolves a welcome token. ok is false for unknown, used or expired links.
+func welcomeLookup(token string) (userID int, email string, view welcomeView, ok bool) {
+	var expires string
+	err := DB.QueryRow(`
+		SELECT t.user_id, t.email, t.expires_at, u.username, c.name
+		FROM welcome_tokens t JOIN users u ON u.id = t.user_id JOIN companies c ON c.id = u.company_id
+		WHERE t.token_hash = ?
+	`, hashSecretToken(token)).Scan(&userID, &email, &expires, &view.Username, &view.Company)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to look up welcome token: %v", err)
+		}
+		return 0, "", view, false
+	}
+	t, err := time.Parse(time.RFC3339, expires)
+	return userID, email, view, err == nil && time.Now().Before(t)
+}
+
+func renderWelcome(w http.ResponseWriter, status int, view welcomeView) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := welcomePage.Execute(w, view); err != nil {
+		log.Printf("Failed to render welcome page: %v", err)
+	}
+}
+
+// ---------- GET /welcome?token=... ----------
+// Public: the token is the credential.
+func WelcomePageHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, view, ok := welcomeLookup(r.URL.Query().Get("token"))
+	if !ok {
+		http.Error(w, "This link is invalid or has expired. Ask your administrator for a new one.", http.StatusNotFound)
+		return
+	}
+	renderWelcome(w, http.StatusOK, view)
+}
+
+// ---------- POST /welcome?token=... ----------
+// Form: password, confirm.
+func WelcomeSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	userID, email, view, ok := welcomeLookup(token)
+	if !ok {
+		http.Error(w, "This link is invalid or has expired. Ask your administrator for a new one.", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	password := r.FormValue("password")
+	if password != r.FormValue("confirm") {
+		view.Errors = []string{"and its repetition do not match"}
+	} else {
+		view.Errors = checkPassword(password, view.Username)
+	}
+	if len(view.Errors) > 0 {
+		renderWelcome(w, http.StatusBadRequest, view)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		webFail("Failed to hash password", w, err)
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		webFail("Failed to start transaction", w, err)
+		return
+	}
+	defer tx.Rollback()
+	// The link proves the address it was sent to, so it verifies that address.
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, email = ?, email_verified_at = ? WHERE id = ?`,
+		string(hash), email, time.Now().UTC().Format(time.RFC3339), userID); err != nil {
+		webFail("Failed to set password", w, err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM welcome_tokens WHERE user_id = ?`, userID); err != nil {
+		webFail("Failed to set password", w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		webFail("Failed to set password", w, err)
+		return
+	}
+	log.Printf("User %d set their password from the welcome email", userID)
+	view.Done = true
+	renderWelcome(w, http.StatusOK, view)
+}
+
+// ---------- POST /api/users/{id}/welcome ----------
+// Mails a new welcome link; body {"email": "..."} optionally changes the address first.
+func ResendWelcomeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	var userID int
+	var email sql.NullString
+	err := DB.QueryRow(`
+		SELECT u.id, u.email FROM users u JOIN companies c ON c.id = u.company_id WHERE u.id = ? AND c.company_id = ?
+	`, mux.Vars(r)["id"], r.Context().Value("company_id")).Scan(&userID, &email)
+	if err != nil {
+		http.Error(w, `{"message":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	address := strings.ToLower(strings.TrimSpace(req.Email))
+	if address == "" {
+		address = email.String
+	} else if a, err := mail.ParseAddress(address); err != nil || a.Address != address {
+		http.Error(w, `{"message":"Invalid email address"}`, http.StatusBadRequest)
+		return
+	}
+	if address == "" {
+		http.Error(w, `{"message":"The user has no email address"}`, http.StatusBadRequest)
+		return
+	}
+	if err := sendWelcomeEmail(r, userID, address); err != nil {
+		webFail("Failed to send welcome email", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Welcome email sent"})
+}
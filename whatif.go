@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What-if simulator: POST /api/whatif applies hypothetical values and quotas to a week and reports
+// how the changed stats, every calculated stat fed by them and their divisions would come out:
+// values, quota attainment and the trend against the previous week (which drives the condition
+// colours on the OIC board). Nothing is written.
+//
+// Each change selects stats by stat_id, by stat (short_id or id), or by division_id (optionally with
+// short_id to pick one stat of that division), and sets value or quota outright or scales the
+// week's current figures with percent or quota_percent:
+//
+//	{"week": "2026-10-15", "changes": [{"division_id": 2, "short_id": "GI", "percent": 15}]}
+
+type whatIfChange struct {
+	StatID       int      `json:"stat_id"`
+	Stat         string   `json:"stat"`
+	DivisionID   int      `json:"division_id"`
+	ShortID      string   `json:"short_id"`
+	Value        *string  `json:"value"`
+	Percent      *float64 `json:"percent"`
+	Quota        *string  `json:"quota"`
+	QuotaPercent *float64 `json:"quota_percent"`
+}
+
+type whatIfFigures struct {
+	Value         *string  `json:"value"`
+	Quota         *string  `json:"quota,omitempty"`
+	AttainmentPct *float64 `json:"attainment_pct,omitempty"`
+	QuotaMet      *bool    `json:"quota_met,omitempty"`
+	Trend         string   `json:"trend,omitempty"`
+}
+
+type whatIfStatResult struct {
+	StatID       int           `json:"stat_id"`
+	ShortID      string        `json:"short_id"`
+	FullName     string        `json:"full_name"`
+	Division     string        `json:"division"`
+	ValueType    string        `json:"value_type"`
+	IsCalculated bool          `json:"is_calculated"`
+	Condition    string        `json:"assigned_condition,omitempty"`
+	Before       whatIfFigures `json:"before"`
+	After        whatIfFigures `json:"after"`
+}
+
+type whatIfDivisionResult struct {
+	Division     string            `json:"division"`
+	TotalsBefore map[string]string `json:"totals_before"` // per value type (per currency code for currency stats), non-calculated stats
+	TotalsAfter  map[string]string `json:"totals_after"`
+	QuotasMet    [2]int            `json:"quotas_met"` // before, after
+	Quotas       int               `json:"quotas"`
+}
+
+type whatIfStat struct {
+	id, divisionID                    int
+	shortID, fullName, valueType, div string
+	currency                          string
+	reversed, calculated              bool
+	condition, calcOp                 string
+}
+
+// whatIfEval computes every stat's value for one set of inputs, recomputing calculated stats from
+// their terms like the recalculation worker does. Stats in a calculation cycle have no value.
+func whatIfEval(stats map[int]*whatIfStat, g *calcGraph, inputs map[int]int64) map[int]*int64 {
+	out := map[int]*int64{}
+	visiting := map[int]bool{}
+	var eval func(id int) *int64
+	eval = func(id int) *int64 {
+		if v, done := out[id]; done {
+			return v
+		}
+		s := stats[id]
+		if s == nil {
+			return nil
+		}
+		if !s.calculated {
+			if v, ok := inputs[id]; ok {
+				out[id] = &v
+			} else {
+				out[id] = nil
+			}
+			return out[id]
+		}
+		if visiting[id] {
+			return nil
+		}
+		visiting[id] = true
+		var terms []calcTerm
+		var values []*int64
+		for _, e := range g.terms[id] {
+			terms = append(terms, calcTerm{StatID: e.From, Sign: e.Sign, Divisor: e.Divisor})
+			values = append(values, eval(e.From))
+		}
+		visiting[id] = false
+		if v, ok := evalCalc(s.calcOp, terms, values, s.valueType, s.currency); ok {
+			out[id] = &v
+		} else {
+			out[id] = nil
+		}
+		return out[id]
+	}
+	for id := range stats {
+		eval(id)
+	}
+	return out
+}
+
+func whatIfScale(v int64, pct float64) int64 {
+	return int64(math.Round(float64(v) * (1 + pct/100)))
+}
+
+// ---------- POST /api/whatif ----------
+func WhatIfHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Week    string         `json:"week"`
+		Changes []whatIfChange `json:"changes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, `{"message":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Changes) == 0 {
+		http.Error(w, `{"message":"changes is required"}`, http.StatusBadRequest)
+		return
+	}
+	companyID := r.Context().Value("company_id").(string)
+	userID, _ := r.Context().Value("user_id").(int)
+	if req.Week == "" {
+		req.Week = currentWeekEnding(time.Now(), requestWeekEndingDay(r))
+	}
+	if err := checkIfValidWE(companyID, req.Week); err != nil {
+		http.Error(w, `{"message":"week must be a W/E date (YYYY-MM-DD)"}`, http.StatusBadRequest)
+		return
+	}
+	companyDBID, err := companyDBID(companyID)
+	if err != nil {
+		webFail("Failed to resolve company", w, err)
+		return
+	}
+	we, _ := time.Parse("2006-01-02", req.Week)
+	prevWeek := we.AddDate(0, 0, -7).Format("2006-01-02")
+
+	stats := map[int]*whatIfStat{}
+	cur, prev, quotas := map[int]int64{}, map[int]int64{}, map[int]int64{}
+	rows, err := DB.Query(`
+		SELECT s.id, s.short_id, s.full_name, s.value_type, COALESCE(s.currency, cs.default_currency, ?), s.reversed, s.is_calculated, s.calc_operator,
+		       COALESCE(s.assigned_division_id, 0), COALESCE(d.name, 'Unassigned'), COALESCE(c.condition, ''),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ?),
+		       (SELECT value FROM weekly_stats WHERE stat_id = s.id AND week_ending = ?),
+		       (SELECT value FROM stat_quotas WHERE stat_id = s.id AND week_ending = ?)
+		FROM stats s
+		LEFT JOIN divisions d ON d.id = s.assigned_division_id
+		LEFT JOIN stat_conditions c ON c.stat_id = s.id AND c.week_ending = ?
+		LEFT JOIN company_settings cs ON cs.company_id = s.company_id
+		WHERE s.company_id = ?
+	`, defaultCurrency, req.Week, prevWeek, req.Week, req.Week, companyDBID)
+	if err != nil {
+		webFail("Failed to load stats", w, err)
+		return
+	}
+	for rows.Next() {
+		s := &whatIfStat{}
+		var c, p, q sql.NullInt64
+		if err := rows.Scan(&s.id, &s.shortID, &s.fullName, &s.valueType, &s.currency, &s.reversed, &s.calculated, &s.calcOp,
+			&s.divisionID, &s.div, &s.condition, &c, &p, &q); err != nil {
+			rows.Close()
+			webFail("Failed to scan stat", w, err)
+			return
+		}
+		stats[s.id] = s
+		if c.Valid {
+			cur[s.id] = c.Int64
+		}
+		if p.Valid {
+			prev[s.id] = p.Int64
+		}
+		if q.Valid {
+			quotas[s.id] = q.Int64
+		}
+	}
+	rows.Close()
+	g, err := loadCalcGraph(DB, companyDBID)
+	if err != nil {
+		webFail("Failed to load calculations", w, err)
+		return
+	}
+
+	base := whatIfEval(stats, g, cur)
+	inputs, newQuotas := map[int]int64{}, map[int]int64{}
+	for id, v := range cur {
+		inputs[id] = v
+	}
+	for id, v := range quotas {
+		newQuotas[id] = v
+	}
+	changed := map[int]bool{}
+	locale := requestLocale(r)
+	for i, ch := range req.Changes {
+		bad := func(msg string) {
+			http.Error(w, fmt.Sprintf(`{"message":"changes[%d]: %s"}`, i, msg), http.StatusBadRequest)
+		}
+		var targets []int
+		switch {
+		case ch.DivisionID != 0:
+			for id, s := range stats {
+				if s.divisionID == ch.DivisionID && (ch.ShortID == "" || strings.EqualFold(s.shortID, ch.ShortID)) {
+					targets = append(targets, id)
+				}
+			}
+			if len(targets) == 0 {
+				bad("no stats in that division match")
+				return
+			}
+			if ch.Value != nil || ch.Quota != nil {
+				bad("a division selects several stats; use percent or quota_percent")
+				return
+			}
+		default:
+			shortID := ch.Stat
+			if shortID == "" {
+				shortID = ch.ShortID
+			}
+			id, err := resolveQuickEntryStat(companyID, userID, ch.StatID, shortID)
+			if err != nil || stats[id] == nil {
+				bad("unknown stat")
+				return
+			}
+			targets = []int{id}
+		}
+		sort.Ints(targets)
+		for _, id := range targets {
+			s := stats[id]
+			if ch.Value != nil || ch.Percent != nil {
+				if s.calculated {
+					if ch.DivisionID != 0 {
+						continue // calculated stats follow from their inputs
+					}
+					bad(s.shortID + " is calculated; change the stats it is calculated from")
+					return
+				}
+				if ch.Value != nil {
+					v, err := parseStatValue(normalizeNumber(*ch.Value, locale, statInputPlaces(s.id)), s.valueType, s.currency)
+					if err != nil {
+						bad("invalid value: " + err.Error())
+						return
+					}
+					inputs[id] = v
+				} else if v, ok := inputs[id]; ok {
+					inputs[id] = whatIfScale(v, *ch.Percent)
+				}
+				changed[id] = true
+			}
+			if ch.Quota != nil {
+				q, err := parseStatValue(normalizeNumber(*ch.Quota, locale, statInputPlaces(s.id)), s.valueType, s.currency)
+				if err != nil {
+					bad("invalid quota: " + err.Error())
+					return
+				}
+				newQuotas[id] = q
+				changed[id] = true
+			} else if ch.QuotaPercent != nil {
+				if q, ok := newQuotas[id]; ok {
+					newQuotas[id] = whatIfScale(q, *ch.QuotaPercent)
+					changed[id] = true
+				}
+			}
+		}
+	}
+	after := whatIfEval(stats, g, inputs)
+	prevVals := whatIfEval(stats, g, prev)
+
+	// Report the changed stats and everything calculated from them.
+	affected := map[int]bool{}
+	for id := range changed {
+		down, _ := g.walk(id, func(n int) []depEdge { return g.users[n] }, func(e depEdge) int { return e.To })
+		for n := range down {
+			affected[n] = true
+		}
+	}
+	figures := func(s *whatIfStat, v *int64, quota int64, hasQuota bool) whatIfFigures {
+		var f whatIfFigures
+		if v != nil {
+			str := formatStatValue(*v, s.valueType, s.currency)
+			f.Value = &str
+			if p := prevVals[s.id]; p != nil {
+				f.Trend = weekTrend(*v, *p, s.reversed)
+			}
+		}
+		if hasQuota {
+			q := formatStatValue(quota, s.valueType, s.currency)
+			f.Quota = &q
+			if v != nil {
+				met := quotaMet(*v, quota, s.reversed)
+				f.QuotaMet = &met
+				if quota != 0 {
+					pct := math.Round(float64(*v)/float64(quota)*10000) / 100
+					f.AttainmentPct = &pct
+				}
+			}
+		}
+		return f
+	}
+	results := []whatIfStatResult{}
+	divisions := map[string]*whatIfDivisionResult{}
+	touchedDivs := map[string]bool{}
+	for id := range affected {
+		touchedDivs[stats[id].div] = true
+	}
+	for id, s := range stats {
+		bq, hasBQ := quotas[id]
+		aq, hasAQ := newQuotas[id]
+		if affected[id] {
+			results = append(results, whatIfStatResult{
+				StatID: id, ShortID: s.shortID, FullName: s.fullName, Division: s.div, ValueType: s.valueType,
+				IsCalculated: s.calculated, Condition: s.condition,
+				Before: figures(s, base[id], bq, hasBQ), After: figures(s, after[id], aq, hasAQ),
+			})
+		}
+		if !touchedDivs[s.div] {
+			continue
+		}
+		d := divisions[s.div]
+		if d == nil {
+			d = &whatIfDivisionResult{Division: s.div, TotalsBefore: map[string]string{}, TotalsAfter: map[string]string{}}
+			divisions[s.div] = d
+		}
+		if hasBQ || hasAQ {
+			d.Quotas++
+		}
+		if b := base[id]; b != nil && hasBQ && quotaMet(*b, bq, s.reversed) {
+			d.QuotasMet[0]++
+		}
+		if a := after[id]; a != nil && hasAQ && quotaMet(*a, aq, s.reversed) {
+			d.QuotasMet[1]++
+		}
+	}
+	for _, d := range divisions {
+		type totalKey struct{ valueType, currency string }
+		before, afterTotals := map[totalKey]int64{}, map[totalKey]int64{}
+		for id, s := range stats {
+			if s.div != d.Division || s.calculated {
+				continue
+			}
+			k := totalKey{valueType: s.valueType}
+			if s.valueType == "currency" {
+				k.currency = s.currency
+			}
+			if v := base[id]; v != nil {
+				before[k] += *v
+			}
+			if v := after[id]; v != nil {
+				afterTotals[k] += *v
+			}
+		}
+		label := func(k totalKey) string {
+			if k.currency != "" {
+				return k.currency
+			}
+			return k.valueType
+		}
+		for k, v := range before {
+			d.TotalsBefore[label(k)] = formatStatValue(v, k.valueType, k.currency)
+		}
+		for k, v := range afterTotals {
+			d.TotalsAfter[label(k)] = formatStatValue(v, k.valueType, k.currency)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Division != results[j].Division {
+			return results[i].Division < results[j].Division
+		}
+		return results[i].ShortID < results[j].ShortID
+	})
+	divOut := []*whatIfDivisionResult{}
+	for _, d := range divisions {
+		divOut = append(divOut, d)
+	}
+	sort.Slice(divOut, func(i, j int) bool { return divOut[i].Division < divOut[j].Division })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week":      req.Week,
+		"persisted": false,
+		"changed":   len(changed),
+		"stats":     results,
+		"divisions": divOut,
+	})
+}